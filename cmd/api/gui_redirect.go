@@ -43,7 +43,7 @@ func (g *guiRedirecter) tryRedirectToGUI(w http.ResponseWriter, r *http.Request)
 
 	// do we have this account/repo?
 	accountName := models.AccountName(vars["account"])
-	account, err := keppel.FindAccount(g.db, accountName)
+	account, err := keppel.FindAccount(r.Context(), g.db, accountName)
 	if err != nil || account == nil {
 		respondNotFound(w, r)
 		return
@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/dlmiddlecote/sqlstats"
+	"github.com/gofrs/uuid/v5"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/redis/go-redis/v9"
@@ -55,6 +56,13 @@ func run(cmd *cobra.Command, args []string) {
 	dbConn := must.Return(easypg.Connect(dbURL, keppel.DBConfiguration()))
 	prometheus.MustRegister(sqlstats.NewStatsCollector(dbName, dbConn))
 	db := keppel.InitORM(dbConn)
+	cfg.DBConnectionPool.ApplyTo(dbConn)
+	if replicaURL, ok := keppel.GetReadReplicaDatabaseURLFromEnvironment(); ok {
+		replicaConn := must.Return(keppel.ConnectToReadReplica(replicaURL))
+		prometheus.MustRegister(sqlstats.NewStatsCollector(dbName+"_replica", replicaConn))
+		db = db.WithReadReplica(replicaConn)
+		cfg.DBConnectionPool.ApplyTo(replicaConn)
+	}
 	must.Succeed(setupDBIfRequested(db))
 
 	rc := must.Return(initRedis())
@@ -83,7 +91,7 @@ func run(cmd *cobra.Command, args []string) {
 		keppelv1.NewAPI(cfg, ad, fd, sd, icd, db, auditor, rle),
 		auth.NewAPI(cfg, ad, fd, db),
 		registryv2.NewAPI(cfg, ad, fd, sd, icd, db, auditor, rle),
-		peerv1.NewAPI(cfg, ad, db),
+		peerv1.NewAPI(cfg, ad, db, auditor),
 		&headerReflector{enableHeaderReflector}, // the header reflection endpoint is only enabled where debugging is enabled (i.e. usually in dev/QA only)
 		httpapi.HealthCheckAPI{
 			SkipRequestLog: true,
@@ -92,6 +100,7 @@ func run(cmd *cobra.Command, args []string) {
 			},
 		},
 		httpapi.WithGlobalMiddleware(reportClientIP),
+		httpapi.WithGlobalMiddleware(assignRequestID),
 		httpapi.WithGlobalMiddleware(corsMiddleware.Handler),
 		pprofapi.API{IsAuthorized: pprofapi.IsRequestFromLocalhost},
 		// This needs to be at the end because it is the fallback match for all
@@ -169,3 +178,23 @@ func reportClientIP(inner http.Handler) http.Handler {
 		inner.ServeHTTP(w, r)
 	})
 }
+
+func assignRequestID(inner http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// This middleware attaches a request ID to the request context, so that it
+		// appears in structured log lines pertaining to this request. The request ID
+		// is taken from the X-Request-Id header if a reverse proxy has set one.
+		requestID := r.Header.Get("X-Request-Id")
+		if requestID == "" {
+			uuidV4, err := uuid.NewV4()
+			if err != nil {
+				http.Error(w, "could not generate request ID: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			requestID = uuidV4.String()
+		}
+		w.Header().Set("X-Request-Id", requestID)
+		ctx := keppel.WithLogFields(r.Context(), keppel.LogFields{RequestID: requestID})
+		inner.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -6,9 +6,7 @@ package apicmd
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
 	"errors"
-	"strings"
 	"time"
 
 	"github.com/sapcc/go-bits/logg"
@@ -21,11 +19,6 @@ import (
 	"github.com/sapcc/keppel/internal/tasks"
 )
 
-type peeringConfig []struct {
-	Hostname             string `json:"hostname"`
-	UseForPullDelegation *bool  `json:"use_for_pull_delegation"`
-}
-
 var createOrUpdatePeerQuery = sqlext.SimplifyWhitespace(`
 	INSERT INTO peers (hostname, use_for_pull_delegation) VALUES ($1, $2)
 		ON CONFLICT (hostname) DO UPDATE SET use_for_pull_delegation = EXCLUDED.use_for_pull_delegation
@@ -34,10 +27,7 @@ var createOrUpdatePeerQuery = sqlext.SimplifyWhitespace(`
 func runPeering(ctx context.Context, cfg keppel.Configuration, db *keppel.DB) {
 	isPeerHostName := make(map[string]bool)
 
-	var peeringCfg peeringConfig
-	decoder := json.NewDecoder(strings.NewReader(osext.GetenvOrDefault("KEPPEL_PEERS", "[]")))
-	decoder.DisallowUnknownFields()
-	must.Succeed(decoder.Decode(&peeringCfg))
+	peeringCfg := must.Return(keppel.ParsePeersConfiguration(osext.GetenvOrDefault("KEPPEL_PEERS", "[]")))
 
 	// add missing entries to `peers` table
 	for _, peer := range peeringCfg {
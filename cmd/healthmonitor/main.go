@@ -80,11 +80,12 @@ func run(cmd *cobra.Command, args []string) {
 		AuthDriver:  ad,
 		AccountName: models.AccountName(args[0]),
 		RepoClient: &client.RepoClient{
-			Scheme:   ad.ServerScheme(),
-			Host:     ad.ServerHost(),
-			RepoName: args[0] + "/healthcheck",
-			UserName: apiUser,
-			Password: apiPassword,
+			Scheme:      ad.ServerScheme(),
+			Host:        ad.ServerHost(),
+			RepoName:    args[0] + "/healthcheck",
+			UserName:    apiUser,
+			Password:    apiPassword,
+			RetryPolicy: client.DefaultRetryPolicy,
 		},
 		LastResultLock: &sync.RWMutex{},
 	}
@@ -140,7 +141,7 @@ func (j *healthMonitorJob) PrepareKeppelAccount(ctx context.Context) error {
 	}
 	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := j.AuthDriver.SendHTTPRequest(req)
+	resp, err := client.SendHTTPRequestWithRetry(j.AuthDriver, client.DefaultRetryPolicy, req)
 	if err != nil {
 		return err
 	}
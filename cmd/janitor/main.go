@@ -5,6 +5,7 @@ package janitorcmd
 
 import (
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/dlmiddlecote/sqlstats"
@@ -15,6 +16,7 @@ import (
 	"github.com/sapcc/go-bits/httpapi/pprofapi"
 	"github.com/sapcc/go-bits/httpext"
 	"github.com/sapcc/go-bits/jobloop"
+	"github.com/sapcc/go-bits/logg"
 	"github.com/sapcc/go-bits/must"
 	"github.com/sapcc/go-bits/osext"
 	"github.com/spf13/cobra"
@@ -23,6 +25,8 @@ import (
 	"github.com/sapcc/keppel/internal/tasks"
 )
 
+var jobSelectionStr string
+
 // AddCommandTo mounts this command into the command hierarchy.
 func AddCommandTo(parent *cobra.Command) {
 	cmd := &cobra.Command{
@@ -32,11 +36,16 @@ func AddCommandTo(parent *cobra.Command) {
 		Args:  cobra.NoArgs,
 		Run:   run,
 	}
+	cmd.Flags().StringVar(&jobSelectionStr, "jobs", "", "Comma-separated list of janitor jobs to run in this process (default: all jobs). Known jobs are: "+strings.Join(tasks.JobNames, ", ")+".")
 	parent.AddCommand(cmd)
 }
 
 func run(cmd *cobra.Command, args []string) {
 	keppel.SetTaskName("janitor")
+	jobs, err := tasks.ParseJobSelection(jobSelectionStr)
+	if err != nil {
+		logg.Fatal("cannot parse --jobs: %s", err.Error())
+	}
 
 	cfg := keppel.ParseConfiguration()
 	ctx := httpext.ContextWithSIGINT(cmd.Context(), 10*time.Second)
@@ -46,6 +55,7 @@ func run(cmd *cobra.Command, args []string) {
 	dbConn := must.Return(easypg.Connect(dbURL, keppel.DBConfiguration()))
 	prometheus.MustRegister(sqlstats.NewStatsCollector(dbName, dbConn))
 	db := keppel.InitORM(dbConn)
+	cfg.DBConnectionPool.ApplyTo(dbConn)
 
 	ad := must.Return(keppel.NewAuthDriver(ctx, osext.MustGetenv("KEPPEL_DRIVER_AUTH"), nil))
 	amd := must.Return(keppel.NewAccountManagementDriver(osext.MustGetenv("KEPPEL_DRIVER_ACCOUNT_MANAGEMENT")))
@@ -55,19 +65,34 @@ func run(cmd *cobra.Command, args []string) {
 
 	// start task loops
 	janitor := tasks.NewJanitor(cfg, fd, sd, icd, db, amd, auditor)
-	go janitor.AccountFederationAnnouncementJob(nil).Run(ctx)
-	go janitor.AbandonedUploadCleanupJob(nil).Run(ctx)
-	go janitor.DeleteAccountsJob(nil).Run(ctx)
-	go janitor.EnforceManagedAccountsJob(nil).Run(ctx)
-	go janitor.ManifestGarbageCollectionJob(nil).Run(ctx)
-	go janitor.BlobMountSweepJob(nil).Run(ctx)
-	go janitor.BlobSweepJob(nil).Run(ctx)
-	go janitor.StorageSweepJob(nil).Run(ctx)
-	go janitor.ManifestSyncJob(nil).Run(ctx)
-	go janitor.BlobValidationJob(nil).Run(ctx)
-	go janitor.ManifestValidationJob(nil).Run(ctx)
+	must.Succeed(janitor.SetJitterFraction(cfg.JanitorJitterFraction))
+	startJob := func(name string, job jobloop.Job, opts ...jobloop.Option) {
+		if jobs.Contains(name) {
+			go job.Run(ctx, opts...)
+		}
+	}
+	startJob("account-federation-announcement", janitor.AccountFederationAnnouncementJob(nil))
+	startJob("federation-archive-sweep", janitor.FederationArchiveSweepJob(nil))
+	if cfg.TrackIssuedTokens {
+		startJob("issued-token-sweep", janitor.IssuedTokenSweepJob(nil))
+	}
+	startJob("abandoned-upload-cleanup", janitor.AbandonedUploadCleanupJob(nil))
+	startJob("abandoned-account-creation-cleanup", janitor.AbandonedAccountCreationCleanupJob(nil))
+	startJob("account-deletion", janitor.DeleteAccountsJob(nil), jobloop.NumGoroutines(3))
+	startJob("managed-account-enforcement", janitor.EnforceManagedAccountsJob(nil))
+	startJob("gc", janitor.ManifestGarbageCollectionJob(nil))
+	startJob("manifest-trash-purge", janitor.ManifestTrashPurgeJob(nil))
+	startJob("blob-mount-sweep", janitor.BlobMountSweepJob(nil))
+	startJob("blob-sweep", janitor.BlobSweepJob(nil))
+	startJob("storage-sweep", janitor.StorageSweepJob(nil))
+	startJob("storage-capacity-check", janitor.StorageCapacityCheckJob(nil))
+	startJob("manifest-sync", janitor.ManifestSyncJob(nil))
+	startJob("blob-validation", janitor.BlobValidationJob(nil))
+	startJob("blob-media-type-backfill", janitor.BlobMediaTypeBackfillJob(nil))
+	startJob("manifest-validation", janitor.ManifestValidationJob(nil))
+	startJob("integrity-report", janitor.IntegrityReportJob(nil))
 	if cfg.Trivy != nil {
-		go janitor.CheckTrivySecurityStatusJob(nil).Run(ctx, jobloop.NumGoroutines(3))
+		startJob("trivy-security-status", janitor.CheckTrivySecurityStatusJob(nil), jobloop.NumGoroutines(3))
 	}
 
 	// start HTTP server for Prometheus metrics and health check
@@ -6,11 +6,15 @@ package trivyproxycmd
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"os/exec"
+	"regexp"
 	"slices"
+	"strconv"
 	"strings"
 	"time"
 
@@ -18,15 +22,29 @@ import (
 	"github.com/sapcc/keppel/internal/trivy"
 
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sapcc/go-bits/httpapi"
 	"github.com/sapcc/go-bits/httpapi/pprofapi"
 	"github.com/sapcc/go-bits/httpext"
+	"github.com/sapcc/go-bits/logg"
 	"github.com/sapcc/go-bits/must"
 	"github.com/sapcc/go-bits/osext"
+	"github.com/sapcc/go-bits/respondwith"
 	"github.com/spf13/cobra"
 )
 
+var inflightScansGauge = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "keppel_trivy_proxy_inflight_scans",
+		Help: "Number of trivy scans that are currently being executed by the trivy proxy.",
+	},
+)
+
+// If all scan slots are occupied, requests wait for at most this long (or
+// until the request context expires) before being rejected with 503.
+const scanQueueTimeout = 1 * time.Minute
+
 func AddCommandTo(parent *cobra.Command) {
 	cmd := &cobra.Command{
 		Use:     "trivy-proxy",
@@ -49,8 +67,22 @@ func run(cmd *cobra.Command, args []string) {
 	dbMirrorPrefix := osext.MustGetenv("KEPPEL_TRIVY_DB_MIRROR_PREFIX")
 	trivyURL := osext.MustGetenv("KEPPEL_TRIVY_URL")
 
+	maxConcurrentStr := osext.GetenvOrDefault("KEPPEL_TRIVY_MAX_CONCURRENT", "4")
+	maxConcurrent, err := strconv.Atoi(maxConcurrentStr)
+	if err != nil || maxConcurrent <= 0 {
+		logg.Fatal("invalid value for KEPPEL_TRIVY_MAX_CONCURRENT: %q", maxConcurrentStr)
+	}
+
+	maxRetriesStr := osext.GetenvOrDefault("KEPPEL_TRIVY_DB_DOWNLOAD_RETRIES", "2")
+	maxRetries, err := strconv.Atoi(maxRetriesStr)
+	if err != nil || maxRetries < 0 {
+		logg.Fatal("invalid value for KEPPEL_TRIVY_DB_DOWNLOAD_RETRIES: %q", maxRetriesStr)
+	}
+
+	prometheus.MustRegister(inflightScansGauge)
+
 	handler := httpapi.Compose(
-		NewAPI(dbMirrorPrefix, token, trivyURL),
+		NewAPI(dbMirrorPrefix, token, trivyURL, maxConcurrent, maxRetries),
 		httpapi.HealthCheckAPI{SkipRequestLog: true},
 		pprofapi.API{IsAuthorized: pprofapi.IsRequestFromLocalhost},
 	)
@@ -67,14 +99,20 @@ type API struct {
 	dbMirrorPrefix string
 	token          string
 	trivyURL       string
+	// each running scan holds one slot in this channel
+	scanSlots chan struct{}
+	// how often a scan is retried when trivy fails to download its DB
+	maxRetries int
 }
 
 // NewAPI constructs a new API instance.
-func NewAPI(dbMirrorPrefix, token, trivyURL string) *API {
+func NewAPI(dbMirrorPrefix, token, trivyURL string, maxConcurrent, maxRetries int) *API {
 	return &API{
 		dbMirrorPrefix: dbMirrorPrefix,
 		token:          token,
 		trivyURL:       trivyURL,
+		scanSlots:      make(chan struct{}, maxConcurrent),
+		maxRetries:     maxRetries,
 	}
 }
 
@@ -88,58 +126,205 @@ func (a *API) proxyToTrivy(w http.ResponseWriter, r *http.Request) {
 
 	secretHeader := r.Header[http.CanonicalHeaderKey(trivy.TokenHeader)]
 	if !slices.Contains(secretHeader, a.token) {
-		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		respondWithError(w, http.StatusUnauthorized, trivy.ProxyErrorUnauthorized, "unauthorized")
 		return
 	}
 
 	query := r.URL.Query()
-	imageURL := query.Get("image")
-	if imageURL == "" {
-		http.Error(w, "image query string must be supplied and cannot be empty", http.StatusUnprocessableEntity)
+	req := scanRequest{
+		ImageURL:    query.Get("image"),
+		Format:      query.Get("format"),
+		KeppelToken: r.Header.Get(trivy.KeppelTokenHeader),
+	}
+	if req.ImageURL == "" {
+		respondWithError(w, http.StatusUnprocessableEntity, trivy.ProxyErrorInvalidRequest, "image query string must be supplied and cannot be empty")
 		return
 	}
+	if req.Format == "" {
+		req.Format = "json"
+	}
 
-	format := query.Get("format")
-	if format == "" {
-		format = "json"
+	if severityStr := query.Get("severity"); severityStr != "" {
+		for _, severity := range strings.Split(severityStr, ",") {
+			if _, exists := trivy.MapToTrivySeverity[severity]; !exists {
+				respondWithError(w, http.StatusUnprocessableEntity, trivy.ProxyErrorInvalidRequest, fmt.Sprintf("invalid severity: %q", severity))
+				return
+			}
+			req.Severities = append(req.Severities, severity)
+		}
 	}
 
-	keppelToken := r.Header.Get(trivy.KeppelTokenHeader)
+	if ignoreUnfixedStr := query.Get("ignore_unfixed"); ignoreUnfixedStr != "" {
+		var err error
+		req.IgnoreUnfixed, err = strconv.ParseBool(ignoreUnfixedStr)
+		if err != nil {
+			respondWithError(w, http.StatusUnprocessableEntity, trivy.ProxyErrorInvalidRequest, fmt.Sprintf("invalid value for ignore_unfixed: %q", ignoreUnfixedStr))
+			return
+		}
+	}
 
-	stdout, stderr, err := a.runTrivy(r.Context(), imageURL, format, keppelToken)
+	// do not fork an unbounded number of trivy processes during request bursts
+	if !a.acquireScanSlot(r.Context()) {
+		w.Header().Set("Retry-After", "10")
+		respondWithError(w, http.StatusServiceUnavailable, trivy.ProxyErrorTooManyScans, "too many concurrent scans, please retry in a few seconds")
+		return
+	}
+	defer a.releaseScanSlot()
+
+	stdout := &responseStreamer{w: w}
+	stderr, err := a.runTrivy(r.Context(), req, stdout)
 	if err != nil {
 		cleanedErr := strings.ReplaceAll(strings.TrimSpace(string(stderr)), "\n", " ")
-		http.Error(w, fmt.Sprintf("trivy: %s: %s", err, cleanedErr), http.StatusInternalServerError)
+		if stdout.started {
+			// we cannot report the error to the client anymore since the response status has already been sent
+			logg.Error("trivy failed after partially writing the report for %s: %s: %s", req.ImageURL, err.Error(), cleanedErr)
+		} else {
+			status, code := classifyTrivyFailure(r.Context(), cleanedErr)
+			respondWithError(w, status, code, fmt.Sprintf("trivy: %s: %s", err, cleanedErr))
+		}
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(stdout)
+	// if trivy did not produce any output, the response status has not been written yet
+	stdout.start()
 }
 
-func (a *API) runTrivy(ctx context.Context, imageURL, format, keppelToken string) (stdout, stderr []byte, err error) {
-	//nolint:gosec // intended behaviour
-	cmd := exec.CommandContext(ctx,
-		"trivy", "image",
+func respondWithError(w http.ResponseWriter, status int, code trivy.ProxyErrorCode, msg string) {
+	respondwith.JSON(w, status, trivy.ProxyError{Code: code, Message: msg})
+}
+
+// Matches trivy's error output when it could not download its vulnerability DB.
+var dbDownloadFailureRx = regexp.MustCompile(`(?i)(failed to download|download error).*\bdb\b|\bdb error`)
+
+// Known failure modes of trivy, as identified by its error output. The first match wins.
+var trivyFailureModes = []struct {
+	Rx     *regexp.Regexp
+	Status int
+	Code   trivy.ProxyErrorCode
+}{
+	{regexp.MustCompile(`context deadline exceeded|(?i)timeout exceeded`), http.StatusGatewayTimeout, trivy.ProxyErrorTimeout},
+	{regexp.MustCompile(`UNAUTHORIZED|DENIED|401 Unauthorized|403 Forbidden`), http.StatusForbidden, trivy.ProxyErrorImageUnauthorized},
+	{regexp.MustCompile(`MANIFEST_UNKNOWN|NAME_UNKNOWN|404 Not Found`), http.StatusNotFound, trivy.ProxyErrorImageNotFound},
+	{dbDownloadFailureRx, http.StatusBadGateway, trivy.ProxyErrorDBDownloadFailed},
+}
+
+func classifyTrivyFailure(ctx context.Context, stderr string) (status int, code trivy.ProxyErrorCode) {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout, trivy.ProxyErrorTimeout
+	}
+	for _, mode := range trivyFailureModes {
+		if mode.Rx.MatchString(stderr) {
+			return mode.Status, mode.Code
+		}
+	}
+	return http.StatusInternalServerError, trivy.ProxyErrorScanFailed
+}
+
+// responseStreamer forwards trivy's stdout into the HTTP response as it is
+// produced. The response status is only sent when the first output arrives,
+// so that failures before that point can still be reported as errors.
+type responseStreamer struct {
+	w       http.ResponseWriter
+	started bool
+}
+
+func (s *responseStreamer) start() {
+	if !s.started {
+		s.w.Header().Set("Content-Type", "application/json")
+		s.w.WriteHeader(http.StatusOK)
+		s.started = true
+	}
+}
+
+// Write implements the io.Writer interface.
+func (s *responseStreamer) Write(buf []byte) (int, error) {
+	s.start()
+	return s.w.Write(buf)
+}
+
+func (a *API) acquireScanSlot(ctx context.Context) bool {
+	ctx, cancel := context.WithTimeout(ctx, scanQueueTimeout)
+	defer cancel()
+
+	select {
+	case a.scanSlots <- struct{}{}:
+		inflightScansGauge.Inc()
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (a *API) releaseScanSlot() {
+	<-a.scanSlots
+	inflightScansGauge.Dec()
+}
+
+// scanRequest contains the parameters of a single scan requested from the trivy proxy.
+type scanRequest struct {
+	ImageURL      string
+	Format        string
+	KeppelToken   string
+	Severities    []string // if empty, all severities are reported
+	IgnoreUnfixed bool     // if true, vulnerabilities without an available fix are not reported
+}
+
+// The delay before the first retry of a scan after a DB download failure.
+// Each further retry doubles the delay.
+const dbDownloadRetryInitialDelay = 1 * time.Second
+
+func (a *API) runTrivy(ctx context.Context, req scanRequest, stdout *responseStreamer) (stderr []byte, err error) {
+	delay := dbDownloadRetryInitialDelay
+	for retry := 0; ; retry++ {
+		stderr, err = a.runTrivyOnce(ctx, req, stdout)
+
+		// we can only retry if the failed attempt did not already write into the response
+		canRetry := retry < a.maxRetries && !stdout.started
+		if err == nil || !canRetry || !dbDownloadFailureRx.Match(stderr) {
+			return stderr, err
+		}
+
+		logg.Info("retrying scan of %s in %s after DB download failure: %s", req.ImageURL, delay, err.Error())
+		select {
+		case <-ctx.Done():
+			return stderr, err
+		case <-time.After(delay):
+			delay *= 2
+		}
+	}
+}
+
+func (a *API) runTrivyOnce(ctx context.Context, req scanRequest, stdout io.Writer) (stderr []byte, err error) {
+	args := []string{
+		"image",
 		"--scanners", "vuln",
 		"--skip-db-update",
 		"--disable-telemetry",
 		// remove when https://github.com/aquasecurity/trivy/issues/3560 is resolved
-		"--java-db-repository", a.dbMirrorPrefix+"/aquasecurity/trivy-java-db",
+		"--java-db-repository", a.dbMirrorPrefix + "/aquasecurity/trivy-java-db",
 		"--server", a.trivyURL,
-		"--registry-token", keppelToken,
-		"--format", format,
+		"--registry-token", req.KeppelToken,
+		"--format", req.Format,
 		"--token", a.token,
 		"--timeout", "10m", // default is 5m
 		"--image-src", "remote", // don't try to use a container runtime which is not installed anyway
-		imageURL)
-	var stdoutBuf, stderrBuf bytes.Buffer
+	}
+	if len(req.Severities) > 0 {
+		args = append(args, "--severity", strings.Join(req.Severities, ","))
+	}
+	if req.IgnoreUnfixed {
+		args = append(args, "--ignore-unfixed")
+	}
+	args = append(args, req.ImageURL)
+
+	//nolint:gosec // intended behaviour
+	cmd := exec.CommandContext(ctx, "trivy", args...)
+	var stderrBuf bytes.Buffer
 	cmd.Cancel = func() error { return cmd.Process.Signal(os.Interrupt) }
-	cmd.Stdout = &stdoutBuf
+	cmd.Stdout = stdout
 	cmd.Stderr = &stderrBuf
 	cmd.WaitDelay = 3 * time.Second
 	err = cmd.Run()
 
-	return stdoutBuf.Bytes(), stderrBuf.Bytes(), err
+	return stderrBuf.Bytes(), err
 }
@@ -0,0 +1,218 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package trivyproxycmd_test
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/httpapi"
+	"github.com/sapcc/go-bits/must"
+
+	trivyproxycmd "github.com/sapcc/keppel/cmd/trivyproxy"
+	"github.com/sapcc/keppel/internal/trivy"
+)
+
+const testToken = "trivy-secret"
+
+// Places a fake `trivy` executable with the given shell script as its body in $PATH.
+func setupFakeTrivy(t *testing.T, script string) {
+	t.Helper()
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "trivy"), []byte("#!/bin/sh\n"+script+"\n"), 0o755)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func newTestHandler() http.Handler {
+	return httpapi.Compose(
+		trivyproxycmd.NewAPI("registry.example.org/mirror", testToken, "http://trivy.example.org", 1, 0),
+		httpapi.WithoutLogging(),
+	)
+}
+
+func TestProxySuccess(t *testing.T) {
+	setupFakeTrivy(t, `echo '{"SchemaVersion":2}'`)
+	h := newTestHandler()
+
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/trivy?image=registry.example.org/test1/foo:latest",
+		Header:       map[string]string{trivy.TokenHeader: testToken},
+		ExpectStatus: http.StatusOK,
+		ExpectHeader: map[string]string{"Content-Type": "application/json"},
+		ExpectBody:   assert.JSONObject{"SchemaVersion": 2},
+	}.Check(t, h)
+}
+
+func TestProxyErrors(t *testing.T) {
+	setupFakeTrivy(t, `echo "$TRIVY_FAKE_STDERR" >&2; exit 1`)
+	h := newTestHandler()
+
+	// requests that are rejected before trivy is run
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/trivy?image=registry.example.org/test1/foo:latest",
+		Header:       map[string]string{trivy.TokenHeader: "wrong-token"},
+		ExpectStatus: http.StatusUnauthorized,
+		ExpectBody:   assert.JSONObject{"code": "UNAUTHORIZED", "message": "unauthorized"},
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/trivy",
+		Header:       map[string]string{trivy.TokenHeader: testToken},
+		ExpectStatus: http.StatusUnprocessableEntity,
+		ExpectBody: assert.JSONObject{
+			"code":    "INVALID_REQUEST",
+			"message": "image query string must be supplied and cannot be empty",
+		},
+	}.Check(t, h)
+
+	// trivy failures are classified based on its error output
+	testCases := []struct {
+		Stderr       string
+		ExpectStatus int
+		ExpectCode   trivy.ProxyErrorCode
+	}{
+		{"GET https://registry.example.org/v2/test1/foo/manifests/latest: UNAUTHORIZED: authentication required", http.StatusForbidden, trivy.ProxyErrorImageUnauthorized},
+		{"GET https://registry.example.org/v2/test1/foo/manifests/latest: MANIFEST_UNKNOWN: manifest unknown", http.StatusNotFound, trivy.ProxyErrorImageNotFound},
+		{"init error: DB error: failed to download vulnerability DB", http.StatusBadGateway, trivy.ProxyErrorDBDownloadFailed},
+		{"scan error: context deadline exceeded", http.StatusGatewayTimeout, trivy.ProxyErrorTimeout},
+		{"panic: something unexpected", http.StatusInternalServerError, trivy.ProxyErrorScanFailed},
+	}
+	for _, tc := range testCases {
+		t.Setenv("TRIVY_FAKE_STDERR", tc.Stderr)
+		assert.HTTPRequest{
+			Method:       "GET",
+			Path:         "/trivy?image=registry.example.org/test1/foo:latest",
+			Header:       map[string]string{trivy.TokenHeader: testToken},
+			ExpectStatus: tc.ExpectStatus,
+			ExpectHeader: map[string]string{"Content-Type": "application/json"},
+			ExpectBody: assert.JSONObject{
+				"code":    string(tc.ExpectCode),
+				"message": "trivy: exit status 1: " + tc.Stderr,
+			},
+		}.Check(t, h)
+	}
+}
+
+// This fake trivy reports which of the optional flags it was called with.
+const fakeTrivyReportingFlags = `
+severity=""
+ignore_unfixed=false
+while [ $# -gt 0 ]; do
+	case "$1" in
+		--severity) severity="$2"; shift ;;
+		--ignore-unfixed) ignore_unfixed=true ;;
+	esac
+	shift
+done
+echo "{\"severity\":\"$severity\",\"ignore_unfixed\":$ignore_unfixed}"`
+
+func TestProxySeverityFilter(t *testing.T) {
+	setupFakeTrivy(t, fakeTrivyReportingFlags)
+	h := newTestHandler()
+
+	// by default, no severity filter is applied
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/trivy?image=registry.example.org/test1/foo:latest",
+		Header:       map[string]string{trivy.TokenHeader: testToken},
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   assert.JSONObject{"severity": "", "ignore_unfixed": false},
+	}.Check(t, h)
+
+	// the severity filter is passed through to trivy
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/trivy?image=registry.example.org/test1/foo:latest&severity=HIGH,CRITICAL",
+		Header:       map[string]string{trivy.TokenHeader: testToken},
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   assert.JSONObject{"severity": "HIGH,CRITICAL", "ignore_unfixed": false},
+	}.Check(t, h)
+
+	// unknown severities are rejected
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/trivy?image=registry.example.org/test1/foo:latest&severity=HIGH,SEVERE",
+		Header:       map[string]string{trivy.TokenHeader: testToken},
+		ExpectStatus: http.StatusUnprocessableEntity,
+		ExpectBody:   assert.JSONObject{"code": "INVALID_REQUEST", "message": `invalid severity: "SEVERE"`},
+	}.Check(t, h)
+}
+
+func TestProxyIgnoreUnfixed(t *testing.T) {
+	setupFakeTrivy(t, fakeTrivyReportingFlags)
+	h := newTestHandler()
+
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/trivy?image=registry.example.org/test1/foo:latest&ignore_unfixed=true",
+		Header:       map[string]string{trivy.TokenHeader: testToken},
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   assert.JSONObject{"severity": "", "ignore_unfixed": true},
+	}.Check(t, h)
+
+	// this is the typical setup for failing CI on fixable HIGH/CRITICAL vulnerabilities
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/trivy?image=registry.example.org/test1/foo:latest&ignore_unfixed=true&severity=HIGH,CRITICAL",
+		Header:       map[string]string{trivy.TokenHeader: testToken},
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   assert.JSONObject{"severity": "HIGH,CRITICAL", "ignore_unfixed": true},
+	}.Check(t, h)
+
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/trivy?image=registry.example.org/test1/foo:latest&ignore_unfixed=maybe",
+		Header:       map[string]string{trivy.TokenHeader: testToken},
+		ExpectStatus: http.StatusUnprocessableEntity,
+		ExpectBody:   assert.JSONObject{"code": "INVALID_REQUEST", "message": `invalid value for ignore_unfixed: "maybe"`},
+	}.Check(t, h)
+}
+
+func TestProxyRetryOnDBDownloadFailure(t *testing.T) {
+	// this fake trivy fails to download its DB on the first attempt only
+	attemptFile := filepath.Join(t.TempDir(), "attempted")
+	t.Setenv("TRIVY_FAKE_ATTEMPT_FILE", attemptFile)
+	setupFakeTrivy(t, `
+if [ ! -f "$TRIVY_FAKE_ATTEMPT_FILE" ]; then
+	touch "$TRIVY_FAKE_ATTEMPT_FILE"
+	echo "init error: DB error: failed to download vulnerability DB" >&2
+	exit 1
+fi
+echo '{"SchemaVersion":2}'`)
+
+	// without retries, the DB download failure is reported to the client
+	h := newTestHandler()
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/trivy?image=registry.example.org/test1/foo:latest",
+		Header:       map[string]string{trivy.TokenHeader: testToken},
+		ExpectStatus: http.StatusBadGateway,
+		ExpectBody: assert.JSONObject{
+			"code":    "DB_DOWNLOAD_FAILED",
+			"message": "trivy: exit status 1: init error: DB error: failed to download vulnerability DB",
+		},
+	}.Check(t, h)
+
+	// with retries, the second attempt succeeds
+	must.Succeed(os.Remove(attemptFile))
+	h = httpapi.Compose(
+		trivyproxycmd.NewAPI("registry.example.org/mirror", testToken, "http://trivy.example.org", 1, 1),
+		httpapi.WithoutLogging(),
+	)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/trivy?image=registry.example.org/test1/foo:latest",
+		Header:       map[string]string{trivy.TokenHeader: testToken},
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   assert.JSONObject{"SchemaVersion": 2},
+	}.Check(t, h)
+}
@@ -0,0 +1,131 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package validatecmd
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// dockerConfig contains the parts of the Docker client config
+// (usually at ~/.docker/config.json) that describe registry credentials.
+type dockerConfig struct {
+	Auths map[string]struct {
+		Auth     string `json:"auth"`
+		Username string `json:"username"`
+		Password string `json:"password"`
+	} `json:"auths"`
+	CredsStore  string            `json:"credsStore"`
+	CredHelpers map[string]string `json:"credHelpers"`
+}
+
+// dockerConfigPath returns the location of the Docker client config, respecting $DOCKER_CONFIG.
+func dockerConfigPath() (string, error) {
+	dir := os.Getenv("DOCKER_CONFIG")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(home, ".docker")
+	}
+	return filepath.Join(dir, "config.json"), nil
+}
+
+// credentialsFromDockerConfig looks up credentials for the given registry host
+// in the Docker client config, like `docker pull` would. If the config does not
+// exist or does not have credentials for this host, empty strings are returned.
+func credentialsFromDockerConfig(host string) (userName, password string, err error) {
+	path, err := dockerConfigPath()
+	if err != nil {
+		return "", "", err
+	}
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", "", nil
+		}
+		return "", "", err
+	}
+	var cfg dockerConfig
+	err = json.Unmarshal(buf, &cfg)
+	if err != nil {
+		return "", "", fmt.Errorf("cannot parse %s: %w", path, err)
+	}
+
+	for _, key := range dockerConfigKeysForHost(host) {
+		// a credential helper specific to this host takes precedence...
+		if helper, ok := cfg.CredHelpers[key]; ok {
+			return credentialsFromHelper(helper, key)
+		}
+
+		// ...then static credentials...
+		if entry, ok := cfg.Auths[key]; ok {
+			if entry.Auth == "" {
+				return entry.Username, entry.Password, nil
+			}
+			decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				return "", "", fmt.Errorf("cannot decode credentials for %s in %s: %w", key, path, err)
+			}
+			userName, password, ok := strings.Cut(string(decoded), ":")
+			if !ok {
+				return "", "", fmt.Errorf("malformed credentials for %s in %s", key, path)
+			}
+			return userName, password, nil
+		}
+	}
+
+	// ...and lastly the default credential store
+	if cfg.CredsStore != "" {
+		return credentialsFromHelper(cfg.CredsStore, dockerConfigKeysForHost(host)[0])
+	}
+	return "", "", nil
+}
+
+// dockerConfigKeysForHost returns all the keys under which credentials for the
+// given host might be stored in the Docker client config, in order of preference.
+func dockerConfigKeysForHost(host string) []string {
+	if host == "registry-1.docker.io" {
+		// Docker Hub credentials are stored under a legacy key
+		return []string{"https://index.docker.io/v1/", "index.docker.io", "docker.io", host}
+	}
+	return []string{host, "https://" + host, "http://" + host}
+}
+
+// credentialsFromHelper obtains credentials from a Docker credential helper
+// using the protocol described at <https://github.com/docker/docker-credential-helpers>.
+func credentialsFromHelper(helper, serverURL string) (userName, password string, err error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("docker-credential-"+helper, "get") //nolint:gosec // helper name comes from the user's own Docker config
+	cmd.Stdin = strings.NewReader(serverURL)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if err != nil {
+		// the helper reports missing credentials on stdout with a non-zero exit code
+		if strings.Contains(stdout.String(), "credentials not found") {
+			return "", "", nil
+		}
+		return "", "", fmt.Errorf("credential helper docker-credential-%s failed: %w (output: %q)",
+			helper, err, strings.TrimSpace(stdout.String()+stderr.String()))
+	}
+
+	var result struct {
+		Username string `json:"Username"`
+		Secret   string `json:"Secret"`
+	}
+	err = json.Unmarshal(stdout.Bytes(), &result)
+	if err != nil {
+		return "", "", fmt.Errorf("cannot parse output of credential helper docker-credential-%s: %w", helper, err)
+	}
+	return result.Username, result.Secret, nil
+}
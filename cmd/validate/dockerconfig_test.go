@@ -0,0 +1,90 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package validatecmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+)
+
+func TestCredentialsFromDockerConfig(t *testing.T) {
+	configDir := t.TempDir()
+	t.Setenv("DOCKER_CONFIG", configDir)
+
+	expectCredentials := func(host, expectedUserName, expectedPassword string) {
+		t.Helper()
+		userName, password, err := credentialsFromDockerConfig(host)
+		if err != nil {
+			t.Fatalf("unexpected error for %s: %s", host, err.Error())
+		}
+		assert.DeepEqual(t, "user name for "+host, userName, expectedUserName)
+		assert.DeepEqual(t, "password for "+host, password, expectedPassword)
+	}
+
+	// without a config file, no credentials are found
+	expectCredentials("registry.example.org", "", "")
+
+	// fake credential helper that knows about a single host
+	binDir := t.TempDir()
+	helperScript := `#!/bin/sh
+read -r host
+if [ "$host" = "helper.example.org" ]; then
+  echo '{"ServerURL":"helper.example.org","Username":"helperuser","Secret":"helpersecret"}'
+else
+  echo "credentials not found in native keychain"
+  exit 1
+fi
+`
+	mustWriteFile(t, filepath.Join(binDir, "docker-credential-fake"), []byte(helperScript))
+	err := os.Chmod(filepath.Join(binDir, "docker-credential-fake"), 0o755)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	mustWriteFile(t, filepath.Join(configDir, "config.json"), []byte(`{
+		"auths": {
+			"registry.example.org": { "auth": "dXNlcjpzZWNyZXQ6d2l0aDpjb2xvbnM=" },
+			"https://index.docker.io/v1/": { "auth": "aHVidXNlcjpodWJzZWNyZXQ=" },
+			"https://plain.example.org": { "username": "plainuser", "password": "plainsecret" }
+		},
+		"credHelpers": {
+			"helper.example.org": "fake",
+			"missing.example.org": "fake"
+		}
+	}`))
+
+	// static credentials (passwords may contain colons)
+	expectCredentials("registry.example.org", "user", "secret:with:colons")
+	expectCredentials("plain.example.org", "plainuser", "plainsecret")
+	// Docker Hub credentials are stored under a legacy key
+	expectCredentials("registry-1.docker.io", "hubuser", "hubsecret")
+	// credentials from a host-specific credential helper
+	expectCredentials("helper.example.org", "helperuser", "helpersecret")
+	// the credential helper does not know about this host
+	expectCredentials("missing.example.org", "", "")
+	// no entry at all
+	expectCredentials("other.example.org", "", "")
+
+	// with a default credential store, it is asked for all hosts without static credentials
+	mustWriteFile(t, filepath.Join(configDir, "config.json"), []byte(`{
+		"auths": {
+			"registry.example.org": { "auth": "dXNlcjpzZWNyZXQ6d2l0aDpjb2xvbnM=" }
+		},
+		"credsStore": "fake"
+	}`))
+	expectCredentials("registry.example.org", "user", "secret:with:colons")
+	expectCredentials("helper.example.org", "helperuser", "helpersecret")
+	expectCredentials("other.example.org", "", "")
+
+	// error case: malformed config
+	mustWriteFile(t, filepath.Join(configDir, "config.json"), []byte(`{"auths": {"registry.example.org": {"auth": "not base64!"}}}`))
+	_, _, err = credentialsFromDockerConfig("registry.example.org")
+	if err == nil {
+		t.Error("expected error for malformed credentials, but got none")
+	}
+}
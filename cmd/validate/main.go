@@ -4,11 +4,19 @@
 package validatecmd
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"fmt"
+	"net/http"
 	"os"
 	"strings"
 
+	. "github.com/majewsky/gg/option"
 	"github.com/opencontainers/go-digest"
+	"github.com/sapcc/go-api-declarations/bininfo"
+	"github.com/sapcc/go-bits/httpext"
 	"github.com/sapcc/go-bits/logg"
 	"github.com/spf13/cobra"
 
@@ -17,28 +25,73 @@ import (
 )
 
 var (
-	authUserName      string
-	authPassword      string
-	platformFilterStr string
+	authUserName          string
+	authPassword          string
+	platformFilterStr     string
+	caCertPath            string
+	insecureSkipTLSVerify bool
+	outputFormat          string
+	maxRetries            int
 )
 
 // AddCommandTo mounts this command into the command hierarchy.
 func AddCommandTo(parent *cobra.Command) {
 	cmd := &cobra.Command{
 		Use:     "validate <image>...",
-		Example: "  keppel validate registry.example.org/library/alpine:3.9",
+		Example: "  keppel validate registry.example.org/library/alpine:3.9\n  keppel validate registry.example.org/library/alpine:3.9 :3.10 @sha256:...\n  keppel validate oci:./alpine-layout:3.9",
 		Short:   "Pulls an image and validates that its contents are intact.",
 		Long: `Pulls an image and validates that its contents are intact.
-If the image is in a Keppel replica account, this ensures that the image is replicated as a side effect.`,
+If the image is in a Keppel replica account, this ensures that the image is replicated as a side effect.
+Arguments that only consist of a tag or digest (like ":3.10" or "@sha256:...") refer to the same repository as the previous argument.
+Arguments of the form "oci:<path>[:<tag>]" refer to an image in a local OCI layout directory (e.g. as created by "skopeo copy ... oci:<path>").
+If no tag is given for an OCI layout, all images listed in its index.json are validated.`,
 		Args: cobra.MinimumNArgs(1),
 		Run:  run,
 	}
-	cmd.PersistentFlags().StringVarP(&authUserName, "username", "u", "", "User name (only required for non-public images).")
+	cmd.PersistentFlags().StringVarP(&authUserName, "username", "u", "", "User name (only required for non-public images). If neither user name nor password are given, credentials are taken from the Docker client config if possible (see `docker login`).")
 	cmd.PersistentFlags().StringVarP(&authPassword, "password", "p", "", "Password (only required for non-public images).")
 	cmd.PersistentFlags().StringVar(&platformFilterStr, "platform-filter", "[]", "When validating a multi-architecture image, only recurse into the contained images matching one of the given platforms. The filter must be given as a JSON array of objects matching each having the same format as the `manifests[].platform` field in the <https://github.com/opencontainers/image-spec/blob/master/image-index.md>.")
+	cmd.PersistentFlags().StringVar(&caCertPath, "ca-cert", "", "Path to a PEM file with additional CA certificates to trust when connecting to the registry (e.g. for internal registries with self-signed certificates).")
+	cmd.PersistentFlags().BoolVar(&insecureSkipTLSVerify, "insecure-skip-tls-verify", false, "Do not verify the registry's TLS certificate. This is insecure and should only be used for testing.")
+	cmd.PersistentFlags().IntVar(&maxRetries, "retries", client.DefaultRetryPolicy.MaxAttempts-1, "How often to retry failed downloads after transient errors (e.g. network errors or 503 responses). Set to 0 to disable retries.")
+	cmd.PersistentFlags().StringVarP(&outputFormat, "output", "o", "text", `Output format: either "text" for human-readable log output, or "json" for one JSON record per checked manifest or blob on stdout, followed by a summary record.`)
 	parent.AddCommand(cmd)
 }
 
+// buildHTTPClient returns the HTTP client for talking to the registry, or nil
+// if the default client can be used.
+func buildHTTPClient(caCertPath string, insecureSkipTLSVerify bool) (*http.Client, error) {
+	if caCertPath == "" && !insecureSkipTLSVerify {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{ //nolint:gosec // only used in HTTP client, where stdlib auto-chooses strong TLS versions
+		InsecureSkipVerify: insecureSkipTLSVerify, //nolint:gosec // only enabled when explicitly requested by the user
+	}
+	if caCertPath != "" {
+		pemBytes, err := os.ReadFile(caCertPath)
+		if err != nil {
+			return nil, err
+		}
+		certPool, err := x509.SystemCertPool()
+		if err != nil {
+			return nil, fmt.Errorf("cannot load system CA certificates: %w", err)
+		}
+		if !certPool.AppendCertsFromPEM(pemBytes) {
+			return nil, fmt.Errorf("no PEM-encoded certificates found in %s", caCertPath)
+		}
+		tlsConfig.RootCAs = certPool
+	}
+
+	var transport http.RoundTripper = &http.Transport{
+		Proxy:             http.ProxyFromEnvironment,
+		TLSClientConfig:   tlsConfig,
+		ForceAttemptHTTP2: true,
+	}
+	httpext.WrapTransport(&transport).SetOverrideUserAgent(bininfo.Component(), bininfo.VersionOr("rolling"))
+	return &http.Client{Transport: transport}, nil
+}
+
 type logger struct{}
 
 // LogManifest implements the client.ValidationLogger interface.
@@ -69,6 +122,44 @@ func (l logger) LogBlob(d digest.Digest, level int, err error, isCached bool) {
 	}
 }
 
+// jsonLogger implements the client.ValidationLogger interface for `--output json`.
+type jsonLogger struct {
+	encoder *json.Encoder
+}
+
+type jsonRecord struct {
+	Type      string                  `json:"type"`
+	Reference string                  `json:"reference,omitempty"`
+	Level     int                     `json:"level"`
+	Cached    bool                    `json:"cached,omitempty"`
+	Error     string                  `json:"error,omitempty"`
+	Summary   *client.ValidationStats `json:"summary,omitempty"`
+}
+
+func (l jsonLogger) write(record jsonRecord) {
+	err := l.encoder.Encode(record)
+	if err != nil {
+		logg.Fatal("cannot write JSON output: " + err.Error())
+	}
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// LogManifest implements the client.ValidationLogger interface.
+func (l jsonLogger) LogManifest(reference models.ManifestReference, level int, err error, isCached bool) {
+	l.write(jsonRecord{Type: "manifest", Reference: reference.String(), Level: level, Cached: isCached, Error: errorString(err)})
+}
+
+// LogBlob implements the client.ValidationLogger interface.
+func (l jsonLogger) LogBlob(d digest.Digest, level int, err error, isCached bool) {
+	l.write(jsonRecord{Type: "blob", Reference: d.String(), Level: level, Cached: isCached, Error: errorString(err)})
+}
+
 func run(cmd *cobra.Command, args []string) {
 	var platformFilter models.PlatformFilter
 	err := json.Unmarshal([]byte(platformFilterStr), &platformFilter)
@@ -76,26 +167,114 @@ func run(cmd *cobra.Command, args []string) {
 		logg.Fatal("cannot parse platform filter: " + err.Error())
 	}
 
-	session := client.ValidationSession{
-		Logger: logger{},
+	httpClient, err := buildHTTPClient(caCertPath, insecureSkipTLSVerify)
+	if err != nil {
+		logg.Fatal("cannot set up HTTP client: " + err.Error())
+	}
+	if insecureSkipTLSVerify {
+		logg.Info("TLS certificate verification is disabled; do not use this with untrusted registries")
+	}
+
+	session := client.ValidationSession{}
+	switch outputFormat {
+	case "text":
+		session.Logger = logger{}
+	case "json":
+		session.Logger = jsonLogger{json.NewEncoder(os.Stdout)}
+	default:
+		logg.Fatal(`invalid value for --output: expected "text" or "json", but got %q`, outputFormat)
 	}
 
+	err = validateImages(cmd.Context(), args, &session, httpClient, platformFilter)
+
+	// report a summary of all work done, even if the validation failed halfway through
+	stats := session.Stats()
+	if l, ok := session.Logger.(jsonLogger); ok {
+		l.write(jsonRecord{Type: "summary", Summary: &stats})
+	} else {
+		logg.Info("checked %d manifests and %d blobs (%d cached results, %d failed), read %d bytes",
+			stats.Manifests, stats.Blobs, stats.Cached, stats.Failed, stats.BytesRead)
+	}
+	if err != nil {
+		os.Exit(1)
+	}
+}
+
+func validateImages(ctx context.Context, args []string, session *client.ValidationSession, httpClient *http.Client, platformFilter models.PlatformFilter) error {
+	// bare tags or digests (like ":3.9" or "@sha256:...") refer to the same
+	// repository as the previous argument
+	var previousRef Option[models.ImageReference]
 	for _, arg := range args {
-		ref, interpretation, err := models.ParseImageReference(arg)
+		if layoutPath, ok := strings.CutPrefix(arg, "oci:"); ok {
+			previousRef = None[models.ImageReference]()
+			err := validateOCILayout(ctx, layoutPath, session, platformFilter)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		ref, interpretation, err := models.ParseImageReferenceWithBase(arg, previousRef)
 		logg.Info("interpreting %s as %s", arg, interpretation)
 		if err != nil {
 			logg.Fatal(err.Error())
 		}
+		previousRef = Some(ref)
+
+		// if no credentials were given on the command line, use those from `docker login`
+		userName, password := authUserName, authPassword
+		if userName == "" && password == "" {
+			userName, password, err = credentialsFromDockerConfig(ref.Host)
+			if err != nil {
+				logg.Fatal("cannot read credentials from Docker config: " + err.Error())
+			}
+			if userName != "" {
+				logg.Info("using credentials for %s from Docker config", ref.Host)
+			}
+		}
 
 		c := &client.RepoClient{
-			Host:     ref.Host,
-			RepoName: ref.RepoName,
-			UserName: authUserName,
-			Password: authPassword,
+			Host:       ref.Host,
+			RepoName:   ref.RepoName,
+			UserName:   userName,
+			Password:   password,
+			HTTPClient: httpClient,
+			RetryPolicy: client.RetryPolicy{
+				MaxAttempts:    maxRetries + 1,
+				InitialBackoff: client.DefaultRetryPolicy.InitialBackoff,
+				MaxBackoff:     client.DefaultRetryPolicy.MaxBackoff,
+			},
 		}
-		err = c.ValidateManifest(cmd.Context(), ref.Reference, &session, platformFilter)
+		err = c.ValidateManifest(ctx, ref.Reference, session, platformFilter)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateOCILayout validates an image from a local OCI layout directory.
+// The argument has the form "<path>" or "<path>:<tag>", like the "oci:" transport of skopeo.
+// If no tag is given, all manifests listed in the layout's index.json are validated.
+func validateOCILayout(ctx context.Context, arg string, session *client.ValidationSession, platformFilter models.PlatformFilter) error {
+	path, tagName, hasTag := strings.Cut(arg, ":")
+	layout := client.OCILayout{Path: path}
+	if hasTag {
+		logg.Info("validating tag %q in OCI layout at %s", tagName, path)
+		return layout.ValidateManifest(ctx, models.ManifestReference{Tag: tagName}, session, platformFilter)
+	}
+
+	index, err := layout.ReadIndex()
+	if err != nil {
+		logg.Error("cannot read OCI layout at %s: %s", path, err.Error())
+		return err
+	}
+	logg.Info("validating all %d manifests in OCI layout at %s", len(index.Manifests), path)
+	for _, desc := range index.Manifests {
+		err := layout.ValidateManifest(ctx, models.ManifestReference{Digest: desc.Digest}, session, platformFilter)
 		if err != nil {
-			os.Exit(1)
+			return err
 		}
 	}
+	return nil
 }
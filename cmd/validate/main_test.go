@@ -0,0 +1,169 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package validatecmd
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+
+	"github.com/sapcc/keppel/internal/client"
+	"github.com/sapcc/keppel/internal/models"
+	"github.com/sapcc/keppel/internal/test"
+)
+
+func TestBuildHTTPClientWithCustomCA(t *testing.T) {
+	// this server uses a self-signed certificate that is not in the system CA bundle
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/" {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "https://")
+
+	dir := t.TempDir()
+	caCertPath := filepath.Join(dir, "ca.pem")
+	caCertPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	mustWriteFile(t, caCertPath, caCertPEM)
+	invalidCACertPath := filepath.Join(dir, "invalid.pem")
+	mustWriteFile(t, invalidCACertPath, []byte("not a certificate"))
+
+	checkCredentials := func(httpClient *http.Client) error {
+		t.Helper()
+		c := &client.RepoClient{Host: host, RepoName: "foo", HTTPClient: httpClient}
+		return c.CheckCredentials(t.Context())
+	}
+
+	// without any flags, the default client is used, which verifies certificates against the system CA bundle
+	httpClient, err := buildHTTPClient("", false)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if httpClient != nil {
+		t.Error("expected no custom HTTP client without flags")
+	}
+	err = checkCredentials(httpClient)
+	if err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Errorf("expected certificate verification error with default client, but got: %v", err)
+	}
+
+	// with --ca-cert, the server certificate is trusted
+	httpClient, err = buildHTTPClient(caCertPath, false)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = checkCredentials(httpClient)
+	if err != nil {
+		t.Errorf("expected success with custom CA, but got: %s", err.Error())
+	}
+
+	// with --insecure-skip-tls-verify, certificates are not verified at all
+	httpClient, err = buildHTTPClient("", true)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = checkCredentials(httpClient)
+	if err != nil {
+		t.Errorf("expected success with verification disabled, but got: %s", err.Error())
+	}
+
+	// error cases for --ca-cert
+	_, err = buildHTTPClient(filepath.Join(dir, "missing.pem"), false)
+	if err == nil {
+		t.Error("expected error for missing CA file, but got none")
+	}
+	_, err = buildHTTPClient(invalidCACertPath, false)
+	expectedMessage := "no PEM-encoded certificates found in " + invalidCACertPath
+	if err == nil || err.Error() != expectedMessage {
+		t.Errorf("expected error %q for invalid CA file, but got: %v", expectedMessage, err)
+	}
+}
+
+func mustWriteFile(t *testing.T, path string, contents []byte) {
+	t.Helper()
+	err := os.WriteFile(path, contents, 0o644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestValidationSummary(t *testing.T) {
+	// do not pick up credentials from the Docker config of the user running the test
+	t.Setenv("DOCKER_CONFIG", t.TempDir())
+
+	// serve a single image from a minimal fake registry
+	image := test.GenerateImage(test.GenerateExampleLayer(1), test.GenerateExampleLayer(2))
+	contents := map[string]test.Bytes{
+		"/v2/foo/manifests/latest":                         image.Manifest,
+		"/v2/foo/blobs/" + image.Config.Digest.String():    image.Config,
+		"/v2/foo/blobs/" + image.Layers[0].Digest.String(): image.Layers[0],
+		"/v2/foo/blobs/" + image.Layers[1].Digest.String(): image.Layers[1],
+	}
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, ok := contents[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", b.MediaType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(b.Contents)))
+		w.Header().Set("Docker-Content-Digest", b.Digest.String())
+		w.WriteHeader(http.StatusOK)
+		w.Write(b.Contents) //nolint:errcheck
+	}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "https://")
+
+	var session client.ValidationSession
+	validate := func(args ...string) error {
+		t.Helper()
+		return validateImages(t.Context(), args, &session, srv.Client(), models.PlatformFilter{})
+	}
+
+	// the first validation downloads everything
+	err := validate(host + "/foo:latest")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "stats", session.Stats(), client.ValidationStats{
+		Manifests: 1,
+		Blobs:     3,
+		BytesRead: image.SizeBytes(),
+	})
+
+	// validating the same image again within the same session uses the cached result
+	err = validate(host + "/foo:latest")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "stats", session.Stats(), client.ValidationStats{
+		Manifests: 2,
+		Blobs:     3,
+		Cached:    1,
+		BytesRead: image.SizeBytes(),
+	})
+
+	// failed validations are counted as well
+	err = validate(host+"/foo:latest", ":missing")
+	if err == nil {
+		t.Fatal("expected validation of missing tag to fail, but got no error")
+	}
+	assert.DeepEqual(t, "stats", session.Stats(), client.ValidationStats{
+		Manifests: 4,
+		Blobs:     3,
+		Cached:    2,
+		Failed:    1,
+		BytesRead: image.SizeBytes(),
+	})
+}
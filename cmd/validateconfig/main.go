@@ -4,25 +4,39 @@
 package validateconfigcmd
 
 import (
+	"context"
+	"os"
+
 	"github.com/spf13/cobra"
 
+	"github.com/sapcc/go-bits/errext"
+	"github.com/sapcc/go-bits/logg"
 	"github.com/sapcc/go-bits/must"
+	"github.com/sapcc/go-bits/osext"
 
 	"github.com/sapcc/keppel/internal/drivers/basic"
+	"github.com/sapcc/keppel/internal/keppel"
+	"github.com/sapcc/keppel/internal/models"
 )
 
+var probeAuthTenantID string
+
 // AddCommandTo mounts this command into the command hierarchy.
 func AddCommandTo(parent *cobra.Command) {
 	cmd := &cobra.Command{
-		Use:   "validate-config",
-		Short: "Validates driver configuration files.",
-		Long: `Contains subcommands to validate configuration files for specific drivers.
+		Use:     "validate-config",
+		Example: "  keppel server validate-config --probe-auth-tenant-id 8f3e4c0a",
+		Short:   "Validates the configuration of the Keppel server components.",
+		Long: `Validates the configuration of the Keppel server components.
+When called without a subcommand, the full configuration is loaded from the environment variables, and all configured
+drivers are instantiated. All problems that are found are reported, and the command exits with non-zero status if there
+were any. The server components are not started.
+The subcommands validate configuration files for specific drivers.
 This is intended to be used e.g. for preflight checks in CI deployments.`,
 		Args: cobra.NoArgs,
-		Run: func(cmd *cobra.Command, args []string) {
-			cmd.Help()
-		},
+		Run:  runForEnvironment,
 	}
+	cmd.Flags().StringVar(&probeAuthTenantID, "probe-auth-tenant-id", "", "If given, ask the storage driver whether an account could be set up in this auth tenant.")
 	parent.AddCommand(cmd)
 
 	cmd.AddCommand(&cobra.Command{
@@ -38,3 +52,93 @@ func runForAccountManagementBasic(cmd *cobra.Command, args []string) {
 	driver := &basic.AccountManagementDriver{ConfigPath: args[0]}
 	must.Succeed(driver.LoadConfig())
 }
+
+func runForEnvironment(cmd *cobra.Command, args []string) {
+	errs := validateEnvironment(cmd.Context())
+	if !errs.IsEmpty() {
+		for _, err := range errs {
+			logg.Error(err.Error())
+		}
+		logg.Error("found %d problem(s) in the configuration", len(errs))
+		os.Exit(1)
+	}
+	logg.Info("configuration looks good")
+}
+
+func validateEnvironment(ctx context.Context) (errs errext.ErrorSet) {
+	cfg, cfgErrs := keppel.TryParseConfiguration()
+	errs.Append(cfgErrs)
+
+	// Redis is only used by the API, but drivers may expect a valid client if it is enabled
+	if osext.GetenvBool("KEPPEL_REDIS_ENABLE") {
+		_, err := keppel.GetRedisOptions("KEPPEL")
+		errs.Add(err)
+	}
+
+	// initialize all drivers in the same order as the server components do
+	authDriverName, err := osext.NeedGetenv("KEPPEL_DRIVER_AUTH")
+	if err != nil {
+		errs.Add(err)
+		errs.Addf("cannot check federation and storage drivers without a working auth driver")
+		return errs
+	}
+	ad, err := keppel.NewAuthDriver(ctx, authDriverName, nil)
+	if err != nil {
+		errs.Addf("cannot initialize auth driver %q: %w", authDriverName, err)
+		errs.Addf("cannot check federation and storage drivers without a working auth driver")
+		return errs
+	}
+
+	fdName, err := osext.NeedGetenv("KEPPEL_DRIVER_FEDERATION")
+	if err == nil {
+		_, err = keppel.NewFederationDriver(ctx, fdName, ad, cfg)
+		if err != nil {
+			errs.Addf("cannot initialize federation driver %q: %w", fdName, err)
+		}
+	} else {
+		errs.Add(err)
+	}
+
+	sdName, err := osext.NeedGetenv("KEPPEL_DRIVER_STORAGE")
+	if err == nil {
+		sd, err := keppel.NewStorageDriver(sdName, ad, cfg)
+		switch {
+		case err != nil:
+			errs.Addf("cannot initialize storage driver %q: %w", sdName, err)
+		case probeAuthTenantID != "":
+			account := models.ReducedAccount{Name: "validate-config-probe", AuthTenantID: probeAuthTenantID}
+			err = sd.CanSetupAccount(ctx, account)
+			if err != nil {
+				errs.Addf("storage driver %q cannot set up accounts in auth tenant %q: %w", sdName, probeAuthTenantID, err)
+			}
+		}
+	} else {
+		errs.Add(err)
+	}
+
+	icdName, err := osext.NeedGetenv("KEPPEL_DRIVER_INBOUND_CACHE")
+	if err == nil {
+		_, err = keppel.NewInboundCacheDriver(ctx, icdName, cfg)
+		if err != nil {
+			errs.Addf("cannot initialize inbound cache driver %q: %w", icdName, err)
+		}
+	} else {
+		errs.Add(err)
+	}
+
+	// these drivers are only used by some of the server components, so we only check them if they are configured
+	if amdName := os.Getenv("KEPPEL_DRIVER_ACCOUNT_MANAGEMENT"); amdName != "" {
+		_, err = keppel.NewAccountManagementDriver(amdName)
+		if err != nil {
+			errs.Addf("cannot initialize account management driver %q: %w", amdName, err)
+		}
+	}
+	if rldName := os.Getenv("KEPPEL_DRIVER_RATELIMIT"); rldName != "" {
+		_, err = keppel.NewRateLimitDriver(rldName, ad, cfg)
+		if err != nil {
+			errs.Addf("cannot initialize rate limit driver %q: %w", rldName, err)
+		}
+	}
+
+	return errs
+}
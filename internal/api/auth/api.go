@@ -13,6 +13,7 @@ import (
 	"github.com/sapcc/go-bits/logg"
 	"github.com/sapcc/go-bits/respondwith"
 
+	"github.com/sapcc/keppel/internal/api"
 	"github.com/sapcc/keppel/internal/auth"
 	"github.com/sapcc/keppel/internal/keppel"
 	"github.com/sapcc/keppel/internal/models"
@@ -33,8 +34,9 @@ func NewAPI(cfg keppel.Configuration, ad keppel.AuthDriver, fd keppel.Federation
 
 // AddTo implements the api.API interface.
 func (a *API) AddTo(r *mux.Router) {
-	r.Methods("GET").Path("/keppel/v1/auth").HandlerFunc(a.handleGetAuth)
+	r.Methods("GET").Path("/keppel/v1/auth").HandlerFunc(api.WithAccountCache(a.handleGetAuth))
 	r.Methods("POST").Path("/keppel/v1/auth/peering").HandlerFunc(a.handlePostPeering)
+	r.Methods("POST").Path("/keppel/v1/auth/check").HandlerFunc(api.WithAccountCache(a.handlePostCheck))
 }
 
 func respondWithError(w http.ResponseWriter, code int, err error) bool {
@@ -76,7 +78,11 @@ func (a *API) handleGetAuth(w http.ResponseWriter, r *http.Request) {
 			scope := req.Scopes[0]
 			if scope.ResourceType == "repository" {
 				repoScope := scope.ParseRepositoryScope(req.IntendedAudience)
-				accountExists, err := keppel.DoesAccountExist(a.db, repoScope.AccountName)
+				accountExists, err := keppel.DoesAccountExist(r.Context(), a.db.ReadReplica(), repoScope.AccountName)
+				if err == nil && !accountExists {
+					// the account might have been created only just now, so confirm on the primary DB
+					accountExists, err = keppel.DoesAccountExist(r.Context(), a.db, repoScope.AccountName)
+				}
 				if respondWithError(w, http.StatusInternalServerError, err) {
 					return
 				}
@@ -111,6 +117,12 @@ func (a *API) handleGetAuth(w http.ResponseWriter, r *http.Request) {
 	if respondWithError(w, http.StatusBadRequest, err) {
 		return
 	}
+	if a.cfg.TrackIssuedTokens {
+		err := authz.TrackIssuedToken(r.Context(), a.db, *tokenResponse)
+		if respondWithError(w, http.StatusInternalServerError, err) {
+			return
+		}
+	}
 	respondwith.JSON(w, http.StatusOK, tokenResponse)
 }
 
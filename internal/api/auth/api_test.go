@@ -851,6 +851,36 @@ func TestAnycastAndDomainRemappedTokens(t *testing.T) {
 				},
 			},
 		}.Check(t, h1)
+
+		// when an account opts out of anycast, anycast tokens do not grant access
+		// to it anymore (regardless of which peer was asked), but local tokens still do
+		test.MustExec(t, s1.DB, `UPDATE accounts SET is_anycast_disabled = TRUE WHERE name = $1`, "test1")
+		for _, h := range []http.Handler{h1, h2} {
+			assert.HTTPRequest{
+				Method:       "GET",
+				Path:         fmt.Sprintf("/keppel/v1/auth?scope=repository:test1/foo:pull&service=%s", anycastService),
+				Header:       correctAuthHeader,
+				ExpectStatus: http.StatusOK,
+				ExpectBody: jwtContents{
+					Audience: anycastService,
+					Issuer:   "keppel-api@" + localService1,
+					Subject:  "correctusername",
+					Access:   nil,
+				},
+			}.Check(t, h)
+		}
+		assert.HTTPRequest{
+			Method:       "GET",
+			Path:         fmt.Sprintf("/keppel/v1/auth?scope=repository:test1/foo:pull&service=%s", localService1),
+			Header:       correctAuthHeader,
+			ExpectStatus: http.StatusOK,
+			ExpectBody: jwtContents{
+				Audience: localService1,
+				Issuer:   "keppel-api@" + localService1,
+				Subject:  "correctusername",
+				Access:   []jwtAccess{{Type: "repository", Name: "test1/foo", Actions: []string{"pull"}}},
+			},
+		}.Check(t, h1)
 	})
 }
 
@@ -938,6 +968,114 @@ func TestMultiScope(t *testing.T) {
 	}.Check(t, h)
 }
 
+func TestNegatedRBACRepositoryMatches(t *testing.T) {
+	s := setupPrimary(t)
+	h := s.Handler
+	service := s.Config.APIPublicHostname
+
+	// anonymous pull on everything except "secret-*", and the second policy
+	// cannot override that because forbidding takes precedence over granting;
+	// also, the user may push everywhere except into "hidden-*"
+	policies := []keppel.RBACPolicy{
+		{
+			ForbiddenRepositoryPattern: "secret-.*",
+			Permissions:                []keppel.RBACPermission{keppel.RBACAnonymousPullPermission},
+		},
+		{
+			RepositoryPattern: "secret-public",
+			Permissions:       []keppel.RBACPermission{keppel.RBACAnonymousPullPermission},
+		},
+		{
+			ForbiddenRepositoryPattern: "hidden-.*",
+			UserNamePattern:            "correct.*",
+			Permissions:                []keppel.RBACPermission{keppel.RBACPullPermission, keppel.RBACPushPermission},
+		},
+	}
+	test.MustExec(t, s.DB, `UPDATE accounts SET rbac_policies_json = $1 WHERE name = $2`, test.ToJSON(policies), "test1")
+	s.AD.GrantedPermissions = "view:test1authtenant,pull:test1authtenant"
+
+	testCases := []struct {
+		RepoName       string
+		AnonymousLogin bool
+		GrantedActions []string
+	}{
+		{"foo", true, []string{"pull"}},
+		{"secret-data", true, nil},
+		{"secret-public", true, nil},
+		{"foo", false, []string{"pull", "push"}},
+		{"secret-data", false, []string{"pull", "push"}},
+		// pull is still granted through the anonymous_pull from the first policy
+		{"hidden-data", false, []string{"pull"}},
+	}
+	for _, tc := range testCases {
+		scope := fmt.Sprintf("repository:test1/%s:pull,push", tc.RepoName)
+		expectedContents := jwtContents{
+			Audience: service,
+			Issuer:   "keppel-api@" + service,
+		}
+		if tc.GrantedActions != nil {
+			expectedContents.Access = []jwtAccess{{
+				Type:    "repository",
+				Name:    "test1/" + tc.RepoName,
+				Actions: tc.GrantedActions,
+			}}
+		}
+		req := assert.HTTPRequest{
+			Method:       "GET",
+			Path:         fmt.Sprintf("/keppel/v1/auth?service=%s&scope=%s", service, scope),
+			ExpectStatus: http.StatusOK,
+			ExpectBody:   expectedContents,
+		}
+		if !tc.AnonymousLogin {
+			req.Header = map[string]string{
+				"Authorization": keppel.BuildBasicAuthHeader("correctusername", "correctpassword"),
+			}
+			expectedContents.Subject = "correctusername"
+			req.ExpectBody = expectedContents
+		}
+		req.Check(t, h)
+	}
+}
+
+func TestTooManyScopes(t *testing.T) {
+	s := setupPrimary(t)
+
+	makeScopes := func(count int) []string {
+		scopes := make([]string, count)
+		for idx := range scopes {
+			scopes[idx] = fmt.Sprintf("repository:test1/foo%d:pull", idx)
+		}
+		return scopes
+	}
+
+	// requesting as many scopes as allowed is fine
+	assert.HTTPRequest{
+		Method: "GET",
+		Path: "/keppel/v1/auth?" + url.Values{
+			"service": {s.Config.APIPublicHostname},
+			"scope":   makeScopes(keppel.DefaultMaxScopesPerToken),
+		}.Encode(),
+		Header:       map[string]string{"Authorization": keppel.BuildBasicAuthHeader("correctusername", "correctpassword")},
+		ExpectStatus: http.StatusOK,
+	}.Check(t, s.Handler)
+
+	// requesting more scopes than that is rejected before any scope is even
+	// looked at (this also applies to anycast requests, which would otherwise
+	// be forwarded to a peer or fail for different reasons)
+	for _, service := range []string{s.Config.APIPublicHostname, s.Config.AnycastAPIPublicHostname} {
+		assert.HTTPRequest{
+			Method: "GET",
+			Path: "/keppel/v1/auth?" + url.Values{
+				"service": {service},
+				"scope":   makeScopes(keppel.DefaultMaxScopesPerToken + 1),
+			}.Encode(),
+			Header:       map[string]string{"Authorization": keppel.BuildBasicAuthHeader("correctusername", "correctpassword")},
+			ExpectStatus: http.StatusBadRequest,
+			ExpectBody:   assert.JSONObject{"details": "cannot issue tokens for more than 100 scopes at once"},
+		}.Check(t, s.Handler)
+	}
+}
+
 func TestIssuerKeyRotation(t *testing.T) {
 	// phase 1: issue a token with the previous issuer key
 	s := setupPrimary(t, test.WithPreviousIssuerKey, test.WithoutCurrentIssuerKey)
@@ -995,3 +1133,86 @@ func TestIssuerKeyRotation(t *testing.T) {
 		},
 	}.Check(t, s.Handler)
 }
+
+func TestIssuerKeyIDs(t *testing.T) {
+	getToken := func(s test.Setup) string {
+		t.Helper()
+		_, respBodyBytes := assert.HTTPRequest{
+			Method:       "GET",
+			Path:         "/keppel/v1/auth?service=registry.example.org&scope=keppel_api:info:access",
+			Header:       map[string]string{"Authorization": keppel.BuildBasicAuthHeader("correctusername", "correctpassword")},
+			ExpectStatus: http.StatusOK,
+		}.Check(t, s.Handler)
+		var respBody struct {
+			Token string `json:"token"`
+		}
+		test.MustDo(t, json.Unmarshal(respBodyBytes, &respBody))
+		return respBody.Token
+	}
+	expectKeyID := func(token, expectedKeyID string) {
+		t.Helper()
+		headerBytes, err := base64.RawURLEncoding.DecodeString(strings.SplitN(token, ".", 2)[0])
+		test.MustDo(t, err)
+		var header struct {
+			KeyID     string `json:"kid"`
+			PublicKey string `json:"jwk"`
+		}
+		test.MustDo(t, json.Unmarshal(headerBytes, &header))
+		assert.DeepEqual(t, "kid header", header.KeyID, expectedKeyID)
+		if header.PublicKey == "" {
+			t.Error("expected token to have a jwk header, but it is missing")
+		}
+	}
+	expectAccepted := func(s test.Setup, token string) {
+		t.Helper()
+		assert.HTTPRequest{
+			Method:       "GET",
+			Path:         "/v2/",
+			Header:       map[string]string{"Authorization": "Bearer " + token},
+			ExpectStatus: http.StatusOK,
+		}.Check(t, s.Handler)
+	}
+
+	// tokens issued by a key with an ID carry that ID in the "kid" header...
+	s := setupPrimary(t, test.WithPreviousIssuerKey, test.WithoutCurrentIssuerKey, test.WithIssuerKeyIDs)
+	tokenWithKeyID := getToken(s)
+	expectKeyID(tokenWithKeyID, "previous")
+	expectAccepted(s, tokenWithKeyID)
+
+	// ...while tokens issued by a key without an ID only have the "jwk" header
+	s = setupPrimary(t, test.WithPreviousIssuerKey, test.WithoutCurrentIssuerKey)
+	tokenWithoutKeyID := getToken(s)
+	expectKeyID(tokenWithoutKeyID, "")
+
+	// when a new key is rotated in, tokens from the previous key are accepted
+	// with and without key ID, and new tokens are issued with the new key ID
+	s = setupPrimary(t, test.WithPreviousIssuerKey, test.WithIssuerKeyIDs)
+	expectAccepted(s, tokenWithKeyID)
+	expectAccepted(s, tokenWithoutKeyID)
+	newToken := getToken(s)
+	expectKeyID(newToken, "current")
+	expectAccepted(s, newToken)
+
+	// instances that do not have key IDs configured can still identify the key
+	// through the "jwk" header
+	s = setupPrimary(t, test.WithPreviousIssuerKey)
+	expectAccepted(s, tokenWithKeyID)
+	expectAccepted(s, newToken)
+
+	// once the previous key has rotated out, its tokens are rejected
+	s = setupPrimary(t, test.WithIssuerKeyIDs)
+	expectAccepted(s, newToken)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/v2/",
+		Header:       map[string]string{"Authorization": "Bearer " + tokenWithKeyID},
+		ExpectStatus: http.StatusUnauthorized,
+		ExpectBody: assert.JSONObject{
+			"errors": []assert.JSONObject{{
+				"code":    string(keppel.ErrUnauthorized),
+				"message": "token is unverifiable: error while executing keyfunc: token signed by unknown key",
+				"detail":  nil,
+			}},
+		},
+	}.Check(t, s.Handler)
+}
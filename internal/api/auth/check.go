@@ -0,0 +1,143 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package authapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/sapcc/go-bits/httpapi"
+	"github.com/sapcc/go-bits/respondwith"
+
+	"github.com/sapcc/keppel/internal/auth"
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+// CheckRequest is the structure of the JSON request body sent to the POST
+// /keppel/v1/auth/check endpoint.
+type CheckRequest struct {
+	Scopes   []string      `json:"scopes"`
+	Identity CheckIdentity `json:"identity"`
+}
+
+// CheckIdentity describes the user on whose behalf a CheckRequest is evaluated.
+type CheckIdentity struct {
+	Anonymous   bool                `json:"anonymous,omitempty"`
+	UserName    string              `json:"username,omitempty"`
+	Permissions []keppel.Permission `json:"permissions,omitempty"`
+	IPAddress   string              `json:"ip_address,omitempty"`
+}
+
+// CheckResult appears in the response of the POST /keppel/v1/auth/check endpoint.
+type CheckResult struct {
+	Scope          string                `json:"scope"`
+	GrantedActions []string              `json:"granted_actions"`
+	Decisions      []auth.ActionDecision `json:"decisions"`
+}
+
+var isCheckablePermission = map[keppel.Permission]bool{
+	keppel.CanViewAccount:       true,
+	keppel.CanPullFromAccount:   true,
+	keppel.CanPushToAccount:     true,
+	keppel.CanDeleteFromAccount: true,
+}
+
+func (a *API) handlePostCheck(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/keppel/v1/auth/check")
+	// decode request body
+	var req CheckRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&req)
+	if err != nil {
+		http.Error(w, "request body is not valid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// validate request
+	if len(req.Scopes) == 0 {
+		http.Error(w, "at least one scope must be given", http.StatusUnprocessableEntity)
+		return
+	}
+	scopes := make([]auth.Scope, len(req.Scopes))
+	for idx, input := range req.Scopes {
+		scope := parseScope(input)
+		if scope.ResourceType != "repository" || scope.ResourceName == "" || len(scope.Actions) == 0 {
+			msg := fmt.Sprintf("scope %q is not supported (only repository scopes of the form \"repository:<account>/<repo>:<actions>\" can be checked)", input)
+			http.Error(w, msg, http.StatusUnprocessableEntity)
+			return
+		}
+		scopes[idx] = scope
+	}
+	uid, err := req.Identity.toUserIdentity()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	// checking access rules requires permission to change the respective accounts,
+	// since this reveals the accounts' RBAC policies
+	var requiredScopes auth.ScopeSet
+	for _, scope := range scopes {
+		repoScope := scope.ParseRepositoryScope(auth.Audience{})
+		requiredScopes.Add(auth.Scope{
+			ResourceType: "keppel_account",
+			ResourceName: string(repoScope.AccountName),
+			Actions:      []string{string(keppel.CanChangeAccount)},
+		})
+	}
+	_, _, rerr := auth.IncomingRequest{
+		HTTPRequest:        r,
+		Scopes:             requiredScopes,
+		CorrectlyReturn403: true,
+	}.Authorize(r.Context(), a.cfg, a.authDriver, a.db)
+	if rerr != nil {
+		rerr.WriteAsTextTo(w)
+		return
+	}
+
+	// evaluate scopes on behalf of the described user
+	results := make([]CheckResult, len(scopes))
+	for idx, scope := range scopes {
+		decisions, grantedActions, err := auth.ExplainRepositoryScope(req.Identity.IPAddress, scope, uid, auth.Audience{}, a.db)
+		if respondwith.ObfuscatedErrorText(w, err) {
+			return
+		}
+		if grantedActions == nil {
+			grantedActions = []string{}
+		}
+		results[idx] = CheckResult{
+			Scope:          req.Scopes[idx],
+			GrantedActions: grantedActions,
+			Decisions:      decisions,
+		}
+	}
+	respondwith.JSON(w, http.StatusOK, map[string]any{"results": results})
+}
+
+func (i CheckIdentity) toUserIdentity() (keppel.UserIdentity, error) {
+	if i.IPAddress != "" && net.ParseIP(i.IPAddress) == nil {
+		return nil, fmt.Errorf("%q is not a valid IP address", i.IPAddress)
+	}
+
+	if i.Anonymous {
+		if i.UserName != "" || len(i.Permissions) > 0 {
+			return nil, errors.New("anonymous identity may not have a username or permissions")
+		}
+		return auth.AnonymousUserIdentity, nil
+	}
+
+	if i.UserName == "" {
+		return nil, errors.New("identity must have a username or be anonymous")
+	}
+	for _, perm := range i.Permissions {
+		if !isCheckablePermission[perm] {
+			return nil, fmt.Errorf("%q is not a valid permission", perm)
+		}
+	}
+	return auth.NewSimulatedUserIdentity(i.UserName, i.Permissions), nil
+}
@@ -0,0 +1,172 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package authapi_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+
+	"github.com/sapcc/keppel/internal/keppel"
+	"github.com/sapcc/keppel/internal/test"
+)
+
+func TestAuthCheck(t *testing.T) {
+	s := setupPrimary(t)
+	h := s.Handler
+
+	test.MustExec(t, s.DB, `UPDATE accounts SET rbac_policies_json = $1 WHERE name = $2`, test.ToJSON([]keppel.RBACPolicy{
+		{
+			RepositoryPattern: "bar",
+			UserNamePattern:   "someone",
+			Permissions:       []keppel.RBACPermission{keppel.RBACPullPermission, keppel.RBACPushPermission},
+		},
+		{
+			RepositoryPattern: "ba+r",
+			Permissions:       []keppel.RBACPermission{keppel.RBACAnonymousPullPermission},
+		},
+		{
+			RepositoryPattern:    "foo",
+			UserNamePattern:      "some.*",
+			ForbiddenPermissions: []keppel.RBACPermission{keppel.RBACDeletePermission},
+		},
+	}), "test1")
+
+	someone := assert.JSONObject{
+		"username":    "someone",
+		"permissions": []string{"view", "pull", "delete"},
+	}
+
+	// checking requires permission to change the respective accounts
+	assert.HTTPRequest{
+		Method: "POST",
+		Path:   "/keppel/v1/auth/check",
+		Header: map[string]string{"X-Test-Perms": "view:test1authtenant,pull:test1authtenant"},
+		Body: assert.JSONObject{
+			"scopes":   []string{"repository:test1/foo:pull"},
+			"identity": someone,
+		},
+		ExpectStatus: http.StatusForbidden,
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method: "POST",
+		Path:   "/keppel/v1/auth/check",
+		Header: map[string]string{"X-Test-Perms": "change:test1authtenant"},
+		Body: assert.JSONObject{
+			"scopes":   []string{"repository:test1/foo:pull", "repository:test2/foo:pull"},
+			"identity": someone,
+		},
+		ExpectStatus: http.StatusForbidden,
+	}.Check(t, h)
+
+	// malformed requests
+	assert.HTTPRequest{
+		Method: "POST",
+		Path:   "/keppel/v1/auth/check",
+		Header: map[string]string{"X-Test-Perms": "change:test1authtenant"},
+		Body: assert.JSONObject{
+			"scopes":   []string{"registry:catalog:*"},
+			"identity": someone,
+		},
+		ExpectStatus: http.StatusUnprocessableEntity,
+		ExpectBody:   assert.StringData("scope \"registry:catalog:*\" is not supported (only repository scopes of the form \"repository:<account>/<repo>:<actions>\" can be checked)\n"),
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method: "POST",
+		Path:   "/keppel/v1/auth/check",
+		Header: map[string]string{"X-Test-Perms": "change:test1authtenant"},
+		Body: assert.JSONObject{
+			"scopes":   []string{"repository:test1/foo:pull"},
+			"identity": assert.JSONObject{"permissions": []string{"pull"}},
+		},
+		ExpectStatus: http.StatusUnprocessableEntity,
+		ExpectBody:   assert.StringData("identity must have a username or be anonymous\n"),
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method: "POST",
+		Path:   "/keppel/v1/auth/check",
+		Header: map[string]string{"X-Test-Perms": "change:test1authtenant"},
+		Body: assert.JSONObject{
+			"scopes":   []string{"repository:test1/foo:pull"},
+			"identity": assert.JSONObject{"username": "someone", "permissions": []string{"change"}},
+		},
+		ExpectStatus: http.StatusUnprocessableEntity,
+		ExpectBody:   assert.StringData("\"change\" is not a valid permission\n"),
+	}.Check(t, h)
+
+	// allowed and denied actions through the user's own permissions, and an RBAC policy forbidding an action
+	assert.HTTPRequest{
+		Method: "POST",
+		Path:   "/keppel/v1/auth/check",
+		Header: map[string]string{"X-Test-Perms": "change:test1authtenant"},
+		Body: assert.JSONObject{
+			"scopes":   []string{"repository:test1/foo:pull,push,delete"},
+			"identity": someone,
+		},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"results": []assert.JSONObject{{
+				"scope":           "repository:test1/foo:pull,push,delete",
+				"granted_actions": []string{"pull"},
+				"decisions": []assert.JSONObject{
+					{"action": "pull", "granted": true, "reason": `granted by the user's "pull" permission for the auth tenant of this account`},
+					{"action": "push", "granted": false, "reason": `the user does not have the "push" permission for the auth tenant of this account`},
+					{"action": "delete", "granted": false, "reason": "forbidden by rbac_policies[2]"},
+				},
+			}},
+		},
+	}.Check(t, h)
+
+	// RBAC-granted actions, for a regular user and for an anonymous user
+	assert.HTTPRequest{
+		Method: "POST",
+		Path:   "/keppel/v1/auth/check",
+		Header: map[string]string{"X-Test-Perms": "change:test1authtenant"},
+		Body: assert.JSONObject{
+			"scopes":   []string{"repository:test1/bar:pull,push"},
+			"identity": someone,
+		},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"results": []assert.JSONObject{{
+				"scope":           "repository:test1/bar:pull,push",
+				"granted_actions": []string{"pull", "push"},
+				"decisions": []assert.JSONObject{
+					{"action": "pull", "granted": true, "reason": `granted through "anonymous_pull" by rbac_policies[1]`},
+					{"action": "push", "granted": true, "reason": "granted by rbac_policies[0]"},
+				},
+			}},
+		},
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method: "POST",
+		Path:   "/keppel/v1/auth/check",
+		Header: map[string]string{"X-Test-Perms": "change:test1authtenant"},
+		Body: assert.JSONObject{
+			"scopes":   []string{"repository:test1/bar:pull,push", "repository:test1/foo:pull"},
+			"identity": assert.JSONObject{"anonymous": true},
+		},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"results": []assert.JSONObject{
+				{
+					"scope":           "repository:test1/bar:pull,push",
+					"granted_actions": []string{"pull"},
+					"decisions": []assert.JSONObject{
+						{"action": "pull", "granted": true, "reason": `granted through "anonymous_pull" by rbac_policies[1]`},
+						{"action": "push", "granted": false, "reason": "anonymous users can only obtain access through RBAC policies"},
+					},
+				},
+				{
+					"scope":           "repository:test1/foo:pull",
+					"granted_actions": []string{},
+					"decisions": []assert.JSONObject{
+						{"action": "pull", "granted": false, "reason": "anonymous users can only obtain access through RBAC policies"},
+					},
+				},
+			},
+		},
+	}.Check(t, h)
+}
@@ -4,15 +4,19 @@
 package authapi
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
+	"regexp"
 
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/sapcc/go-bits/httpapi"
 	"github.com/sapcc/go-bits/respondwith"
 
+	"github.com/sapcc/keppel/internal/auth"
 	"github.com/sapcc/keppel/internal/keppel"
 	"github.com/sapcc/keppel/internal/models"
 )
@@ -37,6 +41,17 @@ func (a *API) handlePostPeering(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// check that the request is well-formed (in particular, since the claimed
+	// hostname ends up in a URL below, it must be a plain hostname)
+	if !peerHostNameRx.MatchString(req.PeerHostName) {
+		http.Error(w, "malformed peer hostname", http.StatusBadRequest)
+		return
+	}
+	if req.Password == "" {
+		http.Error(w, "missing password", http.StatusBadRequest)
+		return
+	}
+
 	// check that these credentials are intended for us
 	if req.UserName != "replication@"+a.cfg.APIPublicHostname {
 		http.Error(w, "wrong audience", http.StatusBadRequest)
@@ -54,24 +69,17 @@ func (a *API) handlePostPeering(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// check that these credentials work
-	authURL := fmt.Sprintf("https://%s/keppel/v1/auth?service=%[1]s", req.PeerHostName)
-	authReq, err := http.NewRequestWithContext(r.Context(), http.MethodGet, authURL, http.NoBody)
-	if respondwith.ObfuscatedErrorText(w, err) {
-		return
-	}
-	authReq.Header.Set("Authorization", keppel.BuildBasicAuthHeader(req.UserName, req.Password))
-
-	authResp, err := http.DefaultClient.Do(authReq)
+	// Anyone can send this request and claim to be one of our peers, so we call
+	// back to the claimed peer to check that it has actually issued these
+	// credentials. A 200 response alone is not enough for that, since the peer
+	// might accept the credentials as those of a regular user: The token that we
+	// receive must grant access to the peer API, which the peer only ever
+	// grants to peer users.
+	err = verifyPeerCredentials(r.Context(), req)
 	if err != nil {
 		http.Error(w, "could not validate credentials: "+err.Error(), http.StatusUnauthorized)
 		return
 	}
-	defer authResp.Body.Close()
-	if authResp.StatusCode != http.StatusOK {
-		http.Error(w, "could not validate credentials: expected 200 OK, but got "+authResp.Status, http.StatusUnauthorized)
-		return
-	}
 
 	// update database
 	_, err = a.db.Exec(
@@ -84,3 +92,62 @@ func (a *API) handlePostPeering(w http.ResponseWriter, r *http.Request) {
 
 	w.WriteHeader(http.StatusNoContent)
 }
+
+// Matches a plain DNS hostname (without port, path, userinfo etc.).
+var peerHostNameRx = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?)*\.?$`)
+
+// The client used for the callback verification. It does not follow
+// redirects, since the credentials must be confirmed by the claimed peer
+// itself.
+var peerCallbackClient = &http.Client{
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+func verifyPeerCredentials(ctx context.Context, req PeeringRequest) error {
+	authURL := fmt.Sprintf("https://%s/keppel/v1/auth?service=%[1]s&scope=%[2]s", req.PeerHostName, auth.PeerAPIScope)
+	authReq, err := http.NewRequestWithContext(ctx, http.MethodGet, authURL, http.NoBody)
+	if err != nil {
+		return err
+	}
+	authReq.Header.Set("Authorization", keppel.BuildBasicAuthHeader(req.UserName, req.Password))
+
+	authResp, err := peerCallbackClient.Do(authReq)
+	if err != nil {
+		return err
+	}
+	defer authResp.Body.Close()
+	if authResp.StatusCode != http.StatusOK {
+		return errors.New("expected 200 OK, but got " + authResp.Status)
+	}
+
+	var data struct {
+		Token string `json:"token"`
+	}
+	err = json.NewDecoder(authResp.Body).Decode(&data)
+	if err != nil {
+		return fmt.Errorf("cannot decode token response: %w", err)
+	}
+
+	// We cannot verify the token's signature since we do not know the peer's
+	// issuer key. This is fine because we got the token directly from the peer
+	// via HTTPS; we only need to look at what the peer has granted.
+	var claims struct {
+		jwt.RegisteredClaims
+		Access []auth.Scope `json:"access"`
+	}
+	_, _, err = jwt.NewParser().ParseUnverified(data.Token, &claims)
+	if err != nil {
+		return fmt.Errorf("cannot parse token: %w", err)
+	}
+	if claims.Subject != req.UserName {
+		return fmt.Errorf("expected token for %q, but got token for %q", req.UserName, claims.Subject)
+	}
+	for _, scope := range claims.Access {
+		if scope.Contains(auth.PeerAPIScope) {
+			return nil
+		}
+	}
+	return errors.New("peer did not grant access to its peer API")
+}
@@ -5,13 +5,14 @@ package authapi_test
 
 import (
 	"net/http"
-	"net/url"
 	"testing"
 
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/sapcc/go-bits/assert"
 	"github.com/sapcc/go-bits/easypg"
 	"github.com/sapcc/go-bits/respondwith"
 
+	"github.com/sapcc/keppel/internal/auth"
 	"github.com/sapcc/keppel/internal/models"
 	"github.com/sapcc/keppel/internal/test"
 )
@@ -29,8 +30,7 @@ func TestPeeringAPI(t *testing.T) {
 		// validate the supplied credentials by calling the peer's auth API - this is
 		// a mock implementation for this
 		expectedAuthHeader := "Basic cmVwbGljYXRpb25AcmVnaXN0cnkuZXhhbXBsZS5vcmc6c3VwZXJzZWNyZXQ="
-		expectedQuery := url.Values{}
-		expectedQuery.Set("service", "peer.example.org")
+		grantPeerAPIAccess := true
 		tt.Handlers["peer.example.org"] = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			if r.URL.Path != "/keppel/v1/auth" {
 				http.Error(w, "not found", http.StatusNotFound)
@@ -44,7 +44,19 @@ func TestPeeringAPI(t *testing.T) {
 				http.Error(w, "wrong Authorization header", http.StatusUnauthorized)
 				return
 			}
-			respondwith.JSON(w, http.StatusOK, map[string]string{"token": "dummy"})
+			access := []auth.Scope{}
+			if grantPeerAPIAccess && r.URL.Query().Get("scope") == auth.PeerAPIScope.String() {
+				access = append(access, auth.PeerAPIScope)
+			}
+			token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+				"sub":    "replication@registry.example.org",
+				"access": access,
+			})
+			tokenStr, err := token.SignedString([]byte("peer-secret"))
+			if respondwith.ObfuscatedErrorText(w, err) {
+				return
+			}
+			respondwith.JSON(w, http.StatusOK, map[string]string{"token": tokenStr})
 		})
 
 		// error cases
@@ -84,6 +96,53 @@ func TestPeeringAPI(t *testing.T) {
 			ExpectBody:   assert.StringData("could not validate credentials: expected 200 OK, but got 401 Unauthorized\n"),
 		}.Check(t, h)
 
+		assert.HTTPRequest{
+			Method: "POST",
+			Path:   "/keppel/v1/auth/peering",
+			Body: assert.JSONObject{
+				"peer":     "peer.example.org/evil?", // not a plain hostname
+				"username": "replication@registry.example.org",
+				"password": "supersecret",
+			},
+			ExpectStatus: http.StatusBadRequest,
+			ExpectBody:   assert.StringData("malformed peer hostname\n"),
+		}.Check(t, h)
+
+		// spoofed hostname: someone else claims to be a different registered
+		// peer, but that peer has not issued these credentials
+		test.MustDo(t, s.DB.Insert(&models.Peer{HostName: "other-peer.example.org"}))
+		tt.Handlers["other-peer.example.org"] = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+		})
+		assert.HTTPRequest{
+			Method: "POST",
+			Path:   "/keppel/v1/auth/peering",
+			Body: assert.JSONObject{
+				"peer":     "other-peer.example.org",
+				"username": "replication@registry.example.org",
+				"password": "supersecret",
+			},
+			ExpectStatus: http.StatusUnauthorized,
+			ExpectBody:   assert.StringData("could not validate credentials: expected 200 OK, but got 401 Unauthorized\n"),
+		}.Check(t, h)
+		_, err := s.DB.Exec(`DELETE FROM peers WHERE hostname = $1`, "other-peer.example.org")
+		test.MustDo(t, err)
+
+		// credentials that the peer accepts, but not as those of a peer user
+		grantPeerAPIAccess = false
+		assert.HTTPRequest{
+			Method: "POST",
+			Path:   "/keppel/v1/auth/peering",
+			Body: assert.JSONObject{
+				"peer":     "peer.example.org",
+				"username": "replication@registry.example.org",
+				"password": "supersecret",
+			},
+			ExpectStatus: http.StatusUnauthorized,
+			ExpectBody:   assert.StringData("could not validate credentials: peer did not grant access to its peer API\n"),
+		}.Check(t, h)
+		grantPeerAPIAccess = true
+
 		// error cases should not touch the DB
 		easypg.AssertDBContent(t, s.DB.Db, "fixtures/before-peering.sql")
 
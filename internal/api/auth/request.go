@@ -26,6 +26,14 @@ func parseRequest(rawQuery string, cfg keppel.Configuration) (Request, error) {
 		return Request{}, fmt.Errorf("cannot parse query string: %s", err.Error())
 	}
 
+	// this check comes before parsing the scopes to avoid wasting time on
+	// absurdly large requests, and also before any special handling of anycast
+	// requests, so that peers never see such requests either
+	maxScopes := cfg.EffectiveMaxScopesPerToken()
+	if len(query["scope"]) > maxScopes {
+		return Request{}, fmt.Errorf("cannot issue tokens for more than %d scopes at once", maxScopes)
+	}
+
 	offlineToken, err := strconv.ParseBool(query.Get("offline_token"))
 	result := Request{
 		ClientID:     query.Get("client_id"),
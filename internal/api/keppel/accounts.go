@@ -5,28 +5,58 @@ package keppelv1
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
+	. "github.com/majewsky/gg/option"
 	"github.com/sapcc/go-api-declarations/cadf"
 	"github.com/sapcc/go-bits/audittools"
 	"github.com/sapcc/go-bits/errext"
 	"github.com/sapcc/go-bits/httpapi"
 	"github.com/sapcc/go-bits/respondwith"
 
+	"github.com/sapcc/keppel/internal/auth"
 	"github.com/sapcc/keppel/internal/keppel"
 	"github.com/sapcc/keppel/internal/models"
+	"github.com/sapcc/keppel/internal/processor"
 )
 
 const SubleaseHeader = "X-Keppel-Sublease-Token"
 
 func (a *API) handleGetAccounts(w http.ResponseWriter, r *http.Request) {
 	httpapi.IdentifyEndpoint(r, "/keppel/v1/accounts")
+	filterSQL, filterBindValues, err := parseAccountReplicationFilters(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// the SQL query does not have a LIMIT since authorization and label filters
+	// can only be applied afterwards; pagination happens on the filtered list
+	query, bindValues, limit, err := paginatedQuery{
+		SQL:         fmt.Sprintf("SELECT * FROM accounts WHERE %s AND $CONDITION ORDER BY name", filterSQL),
+		MarkerField: "name",
+		Options:     r.URL.Query(),
+		BindValues:  filterBindValues,
+	}.Prepare()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	labelFilters, err := parseAccountLabelFilters(r.URL.Query()["label"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	var accounts []models.Account
-	_, err := a.db.Select(&accounts, "SELECT * FROM accounts ORDER BY name")
+	_, err = a.db.Select(&accounts, query, bindValues...)
 	if respondwith.ObfuscatedErrorText(w, err) {
 		return
 	}
@@ -41,27 +71,119 @@ func (a *API) handleGetAccounts(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// restrict accounts to those visible in the current scope
+	// restrict accounts to those visible in the current scope (and those matching the filters, if any)
 	var accountsFiltered []models.Account
 	for idx, account := range accounts {
-		if authz.ScopeSet.Contains(*scopes[idx]) {
-			accountsFiltered = append(accountsFiltered, account)
+		if !authz.ScopeSet.Contains(*scopes[idx]) {
+			continue
+		}
+		if len(labelFilters) > 0 {
+			labels, err := keppel.ParseAccountLabels(account.LabelsJSON)
+			if respondwith.ObfuscatedErrorText(w, err) {
+				return
+			}
+			if !labelFilters.Matches(labels) {
+				continue
+			}
 		}
+		accountsFiltered = append(accountsFiltered, account)
 	}
 	// ensure that this serializes as a list, not as null
 	if len(accountsFiltered) == 0 {
 		accountsFiltered = []models.Account{}
 	}
 
+	// the result is only paginated if the client asks for it
+	isTruncated := false
+	if r.URL.Query().Has("limit") && uint64(len(accountsFiltered)) > limit {
+		accountsFiltered = accountsFiltered[0:limit]
+		isTruncated = true
+	}
+
 	// render accounts to JSON
-	accountsRendered := make([]keppel.Account, len(accountsFiltered))
+	var result struct {
+		Accounts    []keppel.Account `json:"accounts"`
+		IsTruncated bool             `json:"truncated,omitempty"`
+	}
+	result.Accounts = make([]keppel.Account, len(accountsFiltered))
+	result.IsTruncated = isTruncated
 	for idx, account := range accountsFiltered {
-		accountsRendered[idx], err = keppel.RenderAccount(account)
+		result.Accounts[idx], err = keppel.RenderAccount(account)
 		if respondwith.ObfuscatedErrorText(w, err) {
 			return
 		}
 	}
-	respondwith.JSON(w, http.StatusOK, map[string]any{"accounts": accountsRendered})
+	respondwith.JSON(w, http.StatusOK, result)
+}
+
+// parseAccountReplicationFilters parses the "replication" and "upstream_peer"
+// query parameters in GET /keppel/v1/accounts into an SQL condition on the
+// accounts table. The semantics of these filters match the replication policy
+// as rendered by keppel.RenderReplicationPolicy().
+func parseAccountReplicationFilters(query url.Values) (condition string, bindValues []any, err error) {
+	conditions := []string{"TRUE"}
+
+	if query.Has("replication") {
+		switch strategy := keppel.ReplicationStrategy(query.Get("replication")); strategy {
+		case keppel.OnFirstUseStrategy:
+			conditions = append(conditions, "upstream_peer_hostname != ''")
+		case keppel.FromExternalOnFirstUseStrategy:
+			conditions = append(conditions, "upstream_peer_hostname = '' AND external_peer_url != ''")
+		default:
+			return "", nil, fmt.Errorf("invalid value for replication filter: %q", strategy)
+		}
+	}
+
+	if query.Has("upstream_peer") {
+		hostName := query.Get("upstream_peer")
+		if hostName == "" {
+			return "", nil, errors.New("invalid value for upstream_peer filter: \"\"")
+		}
+		bindValues = append(bindValues, hostName)
+		conditions = append(conditions, fmt.Sprintf("upstream_peer_hostname = $%d", len(bindValues)))
+	}
+
+	return strings.Join(conditions, " AND "), bindValues, nil
+}
+
+// accountLabelFilters contains the parsed form of the "label" query parameters
+// in GET /keppel/v1/accounts. Each filter is either "key:value" (the label must
+// have exactly this value) or "key" (the label must exist with any value).
+type accountLabelFilters []accountLabelFilter
+
+type accountLabelFilter struct {
+	Key   string
+	Value Option[string]
+}
+
+func parseAccountLabelFilters(inputs []string) (accountLabelFilters, error) {
+	result := make(accountLabelFilters, len(inputs))
+	for idx, input := range inputs {
+		key, value, hasValue := strings.Cut(input, ":")
+		if key == "" {
+			return nil, fmt.Errorf("malformed label filter: %q", input)
+		}
+		result[idx].Key = key
+		if hasValue {
+			result[idx].Value = Some(value)
+		}
+	}
+	return result, nil
+}
+
+// Matches returns whether the given set of labels satisfies all filters.
+func (f accountLabelFilters) Matches(labels map[string]string) bool {
+	for _, filter := range f {
+		actual, exists := labels[filter.Key]
+		if !exists {
+			return false
+		}
+		expected, ok := filter.Value.Unpack()
+		if ok && actual != expected {
+			return false
+		}
+	}
+	return true
 }
 
 func (a *API) handleGetAccount(w http.ResponseWriter, r *http.Request) {
@@ -97,14 +219,8 @@ func (a *API) handlePutAccount(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, `changing attribute "account.name" in request body is not allowed`, http.StatusUnprocessableEntity)
 		return
 	}
-	// ... or state ...
-	if req.Account.State != "" {
-		http.Error(w, `malformed attribute "account.state" in request body is not allowed here`, http.StatusUnprocessableEntity)
-		return
-	}
-	// ... or metadata ...
-	if req.Account.Metadata != nil && len(*req.Account.Metadata) > 0 {
-		http.Error(w, `malformed attribute "account.metadata" in request body does no longer exist`, http.StatusUnprocessableEntity)
+	// ... or state or metadata ...
+	if !checkAccountReadOnlyAttributes(w, req.Account) {
 		return
 	}
 	// ... and transfer the name here into the struct, to make the below code simpler
@@ -116,6 +232,64 @@ func (a *API) handlePutAccount(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// the upstream of external replica accounts is validated unless explicitly disabled
+	// (e.g. because the upstream is intentionally offline while the account is created)
+	opts := processor.CreateOrUpdateAccountOptions{ValidateUpstream: true}
+	if str := r.URL.Query().Get("validate_upstream"); str != "" {
+		var err error
+		opts.ValidateUpstream, err = strconv.ParseBool(str)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid value for validate_upstream: %q", str), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// conflicts between GC and tag policies are rejected unless explicitly allowed,
+	// in which case they are reported as warnings instead
+	if str := r.URL.Query().Get("allow_policy_conflicts"); str != "" {
+		var err error
+		opts.AllowPolicyConflicts, err = strconv.ParseBool(str)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid value for allow_policy_conflicts: %q", str), http.StatusBadRequest)
+			return
+		}
+	}
+
+	account, ok := a.createOrUpdateAccountFromRequest(w, r, authz, req.Account, opts)
+	if !ok {
+		return
+	}
+
+	accountRendered, err := keppel.RenderAccount(account)
+	if respondwith.ObfuscatedErrorText(w, err) {
+		return
+	}
+	result := map[string]any{"account": accountRendered}
+	if warnings := keppel.FindPolicyConflicts(accountRendered.GCPolicies, accountRendered.TagPolicies); len(warnings) > 0 {
+		result["warnings"] = warnings
+	}
+	respondwith.JSON(w, http.StatusOK, result)
+}
+
+// checkAccountReadOnlyAttributes rejects request bodies for PUT /keppel/v1/accounts/:name
+// and POST /keppel/v1/accounts/:name/_import that try to set attributes which
+// cannot be changed through the API.
+func checkAccountReadOnlyAttributes(w http.ResponseWriter, account keppel.Account) bool {
+	if account.State != "" {
+		http.Error(w, `malformed attribute "account.state" in request body is not allowed here`, http.StatusUnprocessableEntity)
+		return false
+	}
+	if account.Metadata != nil && len(*account.Metadata) > 0 {
+		http.Error(w, `malformed attribute "account.metadata" in request body does no longer exist`, http.StatusUnprocessableEntity)
+		return false
+	}
+	return true
+}
+
+// createOrUpdateAccountFromRequest applies the account configuration from a
+// request to PUT /keppel/v1/accounts/:name or POST /keppel/v1/accounts/:name/_import.
+// If false is returned, an error response has been written.
+func (a *API) createOrUpdateAccountFromRequest(w http.ResponseWriter, r *http.Request, authz *auth.Authorization, account keppel.Account, opts processor.CreateOrUpdateAccountOptions) (models.Account, bool) {
 	getSubleaseTokenCallback := func(_ models.Peer) (keppel.SubleaseToken, error) {
 		t, err := keppel.ParseSubleaseToken(r.Header.Get(SubleaseHeader))
 		if err != nil {
@@ -129,17 +303,12 @@ func (a *API) handlePutAccount(w http.ResponseWriter, r *http.Request) {
 		}
 		return nil
 	}
-	account, rerr := a.processor().CreateOrUpdateAccount(r.Context(), req.Account, authz.UserIdentity.UserInfo(), r, getSubleaseTokenCallback, finalizeAccountCallback)
+	dbAccount, rerr := a.processor().CreateOrUpdateAccount(r.Context(), account, authz.UserIdentity.UserInfo(), r, opts, getSubleaseTokenCallback, finalizeAccountCallback)
 	if rerr != nil {
 		rerr.WriteAsTextTo(w)
-		return
-	}
-
-	accountRendered, err := keppel.RenderAccount(account)
-	if respondwith.ObfuscatedErrorText(w, err) {
-		return
+		return models.Account{}, false
 	}
-	respondwith.JSON(w, http.StatusOK, map[string]any{"account": accountRendered})
+	return dbAccount, true
 }
 
 func (a *API) handleDeleteAccount(w http.ResponseWriter, r *http.Request) {
@@ -239,16 +408,33 @@ func (a *API) handlePutSecurityScanPolicies(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	// validate policies
+	errs := validateSecurityScanPolicies(req.Policies, dbPolicies, authz.UserIdentity.UserName())
+	if !errs.IsEmpty() {
+		http.Error(w, errs.Join("\n"), http.StatusUnprocessableEntity)
+		return
+	}
+
+	// update policies in DB
+	err = a.updateSecurityScanPolicies(r, authz, *account, dbPolicies, req.Policies)
+	if respondwith.ObfuscatedErrorText(w, err) {
+		return
+	}
+
+	respondwith.JSON(w, http.StatusOK, map[string]any{"policies": req.Policies})
+}
+
+// Applies computed values in the given policies, and validates them. Policies
+// managed by users other than the requester may not be created, updated or deleted.
+func validateSecurityScanPolicies(policies, dbPolicies []keppel.SecurityScanPolicy, currentUserName string) (errs errext.ErrorSet) {
 	// apply computed values and validate each input policy on its own
-	currentUserName := authz.UserIdentity.UserName()
-	var errs errext.ErrorSet
-	for idx, policy := range req.Policies {
+	for idx, policy := range policies {
 		path := fmt.Sprintf("policies[%d]", idx)
 		errs.Append(policy.Validate(path))
 
 		switch policy.ManagingUserName {
 		case "$REQUESTER":
-			req.Policies[idx].ManagingUserName = currentUserName
+			policies[idx].ManagingUserName = currentUserName
 		case "", currentUserName:
 			// acceptable
 		default:
@@ -261,7 +447,7 @@ func (a *API) handlePutSecurityScanPolicies(w http.ResponseWriter, r *http.Reque
 	// check that updated or deleted policies are either unmanaged or managed by
 	// the requester
 	for _, dbPolicy := range dbPolicies {
-		if slices.Contains(req.Policies, dbPolicy) {
+		if slices.Contains(policies, dbPolicy) {
 			continue
 		}
 		managingUserName := dbPolicy.ManagingUserName
@@ -269,22 +455,20 @@ func (a *API) handlePutSecurityScanPolicies(w http.ResponseWriter, r *http.Reque
 			errs.Addf("cannot update or delete this existing policy that is managed by a different user: %s", dbPolicy)
 		}
 	}
+	return errs
+}
 
-	// report validation errors
-	if !errs.IsEmpty() {
-		http.Error(w, errs.Join("\n"), http.StatusUnprocessableEntity)
-		return
-	}
-
-	// update policies in DB
-	jsonBuf, err := json.Marshal(req.Policies)
-	if respondwith.ObfuscatedErrorText(w, err) {
-		return
+// Replaces the security scan policies of the given account, and generates audit events for the changes.
+// The policies must have been validated with validateSecurityScanPolicies() beforehand.
+func (a *API) updateSecurityScanPolicies(r *http.Request, authz *auth.Authorization, account models.Account, dbPolicies, policies []keppel.SecurityScanPolicy) error {
+	jsonBuf, err := json.Marshal(policies)
+	if err != nil {
+		return err
 	}
 	_, err = a.db.Exec(`UPDATE accounts SET security_scan_policies_json = $1 WHERE name = $2`,
 		string(jsonBuf), account.Name)
-	if respondwith.ObfuscatedErrorText(w, err) {
-		return
+	if err != nil {
+		return err
 	}
 
 	// generate audit events
@@ -300,22 +484,21 @@ func (a *API) handlePutSecurityScanPolicies(w http.ResponseWriter, r *http.Reque
 			})
 		}
 	}
-	for _, policy := range req.Policies {
+	for _, policy := range policies {
 		if !slices.Contains(dbPolicies, policy) {
 			submitAudit("create/security-scan-policy", AuditSecurityScanPolicy{
-				Account: *account,
+				Account: account,
 				Policy:  policy,
 			})
 		}
 	}
 	for _, policy := range dbPolicies {
-		if !slices.Contains(req.Policies, policy) {
+		if !slices.Contains(policies, policy) {
 			submitAudit("delete/security-scan-policy", AuditSecurityScanPolicy{
-				Account: *account,
+				Account: account,
 				Policy:  policy,
 			})
 		}
 	}
-
-	respondwith.JSON(w, http.StatusOK, map[string]any{"policies": req.Policies})
+	return nil
 }
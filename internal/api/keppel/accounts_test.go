@@ -14,6 +14,7 @@ import (
 	"github.com/sapcc/go-api-declarations/cadf"
 	"github.com/sapcc/go-bits/assert"
 	"github.com/sapcc/go-bits/easypg"
+	"github.com/sapcc/go-bits/respondwith"
 
 	keppelv1 "github.com/sapcc/keppel/internal/api/keppel"
 	"github.com/sapcc/keppel/internal/keppel"
@@ -555,6 +556,250 @@ func TestAccountValidationPolicies(t *testing.T) {
 	}.Check(t, h)
 }
 
+func TestAccountLabels(t *testing.T) {
+	s := test.NewSetup(t, test.WithKeppelAPI)
+	h := s.Handler
+
+	// create accounts with different labels
+	accountLabels := map[string]assert.JSONObject{
+		"first":  {"env": "prod", "owner": "team-a@example.org"},
+		"second": {"env": "staging", "owner": "team-a@example.org"},
+		"third":  {"env": "prod"},
+	}
+	for _, name := range []string{"first", "second", "third"} {
+		assert.HTTPRequest{
+			Method: "PUT",
+			Path:   "/keppel/v1/accounts/" + name,
+			Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+			Body: assert.JSONObject{
+				"account": assert.JSONObject{
+					"auth_tenant_id": "tenant1",
+					"labels":         accountLabels[name],
+				},
+			},
+			ExpectStatus: http.StatusOK,
+			ExpectBody: assert.JSONObject{
+				"account": assert.JSONObject{
+					"name":           name,
+					"auth_tenant_id": "tenant1",
+					"metadata":       nil,
+					"rbac_policies":  []assert.JSONObject{},
+					"labels":         accountLabels[name],
+				},
+			},
+		}.Check(t, h)
+	}
+
+	// labels are shown on GET
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/first",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"account": assert.JSONObject{
+				"name":           "first",
+				"auth_tenant_id": "tenant1",
+				"metadata":       nil,
+				"rbac_policies":  []assert.JSONObject{},
+				"labels":         accountLabels["first"],
+			},
+		},
+	}.Check(t, h)
+
+	// the account list can be filtered by labels
+	testCases := map[string][]string{
+		"?label=env:prod": {"first", "third"},
+		"?label=owner":    {"first", "second"},
+		"?label=env:prod&label=owner:team-a@example.org": {"first"},
+		"?label=env:development":                         {},
+		"?label=cost-center":                             {},
+	}
+	for query, expectedNames := range testCases {
+		expectedAccounts := make([]assert.JSONObject, len(expectedNames))
+		for idx, name := range expectedNames {
+			expectedAccounts[idx] = assert.JSONObject{
+				"name":           name,
+				"auth_tenant_id": "tenant1",
+				"metadata":       nil,
+				"rbac_policies":  []assert.JSONObject{},
+				"labels":         accountLabels[name],
+			}
+		}
+		assert.HTTPRequest{
+			Method:       "GET",
+			Path:         "/keppel/v1/accounts" + query,
+			Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+			ExpectStatus: http.StatusOK,
+			ExpectBody:   assert.JSONObject{"accounts": expectedAccounts},
+		}.Check(t, h)
+	}
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts?label=:prod",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: http.StatusBadRequest,
+		ExpectBody:   assert.StringData("malformed label filter: \":prod\"\n"),
+	}.Check(t, h)
+
+	// labels can be removed by omitting them
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/keppel/v1/accounts/third",
+		Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body: assert.JSONObject{
+			"account": assert.JSONObject{
+				"auth_tenant_id": "tenant1",
+			},
+		},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"account": assert.JSONObject{
+				"name":           "third",
+				"auth_tenant_id": "tenant1",
+				"metadata":       nil,
+				"rbac_policies":  []assert.JSONObject{},
+			},
+		},
+	}.Check(t, h)
+
+	// invalid labels are rejected
+	invalidLabelsTestCases := []struct {
+		Labels       assert.JSONObject
+		ErrorMessage string
+	}{
+		{assert.JSONObject{"env:prod": "yes"}, `invalid label key: "env:prod"`},
+		{assert.JSONObject{"-env": "prod"}, `invalid label key: "-env"`},
+		{assert.JSONObject{"env": "prod\n"}, `value for label "env" contains non-printable characters`},
+		{assert.JSONObject{"env": strings.Repeat("x", 256)}, `value for label "env" is too long (must be at most 255 bytes)`},
+	}
+	for _, tc := range invalidLabelsTestCases {
+		_, body := assert.HTTPRequest{
+			Method: "PUT",
+			Path:   "/keppel/v1/accounts/first",
+			Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+			Body: assert.JSONObject{
+				"account": assert.JSONObject{
+					"auth_tenant_id": "tenant1",
+					"labels":         tc.Labels,
+				},
+			},
+			ExpectStatus: http.StatusUnprocessableEntity,
+		}.Check(t, h)
+		if !strings.HasPrefix(string(body), tc.ErrorMessage) {
+			t.Errorf("expected error message to start with %q, but got %q", tc.ErrorMessage, string(body))
+		}
+	}
+}
+
+func TestGetAccountsReplicationFilter(t *testing.T) {
+	s := test.NewSetup(t,
+		test.WithKeppelAPI,
+		test.WithAccount(models.Account{Name: "primary", AuthTenantID: "tenant1"}),
+		test.WithAccount(models.Account{Name: "replica1", AuthTenantID: "tenant1", UpstreamPeerHostName: "peer1.example.org"}),
+		test.WithAccount(models.Account{Name: "replica2", AuthTenantID: "tenant1", UpstreamPeerHostName: "peer2.example.org"}),
+		test.WithAccount(models.Account{Name: "external", AuthTenantID: "tenant1", ExternalPeerURL: "registry.example.com/library", ExternalPeerUserName: "foo", ExternalPeerPassword: "bar"}),
+		// this account is not visible to the user, and must not affect pagination
+		test.WithAccount(models.Account{Name: "another", AuthTenantID: "tenant2"}),
+	)
+	h := s.Handler
+
+	renderedAccounts := map[string]assert.JSONObject{
+		"primary": {},
+		"replica1": {
+			"replication": assert.JSONObject{"strategy": "on_first_use", "upstream": "peer1.example.org"},
+		},
+		"replica2": {
+			"replication": assert.JSONObject{"strategy": "on_first_use", "upstream": "peer2.example.org"},
+		},
+		"external": {
+			"replication": assert.JSONObject{
+				"strategy": "from_external_on_first_use",
+				"upstream": assert.JSONObject{"url": "registry.example.com/library", "username": "foo"},
+			},
+		},
+	}
+	for name, rendered := range renderedAccounts {
+		rendered["name"] = name
+		rendered["auth_tenant_id"] = "tenant1"
+		rendered["metadata"] = nil
+		rendered["rbac_policies"] = []assert.JSONObject{}
+	}
+
+	testCases := map[string][]string{
+		"":                          {"external", "primary", "replica1", "replica2"},
+		"?replication=on_first_use": {"replica1", "replica2"},
+		"?replication=from_external_on_first_use":  {"external"},
+		"?upstream_peer=peer1.example.org":         {"replica1"},
+		"?upstream_peer=peer3.example.org":         {},
+		"?replication=on_first_use&label=env:prod": {},
+	}
+	for query, expectedNames := range testCases {
+		expectedAccounts := make([]assert.JSONObject, len(expectedNames))
+		for idx, name := range expectedNames {
+			expectedAccounts[idx] = renderedAccounts[name]
+		}
+		assert.HTTPRequest{
+			Method:       "GET",
+			Path:         "/keppel/v1/accounts" + query,
+			Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+			ExpectStatus: http.StatusOK,
+			ExpectBody:   assert.JSONObject{"accounts": expectedAccounts},
+		}.Check(t, h)
+	}
+
+	// the result is paginated
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts?limit=1",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"accounts":  []assert.JSONObject{renderedAccounts["external"]},
+			"truncated": true,
+		},
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts?limit=4",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{"accounts": []assert.JSONObject{
+			renderedAccounts["external"], renderedAccounts["primary"], renderedAccounts["replica1"], renderedAccounts["replica2"],
+		}},
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts?replication=on_first_use&limit=1&marker=replica1",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   assert.JSONObject{"accounts": []assert.JSONObject{renderedAccounts["replica2"]}},
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts?upstream_peer=peer2.example.org&marker=replica1",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   assert.JSONObject{"accounts": []assert.JSONObject{renderedAccounts["replica2"]}},
+	}.Check(t, h)
+
+	// error cases
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts?replication=sometimes",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: http.StatusBadRequest,
+		ExpectBody:   assert.StringData("invalid value for replication filter: \"sometimes\"\n"),
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts?upstream_peer=",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: http.StatusBadRequest,
+		ExpectBody:   assert.StringData("invalid value for upstream_peer filter: \"\"\n"),
+	}.Check(t, h)
+}
+
 func TestGetAccountsErrorCases(t *testing.T) {
 	s := test.NewSetup(t, test.WithKeppelAPI)
 	h := s.Handler
@@ -741,9 +986,9 @@ func TestPutAccountErrorCases(t *testing.T) {
 		ExpectBody:   assert.StringData("no permission for keppel_auth_tenant:tenant1:change\n"),
 	}.Check(t, h)
 
-	// test rejection by federation driver (we test both user error and server
-	// error to validate that they generate the correct respective HTTP status
-	// codes)
+	// test rejection by federation driver (we test user error, server error and
+	// lost races to validate that they generate the correct respective HTTP
+	// status codes)
 	s.FD.ClaimFailsBecauseOfUserError = true
 	assert.HTTPRequest{
 		Method: "PUT",
@@ -774,6 +1019,38 @@ func TestPutAccountErrorCases(t *testing.T) {
 	}.Check(t, h)
 	s.FD.ClaimFailsBecauseOfServerError = false
 
+	s.FD.ClaimFailsBecauseOfRaceLost = true
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/keppel/v1/accounts/second",
+		Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body: assert.JSONObject{
+			"account": assert.JSONObject{
+				"auth_tenant_id": "tenant1",
+			},
+		},
+		ExpectStatus: http.StatusConflict,
+		ExpectHeader: map[string]string{"Retry-After": "1"},
+		ExpectBody:   assert.StringData("concurrent claim on name \"second\", please retry\n"),
+	}.Check(t, h)
+	s.FD.ClaimFailsBecauseOfRaceLost = false
+
+	// test rejection by federation driver because of a reserved account name prefix
+	s.FD.AccountNameReservations = []keppel.AccountNameReservation{{Prefix: "sec", AuthTenantID: "tenant2"}}
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/keppel/v1/accounts/second",
+		Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body: assert.JSONObject{
+			"account": assert.JSONObject{
+				"auth_tenant_id": "tenant1",
+			},
+		},
+		ExpectStatus: http.StatusForbidden,
+		ExpectBody:   assert.StringData("account name second is reserved for a different auth tenant (reserved prefix: \"sec\")\n"),
+	}.Check(t, h)
+	s.FD.AccountNameReservations = nil
+
 	// test rejection by storage driver
 	s.SD.ForbidNewAccounts = true
 	assert.HTTPRequest{
@@ -956,6 +1233,35 @@ func TestPutAccountErrorCases(t *testing.T) {
 			},
 			ErrorMessage: `GC policy with action "delete" cannot set the "time_constraint.newest" attribute`,
 		},
+		{
+			GCPolicyJSON: assert.JSONObject{
+				"match_repository": "library/.*",
+				"match_tag":        "v.*",
+				"action":           "retain",
+			},
+			ErrorMessage: `GC policy with action "retain" must have the "retain_count" attribute`,
+		},
+		{
+			GCPolicyJSON: assert.JSONObject{
+				"match_repository": "library/.*",
+				"match_tag":        "v.*",
+				"time_constraint": assert.JSONObject{
+					"on":         "pushed_at",
+					"older_than": assert.JSONObject{"value": 1, "unit": "d"},
+				},
+				"action":       "retain",
+				"retain_count": 10,
+			},
+			ErrorMessage: `GC policy with action "retain" cannot have a time constraint`,
+		},
+		{
+			GCPolicyJSON: assert.JSONObject{
+				"match_repository": "library/.*",
+				"action":           "delete",
+				"retain_count":     10,
+			},
+			ErrorMessage: `GC policy with action "delete" cannot set the "retain_count" attribute`,
+		},
 	}
 	for _, tc := range gcPolicyTestcases {
 		expectedStatus := http.StatusUnprocessableEntity
@@ -1119,7 +1425,7 @@ func TestPutAccountErrorCases(t *testing.T) {
 				"match_repository": "*/library",
 				"permissions":      []string{"anonymous_pull"},
 			},
-			ErrorMessage: "request body is not valid JSON: \"*/library\" is not a valid regexp: error parsing regexp: missing argument to repetition operator: `*`",
+			ErrorMessage: "invalid \"match_repository\" attribute in RBAC policy: \"*/library\" is not a valid regexp: error parsing regexp: missing argument to repetition operator: `*`",
 		},
 		{
 			RBACPolicyJSON: assert.JSONObject{
@@ -1127,7 +1433,36 @@ func TestPutAccountErrorCases(t *testing.T) {
 				"match_username":   "[a-z]++@tenant2",
 				"permissions":      []string{"pull"},
 			},
-			ErrorMessage: "request body is not valid JSON: \"[a-z]++@tenant2\" is not a valid regexp: error parsing regexp: invalid nested repetition operator: `++`",
+			ErrorMessage: "invalid \"match_username\" attribute in RBAC policy: \"[a-z]++@tenant2\" is not a valid regexp: error parsing regexp: invalid nested repetition operator: `++`",
+		},
+		{
+			RBACPolicyJSON: assert.JSONObject{
+				"match_repository": "(library/)+(a{1000}){1000}",
+				"permissions":      []string{"anonymous_pull"},
+			},
+			ErrorMessage: "invalid \"match_repository\" attribute in RBAC policy: \"(library/)+(a{1000}){1000}\" is not a valid regexp: error parsing regexp: invalid repeat count: `{1000}`",
+		},
+		{
+			RBACPolicyJSON: assert.JSONObject{
+				"forbid_repository": "*-secret",
+				"permissions":       []string{"anonymous_pull"},
+			},
+			ErrorMessage: "invalid \"forbid_repository\" attribute in RBAC policy: \"*-secret\" is not a valid regexp: error parsing regexp: missing argument to repetition operator: `*`",
+		},
+		{
+			RBACPolicyJSON: assert.JSONObject{
+				"forbid_repository":     "secret-.*",
+				"match_username":        "foo",
+				"forbidden_permissions": []string{"pull"},
+			},
+			ErrorMessage: `RBAC policy with "forbid_repository" must grant at least one permission`,
+		},
+		{
+			RBACPolicyJSON: assert.JSONObject{
+				"match_repository": "([a-z]+/){0,500}",
+				"permissions":      []string{"anonymous_pull"},
+			},
+			ErrorMessage: `invalid "match_repository" attribute in RBAC policy: "([a-z]+/){0,500}" is too complex`,
 		},
 	}
 	for _, tc := range rbacPolicyTestcases {
@@ -1535,63 +1870,644 @@ func TestGetPutAccountReplicationOnFirstUse(t *testing.T) {
 }
 
 func TestGetPutAccountReplicationFromExternalOnFirstUse(t *testing.T) {
-	s := test.NewSetup(t, test.WithKeppelAPI)
-	h := s.Handler
+	test.WithRoundTripper(func(tt *test.RoundTripper) {
+		s := test.NewSetup(t, test.WithKeppelAPI)
+		h := s.Handler
+		tt.Handlers["registry.example.com"] = newFakeExternalRegistry("registry.example.com", "foo", "bar")
 
-	// test error cases on creation
-	assert.HTTPRequest{
-		Method: "PUT",
-		Path:   "/keppel/v1/accounts/first",
-		Header: map[string]string{"X-Test-Perms": "change:tenant1"},
-		Body: assert.JSONObject{
-			"account": assert.JSONObject{
-				"auth_tenant_id": "tenant1",
-				"replication": assert.JSONObject{
-					"strategy": "from_external_on_first_use",
-					"upstream": "registry.example.org",
-				},
-			},
-		},
-		ExpectStatus: http.StatusBadRequest,
-		ExpectBody:   assert.StringData("request body is not valid JSON: json: cannot unmarshal string into Go struct field Account.account.replication of type keppel.ReplicationExternalPeerSpec\n"),
-	}.Check(t, h)
-	assert.HTTPRequest{
-		Method: "PUT",
-		Path:   "/keppel/v1/accounts/first",
-		Header: map[string]string{"X-Test-Perms": "change:tenant1"},
-		Body: assert.JSONObject{
-			"account": assert.JSONObject{
-				"auth_tenant_id": "tenant1",
-				"replication": assert.JSONObject{
-					"strategy": "from_external_on_first_use",
-					"upstream": assert.JSONObject{
-						"not": "what-you-expect",
+		// test error cases on creation
+		assert.HTTPRequest{
+			Method: "PUT",
+			Path:   "/keppel/v1/accounts/first",
+			Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+			Body: assert.JSONObject{
+				"account": assert.JSONObject{
+					"auth_tenant_id": "tenant1",
+					"replication": assert.JSONObject{
+						"strategy": "from_external_on_first_use",
+						"upstream": "registry.example.org",
 					},
 				},
 			},
-		},
-		ExpectStatus: http.StatusUnprocessableEntity,
-		ExpectBody:   assert.StringData("missing upstream URL for \"from_external_on_first_use\" replication\n"),
-	}.Check(t, h)
-	assert.HTTPRequest{
-		Method: "PUT",
-		Path:   "/keppel/v1/accounts/first",
-		Header: map[string]string{"X-Test-Perms": "change:tenant1"},
-		Body: assert.JSONObject{
+			ExpectStatus: http.StatusBadRequest,
+			ExpectBody:   assert.StringData("request body is not valid JSON: json: cannot unmarshal string into Go struct field Account.account.replication of type keppel.ReplicationExternalPeerSpec\n"),
+		}.Check(t, h)
+		assert.HTTPRequest{
+			Method: "PUT",
+			Path:   "/keppel/v1/accounts/first",
+			Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+			Body: assert.JSONObject{
+				"account": assert.JSONObject{
+					"auth_tenant_id": "tenant1",
+					"replication": assert.JSONObject{
+						"strategy": "from_external_on_first_use",
+						"upstream": assert.JSONObject{
+							"not": "what-you-expect",
+						},
+					},
+				},
+			},
+			ExpectStatus: http.StatusUnprocessableEntity,
+			ExpectBody:   assert.StringData("missing upstream URL for \"from_external_on_first_use\" replication\n"),
+		}.Check(t, h)
+		assert.HTTPRequest{
+			Method: "PUT",
+			Path:   "/keppel/v1/accounts/first",
+			Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+			Body: assert.JSONObject{
+				"account": assert.JSONObject{
+					"auth_tenant_id": "tenant1",
+					"replication": assert.JSONObject{
+						"strategy": "from_external_on_first_use",
+						"upstream": assert.JSONObject{
+							"url":      "registry.example.com",
+							"username": "keks",
+						},
+					},
+				},
+			},
+			ExpectStatus: http.StatusUnprocessableEntity,
+			ExpectBody:   assert.StringData("need either both username and password or neither for \"from_external_on_first_use\" replication\n"),
+		}.Check(t, h)
+		assert.HTTPRequest{
+			Method: "PUT",
+			Path:   "/keppel/v1/accounts/first",
+			Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+			Body: assert.JSONObject{
+				"account": assert.JSONObject{
+					"auth_tenant_id": "tenant1",
+					"replication": assert.JSONObject{
+						"strategy": "from_external_on_first_use",
+						"upstream": assert.JSONObject{
+							"url":      "registry.example.com",
+							"password": "keks",
+						},
+					},
+				},
+			},
+			ExpectStatus: http.StatusUnprocessableEntity,
+			ExpectBody:   assert.StringData("need either both username and password or neither for \"from_external_on_first_use\" replication\n"),
+		}.Check(t, h)
+
+		// test PUT success case
+		testPlatformFilter := []assert.JSONObject{
+			{
+				"os":           "linux",
+				"architecture": "amd64",
+			},
+			{
+				"os":           "linux",
+				"architecture": "arm64",
+				"variant":      "v8",
+			},
+		}
+		assert.HTTPRequest{
+			Method: "PUT",
+			Path:   "/keppel/v1/accounts/first",
+			Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+			Body: assert.JSONObject{
+				"account": assert.JSONObject{
+					"auth_tenant_id": "tenant1",
+					"replication": assert.JSONObject{
+						"strategy": "from_external_on_first_use",
+						"upstream": assert.JSONObject{
+							"url": "registry.example.com",
+						},
+					},
+					"platform_filter": testPlatformFilter,
+				},
+			},
+			ExpectStatus: http.StatusOK,
+			ExpectBody: assert.JSONObject{
+				"account": assert.JSONObject{
+					"name":           "first",
+					"auth_tenant_id": "tenant1",
+					"metadata":       nil,
+					"rbac_policies":  []assert.JSONObject{},
+					"replication": assert.JSONObject{
+						"strategy": "from_external_on_first_use",
+						"upstream": assert.JSONObject{
+							"url": "registry.example.com",
+						},
+					},
+					"platform_filter": testPlatformFilter,
+				},
+			},
+		}.Check(t, h)
+
+		// PUT on existing account with replication unspecified is okay, leaves
+		// replication settings unchanged
+		assert.HTTPRequest{
+			Method: "PUT",
+			Path:   "/keppel/v1/accounts/first",
+			Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+			Body: assert.JSONObject{
+				"account": assert.JSONObject{
+					"auth_tenant_id": "tenant1",
+				},
+			},
+			ExpectStatus: http.StatusOK,
+			ExpectBody: assert.JSONObject{
+				"account": assert.JSONObject{
+					"name":           "first",
+					"auth_tenant_id": "tenant1",
+					"metadata":       nil,
+					"rbac_policies":  []assert.JSONObject{},
+					"replication": assert.JSONObject{
+						"strategy": "from_external_on_first_use",
+						"upstream": assert.JSONObject{
+							"url": "registry.example.com",
+						},
+					},
+					"platform_filter": testPlatformFilter,
+				},
+			},
+		}.Check(t, h)
+
+		// test PUT on existing account to update replication credentials
+		assert.HTTPRequest{
+			Method: "PUT",
+			Path:   "/keppel/v1/accounts/first",
+			Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+			Body: assert.JSONObject{
+				"account": assert.JSONObject{
+					"auth_tenant_id": "tenant1",
+					"replication": assert.JSONObject{
+						"strategy": "from_external_on_first_use",
+						"upstream": assert.JSONObject{
+							"url":      "registry.example.com",
+							"username": "foo",
+							"password": "bar",
+						},
+					},
+				},
+			},
+			ExpectStatus: http.StatusOK,
+			ExpectBody: assert.JSONObject{
+				"account": assert.JSONObject{
+					"name":           "first",
+					"auth_tenant_id": "tenant1",
+					"metadata":       nil,
+					"rbac_policies":  []assert.JSONObject{},
+					"replication": assert.JSONObject{
+						"strategy": "from_external_on_first_use",
+						"upstream": assert.JSONObject{
+							"url":      "registry.example.com",
+							"username": "foo",
+						},
+					},
+					"platform_filter": testPlatformFilter,
+				},
+			},
+		}.Check(t, h)
+
+		// PUT on existing account with replication credentials section copied from
+		// GET is okay, leaves replication settings unchanged too (this is important
+		// because, in practice, clients copy the account config from GET, change a
+		// thing, and PUT the result)
+		assert.HTTPRequest{
+			Method: "PUT",
+			Path:   "/keppel/v1/accounts/first",
+			Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+			Body: assert.JSONObject{
+				"account": assert.JSONObject{
+					"auth_tenant_id": "tenant1",
+					"rbac_policies":  []assert.JSONObject{},
+					"replication": assert.JSONObject{
+						"strategy": "from_external_on_first_use",
+						"upstream": assert.JSONObject{
+							"url":      "registry.example.com",
+							"username": "foo",
+						},
+					},
+					"platform_filter": testPlatformFilter,
+				},
+			},
+			ExpectStatus: http.StatusOK,
+			ExpectBody: assert.JSONObject{
+				"account": assert.JSONObject{
+					"name":           "first",
+					"auth_tenant_id": "tenant1",
+					"metadata":       nil,
+					"rbac_policies":  []assert.JSONObject{},
+					"replication": assert.JSONObject{
+						"strategy": "from_external_on_first_use",
+						"upstream": assert.JSONObject{
+							"url":      "registry.example.com",
+							"username": "foo",
+						},
+					},
+					"platform_filter": testPlatformFilter,
+				},
+			},
+		}.Check(t, h)
+
+		// ...but changing the username without also supplying a password is wrong
+		assert.HTTPRequest{
+			Method: "PUT",
+			Path:   "/keppel/v1/accounts/first",
+			Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+			Body: assert.JSONObject{
+				"account": assert.JSONObject{
+					"auth_tenant_id": "tenant1",
+					"rbac_policies":  []assert.JSONObject{},
+					"replication": assert.JSONObject{
+						"strategy": "from_external_on_first_use",
+						"upstream": assert.JSONObject{
+							"url":      "registry.example.com",
+							"username": "bar",
+						},
+					},
+					"platform_filter": testPlatformFilter,
+				},
+			},
+			ExpectStatus: http.StatusUnprocessableEntity,
+			ExpectBody:   assert.StringData("cannot change username for \"from_external_on_first_use\" replication without also changing password\n"),
+		}.Check(t, h)
+
+		// test sublease token issuance on account (external replicas count as primary
+		// accounts for the purposes of account name subleasing)
+		s.FD.NextSubleaseTokenSecretToIssue = "this-is-the-token"
+		assert.HTTPRequest{
+			Method:       "POST",
+			Path:         "/keppel/v1/accounts/first/sublease",
+			Header:       map[string]string{"X-Test-Perms": "view:tenant1,change:tenant1"},
+			ExpectStatus: http.StatusOK,
+			ExpectBody:   assert.JSONObject{"sublease_token": makeSubleaseToken("first", "registry.example.org", "this-is-the-token")},
+		}.Check(t, h)
+
+		// PUT on existing account with different replication settings is not allowed
+		assert.HTTPRequest{
+			Method: "PUT",
+			Path:   "/keppel/v1/accounts/first",
+			Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+			Body: assert.JSONObject{
+				"account": assert.JSONObject{
+					"auth_tenant_id": "tenant1",
+					"replication": assert.JSONObject{
+						"strategy": "from_external_on_first_use",
+						"upstream": assert.JSONObject{
+							"url":      "other-registry.example.com",
+							"username": "foo",
+							"password": "bar",
+						},
+					},
+				},
+			},
+			ExpectStatus: http.StatusConflict,
+			ExpectBody:   assert.StringData("cannot change replication policy on existing account\n"),
+		}.Check(t, h)
+		assert.HTTPRequest{
+			Method: "PUT",
+			Path:   "/keppel/v1/accounts/second",
+			Header: map[string]string{"X-Test-Perms": "change:tenant2"},
+			Body: assert.JSONObject{
+				"account": assert.JSONObject{
+					"auth_tenant_id": "tenant2",
+				},
+			},
+			ExpectStatus: http.StatusOK,
+			ExpectBody: assert.JSONObject{
+				"account": assert.JSONObject{
+					"name":           "second",
+					"auth_tenant_id": "tenant2",
+					"metadata":       nil,
+					"rbac_policies":  []assert.JSONObject{},
+				},
+			},
+		}.Check(t, h)
+		assert.HTTPRequest{
+			Method: "PUT",
+			Path:   "/keppel/v1/accounts/second",
+			Header: map[string]string{"X-Test-Perms": "change:tenant2"},
+			Body: assert.JSONObject{
+				"account": assert.JSONObject{
+					"auth_tenant_id": "tenant2",
+					"replication": assert.JSONObject{
+						"strategy": "from_external_on_first_use",
+						"upstream": assert.JSONObject{
+							"url":      "other-registry.example.com",
+							"username": "foo",
+							"password": "bar",
+						},
+					},
+				},
+			},
+			ExpectStatus: http.StatusConflict,
+			ExpectBody:   assert.StringData("cannot change replication policy on existing account\n"),
+		}.Check(t, h)
+
+		// PUT on existing account with different platform filter is not allowed
+		assert.HTTPRequest{
+			Method: "PUT",
+			Path:   "/keppel/v1/accounts/first",
+			Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+			Body: assert.JSONObject{
+				"account": assert.JSONObject{
+					"auth_tenant_id": "tenant1",
+					"replication": assert.JSONObject{
+						"strategy": "from_external_on_first_use",
+						"upstream": assert.JSONObject{
+							"url":      "registry.example.com",
+							"username": "foo",
+							"password": "bar",
+						},
+					},
+					"platform_filter": []assert.JSONObject{},
+				},
+			},
+			ExpectStatus: http.StatusConflict,
+			ExpectBody:   assert.StringData("cannot change platform filter on existing account\n"),
+		}.Check(t, h)
+	})
+}
+
+func TestRotateExternalReplicationCredentials(t *testing.T) {
+	test.WithRoundTripper(func(tt *test.RoundTripper) {
+		s := test.NewSetup(t, test.WithKeppelAPI)
+		h := s.Handler
+		tt.Handlers["registry.example.com"] = newFakeExternalRegistry("registry.example.com", "foo", "bar")
+
+		putAccount := func(userName, password string) assert.HTTPRequest {
+			return assert.HTTPRequest{
+				Method: "PUT",
+				Path:   "/keppel/v1/accounts/first",
+				Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+				Body: assert.JSONObject{
+					"account": assert.JSONObject{
+						"auth_tenant_id": "tenant1",
+						"replication": assert.JSONObject{
+							"strategy": "from_external_on_first_use",
+							"upstream": assert.JSONObject{
+								"url":      "registry.example.com/library",
+								"username": userName,
+								"password": password,
+							},
+						},
+					},
+				},
+			}
+		}
+		expectedAccount := assert.JSONObject{
 			"account": assert.JSONObject{
+				"name":           "first",
 				"auth_tenant_id": "tenant1",
+				"metadata":       nil,
+				"rbac_policies":  []assert.JSONObject{},
 				"replication": assert.JSONObject{
 					"strategy": "from_external_on_first_use",
 					"upstream": assert.JSONObject{
-						"url":      "registry.example.com",
-						"username": "keks",
+						"url":      "registry.example.com/library",
+						"username": "foo",
 					},
 				},
 			},
+		}
+
+		// create an external replica account with outdated credentials
+		req := putAccount("foo", "expired")
+		req.Path += "?validate_upstream=false"
+		req.ExpectStatus = http.StatusOK
+		req.ExpectBody = expectedAccount
+		req.Check(t, h)
+		s.Auditor.IgnoreEventsUntilNow()
+
+		// rotating to credentials that the upstream registry does not accept is rejected
+		req = putAccount("foo", "also-wrong")
+		req.ExpectStatus = http.StatusUnprocessableEntity
+		req.ExpectBody = assert.StringData("cannot authenticate with upstream registry using the new credentials: authentication failed: token endpoint returned status 401 Unauthorized\n")
+		req.Check(t, h)
+		s.Auditor.ExpectEvents(t /*, nothing */)
+
+		// rotating to working credentials is accepted and audited
+		req = putAccount("foo", "bar")
+		req.ExpectStatus = http.StatusOK
+		req.ExpectBody = expectedAccount
+		req.Check(t, h)
+		s.Auditor.ExpectEvents(t,
+			cadf.Event{
+				RequestPath: "/keppel/v1/accounts/first",
+				Action:      cadf.UpdateAction,
+				Outcome:     "success",
+				Reason:      test.CADFReasonOK,
+				Target: cadf.Resource{
+					TypeURI:   "docker-registry/account",
+					ID:        "first",
+					ProjectID: "tenant1",
+				},
+			},
+			cadf.Event{
+				RequestPath: "/keppel/v1/accounts/first",
+				Action:      cadf.UpdateAction,
+				Outcome:     "success",
+				Reason:      test.CADFReasonOK,
+				Target: cadf.Resource{
+					TypeURI:   "docker-registry/account/replication-credentials",
+					ID:        "first",
+					ProjectID: "tenant1",
+					Attachments: []cadf.Attachment{{
+						Name:    "payload",
+						TypeURI: "mime:application/json",
+						Content: `{"strategy":"from_external_on_first_use","upstream":{"url":"registry.example.com/library","username":"foo"}}`,
+					}},
+				},
+			},
+		)
+		assert.DeepEqual(t, "stored password", getExternalPeerPassword(t, s, "first"), "bar")
+
+		// PUT with unchanged credentials does not contact the upstream registry again
+		delete(tt.Handlers, "registry.example.com")
+		req = putAccount("foo", "bar")
+		req.ExpectStatus = http.StatusOK
+		req.ExpectBody = expectedAccount
+		req.Check(t, h)
+		s.Auditor.ExpectEvents(t /*, nothing */)
+	})
+}
+
+func TestCreateExternalReplicaValidatesUpstream(t *testing.T) {
+	test.WithRoundTripper(func(tt *test.RoundTripper) {
+		s := test.NewSetup(t, test.WithKeppelAPI)
+		h := s.Handler
+		tt.Handlers["registry.example.com"] = newFakeExternalRegistry("registry.example.com", "foo", "bar")
+
+		putAccount := func(path, url, password string) assert.HTTPRequest {
+			return assert.HTTPRequest{
+				Method: "PUT",
+				Path:   path,
+				Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+				Body: assert.JSONObject{
+					"account": assert.JSONObject{
+						"auth_tenant_id": "tenant1",
+						"replication": assert.JSONObject{
+							"strategy": "from_external_on_first_use",
+							"upstream": assert.JSONObject{
+								"url":      url,
+								"username": "foo",
+								"password": password,
+							},
+						},
+					},
+				},
+			}
+		}
+		expectedAccount := func(name, url string) assert.JSONObject {
+			return assert.JSONObject{
+				"account": assert.JSONObject{
+					"name":           name,
+					"auth_tenant_id": "tenant1",
+					"metadata":       nil,
+					"rbac_policies":  []assert.JSONObject{},
+					"replication": assert.JSONObject{
+						"strategy": "from_external_on_first_use",
+						"upstream": assert.JSONObject{
+							"url":      url,
+							"username": "foo",
+						},
+					},
+				},
+			}
+		}
+
+		// creating an external replica fails if the credentials are not accepted...
+		req := putAccount("/keppel/v1/accounts/first", "registry.example.com/library", "wrong")
+		req.ExpectStatus = http.StatusUnprocessableEntity
+		req.ExpectBody = assert.StringData("cannot connect to upstream registry: authentication failed: token endpoint returned status 401 Unauthorized\n")
+		req.Check(t, h)
+
+		// ...or if the upstream registry cannot be reached at all
+		test.WithoutRoundTripper(func() {
+			req = putAccount("/keppel/v1/accounts/first", "registry.invalid/library", "bar")
+			req.ExpectStatus = http.StatusUnprocessableEntity
+			_, body := req.Check(t, h)
+			assert.DeepEqual(t, "error message has expected prefix", strings.HasPrefix(string(body), "cannot connect to upstream registry: "), true)
+		})
+		s.Auditor.ExpectEvents(t /*, nothing */)
+
+		// with working credentials, the external replica can be created
+		req = putAccount("/keppel/v1/accounts/first", "registry.example.com/library", "bar")
+		req.ExpectStatus = http.StatusOK
+		req.ExpectBody = expectedAccount("first", "registry.example.com/library")
+		req.Check(t, h)
+
+		// the check can be skipped for upstreams that are intentionally offline
+		test.WithoutRoundTripper(func() {
+			req = putAccount("/keppel/v1/accounts/second?validate_upstream=false", "registry.invalid/library", "bar")
+			req.ExpectStatus = http.StatusOK
+			req.ExpectBody = expectedAccount("second", "registry.invalid/library")
+			req.Check(t, h)
+		})
+
+		// invalid values for the flag are rejected
+		req = putAccount("/keppel/v1/accounts/third?validate_upstream=maybe", "registry.example.com/library", "bar")
+		req.ExpectStatus = http.StatusBadRequest
+		req.ExpectBody = assert.StringData("invalid value for validate_upstream: \"maybe\"\n")
+		req.Check(t, h)
+	})
+}
+
+func TestPutAccountManifestCacheTTL(t *testing.T) {
+	s := test.NewSetup(t, test.WithKeppelAPI)
+	h := s.Handler
+
+	// manifest cache TTL is only allowed on external replicas
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/keppel/v1/accounts/first",
+		Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body: assert.JSONObject{
+			"account": assert.JSONObject{
+				"auth_tenant_id":     "tenant1",
+				"manifest_cache_ttl": assert.JSONObject{"value": 1, "unit": "d"},
+			},
+		},
+		ExpectStatus: http.StatusUnprocessableEntity,
+		ExpectBody:   assert.StringData("manifest cache TTL is only allowed on external replica accounts\n"),
+	}.Check(t, h)
+
+	replicationPolicy := assert.JSONObject{
+		"strategy": "from_external_on_first_use",
+		"upstream": assert.JSONObject{"url": "registry.example.com/library"},
+	}
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/keppel/v1/accounts/first?validate_upstream=false",
+		Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body: assert.JSONObject{
+			"account": assert.JSONObject{
+				"auth_tenant_id":     "tenant1",
+				"replication":        replicationPolicy,
+				"manifest_cache_ttl": assert.JSONObject{"value": -1, "unit": "h"},
+			},
 		},
 		ExpectStatus: http.StatusUnprocessableEntity,
-		ExpectBody:   assert.StringData("need either both username and password or neither for \"from_external_on_first_use\" replication\n"),
+		ExpectBody:   assert.StringData("manifest cache TTL may not be negative\n"),
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/keppel/v1/accounts/first?validate_upstream=false",
+		Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body: assert.JSONObject{
+			"account": assert.JSONObject{
+				"auth_tenant_id":     "tenant1",
+				"replication":        replicationPolicy,
+				"manifest_cache_ttl": assert.JSONObject{"value": 24, "unit": "h"},
+			},
+		},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"account": assert.JSONObject{
+				"name":               "first",
+				"auth_tenant_id":     "tenant1",
+				"metadata":           nil,
+				"rbac_policies":      []assert.JSONObject{},
+				"replication":        replicationPolicy,
+				"manifest_cache_ttl": assert.JSONObject{"value": 1, "unit": "d"},
+			},
+		},
+	}.Check(t, h)
+}
+
+func TestPutAccountManifestTrashRetention(t *testing.T) {
+	s := test.NewSetup(t, test.WithKeppelAPI)
+	h := s.Handler
+
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/keppel/v1/accounts/first",
+		Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body: assert.JSONObject{
+			"account": assert.JSONObject{
+				"auth_tenant_id":           "tenant1",
+				"manifest_trash_retention": assert.JSONObject{"value": -1, "unit": "d"},
+			},
+		},
+		ExpectStatus: http.StatusUnprocessableEntity,
+		ExpectBody:   assert.StringData("manifest trash retention may not be negative\n"),
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/keppel/v1/accounts/first",
+		Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body: assert.JSONObject{
+			"account": assert.JSONObject{
+				"auth_tenant_id":           "tenant1",
+				"manifest_trash_retention": assert.JSONObject{"value": 7, "unit": "d"},
+			},
+		},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"account": assert.JSONObject{
+				"name":                     "first",
+				"auth_tenant_id":           "tenant1",
+				"metadata":                 nil,
+				"rbac_policies":            []assert.JSONObject{},
+				"manifest_trash_retention": assert.JSONObject{"value": 7, "unit": "d"},
+			},
+		},
 	}.Check(t, h)
+
+	// omitting the retention disables the trash again
 	assert.HTTPRequest{
 		Method: "PUT",
 		Path:   "/keppel/v1/accounts/first",
@@ -1599,45 +2515,102 @@ func TestGetPutAccountReplicationFromExternalOnFirstUse(t *testing.T) {
 		Body: assert.JSONObject{
 			"account": assert.JSONObject{
 				"auth_tenant_id": "tenant1",
-				"replication": assert.JSONObject{
-					"strategy": "from_external_on_first_use",
-					"upstream": assert.JSONObject{
-						"url":      "registry.example.com",
-						"password": "keks",
-					},
-				},
+			},
+		},
+		ExpectStatus: http.StatusOK,
+	}.Check(t, h)
+	retentionSecs, err := s.DB.SelectInt(`SELECT manifest_trash_retention_secs FROM accounts WHERE name = 'first'`)
+	test.MustDo(t, err)
+	assert.DeepEqual(t, "manifest_trash_retention_secs", retentionSecs, int64(0))
+}
+
+func TestPutAccountStrictMediaTypes(t *testing.T) {
+	s := test.NewSetup(t, test.WithKeppelAPI)
+	h := s.Handler
+
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/keppel/v1/accounts/first",
+		Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body: assert.JSONObject{
+			"account": assert.JSONObject{
+				"auth_tenant_id":     "tenant1",
+				"strict_media_types": true,
+			},
+		},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"account": assert.JSONObject{
+				"name":               "first",
+				"auth_tenant_id":     "tenant1",
+				"metadata":           nil,
+				"rbac_policies":      []assert.JSONObject{},
+				"strict_media_types": true,
+			},
+		},
+	}.Check(t, h)
+	strict, err := s.DB.SelectBool(`SELECT strict_media_types FROM accounts WHERE name = 'first'`)
+	test.MustDo(t, err)
+	assert.DeepEqual(t, "strict_media_types", strict, true)
+
+	// omitting the flag disables strict media types again
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/keppel/v1/accounts/first",
+		Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body: assert.JSONObject{
+			"account": assert.JSONObject{
+				"auth_tenant_id": "tenant1",
+			},
+		},
+		ExpectStatus: http.StatusOK,
+	}.Check(t, h)
+	strict, err = s.DB.SelectBool(`SELECT strict_media_types FROM accounts WHERE name = 'first'`)
+	test.MustDo(t, err)
+	assert.DeepEqual(t, "strict_media_types", strict, false)
+}
+
+func TestPutAccountPolicyConflicts(t *testing.T) {
+	s := test.NewSetup(t, test.WithKeppelAPI)
+	h := s.Handler
+
+	gcPoliciesJSON := []assert.JSONObject{{
+		"match_repository": "library/.*",
+		"match_tag":        "nightly-.*",
+		"action":           "delete",
+	}}
+	tagPoliciesJSON := []assert.JSONObject{{
+		"match_repository": "library/.*",
+		"block_delete":     true,
+	}}
+	conflictMessage := `gc_policies[0] with action "delete" cannot delete anything because all matching images are protected by tag_policies[0]`
+
+	// a GC policy that is entirely shadowed by a tag policy is rejected...
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/keppel/v1/accounts/first",
+		Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body: assert.JSONObject{
+			"account": assert.JSONObject{
+				"auth_tenant_id": "tenant1",
+				"gc_policies":    gcPoliciesJSON,
+				"tag_policies":   tagPoliciesJSON,
 			},
 		},
 		ExpectStatus: http.StatusUnprocessableEntity,
-		ExpectBody:   assert.StringData("need either both username and password or neither for \"from_external_on_first_use\" replication\n"),
+		ExpectBody:   assert.StringData("conflicting policies: " + conflictMessage + "\n"),
 	}.Check(t, h)
 
-	// test PUT success case
-	testPlatformFilter := []assert.JSONObject{
-		{
-			"os":           "linux",
-			"architecture": "amd64",
-		},
-		{
-			"os":           "linux",
-			"architecture": "arm64",
-			"variant":      "v8",
-		},
-	}
+	// ...unless the conflict is explicitly allowed, in which case it is reported as a warning
 	assert.HTTPRequest{
 		Method: "PUT",
-		Path:   "/keppel/v1/accounts/first",
+		Path:   "/keppel/v1/accounts/first?allow_policy_conflicts=true",
 		Header: map[string]string{"X-Test-Perms": "change:tenant1"},
 		Body: assert.JSONObject{
 			"account": assert.JSONObject{
 				"auth_tenant_id": "tenant1",
-				"replication": assert.JSONObject{
-					"strategy": "from_external_on_first_use",
-					"upstream": assert.JSONObject{
-						"url": "registry.example.com",
-					},
-				},
-				"platform_filter": testPlatformFilter,
+				"gc_policies":    gcPoliciesJSON,
+				"tag_policies":   tagPoliciesJSON,
 			},
 		},
 		ExpectStatus: http.StatusOK,
@@ -1645,21 +2618,16 @@ func TestGetPutAccountReplicationFromExternalOnFirstUse(t *testing.T) {
 			"account": assert.JSONObject{
 				"name":           "first",
 				"auth_tenant_id": "tenant1",
+				"gc_policies":    gcPoliciesJSON,
 				"metadata":       nil,
 				"rbac_policies":  []assert.JSONObject{},
-				"replication": assert.JSONObject{
-					"strategy": "from_external_on_first_use",
-					"upstream": assert.JSONObject{
-						"url": "registry.example.com",
-					},
-				},
-				"platform_filter": testPlatformFilter,
+				"tag_policies":   tagPoliciesJSON,
 			},
+			"warnings": []string{conflictMessage},
 		},
 	}.Check(t, h)
 
-	// PUT on existing account with replication unspecified is okay, leaves
-	// replication settings unchanged
+	// a conflict that already exists does not block further updates, but is still reported as a warning
 	assert.HTTPRequest{
 		Method: "PUT",
 		Path:   "/keppel/v1/accounts/first",
@@ -1667,6 +2635,9 @@ func TestGetPutAccountReplicationFromExternalOnFirstUse(t *testing.T) {
 		Body: assert.JSONObject{
 			"account": assert.JSONObject{
 				"auth_tenant_id": "tenant1",
+				"gc_policies":    gcPoliciesJSON,
+				"metadata":       assert.JSONObject{"foo": "bar"},
+				"tag_policies":   tagPoliciesJSON,
 			},
 		},
 		ExpectStatus: http.StatusOK,
@@ -1674,20 +2645,16 @@ func TestGetPutAccountReplicationFromExternalOnFirstUse(t *testing.T) {
 			"account": assert.JSONObject{
 				"name":           "first",
 				"auth_tenant_id": "tenant1",
-				"metadata":       nil,
+				"gc_policies":    gcPoliciesJSON,
+				"metadata":       assert.JSONObject{"foo": "bar"},
 				"rbac_policies":  []assert.JSONObject{},
-				"replication": assert.JSONObject{
-					"strategy": "from_external_on_first_use",
-					"upstream": assert.JSONObject{
-						"url": "registry.example.com",
-					},
-				},
-				"platform_filter": testPlatformFilter,
+				"tag_policies":   tagPoliciesJSON,
 			},
+			"warnings": []string{conflictMessage},
 		},
 	}.Check(t, h)
 
-	// test PUT on existing account to update replication credentials
+	// a tag policy that only protects some of the images matched by the GC policy is not a conflict
 	assert.HTTPRequest{
 		Method: "PUT",
 		Path:   "/keppel/v1/accounts/first",
@@ -1695,39 +2662,68 @@ func TestGetPutAccountReplicationFromExternalOnFirstUse(t *testing.T) {
 		Body: assert.JSONObject{
 			"account": assert.JSONObject{
 				"auth_tenant_id": "tenant1",
-				"replication": assert.JSONObject{
-					"strategy": "from_external_on_first_use",
-					"upstream": assert.JSONObject{
-						"url":      "registry.example.com",
-						"username": "foo",
-						"password": "bar",
-					},
-				},
+				"gc_policies":    gcPoliciesJSON,
+				"tag_policies": []assert.JSONObject{{
+					"match_repository": "library/alpine",
+					"block_delete":     true,
+				}},
 			},
 		},
 		ExpectStatus: http.StatusOK,
-		ExpectBody: assert.JSONObject{
+	}.Check(t, h)
+
+	// malformed value for the query parameter
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/keppel/v1/accounts/first?allow_policy_conflicts=maybe",
+		Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body: assert.JSONObject{
 			"account": assert.JSONObject{
-				"name":           "first",
 				"auth_tenant_id": "tenant1",
-				"metadata":       nil,
-				"rbac_policies":  []assert.JSONObject{},
-				"replication": assert.JSONObject{
-					"strategy": "from_external_on_first_use",
-					"upstream": assert.JSONObject{
-						"url":      "registry.example.com",
-						"username": "foo",
-					},
-				},
-				"platform_filter": testPlatformFilter,
 			},
 		},
+		ExpectStatus: http.StatusBadRequest,
+		ExpectBody:   assert.StringData("invalid value for allow_policy_conflicts: \"maybe\"\n"),
 	}.Check(t, h)
+}
+
+func TestPutAccountPullAndPushEnabled(t *testing.T) {
+	s := test.NewSetup(t, test.WithKeppelAPI)
+	h := s.Handler
 
-	// PUT on existing account with replication credentials section copied from
-	// GET is okay, leaves replication settings unchanged too (this is important
-	// because, in practice, clients copy the account config from GET, change a
-	// thing, and PUT the result)
+	// both flags can be disabled independently of each other
+	for _, flag := range []string{"pull_enabled", "push_enabled"} {
+		assert.HTTPRequest{
+			Method: "PUT",
+			Path:   "/keppel/v1/accounts/first",
+			Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+			Body: assert.JSONObject{
+				"account": assert.JSONObject{
+					"auth_tenant_id": "tenant1",
+					flag:             false,
+				},
+			},
+			ExpectStatus: http.StatusOK,
+			ExpectBody: assert.JSONObject{
+				"account": assert.JSONObject{
+					"name":           "first",
+					"auth_tenant_id": "tenant1",
+					"metadata":       nil,
+					"rbac_policies":  []assert.JSONObject{},
+					flag:             false,
+				},
+			},
+		}.Check(t, h)
+
+		pullDisabled, err := s.DB.SelectBool(`SELECT is_pull_disabled FROM accounts WHERE name = 'first'`)
+		test.MustDo(t, err)
+		assert.DeepEqual(t, "is_pull_disabled", pullDisabled, flag == "pull_enabled")
+		pushDisabled, err := s.DB.SelectBool(`SELECT is_push_disabled FROM accounts WHERE name = 'first'`)
+		test.MustDo(t, err)
+		assert.DeepEqual(t, "is_push_disabled", pushDisabled, flag == "push_enabled")
+	}
+
+	// setting the flag to true explicitly is the same as omitting it (which is the default)
 	assert.HTTPRequest{
 		Method: "PUT",
 		Path:   "/keppel/v1/accounts/first",
@@ -1735,15 +2731,7 @@ func TestGetPutAccountReplicationFromExternalOnFirstUse(t *testing.T) {
 		Body: assert.JSONObject{
 			"account": assert.JSONObject{
 				"auth_tenant_id": "tenant1",
-				"rbac_policies":  []assert.JSONObject{},
-				"replication": assert.JSONObject{
-					"strategy": "from_external_on_first_use",
-					"upstream": assert.JSONObject{
-						"url":      "registry.example.com",
-						"username": "foo",
-					},
-				},
-				"platform_filter": testPlatformFilter,
+				"pull_enabled":   true,
 			},
 		},
 		ExpectStatus: http.StatusOK,
@@ -1753,53 +2741,41 @@ func TestGetPutAccountReplicationFromExternalOnFirstUse(t *testing.T) {
 				"auth_tenant_id": "tenant1",
 				"metadata":       nil,
 				"rbac_policies":  []assert.JSONObject{},
-				"replication": assert.JSONObject{
-					"strategy": "from_external_on_first_use",
-					"upstream": assert.JSONObject{
-						"url":      "registry.example.com",
-						"username": "foo",
-					},
-				},
-				"platform_filter": testPlatformFilter,
 			},
 		},
 	}.Check(t, h)
+}
+
+func TestPutAccountAnycastEnabled(t *testing.T) {
+	s := test.NewSetup(t, test.WithKeppelAPI)
+	h := s.Handler
 
-	// ...but changing the username without also supplying a password is wrong
 	assert.HTTPRequest{
 		Method: "PUT",
 		Path:   "/keppel/v1/accounts/first",
 		Header: map[string]string{"X-Test-Perms": "change:tenant1"},
 		Body: assert.JSONObject{
 			"account": assert.JSONObject{
-				"auth_tenant_id": "tenant1",
-				"rbac_policies":  []assert.JSONObject{},
-				"replication": assert.JSONObject{
-					"strategy": "from_external_on_first_use",
-					"upstream": assert.JSONObject{
-						"url":      "registry.example.com",
-						"username": "bar",
-					},
-				},
-				"platform_filter": testPlatformFilter,
+				"auth_tenant_id":  "tenant1",
+				"anycast_enabled": false,
 			},
 		},
-		ExpectStatus: http.StatusUnprocessableEntity,
-		ExpectBody:   assert.StringData("cannot change username for \"from_external_on_first_use\" replication without also changing password\n"),
-	}.Check(t, h)
-
-	// test sublease token issuance on account (external replicas count as primary
-	// accounts for the purposes of account name subleasing)
-	s.FD.NextSubleaseTokenSecretToIssue = "this-is-the-token"
-	assert.HTTPRequest{
-		Method:       "POST",
-		Path:         "/keppel/v1/accounts/first/sublease",
-		Header:       map[string]string{"X-Test-Perms": "view:tenant1,change:tenant1"},
 		ExpectStatus: http.StatusOK,
-		ExpectBody:   assert.JSONObject{"sublease_token": makeSubleaseToken("first", "registry.example.org", "this-is-the-token")},
+		ExpectBody: assert.JSONObject{
+			"account": assert.JSONObject{
+				"name":            "first",
+				"auth_tenant_id":  "tenant1",
+				"metadata":        nil,
+				"rbac_policies":   []assert.JSONObject{},
+				"anycast_enabled": false,
+			},
+		},
 	}.Check(t, h)
+	anycastDisabled, err := s.DB.SelectBool(`SELECT is_anycast_disabled FROM accounts WHERE name = 'first'`)
+	test.MustDo(t, err)
+	assert.DeepEqual(t, "is_anycast_disabled", anycastDisabled, true)
 
-	// PUT on existing account with different replication settings is not allowed
+	// omitting the flag enables anycast again (which is the default)
 	assert.HTTPRequest{
 		Method: "PUT",
 		Path:   "/keppel/v1/accounts/first",
@@ -1807,60 +2783,147 @@ func TestGetPutAccountReplicationFromExternalOnFirstUse(t *testing.T) {
 		Body: assert.JSONObject{
 			"account": assert.JSONObject{
 				"auth_tenant_id": "tenant1",
-				"replication": assert.JSONObject{
-					"strategy": "from_external_on_first_use",
-					"upstream": assert.JSONObject{
-						"url":      "other-registry.example.com",
-						"username": "foo",
-						"password": "bar",
-					},
-				},
-			},
-		},
-		ExpectStatus: http.StatusConflict,
-		ExpectBody:   assert.StringData("cannot change replication policy on existing account\n"),
-	}.Check(t, h)
-	assert.HTTPRequest{
-		Method: "PUT",
-		Path:   "/keppel/v1/accounts/second",
-		Header: map[string]string{"X-Test-Perms": "change:tenant2"},
-		Body: assert.JSONObject{
-			"account": assert.JSONObject{
-				"auth_tenant_id": "tenant2",
 			},
 		},
 		ExpectStatus: http.StatusOK,
 		ExpectBody: assert.JSONObject{
 			"account": assert.JSONObject{
-				"name":           "second",
-				"auth_tenant_id": "tenant2",
+				"name":           "first",
+				"auth_tenant_id": "tenant1",
 				"metadata":       nil,
 				"rbac_policies":  []assert.JSONObject{},
 			},
 		},
 	}.Check(t, h)
+	anycastDisabled, err = s.DB.SelectBool(`SELECT is_anycast_disabled FROM accounts WHERE name = 'first'`)
+	test.MustDo(t, err)
+	assert.DeepEqual(t, "is_anycast_disabled", anycastDisabled, false)
+}
+
+func TestPutAccountCreatingState(t *testing.T) {
+	s := test.NewSetup(t, test.WithKeppelAPI)
+	h := s.Handler
+
+	putAccount := func(expectStatus int) {
+		t.Helper()
+		assert.HTTPRequest{
+			Method: "PUT",
+			Path:   "/keppel/v1/accounts/first",
+			Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+			Body: assert.JSONObject{
+				"account": assert.JSONObject{
+					"auth_tenant_id": "tenant1",
+				},
+			},
+			ExpectStatus: expectStatus,
+		}.Check(t, h)
+	}
+	expectAccount := func(expectStatus int, expectBody assert.HTTPResponseBody) {
+		t.Helper()
+		assert.HTTPRequest{
+			Method:       "GET",
+			Path:         "/keppel/v1/accounts/first",
+			Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+			ExpectStatus: expectStatus,
+			ExpectBody:   expectBody,
+		}.Check(t, h)
+	}
+	creatingAccount := assert.JSONObject{
+		"account": assert.JSONObject{
+			"name":           "first",
+			"auth_tenant_id": "tenant1",
+			"metadata":       nil,
+			"rbac_policies":  []assert.JSONObject{},
+			"state":          "creating",
+		},
+	}
+	activeAccount := assert.JSONObject{
+		"account": assert.JSONObject{
+			"name":           "first",
+			"auth_tenant_id": "tenant1",
+			"metadata":       nil,
+			"rbac_policies":  []assert.JSONObject{},
+		},
+	}
+
+	// if the initial setup attempt fails, the account is not left behind
+	s.SD.ForbidNewAccounts = true
+	putAccount(http.StatusConflict)
+	expectAccount(http.StatusForbidden, assert.StringData("no permission for keppel_account:first:view\n"))
+	s.SD.ForbidNewAccounts = false
+	exists, err := keppel.DoesAccountExist(s.Ctx, s.DB, "first")
+	test.MustDo(t, err)
+	assert.DeepEqual(t, "account exists", exists, false)
+
+	// while the storage setup is in progress, the account is reported as "creating"
+	setupWasObserved := false
+	s.SD.OnCanSetupAccount = func(account models.ReducedAccount) {
+		setupWasObserved = true
+		assert.DeepEqual(t, "IsCreating", account.IsCreating, true)
+		expectAccount(http.StatusOK, creatingAccount)
+	}
+	putAccount(http.StatusOK)
+	assert.DeepEqual(t, "setupWasObserved", setupWasObserved, true)
+	s.SD.OnCanSetupAccount = nil
+
+	// once the PUT returns, the account is active
+	expectAccount(http.StatusOK, activeAccount)
+	isCreationStartedAtCleared, err := s.DB.SelectBool(`SELECT creation_started_at IS NULL FROM accounts WHERE name = 'first'`)
+	test.MustDo(t, err)
+	assert.DeepEqual(t, "creation_started_at IS NULL", isCreationStartedAtCleared, true)
+
+	// if setup was interrupted, a repeated PUT resumes it
+	test.MustExec(t, s.DB, `UPDATE accounts SET is_creating = TRUE, creation_started_at = $1 WHERE name = 'first'`, s.Clock.Now())
+	s.SD.ForbidNewAccounts = true
+	putAccount(http.StatusConflict)
+	expectAccount(http.StatusOK, creatingAccount)
+	s.SD.ForbidNewAccounts = false
+	putAccount(http.StatusOK)
+	expectAccount(http.StatusOK, activeAccount)
+
+	// if the janitor gave up on the account while the setup was being resumed,
+	// the setup is not completed
+	test.MustExec(t, s.DB, `UPDATE accounts SET is_creating = TRUE, creation_started_at = $1 WHERE name = 'first'`, s.Clock.Now())
+	s.SD.OnCanSetupAccount = func(account models.ReducedAccount) {
+		test.MustExec(t, s.DB, `DELETE FROM accounts WHERE name = 'first'`)
+	}
+	putAccount(http.StatusConflict)
+	s.SD.OnCanSetupAccount = nil
+	exists, err = keppel.DoesAccountExist(s.Ctx, s.DB, "first")
+	test.MustDo(t, err)
+	assert.DeepEqual(t, "account exists", exists, false)
+}
+
+func TestPutAccountValidateOnPush(t *testing.T) {
+	s := test.NewSetup(t, test.WithKeppelAPI)
+	h := s.Handler
+
 	assert.HTTPRequest{
 		Method: "PUT",
-		Path:   "/keppel/v1/accounts/second",
-		Header: map[string]string{"X-Test-Perms": "change:tenant2"},
+		Path:   "/keppel/v1/accounts/first",
+		Header: map[string]string{"X-Test-Perms": "change:tenant1"},
 		Body: assert.JSONObject{
 			"account": assert.JSONObject{
-				"auth_tenant_id": "tenant2",
-				"replication": assert.JSONObject{
-					"strategy": "from_external_on_first_use",
-					"upstream": assert.JSONObject{
-						"url":      "other-registry.example.com",
-						"username": "foo",
-						"password": "bar",
-					},
-				},
+				"auth_tenant_id":   "tenant1",
+				"validate_on_push": true,
+			},
+		},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"account": assert.JSONObject{
+				"name":             "first",
+				"auth_tenant_id":   "tenant1",
+				"metadata":         nil,
+				"rbac_policies":    []assert.JSONObject{},
+				"validate_on_push": true,
 			},
 		},
-		ExpectStatus: http.StatusConflict,
-		ExpectBody:   assert.StringData("cannot change replication policy on existing account\n"),
 	}.Check(t, h)
+	validateOnPush, err := s.DB.SelectBool(`SELECT validate_on_push FROM accounts WHERE name = 'first'`)
+	test.MustDo(t, err)
+	assert.DeepEqual(t, "validate_on_push", validateOnPush, true)
 
-	// PUT on existing account with different platform filter is not allowed
+	// omitting the flag disables validation on push again
 	assert.HTTPRequest{
 		Method: "PUT",
 		Path:   "/keppel/v1/accounts/first",
@@ -1868,20 +2931,45 @@ func TestGetPutAccountReplicationFromExternalOnFirstUse(t *testing.T) {
 		Body: assert.JSONObject{
 			"account": assert.JSONObject{
 				"auth_tenant_id": "tenant1",
-				"replication": assert.JSONObject{
-					"strategy": "from_external_on_first_use",
-					"upstream": assert.JSONObject{
-						"url":      "registry.example.com",
-						"username": "foo",
-						"password": "bar",
-					},
-				},
-				"platform_filter": []assert.JSONObject{},
 			},
 		},
-		ExpectStatus: http.StatusConflict,
-		ExpectBody:   assert.StringData("cannot change platform filter on existing account\n"),
+		ExpectStatus: http.StatusOK,
 	}.Check(t, h)
+	validateOnPush, err = s.DB.SelectBool(`SELECT validate_on_push FROM accounts WHERE name = 'first'`)
+	test.MustDo(t, err)
+	assert.DeepEqual(t, "validate_on_push", validateOnPush, false)
+}
+
+func getExternalPeerPassword(t *testing.T, s test.Setup, accountName string) string {
+	t.Helper()
+	password, err := s.DB.SelectStr(`SELECT external_peer_password FROM accounts WHERE name = $1`, accountName)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return password
+}
+
+// Returns a handler that emulates the authentication flow of a registry with a single user account.
+func newFakeExternalRegistry(hostName, userName, password string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v2/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer valid-token" {
+			w.Header().Set("Www-Authenticate", fmt.Sprintf(`Bearer realm="https://%s/token",service="%s"`, hostName, hostName))
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		respondwith.JSON(w, http.StatusOK, map[string]any{})
+	})
+	mux.HandleFunc("GET /token", func(w http.ResponseWriter, r *http.Request) {
+		// like most public registries, anonymous access is allowed, but wrong credentials are rejected
+		givenUserName, givenPassword, ok := r.BasicAuth()
+		if ok && (givenUserName != userName || givenPassword != password) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		respondwith.JSON(w, http.StatusOK, map[string]any{"token": "valid-token"})
+	})
+	return mux
 }
 
 func TestDeleteAccount(t *testing.T) {
@@ -2051,11 +3139,12 @@ func TestReplicaAccountsInheritPlatformFilter(t *testing.T) {
 			ExpectStatus: http.StatusOK,
 			ExpectBody: assert.JSONObject{
 				"account": assert.JSONObject{
-					"name":            "first",
-					"auth_tenant_id":  "tenant1",
-					"metadata":        nil,
-					"platform_filter": testPlatformFilter,
-					"rbac_policies":   []assert.JSONObject{},
+					"name":                      "first",
+					"auth_tenant_id":            "tenant1",
+					"metadata":                  nil,
+					"platform_filter":           testPlatformFilter,
+					"platform_filter_inherited": true,
+					"rbac_policies":             []assert.JSONObject{},
 					"replication": assert.JSONObject{
 						"strategy": "on_first_use",
 						"upstream": "registry.example.org",
@@ -2089,11 +3178,12 @@ func TestReplicaAccountsInheritPlatformFilter(t *testing.T) {
 			ExpectStatus: http.StatusOK,
 			ExpectBody: assert.JSONObject{
 				"account": assert.JSONObject{
-					"name":            "second",
-					"auth_tenant_id":  "tenant1",
-					"metadata":        nil,
-					"platform_filter": testPlatformFilter,
-					"rbac_policies":   []assert.JSONObject{},
+					"name":                      "second",
+					"auth_tenant_id":            "tenant1",
+					"metadata":                  nil,
+					"platform_filter":           testPlatformFilter,
+					"platform_filter_inherited": true,
+					"rbac_policies":             []assert.JSONObject{},
 					"replication": assert.JSONObject{
 						"strategy": "on_first_use",
 						"upstream": "registry.example.org",
@@ -2127,6 +3217,49 @@ func TestReplicaAccountsInheritPlatformFilter(t *testing.T) {
 			ExpectStatus: http.StatusConflict,
 			ExpectBody:   assert.StringData("peer account filter needs to match primary account filter: local account [{\"architecture\":\"arm64\",\"os\":\"linux\",\"variant\":\"v8\"}], peer account [{\"architecture\":\"amd64\",\"os\":\"linux\"}] \n"),
 		}.Check(t, s2.Handler)
+
+		// the platform filter is reported as inherited on the replica, but not on the primary where it was set explicitly
+		assert.HTTPRequest{
+			Method:       "GET",
+			Path:         "/keppel/v1/accounts/first",
+			Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+			ExpectStatus: http.StatusOK,
+			ExpectBody: assert.JSONObject{
+				"account": assert.JSONObject{
+					"name":                      "first",
+					"auth_tenant_id":            "tenant1",
+					"metadata":                  nil,
+					"platform_filter":           testPlatformFilter,
+					"platform_filter_inherited": true,
+					"rbac_policies":             []assert.JSONObject{},
+					"replication": assert.JSONObject{
+						"strategy": "on_first_use",
+						"upstream": "registry.example.org",
+					},
+				},
+			},
+		}.Check(t, s2.Handler)
+		assert.HTTPRequest{
+			Method:       "GET",
+			Path:         "/keppel/v1/accounts/first",
+			Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+			ExpectStatus: http.StatusOK,
+			ExpectBody: assert.JSONObject{
+				"account": assert.JSONObject{
+					"name":            "first",
+					"auth_tenant_id":  "tenant1",
+					"metadata":        nil,
+					"platform_filter": testPlatformFilter,
+					"rbac_policies":   []assert.JSONObject{},
+					"replication": assert.JSONObject{
+						"strategy": "from_external_on_first_use",
+						"upstream": assert.JSONObject{
+							"url": "registry.example.org",
+						},
+					},
+				},
+			},
+		}.Check(t, s1.Handler)
 	})
 }
 
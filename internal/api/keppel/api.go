@@ -63,15 +63,35 @@ func (a *API) AddTo(r *mux.Router) {
 	r.Methods("POST").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/sublease").HandlerFunc(a.handlePostAccountSublease)
 	r.Methods("GET").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/security_scan_policies").HandlerFunc(a.handleGetSecurityScanPolicies)
 	r.Methods("PUT").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/security_scan_policies").HandlerFunc(a.handlePutSecurityScanPolicies)
+	r.Methods("GET").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/integrity_report").HandlerFunc(a.handleGetIntegrityReport)
+	r.Methods("GET").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/_export").HandlerFunc(a.handleGetAccountExport)
+	r.Methods("POST").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/_import").HandlerFunc(a.handlePostAccountImport)
+	r.Methods("POST").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/_token").HandlerFunc(a.handlePostAccountToken)
 
 	r.Methods("GET").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/repositories/{repo_name:.+}/_manifests").HandlerFunc(a.handleGetManifests)
 	r.Methods("DELETE").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/repositories/{repo_name:.+}/_manifests/{digest}").HandlerFunc(a.handleDeleteManifest)
 	r.Methods("GET").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/repositories/{repo_name:.+}/_manifests/{digest}/trivy_report").HandlerFunc(a.handleGetTrivyReport)
+	r.Methods("GET").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/repositories/{repo_name:.+}/_manifests/{digest}/tags").HandlerFunc(a.handleGetManifestTags)
+	r.Methods("GET").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/repositories/{repo_name:.+}/_manifests/{digest}/referrers").HandlerFunc(a.handleGetManifestReferrers)
+	r.Methods("GET").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/repositories/{repo_name:.+}/_blobs/{digest}").HandlerFunc(a.handleGetBlob)
+	r.Methods("POST").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/repositories/{repo_name:.+}/_blobs/exists").HandlerFunc(a.handlePostBlobsExist)
 	r.Methods("DELETE").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/repositories/{repo_name:.+}/_tags/{tag_name}").HandlerFunc(a.handleDeleteTag)
+	r.Methods("GET").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/repositories/{repo_name:.+}/_tags/{tag_name}/digest").HandlerFunc(a.handleGetTagDigest)
+	r.Methods("PUT").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/repositories/{repo_name:.+}/_tags/{tag_name}/pin").HandlerFunc(a.handlePutTagPin)
+	r.Methods("DELETE").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/repositories/{repo_name:.+}/_tags/{tag_name}/pin").HandlerFunc(a.handleDeleteTagPin)
+	r.Methods("GET").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/repositories/{repo_name:.+}/_trash").HandlerFunc(a.handleGetTrash)
+	r.Methods("POST").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/repositories/{repo_name:.+}/_trash/{digest}/restore").HandlerFunc(a.handleRestoreFromTrash)
+	r.Methods("POST").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/repositories/{repo_name:.+}/_move").HandlerFunc(a.handleMoveRepository)
 
 	r.Methods("GET").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/repositories").HandlerFunc(a.handleGetRepositories)
 	r.Methods("DELETE").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/repositories/{repo_name:.+}").HandlerFunc(a.handleDeleteRepository)
 
+	r.Methods("GET").Path("/keppel/v1/admin/pending-replications").HandlerFunc(a.handleGetPendingReplications)
+	r.Methods("DELETE").Path("/keppel/v1/admin/pending-replications/{account:[a-z0-9-]{1,48}}/{digest}").HandlerFunc(a.handleDeletePendingReplication)
+	r.Methods("GET").Path("/keppel/v1/admin/tokens/{auth_tenant_id}").HandlerFunc(a.handleGetIssuedTokens)
+	r.Methods("DELETE").Path("/keppel/v1/admin/tokens/{auth_tenant_id}").HandlerFunc(a.handleDeleteIssuedTokens)
+	r.Methods("DELETE").Path("/keppel/v1/admin/tokens/{auth_tenant_id}/{token_id}").HandlerFunc(a.handleDeleteIssuedToken)
+
 	r.Methods("GET").Path("/keppel/v1/peers").HandlerFunc(a.handleGetPeers)
 
 	r.Methods("GET").Path("/keppel/v1/quotas/{auth_tenant_id}").HandlerFunc(a.handleGetQuotas)
@@ -162,7 +182,7 @@ func (a *API) authenticateRequest(w http.ResponseWriter, r *http.Request, ss aut
 // accounts exist or not to unauthorized users.
 func (a *API) findAccountFromRequest(w http.ResponseWriter, r *http.Request, _ *auth.Authorization) *models.Account {
 	accountName := models.AccountName(mux.Vars(r)["account"])
-	account, err := keppel.FindAccount(a.db, accountName)
+	account, err := keppel.FindAccount(r.Context(), a.db, accountName)
 	if respondwith.ObfuscatedErrorText(w, err) {
 		return nil
 	}
@@ -247,6 +267,6 @@ func (q paginatedQuery) Prepare() (modifiedSQLQuery string, modifiedBindValues [
 		query = strings.Replace(query, `$CONDITION`, `TRUE`, 1)
 		return query, q.BindValues, limit, nil
 	}
-	query = strings.Replace(query, `$CONDITION`, q.MarkerField+` > $2`, 1)
+	query = strings.Replace(query, `$CONDITION`, fmt.Sprintf(`%s > $%d`, q.MarkerField, len(q.BindValues)+1), 1)
 	return query, append(q.BindValues, marker), limit, nil
 }
@@ -0,0 +1,162 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package keppelv1
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	. "github.com/majewsky/gg/option"
+	"github.com/opencontainers/go-digest"
+	"github.com/sapcc/go-bits/httpapi"
+	"github.com/sapcc/go-bits/respondwith"
+	"github.com/sapcc/go-bits/sqlext"
+
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+// Blob represents a blob in the API.
+type Blob struct {
+	Digest                 digest.Digest `json:"digest"`
+	MediaType              string        `json:"media_type"`
+	SizeBytes              uint64        `json:"size_bytes"`
+	PushedAt               int64         `json:"pushed_at"`
+	LastValidatedAt        Option[int64] `json:"last_validated_at,omitzero"`
+	ValidationErrorMessage string        `json:"validation_error,omitempty"`
+}
+
+func (a *API) handleGetBlob(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/keppel/v1/accounts/:account/repositories/:repo/_blobs/:digest")
+	authz := a.authenticateRequest(w, r, repoScopeFromRequest(r, keppel.CanPullFromAccount))
+	if authz == nil {
+		return
+	}
+	account := a.findAccountFromRequest(w, r, authz)
+	if account == nil {
+		return
+	}
+	repo := a.findRepositoryFromRequest(w, r, account.Name)
+	if repo == nil {
+		return
+	}
+	parsedDigest, err := digest.Parse(mux.Vars(r)["digest"])
+	if err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	blob, err := keppel.FindBlobByRepository(a.db, parsedDigest, *repo)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if respondwith.ObfuscatedErrorText(w, err) {
+		return
+	}
+
+	respondwith.JSON(w, http.StatusOK, map[string]any{"blob": Blob{
+		Digest:                 blob.Digest,
+		MediaType:              a.cfg.BlobMediaType(*blob),
+		SizeBytes:              blob.SizeBytes,
+		PushedAt:               blob.PushedAt.Unix(),
+		LastValidatedAt:        keppel.MaybeTimeToUnix(blob.LastValidatedAt),
+		ValidationErrorMessage: blob.ValidationErrorMessage,
+	}})
+}
+
+// maxDigestsPerBlobExistenceCheck limits the request size for handlePostBlobsExist.
+const maxDigestsPerBlobExistenceCheck = 1000
+
+// Blobs that are known but not backed by storage (i.e. that are still waiting
+// to be replicated from upstream) do not count as present.
+var blobsPresentInRepoQuery = sqlext.SimplifyWhitespace(`
+	SELECT b.digest
+	  FROM blobs b
+	  JOIN blob_mounts bm ON b.id = bm.blob_id
+	 WHERE b.account_name = $1 AND bm.repo_id = $2 AND b.digest = ANY($3) AND b.storage_id != ''
+`)
+
+func (a *API) handlePostBlobsExist(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/keppel/v1/accounts/:account/repositories/:repo/_blobs/exists")
+	authz := a.authenticateRequest(w, r, repoScopeFromRequest(r, keppel.CanPullFromAccount))
+	if authz == nil {
+		return
+	}
+	account := a.findAccountFromRequest(w, r, authz)
+	if account == nil {
+		return
+	}
+
+	var req struct {
+		Digests []string `json:"digests"`
+	}
+	ok := decodeJSONRequestBody(w, r.Body, &req)
+	if !ok {
+		return
+	}
+	if len(req.Digests) > maxDigestsPerBlobExistenceCheck {
+		http.Error(w, fmt.Sprintf("cannot check more than %d digests at once", maxDigestsPerBlobExistenceCheck), http.StatusBadRequest)
+		return
+	}
+	digests := make([]digest.Digest, len(req.Digests))
+	for idx, input := range req.Digests {
+		parsedDigest, err := digest.Parse(input)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid digest %q: %s", input, err.Error()), http.StatusBadRequest)
+			return
+		}
+		digests[idx] = parsedDigest
+	}
+
+	// unlike in other endpoints, a nonexistent repo is not an error here: since
+	// this endpoint is used to prepare a push, the repo might not exist yet
+	repoName := mux.Vars(r)["repo_name"]
+	if !isValidRepoName(repoName) {
+		http.Error(w, "repo not found", http.StatusNotFound)
+		return
+	}
+	repo, err := keppel.FindRepository(a.db, repoName, account.Name)
+	if errors.Is(err, sql.ErrNoRows) {
+		repo = nil
+	} else if respondwith.ObfuscatedErrorText(w, err) {
+		return
+	}
+
+	isPresent := make(map[digest.Digest]bool)
+	if repo != nil && len(digests) > 0 {
+		digestStrs := make([]string, len(digests))
+		for idx, blobDigest := range digests {
+			digestStrs[idx] = blobDigest.String()
+		}
+		queryArgs := []any{account.Name, repo.ID, pq.Array(digestStrs)}
+		err := sqlext.ForeachRow(a.db, blobsPresentInRepoQuery, queryArgs, func(rows *sql.Rows) error {
+			var blobDigest digest.Digest
+			err := rows.Scan(&blobDigest)
+			if err != nil {
+				return err
+			}
+			isPresent[blobDigest] = true
+			return nil
+		})
+		if respondwith.ObfuscatedErrorText(w, err) {
+			return
+		}
+	}
+
+	present := []digest.Digest{}
+	missing := []digest.Digest{}
+	for _, blobDigest := range digests {
+		if isPresent[blobDigest] {
+			present = append(present, blobDigest)
+		} else {
+			missing = append(missing, blobDigest)
+		}
+	}
+
+	respondwith.JSON(w, http.StatusOK, map[string]any{"present": present, "missing": missing})
+}
@@ -0,0 +1,206 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package keppelv1_test
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/sapcc/go-bits/assert"
+
+	"github.com/sapcc/keppel/internal/models"
+	"github.com/sapcc/keppel/internal/tasks"
+	"github.com/sapcc/keppel/internal/test"
+)
+
+func TestGetBlob(t *testing.T) {
+	repo := models.Repository{AccountName: "test1", Name: "foo"}
+	s := test.NewSetup(t,
+		test.WithKeppelAPI,
+		test.WithQuotas,
+		test.WithAccount(models.Account{Name: "test1", AuthTenantID: "tenant1"}),
+		test.WithRepo(repo),
+	)
+	h := s.Handler
+	j := tasks.NewJanitor(s.Config, s.FD, s.SD, s.ICD, s.DB, s.AMD, s.Auditor).OverrideTimeNow(s.Clock.Now).OverrideGenerateStorageID(s.SIDGenerator.Next)
+	j.DisableJitter()
+	validateBlobJob := j.BlobValidationJob(s.Registry)
+
+	s.Clock.StepBy(time.Hour)
+	blob := test.GenerateExampleLayer(1)
+	blob.MustUpload(t, s, repo)
+	blobPath := "/keppel/v1/accounts/test1/repositories/foo/_blobs/" + blob.Digest.String()
+
+	// error case: no permission
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         blobPath,
+		Header:       map[string]string{"X-Test-Perms": "view:tenant2,pull:tenant2"},
+		ExpectStatus: http.StatusForbidden,
+		ExpectBody:   assert.StringData("no permission for repository:test1/foo:pull\n"),
+	}.Check(t, h)
+
+	// error case: no such blob
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_blobs/" + test.DeterministicDummyDigest(1).String(),
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody:   assert.StringData("not found\n"),
+	}.Check(t, h)
+
+	expectBlob := func(lastValidatedAt any, validationError string) {
+		t.Helper()
+		rendered := assert.JSONObject{
+			"digest":     blob.Digest,
+			"media_type": "application/octet-stream", // not known until a manifest references this blob
+			"size_bytes": len(blob.Contents),
+			"pushed_at":  time.Unix(3600, 0).Unix(),
+		}
+		if lastValidatedAt != nil {
+			rendered["last_validated_at"] = lastValidatedAt
+		}
+		if validationError != "" {
+			rendered["validation_error"] = validationError
+		}
+		assert.HTTPRequest{
+			Method:       "GET",
+			Path:         blobPath,
+			Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+			ExpectStatus: http.StatusOK,
+			ExpectBody:   assert.JSONObject{"blob": rendered},
+		}.Check(t, h)
+	}
+
+	// freshly pushed blob has not been validated yet
+	expectBlob(nil, "")
+
+	// after a successful validation, the time of validation is shown
+	s.Clock.StepBy(8 * 24 * time.Hour)
+	test.MustDo(t, validateBlobJob.ProcessOne(s.Ctx))
+	expectBlob(s.Clock.Now().Unix(), "")
+
+	// when the validation fails, the error is persisted and shown
+	wrongDigest := digest.Canonical.FromBytes([]byte("not the right content"))
+	test.MustExec(t, s.DB, `UPDATE blobs SET digest = $1 WHERE digest = $2`, wrongDigest.String(), blob.Digest.String())
+	s.Clock.StepBy(8 * 24 * time.Hour)
+	err := validateBlobJob.ProcessOne(s.Ctx)
+	if err == nil {
+		t.Fatal("expected blob validation to fail, but it succeeded")
+	}
+	test.MustExec(t, s.DB, `UPDATE blobs SET digest = $1 WHERE digest = $2`, blob.Digest.String(), wrongDigest.String())
+	failedAt := s.Clock.Now().Unix()
+	expectBlob(failedAt, fmt.Sprintf("expected digest %s, but got %s", wrongDigest, blob.Digest))
+
+	// the next successful validation clears the error
+	s.Clock.StepBy(time.Hour)
+	test.MustDo(t, validateBlobJob.ProcessOne(s.Ctx))
+	expectBlob(s.Clock.Now().Unix(), "")
+}
+
+func TestPostBlobsExist(t *testing.T) {
+	repo := models.Repository{AccountName: "test1", Name: "foo"}
+	s := test.NewSetup(t,
+		test.WithKeppelAPI,
+		test.WithQuotas,
+		test.WithAccount(models.Account{Name: "test1", AuthTenantID: "tenant1"}),
+		test.WithRepo(repo),
+	)
+	h := s.Handler
+
+	backedBlob := test.GenerateExampleLayer(1)
+	backedBlob.MustUpload(t, s, repo)
+	unbackedBlob := test.GenerateExampleLayer(2)
+	dbBlob := unbackedBlob.MustUpload(t, s, repo)
+	missingDigest := test.DeterministicDummyDigest(1)
+
+	// simulate a blob that is known from a replicated manifest, but whose contents have not been replicated yet
+	test.MustExec(t, s.DB, `UPDATE blobs SET storage_id = '' WHERE id = $1`, dbBlob.ID)
+
+	body := assert.JSONObject{"digests": []string{backedBlob.Digest.String(), unbackedBlob.Digest.String(), missingDigest.String()}}
+
+	// error case: no permission
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_blobs/exists",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant2,pull:tenant2"},
+		Body:         body,
+		ExpectStatus: http.StatusForbidden,
+		ExpectBody:   assert.StringData("no permission for repository:test1/foo:pull\n"),
+	}.Check(t, h)
+
+	// error case: no permission (the request body is not looked at before authentication)
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_blobs/exists",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant2,pull:tenant2"},
+		Body:         assert.JSONObject{"digests": []string{"sha256:foo"}},
+		ExpectStatus: http.StatusForbidden,
+		ExpectBody:   assert.StringData("no permission for repository:test1/foo:pull\n"),
+	}.Check(t, h)
+
+	// error case: malformed digest
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_blobs/exists",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		Body:         assert.JSONObject{"digests": []string{"sha256:foo"}},
+		ExpectStatus: http.StatusBadRequest,
+		ExpectBody:   assert.StringData(fmt.Sprintf("invalid digest %q: %s\n", "sha256:foo", digest.ErrDigestInvalidLength.Error())),
+	}.Check(t, h)
+
+	// error case: too many digests
+	tooManyDigests := make([]string, 1001)
+	for idx := range tooManyDigests {
+		tooManyDigests[idx] = test.DeterministicDummyDigest(idx).String()
+	}
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_blobs/exists",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		Body:         assert.JSONObject{"digests": tooManyDigests},
+		ExpectStatus: http.StatusBadRequest,
+		ExpectBody:   assert.StringData("cannot check more than 1000 digests at once\n"),
+	}.Check(t, h)
+
+	// happy case: unbacked blobs are reported as missing since their contents are not available locally
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_blobs/exists",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		Body:         body,
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"present": []digest.Digest{backedBlob.Digest},
+			"missing": []digest.Digest{unbackedBlob.Digest, missingDigest},
+		},
+	}.Check(t, h)
+
+	// blobs are only present if they are mounted in the given repo
+	// (this also works for repos that do not exist yet)
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/test1/repositories/bar/_blobs/exists",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		Body:         body,
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"present": []digest.Digest{},
+			"missing": []digest.Digest{backedBlob.Digest, unbackedBlob.Digest, missingDigest},
+		},
+	}.Check(t, h)
+
+	// an empty request yields an empty response
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_blobs/exists",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		Body:         assert.JSONObject{"digests": []string{}},
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   assert.JSONObject{"present": []digest.Digest{}, "missing": []digest.Digest{}},
+	}.Check(t, h)
+}
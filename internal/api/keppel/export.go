@@ -0,0 +1,335 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package keppelv1
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/opencontainers/go-digest"
+	"github.com/sapcc/go-bits/httpapi"
+	"github.com/sapcc/go-bits/respondwith"
+	"github.com/sapcc/go-bits/sqlext"
+
+	"github.com/sapcc/keppel/internal/keppel"
+	"github.com/sapcc/keppel/internal/models"
+	"github.com/sapcc/keppel/internal/processor"
+)
+
+// AccountExport is the document returned by GET /keppel/v1/accounts/:name/_export.
+// It describes the complete state of an account, except for the contents of
+// blobs and manifests, which are only referenced by digest.
+type AccountExport struct {
+	Account              keppel.Account              `json:"account"`
+	SecurityScanPolicies []keppel.SecurityScanPolicy `json:"security_scan_policies"`
+	Repositories         []ExportedRepository        `json:"repositories"`
+	IsTruncated          bool                        `json:"truncated,omitempty"`
+}
+
+// ExportedRepository appears in type AccountExport.
+type ExportedRepository struct {
+	Name      string             `json:"name"`
+	Manifests []ExportedManifest `json:"manifests"`
+	Tags      []ExportedTag      `json:"tags"`
+}
+
+// ExportedManifest appears in type AccountExport.
+type ExportedManifest struct {
+	Digest       digest.Digest   `json:"digest"`
+	MediaType    string          `json:"media_type"`
+	SizeBytes    uint64          `json:"size_bytes"`
+	PushedAt     int64           `json:"pushed_at"`
+	BlobDigests  []digest.Digest `json:"blobs,omitempty"`
+	ChildDigests []digest.Digest `json:"manifests,omitempty"`
+}
+
+// ExportedTag appears in type AccountExport.
+type ExportedTag struct {
+	Name     string        `json:"name"`
+	Digest   digest.Digest `json:"digest"`
+	PushedAt int64         `json:"pushed_at"`
+	IsPinned bool          `json:"pinned,omitempty"`
+}
+
+var exportRepoGetQuery = sqlext.SimplifyWhitespace(`
+	SELECT * FROM repos
+	 WHERE account_name = $1 AND $CONDITION
+	 ORDER BY name ASC
+	 LIMIT $LIMIT
+`)
+
+var exportManifestGetQuery = sqlext.SimplifyWhitespace(`
+	SELECT * FROM manifests WHERE repo_id = $1 AND deleted_at IS NULL ORDER BY digest
+`)
+
+var exportBlobRefsGetQuery = sqlext.SimplifyWhitespace(`
+	SELECT mbr.digest, b.digest
+	  FROM manifest_blob_refs mbr
+	  JOIN blobs b ON b.id = mbr.blob_id
+	 WHERE mbr.repo_id = $1
+	 ORDER BY mbr.digest, b.digest
+`)
+
+var exportManifestRefsGetQuery = sqlext.SimplifyWhitespace(`
+	SELECT parent_digest, child_digest
+	  FROM manifest_manifest_refs
+	 WHERE repo_id = $1
+	 ORDER BY parent_digest, child_digest
+`)
+
+var exportTagGetQuery = sqlext.SimplifyWhitespace(`
+	SELECT t.name, t.digest, t.pushed_at, p.name IS NOT NULL
+	  FROM tags t
+	  LEFT OUTER JOIN tag_pins p ON p.repo_id = t.repo_id AND p.name = t.name
+	 WHERE t.repo_id = $1
+	 ORDER BY t.name
+`)
+
+func (a *API) handleGetAccountExport(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/keppel/v1/accounts/:account/_export")
+	authz := a.authenticateRequest(w, r, accountScopeFromRequest(r, keppel.CanChangeAccount))
+	if authz == nil {
+		return
+	}
+	account := a.findAccountFromRequest(w, r, authz)
+	if account == nil {
+		return
+	}
+
+	accountRendered, err := keppel.RenderAccount(*account)
+	if respondwith.ObfuscatedErrorText(w, err) {
+		return
+	}
+	result := AccountExport{
+		Account:              accountRendered,
+		SecurityScanPolicies: []keppel.SecurityScanPolicy{},
+		Repositories:         []ExportedRepository{},
+	}
+	err = json.Unmarshal([]byte(account.SecurityScanPoliciesJSON), &result.SecurityScanPolicies)
+	if respondwith.ObfuscatedErrorText(w, err) {
+		return
+	}
+
+	// pagination happens on the level of repositories
+	query, bindValues, limit, err := paginatedQuery{
+		SQL:         exportRepoGetQuery,
+		MarkerField: "name",
+		Options:     r.URL.Query(),
+		BindValues:  []any{account.Name},
+	}.Prepare()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var dbRepos []models.Repository
+	_, err = a.db.Select(&dbRepos, query, bindValues...)
+	if respondwith.ObfuscatedErrorText(w, err) {
+		return
+	}
+
+	for _, dbRepo := range dbRepos {
+		if uint64(len(result.Repositories)) >= limit {
+			result.IsTruncated = true
+			break
+		}
+		repo, err := a.exportRepository(dbRepo)
+		if respondwith.ObfuscatedErrorText(w, err) {
+			return
+		}
+		result.Repositories = append(result.Repositories, repo)
+	}
+
+	respondwith.JSON(w, http.StatusOK, result)
+}
+
+func (a *API) exportRepository(dbRepo models.Repository) (ExportedRepository, error) {
+	result := ExportedRepository{
+		Name:      dbRepo.Name,
+		Manifests: []ExportedManifest{},
+		Tags:      []ExportedTag{},
+	}
+
+	blobDigests := make(map[digest.Digest][]digest.Digest)
+	err := sqlext.ForeachRow(a.db, exportBlobRefsGetQuery, []any{dbRepo.ID}, func(rows *sql.Rows) error {
+		var manifestDigest, blobDigest digest.Digest
+		err := rows.Scan(&manifestDigest, &blobDigest)
+		blobDigests[manifestDigest] = append(blobDigests[manifestDigest], blobDigest)
+		return err
+	})
+	if err != nil {
+		return ExportedRepository{}, err
+	}
+
+	childDigests := make(map[digest.Digest][]digest.Digest)
+	err = sqlext.ForeachRow(a.db, exportManifestRefsGetQuery, []any{dbRepo.ID}, func(rows *sql.Rows) error {
+		var parentDigest, childDigest digest.Digest
+		err := rows.Scan(&parentDigest, &childDigest)
+		childDigests[parentDigest] = append(childDigests[parentDigest], childDigest)
+		return err
+	})
+	if err != nil {
+		return ExportedRepository{}, err
+	}
+
+	var dbManifests []models.Manifest
+	_, err = a.db.Select(&dbManifests, exportManifestGetQuery, dbRepo.ID)
+	if err != nil {
+		return ExportedRepository{}, err
+	}
+	for _, dbManifest := range dbManifests {
+		result.Manifests = append(result.Manifests, ExportedManifest{
+			Digest:       dbManifest.Digest,
+			MediaType:    dbManifest.MediaType,
+			SizeBytes:    dbManifest.SizeBytes,
+			PushedAt:     dbManifest.PushedAt.Unix(),
+			BlobDigests:  blobDigests[dbManifest.Digest],
+			ChildDigests: childDigests[dbManifest.Digest],
+		})
+	}
+
+	err = sqlext.ForeachRow(a.db, exportTagGetQuery, []any{dbRepo.ID}, func(rows *sql.Rows) error {
+		var (
+			tag      ExportedTag
+			pushedAt time.Time
+		)
+		err := rows.Scan(&tag.Name, &tag.Digest, &pushedAt, &tag.IsPinned)
+		tag.PushedAt = pushedAt.Unix()
+		result.Tags = append(result.Tags, tag)
+		return err
+	})
+	return result, err
+}
+
+// AccountImportResult is the response body for POST /keppel/v1/accounts/:name/_import.
+type AccountImportResult struct {
+	Account      keppel.Account                  `json:"account"`
+	Repositories AccountImportResultRepositories `json:"repositories"`
+	Manifests    AccountImportResultManifests    `json:"manifests"`
+}
+
+// AccountImportResultRepositories appears in type AccountImportResult.
+type AccountImportResultRepositories struct {
+	Created []string `json:"created"`
+	Skipped []string `json:"skipped"`
+}
+
+// AccountImportResultManifests appears in type AccountImportResult.
+type AccountImportResultManifests struct {
+	Existing []string `json:"existing"`
+	Missing  []string `json:"missing"`
+}
+
+func (a *API) handlePostAccountImport(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/keppel/v1/accounts/:account/_import")
+	var req AccountExport
+	ok := decodeJSONRequestBody(w, r.Body, &req)
+	if !ok {
+		return
+	}
+	// the account is always imported under the name from the URL, so that an
+	// export can be imported under a different name
+	req.Account.Name = models.AccountName(mux.Vars(r)["account"])
+	if !checkAccountReadOnlyAttributes(w, req.Account) {
+		return
+	}
+
+	// check permission to create account
+	authz := a.authenticateRequest(w, r, authTenantScope(keppel.CanChangeAccount, req.Account.AuthTenantID))
+	if authz == nil {
+		return
+	}
+
+	// validate the parts of the document that CreateOrUpdateAccount() does not look at
+	var dbPolicies []keppel.SecurityScanPolicy
+	originalAccount, err := keppel.FindAccount(r.Context(), a.db, req.Account.Name)
+	if respondwith.ObfuscatedErrorText(w, err) {
+		return
+	}
+	if originalAccount != nil {
+		err := json.Unmarshal([]byte(originalAccount.SecurityScanPoliciesJSON), &dbPolicies)
+		if respondwith.ObfuscatedErrorText(w, err) {
+			return
+		}
+	}
+	if req.SecurityScanPolicies == nil {
+		req.SecurityScanPolicies = []keppel.SecurityScanPolicy{}
+	}
+	errs := validateSecurityScanPolicies(req.SecurityScanPolicies, dbPolicies, authz.UserIdentity.UserName())
+	for _, repo := range req.Repositories {
+		if !isValidRepoName(repo.Name) {
+			errs.Addf("invalid repository name: %q", repo.Name)
+		}
+		for _, manifest := range repo.Manifests {
+			if manifest.Digest.Validate() != nil {
+				errs.Addf("invalid manifest digest in repository %q: %q", repo.Name, manifest.Digest)
+			}
+		}
+	}
+	if !errs.IsEmpty() {
+		http.Error(w, errs.Join("\n"), http.StatusUnprocessableEntity)
+		return
+	}
+
+	// apply account configuration in the same way as PUT /keppel/v1/accounts/:name
+	// conflicting GC and tag policies are accepted, so that exported accounts can always be restored as they were
+	account, ok := a.createOrUpdateAccountFromRequest(w, r, authz, req.Account, processor.CreateOrUpdateAccountOptions{
+		ValidateUpstream:     true,
+		AllowPolicyConflicts: true,
+	})
+	if !ok {
+		return
+	}
+	err = a.updateSecurityScanPolicies(r, authz, account, dbPolicies, req.SecurityScanPolicies)
+	if respondwith.ObfuscatedErrorText(w, err) {
+		return
+	}
+
+	// set up repositories; manifests cannot be created since their contents are
+	// not part of the export (in replica accounts, they will be replicated on first pull),
+	// and tags are not restored either since a tag can only exist alongside its manifest
+	// (the `tags` lists in the document are ignored, see docs/api-spec.md)
+	result := AccountImportResult{
+		Repositories: AccountImportResultRepositories{Created: []string{}, Skipped: []string{}},
+		Manifests:    AccountImportResultManifests{Existing: []string{}, Missing: []string{}},
+	}
+	for _, exportedRepo := range req.Repositories {
+		repo, err := keppel.FindRepository(a.db, exportedRepo.Name, account.Name)
+		if errors.Is(err, sql.ErrNoRows) {
+			repo, err = keppel.FindOrCreateRepository(a.db, exportedRepo.Name, account.Name)
+			if respondwith.ObfuscatedErrorText(w, err) {
+				return
+			}
+			result.Repositories.Created = append(result.Repositories.Created, repo.Name)
+		} else {
+			if respondwith.ObfuscatedErrorText(w, err) {
+				return
+			}
+			result.Repositories.Skipped = append(result.Repositories.Skipped, repo.Name)
+		}
+
+		for _, exportedManifest := range exportedRepo.Manifests {
+			ref := fmt.Sprintf("%s@%s", repo.Name, exportedManifest.Digest)
+			_, err := keppel.FindManifest(a.db, *repo, exportedManifest.Digest)
+			if errors.Is(err, sql.ErrNoRows) {
+				result.Manifests.Missing = append(result.Manifests.Missing, ref)
+				continue
+			}
+			if respondwith.ObfuscatedErrorText(w, err) {
+				return
+			}
+			result.Manifests.Existing = append(result.Manifests.Existing, ref)
+		}
+	}
+
+	result.Account, err = keppel.RenderAccount(account)
+	if respondwith.ObfuscatedErrorText(w, err) {
+		return
+	}
+	respondwith.JSON(w, http.StatusOK, result)
+}
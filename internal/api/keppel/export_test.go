@@ -0,0 +1,342 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package keppelv1_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/sapcc/go-bits/assert"
+
+	keppelv1 "github.com/sapcc/keppel/internal/api/keppel"
+	"github.com/sapcc/keppel/internal/models"
+	"github.com/sapcc/keppel/internal/test"
+)
+
+func TestAccountExport(t *testing.T) {
+	s := test.NewSetup(t, test.WithKeppelAPI)
+	h := s.Handler
+
+	// create an account with all kinds of policies
+	gcPoliciesJSON := []assert.JSONObject{{
+		"match_repository": ".*",
+		"only_untagged":    true,
+		"action":           "delete",
+	}}
+	rbacPoliciesJSON := []assert.JSONObject{{
+		"match_repository": "library/.*",
+		"permissions":      []string{"anonymous_pull"},
+	}}
+	tagPoliciesJSON := []assert.JSONObject{{
+		"match_repository": "library/.*",
+		"block_overwrite":  true,
+	}}
+	securityScanPoliciesJSON := []assert.JSONObject{{
+		"match_repository":       ".*",
+		"match_vulnerability_id": ".*",
+		"except_fix_released":    true,
+		"action": assert.JSONObject{
+			"ignore":     true,
+			"assessment": "risk accepted",
+		},
+	}}
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/keppel/v1/accounts/first",
+		Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body: assert.JSONObject{
+			"account": assert.JSONObject{
+				"auth_tenant_id": "tenant1",
+				"gc_policies":    gcPoliciesJSON,
+				"rbac_policies":  rbacPoliciesJSON,
+				"tag_policies":   tagPoliciesJSON,
+			},
+		},
+		ExpectStatus: http.StatusOK,
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "PUT",
+		Path:         "/keppel/v1/accounts/first/security_scan_policies",
+		Header:       map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body:         assert.JSONObject{"policies": securityScanPoliciesJSON},
+		ExpectStatus: http.StatusOK,
+	}.Check(t, h)
+
+	// fill the account with some contents
+	image := test.GenerateImage(test.GenerateExampleLayer(1))
+	image.MustUpload(t, s, models.Repository{AccountName: "first", Name: "library/foo"}, "latest")
+	test.MustInsert(t, s.DB, &models.Repository{AccountName: "first", Name: "empty"})
+
+	// test permissions
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/first/_export",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: http.StatusForbidden,
+	}.Check(t, h)
+
+	// test export
+	expectedAccountJSON := assert.JSONObject{
+		"name":           "first",
+		"auth_tenant_id": "tenant1",
+		"gc_policies":    gcPoliciesJSON,
+		"metadata":       nil,
+		"rbac_policies":  rbacPoliciesJSON,
+		"tag_policies":   tagPoliciesJSON,
+	}
+	fooRepoJSON := assert.JSONObject{
+		"name": "library/foo",
+		"manifests": []assert.JSONObject{{
+			"digest":     image.Manifest.Digest,
+			"media_type": image.Manifest.MediaType,
+			"size_bytes": image.SizeBytes(),
+			"pushed_at":  s.Clock.Now().Unix(),
+			"blobs":      sortedDigests(image.Layers[0].Digest, image.Config.Digest),
+		}},
+		"tags": []assert.JSONObject{{
+			"name":      "latest",
+			"digest":    image.Manifest.Digest,
+			"pushed_at": s.Clock.Now().Unix(),
+		}},
+	}
+	emptyRepoJSON := assert.JSONObject{
+		"name":      "empty",
+		"manifests": []assert.JSONObject{},
+		"tags":      []assert.JSONObject{},
+	}
+	_, respBody := assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/first/_export",
+		Header:       map[string]string{"X-Test-Perms": "change:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"account":                expectedAccountJSON,
+			"security_scan_policies": securityScanPoliciesJSON,
+			"repositories":           []assert.JSONObject{emptyRepoJSON, fooRepoJSON},
+		},
+	}.Check(t, h)
+
+	// test pagination
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/first/_export?limit=1",
+		Header:       map[string]string{"X-Test-Perms": "change:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"account":                expectedAccountJSON,
+			"security_scan_policies": securityScanPoliciesJSON,
+			"repositories":           []assert.JSONObject{emptyRepoJSON},
+			"truncated":              true,
+		},
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/first/_export?limit=1&marker=empty",
+		Header:       map[string]string{"X-Test-Perms": "change:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"account":                expectedAccountJSON,
+			"security_scan_policies": securityScanPoliciesJSON,
+			"repositories":           []assert.JSONObject{fooRepoJSON},
+		},
+	}.Check(t, h)
+
+	// test round-trip fidelity of policies: creating another account from the
+	// exported configuration must yield the same configuration
+	var export keppelv1.AccountExport
+	test.MustDo(t, json.Unmarshal(respBody, &export))
+	export.Account.Name = "second"
+	assert.HTTPRequest{
+		Method:       "PUT",
+		Path:         "/keppel/v1/accounts/second",
+		Header:       map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body:         assert.JSONObject{"account": export.Account},
+		ExpectStatus: http.StatusOK,
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "PUT",
+		Path:         "/keppel/v1/accounts/second/security_scan_policies",
+		Header:       map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body:         assert.JSONObject{"policies": export.SecurityScanPolicies},
+		ExpectStatus: http.StatusOK,
+	}.Check(t, h)
+
+	expectedAccountJSON["name"] = "second"
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/second/_export",
+		Header:       map[string]string{"X-Test-Perms": "change:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"account":                expectedAccountJSON,
+			"security_scan_policies": securityScanPoliciesJSON,
+			"repositories":           []assert.JSONObject{},
+		},
+	}.Check(t, h)
+}
+
+func sortedDigests(digests ...digest.Digest) []digest.Digest {
+	slices.Sort(digests)
+	return digests
+}
+
+func TestAccountImport(t *testing.T) {
+	s := test.NewSetup(t, test.WithKeppelAPI)
+	h := s.Handler
+
+	image := test.GenerateImage(test.GenerateExampleLayer(1))
+	gcPoliciesJSON := []assert.JSONObject{{
+		"match_repository": ".*",
+		"only_untagged":    true,
+		"action":           "delete",
+	}}
+	rbacPoliciesJSON := []assert.JSONObject{{
+		"match_repository": "library/.*",
+		"permissions":      []string{"anonymous_pull"},
+	}}
+	securityScanPoliciesJSON := []assert.JSONObject{{
+		"match_repository":       ".*",
+		"match_vulnerability_id": ".*",
+		"except_fix_released":    true,
+		"action": assert.JSONObject{
+			"ignore":     true,
+			"assessment": "risk accepted",
+		},
+	}}
+	// this document is in the format generated by GET /keppel/v1/accounts/:name/_export
+	exportJSON := assert.JSONObject{
+		"account": assert.JSONObject{
+			"name":           "original",
+			"auth_tenant_id": "tenant1",
+			"gc_policies":    gcPoliciesJSON,
+			"metadata":       nil,
+			"rbac_policies":  rbacPoliciesJSON,
+		},
+		"security_scan_policies": securityScanPoliciesJSON,
+		"repositories": []assert.JSONObject{
+			{
+				"name":      "empty",
+				"manifests": []assert.JSONObject{},
+				"tags":      []assert.JSONObject{},
+			},
+			{
+				"name": "library/foo",
+				"manifests": []assert.JSONObject{{
+					"digest":     image.Manifest.Digest,
+					"media_type": image.Manifest.MediaType,
+					"size_bytes": image.SizeBytes(),
+					"pushed_at":  s.Clock.Now().Unix(),
+				}},
+				"tags": []assert.JSONObject{{
+					"name":      "latest",
+					"digest":    image.Manifest.Digest,
+					"pushed_at": s.Clock.Now().Unix(),
+				}},
+			},
+		},
+	}
+
+	// test permissions
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/first/_import",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		Body:         exportJSON,
+		ExpectStatus: http.StatusForbidden,
+	}.Check(t, h)
+
+	// test validation: nothing is created if the document is invalid
+	assert.HTTPRequest{
+		Method: "POST",
+		Path:   "/keppel/v1/accounts/first/_import",
+		Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body: assert.JSONObject{
+			"account":      assert.JSONObject{"auth_tenant_id": "tenant1"},
+			"repositories": []assert.JSONObject{{"name": "Invalid"}},
+		},
+		ExpectStatus: http.StatusUnprocessableEntity,
+		ExpectBody:   assert.StringData("invalid repository name: \"Invalid\"\n"),
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/first",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: http.StatusNotFound,
+	}.Check(t, h)
+
+	// test import onto a fresh instance (under a different name than in the export)
+	expectedAccountJSON := assert.JSONObject{
+		"name":           "first",
+		"auth_tenant_id": "tenant1",
+		"gc_policies":    gcPoliciesJSON,
+		"metadata":       nil,
+		"rbac_policies":  rbacPoliciesJSON,
+	}
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/first/_import",
+		Header:       map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body:         exportJSON,
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"account": expectedAccountJSON,
+			"repositories": assert.JSONObject{
+				"created": []string{"empty", "library/foo"},
+				"skipped": []string{},
+			},
+			"manifests": assert.JSONObject{
+				"existing": []string{},
+				"missing":  []string{"library/foo@" + image.Manifest.Digest.String()},
+			},
+		},
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/first",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   assert.JSONObject{"account": expectedAccountJSON},
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/first/security_scan_policies",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   assert.JSONObject{"policies": securityScanPoliciesJSON},
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/first/repositories",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{"repositories": []assert.JSONObject{
+			{"name": "empty", "manifest_count": 0, "tag_count": 0},
+			{"name": "library/foo", "manifest_count": 0, "tag_count": 0},
+		}},
+	}.Check(t, h)
+
+	// importing again is idempotent, and reports the manifest that was pushed in the meantime
+	image.MustUpload(t, s, models.Repository{AccountName: "first", Name: "library/foo"}, "latest")
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/first/_import",
+		Header:       map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body:         exportJSON,
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"account": expectedAccountJSON,
+			"repositories": assert.JSONObject{
+				"created": []string{},
+				"skipped": []string{"empty", "library/foo"},
+			},
+			"manifests": assert.JSONObject{
+				"existing": []string{"library/foo@" + image.Manifest.Digest.String()},
+				"missing":  []string{},
+			},
+		},
+	}.Check(t, h)
+}
@@ -0,0 +1,66 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package keppelv1
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/sapcc/go-bits/httpapi"
+	"github.com/sapcc/go-bits/respondwith"
+
+	"github.com/sapcc/keppel/internal/keppel"
+	"github.com/sapcc/keppel/internal/models"
+)
+
+// IntegrityReport represents an entry in the `integrity_reports` table in the API.
+type IntegrityReport struct {
+	CreatedAt     int64                  `json:"created_at"`
+	WindowSeconds uint64                 `json:"window_seconds"`
+	Blobs         IntegrityReportOutcome `json:"blobs"`
+	Manifests     IntegrityReportOutcome `json:"manifests"`
+}
+
+// IntegrityReportOutcome appears in type IntegrityReport.
+type IntegrityReportOutcome struct {
+	ValidatedCount uint64 `json:"validated"`
+	FailedCount    uint64 `json:"failed"`
+}
+
+func (a *API) handleGetIntegrityReport(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/keppel/v1/accounts/:account/integrity_report")
+	authz := a.authenticateRequest(w, r, accountScopeFromRequest(r, keppel.CanViewAccount))
+	if authz == nil {
+		return
+	}
+	account := a.findAccountFromRequest(w, r, authz)
+	if account == nil {
+		return
+	}
+
+	var report models.IntegrityReport
+	err := a.db.SelectOne(&report, `SELECT * FROM integrity_reports WHERE account_name = $1`, account.Name)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "no integrity report has been generated for this account yet", http.StatusNotFound)
+		return
+	}
+	if respondwith.ObfuscatedErrorText(w, err) {
+		return
+	}
+
+	respondwith.JSON(w, http.StatusOK, map[string]any{"integrity_report": IntegrityReport{
+		CreatedAt:     report.CreatedAt.Unix(),
+		WindowSeconds: uint64(models.IntegrityReportWindow / time.Second),
+		Blobs: IntegrityReportOutcome{
+			ValidatedCount: report.ValidatedBlobCount,
+			FailedCount:    report.FailedBlobCount,
+		},
+		Manifests: IntegrityReportOutcome{
+			ValidatedCount: report.ValidatedManifestCount,
+			FailedCount:    report.FailedManifestCount,
+		},
+	}})
+}
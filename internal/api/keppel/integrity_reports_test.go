@@ -0,0 +1,66 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package keppelv1_test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-bits/assert"
+
+	"github.com/sapcc/keppel/internal/models"
+	"github.com/sapcc/keppel/internal/test"
+)
+
+func TestGetIntegrityReport(t *testing.T) {
+	s := test.NewSetup(t,
+		test.WithKeppelAPI,
+		test.WithAccount(models.Account{Name: "test1", AuthTenantID: "tenant1"}),
+	)
+	h := s.Handler
+
+	// error case: no permission
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/integrity_report",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant2"},
+		ExpectStatus: http.StatusForbidden,
+		ExpectBody:   assert.StringData("no permission for keppel_account:test1:view\n"),
+	}.Check(t, h)
+
+	// error case: no report yet
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/integrity_report",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody:   assert.StringData("no integrity report has been generated for this account yet\n"),
+	}.Check(t, h)
+
+	// happy case
+	s.Clock.StepBy(time.Hour)
+	test.MustDo(t, s.DB.Insert(&models.IntegrityReport{
+		AccountName:            "test1",
+		CreatedAt:              s.Clock.Now(),
+		ValidatedBlobCount:     42,
+		FailedBlobCount:        1,
+		ValidatedManifestCount: 23,
+		FailedManifestCount:    0,
+	}))
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/integrity_report",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"integrity_report": assert.JSONObject{
+				"created_at":     s.Clock.Now().Unix(),
+				"window_seconds": 604800,
+				"blobs":          assert.JSONObject{"validated": 42, "failed": 1},
+				"manifests":      assert.JSONObject{"validated": 23, "failed": 0},
+			},
+		},
+	}.Check(t, h)
+}
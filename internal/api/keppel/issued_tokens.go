@@ -0,0 +1,113 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package keppelv1
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/sapcc/go-bits/httpapi"
+	"github.com/sapcc/go-bits/respondwith"
+
+	"github.com/sapcc/keppel/internal/keppel"
+	"github.com/sapcc/keppel/internal/models"
+)
+
+// IssuedToken represents an entry in the `issued_tokens` table in the API.
+type IssuedToken struct {
+	ID        string   `json:"id"`
+	UserName  string   `json:"user_name"`
+	Scopes    []string `json:"scopes"`
+	IssuedAt  int64    `json:"issued_at"`
+	ExpiresAt int64    `json:"expires_at"`
+}
+
+func (a *API) authenticateIssuedTokensRequest(w http.ResponseWriter, r *http.Request) (authTenantID string, ok bool) {
+	authTenantID = mux.Vars(r)["auth_tenant_id"]
+	authz := a.authenticateRequest(w, r, authTenantScope(keppel.CanChangeAccount, authTenantID))
+	if authz == nil {
+		return "", false
+	}
+	if !a.cfg.TrackIssuedTokens {
+		http.Error(w, "tracking of issued tokens is not enabled", http.StatusNotFound)
+		return "", false
+	}
+	return authTenantID, true
+}
+
+func (a *API) handleGetIssuedTokens(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/keppel/v1/admin/tokens/:auth_tenant_id")
+	authTenantID, ok := a.authenticateIssuedTokensRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var dbTokens []models.IssuedToken
+	_, err := a.db.Select(&dbTokens,
+		`SELECT * FROM issued_tokens WHERE auth_tenant_id = $1 AND expires_at > $2 AND revoked_at IS NULL ORDER BY issued_at, id`,
+		authTenantID, a.timeNow())
+	if respondwith.ObfuscatedErrorText(w, err) {
+		return
+	}
+
+	result := make([]IssuedToken, len(dbTokens))
+	for idx, dbToken := range dbTokens {
+		result[idx] = IssuedToken{
+			ID:        dbToken.ID,
+			UserName:  dbToken.UserName,
+			Scopes:    strings.Fields(dbToken.Scopes),
+			IssuedAt:  dbToken.IssuedAt.Unix(),
+			ExpiresAt: dbToken.ExpiresAt.Unix(),
+		}
+	}
+	respondwith.JSON(w, http.StatusOK, map[string]any{"tokens": result})
+}
+
+func (a *API) handleDeleteIssuedTokens(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/keppel/v1/admin/tokens/:auth_tenant_id")
+	authTenantID, ok := a.authenticateIssuedTokensRequest(w, r)
+	if !ok {
+		return
+	}
+
+	// revoking is done by token ID, since a token covering multiple auth tenants
+	// shall not remain usable in any of them
+	_, err := a.db.Exec(
+		`UPDATE issued_tokens SET revoked_at = $2 WHERE revoked_at IS NULL AND id IN (
+			SELECT id FROM issued_tokens WHERE auth_tenant_id = $1 AND expires_at > $2
+		)`,
+		authTenantID, a.timeNow())
+	if respondwith.ObfuscatedErrorText(w, err) {
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *API) handleDeleteIssuedToken(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/keppel/v1/admin/tokens/:auth_tenant_id/:token_id")
+	authTenantID, ok := a.authenticateIssuedTokensRequest(w, r)
+	if !ok {
+		return
+	}
+	tokenID := mux.Vars(r)["token_id"]
+
+	// only active tokens belonging to this auth tenant can be revoked
+	isActive, err := a.db.SelectBool(
+		`SELECT EXISTS(SELECT 1 FROM issued_tokens WHERE id = $1 AND auth_tenant_id = $2 AND expires_at > $3 AND revoked_at IS NULL)`,
+		tokenID, authTenantID, a.timeNow())
+	if respondwith.ObfuscatedErrorText(w, err) {
+		return
+	}
+	if !isActive {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	_, err = a.db.Exec(`UPDATE issued_tokens SET revoked_at = $2 WHERE id = $1 AND revoked_at IS NULL`, tokenID, a.timeNow())
+	if respondwith.ObfuscatedErrorText(w, err) {
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
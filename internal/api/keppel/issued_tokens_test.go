@@ -0,0 +1,186 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package keppelv1_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+
+	"github.com/sapcc/keppel/internal/keppel"
+	"github.com/sapcc/keppel/internal/models"
+	"github.com/sapcc/keppel/internal/test"
+)
+
+func TestIssuedTokens(t *testing.T) {
+	s := test.NewSetup(t,
+		test.WithKeppelAPI,
+		test.WithQuotas,
+		test.WithTokenTracking,
+		test.WithAccount(models.Account{Name: "test1", AuthTenantID: "tenant1"}),
+		test.WithAccount(models.Account{Name: "test2", AuthTenantID: "tenant2"}),
+	)
+	h := s.Handler
+
+	image := test.GenerateImage(test.GenerateExampleLayer(1))
+	image.MustUpload(t, s, models.Repository{AccountName: "test1", Name: "foo"}, "latest")
+
+	// obtain tokens through the Auth API, which records them
+	issueToken := func(scope, perms string) string {
+		t.Helper()
+		_, respBodyBytes := assert.HTTPRequest{
+			Method:       "GET",
+			Path:         "/keppel/v1/auth?service=registry.example.org&scope=" + scope,
+			Header:       map[string]string{"X-Test-Perms": perms},
+			ExpectStatus: http.StatusOK,
+		}.Check(t, h)
+		var tokenData struct {
+			Token string `json:"token"`
+		}
+		test.MustDo(t, json.Unmarshal(respBodyBytes, &tokenData))
+		return tokenData.Token
+	}
+	pullToken := issueToken("repository:test1/foo:pull", "pull:tenant1")
+	pushToken := issueToken("repository:test1/foo:pull,push", "pull:tenant1,push:tenant1")
+	otherToken := issueToken("repository:test2/foo:pull", "pull:tenant2")
+
+	// listing requires permission to change accounts in the auth tenant
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/admin/tokens/tenant1",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: http.StatusForbidden,
+		ExpectBody:   assert.StringData("no permission for keppel_auth_tenant:tenant1:change\n"),
+	}.Check(t, h)
+
+	type listedToken struct {
+		ID       string   `json:"id"`
+		UserName string   `json:"user_name"`
+		Scopes   []string `json:"scopes"`
+	}
+	listTokens := func(authTenantID string) []listedToken {
+		t.Helper()
+		_, respBodyBytes := assert.HTTPRequest{
+			Method:       "GET",
+			Path:         "/keppel/v1/admin/tokens/" + authTenantID,
+			Header:       map[string]string{"X-Test-Perms": "change:" + authTenantID},
+			ExpectStatus: http.StatusOK,
+		}.Check(t, h)
+		var data struct {
+			Tokens []listedToken `json:"tokens"`
+		}
+		test.MustDo(t, json.Unmarshal(respBodyBytes, &data))
+		return data.Tokens
+	}
+
+	// each auth tenant only sees the tokens for its own accounts
+	tokens := listTokens("tenant1")
+	if len(tokens) != 2 {
+		t.Fatalf("expected 2 tokens for tenant1, but got %d", len(tokens))
+	}
+	assert.DeepEqual(t, "user name", tokens[0].UserName, s.AD.ExpectedUserName)
+	assert.DeepEqual(t, "scopes of first token", tokens[0].Scopes, []string{"repository:test1/foo:pull"})
+	assert.DeepEqual(t, "scopes of second token", tokens[1].Scopes, []string{"repository:test1/foo:pull,push"})
+	pullTokenID := tokens[0].ID
+	otherTokens := listTokens("tenant2")
+	if len(otherTokens) != 1 {
+		t.Fatalf("expected 1 token for tenant2, but got %d", len(otherTokens))
+	}
+
+	// all tokens are usable at first
+	pullManifestWith := func(token string, expectStatus int) {
+		t.Helper()
+		req := assert.HTTPRequest{
+			Method:       "GET",
+			Path:         "/v2/test1/foo/manifests/latest",
+			Header:       map[string]string{"Authorization": "Bearer " + token},
+			ExpectStatus: expectStatus,
+			ExpectHeader: test.VersionHeader,
+		}
+		if expectStatus == http.StatusOK {
+			req.ExpectBody = assert.ByteData(image.Manifest.Contents)
+		} else {
+			req.ExpectBody = test.ErrorCode(keppel.ErrUnauthorized)
+		}
+		req.Check(t, h)
+	}
+	pullManifestWith(pullToken, http.StatusOK)
+	pullManifestWith(pushToken, http.StatusOK)
+
+	// revoking a single token: tokens of other auth tenants cannot be revoked
+	// this way, and neither can unknown tokens
+	assert.HTTPRequest{
+		Method:       "DELETE",
+		Path:         "/keppel/v1/admin/tokens/tenant1/" + otherTokens[0].ID,
+		Header:       map[string]string{"X-Test-Perms": "change:tenant1"},
+		ExpectStatus: http.StatusNotFound,
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "DELETE",
+		Path:         "/keppel/v1/admin/tokens/tenant1/unknown",
+		Header:       map[string]string{"X-Test-Perms": "change:tenant1"},
+		ExpectStatus: http.StatusNotFound,
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "DELETE",
+		Path:         "/keppel/v1/admin/tokens/tenant1/" + pullTokenID,
+		Header:       map[string]string{"X-Test-Perms": "change:tenant1"},
+		ExpectStatus: http.StatusNoContent,
+	}.Check(t, h)
+
+	// the revoked token cannot be used anymore, and is not listed anymore
+	pullManifestWith(pullToken, http.StatusUnauthorized)
+	pullManifestWith(pushToken, http.StatusOK)
+	tokens = listTokens("tenant1")
+	if len(tokens) != 1 {
+		t.Fatalf("expected 1 token for tenant1, but got %d", len(tokens))
+	}
+	assert.DeepEqual(t, "scopes of remaining token", tokens[0].Scopes, []string{"repository:test1/foo:pull,push"})
+
+	// bulk-revoking all tokens of an auth tenant does not affect other auth tenants
+	assert.HTTPRequest{
+		Method:       "DELETE",
+		Path:         "/keppel/v1/admin/tokens/tenant1",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: http.StatusForbidden,
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "DELETE",
+		Path:         "/keppel/v1/admin/tokens/tenant1",
+		Header:       map[string]string{"X-Test-Perms": "change:tenant1"},
+		ExpectStatus: http.StatusNoContent,
+	}.Check(t, h)
+	pullManifestWith(pushToken, http.StatusUnauthorized)
+	assert.DeepEqual(t, "tokens for tenant1", len(listTokens("tenant1")), 0)
+	assert.DeepEqual(t, "tokens for tenant2", len(listTokens("tenant2")), 1)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/v2/test2/foo/tags/list",
+		Header:       map[string]string{"Authorization": "Bearer " + otherToken},
+		ExpectStatus: http.StatusNotFound,
+		ExpectHeader: test.VersionHeader,
+		ExpectBody:   test.ErrorCode(keppel.ErrNameUnknown),
+	}.Check(t, h)
+
+	// tokens that were not tracked (like this one, which is issued directly
+	// instead of through the Auth API) are unaffected by revocation
+	pullManifestWith(s.GetToken(t, "repository:test1/foo:pull"), http.StatusOK)
+}
+
+func TestIssuedTokensWithoutTracking(t *testing.T) {
+	s := test.NewSetup(t,
+		test.WithKeppelAPI,
+		test.WithAccount(models.Account{Name: "test1", AuthTenantID: "tenant1"}),
+	)
+
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/admin/tokens/tenant1",
+		Header:       map[string]string{"X-Test-Perms": "change:tenant1"},
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody:   assert.StringData("tracking of issued tokens is not enabled\n"),
+	}.Check(t, s.Handler)
+}
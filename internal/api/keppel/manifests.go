@@ -10,7 +10,9 @@ import (
 	"fmt"
 	"html"
 	"net/http"
+	"slices"
 	"sort"
+	"time"
 
 	"github.com/gorilla/mux"
 	. "github.com/majewsky/gg/option"
@@ -41,6 +43,8 @@ type Manifest struct {
 	VulnerabilityScanErrorMessage string                     `json:"vulnerability_scan_error,omitempty"`
 	MinLayerCreatedAt             Option[int64]              `json:"min_layer_created_at"`
 	MaxLayerCreatedAt             Option[int64]              `json:"max_layer_created_at"`
+	LastValidatedAt               Option[int64]              `json:"last_validated_at,omitzero"`
+	ValidationErrorMessage        string                     `json:"validation_error,omitempty"`
 }
 
 // Tag represents a tag in the API.
@@ -48,12 +52,13 @@ type Tag struct {
 	Name         string        `json:"name"`
 	PushedAt     int64         `json:"pushed_at"`
 	LastPulledAt Option[int64] `json:"last_pulled_at"`
+	IsPinned     bool          `json:"pinned,omitempty"`
 }
 
 var manifestGetQuery = sqlext.SimplifyWhitespace(`
 	SELECT *
 	  FROM manifests
-	 WHERE repo_id = $1 AND $CONDITION
+	 WHERE repo_id = $1 AND deleted_at IS NULL AND $CONDITION
 	 ORDER BY digest ASC
 	 LIMIT $LIMIT
 `)
@@ -61,6 +66,7 @@ var manifestGetQuery = sqlext.SimplifyWhitespace(`
 var securityInfoGetQuery = sqlext.SimplifyWhitespace(`
 	SELECT * FROM trivy_security_info
 	WHERE repo_id = $1 AND $CONDITION
+	  AND digest NOT IN (SELECT digest FROM manifests WHERE repo_id = $1 AND deleted_at IS NOT NULL)
 	ORDER BY digest ASC
 	LIMIT $LIMIT
 `)
@@ -71,6 +77,13 @@ var tagGetQuery = sqlext.SimplifyWhitespace(`
 	 WHERE repo_id = $1 AND digest >= $2 AND digest <= $3
 `)
 
+var tagPinGetQuery = sqlext.SimplifyWhitespace(`
+	SELECT p.name
+	  FROM tag_pins p
+	  JOIN tags t ON t.repo_id = p.repo_id AND t.name = p.name
+	 WHERE p.repo_id = $1 AND t.digest >= $2 AND t.digest <= $3
+`)
+
 func (a *API) handleGetManifests(w http.ResponseWriter, r *http.Request) {
 	httpapi.IdentifyEndpoint(r, "/keppel/v1/accounts/:account/repositories/:repo/_manifests")
 	authz := a.authenticateRequest(w, r, repoScopeFromRequest(r, keppel.CanPullFromAccount))
@@ -157,6 +170,8 @@ func (a *API) handleGetManifests(w http.ResponseWriter, r *http.Request) {
 			VulnerabilityScanErrorMessage: securityInfo.Message,
 			MinLayerCreatedAt:             keppel.MaybeTimeToUnix(dbManifest.MinLayerCreatedAt),
 			MaxLayerCreatedAt:             keppel.MaybeTimeToUnix(dbManifest.MaxLayerCreatedAt),
+			LastValidatedAt:               keppel.MaybeTimeToUnix(dbManifest.LastValidatedAt),
+			ValidationErrorMessage:        dbManifest.ValidationErrorMessage,
 		})
 	}
 
@@ -174,12 +189,19 @@ func (a *API) handleGetManifests(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		var pinnedTagNames []string
+		_, err = a.db.Select(&pinnedTagNames, tagPinGetQuery, repo.ID, firstDigest, lastDigest)
+		if respondwith.ObfuscatedErrorText(w, err) {
+			return
+		}
+
 		tagsByDigest := make(map[digest.Digest][]Tag)
 		for _, dbTag := range dbTags {
 			tagsByDigest[dbTag.Digest] = append(tagsByDigest[dbTag.Digest], Tag{
 				Name:         dbTag.Name,
 				PushedAt:     dbTag.PushedAt.Unix(),
 				LastPulledAt: keppel.MaybeTimeToUnix(dbTag.LastPulledAt),
+				IsPinned:     slices.Contains(pinnedTagNames, dbTag.Name),
 			})
 		}
 		for _, manifest := range result.Manifests {
@@ -208,6 +230,11 @@ func (a *API) handleDeleteManifest(w http.ResponseWriter, r *http.Request) {
 	if repo == nil {
 		return
 	}
+	err := api.CheckAccountWritable(a.cfg, account.Reduced(), false)
+	if err != nil {
+		keppel.AsRegistryV2Error(err).WriteAsTextTo(w)
+		return
+	}
 	parsedDigest, err := digest.Parse(mux.Vars(r)["digest"])
 	if err != nil {
 		http.Error(w, "digest not found", http.StatusNotFound)
@@ -248,14 +275,29 @@ func (a *API) handleDeleteTag(w http.ResponseWriter, r *http.Request) {
 	if repo == nil {
 		return
 	}
+	err := api.CheckAccountWritable(a.cfg, account.Reduced(), false)
+	if err != nil {
+		keppel.AsRegistryV2Error(err).WriteAsTextTo(w)
+		return
+	}
 	tagName := mux.Vars(r)["tag_name"]
 
+	// RBAC policies with "match_tag" can only be enforced once the tag is known
+	tagActions, err := auth.FilterTagActions(r, authz, account.Reduced(), *repo, tagName, []string{"delete"})
+	if respondwith.ObfuscatedErrorText(w, err) {
+		return
+	}
+	if tagActions != nil && !slices.Contains(tagActions, "delete") {
+		http.Error(w, fmt.Sprintf("delete access to tag %q is not allowed", tagName), http.StatusForbidden)
+		return
+	}
+
 	tagPolicies, err := api.GetTagPolicies(a.db, account.Reduced())
 	if respondwith.ObfuscatedErrorText(w, err) {
 		return
 	}
 
-	err = a.processor().DeleteTag(account.Reduced(), *repo, tagName, tagPolicies, keppel.AuditContext{
+	_, err = a.processor().DeleteTag(account.Reduced(), *repo, tagName, tagPolicies, keppel.AuditContext{
 		UserIdentity: authz.UserIdentity,
 		Request:      r,
 	})
@@ -270,6 +312,177 @@ func (a *API) handleDeleteTag(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
+var tagsForManifestGetQuery = sqlext.SimplifyWhitespace(`
+	SELECT t.name, t.pushed_at, t.last_pulled_at, (p.name IS NOT NULL)
+	  FROM tags t
+	  LEFT OUTER JOIN tag_pins p ON p.repo_id = t.repo_id AND p.name = t.name
+	 WHERE t.repo_id = $1 AND t.digest = $2
+	 ORDER BY t.name
+`)
+
+func (a *API) handleGetManifestTags(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/keppel/v1/accounts/:account/repositories/:repo/_manifests/:digest/tags")
+	authz := a.authenticateRequest(w, r, repoScopeFromRequest(r, keppel.CanPullFromAccount))
+	if authz == nil {
+		return
+	}
+	account := a.findAccountFromRequest(w, r, authz)
+	if account == nil {
+		return
+	}
+	repo := a.findRepositoryFromRequest(w, r, account.Name)
+	if repo == nil {
+		return
+	}
+	parsedDigest, err := digest.Parse(mux.Vars(r)["digest"])
+	if err != nil {
+		http.Error(w, "no such manifest", http.StatusNotFound)
+		return
+	}
+
+	manifest, err := keppel.FindManifest(a.db, *repo, parsedDigest)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && manifest.DeletedAt.IsSome()) {
+		http.Error(w, "no such manifest", http.StatusNotFound)
+		return
+	}
+	if respondwith.ObfuscatedErrorText(w, err) {
+		return
+	}
+
+	tags := []Tag{}
+	err = sqlext.ForeachRow(a.db, tagsForManifestGetQuery, []any{repo.ID, manifest.Digest}, func(rows *sql.Rows) error {
+		var (
+			name         string
+			pushedAt     time.Time
+			lastPulledAt Option[time.Time]
+			isPinned     bool
+		)
+		err := rows.Scan(&name, &pushedAt, &lastPulledAt, &isPinned)
+		if err != nil {
+			return err
+		}
+		tags = append(tags, Tag{
+			Name:         name,
+			PushedAt:     pushedAt.Unix(),
+			LastPulledAt: keppel.MaybeTimeToUnix(lastPulledAt),
+			IsPinned:     isPinned,
+		})
+		return nil
+	})
+	if respondwith.ObfuscatedErrorText(w, err) {
+		return
+	}
+
+	respondwith.JSON(w, http.StatusOK, map[string]any{"tags": tags})
+}
+
+func (a *API) handleGetTagDigest(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/keppel/v1/accounts/:account/repositories/:repo/_tags/:name/digest")
+	authz := a.authenticateRequest(w, r, repoScopeFromRequest(r, keppel.CanPullFromAccount))
+	if authz == nil {
+		return
+	}
+	account := a.findAccountFromRequest(w, r, authz)
+	if account == nil {
+		return
+	}
+	repo := a.findRepositoryFromRequest(w, r, account.Name)
+	if repo == nil {
+		return
+	}
+
+	tagName := mux.Vars(r)["tag_name"]
+
+	// RBAC policies with "match_tag" can only be enforced once the tag is known
+	tagActions, err := auth.FilterTagActions(r, authz, account.Reduced(), *repo, tagName, []string{"pull"})
+	if respondwith.ObfuscatedErrorText(w, err) {
+		return
+	}
+	if tagActions != nil && !slices.Contains(tagActions, "pull") {
+		http.Error(w, fmt.Sprintf("pull access to tag %q is not allowed", tagName), http.StatusForbidden)
+		return
+	}
+
+	var tag models.Tag
+	err = a.db.SelectOne(&tag, `SELECT * FROM tags WHERE repo_id = $1 AND name = $2`, repo.ID, tagName)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "no such tag", http.StatusNotFound)
+		return
+	}
+	if respondwith.ObfuscatedErrorText(w, err) {
+		return
+	}
+
+	respondwith.JSON(w, http.StatusOK, map[string]any{"digest": tag.Digest})
+}
+
+func (a *API) handlePutTagPin(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/keppel/v1/accounts/:account/repositories/:repo/_tags/:name/pin")
+	authz, repo, tag := a.findTagForPinning(w, r)
+	if tag == nil {
+		return
+	}
+
+	// pinning an already pinned tag is not an error, but keeps the original pin metadata
+	_, err := a.db.Exec(
+		`INSERT INTO tag_pins (repo_id, name, pinned_at, pinned_by) VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING`,
+		repo.ID, tag.Name, a.timeNow(), authz.UserIdentity.UserName(),
+	)
+	if respondwith.ObfuscatedErrorText(w, err) {
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *API) handleDeleteTagPin(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/keppel/v1/accounts/:account/repositories/:repo/_tags/:name/pin")
+	_, repo, tag := a.findTagForPinning(w, r)
+	if tag == nil {
+		return
+	}
+
+	_, err := a.db.Exec(`DELETE FROM tag_pins WHERE repo_id = $1 AND name = $2`, repo.ID, tag.Name)
+	if respondwith.ObfuscatedErrorText(w, err) {
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Shared preparation for handlePutTagPin and handleDeleteTagPin. Since pins
+// exempt images from GC, toggling them requires the same permission as deleting.
+func (a *API) findTagForPinning(w http.ResponseWriter, r *http.Request) (*auth.Authorization, *models.Repository, *models.Tag) {
+	authz := a.authenticateRequest(w, r, repoScopeFromRequest(r, keppel.CanDeleteFromAccount))
+	if authz == nil {
+		return nil, nil, nil
+	}
+	account := a.findAccountFromRequest(w, r, authz)
+	if account == nil {
+		return nil, nil, nil
+	}
+	repo := a.findRepositoryFromRequest(w, r, account.Name)
+	if repo == nil {
+		return nil, nil, nil
+	}
+	err := api.CheckAccountWritable(a.cfg, account.Reduced(), false)
+	if err != nil {
+		keppel.AsRegistryV2Error(err).WriteAsTextTo(w)
+		return nil, nil, nil
+	}
+
+	var tag models.Tag
+	err = a.db.SelectOne(&tag, `SELECT * FROM tags WHERE repo_id = $1 AND name = $2`, repo.ID, mux.Vars(r)["tag_name"])
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "no such tag", http.StatusNotFound)
+		return nil, nil, nil
+	}
+	if respondwith.ObfuscatedErrorText(w, err) {
+		return nil, nil, nil
+	}
+	return authz, repo, &tag
+}
+
 func (a *API) handleGetTrivyReport(w http.ResponseWriter, r *http.Request) {
 	httpapi.IdentifyEndpoint(r, "/keppel/v1/accounts/:account/repositories/:repo/_manifests/:digest/trivy_report")
 	authz := a.authenticateRequest(w, r, repoScopeFromRequest(r, keppel.CanPullFromAccount))
@@ -302,7 +515,7 @@ func (a *API) handleGetTrivyReport(w http.ResponseWriter, r *http.Request) {
 	}
 
 	manifest, err := keppel.FindManifest(a.db, *repo, parsedDigest)
-	if errors.Is(err, sql.ErrNoRows) {
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && manifest.DeletedAt.IsSome()) {
 		http.Error(w, "not found", http.StatusNotFound)
 		return
 	}
@@ -4,6 +4,7 @@
 package keppelv1_test
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"sort"
@@ -103,6 +104,13 @@ func TestManifestsAPI(t *testing.T) {
 				if idx == 1 {
 					dbManifest.LastPulledAt = Some(pushedAt.Add(100 * time.Second))
 				}
+				if idx == 2 {
+					dbManifest.LastValidatedAt = Some(pushedAt.Add(200 * time.Second))
+				}
+				if idx == 3 {
+					dbManifest.LastValidatedAt = Some(pushedAt.Add(300 * time.Second))
+					dbManifest.ValidationErrorMessage = "manifest blob unknown to registry: " + dummySubject.String()
+				}
 				test.MustInsert(t, s.DB, &dbManifest)
 
 				test.MustDo(t, s.SD.WriteManifest(
@@ -167,6 +175,9 @@ func TestManifestsAPI(t *testing.T) {
 		renderedManifests[1]["tags"] = []assert.JSONObject{
 			{"name": "second", "pushed_at": 20003, "last_pulled_at": nil},
 		}
+		renderedManifests[1]["last_validated_at"] = 12200
+		renderedManifests[2]["last_validated_at"] = 13300
+		renderedManifests[2]["validation_error"] = "manifest blob unknown to registry: " + test.DeterministicDummyDigest(14).String()
 		sort.Slice(renderedManifests, func(i, j int) bool {
 			return renderedManifests[i]["digest"].(digest.Digest) < renderedManifests[j]["digest"].(digest.Digest)
 		})
@@ -367,6 +378,218 @@ func TestManifestsAPI(t *testing.T) {
 	})
 }
 
+func TestGetTagDigest(t *testing.T) {
+	s := test.NewSetup(t,
+		test.WithKeppelAPI,
+		test.WithQuotas,
+		test.WithAccount(models.Account{Name: "test1", AuthTenantID: "tenant1"}),
+	)
+	h := s.Handler
+
+	repoRef := models.Repository{AccountName: "test1", Name: "foo/bar"}
+	image := test.GenerateImage(test.GenerateExampleLayer(1))
+	image.MustUpload(t, s, repoRef, "latest")
+	tr, _ := easypg.NewTracker(t, s.DB.Db)
+
+	// error cases: resolving a tag requires pull permission, and the tag must exist
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/bar/_tags/latest/digest",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: http.StatusForbidden,
+		ExpectBody:   assert.StringData("no permission for repository:test1/foo/bar:pull\n"),
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/bar/_tags/doesnotexist/digest",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody:   assert.StringData("no such tag\n"),
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/doesnotexist/_tags/latest/digest",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody:   assert.StringData("repo not found\n"),
+	}.Check(t, h)
+
+	// happy case
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/bar/_tags/latest/digest",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   assert.JSONObject{"digest": image.Manifest.Digest},
+	}.Check(t, h)
+
+	// RBAC policies with "match_tag" are enforced
+	s.AD.ExpectedUserName = "correctusername"
+	test.MustExec(t, s.DB, `UPDATE accounts SET rbac_policies_json = $2 WHERE name = $1`, "test1",
+		test.ToJSON([]keppel.RBACPolicy{{
+			RepositoryPattern:    "foo/bar",
+			UserNamePattern:      "correctusername",
+			TagPattern:           "lat.*",
+			ForbiddenPermissions: []keppel.RBACPermission{keppel.RBACPullPermission},
+		}}),
+	)
+	tr.DBChanges().Ignore()
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/bar/_tags/latest/digest",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusForbidden,
+		ExpectBody:   assert.StringData("pull access to tag \"latest\" is not allowed\n"),
+	}.Check(t, h)
+
+	// resolving a tag does not count as a pull
+	tr.DBChanges().AssertEmpty()
+}
+
+func TestGetManifestTags(t *testing.T) {
+	s := test.NewSetup(t,
+		test.WithKeppelAPI,
+		test.WithQuotas,
+		test.WithAccount(models.Account{Name: "test1", AuthTenantID: "tenant1"}),
+	)
+	h := s.Handler
+
+	// upload one image with several tags, and one image without any tags
+	repoRef := models.Repository{AccountName: "test1", Name: "foo"}
+	taggedImage := test.GenerateImage(test.GenerateExampleLayer(1))
+	s.Clock.StepBy(time.Hour)
+	taggedImage.MustUpload(t, s, repoRef, "latest")
+	s.Clock.StepBy(time.Hour)
+	taggedImage.MustUpload(t, s, repoRef, "stable")
+	untaggedImage := test.GenerateImage(test.GenerateExampleLayer(2))
+	untaggedImage.MustUpload(t, s, repoRef, "")
+	test.MustExec(t, s.DB, `INSERT INTO tag_pins (repo_id, name, pinned_at, pinned_by) VALUES (1, 'stable', $1, 'exampleuser')`, s.Clock.Now())
+
+	// error cases: listing tags requires pull permission, and the manifest must exist
+	taggedPath := "/keppel/v1/accounts/test1/repositories/foo/_manifests/" + taggedImage.Manifest.Digest.String() + "/tags"
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         taggedPath,
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: http.StatusForbidden,
+		ExpectBody:   assert.StringData("no permission for repository:test1/foo:pull\n"),
+	}.Check(t, h)
+	for _, invalidDigest := range []string{test.DeterministicDummyDigest(1).String(), "invalid"} {
+		assert.HTTPRequest{
+			Method:       "GET",
+			Path:         "/keppel/v1/accounts/test1/repositories/foo/_manifests/" + invalidDigest + "/tags",
+			Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+			ExpectStatus: http.StatusNotFound,
+			ExpectBody:   assert.StringData("no such manifest\n"),
+		}.Check(t, h)
+	}
+
+	// happy case: manifest with multiple tags
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         taggedPath,
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{"tags": []assert.JSONObject{
+			{"name": "latest", "pushed_at": 3600, "last_pulled_at": nil},
+			{"name": "stable", "pushed_at": 7200, "last_pulled_at": nil, "pinned": true},
+		}},
+	}.Check(t, h)
+
+	// happy case: manifest without tags
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_manifests/" + untaggedImage.Manifest.Digest.String() + "/tags",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   assert.JSONObject{"tags": []assert.JSONObject{}},
+	}.Check(t, h)
+}
+
+func TestTagPins(t *testing.T) {
+	s := test.NewSetup(t,
+		test.WithKeppelAPI,
+		test.WithQuotas,
+		test.WithAccount(models.Account{Name: "test1", AuthTenantID: "tenant1"}),
+	)
+	s.AD.ExpectedUserName = "exampleuser"
+	h := s.Handler
+
+	repoRef := models.Repository{AccountName: "test1", Name: "foo"}
+	test.GenerateImage(test.GenerateExampleLayer(1)).MustUpload(t, s, repoRef, "debug")
+	tr, _ := easypg.NewTracker(t, s.DB.Db)
+
+	// error cases: pinning requires delete permission, and the tag must exist
+	assert.HTTPRequest{
+		Method:       "PUT",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_tags/debug/pin",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1,push:tenant1"},
+		ExpectStatus: http.StatusForbidden,
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "PUT",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_tags/doesnotexist/pin",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,delete:tenant1"},
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody:   assert.StringData("no such tag\n"),
+	}.Check(t, h)
+	tr.DBChanges().AssertEmpty()
+
+	// happy case: pin the tag
+	assert.HTTPRequest{
+		Method:       "PUT",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_tags/debug/pin",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,delete:tenant1"},
+		ExpectStatus: http.StatusNoContent,
+	}.Check(t, h)
+	tr.DBChanges().AssertEqualf(`
+			INSERT INTO tag_pins (repo_id, name, pinned_at, pinned_by) VALUES (1, 'debug', %d, 'exampleuser');
+		`,
+		s.Clock.Now().Unix(),
+	)
+
+	// pinning again is a no-op
+	s.Clock.StepBy(time.Hour)
+	assert.HTTPRequest{
+		Method:       "PUT",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_tags/debug/pin",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,delete:tenant1"},
+		ExpectStatus: http.StatusNoContent,
+	}.Check(t, h)
+	tr.DBChanges().AssertEmpty()
+
+	// the pin is shown in the manifest listing
+	_, respBody := assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_manifests",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusOK,
+	}.Check(t, h)
+	var listing struct {
+		Manifests []struct {
+			Tags []struct {
+				Name     string `json:"name"`
+				IsPinned bool   `json:"pinned"`
+			} `json:"tags"`
+		} `json:"manifests"`
+	}
+	test.MustDo(t, json.Unmarshal(respBody, &listing))
+	assert.DeepEqual(t, "pinned flag", listing.Manifests[0].Tags[0].IsPinned, true)
+
+	// happy case: unpin the tag (this is idempotent as well)
+	for range 2 {
+		assert.HTTPRequest{
+			Method:       "DELETE",
+			Path:         "/keppel/v1/accounts/test1/repositories/foo/_tags/debug/pin",
+			Header:       map[string]string{"X-Test-Perms": "view:tenant1,delete:tenant1"},
+			ExpectStatus: http.StatusNoContent,
+		}.Check(t, h)
+	}
+	tr.DBChanges().AssertEqualf(`
+			DELETE FROM tag_pins WHERE repo_id = 1 AND name = 'debug';
+		`)
+}
+
 func TestGetTrivyReport(t *testing.T) {
 	test.WithRoundTripper(func(tt *test.RoundTripper) {
 		s := test.NewSetup(t,
@@ -9,6 +9,7 @@ import (
 	"github.com/sapcc/go-bits/httpapi"
 	"github.com/sapcc/go-bits/respondwith"
 
+	"github.com/sapcc/keppel/internal/auth"
 	"github.com/sapcc/keppel/internal/keppel"
 	"github.com/sapcc/keppel/internal/models"
 )
@@ -40,7 +41,7 @@ func renderPeers(peers []models.Peer) []Peer {
 
 func (a *API) handleGetPeers(w http.ResponseWriter, r *http.Request) {
 	httpapi.IdentifyEndpoint(r, "/keppel/v1/peers")
-	uid, authErr := a.authDriver.AuthenticateUserFromRequest(r)
+	uid, authErr := auth.AuthenticateUserFromRequest(a.authDriver, r)
 	if respondWithAuthError(w, authErr) {
 		return
 	}
@@ -0,0 +1,178 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package keppelv1
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/opencontainers/go-digest"
+	"github.com/sapcc/go-bits/httpapi"
+	"github.com/sapcc/go-bits/respondwith"
+	"github.com/sapcc/go-bits/sqlext"
+
+	"github.com/sapcc/keppel/internal/keppel"
+	"github.com/sapcc/keppel/internal/models"
+)
+
+// Referrer represents a manifest referring to another manifest (via the
+// `subject` field) in the API.
+type Referrer struct {
+	Digest       digest.Digest     `json:"digest"`
+	MediaType    string            `json:"media_type"`
+	ArtifactType string            `json:"artifact_type"`
+	SizeBytes    uint64            `json:"size_bytes"`
+	PushedAt     int64             `json:"pushed_at"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+}
+
+// ReferrerCategory is an enum that classifies referrers by their artifact type.
+type ReferrerCategory string
+
+// Possible values for ReferrerCategory.
+const (
+	SignatureReferrer   ReferrerCategory = "signatures"
+	SBOMReferrer        ReferrerCategory = "sboms"
+	AttestationReferrer ReferrerCategory = "attestations"
+	OtherReferrer       ReferrerCategory = "other"
+)
+
+// artifactTypeCategories maps well-known artifact types to their category.
+// Artifact types that are not listed here are categorized as "other".
+var artifactTypeCategories = map[string]ReferrerCategory{
+	// signatures from cosign and Notation
+	"application/vnd.dev.cosign.artifact.sig.v1+json":  SignatureReferrer,
+	"application/vnd.dev.cosign.simplesigning.v1+json": SignatureReferrer,
+	"application/vnd.cncf.notary.signature":            SignatureReferrer,
+	// SBOMs in SPDX, CycloneDX or Syft format
+	"application/spdx+json":          SBOMReferrer,
+	"text/spdx":                      SBOMReferrer,
+	"application/vnd.cyclonedx+json": SBOMReferrer,
+	"application/vnd.cyclonedx+xml":  SBOMReferrer,
+	"application/vnd.cyclonedx":      SBOMReferrer,
+	"application/vnd.syft+json":      SBOMReferrer,
+	// attestations from in-toto, DSSE or cosign (Sigstore bundles are not listed
+	// since they can contain either signatures or attestations)
+	"application/vnd.in-toto+json":                   AttestationReferrer,
+	"application/vnd.dsse.envelope.v1+json":          AttestationReferrer,
+	"application/vnd.dev.cosign.attestation.v1+json": AttestationReferrer,
+}
+
+// categorizeArtifactType returns the category of referrers with the given
+// artifact type. Parameters like "; charset=utf-8" are ignored.
+func categorizeArtifactType(artifactType string) ReferrerCategory {
+	category, exists := artifactTypeCategories[artifactType]
+	if exists {
+		return category
+	}
+	mediaType, _, _ := strings.Cut(artifactType, ";")
+	category, exists = artifactTypeCategories[strings.TrimSpace(mediaType)]
+	if exists {
+		return category
+	}
+	return OtherReferrer
+}
+
+var referrersGetQuery = sqlext.SimplifyWhitespace(`
+	SELECT *
+	  FROM manifests
+	 WHERE repo_id = $1 AND subject_digest = $2 AND deleted_at IS NULL AND $CONDITION
+	 ORDER BY digest ASC
+	 LIMIT $LIMIT
+`)
+
+func (a *API) handleGetManifestReferrers(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/keppel/v1/accounts/:account/repositories/:repo/_manifests/:digest/referrers")
+	authz := a.authenticateRequest(w, r, repoScopeFromRequest(r, keppel.CanPullFromAccount))
+	if authz == nil {
+		return
+	}
+	account := a.findAccountFromRequest(w, r, authz)
+	if account == nil {
+		return
+	}
+	repo := a.findRepositoryFromRequest(w, r, account.Name)
+	if repo == nil {
+		return
+	}
+	parsedDigest, err := digest.Parse(mux.Vars(r)["digest"])
+	if err != nil {
+		http.Error(w, "no such manifest", http.StatusNotFound)
+		return
+	}
+
+	manifest, err := keppel.FindManifest(a.db, *repo, parsedDigest)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && manifest.DeletedAt.IsSome()) {
+		http.Error(w, "no such manifest", http.StatusNotFound)
+		return
+	}
+	if respondwith.ObfuscatedErrorText(w, err) {
+		return
+	}
+
+	query, bindValues, limit, err := paginatedQuery{
+		SQL:         referrersGetQuery,
+		MarkerField: "digest",
+		Options:     r.URL.Query(),
+		BindValues:  []any{repo.ID, manifest.Digest},
+	}.Prepare()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var dbManifests []models.Manifest
+	_, err = a.db.Select(&dbManifests, query, bindValues...)
+	if respondwith.ObfuscatedErrorText(w, err) {
+		return
+	}
+
+	// all categories are always present in the result (as empty lists if necessary)
+	result := map[string]any{}
+	referrers := map[ReferrerCategory][]Referrer{
+		SignatureReferrer:   {},
+		SBOMReferrer:        {},
+		AttestationReferrer: {},
+		OtherReferrer:       {},
+	}
+	for idx, dbManifest := range dbManifests {
+		if uint64(idx) >= limit {
+			result["truncated"] = true
+			break
+		}
+
+		var annotations map[string]string
+		if dbManifest.AnnotationsJSON != "" {
+			err = json.Unmarshal([]byte(dbManifest.AnnotationsJSON), &annotations)
+			if respondwith.ObfuscatedErrorText(w, err) {
+				return
+			}
+		}
+
+		// same fallback as in the referrers API of the registry API
+		artifactType := dbManifest.ArtifactType
+		if artifactType == "" {
+			artifactType = dbManifest.MediaType
+		}
+
+		category := categorizeArtifactType(artifactType)
+		referrers[category] = append(referrers[category], Referrer{
+			Digest:       dbManifest.Digest,
+			MediaType:    dbManifest.MediaType,
+			ArtifactType: artifactType,
+			SizeBytes:    dbManifest.SizeBytes,
+			PushedAt:     dbManifest.PushedAt.Unix(),
+			Annotations:  annotations,
+		})
+	}
+	for category, list := range referrers {
+		result[string(category)] = list
+	}
+
+	respondwith.JSON(w, http.StatusOK, result)
+}
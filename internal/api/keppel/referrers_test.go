@@ -0,0 +1,149 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package keppelv1_test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sapcc/go-bits/assert"
+
+	"github.com/sapcc/keppel/internal/models"
+	"github.com/sapcc/keppel/internal/test"
+)
+
+func TestGetManifestReferrers(t *testing.T) {
+	s := test.NewSetup(t,
+		test.WithKeppelAPI,
+		test.WithQuotas,
+		test.WithAccount(models.Account{Name: "test1", AuthTenantID: "tenant1"}),
+	)
+	h := s.Handler
+
+	// upload an image with a cosign signature and an SPDX SBOM referring to it
+	repoRef := models.Repository{AccountName: "test1", Name: "foo"}
+	image := test.GenerateOCIImage(test.OCIArgs{
+		ConfigMediaType: imgspecv1.MediaTypeImageConfig,
+	}, test.GenerateExampleLayer(1))
+	image.MustUpload(t, s, repoRef, "latest")
+	s.Clock.StepBy(time.Hour)
+	signature := test.GenerateOCIImage(test.OCIArgs{
+		Config:          map[string]any{},
+		ConfigMediaType: imgspecv1.MediaTypeEmptyJSON,
+		ArtifactType:    "application/vnd.dev.cosign.artifact.sig.v1+json",
+		Annotations:     map[string]string{"dev.cosignproject.cosign/signature": "MEUCIQ=="},
+		SubjectDigest:   image.Manifest.Digest,
+	}, test.GenerateExampleLayer(2))
+	signature.MustUpload(t, s, repoRef, "")
+	s.Clock.StepBy(time.Hour)
+	sbom := test.GenerateOCIImage(test.OCIArgs{
+		Config:          map[string]any{},
+		ConfigMediaType: imgspecv1.MediaTypeEmptyJSON,
+		ArtifactType:    "application/spdx+json",
+		SubjectDigest:   image.Manifest.Digest,
+	}, test.GenerateExampleLayer(3))
+	sbom.MustUpload(t, s, repoRef, "")
+
+	// error cases: listing referrers requires pull permission, and the manifest must exist
+	path := "/keppel/v1/accounts/test1/repositories/foo/_manifests/" + image.Manifest.Digest.String() + "/referrers"
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         path,
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: http.StatusForbidden,
+		ExpectBody:   assert.StringData("no permission for repository:test1/foo:pull\n"),
+	}.Check(t, h)
+	for _, invalidDigest := range []string{test.DeterministicDummyDigest(1).String(), "invalid"} {
+		assert.HTTPRequest{
+			Method:       "GET",
+			Path:         "/keppel/v1/accounts/test1/repositories/foo/_manifests/" + invalidDigest + "/referrers",
+			Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+			ExpectStatus: http.StatusNotFound,
+			ExpectBody:   assert.StringData("no such manifest\n"),
+		}.Check(t, h)
+	}
+
+	// happy case: referrers are sorted into categories
+	signatureJSON := assert.JSONObject{
+		"digest":        signature.Manifest.Digest,
+		"media_type":    imgspecv1.MediaTypeImageManifest,
+		"artifact_type": "application/vnd.dev.cosign.artifact.sig.v1+json",
+		"size_bytes":    signature.SizeBytes(),
+		"pushed_at":     3600,
+		"annotations":   assert.JSONObject{"dev.cosignproject.cosign/signature": "MEUCIQ=="},
+	}
+	sbomJSON := assert.JSONObject{
+		"digest":        sbom.Manifest.Digest,
+		"media_type":    imgspecv1.MediaTypeImageManifest,
+		"artifact_type": "application/spdx+json",
+		"size_bytes":    sbom.SizeBytes(),
+		"pushed_at":     7200,
+	}
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         path,
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"signatures":   []assert.JSONObject{signatureJSON},
+			"sboms":        []assert.JSONObject{sbomJSON},
+			"attestations": []assert.JSONObject{},
+			"other":        []assert.JSONObject{},
+		},
+	}.Check(t, h)
+
+	// pagination: each page contains at most `limit` referrers, ordered by digest
+	first, second := signatureJSON, sbomJSON
+	firstDigest := signature.Manifest.Digest
+	if sbom.Manifest.Digest < signature.Manifest.Digest {
+		first, second = sbomJSON, signatureJSON
+		firstDigest = sbom.Manifest.Digest
+	}
+	pageWith := func(referrer assert.JSONObject) assert.JSONObject {
+		result := assert.JSONObject{
+			"signatures":   []assert.JSONObject{},
+			"sboms":        []assert.JSONObject{},
+			"attestations": []assert.JSONObject{},
+			"other":        []assert.JSONObject{},
+		}
+		if referrer["artifact_type"] == "application/spdx+json" {
+			result["sboms"] = []assert.JSONObject{referrer}
+		} else {
+			result["signatures"] = []assert.JSONObject{referrer}
+		}
+		return result
+	}
+	expectedFirstPage := pageWith(first)
+	expectedFirstPage["truncated"] = true
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         path + "?limit=1",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   expectedFirstPage,
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         path + "?limit=1&marker=" + firstDigest.String(),
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   pageWith(second),
+	}.Check(t, h)
+
+	// happy case: manifest without referrers
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_manifests/" + sbom.Manifest.Digest.String() + "/referrers",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"signatures":   []assert.JSONObject{},
+			"sboms":        []assert.JSONObject{},
+			"attestations": []assert.JSONObject{},
+			"other":        []assert.JSONObject{},
+		},
+	}.Check(t, h)
+}
@@ -0,0 +1,108 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package keppelv1
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/opencontainers/go-digest"
+	"github.com/sapcc/go-bits/httpapi"
+	"github.com/sapcc/go-bits/respondwith"
+
+	"github.com/sapcc/keppel/internal/auth"
+	"github.com/sapcc/keppel/internal/keppel"
+	"github.com/sapcc/keppel/internal/models"
+)
+
+// PendingReplication represents an entry in the `pending_blobs` table in the API.
+type PendingReplication struct {
+	AccountName       models.AccountName   `json:"account"`
+	Digest            digest.Digest        `json:"digest"`
+	Reason            models.PendingReason `json:"reason"`
+	PendingSince      int64                `json:"pending_since"`
+	PendingForSeconds uint64               `json:"pending_for_seconds"`
+}
+
+// Pending replications younger than this are most likely still in progress,
+// so clearing them requires an explicit override.
+const minStuckReplicationAge = 10 * time.Minute
+
+func (a *API) handleGetPendingReplications(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/keppel/v1/admin/pending-replications")
+	authz := a.authenticateRequest(w, r, auth.NewScopeSet(auth.AdminAPIScope))
+	if authz == nil {
+		return
+	}
+
+	var pendingBlobs []models.PendingBlob
+	_, err := a.db.Select(&pendingBlobs, `SELECT * FROM pending_blobs ORDER BY since, account_name, digest`)
+	if respondwith.ObfuscatedErrorText(w, err) {
+		return
+	}
+
+	now := a.timeNow()
+	result := make([]PendingReplication, 0, len(pendingBlobs))
+	for _, pendingBlob := range pendingBlobs {
+		result = append(result, PendingReplication{
+			AccountName:       pendingBlob.AccountName,
+			Digest:            pendingBlob.Digest,
+			Reason:            pendingBlob.Reason,
+			PendingSince:      pendingBlob.PendingSince.Unix(),
+			PendingForSeconds: uint64(max(0, now.Sub(pendingBlob.PendingSince)) / time.Second),
+		})
+	}
+	respondwith.JSON(w, http.StatusOK, map[string]any{"pending_replications": result})
+}
+
+func (a *API) handleDeletePendingReplication(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/keppel/v1/admin/pending-replications/:account/:digest")
+	accountName := models.AccountName(mux.Vars(r)["account"])
+	authz := a.authenticateRequest(w, r, auth.NewScopeSet(auth.AdminAPIScope))
+	if authz == nil {
+		return
+	}
+
+	blobDigest, err := digest.Parse(mux.Vars(r)["digest"])
+	if err != nil {
+		http.Error(w, "digest not found", http.StatusNotFound)
+		return
+	}
+	var pendingBlob models.PendingBlob
+	err = a.db.SelectOne(&pendingBlob,
+		`SELECT * FROM pending_blobs WHERE account_name = $1 AND digest = $2`,
+		accountName, blobDigest)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "no pending replication for this digest", http.StatusNotFound)
+		return
+	}
+	if respondwith.ObfuscatedErrorText(w, err) {
+		return
+	}
+
+	// refuse to clear replications that are likely still in progress, unless the caller insists
+	pendingFor := a.timeNow().Sub(pendingBlob.PendingSince)
+	force, _ := strconv.ParseBool(r.URL.Query().Get("force"))
+	if pendingFor < minStuckReplicationAge && !force {
+		msg := fmt.Sprintf("replication has only been pending for %s and is probably still in progress (use ?force=true to clear it anyway)",
+			pendingFor.Round(time.Second))
+		http.Error(w, msg, http.StatusConflict)
+		return
+	}
+
+	_, err = a.db.Delete(&pendingBlob)
+	if respondwith.ObfuscatedErrorText(w, err) {
+		return
+	}
+	keppel.LogInfo(keppel.WithLogFields(r.Context(), keppel.LogFields{Account: pendingBlob.AccountName}), "cleared pending replication of blob %s in account %s (pending since %s, reason %q) on request of user %q; "+
+		"if the replication was still in progress, the blob may now be replicated multiple times concurrently",
+		pendingBlob.Digest, pendingBlob.AccountName, pendingBlob.PendingSince.Format(time.RFC3339),
+		pendingBlob.Reason, authz.UserIdentity.UserName())
+	w.WriteHeader(http.StatusNoContent)
+}
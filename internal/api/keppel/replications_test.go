@@ -0,0 +1,139 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package keppelv1_test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/easypg"
+
+	"github.com/sapcc/keppel/internal/models"
+	"github.com/sapcc/keppel/internal/test"
+)
+
+func TestPendingReplicationsAPI(t *testing.T) {
+	s := test.NewSetup(t,
+		test.WithKeppelAPI,
+		test.WithAccount(models.Account{Name: "test1", AuthTenantID: "tenant1"}),
+		test.WithAccount(models.Account{Name: "test2", AuthTenantID: "tenant2"}),
+	)
+	h := s.Handler
+
+	// without pending replications, the list is empty
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/admin/pending-replications",
+		Header:       map[string]string{"X-Test-Perms": "clusteradmin:"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   assert.JSONObject{"pending_replications": []assert.JSONObject{}},
+	}.Check(t, h)
+
+	// add some pending replications
+	digest1 := digest.FromString("blob1")
+	digest2 := digest.FromString("blob2")
+	digest3 := digest.FromString("blob3")
+	since1 := s.Clock.Now()
+	s.Clock.StepBy(time.Hour)
+	since2 := s.Clock.Now()
+	for _, pb := range []models.PendingBlob{
+		{AccountName: "test1", Digest: digest1, Reason: models.PendingBecauseOfReplication, PendingSince: since1},
+		{AccountName: "test1", Digest: digest2, Reason: models.PendingBecauseOfReplication, PendingSince: since2},
+		{AccountName: "test2", Digest: digest3, Reason: models.PendingBecauseOfReplication, PendingSince: since1},
+	} {
+		test.MustDo(t, s.DB.Insert(&pb))
+	}
+	s.Clock.StepBy(5 * time.Minute)
+	tr, tr0 := easypg.NewTracker(t, s.DB.Db)
+	tr0.Ignore()
+
+	// anonymous users and users without cluster-admin permission cannot see anything
+	// (not even users that can change all affected accounts, since pending replications are cluster-wide state)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/admin/pending-replications",
+		ExpectStatus: http.StatusUnauthorized,
+		ExpectBody:   assert.StringData("no bearer token found in request headers\n"),
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/admin/pending-replications",
+		Header:       map[string]string{"X-Test-Perms": "change:tenant1,change:tenant2"},
+		ExpectStatus: http.StatusForbidden,
+		ExpectBody:   assert.StringData("no permission for keppel_api:admin:access\n"),
+	}.Check(t, h)
+
+	// cluster admins see all pending replications
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/admin/pending-replications",
+		Header:       map[string]string{"X-Test-Perms": "clusteradmin:"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{"pending_replications": []assert.JSONObject{
+			{"account": "test1", "digest": digest1.String(), "reason": "replication", "pending_since": since1.Unix(), "pending_for_seconds": 3900},
+			{"account": "test2", "digest": digest3.String(), "reason": "replication", "pending_since": since1.Unix(), "pending_for_seconds": 3900},
+			{"account": "test1", "digest": digest2.String(), "reason": "replication", "pending_since": since2.Unix(), "pending_for_seconds": 300},
+		}},
+	}.Check(t, h)
+
+	// clearing also requires cluster-admin permission
+	assert.HTTPRequest{
+		Method:       "DELETE",
+		Path:         "/keppel/v1/admin/pending-replications/test2/" + digest3.String(),
+		Header:       map[string]string{"X-Test-Perms": "change:tenant2"},
+		ExpectStatus: http.StatusForbidden,
+		ExpectBody:   assert.StringData("no permission for keppel_api:admin:access\n"),
+	}.Check(t, h)
+
+	// error case: no such pending replication
+	assert.HTTPRequest{
+		Method:       "DELETE",
+		Path:         "/keppel/v1/admin/pending-replications/test1/" + digest3.String(),
+		Header:       map[string]string{"X-Test-Perms": "clusteradmin:"},
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody:   assert.StringData("no pending replication for this digest\n"),
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "DELETE",
+		Path:         "/keppel/v1/admin/pending-replications/test1/not-a-digest",
+		Header:       map[string]string{"X-Test-Perms": "clusteradmin:"},
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody:   assert.StringData("digest not found\n"),
+	}.Check(t, h)
+
+	// recent replications are probably still in progress and need to be forced
+	assert.HTTPRequest{
+		Method:       "DELETE",
+		Path:         "/keppel/v1/admin/pending-replications/test1/" + digest2.String(),
+		Header:       map[string]string{"X-Test-Perms": "clusteradmin:"},
+		ExpectStatus: http.StatusConflict,
+		ExpectBody:   assert.StringData("replication has only been pending for 5m0s and is probably still in progress (use ?force=true to clear it anyway)\n"),
+	}.Check(t, h)
+	tr.DBChanges().AssertEmpty()
+
+	// happy case: clear a stuck replication
+	assert.HTTPRequest{
+		Method:       "DELETE",
+		Path:         "/keppel/v1/admin/pending-replications/test1/" + digest1.String(),
+		Header:       map[string]string{"X-Test-Perms": "clusteradmin:"},
+		ExpectStatus: http.StatusNoContent,
+	}.Check(t, h)
+	tr.DBChanges().AssertEqualf(`
+		DELETE FROM pending_blobs WHERE account_name = 'test1' AND digest = '%s';
+	`, digest1)
+
+	// happy case: clear a recent replication with force
+	assert.HTTPRequest{
+		Method:       "DELETE",
+		Path:         "/keppel/v1/admin/pending-replications/test1/" + digest2.String() + "?force=true",
+		Header:       map[string]string{"X-Test-Perms": "clusteradmin:"},
+		ExpectStatus: http.StatusNoContent,
+	}.Check(t, h)
+	tr.DBChanges().AssertEqualf(`
+		DELETE FROM pending_blobs WHERE account_name = 'test1' AND digest = '%s';
+	`, digest2)
+}
@@ -5,14 +5,19 @@ package keppelv1
 
 import (
 	"database/sql"
+	"errors"
+	"fmt"
 	"net/http"
 	"time"
 
+	"github.com/gorilla/mux"
 	"github.com/sapcc/go-bits/httpapi"
 	"github.com/sapcc/go-bits/respondwith"
 	"github.com/sapcc/go-bits/sqlext"
 
+	"github.com/sapcc/keppel/internal/api"
 	"github.com/sapcc/keppel/internal/keppel"
+	"github.com/sapcc/keppel/internal/models"
 )
 
 // Repository represents a repository in the API.
@@ -35,6 +40,7 @@ var repositoryGetQuery = sqlext.SimplifyWhitespace(`
 		manifest_stats AS (
 			SELECT repo_id, COUNT(*) AS count, MAX(pushed_at) AS pushed_at
 			  FROM manifests
+			 WHERE deleted_at IS NULL
 			 GROUP BY repo_id
 		),
 		tag_stats AS (
@@ -51,6 +57,9 @@ var repositoryGetQuery = sqlext.SimplifyWhitespace(`
 	  LEFT OUTER JOIN manifest_stats ms ON r.id = ms.repo_id
 	  LEFT OUTER JOIN tag_stats      ts ON r.id = ts.repo_id
 	 WHERE r.account_name = $1 AND $CONDITION
+	   AND ($2 = '' OR EXISTS (
+	         SELECT 1 FROM manifests m WHERE m.repo_id = r.id AND m.artifact_type = $2 AND m.deleted_at IS NULL
+	       ))
 	 ORDER BY name ASC
 	 LIMIT $LIMIT
 `)
@@ -70,7 +79,7 @@ func (a *API) handleGetRepositories(w http.ResponseWriter, r *http.Request) {
 		SQL:         repositoryGetQuery,
 		MarkerField: "r.name",
 		Options:     r.URL.Query(),
-		BindValues:  []any{account.Name},
+		BindValues:  []any{account.Name, r.URL.Query().Get("artifact_type")},
 	}.Prepare()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -157,6 +166,11 @@ func (a *API) handleDeleteRepository(w http.ResponseWriter, r *http.Request) {
 	if repo == nil {
 		return
 	}
+	err := api.CheckAccountWritable(a.cfg, account.Reduced(), false)
+	if err != nil {
+		keppel.AsRegistryV2Error(err).WriteAsTextTo(w)
+		return
+	}
 
 	tx, err := a.db.Begin()
 	if respondwith.ObfuscatedErrorText(w, err) {
@@ -166,7 +180,7 @@ func (a *API) handleDeleteRepository(w http.ResponseWriter, r *http.Request) {
 
 	// deleting a repo is only allowed if there is nothing in it
 	manifestCount, err := tx.SelectInt(
-		`SELECT COUNT(*) FROM manifests WHERE repo_id = $1`,
+		`SELECT COUNT(*) FROM manifests WHERE repo_id = $1 AND deleted_at IS NULL`,
 		repo.ID,
 	)
 	if respondwith.ObfuscatedErrorText(w, err) {
@@ -201,3 +215,120 @@ func (a *API) handleDeleteRepository(w http.ResponseWriter, r *http.Request) {
 
 	w.WriteHeader(http.StatusNoContent)
 }
+
+func (a *API) handleMoveRepository(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/keppel/v1/accounts/:account/repositories/:repo/_move")
+	// decode request body
+	var req struct {
+		AccountName models.AccountName `json:"account"`
+		RepoName    string             `json:"name"`
+	}
+	ok := decodeJSONRequestBody(w, r.Body, &req)
+	if !ok {
+		return
+	}
+	if req.AccountName == "" {
+		req.AccountName = models.AccountName(mux.Vars(r)["account"])
+	}
+
+	// the caller needs to be able to change both the source and the target account
+	authz := a.authenticateRequest(w, r, accountScopes(keppel.CanChangeAccount,
+		models.Account{Name: models.AccountName(mux.Vars(r)["account"])},
+		models.Account{Name: req.AccountName},
+	))
+	if authz == nil {
+		return
+	}
+	account := a.findAccountFromRequest(w, r, authz)
+	if account == nil {
+		return
+	}
+	repo := a.findRepositoryFromRequest(w, r, account.Name)
+	if repo == nil {
+		return
+	}
+	if !isValidRepoName(req.RepoName) {
+		http.Error(w, "target repo name invalid", http.StatusUnprocessableEntity)
+		return
+	}
+
+	targetAccount := account
+	if req.AccountName != account.Name {
+		var err error
+		targetAccount, err = keppel.FindAccount(r.Context(), a.db, req.AccountName)
+		if respondwith.ObfuscatedErrorText(w, err) {
+			return
+		}
+		if targetAccount == nil {
+			http.Error(w, "target account not found", http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	for _, acc := range []*models.Account{account, targetAccount} {
+		err := api.CheckAccountWritable(a.cfg, acc.Reduced(), false)
+		if err != nil {
+			keppel.AsRegistryV2Error(err).WriteAsTextTo(w)
+			return
+		}
+		if acc.IsDeleting {
+			http.Error(w, fmt.Sprintf("account %s is being deleted", acc.Name), http.StatusConflict)
+			return
+		}
+		if acc.UpstreamPeerHostName != "" || acc.ExternalPeerURL != "" {
+			http.Error(w, "cannot move repositories into or out of replica accounts", http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	// the target repo must not exist yet
+	_, err := keppel.FindRepository(a.db, req.RepoName, targetAccount.Name)
+	if err == nil {
+		http.Error(w, "target repo already exists", http.StatusConflict)
+		return
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		respondwith.ObfuscatedErrorText(w, err)
+		return
+	}
+
+	uploadCount, err := a.db.SelectInt(`SELECT COUNT(*) FROM uploads WHERE repo_id = $1`, repo.ID)
+	if respondwith.ObfuscatedErrorText(w, err) {
+		return
+	}
+	if uploadCount > 0 {
+		http.Error(w, "cannot move repository while blobs in it are being uploaded", http.StatusConflict)
+		return
+	}
+
+	// when moving into a different auth tenant, the manifests count towards that tenant's quota
+	if targetAccount.AuthTenantID != account.AuthTenantID {
+		quotas, err := keppel.FindQuotas(a.db, targetAccount.AuthTenantID)
+		if respondwith.ObfuscatedErrorText(w, err) {
+			return
+		}
+		if quotas == nil {
+			quotas = models.DefaultQuotas(targetAccount.AuthTenantID)
+		}
+		manifestUsage, err := keppel.GetManifestUsage(a.db, *quotas)
+		if respondwith.ObfuscatedErrorText(w, err) {
+			return
+		}
+		manifestCount, err := a.db.SelectInt(`SELECT COUNT(*) FROM manifests WHERE repo_id = $1 AND deleted_at IS NULL`, repo.ID)
+		if respondwith.ObfuscatedErrorText(w, err) {
+			return
+		}
+		if manifestUsage+keppel.AtLeastZero(manifestCount) > quotas.ManifestCount {
+			msg := fmt.Sprintf("manifest quota exceeded in target account (quota = %d, usage = %d, repo contains %d manifests)",
+				quotas.ManifestCount, manifestUsage, manifestCount)
+			http.Error(w, msg, http.StatusConflict)
+			return
+		}
+	}
+
+	err = a.processor().MoveRepository(r.Context(), account.Reduced(), *repo, targetAccount.Reduced(), req.RepoName)
+	if respondwith.ObfuscatedErrorText(w, err) {
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -4,12 +4,15 @@
 package keppelv1_test
 
 import (
+	"database/sql"
 	"fmt"
 	"net/http"
+	"net/url"
 	"testing"
 	"time"
 
 	. "github.com/majewsky/gg/option"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/sapcc/go-bits/assert"
 	"github.com/sapcc/go-bits/easypg"
 
@@ -211,3 +214,204 @@ func TestReposAPI(t *testing.T) {
 		ExpectBody:   assert.StringData("cannot delete repository while there are still manifests in it\n"),
 	}.Check(t, h)
 }
+
+func TestReposAPIWithArtifactTypeFilter(t *testing.T) {
+	s := test.NewSetup(t, test.WithKeppelAPI,
+		test.WithAccount(models.Account{Name: "test1", AuthTenantID: "tenant1"}))
+	h := s.Handler
+
+	// setup an account with a mix of container images and other artifacts
+	helmConfigMediaType := "application/vnd.cncf.helm.config.v1+json"
+	sbomArtifactType := "application/spdx+json"
+	images := map[string]test.Image{
+		"docker-image": test.GenerateImage(test.GenerateExampleLayer(1)),
+		"oci-image": test.GenerateOCIImage(test.OCIArgs{
+			ConfigMediaType: imgspecv1.MediaTypeImageConfig,
+		}, test.GenerateExampleLayer(2)),
+		"helm-chart": test.GenerateOCIImage(test.OCIArgs{
+			Config:          map[string]any{"name": "chart", "version": "1.0.0"},
+			ConfigMediaType: helmConfigMediaType,
+		}, test.GenerateExampleLayer(3)),
+		"sbom": test.GenerateOCIImage(test.OCIArgs{
+			Config:          map[string]any{},
+			ConfigMediaType: imgspecv1.MediaTypeEmptyJSON,
+			ArtifactType:    sbomArtifactType,
+		}, test.GenerateExampleLayer(4)),
+	}
+	// this repo contains both an image and a Helm chart
+	mixedImage := test.GenerateOCIImage(test.OCIArgs{
+		ConfigMediaType: imgspecv1.MediaTypeImageConfig,
+	}, test.GenerateExampleLayer(5))
+	mixedChart := test.GenerateOCIImage(test.OCIArgs{
+		Config:          map[string]any{"name": "mixed", "version": "1.0.0"},
+		ConfigMediaType: helmConfigMediaType,
+	}, test.GenerateExampleLayer(6))
+
+	pushedAt := s.Clock.Now().Unix()
+	for repoName, image := range images {
+		image.MustUpload(t, s, models.Repository{AccountName: "test1", Name: repoName}, "latest")
+	}
+	mixedRepoRef := models.Repository{AccountName: "test1", Name: "mixed"}
+	mixedImage.MustUpload(t, s, mixedRepoRef, "image")
+	mixedChart.MustUpload(t, s, mixedRepoRef, "chart")
+
+	renderRepo := func(repoName string) assert.JSONObject {
+		if repoName == "mixed" {
+			return assert.JSONObject{
+				"name":           "mixed",
+				"manifest_count": 2,
+				"tag_count":      2,
+				"size_bytes":     mixedImage.SizeBytes() - uint64(len(mixedImage.Manifest.Contents)) + mixedChart.SizeBytes() - uint64(len(mixedChart.Manifest.Contents)),
+				"pushed_at":      pushedAt,
+			}
+		}
+		image := images[repoName]
+		return assert.JSONObject{
+			"name":           repoName,
+			"manifest_count": 1,
+			"tag_count":      1,
+			"size_bytes":     image.SizeBytes() - uint64(len(image.Manifest.Contents)),
+			"pushed_at":      pushedAt,
+		}
+	}
+	expectRepos := func(query string, repoNames ...string) {
+		t.Helper()
+		repos := make([]assert.JSONObject, len(repoNames))
+		for idx, repoName := range repoNames {
+			repos[idx] = renderRepo(repoName)
+		}
+		assert.HTTPRequest{
+			Method:       "GET",
+			Path:         "/keppel/v1/accounts/test1/repositories" + query,
+			Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+			ExpectStatus: http.StatusOK,
+			ExpectBody:   assert.JSONObject{"repositories": repos},
+		}.Check(t, h)
+	}
+
+	// without filter, all repos are listed
+	expectRepos("", "docker-image", "helm-chart", "mixed", "oci-image", "sbom")
+
+	// with filter, only repos containing at least one matching manifest are listed
+	expectRepos("?artifact_type="+url.QueryEscape(helmConfigMediaType), "helm-chart", "mixed")
+	expectRepos("?artifact_type="+url.QueryEscape(imgspecv1.MediaTypeImageConfig), "mixed", "oci-image")
+	expectRepos("?artifact_type="+url.QueryEscape(sbomArtifactType), "sbom")
+	expectRepos("?artifact_type=application/vnd.example.unknown")
+
+	// the filter can be combined with pagination
+	expectRepos("?artifact_type="+url.QueryEscape(helmConfigMediaType)+"&marker=helm-chart", "mixed")
+
+	// the registry API catalog stays unfiltered
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/v2/_catalog?artifact_type=" + url.QueryEscape(helmConfigMediaType),
+		Header:       map[string]string{"Authorization": "keppel", "X-Test-Perms": "view:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{"repositories": []string{
+			"test1/docker-image", "test1/helm-chart", "test1/mixed", "test1/oci-image", "test1/sbom",
+		}},
+	}.Check(t, h)
+}
+
+func TestMoveRepository(t *testing.T) {
+	s := test.NewSetup(t, test.WithKeppelAPI, test.WithQuotas,
+		test.WithAccount(models.Account{Name: "test1", AuthTenantID: "tenant1"}),
+		test.WithAccount(models.Account{Name: "test2", AuthTenantID: "tenant2"}))
+	h := s.Handler
+
+	image := test.GenerateImage(test.GenerateExampleLayer(1))
+	image.MustUpload(t, s, models.Repository{AccountName: "test1", Name: "foo"}, "latest")
+	test.MustInsert(t, s.DB, &models.Repository{AccountName: "test1", Name: "existing"})
+
+	// error cases
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_move",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		Body:         assert.JSONObject{"name": "bar"},
+		ExpectStatus: http.StatusForbidden,
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_move",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,change:tenant1,view:tenant2"},
+		Body:         assert.JSONObject{"account": "test2", "name": "bar"},
+		ExpectStatus: http.StatusForbidden,
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_move",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,change:tenant1"},
+		Body:         assert.JSONObject{"name": "Invalid"},
+		ExpectStatus: http.StatusUnprocessableEntity,
+		ExpectBody:   assert.StringData("target repo name invalid\n"),
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_move",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,change:tenant1"},
+		Body:         assert.JSONObject{"name": "existing"},
+		ExpectStatus: http.StatusConflict,
+		ExpectBody:   assert.StringData("target repo already exists\n"),
+	}.Check(t, h)
+	// moving into a nonexistent account must be rejected cleanly
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_move",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,change:tenant1,view:tenant2,change:tenant2"},
+		Body:         assert.JSONObject{"account": "test3", "name": "bar"},
+		ExpectStatus: http.StatusForbidden,
+		ExpectBody:   assert.StringData("no permission for keppel_account:test3:change\n"),
+	}.Check(t, h)
+
+	// happy case: rename within the same account
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_move",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,change:tenant1"},
+		Body:         assert.JSONObject{"name": "bar"},
+		ExpectStatus: http.StatusNoContent,
+	}.Check(t, h)
+
+	_, err := keppel.FindRepository(s.DB, "foo", "test1")
+	assert.DeepEqual(t, "error when finding old repo", err, sql.ErrNoRows)
+	repo, err := keppel.FindRepository(s.DB, "bar", "test1")
+	test.MustDo(t, err)
+	assert.DeepEqual(t, "repo ID", repo.ID, int64(1))
+	manifest, err := keppel.FindManifest(s.DB, *repo, image.Manifest.Digest)
+	test.MustDo(t, err)
+	s.ExpectManifestsExistInStorage(t, "bar", *manifest)
+	_, err = s.SD.ReadManifest(s.Ctx, models.ReducedAccount{Name: "test1"}, "foo", image.Manifest.Digest)
+	if err == nil {
+		t.Error("expected manifest to be deleted from old storage location, but could read it")
+	}
+
+	// happy case: move into a different account (this copies the blobs)
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/test1/repositories/bar/_move",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,change:tenant1,view:tenant2,change:tenant2"},
+		Body:         assert.JSONObject{"account": "test2", "name": "baz"},
+		ExpectStatus: http.StatusNoContent,
+	}.Check(t, h)
+
+	repo, err = keppel.FindRepository(s.DB, "baz", "test2")
+	test.MustDo(t, err)
+	assert.DeepEqual(t, "repo ID", repo.ID, int64(1))
+	manifest, err = keppel.FindManifest(s.DB, *repo, image.Manifest.Digest)
+	test.MustDo(t, err)
+	s.ExpectManifestsExistInStorage(t, "baz", *manifest)
+
+	for _, blobContents := range append(image.Layers, image.Config) {
+		blob, err := keppel.FindBlobByRepository(s.DB, blobContents.Digest, *repo)
+		test.MustDo(t, err)
+		assert.DeepEqual(t, "blob account", blob.AccountName, models.AccountName("test2"))
+		s.ExpectBlobsExistInStorage(t, *blob)
+	}
+	refCount, err := s.DB.SelectInt(`SELECT COUNT(*) FROM manifest_blob_refs mbr JOIN blobs b ON b.id = mbr.blob_id WHERE b.account_name = 'test2'`)
+	test.MustDo(t, err)
+	assert.DeepEqual(t, "manifest blob refs in target account", refCount, int64(2))
+	mountCount, err := s.DB.SelectInt(`SELECT COUNT(*) FROM blob_mounts bm JOIN blobs b ON b.id = bm.blob_id WHERE b.account_name = 'test1'`)
+	test.MustDo(t, err)
+	assert.DeepEqual(t, "blob mounts in source account", mountCount, int64(0))
+}
@@ -0,0 +1,123 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package keppelv1
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sapcc/go-bits/httpapi"
+	"github.com/sapcc/go-bits/respondwith"
+
+	"github.com/sapcc/keppel/internal/auth"
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+const (
+	// defaultScopedTokenLifetime is the lifetime of a token minted through
+	// POST /keppel/v1/accounts/:account/_token if the request does not specify one.
+	defaultScopedTokenLifetime = 15 * time.Minute
+	// maxScopedTokenLifetime is the maximum lifetime that can be requested for such a token.
+	maxScopedTokenLifetime = 1 * time.Hour
+)
+
+// the repository permissions that can be granted to a token minted through
+// POST /keppel/v1/accounts/:account/_token
+var scopedTokenActions = []string{"pull", "push", "delete"}
+
+func (a *API) handlePostAccountToken(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/keppel/v1/accounts/:account/_token")
+	// decode request body
+	var req struct {
+		Scopes []struct {
+			RepositoryName string   `json:"repository"`
+			Actions        []string `json:"actions"`
+		} `json:"scopes"`
+		ExpiresInSeconds uint64 `json:"expires_in"`
+	}
+	ok := decodeJSONRequestBody(w, r.Body, &req)
+	if !ok {
+		return
+	}
+
+	// validate requested scopes
+	if len(req.Scopes) == 0 {
+		http.Error(w, "at least one scope must be requested", http.StatusUnprocessableEntity)
+		return
+	}
+	accountName := mux.Vars(r)["account"]
+	var requestedScopes auth.ScopeSet
+	for _, scope := range req.Scopes {
+		if !isValidRepoName(scope.RepositoryName) {
+			http.Error(w, fmt.Sprintf("invalid repository name: %q", scope.RepositoryName), http.StatusUnprocessableEntity)
+			return
+		}
+		if len(scope.Actions) == 0 {
+			http.Error(w, fmt.Sprintf("no actions requested for repository %q", scope.RepositoryName), http.StatusUnprocessableEntity)
+			return
+		}
+		for _, action := range scope.Actions {
+			if !slices.Contains(scopedTokenActions, action) {
+				http.Error(w, fmt.Sprintf("invalid action for repository %q: %q", scope.RepositoryName, action), http.StatusUnprocessableEntity)
+				return
+			}
+		}
+		requestedScopes.Add(auth.Scope{
+			ResourceType: "repository",
+			ResourceName: fmt.Sprintf("%s/%s", accountName, scope.RepositoryName),
+			Actions:      scope.Actions,
+		})
+	}
+
+	// validate requested lifetime
+	expiresIn := defaultScopedTokenLifetime
+	if req.ExpiresInSeconds != 0 {
+		expiresIn = time.Duration(req.ExpiresInSeconds) * time.Second
+		if expiresIn > maxScopedTokenLifetime {
+			http.Error(w, fmt.Sprintf("expires_in may not be larger than %d", uint64(maxScopedTokenLifetime.Seconds())), http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	// the caller needs to be able to change the account, and also needs to hold
+	// all the permissions that shall be granted to the token (this ensures that
+	// the minted token cannot exceed the caller's own access)
+	requiredScopes := accountScopeFromRequest(r, keppel.CanChangeAccount)
+	for _, scope := range requestedScopes {
+		requiredScopes.Add(*scope)
+	}
+	authz := a.authenticateRequest(w, r, requiredScopes)
+	if authz == nil {
+		return
+	}
+	account := a.findAccountFromRequest(w, r, authz)
+	if account == nil {
+		return
+	}
+	if account.IsDeleting {
+		http.Error(w, "account is being deleted", http.StatusConflict)
+		return
+	}
+
+	// the token is issued on behalf of the caller, but only carries the requested scopes
+	scopedAuthz := auth.Authorization{
+		UserIdentity: authz.UserIdentity,
+		Audience:     authz.Audience,
+		ScopeSet:     requestedScopes,
+	}
+	tokenResponse, err := scopedAuthz.IssueTokenWithExpires(a.cfg, expiresIn)
+	if respondwith.ObfuscatedErrorText(w, err) {
+		return
+	}
+	if a.cfg.TrackIssuedTokens {
+		err := scopedAuthz.TrackIssuedToken(r.Context(), a.db, *tokenResponse)
+		if respondwith.ObfuscatedErrorText(w, err) {
+			return
+		}
+	}
+	respondwith.JSON(w, http.StatusOK, tokenResponse)
+}
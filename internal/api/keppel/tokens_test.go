@@ -0,0 +1,157 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package keppelv1_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+
+	"github.com/sapcc/keppel/internal/keppel"
+	"github.com/sapcc/keppel/internal/models"
+	"github.com/sapcc/keppel/internal/test"
+)
+
+func TestPostAccountToken(t *testing.T) {
+	s := test.NewSetup(t,
+		test.WithKeppelAPI,
+		test.WithQuotas,
+		test.WithAccount(models.Account{Name: "test1", AuthTenantID: "tenant1"}),
+	)
+	h := s.Handler
+
+	image := test.GenerateImage(test.GenerateExampleLayer(1))
+	image.MustUpload(t, s, models.Repository{AccountName: "test1", Name: "foo"}, "latest")
+	image.MustUpload(t, s, models.Repository{AccountName: "test1", Name: "bar"}, "latest")
+
+	// error cases: missing or insufficient authorization
+	pullFooRequest := assert.JSONObject{
+		"scopes":     []assert.JSONObject{{"repository": "foo", "actions": []string{"pull"}}},
+		"expires_in": 600,
+	}
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/test1/_token",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		Body:         pullFooRequest,
+		ExpectStatus: http.StatusForbidden,
+		ExpectBody:   assert.StringData("no permission for keppel_account:test1:change\n"),
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/unknown/_token",
+		Header:       map[string]string{"X-Test-Perms": "change:tenant1,pull:tenant1"},
+		Body:         pullFooRequest,
+		ExpectStatus: http.StatusForbidden,
+		ExpectBody:   assert.StringData("no permission for keppel_account:unknown:change\n"),
+	}.Check(t, h)
+
+	// error case: the caller cannot grant permissions that they do not have themselves
+	assert.HTTPRequest{
+		Method: "POST",
+		Path:   "/keppel/v1/accounts/test1/_token",
+		Header: map[string]string{"X-Test-Perms": "change:tenant1,pull:tenant1"},
+		Body: assert.JSONObject{
+			"scopes": []assert.JSONObject{{"repository": "foo", "actions": []string{"pull", "push"}}},
+		},
+		ExpectStatus: http.StatusForbidden,
+		ExpectBody:   assert.StringData("no permission for repository:test1/foo:pull,push\n"),
+	}.Check(t, h)
+
+	// error cases: malformed requests
+	malformedRequests := map[string]assert.JSONObject{
+		"at least one scope must be requested": {
+			"scopes": []assert.JSONObject{},
+		},
+		`invalid repository name: "foo/"`: {
+			"scopes": []assert.JSONObject{{"repository": "foo/", "actions": []string{"pull"}}},
+		},
+		`no actions requested for repository "foo"`: {
+			"scopes": []assert.JSONObject{{"repository": "foo", "actions": []string{}}},
+		},
+		`invalid action for repository "foo": "change"`: {
+			"scopes": []assert.JSONObject{{"repository": "foo", "actions": []string{"change"}}},
+		},
+		"expires_in may not be larger than 3600": {
+			"scopes":     []assert.JSONObject{{"repository": "foo", "actions": []string{"pull"}}},
+			"expires_in": 7200,
+		},
+	}
+	for expectedMessage, body := range malformedRequests {
+		assert.HTTPRequest{
+			Method:       "POST",
+			Path:         "/keppel/v1/accounts/test1/_token",
+			Header:       map[string]string{"X-Test-Perms": "change:tenant1,pull:tenant1"},
+			Body:         body,
+			ExpectStatus: http.StatusUnprocessableEntity,
+			ExpectBody:   assert.StringData(expectedMessage + "\n"),
+		}.Check(t, h)
+	}
+
+	// happy case: mint a token that can only pull from test1/foo
+	_, respBodyBytes := assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/test1/_token",
+		Header:       map[string]string{"X-Test-Perms": "change:tenant1,pull:tenant1,push:tenant1,delete:tenant1"},
+		Body:         pullFooRequest,
+		ExpectStatus: http.StatusOK,
+	}.Check(t, h)
+	var tokenData struct {
+		Token     string `json:"token"`
+		ExpiresIn uint64 `json:"expires_in"`
+	}
+	test.MustDo(t, json.Unmarshal(respBodyBytes, &tokenData))
+	assert.DeepEqual(t, "expires_in", tokenData.ExpiresIn, uint64(600))
+
+	// the minted token can be used for the granted scope...
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/v2/test1/foo/manifests/latest",
+		Header:       map[string]string{"Authorization": "Bearer " + tokenData.Token},
+		ExpectStatus: http.StatusOK,
+		ExpectHeader: test.VersionHeader,
+		ExpectBody:   assert.ByteData(image.Manifest.Contents),
+	}.Check(t, h)
+
+	// ...but not beyond it, even though the caller had more permissions
+	assert.HTTPRequest{
+		Method:       "DELETE",
+		Path:         "/v2/test1/foo/manifests/" + image.Manifest.Digest.String(),
+		Header:       map[string]string{"Authorization": "Bearer " + tokenData.Token},
+		ExpectStatus: http.StatusUnauthorized,
+		ExpectHeader: test.VersionHeader,
+		ExpectBody:   test.ErrorCode(keppel.ErrDenied),
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/v2/test1/bar/manifests/latest",
+		Header:       map[string]string{"Authorization": "Bearer " + tokenData.Token},
+		ExpectStatus: http.StatusUnauthorized,
+		ExpectHeader: test.VersionHeader,
+		ExpectBody:   test.ErrorCode(keppel.ErrDenied),
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/test1/_token",
+		Header:       map[string]string{"Authorization": "Bearer " + tokenData.Token},
+		Body:         pullFooRequest,
+		ExpectStatus: http.StatusForbidden,
+		ExpectBody:   assert.StringData("token does not cover scope keppel_account:test1:change\n"),
+	}.Check(t, h)
+
+	// when no lifetime is requested, the default lifetime of 15 minutes applies
+	_, respBodyBytes = assert.HTTPRequest{
+		Method: "POST",
+		Path:   "/keppel/v1/accounts/test1/_token",
+		Header: map[string]string{"X-Test-Perms": "change:tenant1,pull:tenant1,push:tenant1"},
+		Body: assert.JSONObject{
+			"scopes": []assert.JSONObject{{"repository": "foo", "actions": []string{"pull", "push"}}},
+		},
+		ExpectStatus: http.StatusOK,
+	}.Check(t, h)
+	test.MustDo(t, json.Unmarshal(respBodyBytes, &tokenData))
+	assert.DeepEqual(t, "expires_in", tokenData.ExpiresIn, uint64(900))
+}
@@ -0,0 +1,148 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package keppelv1
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/opencontainers/go-digest"
+	"github.com/sapcc/go-bits/httpapi"
+	"github.com/sapcc/go-bits/respondwith"
+	"github.com/sapcc/go-bits/sqlext"
+
+	"github.com/sapcc/keppel/internal/api"
+	"github.com/sapcc/keppel/internal/keppel"
+	"github.com/sapcc/keppel/internal/models"
+)
+
+// TrashedManifest represents a manifest in the trash in the API.
+type TrashedManifest struct {
+	Digest    digest.Digest `json:"digest"`
+	MediaType string        `json:"media_type"`
+	SizeBytes uint64        `json:"size_bytes"`
+	PushedAt  int64         `json:"pushed_at"`
+	DeletedAt int64         `json:"deleted_at"`
+	ExpiresAt int64         `json:"expires_at"`
+	Tags      []string      `json:"tags,omitempty"`
+}
+
+var trashedManifestGetQuery = sqlext.SimplifyWhitespace(`
+	SELECT *
+	  FROM manifests
+	 WHERE repo_id = $1 AND deleted_at IS NOT NULL AND $CONDITION
+	 ORDER BY digest ASC
+	 LIMIT $LIMIT
+`)
+
+func (a *API) handleGetTrash(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/keppel/v1/accounts/:account/repositories/:repo/_trash")
+	authz := a.authenticateRequest(w, r, repoScopeFromRequest(r, keppel.CanPullFromAccount))
+	if authz == nil {
+		return
+	}
+	account := a.findAccountFromRequest(w, r, authz)
+	if account == nil {
+		return
+	}
+	repo := a.findRepositoryFromRequest(w, r, account.Name)
+	if repo == nil {
+		return
+	}
+
+	query, bindValues, limit, err := paginatedQuery{
+		SQL:         trashedManifestGetQuery,
+		MarkerField: "digest",
+		Options:     r.URL.Query(),
+		BindValues:  []any{repo.ID},
+	}.Prepare()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var dbManifests []models.Manifest
+	_, err = a.db.Select(&dbManifests, query, bindValues...)
+	if respondwith.ObfuscatedErrorText(w, err) {
+		return
+	}
+
+	retention := time.Duration(account.ManifestTrashRetentionSecs) * time.Second
+	result := struct {
+		Manifests   []TrashedManifest `json:"manifests"`
+		IsTruncated bool              `json:"truncated,omitempty"`
+	}{
+		Manifests: []TrashedManifest{},
+	}
+	for _, dbManifest := range dbManifests {
+		if uint64(len(result.Manifests)) >= limit {
+			result.IsTruncated = true
+			break
+		}
+
+		var tags []string
+		if dbManifest.DeletedTagsJSON != "" {
+			err := json.Unmarshal([]byte(dbManifest.DeletedTagsJSON), &tags)
+			if respondwith.ObfuscatedErrorText(w, err) {
+				return
+			}
+		}
+		deletedAt := dbManifest.DeletedAt.UnwrapOr(time.Time{})
+		result.Manifests = append(result.Manifests, TrashedManifest{
+			Digest:    dbManifest.Digest,
+			MediaType: dbManifest.MediaType,
+			SizeBytes: dbManifest.SizeBytes,
+			PushedAt:  dbManifest.PushedAt.Unix(),
+			DeletedAt: deletedAt.Unix(),
+			ExpiresAt: deletedAt.Add(retention).Unix(),
+			Tags:      tags,
+		})
+	}
+
+	respondwith.JSON(w, http.StatusOK, result)
+}
+
+func (a *API) handleRestoreFromTrash(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/keppel/v1/accounts/:account/repositories/:repo/_trash/:digest/restore")
+	authz := a.authenticateRequest(w, r, repoScopeFromRequest(r, keppel.CanPushToAccount))
+	if authz == nil {
+		return
+	}
+	account := a.findAccountFromRequest(w, r, authz)
+	if account == nil {
+		return
+	}
+	repo := a.findRepositoryFromRequest(w, r, account.Name)
+	if repo == nil {
+		return
+	}
+	err := api.CheckAccountWritable(a.cfg, account.Reduced(), false)
+	if err != nil {
+		keppel.AsRegistryV2Error(err).WriteAsTextTo(w)
+		return
+	}
+	parsedDigest, err := digest.Parse(mux.Vars(r)["digest"])
+	if err != nil {
+		http.Error(w, "no such manifest in trash", http.StatusNotFound)
+		return
+	}
+
+	err = a.processor().RestoreManifest(account.Reduced(), *repo, parsedDigest, keppel.AuditContext{
+		UserIdentity: authz.UserIdentity,
+		Request:      r,
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "no such manifest in trash", http.StatusNotFound)
+		return
+	}
+	if respondwith.ObfuscatedErrorText(w, err) {
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
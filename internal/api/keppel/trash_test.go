@@ -0,0 +1,146 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package keppelv1_test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-api-declarations/cadf"
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/easypg"
+
+	"github.com/sapcc/keppel/internal/models"
+	"github.com/sapcc/keppel/internal/test"
+)
+
+func TestManifestTrash(t *testing.T) {
+	s := test.NewSetup(t,
+		test.WithKeppelAPI,
+		test.WithQuotas,
+		test.WithAccount(models.Account{Name: "test1", AuthTenantID: "tenant1", ManifestTrashRetentionSecs: 3600}),
+	)
+	h := s.Handler
+
+	repoRef := models.Repository{AccountName: "test1", Name: "foo"}
+	image := test.GenerateImage(test.GenerateExampleLayer(1))
+	image.MustUpload(t, s, repoRef, "latest")
+	pushedAt := s.Clock.Now()
+
+	// the trash is empty initially
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_trash",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   assert.JSONObject{"manifests": []assert.JSONObject{}},
+	}.Check(t, h)
+
+	// delete the manifest: this moves it into the trash
+	s.Clock.StepBy(time.Hour)
+	assert.HTTPRequest{
+		Method:       "DELETE",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_manifests/" + image.Manifest.Digest.String(),
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,delete:tenant1"},
+		ExpectStatus: http.StatusNoContent,
+	}.Check(t, h)
+	deletedAt := s.Clock.Now()
+	s.Auditor.IgnoreEventsUntilNow()
+
+	// the manifest is not listed anymore, and cannot be deleted again
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_manifests",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   assert.JSONObject{"manifests": []assert.JSONObject{}},
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "DELETE",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_manifests/" + image.Manifest.Digest.String(),
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,delete:tenant1"},
+		ExpectStatus: http.StatusNotFound,
+	}.Check(t, h)
+
+	// instead, it shows up in the trash
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_trash",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{"manifests": []assert.JSONObject{{
+			"digest":     image.Manifest.Digest.String(),
+			"media_type": image.Manifest.MediaType,
+			"size_bytes": image.SizeBytes(),
+			"pushed_at":  pushedAt.Unix(),
+			"deleted_at": deletedAt.Unix(),
+			"expires_at": deletedAt.Add(time.Hour).Unix(),
+			"tags":       []string{"latest"},
+		}}},
+	}.Check(t, h)
+
+	// error cases for restore
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_trash/" + image.Manifest.Digest.String() + "/restore",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusForbidden,
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_trash/" + test.DeterministicDummyDigest(1).String() + "/restore",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,push:tenant1"},
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody:   assert.StringData("no such manifest in trash\n"),
+	}.Check(t, h)
+
+	// happy case for restore: the manifest comes back together with its tag
+	tr, _ := easypg.NewTracker(t, s.DB.Db)
+	s.Clock.StepBy(time.Minute)
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_trash/" + image.Manifest.Digest.String() + "/restore",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,push:tenant1"},
+		ExpectStatus: http.StatusNoContent,
+	}.Check(t, h)
+	tr.DBChanges().AssertEqualf(`
+			UPDATE manifests SET deleted_at = NULL, deleted_tags_json = '' WHERE repo_id = 1 AND digest = '%[1]s';
+			INSERT INTO tags (repo_id, name, digest, pushed_at) VALUES (1, 'latest', '%[1]s', %[2]d);
+		`,
+		image.Manifest.Digest, s.Clock.Now().Unix(),
+	)
+	s.Auditor.ExpectEvents(t, cadf.Event{
+		RequestPath: "/keppel/v1/accounts/test1/repositories/foo/_trash/" + image.Manifest.Digest.String() + "/restore",
+		Action:      cadf.UpdateAction,
+		Outcome:     "success",
+		Reason:      test.CADFReasonOK,
+		Target: cadf.Resource{
+			Attachments: []cadf.Attachment{{
+				Name:    "tags",
+				TypeURI: "mime:application/json",
+				Content: "[\"latest\"]",
+			}},
+			TypeURI:   "docker-registry/account/repository/manifest",
+			Name:      "test1/foo@" + image.Manifest.Digest.String(),
+			ID:        image.Manifest.Digest.String(),
+			ProjectID: "tenant1",
+		},
+	})
+
+	// the trash is empty again, and the manifest cannot be restored twice
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_trash",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   assert.JSONObject{"manifests": []assert.JSONObject{}},
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_trash/" + image.Manifest.Digest.String() + "/restore",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,push:tenant1"},
+		ExpectStatus: http.StatusNotFound,
+	}.Check(t, h)
+}
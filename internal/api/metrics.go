@@ -5,6 +5,8 @@ package api
 
 import (
 	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/sapcc/keppel/internal/models"
 )
 
 var (
@@ -40,6 +42,30 @@ var (
 		},
 		[]string{"account", "auth_tenant_id", "method"},
 	)
+	// CatalogAccountsScannedHistogram is a prometheus.Histogram.
+	CatalogAccountsScannedHistogram = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "keppel_catalog_accounts_scanned",
+			Help:    "Number of accounts whose repositories were loaded from the database to answer a single catalog request.",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 11), // 1 .. 1024
+		},
+	)
+	// CatalogReposCollectedHistogram is a prometheus.Histogram.
+	CatalogReposCollectedHistogram = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "keppel_catalog_repos_collected",
+			Help:    "Number of repositories that were loaded from the database to answer a single catalog request.",
+			Buckets: prometheus.ExponentialBuckets(1, 4, 9), // 1 .. 65536
+		},
+	)
+	// CatalogDurationHistogram is a prometheus.Histogram.
+	CatalogDurationHistogram = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "keppel_catalog_duration_seconds",
+			Help:    "Time taken to collect the repository list for a single catalog request.",
+			Buckets: prometheus.DefBuckets,
+		},
+	)
 	// ManifestsPulledCounter is a prometheus.CounterVec.
 	ManifestsPulledCounter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
@@ -56,6 +82,14 @@ var (
 		},
 		[]string{"account", "auth_tenant_id", "method"},
 	)
+	// ReplicaPullsCounter is a prometheus.CounterVec.
+	ReplicaPullsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "keppel_replica_pull_total",
+			Help: "Counts manifests and blobs that are pulled from replica accounts, split by whether they were served locally (hit) or triggered replication (miss).",
+		},
+		[]string{"account", "auth_tenant_id", "type", "result"},
+	)
 	// UploadsAbortedCounter is a prometheus.CounterVec.
 	UploadsAbortedCounter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
@@ -66,12 +100,34 @@ var (
 	)
 )
 
+// CountReplicaPull increments ReplicaPullsCounter for pulls from replica
+// accounts. Pulls from non-replica accounts are ignored.
+func CountReplicaPull(account models.ReducedAccount, objectType string, wasReplicated bool) {
+	if account.UpstreamPeerHostName == "" && account.ExternalPeerURL == "" {
+		return
+	}
+	result := "hit"
+	if wasReplicated {
+		result = "miss"
+	}
+	ReplicaPullsCounter.With(prometheus.Labels{
+		"account":        string(account.Name),
+		"auth_tenant_id": account.AuthTenantID,
+		"type":           objectType,
+		"result":         result,
+	}).Inc()
+}
+
 func init() {
 	prometheus.MustRegister(BlobBytesPulledCounter)
 	prometheus.MustRegister(BlobBytesPushedCounter)
 	prometheus.MustRegister(BlobsPulledCounter)
 	prometheus.MustRegister(BlobsPushedCounter)
+	prometheus.MustRegister(CatalogAccountsScannedHistogram)
+	prometheus.MustRegister(CatalogReposCollectedHistogram)
+	prometheus.MustRegister(CatalogDurationHistogram)
 	prometheus.MustRegister(ManifestsPulledCounter)
 	prometheus.MustRegister(ManifestsPushedCounter)
+	prometheus.MustRegister(ReplicaPullsCounter)
 	prometheus.MustRegister(UploadsAbortedCounter)
 }
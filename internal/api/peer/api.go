@@ -7,6 +7,7 @@ import (
 	"net/http"
 
 	"github.com/gorilla/mux"
+	"github.com/sapcc/go-bits/audittools"
 
 	"github.com/sapcc/keppel/internal/auth"
 	"github.com/sapcc/keppel/internal/keppel"
@@ -16,14 +17,15 @@ import (
 // API contains state variables used by the peer API. This is an internal API
 // that is only available to peered Keppel instances.
 type API struct {
-	cfg keppel.Configuration
-	ad  keppel.AuthDriver
-	db  *keppel.DB
+	cfg     keppel.Configuration
+	ad      keppel.AuthDriver
+	db      *keppel.DB
+	auditor audittools.Auditor
 }
 
 // NewAPI constructs a new API instance.
-func NewAPI(cfg keppel.Configuration, ad keppel.AuthDriver, db *keppel.DB) *API {
-	return &API{cfg, ad, db}
+func NewAPI(cfg keppel.Configuration, ad keppel.AuthDriver, db *keppel.DB, auditor audittools.Auditor) *API {
+	return &API{cfg, ad, db, auditor}
 }
 
 // AddTo implements the api.API interface.
@@ -34,6 +36,7 @@ func (a *API) AddTo(r *mux.Router) {
 	// Registry V2 API.
 	r.Methods("GET").Path("/peer/v1/delegatedpull/{hostname}/v2/{repo:.+}/manifests/{reference}").HandlerFunc(a.handleDelegatedPullManifest)
 	r.Methods("POST").Path("/peer/v1/sync-replica/{account}/{repo:.+}").HandlerFunc(a.handleSyncReplica)
+	r.Methods("POST").Path("/peer/v1/rotate-credentials").HandlerFunc(a.handleRotateCredentials)
 }
 
 func (a *API) authenticateRequest(w http.ResponseWriter, r *http.Request) *models.Peer {
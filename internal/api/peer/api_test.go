@@ -7,9 +7,14 @@ import (
 	"net/http"
 	"testing"
 
+	. "github.com/majewsky/gg/option"
+	"github.com/opencontainers/go-digest"
+	"github.com/sapcc/go-api-declarations/cadf"
 	"github.com/sapcc/go-bits/assert"
 	"github.com/sapcc/go-bits/easypg"
 
+	"github.com/sapcc/keppel/internal/keppel"
+	"github.com/sapcc/keppel/internal/models"
 	"github.com/sapcc/keppel/internal/test"
 )
 
@@ -37,3 +42,54 @@ func TestAlternativeAuthSchemes(t *testing.T) {
 	// bearer token auth and Keppel API auth do not even allow obtaining a token
 	// for the auth.PeerAPIScope.
 }
+
+func TestRotateCredentials(t *testing.T) {
+	s := test.NewSetup(t, test.WithPeerAPI)
+	h := s.Handler
+
+	lastPeeredAt := s.Clock.Now()
+	test.MustDo(t, s.DB.Insert(&models.Peer{
+		HostName:                 "peer.example.org",
+		TheirCurrentPasswordHash: digest.SHA256.FromString("current").String(),
+		LastPeeredAt:             Some(lastPeeredAt),
+	}))
+	tr, _ := easypg.NewTracker(t, s.DB.Db)
+
+	// only peers can request a credential rotation
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/peer/v1/rotate-credentials",
+		Header:       map[string]string{"Authorization": keppel.BuildBasicAuthHeader("replication@peer.example.org", "wrong")},
+		ExpectStatus: http.StatusUnauthorized,
+	}.Check(t, h)
+	tr.DBChanges().AssertEmpty()
+
+	// the rotation request marks the peer as due for a new password, but does not touch the current password yet
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/peer/v1/rotate-credentials",
+		Header:       map[string]string{"Authorization": keppel.BuildBasicAuthHeader("replication@peer.example.org", "current")},
+		ExpectStatus: http.StatusAccepted,
+	}.Check(t, h)
+	tr.DBChanges().AssertEqualf(`
+		UPDATE peers SET last_peered_at = NULL WHERE hostname = 'peer.example.org';
+	`)
+
+	s.Auditor.ExpectEvents(t, cadf.Event{
+		RequestPath: "/peer/v1/rotate-credentials",
+		Action:      cadf.UpdateAction,
+		Outcome:     "success",
+		Reason:      cadf.Reason{ReasonType: "HTTP", ReasonCode: "202"},
+		Target: cadf.Resource{
+			TypeURI: "docker-registry/peer",
+			ID:      "peer.example.org",
+			Name:    "peer.example.org",
+		},
+		Initiator: cadf.Resource{
+			TypeURI: "service/docker-registry/peer",
+			ID:      "peer.example.org",
+			Name:    "peer.example.org",
+			Domain:  "keppel",
+		},
+	})
+}
@@ -40,7 +40,7 @@ func (a *API) handleSyncReplica(w http.ResponseWriter, r *http.Request) {
 
 	// find account
 	accountName := models.AccountName(mux.Vars(r)["account"])
-	account, err := keppel.FindAccount(a.db, accountName)
+	account, err := keppel.FindAccount(r.Context(), a.db, accountName)
 	if respondwith.ObfuscatedErrorText(w, err) {
 		return
 	}
@@ -137,7 +137,7 @@ func (a *API) handleSyncReplica(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var manifests []keppel.ManifestForSync
-	query = `SELECT digest FROM manifests WHERE repo_id = $1`
+	query = `SELECT digest FROM manifests WHERE repo_id = $1 AND deleted_at IS NULL`
 	err = sqlext.ForeachRow(a.db, query, []any{repo.ID}, func(rows *sql.Rows) error {
 		var digest digest.Digest
 		err = rows.Scan(&digest)
@@ -0,0 +1,66 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package peerv1
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/sapcc/go-api-declarations/cadf"
+	"github.com/sapcc/go-bits/audittools"
+	"github.com/sapcc/go-bits/httpapi"
+	"github.com/sapcc/go-bits/respondwith"
+
+	"github.com/sapcc/keppel/internal/processor"
+)
+
+// Implementation for the POST /peer/v1/rotate-credentials endpoint.
+func (a *API) handleRotateCredentials(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/peer/v1/rotate-credentials")
+	peer := a.authenticateRequest(w, r)
+	if peer == nil {
+		return
+	}
+
+	// We do not issue the new password right here. Instead, we mark the peer as
+	// due for a new password, and the regular peering loop in keppel-api will
+	// pick it up within seconds. This way, there is only one code path that
+	// issues passwords, and the row locking in that code path prevents
+	// concurrent issuances by different keppel-api instances.
+	//
+	// The credential that the peer currently uses stays valid as our
+	// "previous password" until the next regular rotation, so the peer does
+	// not experience any downtime.
+	_, err := a.db.Exec(`UPDATE peers SET last_peered_at = NULL WHERE hostname = $1`, peer.HostName)
+	if respondwith.ObfuscatedErrorText(w, err) {
+		return
+	}
+
+	a.auditor.Record(audittools.Event{
+		Time:       time.Now(),
+		Request:    r,
+		User:       peerUserInfo{HostName: peer.HostName},
+		ReasonCode: http.StatusAccepted,
+		Action:     cadf.UpdateAction,
+		Target:     processor.AuditPeer{HostName: peer.HostName},
+	})
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// peerUserInfo is an audittools.UserInfo representing a peer (who does not
+// have a corresponding user in the auth driver).
+type peerUserInfo struct {
+	HostName string
+}
+
+// AsInitiator implements the audittools.UserInfo interface.
+func (u peerUserInfo) AsInitiator(_ cadf.Host) cadf.Resource {
+	return cadf.Resource{
+		TypeURI: "service/docker-registry/peer",
+		Name:    u.HostName,
+		Domain:  "keppel",
+		ID:      u.HostName,
+	}
+}
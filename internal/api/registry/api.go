@@ -7,7 +7,9 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"maps"
 	"net/http"
+	"slices"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -17,6 +19,7 @@ import (
 	"github.com/sapcc/go-bits/httpapi"
 	"github.com/sapcc/go-bits/respondwith"
 
+	"github.com/sapcc/keppel/internal/api"
 	"github.com/sapcc/keppel/internal/auth"
 	"github.com/sapcc/keppel/internal/keppel"
 	"github.com/sapcc/keppel/internal/models"
@@ -57,8 +60,8 @@ func (a *API) OverrideGenerateStorageID(generateStorageID func() string) *API {
 
 // AddTo implements the api.API interface.
 func (a *API) AddTo(r *mux.Router) {
-	r.Methods("GET").Path("/v2/").HandlerFunc(a.handleToplevel)
-	r.Methods("GET").Path("/v2/_catalog").HandlerFunc(a.handleGetCatalog)
+	r.Methods("GET").Path("/v2/").HandlerFunc(api.WithAccountCache(a.handleToplevel))
+	r.Methods("GET").Path("/v2/_catalog").HandlerFunc(api.WithAccountCache(a.handleGetCatalog))
 
 	//NOTE: We used to match account name and repository name separately here,
 	// but that is not possible anymore since domain-remapped APIs do not have the
@@ -66,40 +69,40 @@ func (a *API) AddTo(r *mux.Router) {
 	// checkAccountAccess().
 	r.Methods("DELETE").
 		Path("/v2/{repository:.+}/blobs/{digest}").
-		HandlerFunc(a.handleDeleteBlob)
+		HandlerFunc(api.WithAccountCache(a.handleDeleteBlob))
 	r.Methods("GET", "HEAD").
 		Path("/v2/{repository:.+}/blobs/{digest}").
-		HandlerFunc(a.handleGetOrHeadBlob)
+		HandlerFunc(api.WithAccountCache(a.handleGetOrHeadBlob))
 	r.Methods("POST").
 		Path("/v2/{repository:.+}/blobs/uploads/").
-		HandlerFunc(a.handleStartBlobUpload)
+		HandlerFunc(api.WithAccountCache(a.handleStartBlobUpload))
 	r.Methods("DELETE").
 		Path("/v2/{repository:.+}/blobs/uploads/{uuid}").
-		HandlerFunc(a.handleDeleteBlobUpload)
+		HandlerFunc(api.WithAccountCache(a.handleDeleteBlobUpload))
 	r.Methods("GET").
 		Path("/v2/{repository:.+}/blobs/uploads/{uuid}").
-		HandlerFunc(a.handleGetBlobUpload)
+		HandlerFunc(api.WithAccountCache(a.handleGetBlobUpload))
 	r.Methods("PATCH").
 		Path("/v2/{repository:.+}/blobs/uploads/{uuid}").
-		HandlerFunc(a.handleContinueBlobUpload)
+		HandlerFunc(api.WithAccountCache(a.handleContinueBlobUpload))
 	r.Methods("PUT").
 		Path("/v2/{repository:.+}/blobs/uploads/{uuid}").
-		HandlerFunc(a.handleFinishBlobUpload)
+		HandlerFunc(api.WithAccountCache(a.handleFinishBlobUpload))
 	r.Methods("DELETE").
 		Path("/v2/{repository:.+}/manifests/{reference}").
-		HandlerFunc(a.handleDeleteManifest)
+		HandlerFunc(api.WithAccountCache(a.handleDeleteManifest))
 	r.Methods("GET", "HEAD").
 		Path("/v2/{repository:.+}/manifests/{reference}").
-		HandlerFunc(a.handleGetOrHeadManifest)
+		HandlerFunc(api.WithAccountCache(a.handleGetOrHeadManifest))
 	r.Methods("PUT").
 		Path("/v2/{repository:.+}/manifests/{reference}").
-		HandlerFunc(a.handlePutManifest)
+		HandlerFunc(api.WithAccountCache(a.handlePutManifest))
 	r.Methods("GET").
 		Path("/v2/{repository:.+}/referrers/{reference}").
-		HandlerFunc(a.handleGetReferrers)
+		HandlerFunc(api.WithAccountCache(a.handleGetReferrers))
 	r.Methods("GET").
 		Path("/v2/{repository:.+}/tags/list").
-		HandlerFunc(a.handleListTags)
+		HandlerFunc(api.WithAccountCache(a.handleListTags))
 }
 
 func (a *API) processor() *processor.Processor {
@@ -217,39 +220,36 @@ func (a *API) checkAccountAccess(w http.ResponseWriter, r *http.Request, strateg
 		AllowsDomainRemapping: true,
 	}.Authorize(r.Context(), a.cfg, a.ad, a.db)
 	if rerr != nil {
+		if anycastHandler != nil && a.tryForwardAnonymousAnycastRequest(w, r, scope, rerr, anycastHandler) {
+			return nil, nil, nil, nil
+		}
 		rerr.WriteAsRegistryV2ResponseTo(w, r)
 		return nil, nil, nil, nil
 	}
 
 	// we need to know the account to select the registry instance for this request
 	repoScope := scope.ParseRepositoryScope(authz.Audience)
-	account, err := keppel.FindReducedAccount(a.db, repoScope.AccountName)
+	account, err := keppel.FindReducedAccount(r.Context(), a.db, repoScope.AccountName)
 	if respondWithError(w, r, err) {
 		return nil, nil, nil, nil
 	}
+	isForwardedAnycast := r.Header.Get("X-Keppel-Forwarded-By") != ""
+	if account != nil && account.IsAnycastDisabled && (authz.Audience.IsAnycast || isForwardedAnycast) {
+		// accounts that opted out of anycast are not served on the anycast API at
+		// all, neither by us nor by forwarding to a peer (we are the peer holding
+		// this account, so either the anycast token must have been issued before
+		// the opt-out, or a peer forwarded an anonymous anycast request to our
+		// regular API)
+		keppel.ErrNameUnknown.With("account not found").WriteAsRegistryV2ResponseTo(w, r)
+		return nil, nil, nil, nil
+	}
 	if account == nil {
 		// if this is an anycast request, try forwarding it to the peer that has the primary account with this name
 		if anycastHandler != nil && authz.Audience.IsAnycast {
-			primaryHostName, err := a.fd.FindPrimaryAccount(r.Context(), repoScope.AccountName)
-			switch {
-			case err == nil:
-				// protect against infinite forwarding loops in case different Keppels have
-				// different ideas about who is the primary account
-				if forwardedBy := r.URL.Query().Get("X-Keppel-Forwarded-By"); forwardedBy != "" {
-					msg := fmt.Sprintf("not forwarding anycast request for account %q to %s because request was already forwarded to us by %s",
-						repoScope.AccountName, primaryHostName, forwardedBy)
-					keppel.ErrUnknown.With(msg).WriteAsRegistryV2ResponseTo(w, r)
-				} else {
-					mappedPrimaryHostName := authz.Audience.MapPeerHostname(primaryHostName)
-					anycastHandler(w, r, anycastRequestInfo{repoScope.AccountName, repoScope.RepositoryName, mappedPrimaryHostName})
-				}
-				return nil, nil, nil, nil
-			case errors.Is(err, keppel.ErrNoSuchPrimaryAccount):
-				// fall through to the standard 404 handling below
-			default:
-				respondWithError(w, r, err)
+			if a.forwardAnycastRequest(w, r, authz.Audience, repoScope, anycastHandler) {
 				return nil, nil, nil, nil
 			}
+			// otherwise fall through to the standard 404 handling below
 		}
 		// defense in depth - if the account does not exist and we're not
 		// anycasting, there should not be a valid token (the auth endpoint does not
@@ -257,6 +257,13 @@ func (a *API) checkAccountAccess(w http.ResponseWriter, r *http.Request, strateg
 		keppel.ErrNameUnknown.With("account not found").WriteAsRegistryV2ResponseTo(w, r)
 		return nil, nil, nil, nil
 	}
+	if account.IsCreating {
+		// until its setup is complete, the account cannot have any contents yet,
+		// and replica accounts must not start replicating before their name claim
+		// is confirmed
+		keppel.ErrUnavailable.With("account is still being created").WriteAsRegistryV2ResponseTo(w, r)
+		return nil, nil, nil, nil
+	}
 
 	canCreateRepoIfMissing := false
 	canFirstPull := false
@@ -292,6 +299,122 @@ func (a *API) checkAccountAccess(w http.ResponseWriter, r *http.Request, strateg
 	return account, repo, authz, challenge
 }
 
+// Forwards an anycast request for an account that we do not have to the peer
+// that has the primary account with this name. Returns false without writing
+// a response if no peer has such an account.
+func (a *API) forwardAnycastRequest(w http.ResponseWriter, r *http.Request, audience auth.Audience, repoScope auth.ParsedRepositoryScope, anycastHandler func(http.ResponseWriter, *http.Request, anycastRequestInfo)) bool {
+	primaryHostName, err := a.fd.FindPrimaryAccount(r.Context(), repoScope.AccountName)
+	switch {
+	case err == nil:
+		// protect against infinite forwarding loops in case different Keppels have
+		// different ideas about who is the primary account
+		if forwardedBy := r.URL.Query().Get("X-Keppel-Forwarded-By"); forwardedBy != "" {
+			msg := fmt.Sprintf("not forwarding anycast request for account %q to %s because request was already forwarded to us by %s",
+				repoScope.AccountName, primaryHostName, forwardedBy)
+			keppel.ErrUnknown.With(msg).WriteAsRegistryV2ResponseTo(w, r)
+		} else {
+			mappedPrimaryHostName := audience.MapPeerHostname(primaryHostName)
+			anycastHandler(w, r, anycastRequestInfo{repoScope.AccountName, repoScope.RepositoryName, mappedPrimaryHostName})
+		}
+		return true
+	case errors.Is(err, keppel.ErrNoSuchPrimaryAccount):
+		return false
+	default:
+		respondWithError(w, r, err)
+		return true
+	}
+}
+
+// Anonymous pulls of public images via anycast do not need a token exchange:
+// We cannot decide on anonymous access to an account that we do not have, so
+// instead of rejecting the request, we forward it directly to the peer that
+// has the account and let it decide. Returns false without writing a response
+// if the request was not forwarded or if the peer rejected it, in which case
+// the caller shall render the original error (including our own auth challenge).
+func (a *API) tryForwardAnonymousAnycastRequest(w http.ResponseWriter, r *http.Request, scope auth.Scope, rerr *keppel.RegistryV2Error, anycastHandler func(http.ResponseWriter, *http.Request, anycastRequestInfo)) bool {
+	// only consider requests without any credentials...
+	if rerr.Code != keppel.ErrUnauthorized || r.Header.Get("Authorization") != "" {
+		return false
+	}
+	// ...that come in on the anycast API directly (not via another peer)...
+	u := keppel.OriginalRequestURL(r)
+	audience := auth.IdentifyAudience(u.Hostname(), a.cfg)
+	if !audience.IsAnycast || r.Header.Get("X-Keppel-Forwarded-By") != "" {
+		return false
+	}
+	// ...for accounts that we do not have
+	repoScope := scope.ParseRepositoryScope(audience)
+	account, err := keppel.FindReducedAccount(r.Context(), a.db, repoScope.AccountName)
+	if err != nil || account != nil {
+		return false
+	}
+
+	// if the peer rejects the anonymous request, the client needs to be sent
+	// through the regular token exchange on the anycast API; the peer's own auth
+	// challenge would point to the peer's auth endpoint instead
+	iw := &unauthorizedInterceptingResponseWriter{inner: w, header: make(http.Header)}
+	if !a.forwardAnycastRequest(iw, r, audience, repoScope, anycastHandler) {
+		return false
+	}
+	return !iw.Intercepted
+}
+
+// unauthorizedInterceptingResponseWriter is a http.ResponseWriter that passes
+// through all responses except for those with status 401, which are discarded.
+type unauthorizedInterceptingResponseWriter struct {
+	inner       http.ResponseWriter
+	header      http.Header
+	wroteHeader bool
+	Intercepted bool
+}
+
+// Header implements the http.ResponseWriter interface.
+func (w *unauthorizedInterceptingResponseWriter) Header() http.Header {
+	return w.header
+}
+
+// WriteHeader implements the http.ResponseWriter interface.
+func (w *unauthorizedInterceptingResponseWriter) WriteHeader(statusCode int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if statusCode == http.StatusUnauthorized {
+		w.Intercepted = true
+		return
+	}
+	maps.Copy(w.inner.Header(), w.header)
+	w.inner.WriteHeader(statusCode)
+}
+
+// Write implements the http.ResponseWriter interface.
+func (w *unauthorizedInterceptingResponseWriter) Write(buf []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.Intercepted {
+		return len(buf), nil
+	}
+	return w.inner.Write(buf)
+}
+
+// Checks whether the given action may be performed on the given tag, taking
+// RBAC policies with "match_tag" into account (see auth.FilterTagActions).
+// On success, all allowed actions (including those implied by the given
+// action, like "anonymous_first_pull" for "pull") are returned. If the account
+// has no RBAC policies with "match_tag", nil is returned since tag access is
+// then equivalent to repository access, which was already checked for the token.
+func (a *API) checkTagAccess(r *http.Request, authz *auth.Authorization, account models.ReducedAccount, repo models.Repository, tagName, action string) ([]string, error) {
+	actions, err := auth.FilterTagActions(r, authz, account, repo, tagName, []string{action})
+	if err != nil {
+		return nil, err
+	}
+	if actions != nil && !slices.Contains(actions, action) {
+		return nil, keppel.ErrDenied.With("%s access to tag %q is not allowed", action, tagName).WithStatus(http.StatusForbidden)
+	}
+	return actions, nil
+}
+
 // Returns the repository name as it appears in URL paths for this API.
 func getRepoNameForURLPath(repo models.Repository, authz *auth.Authorization) string {
 	// on the regular API, the URL path includes the account name
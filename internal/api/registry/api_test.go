@@ -5,6 +5,8 @@ package registryv2_test
 
 import (
 	"net/http"
+	"net/url"
+	"strconv"
 	"testing"
 	"time"
 
@@ -144,3 +146,496 @@ func TestKeppelAPIAuth(t *testing.T) {
 		}.Check(t, h)
 	})
 }
+
+func TestReadOnlyAccount(t *testing.T) {
+	testWithPrimary(t, nil, func(s test.Setup) {
+		h := s.Handler
+		token := s.GetToken(t, "repository:test1/foo:pull,push,delete")
+
+		image := test.GenerateImage(test.GenerateExampleLayer(1))
+		image.MustUpload(t, s, fooRepoRef, "latest")
+		otherImage := test.GenerateImage(test.GenerateExampleLayer(2))
+		otherLayer := otherImage.Layers[0]
+
+		expectReadOnly := assert.JSONObject{
+			"errors": []assert.JSONObject{{
+				"code":    keppel.ErrUnavailable,
+				"message": "account is in read-only mode",
+				"detail":  nil,
+			}},
+		}
+
+		testWithAccountIsReadOnly(t, s.DB, "test1", func() {
+			// pulls still work
+			expectManifestExists(t, h, token, "test1/foo", image.Manifest, "latest", nil)
+			expectBlobExists(t, h, token, "test1/foo", image.Layers[0], nil)
+
+			// but all writes are rejected
+			assert.HTTPRequest{
+				Method: "POST",
+				Path:   "/v2/test1/foo/blobs/uploads/?digest=" + otherLayer.Digest.String(),
+				Header: map[string]string{
+					"Authorization":  "Bearer " + token,
+					"Content-Length": strconv.Itoa(len(otherLayer.Contents)),
+					"Content-Type":   "application/octet-stream",
+				},
+				Body:         assert.ByteData(otherLayer.Contents),
+				ExpectStatus: http.StatusServiceUnavailable,
+				ExpectHeader: test.VersionHeader,
+				ExpectBody:   expectReadOnly,
+			}.Check(t, h)
+			assert.HTTPRequest{
+				Method: "PUT",
+				Path:   "/v2/test1/foo/manifests/other",
+				Header: map[string]string{
+					"Authorization": "Bearer " + token,
+					"Content-Type":  image.Manifest.MediaType,
+				},
+				Body:         assert.ByteData(image.Manifest.Contents),
+				ExpectStatus: http.StatusServiceUnavailable,
+				ExpectHeader: test.VersionHeader,
+				ExpectBody:   expectReadOnly,
+			}.Check(t, h)
+			assert.HTTPRequest{
+				Method:       "DELETE",
+				Path:         "/v2/test1/foo/manifests/" + image.Manifest.Digest.String(),
+				Header:       map[string]string{"Authorization": "Bearer " + token},
+				ExpectStatus: http.StatusServiceUnavailable,
+				ExpectHeader: test.VersionHeader,
+				ExpectBody:   expectReadOnly,
+			}.Check(t, h)
+			assert.HTTPRequest{
+				Method:       "DELETE",
+				Path:         "/v2/test1/foo/blobs/" + image.Layers[0].Digest.String(),
+				Header:       map[string]string{"Authorization": "Bearer " + token},
+				ExpectStatus: http.StatusServiceUnavailable,
+				ExpectHeader: test.VersionHeader,
+				ExpectBody:   expectReadOnly,
+			}.Check(t, h)
+		})
+
+		// after leaving read-only mode, writes work again
+		assert.HTTPRequest{
+			Method:       "DELETE",
+			Path:         "/v2/test1/foo/manifests/" + image.Manifest.Digest.String(),
+			Header:       map[string]string{"Authorization": "Bearer " + token},
+			ExpectStatus: http.StatusAccepted,
+		}.Check(t, h)
+	})
+}
+
+func TestCreatingAccount(t *testing.T) {
+	testWithPrimary(t, nil, func(s test.Setup) {
+		h := s.Handler
+		token := s.GetToken(t, "repository:test1/foo:pull,push")
+		layer := test.GenerateExampleLayer(1)
+
+		expectCreating := assert.JSONObject{
+			"errors": []assert.JSONObject{{
+				"code":    keppel.ErrUnavailable,
+				"message": "account is still being created",
+				"detail":  nil,
+			}},
+		}
+
+		// while the account is still being created, it cannot be used at all
+		test.MustExec(t, s.DB, "UPDATE accounts SET is_creating = TRUE, creation_started_at = $1 WHERE name = $2", s.Clock.Now(), "test1")
+		assert.HTTPRequest{
+			Method: "POST",
+			Path:   "/v2/test1/foo/blobs/uploads/?digest=" + layer.Digest.String(),
+			Header: map[string]string{
+				"Authorization":  "Bearer " + token,
+				"Content-Length": strconv.Itoa(len(layer.Contents)),
+				"Content-Type":   "application/octet-stream",
+			},
+			Body:         assert.ByteData(layer.Contents),
+			ExpectStatus: http.StatusServiceUnavailable,
+			ExpectHeader: test.VersionHeader,
+			ExpectBody:   expectCreating,
+		}.Check(t, h)
+		assert.HTTPRequest{
+			Method:       "GET",
+			Path:         "/v2/test1/foo/blobs/" + layer.Digest.String(),
+			Header:       map[string]string{"Authorization": "Bearer " + token},
+			ExpectStatus: http.StatusServiceUnavailable,
+			ExpectHeader: test.VersionHeader,
+			ExpectBody:   expectCreating,
+		}.Check(t, h)
+
+		// once setup is complete, pushes work
+		test.MustExec(t, s.DB, "UPDATE accounts SET is_creating = FALSE, creation_started_at = NULL WHERE name = $1", "test1")
+		layer.MustUpload(t, s, fooRepoRef)
+	})
+}
+
+func TestPullAndPushToggles(t *testing.T) {
+	testWithPrimary(t, nil, func(s test.Setup) {
+		h := s.Handler
+		token := s.GetToken(t, "repository:test1/foo:pull,push")
+
+		image := test.GenerateImage(test.GenerateExampleLayer(1))
+		image.MustUpload(t, s, fooRepoRef, "latest")
+		otherLayer := test.GenerateExampleLayer(2)
+
+		expectDenied := func(message string) assert.JSONObject {
+			return assert.JSONObject{
+				"errors": []assert.JSONObject{{
+					"code":    keppel.ErrDenied,
+					"message": message,
+					"detail":  nil,
+				}},
+			}
+		}
+		pushBlob := func(expectStatus int, expectBody assert.HTTPResponseBody) {
+			t.Helper()
+			assert.HTTPRequest{
+				Method: "POST",
+				Path:   "/v2/test1/foo/blobs/uploads/?digest=" + otherLayer.Digest.String(),
+				Header: map[string]string{
+					"Authorization":  "Bearer " + token,
+					"Content-Length": strconv.Itoa(len(otherLayer.Contents)),
+					"Content-Type":   "application/octet-stream",
+				},
+				Body:         assert.ByteData(otherLayer.Contents),
+				ExpectStatus: expectStatus,
+				ExpectBody:   expectBody,
+			}.Check(t, h)
+		}
+		pushManifest := func(expectStatus int, expectBody assert.HTTPResponseBody) {
+			t.Helper()
+			assert.HTTPRequest{
+				Method: "PUT",
+				Path:   "/v2/test1/foo/manifests/other",
+				Header: map[string]string{
+					"Authorization": "Bearer " + token,
+					"Content-Type":  image.Manifest.MediaType,
+				},
+				Body:         assert.ByteData(image.Manifest.Contents),
+				ExpectStatus: expectStatus,
+				ExpectBody:   expectBody,
+			}.Check(t, h)
+		}
+
+		// with pushes disabled, pulls still work, but pushes are rejected
+		_, err := s.DB.Exec("UPDATE accounts SET is_push_disabled = TRUE WHERE name = $1", "test1")
+		test.MustDo(t, err)
+		expectManifestExists(t, h, token, "test1/foo", image.Manifest, "latest", nil)
+		expectBlobExists(t, h, token, "test1/foo", image.Layers[0], nil)
+		pushBlob(http.StatusForbidden, expectDenied("pushes into this account are disabled"))
+		pushManifest(http.StatusForbidden, expectDenied("pushes into this account are disabled"))
+		_, err = s.DB.Exec("UPDATE accounts SET is_push_disabled = FALSE WHERE name = $1", "test1")
+		test.MustDo(t, err)
+
+		// uploads that were started before pushes were disabled cannot be continued or finished
+		uploadURL := getBlobUploadURL(t, h, token, "test1/foo")
+		_, err = s.DB.Exec("UPDATE accounts SET is_push_disabled = TRUE WHERE name = $1", "test1")
+		test.MustDo(t, err)
+		assert.HTTPRequest{
+			Method: "PATCH",
+			Path:   uploadURL,
+			Header: map[string]string{
+				"Authorization": "Bearer " + token,
+				"Content-Type":  "application/octet-stream",
+			},
+			Body:         assert.ByteData(otherLayer.Contents),
+			ExpectStatus: http.StatusForbidden,
+			ExpectBody:   expectDenied("pushes into this account are disabled"),
+		}.Check(t, h)
+		assert.HTTPRequest{
+			Method:       "PUT",
+			Path:         keppel.AppendQuery(uploadURL, url.Values{"digest": {otherLayer.Digest.String()}}),
+			Header:       map[string]string{"Authorization": "Bearer " + token},
+			ExpectStatus: http.StatusForbidden,
+			ExpectBody:   expectDenied("pushes into this account are disabled"),
+		}.Check(t, h)
+		_, err = s.DB.Exec("UPDATE accounts SET is_push_disabled = FALSE WHERE name = $1", "test1")
+		test.MustDo(t, err)
+
+		// with pulls disabled, pushes still work, but pulls are rejected
+		_, err = s.DB.Exec("UPDATE accounts SET is_pull_disabled = TRUE WHERE name = $1", "test1")
+		test.MustDo(t, err)
+		pushBlob(http.StatusCreated, nil)
+		pushManifest(http.StatusCreated, nil)
+		assert.HTTPRequest{
+			Method:       "GET",
+			Path:         "/v2/test1/foo/manifests/latest",
+			Header:       map[string]string{"Authorization": "Bearer " + token},
+			ExpectStatus: http.StatusForbidden,
+			ExpectBody:   expectDenied("pulls from this account are disabled"),
+		}.Check(t, h)
+		assert.HTTPRequest{
+			Method:       "GET",
+			Path:         "/v2/test1/foo/blobs/" + image.Layers[0].Digest.String(),
+			Header:       map[string]string{"Authorization": "Bearer " + token},
+			ExpectStatus: http.StatusForbidden,
+			ExpectBody:   expectDenied("pulls from this account are disabled"),
+		}.Check(t, h)
+		_, err = s.DB.Exec("UPDATE accounts SET is_pull_disabled = FALSE WHERE name = $1", "test1")
+		test.MustDo(t, err)
+
+		// after enabling pulls again, they work again
+		expectManifestExists(t, h, token, "test1/foo", image.Manifest, "latest", nil)
+	})
+}
+
+func TestTagScopedRBACPolicies(t *testing.T) {
+	testWithPrimary(t, nil, func(s test.Setup) {
+		h := s.Handler
+		s.AD.ExpectedUserName = "correctusername"
+
+		image := test.GenerateImage(test.GenerateExampleLayer(1))
+		image.MustUpload(t, s, fooRepoRef, "latest")
+		image.MustUpload(t, s, fooRepoRef, "other")
+
+		expectDenied := func(message string) assert.JSONObject {
+			return assert.JSONObject{
+				"errors": []assert.JSONObject{{
+					"code":    keppel.ErrDenied,
+					"message": message,
+					"detail":  nil,
+				}},
+			}
+		}
+
+		// allow anonymous pull of the "latest" tag only
+		test.MustExec(t, s.DB, `UPDATE accounts SET rbac_policies_json = $2 WHERE name = $1`, "test1",
+			test.ToJSON([]keppel.RBACPolicy{{
+				RepositoryPattern: "foo",
+				TagPattern:        "latest",
+				Permissions:       []keppel.RBACPermission{keppel.RBACAnonymousPullPermission},
+			}}),
+		)
+		assert.HTTPRequest{
+			Method:       "GET",
+			Path:         "/v2/test1/foo/manifests/latest",
+			ExpectStatus: http.StatusOK,
+			ExpectBody:   assert.ByteData(image.Manifest.Contents),
+		}.Check(t, h)
+		assert.HTTPRequest{
+			Method:       "GET",
+			Path:         "/v2/test1/foo/manifests/other",
+			ExpectStatus: http.StatusForbidden,
+			ExpectBody:   expectDenied(`pull access to tag "other" is not allowed`),
+		}.Check(t, h)
+
+		// digest-addressed pulls are not subject to tag matching (otherwise the
+		// layers of the "latest" image could not be pulled)
+		assert.HTTPRequest{
+			Method:       "GET",
+			Path:         "/v2/test1/foo/manifests/" + image.Manifest.Digest.String(),
+			ExpectStatus: http.StatusOK,
+			ExpectBody:   assert.ByteData(image.Manifest.Contents),
+		}.Check(t, h)
+		assert.HTTPRequest{
+			Method:       "GET",
+			Path:         "/v2/test1/foo/blobs/" + image.Layers[0].Digest.String(),
+			ExpectStatus: http.StatusOK,
+			ExpectBody:   assert.ByteData(image.Layers[0].Contents),
+		}.Check(t, h)
+
+		// allow a user without push permission to push into "dev-*" tags only
+		test.MustExec(t, s.DB, `UPDATE accounts SET rbac_policies_json = $2 WHERE name = $1`, "test1",
+			test.ToJSON([]keppel.RBACPolicy{{
+				RepositoryPattern: "foo",
+				UserNamePattern:   "correctusername",
+				TagPattern:        "dev-.*",
+				Permissions:       []keppel.RBACPermission{keppel.RBACPullPermission, keppel.RBACPushPermission},
+			}}),
+		)
+		pushManifest := func(tagName string, expectStatus int, expectBody assert.HTTPResponseBody) {
+			t.Helper()
+			assert.HTTPRequest{
+				Method: "PUT",
+				Path:   "/v2/test1/foo/manifests/" + tagName,
+				Header: map[string]string{
+					"X-Test-Perms": "pull:" + authTenantID,
+					"Content-Type": image.Manifest.MediaType,
+				},
+				Body:         assert.ByteData(image.Manifest.Contents),
+				ExpectStatus: expectStatus,
+				ExpectBody:   expectBody,
+			}.Check(t, h)
+		}
+		pushManifest("dev-1", http.StatusCreated, nil)
+		pushManifest("latest", http.StatusForbidden, expectDenied(`push access to tag "latest" is not allowed`))
+
+		// the user can still pull other tags through their regular permissions
+		assert.HTTPRequest{
+			Method:       "GET",
+			Path:         "/v2/test1/foo/manifests/other",
+			Header:       map[string]string{"X-Test-Perms": "pull:" + authTenantID},
+			ExpectStatus: http.StatusOK,
+			ExpectBody:   assert.ByteData(image.Manifest.Contents),
+		}.Check(t, h)
+
+		// a tag-scoped restriction only applies to matching tags
+		test.MustExec(t, s.DB, `UPDATE accounts SET rbac_policies_json = $2 WHERE name = $1`, "test1",
+			test.ToJSON([]keppel.RBACPolicy{{
+				RepositoryPattern:    "foo",
+				UserNamePattern:      "correctusername",
+				TagPattern:           "release-.*",
+				ForbiddenPermissions: []keppel.RBACPermission{keppel.RBACPushPermission},
+			}}),
+		)
+		token := s.GetToken(t, "repository:test1/foo:pull,push")
+		for tagName, expectStatus := range map[string]int{"dev-2": http.StatusCreated, "release-1": http.StatusForbidden} {
+			assert.HTTPRequest{
+				Method: "PUT",
+				Path:   "/v2/test1/foo/manifests/" + tagName,
+				Header: map[string]string{
+					"Authorization": "Bearer " + token,
+					"Content-Type":  image.Manifest.MediaType,
+				},
+				Body:         assert.ByteData(image.Manifest.Contents),
+				ExpectStatus: expectStatus,
+			}.Check(t, h)
+		}
+	})
+}
+
+func TestAnonymousAnycastPull(t *testing.T) {
+	testWithPrimary(t, nil, func(s1 test.Setup) {
+		if !currentlyWithAnycast {
+			return
+		}
+		image := test.GenerateImage(test.GenerateExampleLayer(1))
+		image.MustUpload(t, s1, fooRepoRef, "latest")
+
+		testWithReplica(t, s1, "on_first_use", func(firstPass bool, s2 test.Setup) {
+			testAnycast(t, firstPass, s2.DB, func() {
+				h2 := s2.Handler
+				anycastHeaders := map[string]string{
+					"X-Forwarded-Host":  s1.Config.AnycastAPIPublicHostname,
+					"X-Forwarded-Proto": "https",
+				}
+
+				// without an anonymous pull policy, the peer rejects the forwarded request,
+				// and the client is sent through the token exchange on the anycast API
+				assert.HTTPRequest{
+					Method:       "GET",
+					Path:         "/v2/test1/foo/manifests/latest",
+					Header:       anycastHeaders,
+					ExpectStatus: http.StatusUnauthorized,
+					ExpectHeader: map[string]string{
+						test.VersionHeaderKey: test.VersionHeaderValue,
+						"Www-Authenticate":    `Bearer realm="https://registry-global.example.org/keppel/v1/auth",service="registry-global.example.org",scope="repository:test1/foo:pull"`,
+					},
+					ExpectBody: test.ErrorCode(keppel.ErrUnauthorized),
+				}.Check(t, h2)
+
+				// with an anonymous pull policy, the pull works without any token
+				test.MustExec(t, s1.DB, `UPDATE accounts SET rbac_policies_json = $2 WHERE name = $1`, "test1",
+					test.ToJSON([]keppel.RBACPolicy{{
+						RepositoryPattern: "foo",
+						Permissions:       []keppel.RBACPermission{keppel.RBACAnonymousPullPermission},
+					}}),
+				)
+				assert.HTTPRequest{
+					Method:       "GET",
+					Path:         "/v2/test1/foo/manifests/latest",
+					Header:       anycastHeaders,
+					ExpectStatus: http.StatusOK,
+					ExpectHeader: test.VersionHeader,
+					ExpectBody:   assert.ByteData(image.Manifest.Contents),
+				}.Check(t, h2)
+				assert.HTTPRequest{
+					Method:       "GET",
+					Path:         "/v2/test1/foo/blobs/" + image.Layers[0].Digest.String(),
+					Header:       anycastHeaders,
+					ExpectStatus: http.StatusOK,
+					ExpectBody:   assert.ByteData(image.Layers[0].Contents),
+				}.Check(t, h2)
+
+				// anonymous write access is still rejected by the anycast API itself
+				assert.HTTPRequest{
+					Method:       "DELETE",
+					Path:         "/v2/test1/foo/manifests/latest",
+					Header:       anycastHeaders,
+					ExpectStatus: http.StatusMethodNotAllowed,
+					ExpectBody:   test.ErrorCode(keppel.ErrUnsupported),
+				}.Check(t, h2)
+				test.MustExec(t, s1.DB, `UPDATE accounts SET rbac_policies_json = $2 WHERE name = $1`, "test1", "")
+			})
+		})
+	})
+}
+
+func TestAnycastDisabledAccount(t *testing.T) {
+	testWithPrimary(t, nil, func(s1 test.Setup) {
+		if !currentlyWithAnycast {
+			return
+		}
+		image := test.GenerateImage(test.GenerateExampleLayer(1))
+		image.MustUpload(t, s1, fooRepoRef, "latest")
+
+		testWithReplica(t, s1, "on_first_use", func(firstPass bool, s2 test.Setup) {
+			testAnycast(t, firstPass, s2.DB, func() {
+				h1 := s1.Handler
+				h2 := s2.Handler
+				// this token was issued before the account opted out of anycast
+				anycastToken := s1.GetAnycastToken(t, "repository:test1/foo:pull")
+				anycastHeaders := map[string]string{
+					"Authorization":     "Bearer " + anycastToken,
+					"X-Forwarded-Host":  s1.Config.AnycastAPIPublicHostname,
+					"X-Forwarded-Proto": "https",
+				}
+				test.MustExec(t, s1.DB, `UPDATE accounts SET is_anycast_disabled = TRUE WHERE name = $1`, "test1")
+
+				// anycast requests are refused both by the peer holding the account and
+				// by peers that would otherwise forward the request to it
+				for _, h := range []http.Handler{h1, h2} {
+					for _, path := range []string{
+						"/v2/test1/foo/manifests/latest",
+						"/v2/test1/foo/blobs/" + image.Layers[0].Digest.String(),
+						"/v2/test1/foo/tags/list",
+					} {
+						assert.HTTPRequest{
+							Method:       "GET",
+							Path:         path,
+							Header:       anycastHeaders,
+							ExpectStatus: http.StatusNotFound,
+							ExpectHeader: test.VersionHeader,
+							ExpectBody:   test.ErrorCode(keppel.ErrNameUnknown),
+						}.Check(t, h)
+					}
+				}
+
+				// anonymous anycast requests are forwarded to the peer holding the
+				// account without a token, but are refused there as well
+				test.MustExec(t, s1.DB, `UPDATE accounts SET rbac_policies_json = $2 WHERE name = $1`, "test1",
+					test.ToJSON([]keppel.RBACPolicy{{
+						RepositoryPattern: "foo",
+						Permissions:       []keppel.RBACPermission{keppel.RBACAnonymousPullPermission},
+					}}),
+				)
+				for _, path := range []string{
+					"/v2/test1/foo/manifests/latest",
+					"/v2/test1/foo/blobs/" + image.Layers[0].Digest.String(),
+				} {
+					assert.HTTPRequest{
+						Method: "GET",
+						Path:   path,
+						Header: map[string]string{
+							"X-Forwarded-Host":  s1.Config.AnycastAPIPublicHostname,
+							"X-Forwarded-Proto": "https",
+						},
+						ExpectStatus: http.StatusNotFound,
+						ExpectHeader: test.VersionHeader,
+						ExpectBody:   test.ErrorCode(keppel.ErrNameUnknown),
+					}.Check(t, h2)
+				}
+				test.MustExec(t, s1.DB, `UPDATE accounts SET rbac_policies_json = $2 WHERE name = $1`, "test1", "")
+
+				// local access is not affected
+				expectManifestExists(t, h1, s1.GetToken(t, "repository:test1/foo:pull"), "test1/foo", image.Manifest, "latest", nil)
+
+				// after opting back in, anycast access works again
+				test.MustExec(t, s1.DB, `UPDATE accounts SET is_anycast_disabled = FALSE WHERE name = $1`, "test1")
+				expectManifestExists(t, h2, anycastToken, "test1/foo", image.Manifest, "latest", map[string]string{
+					"X-Forwarded-Host":  s1.Config.AnycastAPIPublicHostname,
+					"X-Forwarded-Proto": "https",
+				})
+			})
+		})
+	})
+}
@@ -39,6 +39,15 @@ func (a *API) handleGetOrHeadBlob(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// the security scanner is exempt from disabled pulls, to keep vulnerability reports current,
+	// and so are peers, to keep replica accounts on other Keppel instances consistent
+	if userType := authz.UserIdentity.UserType(); userType != keppel.TrivyUser && userType != keppel.PeerUser {
+		err = api.CheckAccountPullEnabled(*account)
+		if respondWithError(w, r, err) {
+			return
+		}
+	}
+
 	blobDigest, err := digest.Parse(mux.Vars(r)["digest"])
 	if err != nil {
 		keppel.ErrDigestInvalid.With(err.Error()).WriteAsRegistryV2ResponseTo(w, r)
@@ -66,13 +75,17 @@ func (a *API) handleGetOrHeadBlob(w http.ResponseWriter, r *http.Request) {
 		// ...answer HEAD requests with the metadata that we obtained when replicating the manifest...
 		if r.Method == http.MethodHead {
 			w.Header().Set("Content-Length", strconv.FormatUint(blob.SizeBytes, 10))
-			w.Header().Set("Content-Type", blob.SafeMediaType())
+			w.Header().Set("Content-Type", a.cfg.BlobMediaType(*blob))
 			w.Header().Set("Docker-Content-Digest", blob.Digest.String())
 			w.WriteHeader(http.StatusOK)
 			return
 		}
 
 		// ...and answer GET requests by replicating the blob contents
+		err = api.CheckAccountWritable(a.cfg, *account, true)
+		if respondWithError(w, r, err) {
+			return
+		}
 		responseWasWritten, err := a.processor().ReplicateBlob(r.Context(), *blob, *account, *repo, w)
 
 		if err != nil {
@@ -93,6 +106,9 @@ func (a *API) handleGetOrHeadBlob(w http.ResponseWriter, r *http.Request) {
 			}
 		} else if !responseWasWritten {
 			respondWithError(w, r, errors.New("blob replication yielded neither blob contents nor an error"))
+		} else {
+			// only successful replications count as served misses
+			api.CountReplicaPull(*account, "blob", true)
 		}
 
 		return
@@ -121,6 +137,7 @@ func (a *API) handleGetOrHeadBlob(w http.ResponseWriter, r *http.Request) {
 		}
 		api.BlobsPulledCounter.With(l).Inc()
 		api.BlobBytesPulledCounter.With(l).Add(float64(blob.SizeBytes))
+		api.CountReplicaPull(*account, "blob", false)
 	}
 
 	// prefer redirecting the client to a storage URL if the storage driver can give us one
@@ -151,7 +168,7 @@ func (a *API) handleGetOrHeadBlob(w http.ResponseWriter, r *http.Request) {
 	}
 	defer reader.Close()
 	w.Header().Set("Content-Length", strconv.FormatUint(lengthBytes, 10))
-	w.Header().Set("Content-Type", blob.SafeMediaType())
+	w.Header().Set("Content-Type", a.cfg.BlobMediaType(*blob))
 	w.Header().Set("Docker-Content-Digest", blob.Digest.String())
 	w.WriteHeader(http.StatusOK)
 	if r.Method != http.MethodHead {
@@ -181,6 +198,10 @@ func (a *API) handleDeleteBlob(w http.ResponseWriter, r *http.Request) {
 	if account == nil {
 		return
 	}
+	err := api.CheckAccountWritable(a.cfg, *account, false)
+	if respondWithError(w, r, err) {
+		return
+	}
 
 	blobDigest, err := digest.Parse(mux.Vars(r)["digest"])
 	if err != nil {
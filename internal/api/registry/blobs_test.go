@@ -11,6 +11,7 @@ import (
 	"strconv"
 	"testing"
 
+	"github.com/opencontainers/go-digest"
 	"github.com/sapcc/go-bits/assert"
 
 	"github.com/sapcc/keppel/internal/keppel"
@@ -919,3 +920,253 @@ func TestCrossRepositoryBlobMount(t *testing.T) {
 		expectBlobExists(t, h, otherRepoToken, "test1/bar", blob, nil)
 	})
 }
+
+func TestBlobUploadWithSHA512(t *testing.T) {
+	blob := test.NewBytes([]byte("just some random data"))
+	blob.Digest = digest.SHA512.FromBytes(blob.Contents)
+
+	// by default, only SHA-256 digests are accepted
+	testWithPrimary(t, nil, func(s test.Setup) {
+		h := s.Handler
+		token := s.GetToken(t, "repository:test1/foo:pull,push")
+
+		assert.HTTPRequest{
+			Method: "POST",
+			Path:   "/v2/test1/foo/blobs/uploads/?digest=" + blob.Digest.String(),
+			Header: map[string]string{
+				"Authorization":  "Bearer " + token,
+				"Content-Length": strconv.Itoa(len(blob.Contents)),
+				"Content-Type":   "application/octet-stream",
+			},
+			Body:         assert.ByteData(blob.Contents),
+			ExpectStatus: http.StatusBadRequest,
+			ExpectHeader: test.VersionHeader,
+			ExpectBody: test.ErrorCodeWithMessage{
+				Code:    keppel.ErrDigestInvalid,
+				Message: `digest algorithm "sha512" is not accepted by this registry`,
+			},
+		}.Check(t, h)
+		assert.HTTPRequest{
+			Method:       "PUT",
+			Path:         keppel.AppendQuery(getBlobUploadURL(t, h, token, "test1/foo"), url.Values{"digest": {blob.Digest.String()}}),
+			Header:       map[string]string{"Authorization": "Bearer " + token, "Content-Length": strconv.Itoa(len(blob.Contents))},
+			Body:         assert.ByteData(blob.Contents),
+			ExpectStatus: http.StatusBadRequest,
+			ExpectHeader: test.VersionHeader,
+			ExpectBody:   test.ErrorCode(keppel.ErrDigestInvalid),
+		}.Check(t, h)
+
+		blobCount, err := s.DB.SelectInt(`SELECT COUNT(*) FROM blobs`)
+		test.MustDo(t, err)
+		assert.DeepEqual(t, "blob count", blobCount, int64(0))
+	})
+
+	// when SHA-512 is allowed, blobs can be pushed with SHA-512 digests both monolithically and in chunks
+	opts := []test.SetupOption{test.WithDigestAlgorithms(digest.SHA256, digest.SHA512)}
+	testWithPrimary(t, opts, func(s test.Setup) {
+		h := s.Handler
+		token := s.GetToken(t, "repository:test1/foo:pull,push", "repository:test1/bar:pull,push")
+
+		assert.HTTPRequest{
+			Method: "POST",
+			Path:   "/v2/test1/foo/blobs/uploads/?digest=" + blob.Digest.String(),
+			Header: map[string]string{
+				"Authorization":  "Bearer " + token,
+				"Content-Length": strconv.Itoa(len(blob.Contents)),
+				"Content-Type":   "application/octet-stream",
+			},
+			Body:         assert.ByteData(blob.Contents),
+			ExpectStatus: http.StatusCreated,
+			ExpectHeader: map[string]string{
+				test.VersionHeaderKey: test.VersionHeaderValue,
+				"Location":            "/v2/test1/foo/blobs/" + blob.Digest.String(),
+			},
+		}.Check(t, h)
+		expectBlobExists(t, h, token, "test1/foo", blob, nil)
+
+		resp, _ := assert.HTTPRequest{
+			Method: "PATCH",
+			Path:   getBlobUploadURL(t, h, token, "test1/bar"),
+			Header: map[string]string{
+				"Authorization":  "Bearer " + token,
+				"Content-Type":   "application/octet-stream",
+				"Content-Range":  fmt.Sprintf("0-%d", len(blob.Contents)-1),
+				"Content-Length": strconv.Itoa(len(blob.Contents)),
+			},
+			Body:         assert.ByteData(blob.Contents),
+			ExpectStatus: http.StatusAccepted,
+		}.Check(t, h)
+		uploadURL := resp.Header.Get("Location")
+
+		// the digest is verified after the upload was finalized
+		assert.HTTPRequest{
+			Method:       "PUT",
+			Path:         keppel.AppendQuery(uploadURL, url.Values{"digest": {digest.SHA512.FromString("something else").String()}}),
+			Header:       map[string]string{"Authorization": "Bearer " + token},
+			ExpectStatus: http.StatusBadRequest,
+			ExpectHeader: test.VersionHeader,
+			ExpectBody:   test.ErrorCode(keppel.ErrDigestInvalid),
+		}.Check(t, h)
+
+		resp, _ = assert.HTTPRequest{
+			Method: "PATCH",
+			Path:   getBlobUploadURL(t, h, token, "test1/bar"),
+			Header: map[string]string{
+				"Authorization":  "Bearer " + token,
+				"Content-Type":   "application/octet-stream",
+				"Content-Range":  fmt.Sprintf("0-%d", len(blob.Contents)-1),
+				"Content-Length": strconv.Itoa(len(blob.Contents)),
+			},
+			Body:         assert.ByteData(blob.Contents),
+			ExpectStatus: http.StatusAccepted,
+		}.Check(t, h)
+		uploadURL = resp.Header.Get("Location")
+		assert.HTTPRequest{
+			Method:       "PUT",
+			Path:         keppel.AppendQuery(uploadURL, url.Values{"digest": {blob.Digest.String()}}),
+			Header:       map[string]string{"Authorization": "Bearer " + token},
+			ExpectStatus: http.StatusCreated,
+			ExpectHeader: map[string]string{
+				test.VersionHeaderKey:   test.VersionHeaderValue,
+				"Docker-Content-Digest": blob.Digest.String(),
+			},
+		}.Check(t, h)
+		expectBlobExists(t, h, token, "test1/bar", blob, nil)
+	})
+}
+
+func TestBlobUploadWithValidateOnPush(t *testing.T) {
+	testWithPrimary(t, nil, func(s test.Setup) {
+		h := s.Handler
+		token := s.GetToken(t, "repository:test1/foo:pull,push")
+
+		blob := test.NewBytes([]byte("just some random data"))
+		corruptedContents := bytes.Clone(blob.Contents)
+		corruptedContents[len(corruptedContents)-1] ^= 0xFF
+		expectedMessage := fmt.Sprintf("validation of pushed blob failed: expected digest %s, but got %s",
+			blob.Digest, digest.FromBytes(corruptedContents))
+
+		// simulate a storage backend that silently corrupts data: since the upload
+		// protocol only checks the digest of the data that was sent, this is only
+		// noticed if the account has validation on push enabled
+		test.MustExec(t, s.DB, `UPDATE accounts SET validate_on_push = TRUE WHERE name = $1`, "test1")
+		s.SD.CorruptBlobs = true
+
+		// monolithic upload is rejected and rolled back
+		assert.HTTPRequest{
+			Method: "POST",
+			Path:   "/v2/test1/foo/blobs/uploads/?digest=" + blob.Digest.String(),
+			Header: map[string]string{
+				"Authorization":  "Bearer " + token,
+				"Content-Length": strconv.Itoa(len(blob.Contents)),
+				"Content-Type":   "application/octet-stream",
+			},
+			Body:         assert.ByteData(blob.Contents),
+			ExpectStatus: http.StatusBadRequest,
+			ExpectHeader: test.VersionHeader,
+			ExpectBody:   test.ErrorCodeWithMessage{Code: keppel.ErrDigestInvalid, Message: expectedMessage},
+		}.Check(t, h)
+		expectStorageEmpty(t, s.SD, s.DB)
+
+		// chunked upload is rejected and rolled back
+		assert.HTTPRequest{
+			Method: "PUT",
+			Path:   keppel.AppendQuery(getBlobUploadURL(t, h, token, "test1/foo"), url.Values{"digest": {blob.Digest.String()}}),
+			Header: map[string]string{
+				"Authorization":  "Bearer " + token,
+				"Content-Length": strconv.Itoa(len(blob.Contents)),
+				"Content-Type":   "application/octet-stream",
+			},
+			Body:         assert.ByteData(blob.Contents),
+			ExpectStatus: http.StatusBadRequest,
+			ExpectHeader: test.VersionHeader,
+			ExpectBody:   test.ErrorCodeWithMessage{Code: keppel.ErrDigestInvalid, Message: expectedMessage},
+		}.Check(t, h)
+		expectStorageEmpty(t, s.SD, s.DB)
+
+		// without corruption, the push goes through
+		s.SD.CorruptBlobs = false
+		assert.HTTPRequest{
+			Method: "POST",
+			Path:   "/v2/test1/foo/blobs/uploads/?digest=" + blob.Digest.String(),
+			Header: map[string]string{
+				"Authorization":  "Bearer " + token,
+				"Content-Length": strconv.Itoa(len(blob.Contents)),
+				"Content-Type":   "application/octet-stream",
+			},
+			Body:         assert.ByteData(blob.Contents),
+			ExpectStatus: http.StatusCreated,
+			ExpectHeader: test.VersionHeader,
+		}.Check(t, h)
+		expectBlobExists(t, h, token, "test1/foo", blob, nil)
+
+		// when validation on push is disabled, corruption goes unnoticed until the blob is validated later
+		test.MustExec(t, s.DB, `UPDATE accounts SET validate_on_push = FALSE WHERE name = $1`, "test1")
+		s.SD.CorruptBlobs = true
+		otherBlob := test.NewBytes([]byte("some other random data"))
+		assert.HTTPRequest{
+			Method: "POST",
+			Path:   "/v2/test1/foo/blobs/uploads/?digest=" + otherBlob.Digest.String(),
+			Header: map[string]string{
+				"Authorization":  "Bearer " + token,
+				"Content-Length": strconv.Itoa(len(otherBlob.Contents)),
+				"Content-Type":   "application/octet-stream",
+			},
+			Body:         assert.ByteData(otherBlob.Contents),
+			ExpectStatus: http.StatusCreated,
+			ExpectHeader: test.VersionHeader,
+		}.Check(t, h)
+	})
+}
+
+func TestBlobDefaultMediaType(t *testing.T) {
+	layer := test.GenerateExampleLayer(1)
+	image := test.GenerateImage(layer)
+	strayBlob := test.NewBytes([]byte("just some random data"))
+
+	for _, defaultMediaType := range []string{"", "application/vnd.oci.image.layer.v1.tar"} {
+		var opts []test.SetupOption
+		expectedMediaType := models.DefaultBlobMediaType
+		if defaultMediaType != "" {
+			opts = append(opts, test.WithDefaultBlobMediaType(defaultMediaType))
+			expectedMediaType = defaultMediaType
+		}
+
+		testWithPrimary(t, opts, func(s test.Setup) {
+			h := s.Handler
+			token := s.GetToken(t, "repository:test1/foo:pull")
+
+			// a blob that was uploaded directly and never referenced by a manifest
+			// is reported with the configured default media type
+			strayBlob.MustUpload(t, s, fooRepoRef)
+			for _, method := range []string{"GET", "HEAD"} {
+				assert.HTTPRequest{
+					Method:       method,
+					Path:         "/v2/test1/foo/blobs/" + strayBlob.Digest.String(),
+					Header:       map[string]string{"Authorization": "Bearer " + token},
+					ExpectStatus: http.StatusOK,
+					ExpectHeader: map[string]string{
+						test.VersionHeaderKey: test.VersionHeaderValue,
+						"Content-Type":        expectedMediaType,
+					},
+				}.Check(t, h)
+			}
+
+			// a blob whose media type is known from a manifest is reported with
+			// that media type regardless of the configured default
+			image.MustUpload(t, s, fooRepoRef, "latest")
+			for _, method := range []string{"GET", "HEAD"} {
+				assert.HTTPRequest{
+					Method:       method,
+					Path:         "/v2/test1/foo/blobs/" + layer.Digest.String(),
+					Header:       map[string]string{"Authorization": "Bearer " + token},
+					ExpectStatus: http.StatusOK,
+					ExpectHeader: map[string]string{
+						test.VersionHeaderKey: test.VersionHeaderValue,
+						"Content-Type":        layer.MediaType,
+					},
+				}.Check(t, h)
+			}
+		})
+	}
+}
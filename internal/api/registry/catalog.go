@@ -5,19 +5,24 @@ package registryv2
 
 import (
 	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
-	"slices"
-	"sort"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/lib/pq"
 	"github.com/sapcc/go-bits/httpapi"
 	"github.com/sapcc/go-bits/respondwith"
 	"github.com/sapcc/go-bits/sqlext"
 
+	"github.com/sapcc/keppel/internal/api"
 	"github.com/sapcc/keppel/internal/auth"
+	"github.com/sapcc/keppel/internal/keppel"
 	"github.com/sapcc/keppel/internal/models"
 )
 
@@ -52,10 +57,6 @@ func (a *API) handleGetCatalog(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, `invalid value for "n": `+err.Error(), http.StatusBadRequest)
 			return
 		}
-		if limit == 0 {
-			http.Error(w, `invalid value for "n": must not be 0`, http.StatusBadRequest)
-			return
-		}
 	} else {
 		limit = maxLimit
 	}
@@ -67,88 +68,205 @@ func (a *API) handleGetCatalog(w http.ResponseWriter, r *http.Request) {
 	// names for the result list
 	includeAccountName := authz.Audience.AccountName == ""
 
-	// parse query: marker (parameter "last")
+	// parse query: marker (parameter "last" or "cursor")
+	if query.Has("last") && query.Has("cursor") {
+		http.Error(w, `parameters "last" and "cursor" cannot be given at the same time`, http.StatusBadRequest)
+		return
+	}
 	marker := query.Get("last")
-	markerAccountName := models.AccountName("")
+	var cursor *catalogCursor
+	if query.Has("cursor") {
+		cursor, err = a.parseCatalogCursor(query.Get("cursor"))
+		if errors.Is(err, errMalformedCatalogCursor) {
+			http.Error(w, `invalid value for "cursor": `+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if respondWithError(w, r, err) {
+			return
+		}
+		marker = cursor.LastName
+	}
+	var (
+		markerAccountName models.AccountName
+		markerRepoName    string
+	)
 	if marker != "" {
 		if includeAccountName {
-			fields := strings.SplitN(marker, "/", 2)
-			if len(fields) != 2 {
+			accountName, repoName, ok := strings.Cut(marker, "/")
+			if !ok {
 				http.Error(w, `invalid value for "last": must contain a slash`, http.StatusBadRequest)
 				return
 			}
-			markerAccountName = models.AccountName(fields[0])
+			markerAccountName, markerRepoName = models.AccountName(accountName), repoName
 		} else {
-			markerAccountName = authz.Audience.AccountName
+			markerAccountName, markerRepoName = authz.Audience.AccountName, marker
 		}
 	}
 
+	// as a special case, n=0 yields an empty page (there is no next page since
+	// it would have to be requested with n=0 again)
+	if limit == 0 {
+		respondwith.JSON(w, http.StatusOK, map[string]any{
+			"repositories": []string{},
+		})
+		return
+	}
+
 	// find accessible accounts
 	accountNames := authz.ScopeSet.AccountsWithCatalogAccess(markerAccountName)
-	slices.Sort(accountNames)
 
-	// collect repository names from backend
-	var allNames []string
-	partialResult := false
-	for idx, accountName := range accountNames {
-		names, err := a.getCatalogForAccount(accountName, includeAccountName)
-		if respondWithError(w, r, err) {
-			return
-		}
-
-		// when paginating, we might start in the middle of the first account's repo list
-		if idx == 0 && marker != "" {
-			filteredNames := make([]string, 0, len(names))
-			for _, name := range names {
-				if marker < name {
-					filteredNames = append(filteredNames, name)
-				}
-			}
-			names = filteredNames
-		}
-		sort.Strings(names)
-		allNames = append(allNames, names...)
+	// collect repository names from backend (we ask for one more row than
+	// necessary to find out whether there is a next page)
+	startedAt := time.Now()
+	repos, err := a.getCatalogPage(accountNames, markerAccountName, markerRepoName, cursor, limit+1)
+	if respondWithError(w, r, err) {
+		return
+	}
+	accountsScanned := make(map[models.AccountName]bool)
+	for _, repo := range repos {
+		accountsScanned[repo.AccountName] = true
+	}
+	reposCollected := len(repos)
 
-		// stop asking further accounts for repos once we overflow the current page
-		if uint64(len(allNames)) > limit {
-			allNames = allNames[0:limit]
-			partialResult = true
+	partialResult := uint64(len(repos)) > limit
+	if partialResult {
+		repos = repos[0:limit]
+	}
+	allNames := make([]string, len(repos))
+	for idx, repo := range repos {
+		if includeAccountName {
+			allNames[idx] = fmt.Sprintf("%s/%s", repo.AccountName, repo.Name)
+		} else {
+			allNames[idx] = repo.Name
 		}
 	}
 
+	// record the cost of this request (without any per-account labels, to keep
+	// the cardinality of these metrics bounded)
+	api.CatalogAccountsScannedHistogram.Observe(float64(len(accountsScanned)))
+	api.CatalogReposCollectedHistogram.Observe(float64(reposCollected))
+	api.CatalogDurationHistogram.Observe(time.Since(startedAt).Seconds())
+
 	// write response
 	if partialResult {
 		linkQuery := url.Values{}
 		linkQuery.Set("n", strconv.FormatUint(limit, 10))
-		linkQuery.Set("last", allNames[len(allNames)-1])
+		if cursor == nil {
+			linkQuery.Set("last", allNames[len(allNames)-1])
+		} else {
+			cursor.LastName = allNames[len(allNames)-1]
+			linkQuery.Set("cursor", cursor.Serialize())
+		}
 		linkURL := url.URL{Path: "/v2/_catalog", RawQuery: linkQuery.Encode()}
 		w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, linkURL.String()))
 	}
-	if len(allNames) == 0 {
-		allNames = []string{}
-	}
 	respondwith.JSON(w, http.StatusOK, map[string]any{
 		"repositories": allNames,
 	})
 }
 
-const catalogGetQuery = `SELECT name FROM repos WHERE account_name = $1 ORDER BY name`
+type catalogEntry struct {
+	AccountName models.AccountName
+	Name        string
+}
+
+// getCatalogPage returns up to `limit` repos from the given accounts that sort
+// after the given marker, ordered by account name and then by repo name.
+//
+// NOTE: The order is defined on (account_name, name) instead of the full repo
+// names including the account name. The latter would be wrong when account
+// names are prefixes of each other: "test-1/foo" < "test/foo" because '-' < '/'.
+// Also, we use the "C" collation to get the same byte-wise order that Go uses
+// for strings (e.g. in ScopeSet.AccountsWithCatalogAccess()), regardless of
+// the database's default collation. The index "repos_catalog_order_idx"
+// matches this ordering.
+func (a *API) getCatalogPage(accountNames []models.AccountName, markerAccountName models.AccountName, markerRepoName string, cursor *catalogCursor, limit uint64) ([]catalogEntry, error) {
+	if len(accountNames) == 0 {
+		return nil, nil
+	}
+
+	accountNameStrs := make([]string, len(accountNames))
+	for idx, accountName := range accountNames {
+		accountNameStrs[idx] = string(accountName)
+	}
+	bindValues := []any{pq.Array(accountNameStrs)}
+	conditions := []string{"account_name = ANY($1)"}
+
+	// when paginating, we might start in the middle of the marker account's
+	// repo list (the marker account may not be in the list at all if it was
+	// deleted or is not accessible, but then all listed accounts sort after it)
+	if markerAccountName != "" {
+		bindValues = append(bindValues, markerAccountName, markerRepoName)
+		conditions = append(conditions, fmt.Sprintf(
+			`(account_name COLLATE "C" > $%[1]d OR (account_name = $%[1]d AND name COLLATE "C" > $%[2]d))`,
+			len(bindValues)-1, len(bindValues),
+		))
+	}
+	if cursor != nil {
+		bindValues = append(bindValues, cursor.MaxRepoID)
+		conditions = append(conditions, fmt.Sprintf("id <= $%d", len(bindValues)))
+	}
+
+	bindValues = append(bindValues, limit)
+	query := fmt.Sprintf(
+		`SELECT account_name, name FROM repos WHERE %s ORDER BY account_name COLLATE "C", name COLLATE "C" LIMIT $%d`,
+		strings.Join(conditions, " AND "), len(bindValues),
+	)
 
-func (a *API) getCatalogForAccount(accountName models.AccountName, includeAccountName bool) ([]string, error) {
-	var result []string
-	err := sqlext.ForeachRow(a.db, catalogGetQuery, []any{accountName},
+	var result []catalogEntry
+	startedAt := time.Now()
+	err := sqlext.ForeachRow(a.db.ReadReplica(), query, bindValues,
 		func(rows *sql.Rows) error {
-			var name string
-			err := rows.Scan(&name)
-			if err == nil {
-				if includeAccountName {
-					result = append(result, fmt.Sprintf("%s/%s", accountName, name))
-				} else {
-					result = append(result, name)
-				}
-			}
+			var entry catalogEntry
+			err := rows.Scan(&entry.AccountName, &entry.Name)
+			result = append(result, entry)
 			return err
 		},
 	)
+	keppel.ObserveQueryDuration("catalog_get_page", startedAt)
 	return result, err
 }
+
+// catalogCursor is the decoded form of the "cursor" parameter of `GET /v2/_catalog`.
+//
+// In addition to the last repository name that was shown (like the "last"
+// parameter), it remembers the highest repository ID that existed when the
+// client started paginating. Since repository IDs are assigned in ascending
+// order, this hides all repositories that were created after the first page was
+// generated, so that the client gets a consistent snapshot of the catalog.
+type catalogCursor struct {
+	LastName  string `json:"l,omitempty"`
+	MaxRepoID int64  `json:"r"`
+}
+
+var errMalformedCatalogCursor = errors.New("malformed cursor")
+
+const catalogMaxRepoIDQuery = `SELECT COALESCE(MAX(id), 0) FROM repos`
+
+// An empty cursor starts a new pagination at the current snapshot point.
+func (a *API) parseCatalogCursor(input string) (*catalogCursor, error) {
+	if input == "" {
+		var cursor catalogCursor
+		startedAt := time.Now()
+		err := a.db.ReadReplica().QueryRow(catalogMaxRepoIDQuery).Scan(&cursor.MaxRepoID)
+		keppel.ObserveQueryDuration("catalog_get_max_repo_id", startedAt)
+		return &cursor, err
+	}
+
+	buf, err := base64.RawURLEncoding.DecodeString(input)
+	if err != nil {
+		return nil, errMalformedCatalogCursor
+	}
+	var cursor catalogCursor
+	err = json.Unmarshal(buf, &cursor)
+	if err != nil || cursor.MaxRepoID < 0 {
+		return nil, errMalformedCatalogCursor
+	}
+	return &cursor, nil
+}
+
+// Serialize returns the opaque string representation of this cursor.
+func (c catalogCursor) Serialize() string {
+	buf, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
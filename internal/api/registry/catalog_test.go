@@ -6,11 +6,17 @@ package registryv2_test
 import (
 	"fmt"
 	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
 	"strings"
 	"testing"
 
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/sapcc/go-bits/assert"
 
+	"github.com/sapcc/keppel/internal/api"
 	"github.com/sapcc/keppel/internal/keppel"
 	"github.com/sapcc/keppel/internal/models"
 	"github.com/sapcc/keppel/internal/test"
@@ -35,6 +41,10 @@ func TestCatalogEndpoint(t *testing.T) {
 	// testcases
 	testEmptyCatalog(t, s)
 	testNonEmptyCatalog(t, s)
+	testCatalogWithSnapshotCursor(t, s)
+	testCatalogPaginationEdgeCases(t, s)
+	testCatalogPaginationMatchesReference(t, s)
+	testCatalogMetrics(t, s)
 	testDomainRemappedCatalog(t, s)
 	testAuthErrorsForCatalog(t, s)
 	testNoCatalogOnAnycast(t, s)
@@ -140,22 +150,326 @@ func testNonEmptyCatalog(t *testing.T, s test.Setup) {
 	}.Check(t, h)
 	assert.HTTPRequest{
 		Method:       "GET",
-		Path:         "/v2/_catalog?n=0",
+		Path:         "/v2/_catalog?n=10&last=invalid",
 		Header:       map[string]string{"Authorization": "Bearer " + token},
 		ExpectStatus: http.StatusBadRequest,
 		ExpectHeader: test.VersionHeader,
-		ExpectBody:   assert.StringData("invalid value for \"n\": must not be 0\n"),
+		ExpectBody:   assert.StringData("invalid value for \"last\": must contain a slash\n"),
 	}.Check(t, h)
+}
+
+func testCatalogWithSnapshotCursor(t *testing.T, s test.Setup) {
+	h := s.Handler
+	token := s.GetToken(t,
+		"registry:catalog:*",
+		"keppel_account:test1:view",
+		"keppel_account:test2:view",
+		"keppel_account:test3:view",
+	)
+
+	getPage := func(path string, expectedRepos []string) (nextPath string) {
+		t.Helper()
+		resp, _ := assert.HTTPRequest{
+			Method:       "GET",
+			Path:         path,
+			Header:       map[string]string{"Authorization": "Bearer " + token},
+			ExpectStatus: http.StatusOK,
+			ExpectHeader: test.VersionHeader,
+			ExpectBody:   assert.JSONObject{"repositories": expectedRepos},
+		}.Check(t, h)
+		link := resp.Header.Get("Link")
+		if link == "" {
+			return ""
+		}
+		match := linkHeaderRx.FindStringSubmatch(link)
+		if match == nil {
+			t.Fatalf("malformed Link header: %q", link)
+		}
+		return match[1]
+	}
+
+	// start a paginated listing with a snapshot cursor
+	nextPath := getPage("/v2/_catalog?n=4&cursor=", []string{"test1/bar", "test1/foo", "test1/qux", "test2/bar"})
+	if !strings.Contains(nextPath, "cursor=") || strings.Contains(nextPath, "last=") {
+		t.Errorf("expected Link header to continue with a cursor, but got %q", nextPath)
+	}
+
+	// simulate other clients creating repos in the middle of the pagination
+	// (both before and after the position where the pagination currently is)
+	for _, repo := range []models.Repository{
+		{Name: "aaa", AccountName: "test1"},
+		{Name: "baz", AccountName: "test2"},
+		{Name: "zzz", AccountName: "test3"},
+	} {
+		test.MustInsert(t, s.DB, &repo)
+	}
+
+	// the remaining pages follow the original snapshot, so the new repos do not show up
+	nextPath = getPage(nextPath, []string{"test2/foo", "test2/qux", "test3/bar", "test3/foo"})
+	nextPath = getPage(nextPath, []string{"test3/qux"})
+	assert.DeepEqual(t, "Link header on last page", nextPath, "")
+
+	// by contrast, the spec-standard "last" marker includes new repos that sort after the marker...
+	getPage("/v2/_catalog?n=4&last=test2/bar", []string{"test2/baz", "test2/foo", "test2/qux", "test3/bar"})
+	// ...and a new cursor-based pagination starts from a new snapshot
+	getPage("/v2/_catalog?n=20&cursor=", []string{
+		"test1/aaa", "test1/bar", "test1/foo", "test1/qux",
+		"test2/bar", "test2/baz", "test2/foo", "test2/qux",
+		"test3/bar", "test3/foo", "test3/qux", "test3/zzz",
+	})
+
+	// test error cases for the cursor parameter
 	assert.HTTPRequest{
 		Method:       "GET",
-		Path:         "/v2/_catalog?n=10&last=invalid",
+		Path:         "/v2/_catalog?n=10&cursor=invalid",
 		Header:       map[string]string{"Authorization": "Bearer " + token},
 		ExpectStatus: http.StatusBadRequest,
 		ExpectHeader: test.VersionHeader,
-		ExpectBody:   assert.StringData("invalid value for \"last\": must contain a slash\n"),
+		ExpectBody:   assert.StringData("invalid value for \"cursor\": malformed cursor\n"),
 	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/v2/_catalog?n=10&cursor=&last=test1/foo",
+		Header:       map[string]string{"Authorization": "Bearer " + token},
+		ExpectStatus: http.StatusBadRequest,
+		ExpectHeader: test.VersionHeader,
+		ExpectBody:   assert.StringData("parameters \"last\" and \"cursor\" cannot be given at the same time\n"),
+	}.Check(t, h)
+
+	// cleanup for the following testcases
+	test.MustExec(t, s.DB, `DELETE FROM repos WHERE name IN ('aaa', 'baz', 'zzz')`)
 }
 
+func testCatalogPaginationEdgeCases(t *testing.T, s test.Setup) {
+	h := s.Handler
+	token := s.GetToken(t,
+		"registry:catalog:*",
+		"keppel_account:test1:view",
+		"keppel_account:test2:view",
+		"keppel_account:test3:view",
+	)
+
+	expectPage := func(query string, expectedRepos []string, expectedLink string) {
+		t.Helper()
+		expectedHeaders := map[string]string{test.VersionHeaderKey: test.VersionHeaderValue}
+		if expectedLink != "" {
+			expectedHeaders["Link"] = fmt.Sprintf(`<%s>; rel="next"`, expectedLink)
+		}
+		resp, _ := assert.HTTPRequest{
+			Method:       "GET",
+			Path:         "/v2/_catalog?" + query,
+			Header:       map[string]string{"Authorization": "Bearer " + token},
+			ExpectStatus: http.StatusOK,
+			ExpectHeader: expectedHeaders,
+			ExpectBody:   assert.JSONObject{"repositories": expectedRepos},
+		}.Check(t, h)
+		if expectedLink == "" && resp.Header.Get("Link") != "" {
+			t.Errorf("expected no Link header for %q, but got %q", query, resp.Header.Get("Link"))
+		}
+	}
+
+	// n=0 yields an empty page without a Link header (with or without marker)
+	expectPage("n=0", []string{}, "")
+	expectPage("n=0&last=test1/foo", []string{}, "")
+
+	// a page that ends exactly at an account boundary has a Link header
+	// only if further repos exist...
+	expectPage("n=3", []string{"test1/bar", "test1/foo", "test1/qux"}, "/v2/_catalog?last=test1%2Fqux&n=3")
+	expectPage("n=3&last=test2/qux", []string{"test3/bar", "test3/foo", "test3/qux"}, "")
+	// ...and the next page starts right after the boundary without skipping or
+	// duplicating anything
+	expectPage("n=3&last=test1/qux", []string{"test2/bar", "test2/foo", "test2/qux"}, "/v2/_catalog?last=test2%2Fqux&n=3")
+	// a page that is exactly as large as the rest of the catalog does not have a Link header
+	expectPage("n=9", []string{
+		"test1/bar", "test1/foo", "test1/qux",
+		"test2/bar", "test2/foo", "test2/qux",
+		"test3/bar", "test3/foo", "test3/qux",
+	}, "")
+
+	// markers do not need to refer to existing repos (e.g. because the repo was
+	// deleted since the previous page was generated)
+	expectPage("n=2&last=test2/aaa", []string{"test2/bar", "test2/foo"}, "/v2/_catalog?last=test2%2Ffoo&n=2")
+	expectPage("n=2&last=test2/baz", []string{"test2/foo", "test2/qux"}, "/v2/_catalog?last=test2%2Fqux&n=2")
+	expectPage("n=2&last=test2/zzz", []string{"test3/bar", "test3/foo"}, "/v2/_catalog?last=test3%2Ffoo&n=2")
+	expectPage("n=2&last=test2/", []string{"test2/bar", "test2/foo"}, "/v2/_catalog?last=test2%2Ffoo&n=2")
+	// ...or to existing accounts
+	expectPage("n=2&last=test15/foo", []string{"test2/bar", "test2/foo"}, "/v2/_catalog?last=test2%2Ffoo&n=2")
+	expectPage("n=2&last=aaa/foo", []string{"test1/bar", "test1/foo"}, "/v2/_catalog?last=test1%2Ffoo&n=2")
+
+	// a marker past the end of the catalog yields an empty page
+	expectPage("n=2&last=test3/qux", []string{}, "")
+	expectPage("n=2&last=test3/zzz", []string{}, "")
+	expectPage("n=2&last=zzz/zzz", []string{}, "")
+
+	// when account names are prefixes of each other, pagination follows the
+	// order of accounts (even though "test1-extra/..." sorts before "test1/..."
+	// when comparing full repo names)
+	test.MustExec(t, s.DB, `INSERT INTO accounts (name, auth_tenant_id) VALUES ($1, $2)`, "test1-extra", authTenantID)
+	test.MustInsert(t, s.DB, &models.Repository{Name: "aaa", AccountName: "test1-extra"})
+	token = s.GetToken(t,
+		"registry:catalog:*",
+		"keppel_account:test1:view",
+		"keppel_account:test1-extra:view",
+	)
+	expectPage("n=2&last=test1/bar", []string{"test1/foo", "test1/qux"}, "/v2/_catalog?last=test1%2Fqux&n=2")
+	expectPage("n=2&last=test1/qux", []string{"test1-extra/aaa"}, "")
+	// this also holds when the marker account is not visible to the client
+	token = s.GetToken(t,
+		"registry:catalog:*",
+		"keppel_account:test1-extra:view",
+	)
+	expectPage("n=2&last=test1/qux", []string{"test1-extra/aaa"}, "")
+
+	// cleanup for the following testcases
+	test.MustExec(t, s.DB, `DELETE FROM repos WHERE account_name = $1`, "test1-extra")
+	test.MustExec(t, s.DB, `DELETE FROM accounts WHERE name = $1`, "test1-extra")
+}
+
+// referenceCatalogPage computes a catalog page in the same way as the original
+// implementation of GET /v2/_catalog, which listed all repos in each account
+// separately and assembled the page in Go.
+func referenceCatalogPage(reposByAccount map[models.AccountName][]string, accountNames []models.AccountName, marker string, limit int) (page []string, hasNext bool) {
+	markerAccountName, markerRepoName, _ := strings.Cut(marker, "/")
+	accountNames = slices.Clone(accountNames)
+	slices.Sort(accountNames)
+
+	page = []string{}
+	for _, accountName := range accountNames {
+		if marker != "" && string(accountName) < markerAccountName {
+			continue
+		}
+		names := slices.Clone(reposByAccount[accountName])
+		if string(accountName) == markerAccountName {
+			names = slices.DeleteFunc(names, func(name string) bool { return name <= markerRepoName })
+		}
+		slices.Sort(names)
+		for _, name := range names {
+			page = append(page, fmt.Sprintf("%s/%s", accountName, name))
+		}
+		if len(page) > limit {
+			return page[0:limit], true
+		}
+	}
+	return page, false
+}
+
+func testCatalogPaginationMatchesReference(t *testing.T, s test.Setup) {
+	h := s.Handler
+
+	// add some accounts whose names are prefixes of each other, and whose order
+	// depends on the collation (e.g. "test1-extra" < "test15" in Go, but not in
+	// most natural-language collations)
+	reposByAccount := map[models.AccountName][]string{
+		"test1": {"foo", "bar", "qux"},
+		"test2": {"foo", "bar", "qux"},
+		"test3": {"foo", "bar", "qux"},
+	}
+	for accountName, repoNames := range map[models.AccountName][]string{
+		"test1-extra": {"aaa", "a-b", "a.b", "a/b", "zzz"},
+		"test15":      {"foo", "foo-bar", "foo_bar"},
+	} {
+		test.MustExec(t, s.DB, `INSERT INTO accounts (name, auth_tenant_id) VALUES ($1, $2)`, accountName, authTenantID)
+		for _, repoName := range repoNames {
+			test.MustInsert(t, s.DB, &models.Repository{Name: repoName, AccountName: accountName})
+		}
+		reposByAccount[accountName] = repoNames
+	}
+
+	for _, accountNames := range [][]models.AccountName{
+		{"test1", "test1-extra", "test15", "test2", "test3"},
+		{"test1-extra", "test15", "test3"},
+		{"test2"},
+	} {
+		scopes := []string{"registry:catalog:*"}
+		for _, accountName := range accountNames {
+			scopes = append(scopes, fmt.Sprintf("keppel_account:%s:view", accountName))
+		}
+		token := s.GetToken(t, scopes...)
+
+		// collect markers from all possible pages, as well as some that do not
+		// refer to existing repos or accounts
+		markers := []string{"", "aaa/foo", "test1/", "test1/zzz", "test1-/foo", "test1-extra/a", "test15/foo-", "test2/baz", "zzz/zzz"}
+		allRepos, _ := referenceCatalogPage(reposByAccount, accountNames, "", 100)
+		markers = append(markers, allRepos...)
+
+		for _, marker := range markers {
+			for limit := 1; limit <= len(allRepos)+1; limit++ {
+				expectedPage, hasNext := referenceCatalogPage(reposByAccount, accountNames, marker, limit)
+				path := fmt.Sprintf("/v2/_catalog?n=%d", limit)
+				if marker != "" {
+					path += "&last=" + url.QueryEscape(marker)
+				}
+
+				resp, _ := assert.HTTPRequest{
+					Method:       "GET",
+					Path:         path,
+					Header:       map[string]string{"Authorization": "Bearer " + token},
+					ExpectStatus: http.StatusOK,
+					ExpectBody:   assert.JSONObject{"repositories": expectedPage},
+				}.Check(t, h)
+				if hasNext != (resp.Header.Get("Link") != "") {
+					t.Errorf("expected hasNext = %t for %s with accounts %v, but got Link header %q",
+						hasNext, path, accountNames, resp.Header.Get("Link"))
+				}
+			}
+		}
+	}
+
+	// cleanup for the following testcases
+	for _, accountName := range []models.AccountName{"test1-extra", "test15"} {
+		test.MustExec(t, s.DB, `DELETE FROM repos WHERE account_name = $1`, accountName)
+		test.MustExec(t, s.DB, `DELETE FROM accounts WHERE name = $1`, accountName)
+	}
+}
+
+func testCatalogMetrics(t *testing.T, s test.Setup) {
+	h := s.Handler
+	token := s.GetToken(t,
+		"registry:catalog:*",
+		"keppel_account:test1:view",
+		"keppel_account:test2:view",
+		"keppel_account:test3:view",
+	)
+
+	getHistogram := func(histogram prometheus.Histogram) (count uint64, sum float64) {
+		t.Helper()
+		var m dto.Metric
+		test.MustDo(t, histogram.Write(&m))
+		return m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum()
+	}
+	expectCost := func(path string, accountsScanned, reposCollected float64) {
+		t.Helper()
+		accountsCountBefore, accountsSumBefore := getHistogram(api.CatalogAccountsScannedHistogram)
+		reposCountBefore, reposSumBefore := getHistogram(api.CatalogReposCollectedHistogram)
+		durationCountBefore, _ := getHistogram(api.CatalogDurationHistogram)
+
+		assert.HTTPRequest{
+			Method:       "GET",
+			Path:         path,
+			Header:       map[string]string{"Authorization": "Bearer " + token},
+			ExpectStatus: http.StatusOK,
+		}.Check(t, h)
+
+		accountsCount, accountsSum := getHistogram(api.CatalogAccountsScannedHistogram)
+		reposCount, reposSum := getHistogram(api.CatalogReposCollectedHistogram)
+		durationCount, _ := getHistogram(api.CatalogDurationHistogram)
+		assert.DeepEqual(t, "accounts scanned observations", accountsCount-accountsCountBefore, uint64(1))
+		assert.DeepEqual(t, "accounts scanned", accountsSum-accountsSumBefore, accountsScanned)
+		assert.DeepEqual(t, "repos collected observations", reposCount-reposCountBefore, uint64(1))
+		assert.DeepEqual(t, "repos collected", reposSum-reposSumBefore, reposCollected)
+		assert.DeepEqual(t, "duration observations", durationCount-durationCountBefore, uint64(1))
+	}
+
+	// unpaginated listing scans all accounts
+	expectCost("/v2/_catalog", 3, 9)
+	// only one page worth of repos (plus one to detect the next page) is collected
+	expectCost("/v2/_catalog?n=2", 1, 3)
+	// repos before the marker are not collected at all
+	expectCost("/v2/_catalog?n=2&last=test2/foo", 2, 3)
+}
+
+var linkHeaderRx = regexp.MustCompile(`^<(/v2/_catalog\?[^>]*)>; rel="next"$`)
+
 func testDomainRemappedCatalog(t *testing.T, s test.Setup) {
 	h := s.Handler
 	token := s.GetDomainRemappedToken(t, "test1",
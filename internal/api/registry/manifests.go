@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -40,9 +41,27 @@ func (a *API) handleGetOrHeadManifest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// the security scanner is exempt from disabled pulls, to keep vulnerability reports current,
+	// and so are peers, to keep replica accounts on other Keppel instances consistent
+	if userType := authz.UserIdentity.UserType(); userType != keppel.TrivyUser && userType != keppel.PeerUser {
+		err = api.CheckAccountPullEnabled(*account)
+		if respondWithError(w, r, err) {
+			return
+		}
+	}
+
 	reference := models.ParseManifestReference(mux.Vars(r)["reference"])
+	var tagActions []string
+	if reference.IsTag() {
+		tagActions, err = a.checkTagAccess(r, authz, *account, *repo, reference.Tag, "pull")
+		if respondWithError(w, r, err) {
+			return
+		}
+	}
+
 	dbManifest, err := a.findManifestInDB(*repo, reference)
 	var manifestBytes []byte
+	wasReplicated := false
 
 	if !errors.Is(err, sql.ErrNoRows) {
 		if respondWithError(w, r, err) {
@@ -59,11 +78,15 @@ func (a *API) handleGetOrHeadManifest(w http.ResponseWriter, r *http.Request) {
 		if (account.UpstreamPeerHostName != "" || account.ExternalPeerURL != "") && !account.IsDeleting && (userType != keppel.PeerUser && userType != keppel.TrivyUser) {
 			// when replicating from external, only authenticated users can trigger the replication
 			if account.ExternalPeerURL != "" && userType != keppel.RegularUser {
-				if !authz.ScopeSet.Contains(auth.Scope{
+				canFirstPull := authz.ScopeSet.Contains(auth.Scope{
 					ResourceType: "repository",
 					ResourceName: repo.FullName(),
 					Actions:      []string{"anonymous_first_pull"},
-				}) {
+				})
+				if tagActions != nil {
+					canFirstPull = canFirstPull && slices.Contains(tagActions, "anonymous_first_pull")
+				}
+				if !canFirstPull {
 					rerr := keppel.ErrDenied.With("image does not exist here, and anonymous users may not replicate images")
 					// this must be a 401 and include a challenge; clients should be able to understand that
 					// they can retry this after authenticating and expect a different result
@@ -72,6 +95,10 @@ func (a *API) handleGetOrHeadManifest(w http.ResponseWriter, r *http.Request) {
 				}
 			}
 
+			err = api.CheckAccountWritable(a.cfg, *account, true)
+			if respondWithError(w, r, err) {
+				return
+			}
 			tagPolicies, err := api.GetTagPolicies(a.db, *account)
 			if respondWithError(w, r, err) {
 				return
@@ -84,10 +111,15 @@ func (a *API) handleGetOrHeadManifest(w http.ResponseWriter, r *http.Request) {
 			if respondWithError(w, r, err) {
 				return
 			}
+			wasReplicated = true
 		} else {
 			keppel.ErrManifestUnknown.With("").WithDetail(reference.Tag).WriteAsRegistryV2ResponseTo(w, r)
 			return
 		}
+	} else if refreshedManifest, refreshedBytes, ok := a.refreshStaleTag(r, *account, *repo, authz, reference); ok {
+		// the tag was re-resolved from upstream because its manifest cache TTL had expired
+		dbManifest, manifestBytes = refreshedManifest, refreshedBytes
+		wasReplicated = true
 	} else {
 		// if manifest was found in our DB, fetch the contents from the DB (or fall
 		// back to the storage if the DB entry is not there for some reason)
@@ -133,7 +165,7 @@ func (a *API) handleGetOrHeadManifest(w http.ResponseWriter, r *http.Request) {
 		if negotiatedMediaType == "" {
 			// we cannot serve the manifest itself, but maybe we can redirect into one of the acceptable
 			// alternates
-			manifestParsed, err := keppel.ParseManifest(dbManifest.MediaType, manifestBytes)
+			manifestParsed, err := a.cfg.ParseManifest(dbManifest.MediaType, manifestBytes)
 			if err != nil {
 				keppel.ErrManifestInvalid.With(err.Error()).WriteAsRegistryV2ResponseTo(w, r)
 				return
@@ -189,6 +221,8 @@ func (a *API) handleGetOrHeadManifest(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodGet && r.Header.Get("X-Keppel-No-Count-Towards-Last-Pulled") != "1" && authz.UserIdentity.UserType() != keppel.TrivyUser {
 		l := prometheus.Labels{"account": string(account.Name), "auth_tenant_id": account.AuthTenantID, "method": "registry-api"}
 		api.ManifestsPulledCounter.With(l).Inc()
+		api.CountReplicaPull(*account, "manifest", wasReplicated)
+		logCtx := keppel.WithLogFields(r.Context(), keppel.LogFields{Account: account.Name})
 
 		// update manifests.last_pulled_at
 		_, err := a.db.Exec(
@@ -202,11 +236,11 @@ func (a *API) handleGetOrHeadManifest(w http.ResponseWriter, r *http.Request) {
 				if authz.UserIdentity.UserType() == keppel.AnonymousUser {
 					userNameDisplay = "<anonymous>"
 				}
-				logg.Info("last_pulled_at timestamp of manifest %s@%s got updated by more than 7 days by user %q, user agent %q",
+				keppel.LogInfo(logCtx, "last_pulled_at timestamp of manifest %s@%s got updated by more than 7 days by user %q, user agent %q",
 					repo.FullName(), dbManifest.Digest, userNameDisplay, r.Header.Get("User-Agent"))
 			}
 		} else {
-			logg.Error("could not update last_pulled_at timestamp on manifest %s@%s: %s", repo.FullName(), dbManifest.Digest, err.Error())
+			keppel.LogError(logCtx, "could not update last_pulled_at timestamp on manifest %s@%s: %s", repo.FullName(), dbManifest.Digest, err.Error())
 		}
 
 		// also update tags.last_pulled_at if applicable
@@ -216,20 +250,95 @@ func (a *API) handleGetOrHeadManifest(w http.ResponseWriter, r *http.Request) {
 				a.timeNow(), dbManifest.RepositoryID, dbManifest.Digest, reference.Tag,
 			)
 			if err != nil {
-				logg.Error("could not update last_pulled_at timestamp on tag %s/%s: %s", repo.FullName(), reference.Tag, err.Error())
+				keppel.LogError(logCtx, "could not update last_pulled_at timestamp on tag %s/%s: %s", repo.FullName(), reference.Tag, err.Error())
 			}
 		}
 	}
 }
 
+// For external replica accounts with a manifest cache TTL, tags that were
+// replicated (or last refreshed) longer than the TTL ago are re-resolved from
+// upstream, so that mutable tags like "latest" stay fresh. If the refresh is
+// not possible or fails, false is returned and the cached manifest shall be
+// served instead. Pulls by digest are never refreshed.
+func (a *API) refreshStaleTag(r *http.Request, account models.ReducedAccount, repo models.Repository, authz *auth.Authorization, reference models.ManifestReference) (*models.Manifest, []byte, bool) {
+	if !reference.IsTag() || account.ExternalPeerURL == "" || account.ManifestCacheTTLSecs <= 0 || account.IsDeleting {
+		return nil, nil, false
+	}
+
+	// the same restrictions apply as for the initial replication (see above),
+	// except that we fall back to serving the cached manifest instead of failing
+	userType := authz.UserIdentity.UserType()
+	if userType == keppel.PeerUser || userType == keppel.TrivyUser {
+		return nil, nil, false
+	}
+	if userType != keppel.RegularUser && !authz.ScopeSet.Contains(auth.Scope{
+		ResourceType: "repository",
+		ResourceName: repo.FullName(),
+		Actions:      []string{"anonymous_first_pull"},
+	}) {
+		return nil, nil, false
+	}
+	if api.CheckAccountWritable(a.cfg, account, true) != nil {
+		return nil, nil, false
+	}
+
+	logCtx := keppel.WithLogFields(r.Context(), keppel.LogFields{Account: account.Name})
+
+	// is the tag stale?
+	var refreshedAt time.Time
+	err := a.db.QueryRow(
+		`SELECT COALESCE(last_refreshed_at, pushed_at) FROM tags WHERE repo_id = $1 AND name = $2`,
+		repo.ID, reference.Tag,
+	).Scan(&refreshedAt)
+	if err != nil {
+		keppel.LogError(logCtx, "could not check freshness of tag %s:%s: %s", repo.FullName(), reference.Tag, err.Error())
+		return nil, nil, false
+	}
+	ttl := time.Duration(account.ManifestCacheTTLSecs) * time.Second
+	if refreshedAt.After(a.timeNow().Add(-ttl)) {
+		return nil, nil, false
+	}
+
+	// re-resolve the tag from upstream
+	tagPolicies, err := api.GetTagPolicies(a.db, account)
+	if err != nil {
+		keppel.LogError(logCtx, "could not refresh stale tag %s:%s: %s", repo.FullName(), reference.Tag, err.Error())
+		return nil, nil, false
+	}
+	dbManifest, manifestBytes, err := a.processor().ReplicateManifest(r.Context(), account, repo, reference, tagPolicies, keppel.AuditContext{
+		UserIdentity: authz.UserIdentity,
+		Request:      r,
+	})
+	if err != nil {
+		keppel.LogInfo(logCtx, "could not refresh stale tag %s:%s from upstream (serving cached manifest instead): %s", repo.FullName(), reference.Tag, err.Error())
+		return nil, nil, false
+	}
+	_, err = a.db.Exec(
+		`UPDATE tags SET last_refreshed_at = $1 WHERE repo_id = $2 AND name = $3`,
+		a.timeNow(), repo.ID, reference.Tag,
+	)
+	if err != nil {
+		keppel.LogError(logCtx, "could not update last_refreshed_at timestamp on tag %s:%s: %s", repo.FullName(), reference.Tag, err.Error())
+	}
+	return dbManifest, manifestBytes, true
+}
+
+const (
+	tagDigestGetQuery        = `SELECT digest FROM tags WHERE repo_id = $1 AND name = $2`
+	manifestGetByRepoIDQuery = `SELECT * FROM manifests WHERE repo_id = $1 AND digest = $2 AND deleted_at IS NULL`
+	manifestContentGetQuery  = `SELECT content FROM manifest_contents WHERE repo_id = $1 AND digest = $2`
+)
+
 func (a *API) findManifestInDB(repo models.Repository, reference models.ManifestReference) (*models.Manifest, error) {
 	// resolve tag into digest if necessary
 	refDigest := reference.Digest
 	if reference.IsTag() {
-		digestStr, err := a.db.SelectStr(
-			`SELECT digest FROM tags WHERE repo_id = $1 AND name = $2`,
-			repo.ID, reference.Tag,
-		)
+		// tags are resolved on the primary DB: if a tag was just pushed with a
+		// new manifest, the read replica might still point to the old one
+		startedAt := time.Now()
+		digestStr, err := a.db.SelectStr(tagDigestGetQuery, repo.ID, reference.Tag)
+		keppel.ObserveQueryDuration("tag_digest_get", startedAt)
 		if err != nil {
 			return nil, err
 		}
@@ -243,19 +352,17 @@ func (a *API) findManifestInDB(repo models.Repository, reference models.Manifest
 	}
 
 	var dbManifest models.Manifest
-	err := a.db.SelectOne(&dbManifest,
-		`SELECT * FROM manifests WHERE repo_id = $1 AND digest = $2`,
-		repo.ID, refDigest.String(),
-	)
+	startedAt := time.Now()
+	err := a.db.SelectOneFromReplica(&dbManifest, manifestGetByRepoIDQuery, repo.ID, refDigest.String())
+	keppel.ObserveQueryDuration("manifest_get_by_repo_id", startedAt)
 	return &dbManifest, err
 }
 
 func (a *API) getManifestContentFromDB(repoID int64, digestStr digest.Digest) ([]byte, error) {
 	var result []byte
-	err := a.db.SelectOne(&result,
-		`SELECT content FROM manifest_contents WHERE repo_id = $1 AND digest = $2`,
-		repoID, digestStr,
-	)
+	startedAt := time.Now()
+	err := a.db.SelectOneFromReplica(&result, manifestContentGetQuery, repoID, digestStr)
+	keppel.ObserveQueryDuration("manifest_content_get", startedAt)
 	return result, err
 }
 
@@ -274,6 +381,10 @@ func (a *API) handleDeleteManifest(w http.ResponseWriter, r *http.Request) {
 	if account == nil {
 		return
 	}
+	err := api.CheckAccountWritable(a.cfg, *account, false)
+	if respondWithError(w, r, err) {
+		return
+	}
 
 	tagPolicies, err := api.GetTagPolicies(a.db, *account)
 	if respondWithError(w, r, err) {
@@ -282,12 +393,19 @@ func (a *API) handleDeleteManifest(w http.ResponseWriter, r *http.Request) {
 
 	// delete tag or manifest from the database
 	ref := models.ParseManifestReference(mux.Vars(r)["reference"])
+	if ref.IsTag() {
+		_, err = a.checkTagAccess(r, authz, *account, *repo, ref.Tag, "delete")
+		if respondWithError(w, r, err) {
+			return
+		}
+	}
 	actx := keppel.AuditContext{
 		UserIdentity: authz.UserIdentity,
 		Request:      r,
 	}
+	manifestDigest := ref.Digest
 	if ref.IsTag() {
-		err = a.processor().DeleteTag(*account, *repo, ref.Tag, tagPolicies, actx)
+		manifestDigest, err = a.processor().DeleteTag(*account, *repo, ref.Tag, tagPolicies, actx)
 	} else {
 		err = a.processor().DeleteManifest(r.Context(), *account, *repo, ref.Digest, tagPolicies, actx)
 	}
@@ -299,6 +417,8 @@ func (a *API) handleDeleteManifest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// when deleting a tag, this tells the client which manifest the tag pointed to
+	w.Header().Set("Docker-Content-Digest", manifestDigest.String())
 	w.WriteHeader(http.StatusAccepted)
 }
 
@@ -336,6 +456,22 @@ func (a *API) handlePutManifest(w http.ResponseWriter, r *http.Request) {
 		keppel.ErrUnsupported.With("account is being deleted").WithStatus(http.StatusMethodNotAllowed).WriteAsRegistryV2ResponseTo(w, r)
 		return
 	}
+	err = api.CheckAccountWritable(a.cfg, *account, false)
+	if respondWithError(w, r, err) {
+		return
+	}
+	err = api.CheckAccountPushEnabled(*account)
+	if respondWithError(w, r, err) {
+		return
+	}
+
+	ref := models.ParseManifestReference(mux.Vars(r)["reference"])
+	if ref.IsTag() {
+		_, err = a.checkTagAccess(r, authz, *account, *repo, ref.Tag, "push")
+		if respondWithError(w, r, err) {
+			return
+		}
+	}
 
 	// read manifest from request
 	manifestBytes, err := io.ReadAll(r.Body)
@@ -349,7 +485,10 @@ func (a *API) handlePutManifest(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// validate and store manifest
-	ref := models.ParseManifestReference(mux.Vars(r)["reference"])
+	if ref.IsDigest() && !a.cfg.IsDigestAlgorithmAccepted(ref.Digest.Algorithm()) {
+		keppel.ErrDigestInvalid.With("digest algorithm %q is not accepted by this registry", ref.Digest.Algorithm()).WriteAsRegistryV2ResponseTo(w, r)
+		return
+	}
 	manifest, err := a.processor().ValidateAndStoreManifest(r.Context(), *account, *repo, processor.IncomingManifest{
 		Reference: ref,
 		MediaType: r.Header.Get("Content-Type"),
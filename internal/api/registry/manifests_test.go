@@ -5,11 +5,13 @@ package registryv2_test
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"testing"
 	"time"
 
 	"github.com/containers/image/v5/manifest"
+	. "github.com/majewsky/gg/option"
 	"github.com/opencontainers/go-digest"
 	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/sapcc/go-api-declarations/cadf"
@@ -570,6 +572,211 @@ func TestManifestQuotaExceeded(t *testing.T) {
 	})
 }
 
+func TestImmutableTags(t *testing.T) {
+	testWithPrimary(t, nil, func(s test.Setup) {
+		h := s.Handler
+		token := s.GetToken(t, "repository:test1/foo:pull,push,delete")
+
+		// as a setup, upload two images
+		image1 := test.GenerateImage(test.GenerateExampleLayer(1))
+		image2 := test.GenerateImage(test.GenerateExampleLayer(2))
+		image1.MustUpload(t, s, fooRepoRef, "v1.0.0")
+		image1.MustUpload(t, s, fooRepoRef, "dev")
+		image2.MustUpload(t, s, fooRepoRef, "")
+
+		// make all release tags immutable
+		test.MustExec(t, s.DB, `UPDATE accounts SET tag_policies_json = $2 WHERE name = $1`, "test1",
+			test.ToJSON([]keppel.TagPolicy{{
+				PolicyMatchRule: keppel.PolicyMatchRule{
+					RepositoryRx: ".*",
+					TagRx:        `v[0-9.]+`,
+				},
+				BlockOverwrite: true,
+				BlockDelete:    true,
+			}}),
+		)
+
+		// re-pushing the same digest into an immutable tag is fine
+		image1.MustUpload(t, s, fooRepoRef, "v1.0.0")
+
+		// pointing an immutable tag to a different digest is not allowed
+		assert.HTTPRequest{
+			Method: "PUT",
+			Path:   "/v2/test1/foo/manifests/v1.0.0",
+			Header: map[string]string{
+				"Authorization": "Bearer " + token,
+				"Content-Type":  image2.Manifest.MediaType,
+			},
+			Body:         assert.ByteData(image2.Manifest.Contents),
+			ExpectStatus: http.StatusConflict,
+			ExpectHeader: test.VersionHeader,
+			ExpectBody: test.ErrorCodeWithMessage{
+				Code:    keppel.ErrDenied,
+				Message: `cannot overwrite tag "v1.0.0" as it is protected by a tag_policy`,
+			},
+		}.Check(t, h)
+
+		// tags not matching the policy's regex can still be overwritten
+		image2.MustUpload(t, s, fooRepoRef, "dev")
+
+		// immutable tags cannot be deleted...
+		assert.HTTPRequest{
+			Method:       "DELETE",
+			Path:         "/v2/test1/foo/manifests/v1.0.0",
+			Header:       map[string]string{"Authorization": "Bearer " + token},
+			ExpectStatus: http.StatusConflict,
+			ExpectHeader: test.VersionHeader,
+		}.Check(t, h)
+		assert.HTTPRequest{
+			Method:       "DELETE",
+			Path:         "/v2/test1/foo/manifests/" + image1.Manifest.Digest.String(),
+			Header:       map[string]string{"Authorization": "Bearer " + token},
+			ExpectStatus: http.StatusConflict,
+			ExpectHeader: test.VersionHeader,
+		}.Check(t, h)
+
+		// ...unless the account is being deleted
+		testWithAccountIsDeleting(t, s.DB, "test1", func() {
+			assert.HTTPRequest{
+				Method:       "DELETE",
+				Path:         "/v2/test1/foo/manifests/" + image1.Manifest.Digest.String(),
+				Header:       map[string]string{"Authorization": "Bearer " + token},
+				ExpectStatus: http.StatusAccepted,
+				ExpectHeader: test.VersionHeader,
+			}.Check(t, h)
+		})
+	})
+}
+
+func TestDeleteManifestByTag(t *testing.T) {
+	testWithPrimary(t, nil, func(s test.Setup) {
+		h := s.Handler
+		token := s.GetToken(t, "repository:test1/foo:pull,push,delete")
+
+		// as a setup, upload one image with two tags and another image with only one tag
+		image1 := test.GenerateImage(test.GenerateExampleLayer(1))
+		image2 := test.GenerateImage(test.GenerateExampleLayer(2))
+		image1.MustUpload(t, s, fooRepoRef, "first")
+		image1.MustUpload(t, s, fooRepoRef, "second")
+		image2.MustUpload(t, s, fooRepoRef, "only")
+
+		expectManifestStatus := func(reference string, expectedStatus int) {
+			t.Helper()
+			assert.HTTPRequest{
+				Method:       "HEAD",
+				Path:         "/v2/test1/foo/manifests/" + reference,
+				Header:       map[string]string{"Authorization": "Bearer " + token},
+				ExpectStatus: expectedStatus,
+			}.Check(t, h)
+		}
+		expectTagCount := func(expected int) {
+			t.Helper()
+			count, err := s.DB.SelectInt(`SELECT COUNT(*) FROM tags`)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			assert.DeepEqual(t, "number of tags", count, int64(expected))
+		}
+
+		// deleting a tag that shares its manifest with another tag only removes the
+		// tag; the response identifies the manifest that the tag pointed to
+		assert.HTTPRequest{
+			Method:       "DELETE",
+			Path:         "/v2/test1/foo/manifests/first",
+			Header:       map[string]string{"Authorization": "Bearer " + token},
+			ExpectStatus: http.StatusAccepted,
+			ExpectHeader: map[string]string{
+				test.VersionHeaderKey:   test.VersionHeaderValue,
+				"Docker-Content-Digest": image1.Manifest.Digest.String(),
+			},
+		}.Check(t, h)
+		expectTagCount(2)
+		expectManifestStatus("first", http.StatusNotFound)
+		expectManifestStatus("second", http.StatusOK)
+		expectManifestStatus(image1.Manifest.Digest.String(), http.StatusOK)
+
+		// deleting the only tag of a manifest also only removes the tag: the
+		// untagged manifest is left for GC policies to clean up
+		assert.HTTPRequest{
+			Method:       "DELETE",
+			Path:         "/v2/test1/foo/manifests/only",
+			Header:       map[string]string{"Authorization": "Bearer " + token},
+			ExpectStatus: http.StatusAccepted,
+			ExpectHeader: map[string]string{
+				test.VersionHeaderKey:   test.VersionHeaderValue,
+				"Docker-Content-Digest": image2.Manifest.Digest.String(),
+			},
+		}.Check(t, h)
+		expectTagCount(1)
+		expectManifestStatus("only", http.StatusNotFound)
+		expectManifestStatus(image2.Manifest.Digest.String(), http.StatusOK)
+
+		// deleting the same tag again fails
+		assert.HTTPRequest{
+			Method:       "DELETE",
+			Path:         "/v2/test1/foo/manifests/only",
+			Header:       map[string]string{"Authorization": "Bearer " + token},
+			ExpectStatus: http.StatusNotFound,
+			ExpectHeader: test.VersionHeader,
+			ExpectBody:   test.ErrorCode(keppel.ErrManifestUnknown),
+		}.Check(t, h)
+
+		// deleting by digest also reports the digest
+		assert.HTTPRequest{
+			Method:       "DELETE",
+			Path:         "/v2/test1/foo/manifests/" + image2.Manifest.Digest.String(),
+			Header:       map[string]string{"Authorization": "Bearer " + token},
+			ExpectStatus: http.StatusAccepted,
+			ExpectHeader: map[string]string{
+				test.VersionHeaderKey:   test.VersionHeaderValue,
+				"Docker-Content-Digest": image2.Manifest.Digest.String(),
+			},
+		}.Check(t, h)
+		expectManifestStatus(image2.Manifest.Digest.String(), http.StatusNotFound)
+		expectManifestStatus(image1.Manifest.Digest.String(), http.StatusOK)
+	})
+}
+
+func TestManifestReferenceDepth(t *testing.T) {
+	testWithPrimary(t, []test.SetupOption{test.WithMaxManifestReferenceDepth(2)}, func(s test.Setup) {
+		h := s.Handler
+		token := s.GetToken(t, "repository:test1/foo:pull,push")
+
+		// as a setup, upload an image and an image list containing it (depth 1)
+		image := test.GenerateImage(test.GenerateExampleLayer(1))
+		image.MustUpload(t, s, fooRepoRef, "")
+		list := test.GenerateImageList(image)
+		list.MustUpload(t, s, fooRepoRef, "")
+
+		pushIndex := func(index test.Bytes, expectStatus int, expectBody assert.HTTPResponseBody) {
+			t.Helper()
+			assert.HTTPRequest{
+				Method: "PUT",
+				Path:   "/v2/test1/foo/manifests/" + index.Digest.String(),
+				Header: map[string]string{
+					"Authorization": "Bearer " + token,
+					"Content-Type":  index.MediaType,
+				},
+				Body:         assert.ByteData(index.Contents),
+				ExpectStatus: expectStatus,
+				ExpectHeader: test.VersionHeader,
+				ExpectBody:   expectBody,
+			}.Check(t, h)
+		}
+
+		// an index containing the image list has depth 2, which is still allowed
+		index2 := test.GenerateImageIndex(list.Manifest)
+		pushIndex(index2, http.StatusCreated, nil)
+
+		// one more level of nesting is rejected
+		index3 := test.GenerateImageIndex(index2)
+		pushIndex(index3, http.StatusBadRequest, test.ErrorCodeWithMessage{
+			Code:    keppel.ErrManifestInvalid,
+			Message: "manifest references are nested more than 2 levels deep",
+		})
+	})
+}
+
 func TestRuleForManifest(t *testing.T) {
 	testWithPrimary(t, nil, func(s test.Setup) {
 		h := s.Handler
@@ -660,6 +867,192 @@ func TestRuleForManifest(t *testing.T) {
 	})
 }
 
+func TestStrictMediaTypes(t *testing.T) {
+	artifactMediaType := "application/vnd.example.artifact.manifest.v1+json"
+	testWithPrimary(t, []test.SetupOption{test.WithOpaqueManifestMediaTypes(artifactMediaType)}, func(s test.Setup) {
+		h := s.Handler
+		token := s.GetToken(t, "repository:test1/foo:pull,push")
+
+		artifactContents := []byte(`{"schemaVersion":2,"mediaType":"application/vnd.example.artifact.manifest.v1+json","payload":"hello"}`)
+		artifactDigest := digest.FromBytes(artifactContents)
+
+		// manifests with allowlisted opaque media types are stored as opaque artifact manifests
+		assert.HTTPRequest{
+			Method: "PUT",
+			Path:   "/v2/test1/foo/manifests/artifact",
+			Header: map[string]string{
+				"Authorization": "Bearer " + token,
+				"Content-Type":  artifactMediaType,
+			},
+			Body:         assert.ByteData(artifactContents),
+			ExpectStatus: http.StatusCreated,
+			ExpectHeader: map[string]string{
+				test.VersionHeaderKey:   test.VersionHeaderValue,
+				"Docker-Content-Digest": artifactDigest.String(),
+			},
+		}.Check(t, h)
+		assert.HTTPRequest{
+			Method: "GET",
+			Path:   "/v2/test1/foo/manifests/artifact",
+			Header: map[string]string{
+				"Authorization": "Bearer " + token,
+				"Accept":        artifactMediaType,
+			},
+			ExpectStatus: http.StatusOK,
+			ExpectHeader: map[string]string{
+				test.VersionHeaderKey:   test.VersionHeaderValue,
+				"Content-Type":          artifactMediaType,
+				"Docker-Content-Digest": artifactDigest.String(),
+			},
+			ExpectBody: assert.ByteData(artifactContents),
+		}.Check(t, h)
+
+		// since an allowlist is configured, other unknown media types are rejected
+		assert.HTTPRequest{
+			Method: "PUT",
+			Path:   "/v2/test1/foo/manifests/unknown",
+			Header: map[string]string{
+				"Authorization": "Bearer " + token,
+				"Content-Type":  "application/vnd.example.unknown.v1+json",
+			},
+			Body:         assert.ByteData(artifactContents),
+			ExpectStatus: http.StatusBadRequest,
+			ExpectHeader: test.VersionHeader,
+			ExpectBody: test.ErrorCodeWithMessage{
+				Code:    keppel.ErrManifestInvalid,
+				Message: `unsupported manifest media type: "application/vnd.example.unknown.v1+json"`,
+			},
+		}.Check(t, h)
+
+		// image manifests cannot be disguised as opaque artifact manifests (their
+		// blob references would not be tracked)
+		image := test.GenerateImage(test.GenerateExampleLayer(1))
+		assert.HTTPRequest{
+			Method: "PUT",
+			Path:   "/v2/test1/foo/manifests/disguised",
+			Header: map[string]string{
+				"Authorization": "Bearer " + token,
+				"Content-Type":  artifactMediaType,
+			},
+			Body:         assert.ByteData(image.Manifest.Contents),
+			ExpectStatus: http.StatusBadRequest,
+			ExpectHeader: test.VersionHeader,
+			ExpectBody: test.ErrorCodeWithMessage{
+				Code:    keppel.ErrManifestInvalid,
+				Message: fmt.Sprintf("manifest media type %q does not match the media type %q declared in the manifest", artifactMediaType, image.Manifest.MediaType),
+			},
+		}.Check(t, h)
+
+		// with strict media types, the same push is rejected...
+		test.MustExec(t, s.DB, `UPDATE accounts SET strict_media_types = TRUE WHERE name = $1`, "test1")
+		assert.HTTPRequest{
+			Method: "PUT",
+			Path:   "/v2/test1/foo/manifests/other-artifact",
+			Header: map[string]string{
+				"Authorization": "Bearer " + token,
+				"Content-Type":  artifactMediaType,
+			},
+			Body:         assert.ByteData(artifactContents),
+			ExpectStatus: http.StatusBadRequest,
+			ExpectHeader: test.VersionHeader,
+			ExpectBody: test.ErrorCodeWithMessage{
+				Code:    keppel.ErrManifestInvalid,
+				Message: fmt.Sprintf("manifest media type %q is not allowed in this account", artifactMediaType),
+			},
+		}.Check(t, h)
+
+		// ...but known media types are still accepted
+		image.Config.MustUpload(t, s, fooRepoRef)
+		image.Layers[0].MustUpload(t, s, fooRepoRef)
+		assert.HTTPRequest{
+			Method: "PUT",
+			Path:   "/v2/test1/foo/manifests/latest",
+			Header: map[string]string{
+				"Authorization": "Bearer " + token,
+				"Content-Type":  image.Manifest.MediaType,
+			},
+			Body:         assert.ByteData(image.Manifest.Contents),
+			ExpectStatus: http.StatusCreated,
+			ExpectHeader: test.VersionHeader,
+		}.Check(t, h)
+
+		// manifests that were pushed before the option was enabled can still be pulled
+		assert.HTTPRequest{
+			Method: "GET",
+			Path:   "/v2/test1/foo/manifests/" + artifactDigest.String(),
+			Header: map[string]string{
+				"Authorization": "Bearer " + token,
+				"Accept":        artifactMediaType,
+			},
+			ExpectStatus: http.StatusOK,
+			ExpectBody:   assert.ByteData(artifactContents),
+		}.Check(t, h)
+	})
+}
+
+func TestStrictMediaTypesWithDefaultConfiguration(t *testing.T) {
+	testWithPrimary(t, nil, func(s test.Setup) {
+		h := s.Handler
+		token := s.GetToken(t, "repository:test1/foo:pull,push")
+
+		artifactMediaType := "application/vnd.example.unknown.v1+json"
+		artifactContents := []byte(`{"schemaVersion":2,"payload":"hello"}`)
+		artifactDigest := digest.FromBytes(artifactContents)
+
+		// without an allowlist, manifests with any unknown media type are stored as opaque artifact manifests
+		assert.HTTPRequest{
+			Method: "PUT",
+			Path:   "/v2/test1/foo/manifests/artifact",
+			Header: map[string]string{
+				"Authorization": "Bearer " + token,
+				"Content-Type":  artifactMediaType,
+			},
+			Body:         assert.ByteData(artifactContents),
+			ExpectStatus: http.StatusCreated,
+			ExpectHeader: map[string]string{
+				test.VersionHeaderKey:   test.VersionHeaderValue,
+				"Docker-Content-Digest": artifactDigest.String(),
+			},
+		}.Check(t, h)
+
+		// image manifests still cannot be disguised as opaque artifact manifests
+		image := test.GenerateImage(test.GenerateExampleLayer(1))
+		assert.HTTPRequest{
+			Method: "PUT",
+			Path:   "/v2/test1/foo/manifests/disguised",
+			Header: map[string]string{
+				"Authorization": "Bearer " + token,
+				"Content-Type":  artifactMediaType,
+			},
+			Body:         assert.ByteData(image.Manifest.Contents),
+			ExpectStatus: http.StatusBadRequest,
+			ExpectHeader: test.VersionHeader,
+			ExpectBody: test.ErrorCodeWithMessage{
+				Code:    keppel.ErrManifestInvalid,
+				Message: fmt.Sprintf("manifest media type %q does not match the media type %q declared in the manifest", artifactMediaType, image.Manifest.MediaType),
+			},
+		}.Check(t, h)
+
+		// with strict media types, unknown media types are rejected
+		test.MustExec(t, s.DB, `UPDATE accounts SET strict_media_types = TRUE WHERE name = $1`, "test1")
+		assert.HTTPRequest{
+			Method: "PUT",
+			Path:   "/v2/test1/foo/manifests/other-artifact",
+			Header: map[string]string{
+				"Authorization": "Bearer " + token,
+				"Content-Type":  artifactMediaType,
+			},
+			Body:         assert.ByteData(artifactContents),
+			ExpectStatus: http.StatusBadRequest,
+			ExpectHeader: test.VersionHeader,
+			ExpectBody: test.ErrorCodeWithMessage{
+				Code:    keppel.ErrManifestInvalid,
+				Message: fmt.Sprintf("manifest media type %q is not allowed in this account", artifactMediaType),
+			},
+		}.Check(t, h)
+	})
+}
+
 func expectLabelsJSONOnManifest(t *testing.T, db *keppel.DB, manifestDigest digest.Digest, expected map[string]string) {
 	t.Helper()
 	labelsJSONStr, err := db.SelectStr(`SELECT labels_json FROM manifests WHERE digest = $1`, manifestDigest.String())
@@ -782,3 +1175,204 @@ func TestManifestArtifactType(t *testing.T) {
 		assert.DeepEqual(t, "artifact_type", artifactType, artifactTypeStr)
 	})
 }
+
+func TestManifestWithEmptyConfig(t *testing.T) {
+	testWithPrimary(t, nil, func(s test.Setup) {
+		h := s.Handler
+		token := s.GetToken(t, "repository:test1/foo:pull,push", "repository:test1/bar:pull,push")
+
+		// generate an OCI artifact using the empty config, and only upload its layer
+		artifact := test.GenerateOCIImage(test.OCIArgs{
+			Config:          map[string]any{},
+			ConfigMediaType: imgspecv1.MediaTypeEmptyJSON,
+			ArtifactType:    "application/vnd.example.sbom.v1+json",
+		}, test.GenerateExampleLayer(1))
+		assert.DeepEqual(t, "config digest", artifact.Config.Digest, imgspecv1.DescriptorEmptyJSON.Digest)
+		artifact.Layers[0].MustUpload(t, s, fooRepoRef)
+
+		// manifest push should succeed even though the empty config blob was not uploaded
+		assert.HTTPRequest{
+			Method: "PUT",
+			Path:   "/v2/test1/foo/manifests/latest",
+			Header: map[string]string{
+				"Authorization": "Bearer " + token,
+				"Content-Type":  imgspecv1.MediaTypeImageManifest,
+			},
+			Body:         assert.ByteData(artifact.Manifest.Contents),
+			ExpectStatus: http.StatusCreated,
+			ExpectHeader: test.VersionHeader,
+		}.Check(t, h)
+
+		// the empty config blob has been materialized and can be pulled
+		assert.HTTPRequest{
+			Method:       "GET",
+			Path:         "/v2/test1/foo/blobs/" + imgspecv1.DescriptorEmptyJSON.Digest.String(),
+			Header:       map[string]string{"Authorization": "Bearer " + token},
+			ExpectStatus: http.StatusOK,
+			ExpectHeader: test.VersionHeader,
+			ExpectBody:   assert.ByteData(imgspecv1.DescriptorEmptyJSON.Data),
+		}.Check(t, h)
+
+		// pushing the same artifact into another repo reuses the existing blob
+		artifact.Layers[0].MustUpload(t, s, models.Repository{AccountName: "test1", Name: "bar"})
+		assert.HTTPRequest{
+			Method: "PUT",
+			Path:   "/v2/test1/bar/manifests/latest",
+			Header: map[string]string{
+				"Authorization": "Bearer " + token,
+				"Content-Type":  imgspecv1.MediaTypeImageManifest,
+			},
+			Body:         assert.ByteData(artifact.Manifest.Contents),
+			ExpectStatus: http.StatusCreated,
+			ExpectHeader: test.VersionHeader,
+		}.Check(t, h)
+
+		blobCount, err := s.DB.SelectInt(`SELECT COUNT(*) FROM blobs WHERE digest = $1`, imgspecv1.DescriptorEmptyJSON.Digest.String())
+		test.MustDo(t, err)
+		assert.DeepEqual(t, "empty blob count", blobCount, int64(1))
+		mountCount, err := s.DB.SelectInt(
+			`SELECT COUNT(*) FROM blob_mounts bm JOIN blobs b ON b.id = bm.blob_id WHERE b.digest = $1`,
+			imgspecv1.DescriptorEmptyJSON.Digest.String(),
+		)
+		test.MustDo(t, err)
+		assert.DeepEqual(t, "empty blob mount count", mountCount, int64(2))
+	})
+}
+
+func TestManifestPushWithSHA512Digest(t *testing.T) {
+	image := test.GenerateImage(test.GenerateExampleLayer(1))
+	manifestDigest := digest.SHA512.FromBytes(image.Manifest.Contents)
+
+	// by default, manifests cannot be pushed with SHA-512 digests
+	testWithPrimary(t, nil, func(s test.Setup) {
+		h := s.Handler
+		token := s.GetToken(t, "repository:test1/foo:pull,push")
+
+		assert.HTTPRequest{
+			Method: "PUT",
+			Path:   "/v2/test1/foo/manifests/" + manifestDigest.String(),
+			Header: map[string]string{
+				"Authorization": "Bearer " + token,
+				"Content-Type":  image.Manifest.MediaType,
+			},
+			Body:         assert.ByteData(image.Manifest.Contents),
+			ExpectStatus: http.StatusBadRequest,
+			ExpectHeader: test.VersionHeader,
+			ExpectBody: test.ErrorCodeWithMessage{
+				Code:    keppel.ErrDigestInvalid,
+				Message: `digest algorithm "sha512" is not accepted by this registry`,
+			},
+		}.Check(t, h)
+	})
+
+	// when SHA-512 is allowed, the manifest round-trips with its SHA-512 digest
+	opts := []test.SetupOption{test.WithDigestAlgorithms(digest.SHA256, digest.SHA512)}
+	testWithPrimary(t, opts, func(s test.Setup) {
+		h := s.Handler
+		token := s.GetToken(t, "repository:test1/foo:pull,push")
+		image.Config.MustUpload(t, s, fooRepoRef)
+		image.Layers[0].MustUpload(t, s, fooRepoRef)
+
+		assert.HTTPRequest{
+			Method: "PUT",
+			Path:   "/v2/test1/foo/manifests/" + manifestDigest.String(),
+			Header: map[string]string{
+				"Authorization": "Bearer " + token,
+				"Content-Type":  image.Manifest.MediaType,
+			},
+			Body:         assert.ByteData(image.Manifest.Contents),
+			ExpectStatus: http.StatusCreated,
+			ExpectHeader: map[string]string{
+				test.VersionHeaderKey:   test.VersionHeaderValue,
+				"Docker-Content-Digest": manifestDigest.String(),
+			},
+		}.Check(t, h)
+		assert.HTTPRequest{
+			Method:       "GET",
+			Path:         "/v2/test1/foo/manifests/" + manifestDigest.String(),
+			Header:       map[string]string{"Authorization": "Bearer " + token},
+			ExpectStatus: http.StatusOK,
+			ExpectHeader: map[string]string{
+				test.VersionHeaderKey:   test.VersionHeaderValue,
+				"Docker-Content-Digest": manifestDigest.String(),
+			},
+			ExpectBody: assert.ByteData(image.Manifest.Contents),
+		}.Check(t, h)
+
+		// a SHA-512 digest that does not match the contents is rejected
+		assert.HTTPRequest{
+			Method: "PUT",
+			Path:   "/v2/test1/foo/manifests/" + digest.SHA512.FromString("something else").String(),
+			Header: map[string]string{
+				"Authorization": "Bearer " + token,
+				"Content-Type":  image.Manifest.MediaType,
+			},
+			Body:         assert.ByteData(image.Manifest.Contents),
+			ExpectStatus: http.StatusBadRequest,
+			ExpectHeader: test.VersionHeader,
+			ExpectBody:   test.ErrorCode(keppel.ErrDigestInvalid),
+		}.Check(t, h)
+
+		// the manifest also passes validation at a later point in time
+		j := tasks.NewJanitor(s.Config, s.FD, s.SD, s.ICD, s.DB, s.AMD, s.Auditor).OverrideTimeNow(s.Clock.Now).OverrideGenerateStorageID(s.SIDGenerator.Next)
+		j.DisableJitter()
+		s.Clock.StepBy(36 * time.Hour)
+		test.MustDo(t, j.ManifestValidationJob(s.Registry).ProcessOne(s.Ctx))
+		errorMessage, err := s.DB.SelectStr(`SELECT validation_error_message FROM manifests WHERE digest = $1`, manifestDigest.String())
+		test.MustDo(t, err)
+		assert.DeepEqual(t, "validation_error_message", errorMessage, "")
+	})
+}
+
+func TestManifestPushWithValidateOnPush(t *testing.T) {
+	testWithPrimary(t, nil, func(s test.Setup) {
+		h := s.Handler
+		token := s.GetToken(t, "repository:test1/foo:pull,push")
+		test.MustExec(t, s.DB, `UPDATE accounts SET validate_on_push = TRUE WHERE name = $1`, "test1")
+
+		image := test.GenerateImage(test.GenerateExampleLayer(1))
+		configBlob := image.Config.MustUpload(t, s, fooRepoRef)
+		image.Layers[0].MustUpload(t, s, fooRepoRef)
+
+		// simulate the config blob getting lost in the storage
+		account := models.ReducedAccount{Name: "test1"}
+		contents, _, err := s.SD.ReadBlob(s.Ctx, account, configBlob.StorageID)
+		test.MustDo(t, err)
+		test.MustDo(t, s.SD.DeleteBlob(s.Ctx, account, configBlob.StorageID))
+
+		// the manifest push is rejected because the blob is missing in the storage...
+		assert.HTTPRequest{
+			Method: "PUT",
+			Path:   "/v2/test1/foo/manifests/latest",
+			Header: map[string]string{
+				"Authorization": "Bearer " + token,
+				"Content-Type":  image.Manifest.MediaType,
+			},
+			Body:         assert.ByteData(image.Manifest.Contents),
+			ExpectStatus: http.StatusNotFound,
+			ExpectHeader: test.VersionHeader,
+			ExpectBody: test.ErrorCodeWithMessage{
+				Code:    keppel.ErrManifestBlobUnknown,
+				Message: "blob could not be found in the storage: no such blob",
+			},
+		}.Check(t, h)
+		manifestCount, err := s.DB.SelectInt(`SELECT COUNT(*) FROM manifests`)
+		test.MustDo(t, err)
+		assert.DeepEqual(t, "manifest count", manifestCount, int64(0))
+
+		// ...but goes through once the blob is back
+		test.MustDo(t, s.SD.AppendToBlob(s.Ctx, account, configBlob.StorageID, 1, None[uint64](), contents))
+		test.MustDo(t, s.SD.FinalizeBlob(s.Ctx, account, configBlob.StorageID, 1))
+		assert.HTTPRequest{
+			Method: "PUT",
+			Path:   "/v2/test1/foo/manifests/latest",
+			Header: map[string]string{
+				"Authorization": "Bearer " + token,
+				"Content-Type":  image.Manifest.MediaType,
+			},
+			Body:         assert.ByteData(image.Manifest.Contents),
+			ExpectStatus: http.StatusCreated,
+			ExpectHeader: test.VersionHeader,
+		}.Check(t, h)
+	})
+}
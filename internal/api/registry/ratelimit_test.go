@@ -183,3 +183,87 @@ func TestAnycastRateLimits(t *testing.T) {
 		})
 	})
 }
+
+func TestAnonymousRateLimits(t *testing.T) {
+	limit := redis_rate.Limit{Rate: 10, Period: time.Minute, Burst: 5}
+	anonLimit := redis_rate.Limit{Rate: 2, Period: time.Minute, Burst: 2}
+	rld := basic.RateLimitDriver{
+		Limits: map[keppel.RateLimitedAction]redis_rate.Limit{
+			keppel.ManifestPullAction: limit,
+		},
+		AnonymousLimits: map[keppel.RateLimitedAction]redis_rate.Limit{
+			keppel.ManifestPullAction: anonLimit,
+		},
+	}
+	rle := &keppel.RateLimitEngine{Driver: rld, Client: nil}
+	setupOptions := []test.SetupOption{
+		test.WithRateLimitEngine(rle),
+	}
+
+	testWithPrimary(t, setupOptions, func(s test.Setup) {
+		_, err := keppel.FindOrCreateRepository(s.DB, "foo", models.AccountName("test1"))
+		test.MustDo(t, err)
+		test.MustExec(t, s.DB, `UPDATE accounts SET rbac_policies_json = $2 WHERE name = $1`, "test1",
+			test.ToJSON([]keppel.RBACPolicy{{
+				RepositoryPattern: "foo",
+				Permissions:       []keppel.RBACPermission{keppel.RBACAnonymousPullPermission},
+			}}),
+		)
+
+		h := s.Handler
+		s.Clock.StepBy(time.Hour)
+		token := s.GetToken(t, "repository:test1/foo:pull")
+		bogusDigest := test.DeterministicDummyDigest(1).String()
+
+		anonReq := assert.HTTPRequest{
+			Method:       "GET",
+			Path:         "/v2/test1/foo/manifests/" + bogusDigest,
+			Header:       map[string]string{"X-Forwarded-For": "198.51.100.1"},
+			ExpectStatus: http.StatusNotFound,
+			ExpectHeader: test.VersionHeader,
+			ExpectBody:   test.ErrorCode(keppel.ErrManifestUnknown),
+		}
+		authReq := anonReq
+		authReq.Header = map[string]string{
+			"Authorization":   "Bearer " + token,
+			"X-Forwarded-For": "198.51.100.1",
+		}
+		failingAnonReq := anonReq
+		failingAnonReq.ExpectStatus = http.StatusTooManyRequests
+		failingAnonReq.ExpectBody = test.ErrorCode(keppel.ErrTooManyRequests)
+		failingAnonReq.ExpectHeader = map[string]string{
+			test.VersionHeaderKey: test.VersionHeaderValue,
+			"Retry-After":         "30",
+		}
+
+		// anonymous users exhaust their stricter burst budget first...
+		for range anonLimit.Burst {
+			anonReq.Check(t, h)
+		}
+		failingAnonReq.Check(t, h)
+
+		// ...while authenticated users from the same IP address are counted
+		// against the separate, more generous rate limit
+		for range limit.Burst {
+			authReq.Check(t, h)
+		}
+
+		// the anonymous rate limit is keyed by IP address, so anonymous users from
+		// other IP addresses are not affected
+		otherAnonReq := anonReq
+		otherAnonReq.Header = map[string]string{"X-Forwarded-For": "198.51.100.2"}
+		otherAnonReq.Check(t, h)
+		failingAnonReq.Check(t, h)
+
+		// the regular rate limit is keyed by account instead, so authenticated
+		// users cannot evade it by sending requests from other IP addresses
+		failingAuthReq := authReq
+		failingAuthReq.Header = map[string]string{
+			"Authorization":   "Bearer " + token,
+			"X-Forwarded-For": "198.51.100.2",
+		}
+		failingAuthReq.ExpectStatus = http.StatusTooManyRequests
+		failingAuthReq.ExpectBody = test.ErrorCode(keppel.ErrTooManyRequests)
+		failingAuthReq.Check(t, h)
+	})
+}
@@ -17,11 +17,11 @@ import (
 )
 
 var getManifestBySubjectQuery = sqlext.SimplifyWhitespace(`
-  SELECT * FROM manifests WHERE repo_id = $1 AND subject_digest = $2
+  SELECT * FROM manifests WHERE repo_id = $1 AND subject_digest = $2 AND deleted_at IS NULL
 `)
 
 var getManifestBySubjectAndArtifactTypeQuery = sqlext.SimplifyWhitespace(`
-  SELECT * FROM manifests WHERE repo_id = $1 AND subject_digest = $2 AND artifact_type = $3
+  SELECT * FROM manifests WHERE repo_id = $1 AND subject_digest = $2 AND artifact_type = $3 AND deleted_at IS NULL
 `)
 
 func (a *API) handleGetReferrers(w http.ResponseWriter, r *http.Request) {
@@ -11,9 +11,12 @@ import (
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/sapcc/go-bits/assert"
 	"github.com/sapcc/go-bits/easypg"
 
+	"github.com/sapcc/keppel/internal/api"
 	"github.com/sapcc/keppel/internal/keppel"
 	"github.com/sapcc/keppel/internal/models"
 	"github.com/sapcc/keppel/internal/test"
@@ -391,6 +394,107 @@ func TestReplicationAllowAnonymousReplicationFromExternal(t *testing.T) {
 	})
 }
 
+func TestReplicaPullMetrics(t *testing.T) {
+	testWithPrimary(t, nil, func(s1 test.Setup) {
+		// upload image to primary account
+		image := test.GenerateImage(test.GenerateExampleLayer(1))
+		s1.Clock.StepBy(time.Second)
+		image.MustUpload(t, s1, fooRepoRef, "first")
+
+		testWithAllReplicaTypes(t, s1, func(strategy string, firstPass bool, s2 test.Setup) {
+			// need only one pass for this test
+			if !firstPass {
+				return
+			}
+			h2 := s2.Handler
+			token := s2.GetToken(t, "repository:test1/foo:pull")
+
+			getReplicaPullCount := func(objectType, result string) float64 {
+				var m dto.Metric
+				counter := api.ReplicaPullsCounter.With(prometheus.Labels{
+					"account":        "test1",
+					"auth_tenant_id": authTenantID,
+					"type":           objectType,
+					"result":         result,
+				})
+				test.MustDo(t, counter.Write(&m))
+				return m.GetCounter().GetValue()
+			}
+			expectReplicaPullCounts := func(manifestHits, manifestMisses, blobHits, blobMisses float64, action func()) {
+				t.Helper()
+				before := []float64{
+					getReplicaPullCount("manifest", "hit"), getReplicaPullCount("manifest", "miss"),
+					getReplicaPullCount("blob", "hit"), getReplicaPullCount("blob", "miss"),
+				}
+				action()
+				assert.DeepEqual(t, "manifest hits", getReplicaPullCount("manifest", "hit")-before[0], manifestHits)
+				assert.DeepEqual(t, "manifest misses", getReplicaPullCount("manifest", "miss")-before[1], manifestMisses)
+				assert.DeepEqual(t, "blob hits", getReplicaPullCount("blob", "hit")-before[2], blobHits)
+				assert.DeepEqual(t, "blob misses", getReplicaPullCount("blob", "miss")-before[3], blobMisses)
+			}
+
+			// cold pull: the first GET of the manifest replicates it, the second GET
+			// (expectManifestExists() does two successful GETs) is served locally
+			expectReplicaPullCounts(1, 1, 0, 0, func() {
+				expectManifestExists(t, h2, token, "test1/foo", image.Manifest, "first", nil)
+			})
+			expectReplicaPullCounts(0, 0, 0, 1, func() {
+				expectBlobExists(t, h2, token, "test1/foo", image.Layers[0], nil)
+			})
+
+			// warm pull: everything is served locally
+			expectReplicaPullCounts(2, 0, 0, 0, func() {
+				expectManifestExists(t, h2, token, "test1/foo", image.Manifest, "first", nil)
+			})
+			expectReplicaPullCounts(0, 0, 1, 0, func() {
+				expectBlobExists(t, h2, token, "test1/foo", image.Layers[0], nil)
+			})
+		})
+	})
+}
+
+func TestReplicationManifestCacheTTL(t *testing.T) {
+	testWithPrimary(t, nil, func(s1 test.Setup) {
+		// upload image to primary account
+		image1 := test.GenerateImage(test.GenerateExampleLayer(1))
+		image2 := test.GenerateImage(test.GenerateExampleLayer(2))
+		s1.Clock.StepBy(time.Second)
+		image1.MustUpload(t, s1, fooRepoRef, "latest")
+
+		testWithReplica(t, s1, "from_external_on_first_use", func(firstPass bool, s2 test.Setup) {
+			h2 := s2.Handler
+			token := s2.GetToken(t, "repository:test1/foo:pull")
+
+			if firstPass {
+				test.MustExec(t, s2.DB, `UPDATE accounts SET manifest_cache_ttl_secs = $1 WHERE name = $2`, 86400, "test1")
+
+				// first pull replicates the tag
+				expectManifestExists(t, h2, token, "test1/foo", image1.Manifest, "latest", nil)
+
+				// when the tag is moved in the primary account, the replica still serves the
+				// cached manifest while the manifest cache TTL has not expired yet...
+				s1.Clock.StepBy(time.Hour)
+				image2.MustUpload(t, s1, fooRepoRef, "latest")
+				expectManifestExists(t, h2, token, "test1/foo", image1.Manifest, "latest", nil)
+
+				// ...but re-resolves the tag once the TTL has expired (we need to step
+				// over the max age of the inbound cache here, too)
+				s1.Clock.StepBy(25 * time.Hour)
+				expectManifestExists(t, h2, token, "test1/foo", image2.Manifest, "latest", nil)
+
+				// pulls by digest are not affected by the TTL
+				expectManifestExists(t, h2, token, "test1/foo", image1.Manifest, "", nil)
+			} else {
+				// when the upstream registry cannot be reached, an expired tag is
+				// still served from the cache
+				s1.Clock.StepBy(25 * time.Hour)
+				expectManifestExists(t, h2, token, "test1/foo", image2.Manifest, "latest", nil)
+				expectManifestExists(t, h2, token, "test1/foo", image1.Manifest, "", nil)
+			}
+		})
+	})
+}
+
 func TestReplicationImageListWithPlatformFilter(t *testing.T) {
 	testWithPrimary(t, nil, func(s1 test.Setup) {
 		// This test is mostly identical to TestReplicationImageList(), but the
@@ -252,3 +252,11 @@ func testWithAccountIsDeleting(t *testing.T, db *keppel.DB, accountName models.A
 	_, err = db.Exec("UPDATE accounts SET is_deleting = FALSE WHERE name = $1", accountName)
 	test.MustDo(t, err)
 }
+
+func testWithAccountIsReadOnly(t *testing.T, db *keppel.DB, accountName models.AccountName, action func()) {
+	_, err := db.Exec("UPDATE accounts SET is_read_only = TRUE WHERE name = $1", accountName)
+	test.MustDo(t, err)
+	action()
+	_, err = db.Exec("UPDATE accounts SET is_read_only = FALSE WHERE name = $1", accountName)
+	test.MustDo(t, err)
+}
@@ -9,11 +9,14 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"time"
 
 	distspecv1 "github.com/opencontainers/distribution-spec/specs-go/v1"
 	"github.com/sapcc/go-bits/httpapi"
 	"github.com/sapcc/go-bits/respondwith"
 	"github.com/sapcc/go-bits/sqlext"
+
+	"github.com/sapcc/keppel/internal/keppel"
 )
 
 var tagsListQuery = sqlext.SimplifyWhitespace(`
@@ -57,6 +60,7 @@ func (a *API) handleListTags(w http.ResponseWriter, r *http.Request) {
 
 	// list tags (we request one more than `limit` to see if we need to paginate)
 	tags := []string{}
+	startedAt := time.Now()
 	err = sqlext.ForeachRow(a.db, tagsListQuery, []any{repo.ID, marker, limit + 1}, func(rows *sql.Rows) error {
 		var tagName string
 		err = rows.Scan(&tagName)
@@ -65,6 +69,7 @@ func (a *API) handleListTags(w http.ResponseWriter, r *http.Request) {
 		}
 		return err
 	})
+	keppel.ObserveQueryDuration("tags_list", startedAt)
 	if respondWithError(w, r, err) {
 		return
 	}
@@ -69,6 +69,14 @@ func (a *API) handleStartBlobUpload(w http.ResponseWriter, r *http.Request) {
 		keppel.ErrUnsupported.With("account is being deleted").WithStatus(http.StatusMethodNotAllowed).WriteAsRegistryV2ResponseTo(w, r)
 		return
 	}
+	err = api.CheckAccountWritable(a.cfg, *account, false)
+	if respondWithError(w, r, err) {
+		return
+	}
+	err = api.CheckAccountPushEnabled(*account)
+	if respondWithError(w, r, err) {
+		return
+	}
 
 	// only allow new blob uploads when there is enough quota to push a manifest
 	//
@@ -192,6 +200,10 @@ func (a *API) performMonolithicUpload(w http.ResponseWriter, r *http.Request, ac
 		keppel.ErrDigestInvalid.With(err.Error()).WriteAsRegistryV2ResponseTo(w, r)
 		return false
 	}
+	if !a.cfg.IsDigestAlgorithmAccepted(blobDigest.Algorithm()) {
+		keppel.ErrDigestInvalid.With("digest algorithm %q is not accepted by this registry", blobDigest.Algorithm()).WriteAsRegistryV2ResponseTo(w, r)
+		return false
+	}
 
 	// parse Content-Length
 	sizeBytesStr := r.Header.Get("Content-Length")
@@ -212,7 +224,7 @@ func (a *API) performMonolithicUpload(w http.ResponseWriter, r *http.Request, ac
 		SizeBytes: 0,
 		NumChunks: 0,
 	}
-	dw := digestWriter{Hash: sha256.New()}
+	dw := digestWriter{Hash: blobDigest.Algorithm().Hash()}
 	err = a.processor().AppendToBlob(r.Context(), account, &upload, io.TeeReader(r.Body, &dw), &sizeBytes)
 	if err == nil {
 		err = a.sd.FinalizeBlob(r.Context(), account, upload.StorageID, upload.NumChunks)
@@ -221,7 +233,7 @@ func (a *API) performMonolithicUpload(w http.ResponseWriter, r *http.Request, ac
 		countAbortedBlobUpload(account)
 		err := a.sd.AbortBlobUpload(r.Context(), account, upload.StorageID, upload.NumChunks)
 		if err != nil {
-			logg.Error("additional error encountered while aborting blob upload %s into %s: %s", upload.StorageID, repo.FullName(), err.Error())
+			keppel.LogError(keppel.WithLogFields(r.Context(), keppel.LogFields{Account: account.Name}), "additional error encountered while aborting blob upload %s into %s: %s", upload.StorageID, repo.FullName(), err.Error())
 		}
 		return false
 	}
@@ -232,7 +244,7 @@ func (a *API) performMonolithicUpload(w http.ResponseWriter, r *http.Request, ac
 			countAbortedBlobUpload(account)
 			err := a.sd.DeleteBlob(r.Context(), account, upload.StorageID)
 			if err != nil {
-				logg.Error("additional error encountered while deleting broken blob %s from %s: %s", upload.StorageID, repo.FullName(), err.Error())
+				keppel.LogError(keppel.WithLogFields(r.Context(), keppel.LogFields{Account: account.Name}), "additional error encountered while deleting broken blob %s from %s: %s", upload.StorageID, repo.FullName(), err.Error())
 			}
 			return
 		}
@@ -244,11 +256,15 @@ func (a *API) performMonolithicUpload(w http.ResponseWriter, r *http.Request, ac
 		return false
 	}
 
-	actualDigest := digest.NewDigest(digest.SHA256, dw.Hash)
+	actualDigest := digest.NewDigest(blobDigest.Algorithm(), dw.Hash)
 	if actualDigest != blobDigest {
 		keppel.ErrDigestInvalid.With("expected %s, but actual digest was %s", blobDigest.String(), actualDigest.String()).WriteAsRegistryV2ResponseTo(w, r)
 		return false
 	}
+	err = a.processor().ValidatePushedBlob(r.Context(), account, upload.StorageID, blobDigest, sizeBytes)
+	if respondWithError(w, r, err) {
+		return false
+	}
 
 	// record blob in DB
 	tx, err := a.db.Begin()
@@ -367,6 +383,15 @@ func (a *API) handleContinueBlobUpload(w http.ResponseWriter, r *http.Request) {
 	if account == nil {
 		return
 	}
+	err := api.CheckAccountWritable(a.cfg, *account, false)
+	if respondWithError(w, r, err) {
+		return
+	}
+	// pushes may have been disabled while this upload was already in progress
+	err = api.CheckAccountPushEnabled(*account)
+	if respondWithError(w, r, err) {
+		return
+	}
 	upload := a.findUpload(w, r, *repo)
 	if upload == nil {
 		return
@@ -422,6 +447,15 @@ func (a *API) handleFinishBlobUpload(w http.ResponseWriter, r *http.Request) {
 	if account == nil {
 		return
 	}
+	err := api.CheckAccountWritable(a.cfg, *account, false)
+	if respondWithError(w, r, err) {
+		return
+	}
+	// pushes may have been disabled while this upload was already in progress
+	err = api.CheckAccountPushEnabled(*account)
+	if respondWithError(w, r, err) {
+		return
+	}
 	upload := a.findUpload(w, r, *repo)
 	if upload == nil {
 		return
@@ -458,7 +492,7 @@ func (a *API) handleFinishBlobUpload(w http.ResponseWriter, r *http.Request) {
 	// storage that the DB does not know about, but the storage sweep can clean
 	// that up later.
 	var blob *models.Blob
-	err := a.sd.FinalizeBlob(r.Context(), *account, upload.StorageID, upload.NumChunks)
+	err = a.sd.FinalizeBlob(r.Context(), *account, upload.StorageID, upload.NumChunks)
 	if err == nil {
 		blob, err = a.createBlobFromUpload(r.Context(), *account, *repo, *upload, query.Get("digest"))
 	}
@@ -664,8 +698,35 @@ func (a *API) createBlobFromUpload(ctx context.Context, account models.ReducedAc
 	if err != nil {
 		return nil, keppel.ErrDigestInvalid.With(err.Error())
 	}
-	if blobDigest.String() != upload.Digest {
-		return nil, keppel.ErrDigestInvalid.With("")
+	if !a.cfg.IsDigestAlgorithmAccepted(blobDigest.Algorithm()) {
+		return nil, keppel.ErrDigestInvalid.With("digest algorithm %q is not accepted by this registry", blobDigest.Algorithm())
+	}
+	if blobDigest.Algorithm() == digest.SHA256 {
+		if blobDigest.String() != upload.Digest {
+			return nil, keppel.ErrDigestInvalid.With("")
+		}
+	} else {
+		// the upload session state only tracks the SHA-256 digest, so for other
+		// algorithms, we need to read the finalized blob back from the storage
+		reader, _, err := a.sd.ReadBlob(ctx, account, upload.StorageID)
+		if err != nil {
+			return nil, err
+		}
+		actualDigest, err := blobDigest.Algorithm().FromReader(reader)
+		closeErr := reader.Close()
+		if err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return nil, err
+		}
+		if actualDigest != blobDigest {
+			return nil, keppel.ErrDigestInvalid.With("")
+		}
+	}
+	err = a.processor().ValidatePushedBlob(ctx, account, upload.StorageID, blobDigest, upload.SizeBytes)
+	if err != nil {
+		return nil, err
 	}
 
 	// prepare database changes
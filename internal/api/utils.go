@@ -31,7 +31,7 @@ func CheckRateLimit(r *http.Request, rle *keppel.RateLimitEngine, account models
 		return nil
 	}
 
-	result, err := rle.RateLimitAllows(r.Context(), httpext.GetRequesterIPFor(r), account, action, amount)
+	result, err := rle.RateLimitAllows(r.Context(), httpext.GetRequesterIPFor(r), account, userType, action, amount)
 	if err != nil {
 		return err
 	}
@@ -57,3 +57,46 @@ func GetTagPolicies(db *keppel.DB, account models.ReducedAccount) ([]keppel.TagP
 
 	return keppel.ParseTagPolicies(tagPoliciesStr)
 }
+
+// CheckAccountPullEnabled returns a 403 error if pulls from the given account have been disabled.
+func CheckAccountPullEnabled(account models.ReducedAccount) error {
+	if account.IsPullDisabled {
+		return keppel.ErrDenied.With("pulls from this account are disabled").WithStatus(http.StatusForbidden)
+	}
+	return nil
+}
+
+// CheckAccountPushEnabled returns a 403 error if pushes into the given account have been disabled.
+func CheckAccountPushEnabled(account models.ReducedAccount) error {
+	if account.IsPushDisabled {
+		return keppel.ErrDenied.With("pushes into this account are disabled").WithStatus(http.StatusForbidden)
+	}
+	return nil
+}
+
+// CheckAccountWritable returns a 503 error if writes into the given account are currently forbidden,
+// either because the account is still being created, because of the account's read-only flag,
+// or because the entire instance is in read-only mode.
+// Set isReplication for writes that are caused by replicating content into a replica account.
+func CheckAccountWritable(cfg keppel.Configuration, account models.ReducedAccount, isReplication bool) error {
+	if account.IsCreating {
+		return keppel.ErrUnavailable.With("account is still being created")
+	}
+	if !cfg.ReadOnly && !account.IsReadOnly {
+		return nil
+	}
+	if isReplication && cfg.ReadOnlyAllowsReplication {
+		return nil
+	}
+	return keppel.ErrUnavailable.With("account is in read-only mode")
+}
+
+// WithAccountCache wraps an HTTP handler such that repeated account lookups
+// within the same request are served from a request-scoped cache (see
+// keppel.WithAccountCache). This shall only be used for handlers that do not
+// modify accounts.
+func WithAccountCache(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		handler(w, r.WithContext(keppel.WithAccountCache(r.Context())))
+	}
+}
@@ -0,0 +1,103 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package auth
+
+import (
+	"fmt"
+
+	. "github.com/majewsky/gg/option"
+
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+// ActionDecision explains whether a single action in a repository scope would
+// be granted to a user, and why.
+type ActionDecision struct {
+	Action  string `json:"action"`
+	Granted bool   `json:"granted"`
+	Reason  string `json:"reason"`
+}
+
+// ExplainRepositoryScope evaluates a repository scope in the same way as
+// during token issuance, but instead of just filtering the requested actions,
+// it returns an explanation for each of them. Additionally, the list of
+// actions that would be included in a token is returned.
+//
+// This is used by the dry-run authorization check in the Auth API.
+func ExplainRepositoryScope(ip string, scope Scope, uid keppel.UserIdentity, audience Audience, db *keppel.DB) ([]ActionDecision, []string, error) {
+	repoScope := scope.ParseRepositoryScope(audience)
+	if repoScope.RepositoryName == "" {
+		decisions := make([]ActionDecision, len(scope.Actions))
+		for idx, action := range scope.Actions {
+			decisions[idx] = ActionDecision{Action: action, Granted: false, Reason: "scope does not refer to a valid repository"}
+		}
+		return decisions, nil, nil
+	}
+
+	eval, err := evaluateRepoOrTagActions(ip, repoScope.AccountName, repoScope.RepositoryName, None[string](), uid, db)
+	if err != nil {
+		return nil, nil, err
+	}
+	decisions := make([]ActionDecision, len(scope.Actions))
+	for idx, action := range scope.Actions {
+		decisions[idx] = ActionDecision{
+			Action:  action,
+			Granted: eval.IsAllowedAction[action],
+			Reason:  eval.explain(action),
+		}
+	}
+	return decisions, eval.GrantedActions(scope.Actions), nil
+}
+
+var permissionForAction = map[string]keppel.Permission{
+	"pull":   keppel.CanPullFromAccount,
+	"push":   keppel.CanPushToAccount,
+	"delete": keppel.CanDeleteFromAccount,
+}
+
+func (e repoActionsEvaluation) explain(action string) string {
+	if !e.AccountExists {
+		return "account does not exist"
+	}
+
+	if action == "anonymous_first_pull" {
+		if !e.IsAllowedAction["pull"] {
+			return `requires the "pull" action, which is not granted`
+		}
+		return e.explainOverride(keppel.RBACAnonymousFirstPullPermission, "not granted by any RBAC policy")
+	}
+
+	perm, exists := permissionForAction[action]
+	if !exists {
+		return "unknown action"
+	}
+	if action == "pull" {
+		if override, exists := e.Overrides[keppel.RBACAnonymousPullPermission]; exists && override.Granted {
+			return fmt.Sprintf(`granted through "anonymous_pull" by rbac_policies[%d]`, override.PolicyIndex)
+		}
+	}
+
+	var defaultReason string
+	switch {
+	case e.UserIdentity.UserType() == keppel.AnonymousUser:
+		defaultReason = "anonymous users can only obtain access through RBAC policies"
+	case e.UserIdentity.HasPermission(perm, e.AuthTenantID):
+		defaultReason = fmt.Sprintf("granted by the user's %q permission for the auth tenant of this account", string(perm))
+	default:
+		defaultReason = fmt.Sprintf("the user does not have the %q permission for the auth tenant of this account", string(perm))
+	}
+	return e.explainOverride(keppel.RBACPermission(action), defaultReason)
+}
+
+func (e repoActionsEvaluation) explainOverride(perm keppel.RBACPermission, defaultReason string) string {
+	override, exists := e.Overrides[perm]
+	switch {
+	case !exists:
+		return defaultReason
+	case override.Granted:
+		return fmt.Sprintf("granted by rbac_policies[%d]", override.PolicyIndex)
+	default:
+		return fmt.Sprintf("forbidden by rbac_policies[%d]", override.PolicyIndex)
+	}
+}
@@ -4,9 +4,12 @@
 package auth
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
+	"net/http"
+	"slices"
 
 	. "github.com/majewsky/gg/option"
 	"github.com/sapcc/go-bits/httpext"
@@ -18,7 +21,7 @@ import (
 // Produces a new ScopeSet containing only those scopes that the given
 // `uid` is permitted to access and only those actions therein which this `uid`
 // is permitted to perform.
-func filterAuthorized(ir IncomingRequest, uid keppel.UserIdentity, audience Audience, db *keppel.DB) (ScopeSet, error) {
+func filterAuthorized(ctx context.Context, ir IncomingRequest, uid keppel.UserIdentity, audience Audience, db *keppel.DB) (ScopeSet, error) {
 	result := make(ScopeSet, 0, len(ir.Scopes))
 	// make sure that additional scopes get appended at the end, on the offchance
 	// that a client might parse its token and look at access[0] to check for its
@@ -30,7 +33,7 @@ func filterAuthorized(ir IncomingRequest, uid keppel.UserIdentity, audience Audi
 		filtered := *scope
 		switch scope.ResourceType {
 		case "registry":
-			filtered.Actions, err = filterRegistryActions(uid, audience, db, scope, &additional)
+			filtered.Actions, err = filterRegistryActions(ctx, uid, audience, db, scope, &additional)
 			if err != nil {
 				return nil, err
 			}
@@ -48,12 +51,14 @@ func filterAuthorized(ir IncomingRequest, uid keppel.UserIdentity, audience Audi
 				filtered.Actions = PeerAPIScope.Actions
 			case scope.Contains(InfoAPIScope) && uid.UserType() != keppel.AnonymousUser:
 				filtered.Actions = InfoAPIScope.Actions
+			case scope.Contains(AdminAPIScope) && audience.AccountName == "" && !audience.IsAnycast && uid.HasPermission(keppel.CanAdministrateCluster, ""):
+				filtered.Actions = AdminAPIScope.Actions
 			default:
 				filtered.Actions = nil
 			}
 
 		case "keppel_account":
-			filtered.Actions, err = filterKeppelAccountActions(uid, audience, db, scope)
+			filtered.Actions, err = filterKeppelAccountActions(ctx, uid, audience, db, scope)
 			if err != nil {
 				return nil, err
 			}
@@ -80,7 +85,7 @@ func filterAuthorized(ir IncomingRequest, uid keppel.UserIdentity, audience Audi
 	return append(result, additional...), nil
 }
 
-func addCatalogAccess(ss *ScopeSet, uid keppel.UserIdentity, audience Audience, db *keppel.DB) error {
+func addCatalogAccess(ctx context.Context, ss *ScopeSet, uid keppel.UserIdentity, audience Audience, db *keppel.DB) error {
 	var accounts []models.Account
 	if audience.AccountName == "" {
 		// on the standard API, all accounts are potentially accessible
@@ -90,7 +95,7 @@ func addCatalogAccess(ss *ScopeSet, uid keppel.UserIdentity, audience Audience,
 		}
 	} else {
 		// on a domain-remapped API, only that API's account is accessible (if it exists)
-		account, err := keppel.FindAccount(db, audience.AccountName)
+		account, err := keppel.FindAccount(ctx, db, audience.AccountName)
 		if err != nil {
 			return err
 		}
@@ -112,7 +117,7 @@ func addCatalogAccess(ss *ScopeSet, uid keppel.UserIdentity, audience Audience,
 	return nil
 }
 
-func filterRegistryActions(uid keppel.UserIdentity, audience Audience, db *keppel.DB, scope *Scope, additional *ScopeSet) ([]string, error) {
+func filterRegistryActions(ctx context.Context, uid keppel.UserIdentity, audience Audience, db *keppel.DB, scope *Scope, additional *ScopeSet) ([]string, error) {
 	var filtered []string
 
 	if audience.IsAnycast {
@@ -135,7 +140,7 @@ func filterRegistryActions(uid keppel.UserIdentity, audience Audience, db *keppe
 
 	if scope.Contains(CatalogEndpointScope) {
 		filtered = CatalogEndpointScope.Actions
-		err := addCatalogAccess(additional, uid, audience, db)
+		err := addCatalogAccess(ctx, additional, uid, audience, db)
 		if err != nil {
 			return nil, err
 		}
@@ -152,46 +157,122 @@ func filterRepoActions(ip string, scope Scope, uid keppel.UserIdentity, audience
 		// without any slashes
 		return nil, nil
 	}
+	eval, err := evaluateRepoOrTagActions(ip, repoScope.AccountName, repoScope.RepositoryName, None[string](), uid, db)
+	if err != nil {
+		return nil, err
+	}
+	if audience.IsAnycast && eval.IsAnycastDisabled {
+		// accounts that opted out of anycast are treated as nonexistent on the anycast API
+		return nil, nil
+	}
+	return eval.GrantedActions(scope.Actions), nil
+}
+
+// FilterTagActions returns those of the given actions (out of "pull", "push"
+// and "delete") that the requesting user may perform on the given tag.
+//
+// Tokens are always issued for entire repositories, so RBAC policies with a
+// "match_tag" attribute can only be evaluated partially during token issuance:
+// Their grants are included in the token (so that e.g. the blobs of a tagged
+// image can be pulled), but their restrictions are not. Registry API handlers
+// must therefore call this function for all operations that address a tag.
+// Operations that address a digest are not subject to tag matching.
+//
+// If none of the account's RBAC policies has a "match_tag" attribute, the
+// evaluation cannot differ from the one during token issuance, so nil is
+// returned without evaluating anything to indicate that no restrictions apply
+// beyond those of the token.
+func FilterTagActions(r *http.Request, authz *Authorization, account models.ReducedAccount, repo models.Repository, tagName string, actions []string) ([]string, error) {
+	policies, err := keppel.ParseRBACPoliciesField(account.RBACPoliciesJSON)
+	if err != nil {
+		return nil, fmt.Errorf("while parsing account RBAC policies: %w", err)
+	}
+	if !slices.ContainsFunc(policies, func(p keppel.RBACPolicy) bool { return p.TagPattern != "" }) {
+		return nil, nil
+	}
+
+	ip := httpext.GetRequesterIPFor(r)
+	eval := evaluateRBACPolicies(ip, account.AuthTenantID, policies, repo.Name, Some(tagName), authz.UserIdentity)
+	return eval.GrantedActions(actions), nil
+}
+
+// The result of evaluating repository permissions in evaluateRepoOrTagActions().
+type repoActionsEvaluation struct {
+	AccountExists     bool
+	IsAnycastDisabled bool
+	UserIdentity      keppel.UserIdentity
+	AuthTenantID      string
+	// permission overrides from matching RBAC policies
+	Overrides       map[keppel.RBACPermission]rbacOverride
+	IsAllowedAction map[string]bool
+}
+
+type rbacOverride struct {
+	Granted bool
+	// index into the account's RBAC policies (only used for explanations)
+	PolicyIndex int
+}
 
+func evaluateRepoOrTagActions(ip string, accountName models.AccountName, repoName string, tagName Option[string], uid keppel.UserIdentity, db *keppel.DB) (repoActionsEvaluation, error) {
 	// NOTE: As an optimization, this only loads the few required fields for the account
 	// instead of the entire `accounts` row. Before this optimization, the loads
 	// via keppel.FindAccount() at this callsite made up 8% of all allocations
 	// performed by keppel-api.
 	var (
-		authTenantID     string
-		rbacPoliciesJSON string
+		authTenantID      string
+		rbacPoliciesJSON  string
+		isAnycastDisabled bool
 	)
 	err := db.QueryRow(
-		`SELECT auth_tenant_id, rbac_policies_json FROM accounts WHERE name = $1`,
-		repoScope.AccountName,
-	).Scan(&authTenantID, &rbacPoliciesJSON)
+		`SELECT auth_tenant_id, rbac_policies_json, is_anycast_disabled FROM accounts WHERE name = $1`,
+		accountName,
+	).Scan(&authTenantID, &rbacPoliciesJSON, &isAnycastDisabled)
 	if errors.Is(err, sql.ErrNoRows) {
 		// if the account does not exist, we cannot give access to it
 		// (this is not an error, because an error would leak information on which accounts exist)
-		return nil, nil
+		return repoActionsEvaluation{AccountExists: false, UserIdentity: uid}, nil
 	} else if err != nil {
-		return nil, err
+		return repoActionsEvaluation{}, err
 	}
 
-	// collect permission overrides from matching RBAC policies
 	policies, err := keppel.ParseRBACPoliciesField(rbacPoliciesJSON)
 	if err != nil {
-		return nil, fmt.Errorf("while parsing account RBAC policies: %w", err)
+		return repoActionsEvaluation{}, fmt.Errorf("while parsing account RBAC policies: %w", err)
 	}
-	permOverride := make(map[keppel.RBACPermission]Option[bool])
+	eval := evaluateRBACPolicies(ip, authTenantID, policies, repoName, tagName, uid)
+	eval.IsAnycastDisabled = isAnycastDisabled
+	return eval, nil
+}
+
+func evaluateRBACPolicies(ip, authTenantID string, policies []keppel.RBACPolicy, repoName string, tagName Option[string], uid keppel.UserIdentity) repoActionsEvaluation {
+	// collect permission overrides from matching RBAC policies
+	permOverride := make(map[keppel.RBACPermission]rbacOverride)
 	userName := uid.UserName()
-	for _, policy := range policies {
-		if !policy.Matches(ip, repoScope.RepositoryName, userName) {
+	for idx, policy := range policies {
+		if !policy.Matches(ip, repoName, userName) {
 			continue
 		}
+		grantedPermissions, forbiddenPermissions := policy.EffectivePermissions(repoName)
+		if policy.TagPattern != "" {
+			if tag, ok := tagName.Unpack(); ok {
+				if !policy.MatchesTag(tag) {
+					continue
+				}
+			} else {
+				// during token issuance, the tag is not known yet (see comment on FilterTagActions)
+				forbiddenPermissions = nil
+			}
+		}
 		// NOTE: forbidding overrides take precedence over granting overrides
-		for _, perm := range policy.Permissions {
-			if permOverride[perm] != Some(false) {
-				permOverride[perm] = Some(true)
+		for _, perm := range grantedPermissions {
+			if override, exists := permOverride[perm]; !exists || override.Granted {
+				permOverride[perm] = rbacOverride{Granted: true, PolicyIndex: idx}
 			}
 		}
-		for _, perm := range policy.ForbiddenPermissions {
-			permOverride[perm] = Some(false)
+		for _, perm := range forbiddenPermissions {
+			if override, exists := permOverride[perm]; !exists || override.Granted {
+				permOverride[perm] = rbacOverride{Granted: false, PolicyIndex: idx}
+			}
 		}
 	}
 
@@ -201,40 +282,51 @@ func filterRepoActions(ip string, scope Scope, uid keppel.UserIdentity, audience
 		delete(permOverride, keppel.RBACPushPermission)
 		delete(permOverride, keppel.RBACDeletePermission)
 	}
+	overrideOr := func(perm keppel.RBACPermission, defaultValue bool) bool {
+		override, exists := permOverride[perm]
+		if exists {
+			return override.Granted
+		}
+		return defaultValue
+	}
 
 	// evaluate final permission set
 	isAllowedAction := map[string]bool{
-		"pull": permOverride[keppel.RBACPullPermission].UnwrapOr(
-			uid.HasPermission(keppel.CanPullFromAccount, authTenantID),
-		),
-		"push": permOverride[keppel.RBACPushPermission].UnwrapOr(
-			uid.HasPermission(keppel.CanPushToAccount, authTenantID),
-		),
-		"delete": permOverride[keppel.RBACDeletePermission].UnwrapOr(
-			uid.HasPermission(keppel.CanDeleteFromAccount, authTenantID),
-		),
+		"pull":   overrideOr(keppel.RBACPullPermission, uid.HasPermission(keppel.CanPullFromAccount, authTenantID)),
+		"push":   overrideOr(keppel.RBACPushPermission, uid.HasPermission(keppel.CanPushToAccount, authTenantID)),
+		"delete": overrideOr(keppel.RBACDeletePermission, uid.HasPermission(keppel.CanDeleteFromAccount, authTenantID)),
 	}
-	if permOverride[keppel.RBACAnonymousPullPermission].UnwrapOr(false) {
+	if overrideOr(keppel.RBACAnonymousPullPermission, false) {
 		isAllowedAction["pull"] = true
 	}
 	if isAllowedAction["pull"] {
-		isAllowedAction["anonymous_first_pull"] = permOverride[keppel.RBACAnonymousFirstPullPermission].UnwrapOr(false)
+		isAllowedAction["anonymous_first_pull"] = overrideOr(keppel.RBACAnonymousFirstPullPermission, false)
 	}
 
-	// grant requested actions as possible
+	return repoActionsEvaluation{
+		AccountExists:   true,
+		UserIdentity:    uid,
+		AuthTenantID:    authTenantID,
+		Overrides:       permOverride,
+		IsAllowedAction: isAllowedAction,
+	}
+}
+
+// GrantedActions returns those of the requested actions that are allowed.
+func (e repoActionsEvaluation) GrantedActions(actions []string) []string {
 	var result []string
-	for _, action := range scope.Actions {
-		if isAllowedAction[action] {
+	for _, action := range actions {
+		if e.IsAllowedAction[action] {
 			result = append(result, action)
 		}
-		if action == "pull" && isAllowedAction["anonymous_first_pull"] {
+		if action == "pull" && e.IsAllowedAction["anonymous_first_pull"] {
 			result = append(result, "anonymous_first_pull")
 		}
 	}
-	return result, nil
+	return result
 }
 
-func filterKeppelAccountActions(uid keppel.UserIdentity, audience Audience, db *keppel.DB, scope *Scope) ([]string, error) {
+func filterKeppelAccountActions(ctx context.Context, uid keppel.UserIdentity, audience Audience, db *keppel.DB, scope *Scope) ([]string, error) {
 	if audience.AccountName != "" && scope.ResourceName != string(audience.AccountName) {
 		// domain-remapped APIs only allow access to that API's account
 		return nil, nil
@@ -245,7 +337,7 @@ func filterKeppelAccountActions(uid keppel.UserIdentity, audience Audience, db *
 		return nil, nil
 	}
 
-	account, err := keppel.FindAccount(db, models.AccountName(scope.ResourceName))
+	account, err := keppel.FindAccount(ctx, db, models.AccountName(scope.ResourceName))
 	if err != nil {
 		return nil, err
 	}
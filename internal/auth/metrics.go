@@ -0,0 +1,77 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package auth
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+var (
+	authDriverResultsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "keppel_auth_driver_results",
+			Help: "Counts authentication attempts that were handled by the auth driver.",
+		},
+		[]string{"driver", "method", "outcome"},
+	)
+	authDriverDurationHistogram = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "keppel_auth_driver_duration_seconds",
+			Help:    "Time taken by the auth driver to authenticate a user.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"driver", "method"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(authDriverResultsCounter)
+	prometheus.MustRegister(authDriverDurationHistogram)
+}
+
+// AuthenticateUser calls ad.AuthenticateUser() and records the outcome and
+// latency of the call in the auth driver metrics.
+func AuthenticateUser(ctx context.Context, ad keppel.AuthDriver, userName, password string) (keppel.UserIdentity, *keppel.RegistryV2Error) {
+	startedAt := time.Now()
+	uid, rerr := ad.AuthenticateUser(ctx, userName, password)
+	observeAuthDriverCall(ad, "basic", startedAt, rerr)
+	return uid, rerr
+}
+
+// AuthenticateUserFromRequest calls ad.AuthenticateUserFromRequest() and
+// records the outcome and latency of the call in the auth driver metrics.
+// Requests without any credentials for the auth driver (i.e. when the driver
+// returns neither a UserIdentity nor an error) are not recorded.
+func AuthenticateUserFromRequest(ad keppel.AuthDriver, r *http.Request) (keppel.UserIdentity, *keppel.RegistryV2Error) {
+	startedAt := time.Now()
+	uid, rerr := ad.AuthenticateUserFromRequest(r)
+	if uid != nil || rerr != nil {
+		observeAuthDriverCall(ad, "request", startedAt, rerr)
+	}
+	return uid, rerr
+}
+
+func observeAuthDriverCall(ad keppel.AuthDriver, method string, startedAt time.Time, rerr *keppel.RegistryV2Error) {
+	labels := prometheus.Labels{"driver": ad.PluginTypeID(), "method": method}
+	authDriverDurationHistogram.With(labels).Observe(time.Since(startedAt).Seconds())
+
+	// rejected credentials are a "failure", whereas all other errors indicate
+	// that the auth driver could not make a decision (e.g. because its backend
+	// is unavailable)
+	switch {
+	case rerr == nil:
+		labels["outcome"] = "success"
+	case rerr.Code == keppel.ErrUnauthorized || rerr.Code == keppel.ErrDenied:
+		labels["outcome"] = "failure"
+	default:
+		labels["outcome"] = "error"
+	}
+	authDriverResultsCounter.With(labels).Inc()
+}
@@ -0,0 +1,94 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/redis/go-redis/v9"
+	"github.com/sapcc/go-bits/assert"
+
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+// metricsTestAuthDriver is a minimal keppel.AuthDriver. (We cannot use
+// test.AuthDriver here because package test imports this package.)
+type metricsTestAuthDriver struct{}
+
+func (metricsTestAuthDriver) PluginTypeID() string                             { return "metrics-test" }
+func (metricsTestAuthDriver) Init(ctx context.Context, rc *redis.Client) error { return nil }
+
+func (metricsTestAuthDriver) AuthenticateUser(ctx context.Context, userName, password string) (keppel.UserIdentity, *keppel.RegistryV2Error) {
+	switch password {
+	case "correct":
+		return AnonymousUserIdentity, nil
+	case "unavailable":
+		return nil, keppel.ErrUnavailable.With("backend is down")
+	default:
+		return nil, keppel.ErrUnauthorized.With("wrong credentials")
+	}
+}
+
+func (d metricsTestAuthDriver) AuthenticateUserFromRequest(r *http.Request) (keppel.UserIdentity, *keppel.RegistryV2Error) {
+	password := r.Header.Get("X-Test-Password")
+	if password == "" {
+		return nil, nil
+	}
+	return d.AuthenticateUser(r.Context(), "", password)
+}
+
+func TestAuthDriverMetrics(t *testing.T) {
+	ad := metricsTestAuthDriver{}
+
+	getCount := func(method, outcome string) float64 {
+		t.Helper()
+		var m dto.Metric
+		labels := prometheus.Labels{"driver": "metrics-test", "method": method, "outcome": outcome}
+		err := authDriverResultsCounter.With(labels).Write(&m)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return m.GetCounter().GetValue()
+	}
+	getObservationCount := func(method string) uint64 {
+		t.Helper()
+		var m dto.Metric
+		labels := prometheus.Labels{"driver": "metrics-test", "method": method}
+		err := authDriverDurationHistogram.With(labels).(prometheus.Histogram).Write(&m)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return m.GetHistogram().GetSampleCount()
+	}
+
+	// AuthenticateUser: all calls are recorded
+	for _, password := range []string{"correct", "correct", "wrong", "unavailable"} {
+		_, _ = AuthenticateUser(t.Context(), ad, "user", password)
+	}
+	assert.DeepEqual(t, "basic success count", getCount("basic", "success"), 2.0)
+	assert.DeepEqual(t, "basic failure count", getCount("basic", "failure"), 1.0)
+	assert.DeepEqual(t, "basic error count", getCount("basic", "error"), 1.0)
+	assert.DeepEqual(t, "basic observation count", getObservationCount("basic"), uint64(4))
+
+	// AuthenticateUserFromRequest: requests without credentials are not recorded
+	for _, password := range []string{"correct", "wrong", "wrong", ""} {
+		r := httptest.NewRequest(http.MethodGet, "/keppel/v1/peers", http.NoBody)
+		if password != "" {
+			r.Header.Set("X-Test-Password", password)
+		}
+		uid, rerr := AuthenticateUserFromRequest(ad, r)
+		if password == "" && (uid != nil || rerr != nil) {
+			t.Errorf("expected no result for request without credentials, but got uid = %v, rerr = %v", uid, rerr)
+		}
+	}
+	assert.DeepEqual(t, "request success count", getCount("request", "success"), 1.0)
+	assert.DeepEqual(t, "request failure count", getCount("request", "failure"), 2.0)
+	assert.DeepEqual(t, "request error count", getCount("request", "error"), 0.0)
+	assert.DeepEqual(t, "request observation count", getObservationCount("request"), uint64(3))
+}
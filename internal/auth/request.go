@@ -108,7 +108,7 @@ func (ir IncomingRequest) Authorize(ctx context.Context, cfg keppel.Configuratio
 		if err != nil {
 			return nil, nil, keppel.AsRegistryV2Error(err)
 		}
-		authz, err = ir.authorizeViaUserIdentity(uid, audience, db)
+		authz, err = ir.authorizeViaUserIdentity(ctx, uid, audience, db)
 		if err != nil {
 			return nil, nil, keppel.AsRegistryV2Error(err)
 		}
@@ -116,17 +116,24 @@ func (ir IncomingRequest) Authorize(ctx context.Context, cfg keppel.Configuratio
 	case strings.HasPrefix(authHeader, "Bearer "):
 		// clearly a request for token auth
 		var rerr *keppel.RegistryV2Error
-		authz, rerr = parseToken(cfg, ad, audience, strings.TrimPrefix(authHeader, "Bearer "))
+		var tokenID string
+		authz, tokenID, rerr = parseToken(cfg, ad, audience, strings.TrimPrefix(authHeader, "Bearer "))
 		if rerr != nil {
 			return nil, nil, challenge.AddTo(rerr)
 		}
+		if cfg.TrackIssuedTokens {
+			err := checkTokenRevocation(db, tokenID)
+			if err != nil {
+				return nil, nil, challenge.AddTo(keppel.AsRegistryV2Error(err))
+			}
+		}
 		tokenFound = true
 		allowChallenge = true
 
 	case authHeader == "" || authHeader == "keppel":
 		// possibly a request for driver auth, but fallback on AnonymousUserIdentity
 		// if driver auth does not detect any matching headers
-		uid, rerr := ad.AuthenticateUserFromRequest(r)
+		uid, rerr := AuthenticateUserFromRequest(ad, r)
 		if rerr != nil {
 			return nil, nil, rerr
 		}
@@ -144,7 +151,7 @@ func (ir IncomingRequest) Authorize(ctx context.Context, cfg keppel.Configuratio
 		}
 
 		var err error
-		authz, err = ir.authorizeViaUserIdentity(uid, audience, db)
+		authz, err = ir.authorizeViaUserIdentity(ctx, uid, audience, db)
 		if err != nil {
 			return nil, nil, keppel.AsRegistryV2Error(err)
 		}
@@ -230,7 +237,7 @@ func checkBasicAuth(ctx context.Context, authHeader string, ad keppel.AuthDriver
 	}
 
 	// recognize regular user credentials
-	uid, rerr := ad.AuthenticateUser(ctx, userName, password)
+	uid, rerr := AuthenticateUser(ctx, ad, userName, password)
 	return uid, safelyReturnRegistryError(rerr)
 }
 
@@ -245,8 +252,8 @@ func safelyReturnRegistryError(rerr *keppel.RegistryV2Error) error {
 	return rerr
 }
 
-func (ir IncomingRequest) authorizeViaUserIdentity(uid keppel.UserIdentity, audience Audience, db *keppel.DB) (*Authorization, error) {
-	ss, err := filterAuthorized(ir, uid, audience, db)
+func (ir IncomingRequest) authorizeViaUserIdentity(ctx context.Context, uid keppel.UserIdentity, audience Audience, db *keppel.DB) (*Authorization, error) {
+	ss, err := filterAuthorized(ctx, ir, uid, audience, db)
 	if err != nil {
 		return nil, err
 	}
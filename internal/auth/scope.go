@@ -123,3 +123,10 @@ var InfoAPIScope = Scope{
 	ResourceName: "info",
 	Actions:      []string{"access"},
 }
+
+// AdminAPIScope is the Scope for all endpoints below `/keppel/v1/admin/`.
+var AdminAPIScope = Scope{
+	ResourceType: "keppel_api",
+	ResourceName: "admin",
+	Actions:      []string{"access"},
+}
@@ -32,6 +32,10 @@ func (ss ScopeSet) Contains(s Scope) bool {
 
 // Add adds a scope to this ScopeSet. If the ScopeSet already contains a Scope
 // referring to the same resource, it is merged with the given scope.
+//
+// The ScopeSet is thus always in canonical form: There is at most one Scope
+// per resource, and each Scope lists each of its actions exactly once, in the
+// order in which they were first added.
 func (ss *ScopeSet) Add(s Scope) {
 	if len(s.Actions) == 0 {
 		return
@@ -42,22 +46,25 @@ func (ss *ScopeSet) Add(s Scope) {
 			return
 		}
 	}
+	// the actions need to be copied in any case, to ensure that later merges
+	// do not write into a slice that is still owned by the caller
+	s.Actions = mergeAndDedupActions(nil, s.Actions)
 	*ss = append(*ss, &s)
 }
 
-func mergeAndDedupActions(lhs, rhs []string) (result []string) {
-	seen := make(map[string]bool)
-	for _, elem := range append(lhs, rhs...) {
-		if seen[elem] {
-			continue
+func mergeAndDedupActions(lhs, rhs []string) []string {
+	result := make([]string, 0, len(lhs)+len(rhs))
+	for _, elem := range slices.Concat(lhs, rhs) {
+		if !slices.Contains(result, elem) {
+			result = append(result, elem)
 		}
-		result = append(result, elem)
-		seen[elem] = true
 	}
-	return
+	return result
 }
 
-// Flatten returns the scope set as a plain list of scopes.
+// Flatten returns the scope set as a plain list of scopes. Since the ScopeSet
+// is in canonical form (see Add), this list is minimal: Each resource appears
+// only once, and without duplicate actions.
 func (ss ScopeSet) Flatten() []Scope {
 	if len(ss) == 0 {
 		return nil
@@ -65,6 +72,7 @@ func (ss ScopeSet) Flatten() []Scope {
 	result := make([]Scope, len(ss))
 	for idx, s := range ss {
 		result[idx] = *s
+		result[idx].Actions = slices.Clone(s.Actions)
 	}
 	return result
 }
@@ -72,6 +80,7 @@ func (ss ScopeSet) Flatten() []Scope {
 // AccountsWithCatalogAccess returns the names of all accounts whose contents
 // can be listed with the access level in this ScopeSet. If `markerAccountName`
 // is not empty, only accounts with `name > markerAccountName` will be returned.
+// Since there is only one Scope per resource, each account is returned at most once.
 //
 // For use with the /v2/_catalog endpoint.
 func (ss ScopeSet) AccountsWithCatalogAccess(markerAccountName models.AccountName) []models.AccountName {
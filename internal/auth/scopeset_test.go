@@ -0,0 +1,49 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package auth
+
+import (
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+
+	"github.com/sapcc/keppel/internal/models"
+)
+
+func TestScopeSetCanonicalization(t *testing.T) {
+	pullActions := []string{"pull", "pull"}
+	ss := NewScopeSet(
+		Scope{ResourceType: "repository", ResourceName: "test1/foo", Actions: pullActions},
+		Scope{ResourceType: "keppel_account", ResourceName: "test1", Actions: []string{"view"}},
+		Scope{ResourceType: "repository", ResourceName: "test1/foo", Actions: []string{"push", "pull"}},
+		Scope{ResourceType: "repository", ResourceName: "test1/bar", Actions: []string{"pull"}},
+		Scope{ResourceType: "keppel_account", ResourceName: "test1", Actions: []string{"view", "view"}},
+		Scope{ResourceType: "repository", ResourceName: "test1/bar", Actions: nil},
+		Scope{ResourceType: "repository", ResourceName: "test1/baz", Actions: []string{}},
+		Scope{ResourceType: "keppel_account", ResourceName: "test2", Actions: []string{"view", "change"}},
+		Scope{ResourceType: "repository", ResourceName: "test1/foo", Actions: []string{"delete", "push"}},
+	)
+
+	assert.DeepEqual(t, "flattened scopes", ss.Flatten(), []Scope{
+		{ResourceType: "repository", ResourceName: "test1/foo", Actions: []string{"pull", "push", "delete"}},
+		{ResourceType: "keppel_account", ResourceName: "test1", Actions: []string{"view"}},
+		{ResourceType: "repository", ResourceName: "test1/bar", Actions: []string{"pull"}},
+		{ResourceType: "keppel_account", ResourceName: "test2", Actions: []string{"view", "change"}},
+	})
+	assert.DeepEqual(t, "accounts with catalog access", ss.AccountsWithCatalogAccess(""), []models.AccountName{"test1", "test2"})
+
+	// merging must not write into slices owned by the caller...
+	assert.DeepEqual(t, "input actions", pullActions, []string{"pull", "pull"})
+	// ...and the flattened list must not share slices with the ScopeSet
+	flattened := ss.Flatten()
+	flattened[0].Actions[0] = "*"
+	assert.DeepEqual(t, "actions after modifying flattened list", ss.Flatten()[0].Actions, []string{"pull", "push", "delete"})
+
+	// a canonical ScopeSet is not changed by re-adding its own scopes
+	ss2 := NewScopeSet(ss.Flatten()...)
+	for _, s := range ss.Flatten() {
+		ss2.Add(s)
+	}
+	assert.DeepEqual(t, "flattened scopes after re-adding", ss2.Flatten(), ss.Flatten())
+}
@@ -31,25 +31,25 @@ type tokenClaims struct {
 	Embedded embeddedUserIdentity `json:"kea"` // kea = keppel embedded authorization ("UserIdentity" used to be called "Authorization")
 }
 
-func parseToken(cfg keppel.Configuration, ad keppel.AuthDriver, audience Audience, tokenStr string) (*Authorization, *keppel.RegistryV2Error) {
+// parseToken returns the Authorization contained in the token, as well as the
+// token's ID (its "jti" claim).
+func parseToken(cfg keppel.Configuration, ad keppel.AuthDriver, audience Audience, tokenStr string) (*Authorization, string, *keppel.RegistryV2Error) {
 	// this function is used by jwt.ParseWithClaims() to select which public key to use for validation
 	keyFunc := func(t *jwt.Token) (any, error) {
 		// check the token header to see which key we used for signing
-		ourIssuerKeys := audience.IssuerKeys(cfg)
-		for _, ourIssuerKey := range ourIssuerKeys {
-			if t.Header["jwk"] == serializePublicKey(ourIssuerKey) {
-				// check that the signing method matches what we generate
-				ourSigningMethod := chooseSigningMethod(ourIssuerKey)
-				if !equalSigningMethods(ourSigningMethod, t.Method) {
-					return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
-				}
-
-				// jwt.Parse needs the public key to validate the token
-				return derivePublicKey(ourIssuerKey), nil
-			}
+		ourIssuerKey, ok := findIssuerKey(audience.IssuerKeys(cfg), t.Header)
+		if !ok {
+			return nil, errors.New("token signed by unknown key")
+		}
+
+		// check that the signing method matches what we generate
+		ourSigningMethod := chooseSigningMethod(ourIssuerKey.PrivateKey)
+		if !equalSigningMethods(ourSigningMethod, t.Method) {
+			return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
 		}
 
-		return nil, errors.New("token signed by unknown key")
+		// jwt.Parse needs the public key to validate the token
+		return derivePublicKey(ourIssuerKey.PrivateKey), nil
 	}
 
 	// parse JWT
@@ -69,12 +69,12 @@ func parseToken(cfg keppel.Configuration, ad keppel.AuthDriver, audience Audienc
 	claims.Embedded.AuthDriver = ad
 	token, err := jwt.ParseWithClaims(tokenStr, &claims, keyFunc, parserOpts...)
 	if err != nil {
-		return nil, keppel.ErrUnauthorized.With(err.Error())
+		return nil, "", keppel.ErrUnauthorized.With(err.Error())
 	}
 	if !token.Valid {
 		//NOTE: This branch is defense in depth. As of the time of this writing,
 		// token.Valid == false if and only if err != nil.
-		return nil, keppel.ErrUnauthorized.With("token invalid")
+		return nil, "", keppel.ErrUnauthorized.With("token invalid")
 	}
 
 	var ss ScopeSet
@@ -85,7 +85,7 @@ func parseToken(cfg keppel.Configuration, ad keppel.AuthDriver, audience Audienc
 		UserIdentity: claims.Embedded.UserIdentity,
 		ScopeSet:     ss,
 		Audience:     audience,
-	}, nil
+	}, claims.ID, nil
 }
 
 // TokenResponse is the format expected by Docker in an auth response. The Token
@@ -94,6 +94,11 @@ type TokenResponse struct {
 	Token     string `json:"token"`
 	ExpiresIn uint64 `json:"expires_in"`
 	IssuedAt  string `json:"issued_at"`
+
+	// not serialized, only used by TrackIssuedToken()
+	id        string
+	issuedAt  time.Time
+	expiresAt time.Time
 }
 
 // IssueToken renders the given Authorization into a JWT token that can be used
@@ -113,7 +118,7 @@ func (a Authorization) IssueTokenWithExpires(cfg keppel.Configuration, expiresIn
 		return nil, errors.New("no issuer keys configured for this audience")
 	}
 	issuerKey := issuerKeys[0]
-	method := chooseSigningMethod(issuerKey)
+	method := chooseSigningMethod(issuerKey.PrivateKey)
 
 	// fill the "issuer" field with a dummy audience that has anycast forced to
 	// false to reveal the identity of the Keppel API that issued the token
@@ -139,17 +144,44 @@ func (a Authorization) IssueTokenWithExpires(cfg keppel.Configuration, expiresIn
 		Embedded: embeddedUserIdentity{UserIdentity: a.UserIdentity},
 	})
 	// we need to remember which key we used for this token, to choose the right
-	// key for validation during parseToken()
-	token.Header["jwk"] = serializePublicKey(issuerKey)
+	// key for validation during parseToken() (the "jwk" header is always
+	// included for the benefit of Keppel instances that do not know about key IDs)
+	token.Header["jwk"] = serializePublicKey(issuerKey.PrivateKey)
+	if issuerKey.ID != "" {
+		token.Header["kid"] = issuerKey.ID
+	}
 
-	tokenStr, err := token.SignedString(issuerKey)
+	tokenStr, err := token.SignedString(issuerKey.PrivateKey)
 	return &TokenResponse{
 		Token:     tokenStr,
 		ExpiresIn: uint64(expiresAt.Sub(now).Seconds()),
 		IssuedAt:  now.Format(time.RFC3339),
+		id:        uuidV4.String(),
+		issuedAt:  now,
+		expiresAt: expiresAt,
 	}, err
 }
 
+// findIssuerKey selects the key that was used to sign a token, based on the
+// token's header. The explicit key ID in the "kid" header takes precedence,
+// but tokens without a matching key ID are still identified by the public key
+// in the "jwk" header, which all tokens issued by Keppel have.
+func findIssuerKey(keys []keppel.IssuerKey, header map[string]any) (keppel.IssuerKey, bool) {
+	if keyID, ok := header["kid"].(string); ok && keyID != "" {
+		for _, key := range keys {
+			if key.ID == keyID {
+				return key, true
+			}
+		}
+	}
+	for _, key := range keys {
+		if header["jwk"] == serializePublicKey(key.PrivateKey) {
+			return key, true
+		}
+	}
+	return keppel.IssuerKey{}, false
+}
+
 func chooseSigningMethod(key crypto.PrivateKey) jwt.SigningMethod {
 	switch key.(type) {
 	case ed25519.PrivateKey:
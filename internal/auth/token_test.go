@@ -0,0 +1,51 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+func TestFindIssuerKey(t *testing.T) {
+	generateKey := func(id string) keppel.IssuerKey {
+		_, privkey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return keppel.IssuerKey{ID: id, PrivateKey: privkey}
+	}
+	currentKey := generateKey("current")
+	previousKey := generateKey("previous")
+	unnamedKey := generateKey("")
+	keys := []keppel.IssuerKey{currentKey, previousKey, unnamedKey}
+
+	testCases := []struct {
+		Description string
+		Header      map[string]any
+		ExpectedKey keppel.IssuerKey
+		ExpectFound bool
+	}{
+		{"selection by kid", map[string]any{"kid": "previous"}, previousKey, true},
+		{"kid takes precedence over jwk", map[string]any{"kid": "previous", "jwk": serializePublicKey(currentKey.PrivateKey)}, previousKey, true},
+		{"fallback to jwk for unknown kid", map[string]any{"kid": "unknown", "jwk": serializePublicKey(currentKey.PrivateKey)}, currentKey, true},
+		{"selection by jwk only", map[string]any{"jwk": serializePublicKey(unnamedKey.PrivateKey)}, unnamedKey, true},
+		{"unknown kid without jwk", map[string]any{"kid": "unknown"}, keppel.IssuerKey{}, false},
+		{"unknown jwk", map[string]any{"jwk": serializePublicKey(generateKey("").PrivateKey)}, keppel.IssuerKey{}, false},
+	}
+
+	for _, tc := range testCases {
+		key, found := findIssuerKey(keys, tc.Header)
+		assert.DeepEqual(t, tc.Description+": found", found, tc.ExpectFound)
+		assert.DeepEqual(t, tc.Description+": key ID", key.ID, tc.ExpectedKey.ID)
+		if found {
+			assert.DeepEqual(t, tc.Description+": public key", serializePublicKey(key.PrivateKey), serializePublicKey(tc.ExpectedKey.PrivateKey))
+		}
+	}
+}
@@ -0,0 +1,122 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	. "github.com/majewsky/gg/option"
+	"github.com/sapcc/go-bits/sqlext"
+
+	"github.com/sapcc/keppel/internal/keppel"
+	"github.com/sapcc/keppel/internal/models"
+)
+
+// TrackIssuedToken records a token that was issued for this Authorization in
+// the `issued_tokens` table, so that it can be listed and revoked through the
+// Keppel API. This shall only be called if cfg.TrackIssuedTokens is set.
+//
+// The token is recorded once for each auth tenant owning an account that is
+// covered by the token's scopes. Tokens that do not refer to any account (e.g.
+// for the catalog endpoint) and tokens for anonymous users are not recorded.
+func (a Authorization) TrackIssuedToken(ctx context.Context, db *keppel.DB, resp TokenResponse) error {
+	if a.UserIdentity.UserType() == keppel.AnonymousUser {
+		return nil
+	}
+
+	// find the auth tenants of all accounts covered by the scopes in one go
+	var accountNames []string
+	for _, scope := range a.ScopeSet {
+		accountName := a.findAccountNameForScope(*scope)
+		if accountName != "" {
+			accountNames = append(accountNames, string(accountName))
+		}
+	}
+	authTenantIDByAccountName := make(map[models.AccountName]string, len(accountNames))
+	if len(accountNames) > 0 {
+		err := sqlext.ForeachRow(db, trackIssuedTokenAccountsQuery, []any{pq.Array(accountNames)}, func(rows *sql.Rows) error {
+			var (
+				accountName  models.AccountName
+				authTenantID string
+			)
+			err := rows.Scan(&accountName, &authTenantID)
+			if err != nil {
+				return err
+			}
+			authTenantIDByAccountName[accountName] = authTenantID
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	var (
+		authTenantIDs []string
+		scopeStrs     []string
+	)
+	for _, scope := range a.ScopeSet {
+		var authTenantID string
+		if scope.ResourceType == "keppel_auth_tenant" {
+			authTenantID = scope.ResourceName
+		} else {
+			authTenantID = authTenantIDByAccountName[a.findAccountNameForScope(*scope)]
+		}
+		if authTenantID != "" && !slices.Contains(authTenantIDs, authTenantID) {
+			authTenantIDs = append(authTenantIDs, authTenantID)
+		}
+		scopeStrs = append(scopeStrs, scope.String())
+	}
+
+	for _, authTenantID := range authTenantIDs {
+		err := db.Insert(&models.IssuedToken{
+			ID:           resp.id,
+			AuthTenantID: authTenantID,
+			UserName:     a.UserIdentity.UserName(),
+			Scopes:       strings.Join(scopeStrs, " "),
+			IssuedAt:     resp.issuedAt,
+			ExpiresAt:    resp.expiresAt,
+			RevokedAt:    None[time.Time](),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var trackIssuedTokenAccountsQuery = `SELECT name, auth_tenant_id FROM accounts WHERE name = ANY($1)`
+
+func (a Authorization) findAccountNameForScope(scope Scope) models.AccountName {
+	switch scope.ResourceType {
+	case "keppel_account":
+		return models.AccountName(scope.ResourceName)
+	case "repository":
+		return scope.ParseRepositoryScope(a.Audience).AccountName
+	default:
+		return ""
+	}
+}
+
+// checkTokenRevocation is only called if cfg.TrackIssuedTokens is set, since
+// revocations are recorded in the same table as the tracked tokens. This costs
+// one database roundtrip per request that is authenticated with a token.
+func checkTokenRevocation(db *keppel.DB, tokenID string) error {
+	isRevoked, err := db.SelectBool(
+		`SELECT EXISTS(SELECT 1 FROM issued_tokens WHERE id = $1 AND revoked_at IS NOT NULL)`,
+		tokenID,
+	)
+	if err != nil {
+		return err
+	}
+	if isRevoked {
+		return keppel.ErrUnauthorized.With("token has been revoked")
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package auth
+
+import (
+	"errors"
+	"slices"
+
+	"github.com/sapcc/go-bits/audittools"
+
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+// NewSimulatedUserIdentity returns a keppel.UserIdentity for a regular user
+// with the given name, who has the given permissions for all auth tenants.
+//
+// This is used by the dry-run authorization check in the Auth API to evaluate
+// access rules on behalf of users described by an operator. Since it does not
+// correspond to an actual authenticated user, it cannot be serialized into a
+// token.
+func NewSimulatedUserIdentity(userName string, perms []keppel.Permission) keppel.UserIdentity {
+	return simulatedUserIdentity{userName, perms}
+}
+
+type simulatedUserIdentity struct {
+	userName string
+	perms    []keppel.Permission
+}
+
+// PluginTypeID implements the keppel.UserIdentity interface.
+func (simulatedUserIdentity) PluginTypeID() string {
+	return "simulated"
+}
+
+// HasPermission implements the keppel.UserIdentity interface.
+func (uid simulatedUserIdentity) HasPermission(perm keppel.Permission, tenantID string) bool {
+	return tenantID != "" && slices.Contains(uid.perms, perm)
+}
+
+// UserType implements the keppel.UserIdentity interface.
+func (simulatedUserIdentity) UserType() keppel.UserType {
+	return keppel.RegularUser
+}
+
+// UserName implements the keppel.UserIdentity interface.
+func (uid simulatedUserIdentity) UserName() string {
+	return uid.userName
+}
+
+// UserInfo implements the keppel.UserIdentity interface.
+func (simulatedUserIdentity) UserInfo() audittools.UserInfo {
+	return nil
+}
+
+// SerializeToJSON implements the keppel.UserIdentity interface.
+func (simulatedUserIdentity) SerializeToJSON() (payload []byte, err error) {
+	return nil, errors.New("simulated user identities cannot be serialized")
+}
+
+// DeserializeFromJSON implements the keppel.UserIdentity interface.
+func (simulatedUserIdentity) DeserializeFromJSON(in []byte, _ keppel.AuthDriver) error {
+	return errors.New("simulated user identities cannot be deserialized")
+}
@@ -0,0 +1,49 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package client
+
+import (
+	"net/http"
+	"net/url"
+)
+
+func (c *RepoClient) authHeaderFor(host string) string {
+	if host == c.Host {
+		return c.authHeader
+	}
+	return c.peerAuthHeaders[host]
+}
+
+func (c *RepoClient) setAuthHeaderFor(host, authHeader string) {
+	if host == c.Host {
+		c.authHeader = authHeader
+		return
+	}
+	if c.peerAuthHeaders == nil {
+		c.peerAuthHeaders = make(map[string]string)
+	}
+	c.peerAuthHeaders[host] = authHeader
+}
+
+// rememberPeerAffinity inspects a successful response to see if the request
+// for the given path was redirected to a different registry host serving the
+// same path. If so, subsequent requests for that path will be sent to that
+// host directly.
+//
+// Redirects to a different path (e.g. to a storage backend) are not
+// considered since those URLs are usually only valid for a short time.
+func (c *RepoClient) rememberPeerAffinity(r repoRequest, path string, resp *http.Response) {
+	if !r.isReadOnly() || resp.Request == nil {
+		return
+	}
+	finalURL := resp.Request.URL
+	if finalURL.Host == c.Host || finalURL.Path != path {
+		return
+	}
+
+	if c.peerAffinity == nil {
+		c.peerAffinity = make(map[string]string)
+	}
+	c.peerAffinity[r.Path] = (&url.URL{Scheme: finalURL.Scheme, Host: finalURL.Host}).String()
+}
@@ -0,0 +1,110 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package client
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/sapcc/go-bits/assert"
+
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+func TestRedirectHostAffinity(t *testing.T) {
+	blobContents := []byte("hello world")
+	blobDigest := digest.FromBytes(blobContents)
+	blobPath := "/v2/foo/blobs/" + blobDigest.String()
+
+	var (
+		anycastHits  []string
+		peerHits     []string
+		peerHasBlob  = true
+		anycastProxy = true
+	)
+	serveBlob := func(w http.ResponseWriter) {
+		w.Header().Set("Content-Length", fmt.Sprint(len(blobContents)))
+		w.WriteHeader(http.StatusOK)
+		w.Write(blobContents) //nolint:errcheck
+	}
+
+	// the peer holds the blob and requires its own token
+	var peer *httptest.Server
+	peer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			fmt.Fprint(w, `{"token":"peer-token"}`)
+			return
+		}
+		peerHits = append(peerHits, r.URL.Path)
+		if r.Header.Get("Authorization") != "Bearer peer-token" {
+			w.Header().Set("Www-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="peer",scope="repository:foo:pull"`, peer.URL))
+			keppel.ErrUnauthorized.With("no token").WriteAsRegistryV2ResponseTo(w, r)
+			return
+		}
+		if r.URL.Path == blobPath && peerHasBlob {
+			serveBlob(w)
+		} else {
+			keppel.ErrBlobUnknown.With("").WriteAsRegistryV2ResponseTo(w, r)
+		}
+	}))
+	defer peer.Close()
+
+	// the anycast endpoint redirects to the peer (unless told otherwise)
+	anycast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		anycastHits = append(anycastHits, r.URL.Path)
+		if anycastProxy {
+			http.Redirect(w, r, peer.URL+r.URL.Path, http.StatusTemporaryRedirect)
+		} else {
+			serveBlob(w)
+		}
+	}))
+	defer anycast.Close()
+
+	c := &RepoClient{
+		Scheme:   "http",
+		Host:     strings.TrimPrefix(anycast.URL, "http://"),
+		RepoName: "foo",
+	}
+	downloadBlob := func() {
+		t.Helper()
+		reader, _, err := c.DownloadBlob(t.Context(), blobDigest)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer reader.Close()
+		buf, err := io.ReadAll(reader)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		assert.DeepEqual(t, "blob contents", string(buf), string(blobContents))
+	}
+
+	// first download goes through the anycast endpoint, then authenticates with the peer
+	downloadBlob()
+	assert.DeepEqual(t, "anycast hits", anycastHits, []string{blobPath})
+	assert.DeepEqual(t, "peer hits", peerHits, []string{blobPath, blobPath})
+
+	// subsequent downloads go directly to the peer, with the existing token
+	downloadBlob()
+	downloadBlob()
+	assert.DeepEqual(t, "anycast hits", anycastHits, []string{blobPath})
+	assert.DeepEqual(t, "peer hits", peerHits, []string{blobPath, blobPath, blobPath, blobPath})
+
+	// if the peer cannot serve the blob anymore, we fall back to the anycast endpoint
+	peerHasBlob = false
+	anycastProxy = false
+	downloadBlob()
+	assert.DeepEqual(t, "anycast hits", anycastHits, []string{blobPath, blobPath})
+	assert.DeepEqual(t, "peer hits", len(peerHits), 5)
+
+	// ...and since there was no redirect this time, the affinity is gone
+	downloadBlob()
+	assert.DeepEqual(t, "anycast hits", anycastHits, []string{blobPath, blobPath, blobPath})
+	assert.DeepEqual(t, "peer hits", len(peerHits), 5)
+}
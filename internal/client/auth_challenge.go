@@ -20,6 +20,9 @@ import (
 // AuthChallenge contains the parsed contents of a Www-Authenticate header
 // returned by a registry.
 type AuthChallenge struct {
+	// Scheme is either "Bearer" (for the token-exchange flow) or "Basic" (for
+	// registries that expect credentials on each request).
+	Scheme  string
 	Realm   string
 	Service string
 	Scope   string
@@ -34,13 +37,18 @@ func ParseAuthChallenge(hdr http.Header) (AuthChallenge, error) {
 	if input == "" {
 		return AuthChallenge{}, errors.New("missing Www-Authenticate header")
 	}
-	if !strings.HasPrefix(input, "Bearer ") {
-		parts := strings.SplitN(input, " ", 2)
-		return AuthChallenge{}, fmt.Errorf("cannot handle Www-Authenticate challenge of type %q", parts[0])
+	scheme, input, _ := strings.Cut(input, " ")
+	switch {
+	case strings.EqualFold(scheme, "Bearer"):
+		scheme = "Bearer"
+	case strings.EqualFold(scheme, "Basic"):
+		scheme = "Basic"
+	default:
+		return AuthChallenge{}, fmt.Errorf("cannot handle Www-Authenticate challenge of type %q", scheme)
 	}
-	input = strings.TrimSpace(strings.TrimPrefix(input, "Bearer "))
+	input = strings.TrimSpace(input)
 
-	var c AuthChallenge
+	c := AuthChallenge{Scheme: scheme}
 
 	for input != "" {
 		// find next challenge field (because of the ^ anchor, this always yields a
@@ -64,20 +72,40 @@ func ParseAuthChallenge(hdr http.Header) (AuthChallenge, error) {
 		}
 	}
 
+	if c.Scheme == "Basic" {
+		// Basic challenges only have an informational realm, and no token endpoint
+		return c, nil
+	}
 	if c.Realm == "" {
 		return AuthChallenge{}, fmt.Errorf("missing realm in Www-Authenticate: Bearer %s", input)
 	}
 	if c.Service == "" {
 		return AuthChallenge{}, fmt.Errorf("missing service in Www-Authenticate: Bearer %s", input)
 	}
-	if c.Scope == "" {
-		return AuthChallenge{}, fmt.Errorf("missing scope in Www-Authenticate: Bearer %s", input)
-	}
+	// NOTE: The scope is optional because it is not given in challenges for the toplevel API endpoint (GET /v2/).
 	return c, nil
 }
 
-// GetToken obtains a token that satisfies this challenge.
-func (c AuthChallenge) GetToken(ctx context.Context, userName, password string) (string, error) {
+// GetAuthorizationHeader returns the value for the Authorization header that
+// satisfies this challenge. For Bearer challenges, a token is obtained using
+// the given HTTP client. For Basic challenges, the credentials are used
+// directly.
+func (c AuthChallenge) GetAuthorizationHeader(ctx context.Context, httpClient *http.Client, userName, password string) (string, error) {
+	if c.Scheme == "Basic" {
+		if userName == "" {
+			return "", errors.New("registry requires basic auth, but no credentials are configured")
+		}
+		return keppel.BuildBasicAuthHeader(userName, password), nil
+	}
+	token, err := c.GetToken(ctx, httpClient, userName, password)
+	if err != nil {
+		return "", err
+	}
+	return "Bearer " + token, nil
+}
+
+// GetToken obtains a token that satisfies this Bearer challenge, using the given HTTP client.
+func (c AuthChallenge) GetToken(ctx context.Context, httpClient *http.Client, userName, password string) (string, error) {
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.Realm, http.NoBody)
 	if err != nil {
 		return "", err
@@ -87,10 +115,12 @@ func (c AuthChallenge) GetToken(ctx context.Context, userName, password string)
 	}
 	q := make(url.Values)
 	q.Set("service", c.Service)
-	q.Set("scope", c.Scope)
+	if c.Scope != "" {
+		q.Set("scope", c.Scope)
+	}
 	req.URL.RawQuery = q.Encode()
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		return "", err
 	}
@@ -104,6 +134,10 @@ func (c AuthChallenge) GetToken(ctx context.Context, userName, password string)
 		return "", err
 	}
 
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint returned status %s", resp.Status)
+	}
+
 	var data struct {
 		AccessToken string `json:"access_token"`
 		Token       string `json:"token"`
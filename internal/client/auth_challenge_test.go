@@ -0,0 +1,156 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+
+	"github.com/sapcc/keppel/internal/keppel"
+	"github.com/sapcc/keppel/internal/models"
+)
+
+// tokenRegistry is a mock upstream registry that challenges for repo-scoped
+// tokens, and only accepts tokens for the repository that they were issued for.
+type tokenRegistry struct {
+	url          string
+	issuedScopes []string
+}
+
+func (s *tokenRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/token" {
+		scope := r.URL.Query().Get("scope")
+		s.issuedScopes = append(s.issuedScopes, scope)
+		fmt.Fprintf(w, `{"token":%q}`, "token-for-"+scope)
+		return
+	}
+
+	repoName, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v2/"), "/manifests/")
+	scope := fmt.Sprintf("repository:%s:pull", repoName)
+	if r.Header.Get("Authorization") != "Bearer token-for-"+scope {
+		w.Header().Set("Www-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="upstream",scope="%s"`, s.url, scope))
+		keppel.ErrUnauthorized.With("").WriteAsRegistryV2ResponseTo(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "{}")
+}
+
+func TestPerRepoTokenAcquisition(t *testing.T) {
+	upstream := &tokenRegistry{}
+	srv := httptest.NewServer(upstream)
+	defer srv.Close()
+	upstream.url = srv.URL
+
+	newClient := func(repoName string) *RepoClient {
+		return &RepoClient{
+			Scheme:   "http",
+			Host:     strings.TrimPrefix(srv.URL, "http://"),
+			RepoName: repoName,
+			UserName: "user",
+			Password: "pass",
+		}
+	}
+	downloadManifest := func(c *RepoClient) {
+		t.Helper()
+		_, _, err := c.DownloadManifest(t.Context(), models.ManifestReference{Tag: "latest"}, nil)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	// each repo obtains its own token, and reuses it for subsequent requests
+	fooClient := newClient("library/foo")
+	barClient := newClient("library/bar")
+	downloadManifest(fooClient)
+	downloadManifest(barClient)
+	downloadManifest(fooClient)
+	downloadManifest(barClient)
+	assert.DeepEqual(t, "issued scopes", upstream.issuedScopes, []string{
+		"repository:library/foo:pull",
+		"repository:library/bar:pull",
+	})
+
+	// a token for one repo does not work for another
+	barClient.SetToken("token-for-repository:library/foo:pull")
+	downloadManifest(barClient)
+	assert.DeepEqual(t, "issued scopes", upstream.issuedScopes, []string{
+		"repository:library/foo:pull",
+		"repository:library/bar:pull",
+		"repository:library/bar:pull",
+	})
+}
+
+func TestBasicAuthChallenge(t *testing.T) {
+	var authHeaders []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authHeaders = append(authHeaders, r.Header.Get("Authorization"))
+		userName, password, ok := r.BasicAuth()
+		if !ok || userName != "user" || password != "pass" {
+			w.Header().Set("Www-Authenticate", `Basic realm="Upstream Registry"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, "{}")
+	}))
+	defer srv.Close()
+
+	c := &RepoClient{
+		Scheme:   "http",
+		Host:     strings.TrimPrefix(srv.URL, "http://"),
+		RepoName: "library/foo",
+		UserName: "user",
+		Password: "pass",
+	}
+	for range 2 {
+		_, _, err := c.DownloadManifest(t.Context(), models.ManifestReference{Tag: "latest"}, nil)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	// the first request is challenged, the second one already carries the credentials
+	basicAuth := keppel.BuildBasicAuthHeader("user", "pass")
+	assert.DeepEqual(t, "Authorization headers", authHeaders, []string{"", basicAuth, basicAuth})
+
+	// without credentials, the challenge cannot be answered
+	c = &RepoClient{
+		Scheme:   "http",
+		Host:     strings.TrimPrefix(srv.URL, "http://"),
+		RepoName: "library/foo",
+	}
+	_, _, err := c.DownloadManifest(t.Context(), models.ManifestReference{Tag: "latest"}, nil)
+	expectErrorString(t, err, "authentication failed: registry requires basic auth, but no credentials are configured")
+}
+
+func TestParseAuthChallenge(t *testing.T) {
+	testCases := map[string]AuthChallenge{
+		`Bearer realm="https://auth.example.org/token",service="registry.example.org",scope="repository:foo:pull"`: {
+			Scheme:  "Bearer",
+			Realm:   "https://auth.example.org/token",
+			Service: "registry.example.org",
+			Scope:   "repository:foo:pull",
+		},
+		`Basic realm="Upstream Registry"`: {Scheme: "Basic", Realm: "Upstream Registry"},
+		`basic realm="Upstream Registry"`: {Scheme: "Basic", Realm: "Upstream Registry"},
+	}
+	for input, expected := range testCases {
+		actual, err := ParseAuthChallenge(http.Header{"Www-Authenticate": {input}})
+		if err != nil {
+			t.Errorf("unexpected error for %q: %s", input, err.Error())
+			continue
+		}
+		assert.DeepEqual(t, "ParseAuthChallenge("+input+")", actual, expected)
+	}
+
+	_, err := ParseAuthChallenge(http.Header{"Www-Authenticate": {`Negotiate abcdef`}})
+	expectErrorString(t, err, `cannot handle Www-Authenticate challenge of type "Negotiate"`)
+}
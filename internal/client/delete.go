@@ -0,0 +1,59 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/sapcc/keppel/internal/keppel"
+	"github.com/sapcc/keppel/internal/models"
+)
+
+// DeleteManifest deletes a manifest from this repository. The reference should
+// usually be a digest, since not all registries support deleting tags.
+//
+// On failure, the error is always a *keppel.RegistryV2Error. Callers can
+// distinguish the most common failure modes by its code:
+// keppel.ErrManifestUnknown if the manifest does not exist,
+// keppel.ErrDenied if the operation was not permitted, and
+// keppel.ErrUnsupported if the registry does not allow deletion at all.
+func (c *RepoClient) DeleteManifest(ctx context.Context, reference models.ManifestReference) error {
+	resp, err := c.doRequest(ctx, repoRequest{
+		Method:       http.MethodDelete,
+		Path:         "manifests/" + reference.String(),
+		ExpectStatus: http.StatusAccepted,
+	})
+	if err != nil {
+		return asRegistryV2Error(err, reference)
+	}
+	return resp.Body.Close()
+}
+
+// asRegistryV2Error normalizes errors returned by doRequest into a
+// *keppel.RegistryV2Error, even if the registry did not return an error
+// document in the response body.
+func asRegistryV2Error(err error, reference models.ManifestReference) *keppel.RegistryV2Error {
+	var rerr *keppel.RegistryV2Error
+	if errors.As(err, &rerr) {
+		return rerr
+	}
+
+	var serr unexpectedStatusCodeError
+	if !errors.As(err, &serr) {
+		return keppel.ErrUnknown.WithError(err)
+	}
+	switch serr.actualStatusCode {
+	case http.StatusNotFound:
+		rerr = keppel.ErrManifestUnknown.With("").WithDetail(reference.String())
+	case http.StatusUnauthorized, http.StatusForbidden:
+		rerr = keppel.ErrDenied.WithError(err)
+	case http.StatusMethodNotAllowed:
+		rerr = keppel.ErrUnsupported.WithError(err)
+	default:
+		rerr = keppel.ErrUnknown.WithError(err)
+	}
+	return rerr.WithStatus(serr.actualStatusCode)
+}
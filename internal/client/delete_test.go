@@ -0,0 +1,96 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+
+	"github.com/sapcc/keppel/internal/keppel"
+	"github.com/sapcc/keppel/internal/models"
+)
+
+func TestDeleteManifest(t *testing.T) {
+	existingDigest := "sha256:7afe57cc71e06b56e9fea34f33a587449cb323edbae285daeb4ce27ef75d0792"
+	protectedDigest := "sha256:95bfc2536236f7e9b8b9de57626261558acee7e7f5163858236573187c12d100"
+	plainErrorDigest := "sha256:3f7e1acccded9243812450eced5ee1e59385d5433662e4434311cc27655daa43"
+
+	// mock registry that requires a bearer token for all requests
+	var deletedPaths []string
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			if r.Header.Get("Authorization") != keppel.BuildBasicAuthHeader("user", "secret") {
+				http.Error(w, "wrong credentials", http.StatusUnauthorized)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"token":"valid-token"}`)
+			return
+		}
+		w.Header().Set("Www-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="example",scope="repository:foo:delete"`, srv.URL))
+		if r.Header.Get("Authorization") != "Bearer valid-token" {
+			keppel.ErrUnauthorized.With("no token").WriteAsRegistryV2ResponseTo(w, r)
+			return
+		}
+
+		switch strings.TrimPrefix(r.URL.Path, "/v2/foo/manifests/") {
+		case existingDigest:
+			deletedPaths = append(deletedPaths, r.URL.Path)
+			w.WriteHeader(http.StatusAccepted)
+		case protectedDigest:
+			keppel.ErrDenied.With("manifest is protected").WriteAsRegistryV2ResponseTo(w, r)
+		case plainErrorDigest:
+			// some registries return errors without an error document
+			http.Error(w, "nope", http.StatusMethodNotAllowed)
+		default:
+			keppel.ErrManifestUnknown.With("").WriteAsRegistryV2ResponseTo(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	c := &RepoClient{
+		Scheme:   "http",
+		Host:     strings.TrimPrefix(srv.URL, "http://"),
+		RepoName: "foo",
+		UserName: "user",
+		Password: "secret",
+	}
+	expectCode := func(err error, code keppel.RegistryV2ErrorCode) {
+		t.Helper()
+		var rerr *keppel.RegistryV2Error
+		if !errors.As(err, &rerr) {
+			t.Errorf("expected RegistryV2Error with code %s, but got %#v", code, err)
+			return
+		}
+		assert.DeepEqual(t, "error code", rerr.Code, code)
+	}
+
+	// happy case
+	err := c.DeleteManifest(t.Context(), models.ParseManifestReference(existingDigest))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "deleted paths", deletedPaths, []string{"/v2/foo/manifests/" + existingDigest})
+
+	// error cases
+	err = c.DeleteManifest(t.Context(), models.ParseManifestReference("sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"))
+	expectCode(err, keppel.ErrManifestUnknown)
+	err = c.DeleteManifest(t.Context(), models.ParseManifestReference(protectedDigest))
+	expectCode(err, keppel.ErrDenied)
+	err = c.DeleteManifest(t.Context(), models.ParseManifestReference(plainErrorDigest))
+	expectCode(err, keppel.ErrUnsupported)
+
+	// error case: wrong credentials
+	c = &RepoClient{Scheme: "http", Host: c.Host, RepoName: "foo", UserName: "user", Password: "wrong"}
+	err = c.DeleteManifest(t.Context(), models.ParseManifestReference(existingDigest))
+	expectCode(err, keppel.ErrUnknown)
+	assert.DeepEqual(t, "deleted paths", len(deletedPaths), 1)
+}
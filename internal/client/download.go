@@ -5,6 +5,8 @@ package client
 
 import (
 	"context"
+	"errors"
+	"hash"
 	"io"
 	"net/http"
 	"strconv"
@@ -18,6 +20,11 @@ import (
 
 // DownloadBlob fetches a blob's contents from this repository. If an error is
 // returned, it's usually a *keppel.RegistryV2Error.
+//
+// If the registry reports a different digest in the Docker-Content-Digest
+// header, keppel.ErrDigestInvalid is returned. The returned reader also checks
+// the digest of the blob contents, and fails with keppel.ErrDigestInvalid
+// instead of returning io.EOF if they do not match the requested digest.
 func (c *RepoClient) DownloadBlob(ctx context.Context, blobDigest digest.Digest) (contents io.ReadCloser, sizeBytes uint64, returnErr error) {
 	resp, err := c.doRequest(ctx, repoRequest{
 		Method:       "GET",
@@ -32,7 +39,16 @@ func (c *RepoClient) DownloadBlob(ctx context.Context, blobDigest digest.Digest)
 		resp.Body.Close()
 		return nil, 0, err
 	}
-	return resp.Body, sizeBytes, nil
+	err = checkDigestHeader(resp.Header, blobDigest)
+	if err != nil {
+		resp.Body.Close()
+		return nil, 0, err
+	}
+	return &digestVerifyingReader{
+		inner:    resp.Body,
+		expected: blobDigest,
+		hash:     blobDigest.Algorithm().Hash(),
+	}, sizeBytes, nil
 }
 
 // DownloadManifestOpts appears in func DownloadManifest.
@@ -43,6 +59,10 @@ type DownloadManifestOpts struct {
 
 // DownloadManifest fetches a manifest from this repository. If an error is
 // returned, it's usually a *keppel.RegistryV2Error.
+//
+// If the manifest is requested by digest, or if the registry reports a digest
+// in the Docker-Content-Digest header, the manifest contents are checked
+// against that digest, and keppel.ErrDigestInvalid is returned on mismatch.
 func (c *RepoClient) DownloadManifest(ctx context.Context, reference models.ManifestReference, opts *DownloadManifestOpts) (contents []byte, mediaType string, returnErr error) {
 	if opts == nil {
 		opts = &DownloadManifestOpts{}
@@ -79,5 +99,67 @@ func (c *RepoClient) DownloadManifest(ctx context.Context, reference models.Mani
 		return nil, "", err
 	}
 
+	if reference.IsDigest() {
+		err = checkDigestHeader(resp.Header, reference.Digest)
+		if err == nil {
+			err = checkDigestOfContents(respBytes, reference.Digest)
+		}
+	} else if headerDigest, parseErr := digest.Parse(resp.Header.Get("Docker-Content-Digest")); parseErr == nil {
+		err = checkDigestOfContents(respBytes, headerDigest)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
 	return respBytes, resp.Header.Get("Content-Type"), nil
 }
+
+// checkDigestHeader checks that the Docker-Content-Digest header, if present,
+// matches the digest that we asked for. Digests with a different algorithm
+// cannot be compared and are therefore ignored.
+func checkDigestHeader(hdr http.Header, expected digest.Digest) error {
+	headerDigest, err := digest.Parse(hdr.Get("Docker-Content-Digest"))
+	if err != nil || headerDigest.Algorithm() != expected.Algorithm() {
+		return nil
+	}
+	if headerDigest != expected {
+		return keppel.ErrDigestInvalid.With("expected digest %s, but Docker-Content-Digest header reports %s", expected, headerDigest)
+	}
+	return nil
+}
+
+func checkDigestOfContents(contents []byte, expected digest.Digest) error {
+	if !expected.Algorithm().Available() {
+		return keppel.ErrDigestInvalid.With("unsupported digest algorithm: %s", expected.Algorithm())
+	}
+	actual := expected.Algorithm().FromBytes(contents)
+	if actual != expected {
+		return keppel.ErrDigestInvalid.With("expected digest %s, but actual digest is %s", expected, actual)
+	}
+	return nil
+}
+
+// digestVerifyingReader wraps the response body in DownloadBlob.
+type digestVerifyingReader struct {
+	inner    io.ReadCloser
+	expected digest.Digest
+	hash     hash.Hash
+}
+
+// Read implements the io.Reader interface.
+func (r *digestVerifyingReader) Read(buf []byte) (int, error) {
+	n, err := r.inner.Read(buf)
+	r.hash.Write(buf[:n])
+	if errors.Is(err, io.EOF) {
+		actual := digest.NewDigest(r.expected.Algorithm(), r.hash)
+		if actual != r.expected {
+			return n, keppel.ErrDigestInvalid.With("expected digest %s, but actual digest is %s", r.expected, actual)
+		}
+	}
+	return n, err
+}
+
+// Close implements the io.Closer interface.
+func (r *digestVerifyingReader) Close() error {
+	return r.inner.Close()
+}
@@ -0,0 +1,110 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/sapcc/go-bits/assert"
+
+	"github.com/sapcc/keppel/internal/keppel"
+	"github.com/sapcc/keppel/internal/models"
+)
+
+func TestDownloadVerifiesDigest(t *testing.T) {
+	goodContents := []byte(`{"hello":"world"}`)
+	goodDigest := digest.FromBytes(goodContents)
+	otherDigest := digest.FromString("something else")
+
+	// the mock registry serves `contents` for every blob and manifest,
+	// and reports `headerDigest` in the Docker-Content-Digest header (if set)
+	var (
+		contents     []byte
+		headerDigest digest.Digest
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if headerDigest != "" {
+			w.Header().Set("Docker-Content-Digest", headerDigest.String())
+		}
+		w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+		w.Header().Set("Content-Length", fmt.Sprint(len(contents)))
+		w.WriteHeader(http.StatusOK)
+		w.Write(contents) //nolint:errcheck
+	}))
+	defer srv.Close()
+
+	c := &RepoClient{
+		Scheme:   "http",
+		Host:     strings.TrimPrefix(srv.URL, "http://"),
+		RepoName: "foo",
+	}
+	downloadBlob := func() ([]byte, error) {
+		reader, _, err := c.DownloadBlob(t.Context(), goodDigest)
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		return io.ReadAll(reader)
+	}
+	downloadManifest := func(ref models.ManifestReference) ([]byte, error) {
+		buf, _, err := c.DownloadManifest(t.Context(), ref, nil)
+		return buf, err
+	}
+	byDigest := models.ManifestReference{Digest: goodDigest}
+	byTag := models.ManifestReference{Tag: "latest"}
+
+	// happy case: contents and header match
+	contents = goodContents
+	headerDigest = goodDigest
+	buf, err := downloadBlob()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "blob contents", string(buf), string(goodContents))
+	buf, err = downloadManifest(byDigest)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "manifest contents", string(buf), string(goodContents))
+	_, err = downloadManifest(byTag)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// error case: header reports a different digest
+	headerDigest = otherDigest
+	_, err = downloadBlob()
+	expectDigestInvalid(t, err)
+	_, err = downloadManifest(byDigest)
+	expectDigestInvalid(t, err)
+	_, err = downloadManifest(byTag)
+	expectDigestInvalid(t, err)
+
+	// error case: contents do not match the requested digest (with or without header)
+	contents = []byte(`{"hello":"tampered"}`)
+	for _, hdr := range []digest.Digest{"", goodDigest} {
+		headerDigest = hdr
+		_, err = downloadBlob()
+		expectDigestInvalid(t, err)
+		_, err = downloadManifest(byDigest)
+		expectDigestInvalid(t, err)
+	}
+}
+
+func expectDigestInvalid(t *testing.T, err error) {
+	t.Helper()
+	var rerr *keppel.RegistryV2Error
+	if err == nil {
+		t.Error("expected DIGEST_INVALID error, but got no error")
+	} else if !errors.As(err, &rerr) || rerr.Code != keppel.ErrDigestInvalid {
+		t.Errorf("expected DIGEST_INVALID error, but got %q", err.Error())
+	}
+}
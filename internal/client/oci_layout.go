@@ -0,0 +1,171 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/opencontainers/go-digest"
+	imagespecs "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/sapcc/keppel/internal/keppel"
+	"github.com/sapcc/keppel/internal/models"
+)
+
+// OCILayout provides read access to an image stored on the local filesystem in
+// the OCI image layout format, as described in
+// <https://github.com/opencontainers/image-spec/blob/main/image-layout.md>.
+// Such directories are created e.g. by `skopeo copy docker://... oci:<path>`.
+//
+// OCILayout offers the same validation methods as RepoClient, so that images
+// can be validated before they are pushed into a registry.
+type OCILayout struct {
+	Path string
+}
+
+// ReadIndex reads and parses the index.json file of this OCI layout.
+func (l OCILayout) ReadIndex() (imagespecs.Index, error) {
+	var index imagespecs.Index
+	buf, err := os.ReadFile(filepath.Join(l.Path, "oci-layout"))
+	if err != nil {
+		return index, fmt.Errorf("not an OCI layout: %w", err)
+	}
+	var layout imagespecs.ImageLayout
+	err = json.Unmarshal(buf, &layout)
+	if err != nil {
+		return index, fmt.Errorf("cannot parse %s: %w", filepath.Join(l.Path, "oci-layout"), err)
+	}
+	if layout.Version != imagespecs.ImageLayoutVersion {
+		return index, fmt.Errorf("unsupported OCI layout version: %q", layout.Version)
+	}
+
+	buf, err = os.ReadFile(filepath.Join(l.Path, "index.json"))
+	if err != nil {
+		return index, err
+	}
+	err = json.Unmarshal(buf, &index)
+	if err != nil {
+		return index, fmt.Errorf("cannot parse %s: %w", filepath.Join(l.Path, "index.json"), err)
+	}
+	return index, nil
+}
+
+func (l OCILayout) blobPath(blobDigest digest.Digest) (string, error) {
+	err := blobDigest.Validate()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(l.Path, "blobs", blobDigest.Algorithm().String(), blobDigest.Encoded()), nil
+}
+
+// DownloadBlob reads a blob's contents from this OCI layout. If the blob does
+// not exist, keppel.ErrBlobUnknown is returned.
+func (l OCILayout) DownloadBlob(_ context.Context, blobDigest digest.Digest) (contents io.ReadCloser, sizeBytes uint64, returnErr error) {
+	path, err := l.blobPath(blobDigest)
+	if err != nil {
+		return nil, 0, keppel.ErrDigestInvalid.With(err.Error())
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, 0, keppel.ErrBlobUnknown.With("").WithDetail(blobDigest.String())
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, uint64(fi.Size()), nil //nolint:gosec // file sizes are never negative
+}
+
+// DownloadManifest reads a manifest from this OCI layout. Tags are resolved
+// through the "org.opencontainers.image.ref.name" annotation in index.json.
+// If the manifest does not exist, keppel.ErrManifestUnknown is returned.
+//
+// The opts argument only exists for symmetry with RepoClient and is ignored.
+func (l OCILayout) DownloadManifest(_ context.Context, reference models.ManifestReference, _ *DownloadManifestOpts) (contents []byte, mediaType string, returnErr error) {
+	index, err := l.ReadIndex()
+	if err != nil {
+		return nil, "", err
+	}
+
+	manifestDigest := reference.Digest
+	if reference.IsTag() {
+		for _, desc := range index.Manifests {
+			if desc.Annotations[imagespecs.AnnotationRefName] == reference.Tag {
+				manifestDigest = desc.Digest
+				mediaType = desc.MediaType
+				break
+			}
+		}
+		if manifestDigest == "" {
+			return nil, "", keppel.ErrManifestUnknown.With("").WithDetail(reference.Tag)
+		}
+	}
+
+	path, err := l.blobPath(manifestDigest)
+	if err != nil {
+		return nil, "", keppel.ErrDigestInvalid.With(err.Error())
+	}
+	contents, err = os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, "", keppel.ErrManifestUnknown.With("").WithDetail(manifestDigest.String())
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	// for manifests that are not listed in index.json (e.g. submanifests of an
+	// image index), the media type needs to be taken from the manifest itself
+	if mediaType == "" {
+		mediaType = sniffManifestMediaType(contents)
+	}
+	return contents, mediaType, nil
+}
+
+func sniffManifestMediaType(contents []byte) string {
+	var data struct {
+		MediaType string            `json:"mediaType"`
+		Manifests []json.RawMessage `json:"manifests"`
+	}
+	err := json.Unmarshal(contents, &data)
+	switch {
+	case err != nil:
+		// let keppel.ParseManifest() report the actual error
+		return imagespecs.MediaTypeImageManifest
+	case data.MediaType != "":
+		return data.MediaType
+	case data.Manifests != nil:
+		// the mediaType field is optional for OCI manifests, so guess from the structure
+		return imagespecs.MediaTypeImageIndex
+	default:
+		return imagespecs.MediaTypeImageManifest
+	}
+}
+
+func (l OCILayout) validationCacheKey(digestOrTagName string) string {
+	// see comment in RepoClient.validationCacheKey
+	return fmt.Sprintf("oci:%s/%s", l.Path, digestOrTagName)
+}
+
+// ValidateManifest reads the given manifest from this OCI layout and verifies
+// that it parses correctly. It also validates all referenced manifests and
+// blobs recursively, in the same way as RepoClient.ValidateManifest.
+func (l OCILayout) ValidateManifest(ctx context.Context, reference models.ManifestReference, session *ValidationSession, platformFilter models.PlatformFilter) error {
+	return validateManifest(ctx, l, reference, 0, session.applyDefaults(), platformFilter)
+}
+
+// ValidateBlobContents reads the given blob from this OCI layout and verifies
+// that the contents produce the correct digest.
+func (l OCILayout) ValidateBlobContents(ctx context.Context, blobDigest digest.Digest, session *ValidationSession) error {
+	return validateBlobContents(ctx, l, blobDigest, 0, session.applyDefaults())
+}
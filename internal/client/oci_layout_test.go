@@ -0,0 +1,103 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package client
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/sapcc/go-bits/assert"
+
+	"github.com/sapcc/keppel/internal/models"
+)
+
+const (
+	fixtureLayerDigest    = "sha256:95bfc2536236f7e9b8b9de57626261558acee7e7f5163858236573187c12d100"
+	fixtureManifestDigest = "sha256:7afe57cc71e06b56e9fea34f33a587449cb323edbae285daeb4ce27ef75d0792"
+)
+
+func TestValidateOCILayout(t *testing.T) {
+	layout := OCILayout{Path: "fixtures/oci-layout"}
+
+	index, err := layout.ReadIndex()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "number of manifests in index", len(index.Manifests), 2)
+
+	// validating a single image checks the manifest, config and layer
+	var session ValidationSession
+	err = layout.ValidateManifest(t.Context(), models.ManifestReference{Tag: "1.0"}, &session, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "stats", session.Stats().Manifests, uint64(1))
+	assert.DeepEqual(t, "stats", session.Stats().Blobs, uint64(2))
+
+	// validating the image index recurses into the same image (whose media type
+	// is not given in index.json and thus needs to be sniffed)
+	session = ValidationSession{}
+	err = layout.ValidateManifest(t.Context(), models.ManifestReference{Tag: "list"}, &session, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "stats", session.Stats().Manifests, uint64(2))
+	assert.DeepEqual(t, "stats", session.Stats().Blobs, uint64(2))
+
+	// validation by digest works as well
+	err = layout.ValidateManifest(t.Context(), models.ManifestReference{Digest: fixtureManifestDigest}, nil, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// error case: unknown tag
+	err = layout.ValidateManifest(t.Context(), models.ManifestReference{Tag: "2.0"}, nil, nil)
+	expectErrorString(t, err, "manifest unknown: 2.0")
+
+	// error case: not an OCI layout
+	err = OCILayout{Path: t.TempDir()}.ValidateManifest(t.Context(), models.ManifestReference{Tag: "1.0"}, nil, nil)
+	if err == nil {
+		t.Error("expected error for non-OCI-layout directory, but got none")
+	}
+}
+
+func TestValidateCorruptedOCILayout(t *testing.T) {
+	// make a copy of the fixture that we can break
+	dir := t.TempDir()
+	err := os.CopyFS(dir, os.DirFS("fixtures/oci-layout"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	layout := OCILayout{Path: dir}
+	layerPath := filepath.Join(dir, "blobs", "sha256", digest.Digest(fixtureLayerDigest).Encoded())
+
+	// error case: layer contents do not match their digest
+	err = os.WriteFile(layerPath, []byte("corrupted\n"), 0o644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var session ValidationSession
+	err = layout.ValidateManifest(t.Context(), models.ManifestReference{Tag: "1.0"}, &session, nil)
+	expectErrorString(t, err, "actual digest is "+digest.FromString("corrupted\n").String())
+	assert.DeepEqual(t, "failures", session.Stats().Failed, uint64(1))
+
+	// error case: layer is missing
+	err = os.Remove(layerPath)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = layout.ValidateBlobContents(t.Context(), fixtureLayerDigest, nil)
+	expectErrorString(t, err, "blob unknown to registry: "+fixtureLayerDigest)
+}
+
+func expectErrorString(t *testing.T, err error, expected string) {
+	t.Helper()
+	if err == nil {
+		t.Errorf("expected error %q, but got no error", expected)
+	} else if err.Error() != expected {
+		t.Errorf("expected error %q, but got %q", expected, err.Error())
+	}
+}
@@ -132,3 +132,21 @@ func jsonUnmarshalStrict(buf []byte, target any) error {
 	dec.DisallowUnknownFields()
 	return dec.Decode(target)
 }
+
+// RequestCredentialRotation asks the peer to issue new peering credentials to
+// us as soon as possible, e.g. because we suspect that our current credentials
+// have been leaked. Our current credentials remain valid until the peer has
+// issued new ones.
+func (c Client) RequestCredentialRotation(ctx context.Context) error {
+	reqURL := c.buildRequestURL("peer/v1/rotate-credentials")
+
+	respBodyBytes, respStatusCode, _, err := c.doRequest(ctx, http.MethodPost, reqURL, http.NoBody, nil)
+	if err != nil {
+		return err
+	}
+	if respStatusCode != http.StatusAccepted {
+		return fmt.Errorf("during POST %s: expected 202, got %d with response: %s",
+			reqURL, respStatusCode, string(respBodyBytes))
+	}
+	return nil
+}
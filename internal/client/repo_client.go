@@ -14,6 +14,9 @@ import (
 
 	"maps"
 
+	"github.com/opencontainers/go-digest"
+	"github.com/sapcc/go-bits/logg"
+
 	"github.com/sapcc/keppel/internal/keppel"
 )
 
@@ -27,8 +30,25 @@ type RepoClient struct {
 	UserName string
 	Password string
 
-	// auth state
-	token string
+	// HTTPClient is used for all requests to the registry, including token
+	// requests. If nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+	// RetryPolicy controls how idempotent requests are retried after transient
+	// failures. The zero value disables retries.
+	RetryPolicy RetryPolicy
+
+	// auth state: values for the Authorization header, as obtained by answering
+	// the registry's auth challenge (since a RepoClient only ever talks to one
+	// repository, this is a per-repo cache of tokens)
+	authHeader      string            // for Host
+	peerAuthHeaders map[string]string // for other hosts that we were redirected to (see peerAffinity)
+
+	// When a request is redirected to a different registry host serving the
+	// same repository (e.g. an anycast endpoint redirecting to the peer that
+	// holds the image), we remember that host here to send subsequent requests
+	// for the same path directly to it. Keys are repoRequest.Path, values are
+	// URL prefixes like "https://peer.example.org".
+	peerAffinity map[string]string
 }
 
 type repoRequest struct {
@@ -42,19 +62,64 @@ type repoRequest struct {
 // SetToken can be used in tests to inject a pre-computed token and bypass the
 // username/password requirement.
 func (c *RepoClient) SetToken(token string) {
-	c.token = token
+	c.authHeader = "Bearer " + token
 }
 
-func (c *RepoClient) sendRequest(ctx context.Context, r repoRequest, uri string) (*http.Response, *http.Request, error) {
-	req, err := http.NewRequestWithContext(ctx, r.Method, uri, r.Body)
-	if err != nil {
-		return nil, nil, err
+func (c *RepoClient) httpClient() *http.Client {
+	if c.HTTPClient == nil {
+		return http.DefaultClient
 	}
-	maps.Copy(req.Header, r.Headers)
-	if c.token != "" {
-		req.Header.Set("Authorization", "Bearer "+c.token)
+	return c.HTTPClient
+}
+
+// isReadOnly returns whether this request does not modify anything on the server.
+func (r repoRequest) isReadOnly() bool {
+	return r.Method == http.MethodGet || r.Method == http.MethodHead
+}
+
+// isIdempotent returns whether this request can be retried safely.
+func (r repoRequest) isIdempotent() bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		return true
+	case http.MethodPut:
+		// pushing a manifest to its digest always has the same result, but pushing
+		// to a tag could overwrite a concurrent push to the same tag
+		ref, ok := strings.CutPrefix(r.Path, "manifests/")
+		if !ok {
+			return false
+		}
+		_, err := digest.Parse(ref)
+		return err == nil
+	default:
+		return false
 	}
-	resp, err := http.DefaultClient.Do(req)
+}
+
+func (c *RepoClient) sendRequest(ctx context.Context, r repoRequest, uri string) (*http.Response, *http.Request, error) {
+	var req *http.Request
+	resp, err := c.RetryPolicy.Do(ctx, r.isIdempotent(), func() (*http.Response, error) {
+		if r.Body != nil {
+			_, err := r.Body.Seek(0, io.SeekStart)
+			if err != nil {
+				return nil, err
+			}
+		}
+		var err error
+		req, err = http.NewRequestWithContext(ctx, r.Method, uri, r.Body)
+		if err != nil {
+			return nil, err
+		}
+		if sizer, ok := r.Body.(interface{ Size() int64 }); ok && req.ContentLength == 0 {
+			// for custom body types, net/http cannot compute the Content-Length by itself
+			req.ContentLength = sizer.Size()
+		}
+		maps.Copy(req.Header, r.Headers)
+		if authHeader := c.authHeaderFor(req.URL.Host); authHeader != "" {
+			req.Header.Set("Authorization", authHeader)
+		}
+		return c.httpClient().Do(req)
+	})
 	if err != nil {
 		return nil, nil, keppel.ErrUnavailable.With(err.Error())
 	}
@@ -67,8 +132,43 @@ func (c *RepoClient) doRequest(ctx context.Context, r repoRequest) (*http.Respon
 		c.Scheme = "https"
 	}
 
-	uri := fmt.Sprintf("%s://%s/v2/%s/%s", c.Scheme, c.Host, c.RepoName, r.Path)
+	path := fmt.Sprintf("/v2/%s/%s", c.RepoName, r.Path)
+	if peerURL, ok := c.peerAffinity[r.Path]; ok && r.isReadOnly() {
+		resp, err := c.doRequestTo(ctx, r, peerURL+path)
+		if err == nil {
+			return resp, nil
+		}
+		// the peer may have become unavailable or lost the content in question,
+		// so fall back to asking the original host again
+		logg.Debug("request to %s%s failed, falling back to %s: %s", peerURL, path, c.Host, err.Error())
+		delete(c.peerAffinity, r.Path)
+	}
+
+	resp, err := c.doRequestTo(ctx, r, fmt.Sprintf("%s://%s%s", c.Scheme, c.Host, path))
+	if err == nil {
+		c.rememberPeerAffinity(r, path, resp)
+	}
+	return resp, err
+}
+
+// CheckCredentials performs a test authentication against the registry using
+// the configured credentials, by sending a request to the toplevel API
+// endpoint (GET /v2/). An error is returned if the registry cannot be reached
+// or rejects the credentials.
+func (c *RepoClient) CheckCredentials(ctx context.Context) error {
+	if c.Scheme == "" {
+		c.Scheme = "https"
+	}
+
+	uri := fmt.Sprintf("%s://%s/v2/", c.Scheme, c.Host)
+	resp, err := c.doRequestTo(ctx, repoRequest{Method: http.MethodGet, ExpectStatus: http.StatusOK}, uri)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
 
+func (c *RepoClient) doRequestTo(ctx context.Context, r repoRequest, uri string) (*http.Response, error) {
 	// send GET request for manifest
 	resp, req, err := c.sendRequest(ctx, r, uri)
 	if err != nil {
@@ -81,12 +181,23 @@ func (c *RepoClient) doRequest(ctx context.Context, r repoRequest) (*http.Respon
 		if err != nil {
 			return nil, fmt.Errorf("cannot parse auth challenge from 401 response to %s %s: %w", r.Method, uri, err)
 		}
-		c.token, err = authChallenge.GetToken(ctx, c.UserName, c.Password)
+		authHeader, err := authChallenge.GetAuthorizationHeader(ctx, c.httpClient(), c.UserName, c.Password)
 		if err != nil {
 			return nil, fmt.Errorf("authentication failed: %w", err)
 		}
+		// if we were redirected to a different host, the challenge came from
+		// there, and we need to send the authenticated request there directly
+		// (since the Authorization header is not carried over on redirects)
+		if resp.Request != nil && resp.Request.URL.Host != req.URL.Host {
+			uri = resp.Request.URL.String()
+		}
+		if resp.Request != nil {
+			c.setAuthHeaderFor(resp.Request.URL.Host, authHeader)
+		} else {
+			c.setAuthHeaderFor(req.URL.Host, authHeader)
+		}
 
-		// ...then resend the GET request with the token
+		// ...then resend the request with the token (or basic credentials)
 		if r.Body != nil {
 			_, err = r.Body.Seek(0, io.SeekStart)
 			if err != nil {
@@ -117,7 +228,7 @@ func (c *RepoClient) doRequest(ctx context.Context, r repoRequest) (*http.Respon
 			}
 		}
 
-		return nil, unexpectedStatusCodeError{req, http.StatusOK, resp.Status}
+		return nil, unexpectedStatusCodeError{req, r.ExpectStatus, resp.StatusCode, resp.Status}
 	}
 
 	return resp, nil
@@ -126,9 +237,10 @@ func (c *RepoClient) doRequest(ctx context.Context, r repoRequest) (*http.Respon
 ////////////////////////////////////////////////////////////////////////////////
 
 type unexpectedStatusCodeError struct {
-	req            *http.Request
-	expectedStatus int
-	actualStatus   string
+	req              *http.Request
+	expectedStatus   int
+	actualStatusCode int
+	actualStatus     string
 }
 
 func (e unexpectedStatusCodeError) Error() string {
@@ -0,0 +1,150 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/sapcc/go-bits/logg"
+)
+
+// RetryPolicy describes how requests are retried after transient failures.
+// Only idempotent requests are ever retried, i.e. requests that can be sent
+// multiple times without changing the outcome.
+//
+// Transient failures are network errors as well as responses with status 429
+// (Too Many Requests), 502 (Bad Gateway), 503 (Service Unavailable) or 504
+// (Gateway Timeout). If the response has a Retry-After header, the next
+// attempt is delayed accordingly.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first one.
+	// A value of 0 or 1 disables retries.
+	MaxAttempts int
+	// InitialBackoff is the delay before the first retry. The delay is doubled
+	// for each subsequent retry, up to MaxBackoff.
+	InitialBackoff time.Duration
+	// MaxBackoff is the upper limit for the delay between attempts, including
+	// delays requested through Retry-After.
+	MaxBackoff time.Duration
+}
+
+// DefaultRetryPolicy is a reasonable RetryPolicy for CLI tools and monitors.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    4,
+	InitialBackoff: 500 * time.Millisecond,
+	MaxBackoff:     10 * time.Second,
+}
+
+// Do calls `attempt` until it produces a response that is not a transient
+// failure, or until the policy does not allow any more attempts. If
+// `idempotent` is false, `attempt` is only called once.
+//
+// The response from the final attempt is returned as-is. Responses from all
+// previous attempts are closed by this function.
+func (p RetryPolicy) Do(ctx context.Context, idempotent bool, attempt func() (*http.Response, error)) (*http.Response, error) {
+	backoff := p.InitialBackoff
+	for attemptCount := 1; ; attemptCount++ {
+		resp, err := attempt()
+		if !idempotent || attemptCount >= p.MaxAttempts || !isTransientFailure(resp, err) {
+			return resp, err
+		}
+
+		delay := backoff
+		if resp != nil {
+			delay = max(delay, parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()))
+			_, _ = io.Copy(io.Discard, resp.Body) // drain body to allow connection reuse
+			resp.Body.Close()
+		}
+		delay = min(delay, p.MaxBackoff)
+		if err == nil {
+			logg.Debug("retrying request after %s: got status %d", delay, resp.StatusCode)
+		} else {
+			logg.Debug("retrying request after %s: %s", delay, err.Error())
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+		backoff = min(2*backoff, p.MaxBackoff)
+	}
+}
+
+func isTransientFailure(resp *http.Response, err error) bool {
+	if err == nil {
+		return isTransientStatus(resp.StatusCode)
+	}
+
+	// some AuthDriver implementations report unexpected status codes as errors
+	var serr interface{ GetStatusCode() int }
+	if errors.As(err, &serr) {
+		return isTransientStatus(serr.GetStatusCode())
+	}
+	// otherwise, only network-level errors are transient
+	var nerr net.Error
+	return errors.As(err, &nerr) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET)
+}
+
+func isTransientStatus(statusCode int) bool {
+	switch statusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// parseRetryAfter parses the value of a Retry-After header, which can be given
+// either in seconds or as an HTTP date. If the value is missing or malformed, 0 is returned.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	seconds, err := strconv.ParseUint(value, 10, 32)
+	if err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	t, err := http.ParseTime(value)
+	if err == nil {
+		return max(0, t.Sub(now))
+	}
+	return 0
+}
+
+// SendHTTPRequestWithRetry is like ad.SendHTTPRequest(req), but retries
+// idempotent requests (GET, HEAD and PUT) according to the given policy.
+// If req has a body, req.GetBody must be set (http.NewRequest does this
+// automatically for the common body types).
+func SendHTTPRequestWithRetry(ad AuthDriver, policy RetryPolicy, req *http.Request) (*http.Response, error) {
+	idempotent := req.Method == http.MethodGet || req.Method == http.MethodHead || req.Method == http.MethodPut
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		idempotent = false // cannot replay the body
+	}
+
+	isFirstAttempt := true
+	return policy.Do(req.Context(), idempotent, func() (*http.Response, error) {
+		if isFirstAttempt {
+			isFirstAttempt = false
+			return ad.SendHTTPRequest(req)
+		}
+		nextReq := req.Clone(req.Context())
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			nextReq.Body = body
+		}
+		return ad.SendHTTPRequest(nextReq)
+	})
+}
@@ -0,0 +1,210 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/sapcc/go-bits/assert"
+
+	"github.com/sapcc/keppel/internal/models"
+)
+
+var testRetryPolicy = RetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: time.Millisecond,
+	MaxBackoff:     5 * time.Millisecond,
+}
+
+var emptyManifestDigest = digest.FromString("{}").String()
+
+// flakyServer is a mock registry that fails the first few requests to each path.
+type flakyServer struct {
+	mutex          sync.Mutex
+	failuresByPath map[string]int
+	hitsByPath     map[string]int
+	bodiesByPath   map[string][]string
+}
+
+func (s *flakyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	key := r.Method + " " + r.URL.Path
+	s.hitsByPath[key]++
+	body, _ := io.ReadAll(r.Body)
+	s.bodiesByPath[key] = append(s.bodiesByPath[key], string(body))
+
+	if s.failuresByPath[key] > 0 {
+		s.failuresByPath[key]--
+		w.Header().Set("Retry-After", "3600") // will be capped by MaxBackoff
+		http.Error(w, "try again later", http.StatusServiceUnavailable)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, "{}")
+	default:
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+func TestRepoClientRetries(t *testing.T) {
+	srv := &flakyServer{
+		failuresByPath: map[string]int{
+			"GET /v2/foo/manifests/latest":                 2,
+			"GET /v2/foo/manifests/broken":                 5,
+			"POST /v2/foo/blobs/uploads/":                  1,
+			"PUT /v2/foo/manifests/latest":                 1,
+			"PUT /v2/foo/manifests/" + emptyManifestDigest: 1,
+		},
+		hitsByPath:   make(map[string]int),
+		bodiesByPath: make(map[string][]string),
+	}
+	httpSrv := httptest.NewServer(srv)
+	defer httpSrv.Close()
+
+	c := &RepoClient{
+		Scheme:      "http",
+		Host:        strings.TrimPrefix(httpSrv.URL, "http://"),
+		RepoName:    "foo",
+		RetryPolicy: testRetryPolicy,
+	}
+
+	// GET is retried until it succeeds
+	_, _, err := c.DownloadManifest(t.Context(), models.ManifestReference{Tag: "latest"}, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// ...but only up to MaxAttempts
+	_, _, err = c.DownloadManifest(t.Context(), models.ManifestReference{Tag: "broken"}, nil)
+	if err == nil {
+		t.Error("expected DownloadManifest to fail, but got no error")
+	}
+
+	// POST is not idempotent and thus never retried
+	_, err = c.UploadMonolithicBlob(t.Context(), []byte("blob"))
+	if err == nil {
+		t.Error("expected UploadMonolithicBlob to fail, but got no error")
+	}
+
+	// PUT to a tag is not retried, but PUT to a digest is (including the body)
+	_, err = c.UploadManifest(t.Context(), []byte("{}"), "application/vnd.oci.image.manifest.v1+json", "latest")
+	if err == nil {
+		t.Error("expected UploadManifest to tag to fail, but got no error")
+	}
+	_, err = c.UploadManifest(t.Context(), []byte("{}"), "application/vnd.oci.image.manifest.v1+json", "")
+	if err != nil {
+		t.Error(err.Error())
+	}
+
+	assert.DeepEqual(t, "requests", srv.hitsByPath, map[string]int{
+		"GET /v2/foo/manifests/latest":                 3,
+		"GET /v2/foo/manifests/broken":                 3,
+		"POST /v2/foo/blobs/uploads/":                  1,
+		"PUT /v2/foo/manifests/latest":                 1,
+		"PUT /v2/foo/manifests/" + emptyManifestDigest: 2,
+	})
+	assert.DeepEqual(t, "request bodies", srv.bodiesByPath["PUT /v2/foo/manifests/"+emptyManifestDigest], []string{"{}", "{}"})
+
+	// without a RetryPolicy, nothing is retried
+	srv.failuresByPath["GET /v2/foo/manifests/latest"] = 1
+	c.RetryPolicy = RetryPolicy{}
+	_, _, err = c.DownloadManifest(t.Context(), models.ManifestReference{Tag: "latest"}, nil)
+	if err == nil {
+		t.Error("expected DownloadManifest without retries to fail, but got no error")
+	}
+	assert.DeepEqual(t, "requests", srv.hitsByPath["GET /v2/foo/manifests/latest"], 4)
+}
+
+type mockStatusCodeError struct {
+	statusCode int
+}
+
+func (e mockStatusCodeError) Error() string {
+	return fmt.Sprintf("unexpected status %d", e.statusCode)
+}
+
+func (e mockStatusCodeError) GetStatusCode() int {
+	return e.statusCode
+}
+
+// mockAuthDriver reports the given errors in order, then succeeds.
+type mockAuthDriver struct {
+	AuthDriver
+	errs   []error
+	bodies []string
+}
+
+func (d *mockAuthDriver) SendHTTPRequest(req *http.Request) (*http.Response, error) {
+	body, _ := io.ReadAll(req.Body)
+	d.bodies = append(d.bodies, string(body))
+	if len(d.errs) > 0 {
+		err := d.errs[0]
+		d.errs = d.errs[1:]
+		return nil, err
+	}
+	return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+}
+
+func TestSendHTTPRequestWithRetry(t *testing.T) {
+	newRequest := func(method string) *http.Request {
+		req, err := http.NewRequestWithContext(context.Background(), method, "/keppel/v1/accounts/foo", bytes.NewReader([]byte("body")))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return req
+	}
+
+	// transient errors on PUT are retried, with the same body each time
+	ad := &mockAuthDriver{errs: []error{mockStatusCodeError{503}, mockStatusCodeError{429}}}
+	_, err := SendHTTPRequestWithRetry(ad, testRetryPolicy, newRequest(http.MethodPut))
+	if err != nil {
+		t.Error(err.Error())
+	}
+	assert.DeepEqual(t, "request bodies", ad.bodies, []string{"body", "body", "body"})
+
+	// non-transient errors are not retried
+	ad = &mockAuthDriver{errs: []error{mockStatusCodeError{403}}}
+	_, err = SendHTTPRequestWithRetry(ad, testRetryPolicy, newRequest(http.MethodPut))
+	if err == nil {
+		t.Error("expected error for 403, but got none")
+	}
+	assert.DeepEqual(t, "request count", len(ad.bodies), 1)
+
+	// non-idempotent requests are not retried
+	ad = &mockAuthDriver{errs: []error{mockStatusCodeError{503}}}
+	_, err = SendHTTPRequestWithRetry(ad, testRetryPolicy, newRequest(http.MethodPost))
+	if err == nil {
+		t.Error("expected error for POST, but got none")
+	}
+	assert.DeepEqual(t, "request count", len(ad.bodies), 1)
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	testCases := map[string]time.Duration{
+		"":                              0,
+		"120":                           2 * time.Minute,
+		"Wed, 01 Jan 2025 12:00:30 GMT": 30 * time.Second,
+		"Wed, 01 Jan 2025 11:00:00 GMT": 0,
+		"soon":                          0,
+		"-5":                            0,
+	}
+	for input, expected := range testCases {
+		assert.DeepEqual(t, "parseRetryAfter("+input+")", parseRetryAfter(input, now), expected)
+	}
+}
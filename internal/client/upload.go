@@ -6,24 +6,54 @@ package client
 import (
 	"bytes"
 	"context"
+	"io"
 	"net/http"
 	"strconv"
 
 	"github.com/opencontainers/go-digest"
 )
 
+// UploadOption is an optional argument to UploadMonolithicBlob.
+type UploadOption func(*uploadOptions)
+
+type uploadOptions struct {
+	progress func(bytesSent, bytesTotal uint64)
+}
+
+// WithUploadProgress is an UploadOption that reports the progress of an
+// upload by calling the given callback whenever a chunk of the request body
+// has been sent. The reported byte counts increase monotonically.
+func WithUploadProgress(callback func(bytesSent, bytesTotal uint64)) UploadOption {
+	return func(o *uploadOptions) {
+		o.progress = callback
+	}
+}
+
 // UploadMonolithicBlob performs a monolithic blob upload. On success, the
 // blob's digest is returned.
-func (c *RepoClient) UploadMonolithicBlob(ctx context.Context, contents []byte) (digest.Digest, error) {
+func (c *RepoClient) UploadMonolithicBlob(ctx context.Context, contents []byte, opts ...UploadOption) (digest.Digest, error) {
+	var o uploadOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
 	d := digest.Canonical.FromBytes(contents)
 
+	var body io.ReadSeeker = bytes.NewReader(contents)
+	if o.progress != nil {
+		body = &progressReader{
+			inner:    bytes.NewReader(contents),
+			total:    uint64(len(contents)),
+			callback: o.progress,
+		}
+	}
+
 	resp, err := c.doRequest(ctx, repoRequest{
 		Method: "POST",
 		Path:   "blobs/uploads/?digest=" + d.String(),
 		Headers: http.Header{
 			"Content-Type": {"application/octet-stream"},
 		},
-		Body:         bytes.NewReader(contents),
+		Body:         body,
 		ExpectStatus: http.StatusCreated,
 	})
 	if err == nil {
@@ -57,3 +87,34 @@ func (c *RepoClient) UploadManifest(ctx context.Context, contents []byte, mediaT
 	}
 	return d, err
 }
+
+// progressReader wraps the request body of an upload to report progress.
+type progressReader struct {
+	inner    *bytes.Reader
+	total    uint64
+	callback func(bytesSent, bytesTotal uint64)
+	// The body may be sent multiple times (e.g. after an auth challenge or
+	// during retries), so we only report progress beyond what was already reported.
+	reported uint64
+}
+
+// Read implements the io.Reader interface.
+func (r *progressReader) Read(buf []byte) (int, error) {
+	n, err := r.inner.Read(buf)
+	sent := r.total - uint64(r.inner.Len()) //nolint:gosec // Len() is never negative
+	if sent > r.reported {
+		r.reported = sent
+		r.callback(sent, r.total)
+	}
+	return n, err
+}
+
+// Seek implements the io.Seeker interface.
+func (r *progressReader) Seek(offset int64, whence int) (int64, error) {
+	return r.inner.Seek(offset, whence)
+}
+
+// Size is used by RepoClient.sendRequest to set the request's Content-Length.
+func (r *progressReader) Size() int64 {
+	return r.inner.Size()
+}
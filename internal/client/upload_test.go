@@ -0,0 +1,71 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package client
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/sapcc/go-bits/assert"
+)
+
+func TestUploadMonolithicBlobWithProgress(t *testing.T) {
+	contents := bytes.Repeat([]byte("0123456789abcdef"), 64*1024) // 1 MiB
+
+	var (
+		receivedContents      []byte
+		receivedContentLength int64
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedContentLength = r.ContentLength
+		var err error
+		receivedContents, err = io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err.Error())
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+
+	c := &RepoClient{
+		Scheme:   "http",
+		Host:     strings.TrimPrefix(srv.URL, "http://"),
+		RepoName: "foo",
+	}
+
+	var reports [][2]uint64
+	d, err := c.UploadMonolithicBlob(t.Context(), contents, WithUploadProgress(func(bytesSent, bytesTotal uint64) {
+		reports = append(reports, [2]uint64{bytesSent, bytesTotal})
+	}))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "digest", d, digest.FromBytes(contents))
+	assert.DeepEqual(t, "received contents", receivedContents, contents)
+	assert.DeepEqual(t, "received Content-Length", receivedContentLength, int64(len(contents)))
+
+	// the callback is invoked with monotonically increasing counts, up to the full size
+	if len(reports) < 2 {
+		t.Fatalf("expected multiple progress reports, but got %d", len(reports))
+	}
+	for idx, report := range reports {
+		assert.DeepEqual(t, "reported total", report[1], uint64(len(contents)))
+		if idx > 0 && report[0] <= reports[idx-1][0] {
+			t.Errorf("progress report #%d is not increasing: %d after %d", idx, report[0], reports[idx-1][0])
+		}
+	}
+	assert.DeepEqual(t, "final progress report", reports[len(reports)-1][0], uint64(len(contents)))
+
+	// without the option, the upload works as before
+	_, err = c.UploadMonolithicBlob(t.Context(), []byte("small"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "received contents", string(receivedContents), "small")
+}
@@ -32,8 +32,32 @@ func (noopLogger) LogBlob(digest.Digest, int, error, bool)                {}
 // referenced multiple times. The session instance should only be used for as
 // long as the caller wishes to cache validation results.
 type ValidationSession struct {
-	Logger  ValidationLogger
-	isValid map[string]bool
+	Logger ValidationLogger
+	// MaxManifestReferenceDepth limits how deeply manifests may be nested within
+	// each other. If zero, keppel.DefaultMaxManifestReferenceDepth is used.
+	MaxManifestReferenceDepth int
+	isValid                   map[string]bool
+	inProgress                map[string]bool // manifests on the current path of the recursion (to detect cycles)
+	stats                     ValidationStats
+}
+
+// ValidationStats summarizes the work done during a ValidationSession.
+type ValidationStats struct {
+	// number of manifests and blobs that were checked (including those where
+	// the result was taken from the cache)
+	Manifests uint64 `json:"manifests"`
+	Blobs     uint64 `json:"blobs"`
+	// number of checks where the result was taken from the cache
+	Cached uint64 `json:"cached"`
+	// number of manifests and blobs that failed validation
+	Failed uint64 `json:"failed"`
+	// number of bytes downloaded from the registry
+	BytesRead uint64 `json:"bytes_read"`
+}
+
+// Stats returns a summary of the work done in this session so far.
+func (s *ValidationSession) Stats() ValidationStats {
+	return s.stats
 }
 
 func (s *ValidationSession) applyDefaults() *ValidationSession {
@@ -45,12 +69,26 @@ func (s *ValidationSession) applyDefaults() *ValidationSession {
 	if s.Logger == nil {
 		s.Logger = noopLogger{}
 	}
+	if s.MaxManifestReferenceDepth == 0 {
+		s.MaxManifestReferenceDepth = keppel.DefaultMaxManifestReferenceDepth
+	}
 	if s.isValid == nil {
 		s.isValid = make(map[string]bool)
 	}
+	if s.inProgress == nil {
+		s.inProgress = make(map[string]bool)
+	}
 	return s
 }
 
+// validationSource is where ValidateManifest and ValidateBlobContents read
+// manifests and blobs from. This is implemented by RepoClient and OCILayout.
+type validationSource interface {
+	DownloadManifest(ctx context.Context, reference models.ManifestReference, opts *DownloadManifestOpts) (contents []byte, mediaType string, returnErr error)
+	DownloadBlob(ctx context.Context, blobDigest digest.Digest) (contents io.ReadCloser, sizeBytes uint64, returnErr error)
+	validationCacheKey(digestOrTagName string) string
+}
+
 func (c *RepoClient) validationCacheKey(digestOrTagName string) string {
 	// We allow sharing a ValidationSession between multiple RepoClients to keep
 	// the API simple. But we cannot share validation results between repos: For
@@ -64,11 +102,13 @@ func (c *RepoClient) validationCacheKey(digestOrTagName string) string {
 // it parses correctly. It also validates all references manifests and blobs
 // recursively.
 func (c *RepoClient) ValidateManifest(ctx context.Context, reference models.ManifestReference, session *ValidationSession, platformFilter models.PlatformFilter) error {
-	return c.doValidateManifest(ctx, reference, 0, session.applyDefaults(), platformFilter)
+	return validateManifest(ctx, c, reference, 0, session.applyDefaults(), platformFilter)
 }
 
-func (c *RepoClient) doValidateManifest(ctx context.Context, reference models.ManifestReference, level int, session *ValidationSession, platformFilter models.PlatformFilter) (returnErr error) {
+func validateManifest(ctx context.Context, c validationSource, reference models.ManifestReference, level int, session *ValidationSession, platformFilter models.PlatformFilter) (returnErr error) {
+	session.stats.Manifests++
 	if session.isValid[c.validationCacheKey(reference.String())] {
+		session.stats.Cached++
 		session.Logger.LogManifest(reference, level, nil, true)
 		return nil
 	}
@@ -76,20 +116,40 @@ func (c *RepoClient) doValidateManifest(ctx context.Context, reference models.Ma
 	logged := false
 	defer func() {
 		if !logged {
+			if returnErr != nil {
+				session.stats.Failed++
+			}
 			session.Logger.LogManifest(reference, level, returnErr, false)
 		}
 	}()
 
+	// do not follow reference chains that are nested too deeply or that loop back onto themselves
+	if level > session.MaxManifestReferenceDepth {
+		return keppel.ErrManifestReferencesTooDeep(session.MaxManifestReferenceDepth)
+	}
+	if reference.Digest != "" {
+		cacheKey := c.validationCacheKey(reference.Digest.String())
+		if session.inProgress[cacheKey] {
+			return keppel.ErrManifestReferencesCycle(reference.Digest)
+		}
+		session.inProgress[cacheKey] = true
+		defer delete(session.inProgress, cacheKey)
+	}
+
 	manifestBytes, manifestMediaType, err := c.DownloadManifest(ctx, reference, nil)
 	if err != nil {
 		return err
 	}
+	session.stats.BytesRead += uint64(len(manifestBytes))
 	manifest, err := keppel.ParseManifest(manifestMediaType, manifestBytes)
 	if err != nil {
 		return err
 	}
 
 	manifestDigest := digest.FromBytes(manifestBytes)
+	if reference.Digest != "" {
+		manifestDigest = reference.Digest.Algorithm().FromBytes(manifestBytes)
+	}
 
 	if reference.Digest != "" && manifestDigest != reference.Digest {
 		return keppel.ErrDigestInvalid.With("actual manifest digest is " + manifestDigest.String())
@@ -101,13 +161,13 @@ func (c *RepoClient) doValidateManifest(ctx context.Context, reference models.Ma
 
 	// ...now recurse into the manifests and blobs that it references
 	for _, layerInfo := range manifest.BlobReferences() {
-		err := c.doValidateBlobContents(ctx, layerInfo.Digest, level+1, session)
+		err := validateBlobContents(ctx, c, layerInfo.Digest, level+1, session)
 		if err != nil {
 			return err
 		}
 	}
 	for _, desc := range manifest.ManifestReferences(platformFilter) {
-		err := c.doValidateManifest(ctx, models.ManifestReference{Digest: desc.Digest}, level+1, session, platformFilter)
+		err := validateManifest(ctx, c, models.ManifestReference{Digest: desc.Digest}, level+1, session, platformFilter)
 		if err != nil {
 			return err
 		}
@@ -122,16 +182,21 @@ func (c *RepoClient) doValidateManifest(ctx context.Context, reference models.Ma
 // ValidateBlobContents fetches the given blob from the repo and verifies that
 // the contents produce the correct digest.
 func (c *RepoClient) ValidateBlobContents(ctx context.Context, blobDigest digest.Digest, session *ValidationSession) error {
-	return c.doValidateBlobContents(ctx, blobDigest, 0, session.applyDefaults())
+	return validateBlobContents(ctx, c, blobDigest, 0, session.applyDefaults())
 }
 
-func (c *RepoClient) doValidateBlobContents(ctx context.Context, blobDigest digest.Digest, level int, session *ValidationSession) (returnErr error) {
+func validateBlobContents(ctx context.Context, c validationSource, blobDigest digest.Digest, level int, session *ValidationSession) (returnErr error) {
+	session.stats.Blobs++
 	cacheKey := c.validationCacheKey(blobDigest.String())
 	if session.isValid[cacheKey] {
+		session.stats.Cached++
 		session.Logger.LogBlob(blobDigest, level, nil, true)
 		return nil
 	}
 	defer func() {
+		if returnErr != nil {
+			session.stats.Failed++
+		}
 		session.Logger.LogBlob(blobDigest, level, returnErr, false)
 	}()
 
@@ -149,7 +214,8 @@ func (c *RepoClient) doValidateBlobContents(ctx context.Context, blobDigest dige
 	}()
 
 	hash := blobDigest.Algorithm().Hash()
-	_, err = io.Copy(hash, readCloser)
+	bytesRead, err := io.Copy(hash, readCloser)
+	session.stats.BytesRead += uint64(bytesRead) //nolint:gosec // io.Copy never returns a negative count
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,88 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package client
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	imagespecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sapcc/go-bits/assert"
+
+	"github.com/sapcc/keppel/internal/models"
+)
+
+// writeNestedIndexes writes a chain of image indexes into the given OCI layout,
+// such that each index references the previous one, and the first one is
+// empty. The digests of all indexes are returned in order of creation.
+func writeNestedIndexes(t *testing.T, layout OCILayout, count int) []digest.Digest {
+	t.Helper()
+	blobDir := filepath.Join(layout.Path, "blobs", "sha256")
+	err := os.MkdirAll(blobDir, 0o777)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = os.WriteFile(filepath.Join(layout.Path, "index.json"), []byte(`{"schemaVersion":2,"manifests":[]}`), 0o666)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = os.WriteFile(filepath.Join(layout.Path, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0o666)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var result []digest.Digest
+	index := imagespecs.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: imagespecs.MediaTypeImageIndex,
+		Manifests: []imagespecs.Descriptor{},
+	}
+	for range count {
+		contents, err := json.Marshal(index)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		indexDigest := digest.FromBytes(contents)
+		err = os.WriteFile(filepath.Join(blobDir, indexDigest.Encoded()), contents, 0o666)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		result = append(result, indexDigest)
+
+		index.Manifests = []imagespecs.Descriptor{{
+			MediaType: imagespecs.MediaTypeImageIndex,
+			Digest:    indexDigest,
+			Size:      int64(len(contents)),
+		}}
+	}
+	return result
+}
+
+func TestValidateManifestReferenceDepth(t *testing.T) {
+	layout := OCILayout{Path: t.TempDir()}
+	digests := writeNestedIndexes(t, layout, 5)
+	topDigest := digests[len(digests)-1]
+
+	// the topmost index has 4 levels of indexes below it
+	session := ValidationSession{MaxManifestReferenceDepth: 4}
+	err := layout.ValidateManifest(t.Context(), models.ManifestReference{Digest: topDigest}, &session, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "stats", session.Stats().Manifests, uint64(5))
+
+	session = ValidationSession{MaxManifestReferenceDepth: 3}
+	err = layout.ValidateManifest(t.Context(), models.ManifestReference{Digest: topDigest}, &session, nil)
+	expectErrorString(t, err, "manifest references are nested more than 3 levels deep")
+
+	// the default limit is large enough for this
+	err = layout.ValidateManifest(t.Context(), models.ManifestReference{Digest: topDigest}, nil, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+}
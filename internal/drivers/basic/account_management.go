@@ -31,15 +31,24 @@ type AccountConfig struct {
 }
 
 type Account struct {
-	Name                 models.AccountName          `json:"name"`
-	AuthTenantID         string                      `json:"auth_tenant_id"`
-	GCPolicies           []keppel.GCPolicy           `json:"gc_policies"`
-	RBACPolicies         []keppel.RBACPolicy         `json:"rbac_policies"`
-	ReplicationPolicy    *keppel.ReplicationPolicy   `json:"replication"`
-	SecurityScanPolicies []keppel.SecurityScanPolicy `json:"security_scan_policies"`
-	TagPolicies          []keppel.TagPolicy          `json:"tag_policies,omitempty"`
-	ValidationPolicy     *keppel.ValidationPolicy    `json:"validation"`
-	PlatformFilter       models.PlatformFilter       `json:"platform_filter"`
+	Name                   models.AccountName          `json:"name"`
+	AuthTenantID           string                      `json:"auth_tenant_id"`
+	GCPolicies             []keppel.GCPolicy           `json:"gc_policies"`
+	RBACPolicies           []keppel.RBACPolicy         `json:"rbac_policies"`
+	ReplicationPolicy      *keppel.ReplicationPolicy   `json:"replication"`
+	SecurityScanPolicies   []keppel.SecurityScanPolicy `json:"security_scan_policies"`
+	TagPolicies            []keppel.TagPolicy          `json:"tag_policies,omitempty"`
+	ValidationPolicy       *keppel.ValidationPolicy    `json:"validation"`
+	PlatformFilter         models.PlatformFilter       `json:"platform_filter"`
+	ManifestCacheTTL       *keppel.Duration            `json:"manifest_cache_ttl,omitempty"`
+	ManifestTrashRetention *keppel.Duration            `json:"manifest_trash_retention,omitempty"`
+	ReadOnly               bool                        `json:"read_only,omitempty"`
+	PullEnabled            *bool                       `json:"pull_enabled,omitempty"`
+	PushEnabled            *bool                       `json:"push_enabled,omitempty"`
+	AnycastEnabled         *bool                       `json:"anycast_enabled,omitempty"`
+	StrictMediaTypes       bool                        `json:"strict_media_types,omitempty"`
+	ValidateOnPush         bool                        `json:"validate_on_push,omitempty"`
+	Labels                 map[string]string           `json:"labels,omitempty"`
 }
 
 func init() {
@@ -73,14 +82,23 @@ func (a *AccountManagementDriver) ConfigureAccount(accountName models.AccountNam
 		}
 
 		account := keppel.Account{
-			AuthTenantID:      cfgAccount.AuthTenantID,
-			GCPolicies:        cfgAccount.GCPolicies,
-			Name:              cfgAccount.Name,
-			RBACPolicies:      cfgAccount.RBACPolicies,
-			ReplicationPolicy: cfgAccount.ReplicationPolicy,
-			TagPolicies:       cfgAccount.TagPolicies,
-			ValidationPolicy:  cfgAccount.ValidationPolicy,
-			PlatformFilter:    cfgAccount.PlatformFilter,
+			AuthTenantID:           cfgAccount.AuthTenantID,
+			GCPolicies:             cfgAccount.GCPolicies,
+			Name:                   cfgAccount.Name,
+			RBACPolicies:           cfgAccount.RBACPolicies,
+			ReplicationPolicy:      cfgAccount.ReplicationPolicy,
+			TagPolicies:            cfgAccount.TagPolicies,
+			ValidationPolicy:       cfgAccount.ValidationPolicy,
+			PlatformFilter:         cfgAccount.PlatformFilter,
+			ManifestCacheTTL:       cfgAccount.ManifestCacheTTL,
+			ManifestTrashRetention: cfgAccount.ManifestTrashRetention,
+			ReadOnly:               cfgAccount.ReadOnly,
+			PullEnabled:            cfgAccount.PullEnabled,
+			PushEnabled:            cfgAccount.PushEnabled,
+			AnycastEnabled:         cfgAccount.AnycastEnabled,
+			StrictMediaTypes:       cfgAccount.StrictMediaTypes,
+			ValidateOnPush:         cfgAccount.ValidateOnPush,
+			Labels:                 cfgAccount.Labels,
 		}
 		return Some(account), cfgAccount.SecurityScanPolicies, nil
 	}
@@ -0,0 +1,210 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package basic
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sapcc/go-bits/audittools"
+	"github.com/sapcc/go-bits/logg"
+	"github.com/sapcc/go-bits/osext"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+// AuthDriver is the auth driver "basic". It authenticates users against a
+// static list of users from a configuration file. This driver is intended for
+// development and evaluation setups only, and should not be used in production.
+type AuthDriver struct {
+	ConfigPath string
+	users      map[string]AuthUser
+}
+
+// AuthConfig is the structure of the configuration file for AuthDriver.
+type AuthConfig struct {
+	Users []AuthUser `json:"users"`
+}
+
+// AuthUser appears in type AuthConfig.
+type AuthUser struct {
+	Name         string              `json:"name"`
+	PasswordHash string              `json:"password_hash"`
+	AuthTenantID string              `json:"auth_tenant_id"`
+	Permissions  []keppel.Permission `json:"permissions"`
+}
+
+// When a user does not exist, we still compare the password against this hash
+// (of the password "dummy" with bcrypt.DefaultCost), so that the response time
+// does not reveal which users exist.
+var dummyPasswordHash = []byte("$2a$10$yvbJ2A/EQV4hcvptNYLxPeHBtjGqmqW5/QBXpKn1L6l.oFop2Nc/W")
+
+func init() {
+	keppel.AuthDriverRegistry.Add(func() keppel.AuthDriver { return &AuthDriver{} })
+	keppel.UserIdentityRegistry.Add(func() keppel.UserIdentity { return &userIdentity{} })
+}
+
+// PluginTypeID implements the keppel.AuthDriver interface.
+func (d *AuthDriver) PluginTypeID() string { return "basic" }
+
+// Init implements the keppel.AuthDriver interface.
+func (d *AuthDriver) Init(ctx context.Context, rc *redis.Client) error {
+	configPath, err := osext.NeedGetenv("KEPPEL_AUTH_CONFIG_PATH")
+	if err != nil {
+		return err
+	}
+	d.ConfigPath = configPath
+	err = d.LoadConfig()
+	if err != nil {
+		return err
+	}
+
+	logg.Info("auth driver \"basic\" is in use: this driver is intended for development and testing only, DO NOT USE IT IN PRODUCTION")
+	return nil
+}
+
+// LoadConfig reads and validates the configuration file.
+func (d *AuthDriver) LoadConfig() error {
+	reader, err := os.Open(d.ConfigPath)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	decoder := json.NewDecoder(reader)
+	decoder.DisallowUnknownFields()
+	var config AuthConfig
+	err = decoder.Decode(&config)
+	if err != nil {
+		return fmt.Errorf("while parsing %s: %w", d.ConfigPath, err)
+	}
+
+	users := make(map[string]AuthUser, len(config.Users))
+	var errs []error
+	for idx, user := range config.Users {
+		errs = append(errs, user.validate(fmt.Sprintf("users[%d]", idx))...)
+		if _, exists := users[user.Name]; exists {
+			errs = append(errs, fmt.Errorf("users[%d] has the same name as an earlier user: %q", idx, user.Name))
+		}
+		users[user.Name] = user
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("while parsing %s: %w", d.ConfigPath, errors.Join(errs...))
+	}
+
+	d.users = users
+	return nil
+}
+
+func (u AuthUser) validate(path string) (errs []error) {
+	if u.Name == "" {
+		errs = append(errs, fmt.Errorf("%s.name is missing", path))
+	}
+	if strings.Contains(u.Name, ":") {
+		errs = append(errs, fmt.Errorf("%s.name may not contain colons: %q", path, u.Name))
+	}
+	_, err := bcrypt.Cost([]byte(u.PasswordHash))
+	if err != nil {
+		errs = append(errs, fmt.Errorf("%s.password_hash is not a valid bcrypt hash: %w", path, err))
+	}
+	if u.AuthTenantID == "" {
+		errs = append(errs, fmt.Errorf("%s.auth_tenant_id is missing", path))
+	}
+	for _, perm := range u.Permissions {
+		if !perm.IsValid() {
+			errs = append(errs, fmt.Errorf("%s.permissions contains unknown permission %q", path, perm))
+		}
+	}
+	return errs
+}
+
+// AuthenticateUser implements the keppel.AuthDriver interface.
+func (d *AuthDriver) AuthenticateUser(ctx context.Context, userName, password string) (keppel.UserIdentity, *keppel.RegistryV2Error) {
+	user, exists := d.users[userName]
+	passwordHash := dummyPasswordHash
+	if exists {
+		passwordHash = []byte(user.PasswordHash)
+	}
+	err := bcrypt.CompareHashAndPassword(passwordHash, []byte(password))
+	if err != nil || !exists {
+		return nil, keppel.ErrUnauthorized.With("invalid username or password")
+	}
+	return &userIdentity{User: user}, nil
+}
+
+// AuthenticateUserFromRequest implements the keppel.AuthDriver interface.
+func (d *AuthDriver) AuthenticateUserFromRequest(r *http.Request) (keppel.UserIdentity, *keppel.RegistryV2Error) {
+	userName, password, ok := r.BasicAuth()
+	if !ok {
+		// fallback to anonymous auth
+		return nil, nil
+	}
+	return d.AuthenticateUser(r.Context(), userName, password)
+}
+
+type userIdentity struct {
+	User AuthUser
+}
+
+// PluginTypeID implements the keppel.UserIdentity interface.
+func (uid *userIdentity) PluginTypeID() string { return "basic" }
+
+// HasPermission implements the keppel.UserIdentity interface.
+func (uid *userIdentity) HasPermission(perm keppel.Permission, tenantID string) bool {
+	if perm == keppel.CanAdministrateCluster {
+		// this permission is not tied to an auth tenant
+		return tenantID == "" && slices.Contains(uid.User.Permissions, perm)
+	}
+	return tenantID == uid.User.AuthTenantID && slices.Contains(uid.User.Permissions, perm)
+}
+
+// UserType implements the keppel.UserIdentity interface.
+func (uid *userIdentity) UserType() keppel.UserType {
+	return keppel.RegularUser
+}
+
+// UserName implements the keppel.UserIdentity interface.
+func (uid *userIdentity) UserName() string {
+	return uid.User.Name
+}
+
+// UserInfo implements the keppel.UserIdentity interface.
+func (uid *userIdentity) UserInfo() audittools.UserInfo {
+	return nil
+}
+
+// SerializeToJSON implements the keppel.UserIdentity interface.
+func (uid *userIdentity) SerializeToJSON() (payload []byte, err error) {
+	return json.Marshal(uid.User.Name)
+}
+
+// DeserializeFromJSON implements the keppel.UserIdentity interface.
+func (uid *userIdentity) DeserializeFromJSON(in []byte, ad keppel.AuthDriver) error {
+	d, ok := ad.(*AuthDriver)
+	if !ok {
+		return keppel.ErrAuthDriverMismatch
+	}
+	var userName string
+	err := json.Unmarshal(in, &userName)
+	if err != nil {
+		return err
+	}
+
+	// permissions are looked up from the current configuration, so that tokens
+	// for users that were removed from the configuration become invalid
+	user, exists := d.users[userName]
+	if !exists {
+		return fmt.Errorf("user %q does not exist anymore", userName)
+	}
+	uid.User = user
+	return nil
+}
@@ -0,0 +1,148 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package basic
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+func setupAuthDriverForTest(t *testing.T) *AuthDriver {
+	t.Helper()
+	d := &AuthDriver{ConfigPath: "./fixtures/auth.json"}
+	err := d.LoadConfig()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return d
+}
+
+func TestAuthenticateUser(t *testing.T) {
+	d := setupAuthDriverForTest(t)
+
+	// successful authentication
+	uid, rerr := d.AuthenticateUser(t.Context(), "alice", "alicepass")
+	if rerr != nil {
+		t.Fatal(rerr.Error())
+	}
+	assert.DeepEqual(t, "user name", uid.UserName(), "alice")
+	assert.DeepEqual(t, "user type", uid.UserType(), keppel.RegularUser)
+	assert.DeepEqual(t, "can push in own tenant", uid.HasPermission(keppel.CanPushToAccount, "tenant1"), true)
+	assert.DeepEqual(t, "can push in other tenant", uid.HasPermission(keppel.CanPushToAccount, "tenant2"), false)
+	assert.DeepEqual(t, "can change quotas", uid.HasPermission(keppel.CanChangeQuotas, "tenant1"), false)
+	assert.DeepEqual(t, "is cluster admin", uid.HasPermission(keppel.CanAdministrateCluster, ""), false)
+
+	uid, rerr = d.AuthenticateUser(t.Context(), "bob", "bobpass")
+	if rerr != nil {
+		t.Fatal(rerr.Error())
+	}
+	assert.DeepEqual(t, "can pull in own tenant", uid.HasPermission(keppel.CanPullFromAccount, "tenant2"), true)
+	assert.DeepEqual(t, "can push in own tenant", uid.HasPermission(keppel.CanPushToAccount, "tenant2"), false)
+	assert.DeepEqual(t, "is cluster admin", uid.HasPermission(keppel.CanAdministrateCluster, ""), true)
+	assert.DeepEqual(t, "is cluster admin in own tenant", uid.HasPermission(keppel.CanAdministrateCluster, "tenant2"), false)
+
+	// failed authentication: wrong password, unknown user, and password of a different user
+	for _, creds := range [][2]string{{"alice", "wrong"}, {"alice", ""}, {"carol", "alicepass"}, {"bob", "alicepass"}} {
+		uid, rerr := d.AuthenticateUser(t.Context(), creds[0], creds[1])
+		if uid != nil {
+			t.Errorf("expected authentication as %q with password %q to fail, but got uid = %#v", creds[0], creds[1], uid)
+		}
+		if rerr == nil {
+			t.Errorf("expected authentication as %q with password %q to fail, but got no error", creds[0], creds[1])
+		} else {
+			assert.DeepEqual(t, "error code", rerr.Code, keppel.ErrUnauthorized)
+		}
+	}
+}
+
+func TestAuthenticateUserFromRequest(t *testing.T) {
+	d := setupAuthDriverForTest(t)
+
+	// no credentials -> fallback to anonymous auth
+	r := httptest.NewRequest(http.MethodGet, "/keppel/v1/peers", http.NoBody)
+	uid, rerr := d.AuthenticateUserFromRequest(r)
+	if uid != nil || rerr != nil {
+		t.Errorf("expected fallback to anonymous auth, but got uid = %#v, rerr = %#v", uid, rerr)
+	}
+
+	// valid basic auth credentials
+	r.SetBasicAuth("bob", "bobpass")
+	uid, rerr = d.AuthenticateUserFromRequest(r)
+	if rerr != nil {
+		t.Fatal(rerr.Error())
+	}
+	assert.DeepEqual(t, "user name", uid.UserName(), "bob")
+
+	// invalid basic auth credentials
+	r.SetBasicAuth("bob", "wrong")
+	_, rerr = d.AuthenticateUserFromRequest(r)
+	if rerr == nil {
+		t.Fatal("expected authentication with wrong password to fail, but got no error")
+	}
+	assert.DeepEqual(t, "error code", rerr.Code, keppel.ErrUnauthorized)
+}
+
+func TestUserIdentitySerialization(t *testing.T) {
+	d := setupAuthDriverForTest(t)
+	uid, rerr := d.AuthenticateUser(t.Context(), "alice", "alicepass")
+	if rerr != nil {
+		t.Fatal(rerr.Error())
+	}
+
+	// the password hash is not included in the serialized identity
+	payload, err := uid.SerializeToJSON()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "payload", string(payload), `"alice"`)
+
+	uid2, err := keppel.DeserializeUserIdentity("basic", payload, d)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "deserialized identity", uid2, uid)
+
+	// identities of users that were removed from the config are not accepted anymore
+	_, err = keppel.DeserializeUserIdentity("basic", []byte(`"carol"`), d)
+	if err == nil {
+		t.Error("expected deserialization of unknown user to fail, but got no error")
+	}
+}
+
+func TestAuthConfigValidation(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "auth.json")
+	err := os.WriteFile(configPath, []byte(`{"users":[
+		{"name":"alice","password_hash":"$2a$04$f/VFlZcqMVcrw7inWgBjmOALvHXLCUSjgrcsCtNiSUv3Hc0zqTt9e","auth_tenant_id":"tenant1","permissions":["pull"]},
+		{"name":"alice","password_hash":"alicepass","auth_tenant_id":"","permissions":["pull","fly"]},
+		{"name":"bob:builder","password_hash":"$2a$04$yQyqV.fPQTI3eksxvZuaEeK6cElDO0Uo6VRl7lbgB5aaygIikSqpe","auth_tenant_id":"tenant2","permissions":[]}
+	]}`), 0o600)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	d := &AuthDriver{ConfigPath: configPath}
+	err = d.LoadConfig()
+	if err == nil {
+		t.Fatal("expected config validation to fail, but got no error")
+	}
+	for _, expected := range []string{
+		`users[1].password_hash is not a valid bcrypt hash`,
+		`users[1].auth_tenant_id is missing`,
+		`users[1].permissions contains unknown permission "fly"`,
+		`users[1] has the same name as an earlier user: "alice"`,
+		`users[2].name may not contain colons: "bob:builder"`,
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected error message to contain %q, but got: %s", expected, err.Error())
+		}
+	}
+}
@@ -22,21 +22,29 @@ import (
 // RateLimitDriver is the rate limit driver "basic".
 type RateLimitDriver struct {
 	Limits map[keppel.RateLimitedAction]redis_rate.Limit
+	// AnonymousLimits, if present for a given action, replace Limits for anonymous users.
+	AnonymousLimits map[keppel.RateLimitedAction]redis_rate.Limit
 }
 
 type envVarSet struct {
 	RateLimit string
 	Burst     string
+	// If true, the rate limit is not enforced if RateLimit is not set.
+	IsOptional bool
 }
 
 var (
 	envVars = map[keppel.RateLimitedAction]envVarSet{
-		keppel.BlobPullAction:            {"KEPPEL_RATELIMIT_BLOB_PULLS", "KEPPEL_BURST_BLOB_PULLS"},
-		keppel.BlobPushAction:            {"KEPPEL_RATELIMIT_BLOB_PUSHES", "KEPPEL_BURST_BLOB_PUSHES"},
-		keppel.ManifestPullAction:        {"KEPPEL_RATELIMIT_MANIFEST_PULLS", "KEPPEL_BURST_MANIFEST_PULLS"},
-		keppel.ManifestPushAction:        {"KEPPEL_RATELIMIT_MANIFEST_PUSHES", "KEPPEL_BURST_MANIFEST_PUSHES"},
-		keppel.AnycastBlobBytePullAction: {"KEPPEL_RATELIMIT_ANYCAST_BLOB_PULL_BYTES", "KEPPEL_BURST_ANYCAST_BLOB_PULL_BYTES"},
-		keppel.TrivyReportRetrieveAction: {"KEPPEL_RATELIMIT_TRIVY_REPORT_RETRIEVALS", "KEPPEL_BURST_TRIVY_REPORT_RETRIEVALS"},
+		keppel.BlobPullAction:            {"KEPPEL_RATELIMIT_BLOB_PULLS", "KEPPEL_BURST_BLOB_PULLS", false},
+		keppel.BlobPushAction:            {"KEPPEL_RATELIMIT_BLOB_PUSHES", "KEPPEL_BURST_BLOB_PUSHES", false},
+		keppel.ManifestPullAction:        {"KEPPEL_RATELIMIT_MANIFEST_PULLS", "KEPPEL_BURST_MANIFEST_PULLS", false},
+		keppel.ManifestPushAction:        {"KEPPEL_RATELIMIT_MANIFEST_PUSHES", "KEPPEL_BURST_MANIFEST_PUSHES", false},
+		keppel.AnycastBlobBytePullAction: {"KEPPEL_RATELIMIT_ANYCAST_BLOB_PULL_BYTES", "KEPPEL_BURST_ANYCAST_BLOB_PULL_BYTES", true},
+		keppel.TrivyReportRetrieveAction: {"KEPPEL_RATELIMIT_TRIVY_REPORT_RETRIEVALS", "KEPPEL_BURST_TRIVY_REPORT_RETRIEVALS", false},
+	}
+	anonymousEnvVars = map[keppel.RateLimitedAction]envVarSet{
+		keppel.BlobPullAction:     {"KEPPEL_RATELIMIT_ANONYMOUS_BLOB_PULLS", "KEPPEL_BURST_ANONYMOUS_BLOB_PULLS", true},
+		keppel.ManifestPullAction: {"KEPPEL_RATELIMIT_ANONYMOUS_MANIFEST_PULLS", "KEPPEL_BURST_ANONYMOUS_MANIFEST_PULLS", true},
 	}
 	valueRx           = regexp.MustCompile(`^\s*([0-9]+)\s*[Br]/([smh])\s*$`)
 	limitConstructors = map[string]func(int) redis_rate.Limit{
@@ -48,7 +56,10 @@ var (
 
 func init() {
 	keppel.RateLimitDriverRegistry.Add(func() keppel.RateLimitDriver {
-		return RateLimitDriver{make(map[keppel.RateLimitedAction]redis_rate.Limit)}
+		return RateLimitDriver{
+			Limits:          make(map[keppel.RateLimitedAction]redis_rate.Limit),
+			AnonymousLimits: make(map[keppel.RateLimitedAction]redis_rate.Limit),
+		}
 	})
 }
 
@@ -57,8 +68,16 @@ func (d RateLimitDriver) PluginTypeID() string { return "basic" }
 
 // Init implements the keppel.RateLimitDriver interface.
 func (d RateLimitDriver) Init(ad keppel.AuthDriver, cfg keppel.Configuration) error {
+	err := parseLimits(d.Limits, envVars, "rate quota")
+	if err != nil {
+		return err
+	}
+	return parseLimits(d.AnonymousLimits, anonymousEnvVars, "anonymous rate quota")
+}
+
+func parseLimits(limits map[keppel.RateLimitedAction]redis_rate.Limit, envVars map[keppel.RateLimitedAction]envVarSet, description string) error {
 	for action, envVars := range envVars {
-		rate, err := parseRateLimit(envVars.RateLimit)
+		rate, err := parseRateLimit(envVars.RateLimit, envVars.IsOptional)
 		if err != nil {
 			return err
 		}
@@ -67,8 +86,8 @@ func (d RateLimitDriver) Init(ad keppel.AuthDriver, cfg keppel.Configuration) er
 			if err != nil {
 				return err
 			}
-			d.Limits[action] = redis_rate.Limit{Rate: rate.Rate, Burst: burst, Period: rate.Period}
-			logg.Debug("parsed rate quota for %s is %#v", action, d.Limits[action])
+			limits[action] = redis_rate.Limit{Rate: rate.Rate, Burst: burst, Period: rate.Period}
+			logg.Debug("parsed %s for %s is %#v", description, action, limits[action])
 		}
 	}
 	return nil
@@ -83,15 +102,28 @@ func (d RateLimitDriver) GetRateLimit(account models.ReducedAccount, action kepp
 	return None[redis_rate.Limit]()
 }
 
-func parseRateLimit(envVar string) (*redis_rate.Limit, error) {
+// GetAnonymousRateLimit implements the keppel.AnonymousRateLimitDriver interface.
+func (d RateLimitDriver) GetAnonymousRateLimit(action keppel.RateLimitedAction) Option[redis_rate.Limit] {
+	quota, ok := d.AnonymousLimits[action]
+	if ok {
+		return Some(quota)
+	}
+	return None[redis_rate.Limit]()
+}
+
+func parseRateLimit(envVar string, isOptional bool) (*redis_rate.Limit, error) {
 	var valStr string
-	if strings.HasSuffix(envVar, "_BYTES") {
+	if isOptional {
 		valStr = os.Getenv(envVar)
 		if valStr == "" {
 			return nil, nil
 		}
 	} else {
-		valStr = osext.MustGetenv(envVar)
+		var err error
+		valStr, err = osext.NeedGetenv(envVar)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	match := valueRx.FindStringSubmatch(valStr)
@@ -36,7 +36,11 @@ func (d *StorageDriver) PluginTypeID() string { return "filesystem" }
 
 // Init implements the keppel.StorageDriver interface.
 func (d *StorageDriver) Init(ad keppel.AuthDriver, cfg keppel.Configuration) (err error) {
-	d.rootPath, err = filepath.Abs(osext.MustGetenv("KEPPEL_FILESYSTEM_PATH"))
+	rootPath, err := osext.NeedGetenv("KEPPEL_FILESYSTEM_PATH")
+	if err != nil {
+		return err
+	}
+	d.rootPath, err = filepath.Abs(rootPath)
 	return err
 }
 
@@ -155,14 +159,22 @@ func (d *StorageDriver) DeleteManifest(ctx context.Context, account models.Reduc
 // ReadTrivyReport implements the keppel.StorageDriver interface.
 func (d *StorageDriver) ReadTrivyReport(ctx context.Context, account models.ReducedAccount, repoName string, manifestDigest digest.Digest, format string) ([]byte, error) {
 	path := d.getTrivyReportPath(account, repoName, manifestDigest, format)
-	return os.ReadFile(path)
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return trivy.DecompressReport(contents)
 }
 
 // WriteTrivyReport implements the keppel.StorageDriver interface.
 func (d *StorageDriver) WriteTrivyReport(ctx context.Context, account models.ReducedAccount, repoName string, manifestDigest digest.Digest, payload trivy.ReportPayload) error {
+	payload, err := payload.Compress()
+	if err != nil {
+		return err
+	}
 	path := d.getTrivyReportPath(account, repoName, manifestDigest, payload.Format)
 	tmpPath := path + ".tmp"
-	err := os.MkdirAll(filepath.Dir(tmpPath), 0777) // subject to umask
+	err = os.MkdirAll(filepath.Dir(tmpPath), 0777) // subject to umask
 	if err != nil {
 		return err
 	}
@@ -300,6 +312,11 @@ func (d *StorageDriver) getTrivyReports(account models.ReducedAccount) ([]keppel
 	return reports, nil
 }
 
+// StorageCapacity implements the keppel.StorageDriver interface.
+func (d *StorageDriver) StorageCapacity(ctx context.Context) (used, total uint64, err error) {
+	return 0, 0, keppel.ErrCapacityUnknown
+}
+
 // CanSetupAccount implements the keppel.StorageDriver interface.
 func (d *StorageDriver) CanSetupAccount(ctx context.Context, account models.ReducedAccount) error {
 	return nil // this driver does not perform any preflight checks here
@@ -0,0 +1,293 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+// Package ldap contains the AuthDriver "ldap": Users are authenticated by
+// binding against an LDAP server, and their permissions are derived from their
+// group memberships.
+package ldap
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	goldap "github.com/go-ldap/ldap/v3"
+	"github.com/redis/go-redis/v9"
+	"github.com/sapcc/go-bits/logg"
+	"github.com/sapcc/go-bits/osext"
+
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+// AuthDriver is the auth driver "ldap".
+type AuthDriver struct {
+	Config       Config
+	BindPassword string
+	pool         *connPool
+}
+
+// Config is the structure of the configuration file for AuthDriver.
+type Config struct {
+	URL            string      `json:"url"`
+	StartTLS       bool        `json:"start_tls"`
+	CACertPath     string      `json:"ca_cert_path"`
+	BindDN         string      `json:"bind_dn"`
+	UserSearch     UserSearch  `json:"user_search"`
+	GroupAttribute string      `json:"group_attribute"`
+	PoolSize       int         `json:"pool_size"`
+	Rules          []GroupRule `json:"rules"`
+}
+
+// UserSearch appears in type Config.
+type UserSearch struct {
+	BaseDN string `json:"base_dn"`
+	// Filter contains the placeholder "%s" for the (escaped) user name.
+	Filter string `json:"filter"`
+}
+
+// GroupRule appears in type Config. It grants permissions in an auth tenant
+// to all members of a group.
+type GroupRule struct {
+	GroupDN      string              `json:"group_dn"`
+	AuthTenantID string              `json:"auth_tenant_id"`
+	Permissions  []keppel.Permission `json:"permissions"`
+	parsedDN     *goldap.DN
+}
+
+func init() {
+	keppel.AuthDriverRegistry.Add(func() keppel.AuthDriver { return &AuthDriver{} })
+	keppel.UserIdentityRegistry.Add(func() keppel.UserIdentity { return &userIdentity{} })
+}
+
+// PluginTypeID implements the keppel.AuthDriver interface.
+func (d *AuthDriver) PluginTypeID() string { return "ldap" }
+
+// Init implements the keppel.AuthDriver interface.
+func (d *AuthDriver) Init(ctx context.Context, rc *redis.Client) error {
+	configPath, err := osext.NeedGetenv("KEPPEL_LDAP_CONFIG_PATH")
+	if err != nil {
+		return err
+	}
+	d.BindPassword, err = osext.NeedGetenv("KEPPEL_LDAP_BIND_PASSWORD")
+	if err != nil {
+		return err
+	}
+
+	reader, err := os.Open(configPath)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	decoder := json.NewDecoder(reader)
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&d.Config)
+	if err != nil {
+		return fmt.Errorf("while parsing %s: %w", configPath, err)
+	}
+	err = d.Config.validate()
+	if err != nil {
+		return fmt.Errorf("while parsing %s: %w", configPath, err)
+	}
+
+	tlsConfig, err := d.Config.buildTLSConfig()
+	if err != nil {
+		return err
+	}
+	d.pool = newConnPool(d.Config.PoolSize, func() (ldapConn, error) {
+		return dial(d.Config, tlsConfig)
+	})
+	return nil
+}
+
+func (cfg *Config) validate() error {
+	var errs []error
+	if cfg.URL == "" {
+		errs = append(errs, errors.New("url is missing"))
+	}
+	if cfg.StartTLS && strings.HasPrefix(cfg.URL, "ldaps://") {
+		errs = append(errs, errors.New("start_tls cannot be used with an ldaps:// URL"))
+	}
+	if cfg.BindDN == "" {
+		errs = append(errs, errors.New("bind_dn is missing"))
+	}
+	if cfg.UserSearch.BaseDN == "" {
+		errs = append(errs, errors.New("user_search.base_dn is missing"))
+	}
+	if cfg.UserSearch.Filter == "" {
+		cfg.UserSearch.Filter = "(uid=%s)"
+	} else if !strings.Contains(cfg.UserSearch.Filter, "%s") {
+		errs = append(errs, errors.New(`user_search.filter must contain the placeholder "%s" for the user name`))
+	}
+	if cfg.GroupAttribute == "" {
+		cfg.GroupAttribute = "memberOf"
+	}
+	if cfg.PoolSize == 0 {
+		cfg.PoolSize = 4
+	} else if cfg.PoolSize < 0 {
+		errs = append(errs, errors.New("pool_size may not be negative"))
+	}
+
+	for idx, rule := range cfg.Rules {
+		path := fmt.Sprintf("rules[%d]", idx)
+		dn, err := goldap.ParseDN(rule.GroupDN)
+		if err != nil || rule.GroupDN == "" {
+			errs = append(errs, fmt.Errorf("%s.group_dn is not a valid DN: %q", path, rule.GroupDN))
+		}
+		cfg.Rules[idx].parsedDN = dn
+		if rule.AuthTenantID == "" {
+			errs = append(errs, fmt.Errorf("%s.auth_tenant_id is missing", path))
+		}
+		for _, perm := range rule.Permissions {
+			if !perm.IsValid() {
+				errs = append(errs, fmt.Errorf("%s.permissions contains unknown permission %q", path, perm))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (cfg Config) buildTLSConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.CACertPath != "" {
+		buf, err := os.ReadFile(cfg.CACertPath)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(buf) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.CACertPath)
+		}
+	}
+	return tlsConfig, nil
+}
+
+func dial(cfg Config, tlsConfig *tls.Config) (ldapConn, error) {
+	conn, err := goldap.DialURL(cfg.URL,
+		goldap.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}),
+		goldap.DialWithTLSConfig(tlsConfig),
+	)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(30 * time.Second)
+	if cfg.StartTLS {
+		err = conn.StartTLS(tlsConfig)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// AuthenticateUser implements the keppel.AuthDriver interface.
+func (d *AuthDriver) AuthenticateUser(ctx context.Context, userName, password string) (keppel.UserIdentity, *keppel.RegistryV2Error) {
+	// an empty password would result in an unauthenticated bind, which succeeds on most LDAP servers
+	if userName == "" || password == "" {
+		return nil, keppel.ErrUnauthorized.With("invalid username or password")
+	}
+
+	conn, err := d.pool.Get()
+	if err != nil {
+		logg.Error("cannot connect to LDAP server: %s", err.Error())
+		return nil, keppel.ErrUnavailable.With("cannot connect to LDAP server")
+	}
+	groupDNs, err := d.authenticateUserWith(conn, userName, password)
+	d.pool.Put(conn, err)
+
+	switch {
+	case errors.Is(err, errInvalidCredentials):
+		return nil, keppel.ErrUnauthorized.With("invalid username or password")
+	case err != nil:
+		logg.Error("while authenticating user %q against LDAP: %s", userName, err.Error())
+		return nil, keppel.ErrUnavailable.With("cannot authenticate against LDAP server")
+	}
+
+	uid := &userIdentity{keppel.TenantPermissionsIdentity{Name: userName}}
+	for _, rule := range d.Config.Rules {
+		if !slices.ContainsFunc(groupDNs, rule.parsedDN.EqualFold) {
+			continue
+		}
+		uid.Grant(rule.AuthTenantID, rule.Permissions)
+	}
+	return uid, nil
+}
+
+var errInvalidCredentials = errors.New("invalid credentials")
+
+// Returns the DNs of all groups that the user is a member of.
+func (d *AuthDriver) authenticateUserWith(conn ldapConn, userName, password string) ([]*goldap.DN, error) {
+	// the connection may still be bound as a different user from its previous use
+	err := conn.Bind(d.Config.BindDN, d.BindPassword)
+	if err != nil {
+		return nil, fmt.Errorf("cannot bind as %q: %w", d.Config.BindDN, err)
+	}
+
+	result, err := conn.Search(goldap.NewSearchRequest(
+		d.Config.UserSearch.BaseDN, goldap.ScopeWholeSubtree, goldap.NeverDerefAliases,
+		2, 0, false, // we only need to know whether there is more than one match
+		strings.ReplaceAll(d.Config.UserSearch.Filter, "%s", goldap.EscapeFilter(userName)),
+		[]string{d.Config.GroupAttribute}, nil,
+	))
+	if err != nil && !goldap.IsErrorWithCode(err, goldap.LDAPResultSizeLimitExceeded) {
+		return nil, fmt.Errorf("cannot search for user: %w", err)
+	}
+	if result == nil || len(result.Entries) != 1 {
+		// unknown or ambiguous user name
+		return nil, errInvalidCredentials
+	}
+	entry := result.Entries[0]
+
+	err = conn.Bind(entry.DN, password)
+	if goldap.IsErrorWithCode(err, goldap.LDAPResultInvalidCredentials) {
+		return nil, errInvalidCredentials
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot bind as %q: %w", entry.DN, err)
+	}
+
+	var groupDNs []*goldap.DN
+	for _, value := range entry.GetAttributeValues(d.Config.GroupAttribute) {
+		dn, err := goldap.ParseDN(value)
+		if err != nil {
+			logg.Info("ignoring invalid group DN %q for LDAP user %q: %s", value, entry.DN, err.Error())
+			continue
+		}
+		groupDNs = append(groupDNs, dn)
+	}
+	return groupDNs, nil
+}
+
+// AuthenticateUserFromRequest implements the keppel.AuthDriver interface.
+func (d *AuthDriver) AuthenticateUserFromRequest(r *http.Request) (keppel.UserIdentity, *keppel.RegistryV2Error) {
+	userName, password, ok := r.BasicAuth()
+	if !ok {
+		// fallback to anonymous auth
+		return nil, nil
+	}
+	return d.AuthenticateUser(r.Context(), userName, password)
+}
+
+type userIdentity struct {
+	keppel.TenantPermissionsIdentity
+}
+
+// PluginTypeID implements the keppel.UserIdentity interface.
+func (uid *userIdentity) PluginTypeID() string { return "ldap" }
+
+// DeserializeFromJSON implements the keppel.UserIdentity interface.
+func (uid *userIdentity) DeserializeFromJSON(in []byte, ad keppel.AuthDriver) error {
+	if _, ok := ad.(*AuthDriver); !ok {
+		return keppel.ErrAuthDriverMismatch
+	}
+	return json.Unmarshal(in, &uid.TenantPermissionsIdentity)
+}
@@ -0,0 +1,323 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package ldap
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	goldap "github.com/go-ldap/ldap/v3"
+	"github.com/sapcc/go-bits/assert"
+
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// mock LDAP server
+
+type mockEntry struct {
+	DN         string
+	Password   string
+	Attributes map[string][]string
+}
+
+// mockDirectory is an in-memory LDAP server that understands just enough to
+// serve the requests made by AuthDriver.
+type mockDirectory struct {
+	Entries   []mockEntry
+	DialCount int
+	// if set, the next search fails with this error
+	SearchError error
+	LastFilter  string
+}
+
+func (dir *mockDirectory) Dial() (ldapConn, error) {
+	dir.DialCount++
+	return &mockConn{dir: dir}, nil
+}
+
+type mockConn struct {
+	dir     *mockDirectory
+	boundDN string
+	closed  bool
+}
+
+func (c *mockConn) Bind(dn, password string) error {
+	for _, entry := range c.dir.Entries {
+		if entry.DN == dn && entry.Password == password {
+			c.boundDN = dn
+			return nil
+		}
+	}
+	c.boundDN = ""
+	return goldap.NewError(goldap.LDAPResultInvalidCredentials, errors.New("invalid credentials"))
+}
+
+func (c *mockConn) Search(req *goldap.SearchRequest) (*goldap.SearchResult, error) {
+	c.dir.LastFilter = req.Filter
+	if err := c.dir.SearchError; err != nil {
+		c.dir.SearchError = nil
+		return nil, err
+	}
+	if c.boundDN != testBindDN {
+		return nil, goldap.NewError(goldap.LDAPResultInsufficientAccessRights, errors.New("not bound as service user"))
+	}
+
+	// we only understand filters of the form "(uid=...)", where "*" matches all users
+	value, ok := strings.CutPrefix(req.Filter, "(uid=")
+	value, ok2 := strings.CutSuffix(value, ")")
+	if !ok || !ok2 {
+		return nil, goldap.NewError(goldap.LDAPResultUnwillingToPerform, errors.New("unsupported filter: "+req.Filter))
+	}
+
+	result := &goldap.SearchResult{}
+	for _, entry := range c.dir.Entries {
+		uids := entry.Attributes["uid"]
+		if len(uids) == 0 || !strings.HasSuffix(entry.DN, ","+req.BaseDN) {
+			continue
+		}
+		if value != "*" && goldap.EscapeFilter(uids[0]) != value {
+			continue
+		}
+		attrs := make(map[string][]string)
+		for _, name := range req.Attributes {
+			attrs[name] = entry.Attributes[name]
+		}
+		result.Entries = append(result.Entries, goldap.NewEntry(entry.DN, attrs))
+	}
+	if req.SizeLimit > 0 && len(result.Entries) > req.SizeLimit {
+		result.Entries = result.Entries[:req.SizeLimit]
+		return result, goldap.NewError(goldap.LDAPResultSizeLimitExceeded, errors.New("size limit exceeded"))
+	}
+	return result, nil
+}
+
+func (c *mockConn) IsClosing() bool {
+	return c.closed
+}
+
+func (c *mockConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// tests
+
+const (
+	testBindDN       = "cn=keppel,ou=services,dc=example,dc=org"
+	testBindPassword = "service-secret"
+	groupAdmins      = "cn=admins,ou=groups,dc=example,dc=org"
+	groupViewers     = "cn=viewers,ou=groups,dc=example,dc=org"
+)
+
+func setupAuthDriverForTest(t *testing.T) (*AuthDriver, *mockDirectory) {
+	t.Helper()
+	dir := &mockDirectory{Entries: []mockEntry{
+		{DN: testBindDN, Password: testBindPassword},
+		{
+			DN:       "uid=alice,ou=people,dc=example,dc=org",
+			Password: "alicepass",
+			Attributes: map[string][]string{
+				"uid": {"alice"},
+				// DNs are compared case-insensitively, and unknown groups are ignored
+				"memberOf": {"CN=Admins,OU=Groups,DC=example,DC=org", "cn=other,ou=groups,dc=example,dc=org"},
+			},
+		},
+		{
+			DN:       "uid=bob,ou=people,dc=example,dc=org",
+			Password: "bobpass",
+			Attributes: map[string][]string{
+				"uid":      {"bob"},
+				"memberOf": {groupViewers},
+			},
+		},
+		{
+			DN:       "uid=carol,ou=people,dc=example,dc=org",
+			Password: "carolpass",
+			Attributes: map[string][]string{
+				"uid": {"carol"},
+			},
+		},
+	}}
+
+	d := &AuthDriver{
+		Config: Config{
+			URL:        "ldap://ldap.example.org",
+			BindDN:     testBindDN,
+			UserSearch: UserSearch{BaseDN: "ou=people,dc=example,dc=org"},
+			PoolSize:   2,
+			Rules: []GroupRule{
+				{GroupDN: groupAdmins, AuthTenantID: "tenant1", Permissions: []keppel.Permission{"view", "pull", "push", "delete", "change"}},
+				{GroupDN: groupAdmins, AuthTenantID: "tenant2", Permissions: []keppel.Permission{"view", "pull"}},
+				{GroupDN: groupViewers, AuthTenantID: "tenant2", Permissions: []keppel.Permission{"view", "pull"}},
+			},
+		},
+		BindPassword: testBindPassword,
+	}
+	err := d.Config.validate()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	d.pool = newConnPool(d.Config.PoolSize, dir.Dial)
+	return d, dir
+}
+
+func TestAuthenticateUser(t *testing.T) {
+	d, dir := setupAuthDriverForTest(t)
+
+	// successful bind, with permissions derived from group memberships
+	uid, rerr := d.AuthenticateUser(t.Context(), "alice", "alicepass")
+	if rerr != nil {
+		t.Fatal(rerr.Error())
+	}
+	assert.DeepEqual(t, "user name", uid.UserName(), "alice")
+	assert.DeepEqual(t, "user type", uid.UserType(), keppel.RegularUser)
+	assert.DeepEqual(t, "alice can push in tenant1", uid.HasPermission(keppel.CanPushToAccount, "tenant1"), true)
+	assert.DeepEqual(t, "alice can pull in tenant2", uid.HasPermission(keppel.CanPullFromAccount, "tenant2"), true)
+	assert.DeepEqual(t, "alice can push in tenant2", uid.HasPermission(keppel.CanPushToAccount, "tenant2"), false)
+	assert.DeepEqual(t, "alice can change quotas", uid.HasPermission(keppel.CanChangeQuotas, "tenant1"), false)
+
+	uid, rerr = d.AuthenticateUser(t.Context(), "bob", "bobpass")
+	if rerr != nil {
+		t.Fatal(rerr.Error())
+	}
+	assert.DeepEqual(t, "bob can pull in tenant2", uid.HasPermission(keppel.CanPullFromAccount, "tenant2"), true)
+	assert.DeepEqual(t, "bob can view tenant1", uid.HasPermission(keppel.CanViewAccount, "tenant1"), false)
+
+	// users without matching groups can log in, but do not have any permissions
+	uid, rerr = d.AuthenticateUser(t.Context(), "carol", "carolpass")
+	if rerr != nil {
+		t.Fatal(rerr.Error())
+	}
+	assert.DeepEqual(t, "carol can view tenant1", uid.HasPermission(keppel.CanViewAccount, "tenant1"), false)
+
+	// failed binds: wrong password, unknown user, empty password (which would be
+	// an unauthenticated bind), and a wildcard that must be escaped in the filter
+	for _, creds := range [][2]string{{"alice", "wrong"}, {"alice", "bobpass"}, {"dave", "alicepass"}, {"alice", ""}, {"*", "alicepass"}} {
+		uid, rerr := d.AuthenticateUser(t.Context(), creds[0], creds[1])
+		if uid != nil {
+			t.Errorf("expected authentication as %q with password %q to fail, but got uid = %#v", creds[0], creds[1], uid)
+		}
+		if rerr == nil {
+			t.Errorf("expected authentication as %q with password %q to fail, but got no error", creds[0], creds[1])
+		} else {
+			assert.DeepEqual(t, "error code", rerr.Code, keppel.ErrUnauthorized)
+		}
+	}
+
+	assert.DeepEqual(t, "filter for wildcard user name", dir.LastFilter, `(uid=\2a)`)
+
+	// all of this was done on a single pooled connection
+	assert.DeepEqual(t, "dial count", dir.DialCount, 1)
+}
+
+func TestConnectionPoolDiscardsBrokenConnections(t *testing.T) {
+	d, dir := setupAuthDriverForTest(t)
+
+	_, rerr := d.AuthenticateUser(t.Context(), "alice", "alicepass")
+	if rerr != nil {
+		t.Fatal(rerr.Error())
+	}
+	assert.DeepEqual(t, "dial count", dir.DialCount, 1)
+
+	// a network error is reported as such, and not as invalid credentials
+	dir.SearchError = goldap.NewError(goldap.ErrorNetwork, errors.New("connection reset by peer"))
+	_, rerr = d.AuthenticateUser(t.Context(), "alice", "alicepass")
+	if rerr == nil {
+		t.Fatal("expected authentication to fail, but got no error")
+	}
+	assert.DeepEqual(t, "error code", rerr.Code, keppel.ErrUnavailable)
+
+	// the broken connection is not reused
+	_, rerr = d.AuthenticateUser(t.Context(), "alice", "alicepass")
+	if rerr != nil {
+		t.Fatal(rerr.Error())
+	}
+	assert.DeepEqual(t, "dial count", dir.DialCount, 2)
+}
+
+func TestAuthenticateUserFromRequest(t *testing.T) {
+	d, _ := setupAuthDriverForTest(t)
+
+	// no credentials -> fallback to anonymous auth
+	r := httptest.NewRequest(http.MethodGet, "/keppel/v1/peers", http.NoBody)
+	uid, rerr := d.AuthenticateUserFromRequest(r)
+	if uid != nil || rerr != nil {
+		t.Errorf("expected fallback to anonymous auth, but got uid = %#v, rerr = %#v", uid, rerr)
+	}
+
+	r.SetBasicAuth("bob", "bobpass")
+	uid, rerr = d.AuthenticateUserFromRequest(r)
+	if rerr != nil {
+		t.Fatal(rerr.Error())
+	}
+	assert.DeepEqual(t, "user name", uid.UserName(), "bob")
+
+	r.SetBasicAuth("bob", "wrong")
+	_, rerr = d.AuthenticateUserFromRequest(r)
+	if rerr == nil {
+		t.Fatal("expected authentication with wrong password to fail, but got no error")
+	}
+	assert.DeepEqual(t, "error code", rerr.Code, keppel.ErrUnauthorized)
+}
+
+func TestUserIdentitySerialization(t *testing.T) {
+	d, _ := setupAuthDriverForTest(t)
+	uid, rerr := d.AuthenticateUser(t.Context(), "alice", "alicepass")
+	if rerr != nil {
+		t.Fatal(rerr.Error())
+	}
+
+	payload, err := uid.SerializeToJSON()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	uid2, err := keppel.DeserializeUserIdentity("ldap", payload, d)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "deserialized identity", uid2, uid)
+}
+
+func TestConfigValidation(t *testing.T) {
+	cfg := Config{
+		URL:        "ldaps://ldap.example.org",
+		StartTLS:   true,
+		UserSearch: UserSearch{Filter: "(uid=alice)"},
+		Rules: []GroupRule{
+			{GroupDN: "not a DN", AuthTenantID: "", Permissions: []keppel.Permission{"pull", "fly"}},
+		},
+	}
+	err := cfg.validate()
+	if err == nil {
+		t.Fatal("expected config validation to fail, but got no error")
+	}
+	assert.DeepEqual(t, "error message", err.Error(), strings.Join([]string{
+		`start_tls cannot be used with an ldaps:// URL`,
+		`bind_dn is missing`,
+		`user_search.base_dn is missing`,
+		`user_search.filter must contain the placeholder "%s" for the user name`,
+		`rules[0].group_dn is not a valid DN: "not a DN"`,
+		`rules[0].auth_tenant_id is missing`,
+		`rules[0].permissions contains unknown permission "fly"`,
+	}, "\n"))
+
+	// defaults are filled in for optional fields
+	cfg = Config{
+		URL:        "ldap://ldap.example.org",
+		BindDN:     testBindDN,
+		UserSearch: UserSearch{BaseDN: "ou=people,dc=example,dc=org"},
+	}
+	err = cfg.validate()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "default filter", cfg.UserSearch.Filter, "(uid=%s)")
+	assert.DeepEqual(t, "default group attribute", cfg.GroupAttribute, "memberOf")
+	assert.DeepEqual(t, "default pool size", cfg.PoolSize, 4)
+}
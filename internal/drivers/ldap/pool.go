@@ -0,0 +1,64 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package ldap
+
+import (
+	"errors"
+
+	goldap "github.com/go-ldap/ldap/v3"
+)
+
+// ldapConn is the subset of *goldap.Conn that we use. This interface exists to
+// allow substituting a mock LDAP server in tests.
+type ldapConn interface {
+	Bind(username, password string) error
+	Search(*goldap.SearchRequest) (*goldap.SearchResult, error)
+	IsClosing() bool
+	Close() error
+}
+
+// connPool keeps up to a fixed number of idle LDAP connections around, so that
+// we do not need to establish a new connection (possibly including a TLS
+// handshake) for every authentication.
+type connPool struct {
+	dial func() (ldapConn, error)
+	idle chan ldapConn
+}
+
+func newConnPool(size int, dial func() (ldapConn, error)) *connPool {
+	return &connPool{
+		dial: dial,
+		idle: make(chan ldapConn, size),
+	}
+}
+
+// Get returns an idle connection if there is one, or establishes a new one.
+func (p *connPool) Get() (ldapConn, error) {
+	for {
+		select {
+		case conn := <-p.idle:
+			if conn.IsClosing() {
+				continue
+			}
+			return conn, nil
+		default:
+			return p.dial()
+		}
+	}
+}
+
+// Put returns a connection to the pool after use. The error is the one that
+// resulted from using the connection. Connections are discarded if an
+// unexpected error occurred, since they may be broken, or if the pool is full.
+func (p *connPool) Put(conn ldapConn, err error) {
+	if (err != nil && !errors.Is(err, errInvalidCredentials)) || conn.IsClosing() {
+		conn.Close()
+		return
+	}
+	select {
+	case p.idle <- conn:
+	default:
+		conn.Close()
+	}
+}
@@ -28,8 +28,11 @@ func (fd *federationDriver) PluginTypeID() string { return "multi" }
 
 // Init implements the keppel.FederationDriver interface.
 func (fd *federationDriver) Init(ctx context.Context, ad keppel.AuthDriver, cfg keppel.Configuration) error {
-	driverNames := strings.SplitSeq(osext.MustGetenv("KEPPEL_FEDERATION_MULTI_DRIVERS"), ",")
-	for driverName := range driverNames {
+	driverNamesStr, err := osext.NeedGetenv("KEPPEL_FEDERATION_MULTI_DRIVERS")
+	if err != nil {
+		return err
+	}
+	for driverName := range strings.SplitSeq(driverNamesStr, ",") {
 		if driverName == "multi" {
 			// prevent infinite loops
 			return errors.New(`cannot nest "multi" federation driver within itself`)
@@ -90,7 +93,56 @@ func (fd *federationDriver) RecordExistingAccount(ctx context.Context, account m
 	return nil
 }
 
+// SupportsBatchAnnouncements implements the keppel.BatchAnnouncingFederationDriver interface.
+func (fd *federationDriver) SupportsBatchAnnouncements() bool {
+	// if any subdriver announces one account at a time, a large batch would
+	// take as long as announcing all of its accounts in sequence
+	for _, driver := range fd.Drivers {
+		if !keppel.SupportsBatchAnnouncements(driver) {
+			return false
+		}
+	}
+	return true
+}
+
+// RecordExistingAccounts implements the keppel.BatchAnnouncingFederationDriver interface.
+func (fd *federationDriver) RecordExistingAccounts(ctx context.Context, accounts []models.Account, now time.Time) []error {
+	errs := make([]error, len(accounts))
+	for _, driver := range fd.Drivers {
+		// like in RecordExistingAccount, each account is only given to the next
+		// driver if all previous drivers accepted it
+		var (
+			pendingAccounts []models.Account
+			pendingIndexes  []int
+		)
+		for idx, account := range accounts {
+			if errs[idx] == nil {
+				pendingAccounts = append(pendingAccounts, account)
+				pendingIndexes = append(pendingIndexes, idx)
+			}
+		}
+		if len(pendingAccounts) == 0 {
+			break
+		}
+		for pendingIdx, err := range keppel.RecordExistingAccounts(ctx, driver, pendingAccounts, now) {
+			errs[pendingIndexes[pendingIdx]] = err
+		}
+	}
+	return errs
+}
+
 // FindPrimaryAccount implements the keppel.FederationDriver interface.
 func (fd *federationDriver) FindPrimaryAccount(ctx context.Context, accountName models.AccountName) (peerHostName string, err error) {
 	return fd.Drivers[0].FindPrimaryAccount(ctx, accountName)
 }
+
+// SweepArchivedAccountNames implements the keppel.FederationDriver interface.
+func (fd *federationDriver) SweepArchivedAccountNames(ctx context.Context, now time.Time) error {
+	for _, driver := range fd.Drivers {
+		err := driver.SweepArchivedAccountNames(ctx, now)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,226 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+// Package oidc contains the AuthDriver "oidc": Users are authenticated with
+// access tokens issued by an OpenID Connect identity provider, and their
+// permissions are derived from claims in these tokens.
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/redis/go-redis/v9"
+	"github.com/sapcc/go-bits/osext"
+
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+// AuthDriver is the auth driver "oidc".
+type AuthDriver struct {
+	Config Config
+	jwks   *jwksCache
+}
+
+// Config is the structure of the configuration file for AuthDriver.
+type Config struct {
+	IssuerURL     string      `json:"issuer_url"`
+	Audience      string      `json:"audience"`
+	UserNameClaim string      `json:"username_claim"`
+	GroupsClaim   string      `json:"groups_claim"`
+	Rules         []GroupRule `json:"rules"`
+}
+
+// GroupRule appears in type Config. It grants permissions in an auth tenant
+// to all users that have the given value in their groups claim.
+type GroupRule struct {
+	Group        string              `json:"group"`
+	AuthTenantID string              `json:"auth_tenant_id"`
+	Permissions  []keppel.Permission `json:"permissions"`
+}
+
+// OIDCTokenUserName is the user name that must be given when supplying an
+// access token as password through basic auth (e.g. for `docker login`).
+const OIDCTokenUserName = "oidc-token"
+
+func init() {
+	keppel.AuthDriverRegistry.Add(func() keppel.AuthDriver { return &AuthDriver{} })
+	keppel.UserIdentityRegistry.Add(func() keppel.UserIdentity { return &userIdentity{} })
+}
+
+// PluginTypeID implements the keppel.AuthDriver interface.
+func (d *AuthDriver) PluginTypeID() string { return "oidc" }
+
+// Init implements the keppel.AuthDriver interface.
+func (d *AuthDriver) Init(ctx context.Context, rc *redis.Client) error {
+	configPath, err := osext.NeedGetenv("KEPPEL_OIDC_CONFIG_PATH")
+	if err != nil {
+		return err
+	}
+	reader, err := os.Open(configPath)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	decoder := json.NewDecoder(reader)
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&d.Config)
+	if err != nil {
+		return fmt.Errorf("while parsing %s: %w", configPath, err)
+	}
+	err = d.Config.validate()
+	if err != nil {
+		return fmt.Errorf("while parsing %s: %w", configPath, err)
+	}
+
+	return d.initJWKS(ctx, &http.Client{Timeout: 10 * time.Second})
+}
+
+func (d *AuthDriver) initJWKS(ctx context.Context, client *http.Client) error {
+	jwksURL, err := discoverJWKSURL(ctx, client, d.Config.IssuerURL)
+	if err != nil {
+		return fmt.Errorf("cannot discover OIDC provider configuration: %w", err)
+	}
+	d.jwks = &jwksCache{URL: jwksURL, Client: client, TimeNow: time.Now}
+	return nil
+}
+
+func (cfg *Config) validate() error {
+	var errs []error
+	if cfg.IssuerURL == "" {
+		errs = append(errs, errors.New("issuer_url is missing"))
+	}
+	if cfg.Audience == "" {
+		errs = append(errs, errors.New("audience is missing"))
+	}
+	if cfg.UserNameClaim == "" {
+		cfg.UserNameClaim = "sub"
+	}
+	if cfg.GroupsClaim == "" {
+		cfg.GroupsClaim = "groups"
+	}
+
+	for idx, rule := range cfg.Rules {
+		path := fmt.Sprintf("rules[%d]", idx)
+		if rule.Group == "" {
+			errs = append(errs, fmt.Errorf("%s.group is missing", path))
+		}
+		if rule.AuthTenantID == "" {
+			errs = append(errs, fmt.Errorf("%s.auth_tenant_id is missing", path))
+		}
+		for _, perm := range rule.Permissions {
+			if !perm.IsValid() {
+				errs = append(errs, fmt.Errorf("%s.permissions contains unknown permission %q", path, perm))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// AuthenticateUser implements the keppel.AuthDriver interface.
+func (d *AuthDriver) AuthenticateUser(ctx context.Context, userName, password string) (keppel.UserIdentity, *keppel.RegistryV2Error) {
+	if userName != OIDCTokenUserName {
+		return nil, keppel.ErrUnauthorized.With(`wrong username (to log in with an OIDC access token, use the username %q)`, OIDCTokenUserName)
+	}
+	return d.authenticateToken(ctx, password)
+}
+
+// AuthenticateUserFromRequest implements the keppel.AuthDriver interface.
+func (d *AuthDriver) AuthenticateUserFromRequest(r *http.Request) (keppel.UserIdentity, *keppel.RegistryV2Error) {
+	tokenStr := r.Header.Get("X-Auth-Token")
+	if tokenStr == "" {
+		// fallback to anonymous auth
+		return nil, nil
+	}
+	return d.authenticateToken(r.Context(), tokenStr)
+}
+
+func (d *AuthDriver) authenticateToken(ctx context.Context, tokenStr string) (keppel.UserIdentity, *keppel.RegistryV2Error) {
+	keyFunc := func(t *jwt.Token) (any, error) {
+		keyID, _ := t.Header["kid"].(string)
+		return d.jwks.GetKey(ctx, keyID)
+	}
+	var claims jwt.MapClaims
+	_, err := jwt.ParseWithClaims(tokenStr, &claims, keyFunc,
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}),
+		jwt.WithLeeway(3*time.Second),
+		jwt.WithIssuer(d.Config.IssuerURL),
+		jwt.WithAudience(d.Config.Audience),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, keppel.ErrUnauthorized.With("OIDC token validation failed: %s", err.Error())
+	}
+
+	userName, ok := lookupClaim(claims, d.Config.UserNameClaim).(string)
+	if !ok || userName == "" {
+		return nil, keppel.ErrUnauthorized.With("OIDC token validation failed: no value for claim %q", d.Config.UserNameClaim)
+	}
+
+	uid := &userIdentity{keppel.TenantPermissionsIdentity{Name: userName}}
+	groups := claimValues(lookupClaim(claims, d.Config.GroupsClaim))
+	for _, rule := range d.Config.Rules {
+		if !slices.Contains(groups, rule.Group) {
+			continue
+		}
+		uid.Grant(rule.AuthTenantID, rule.Permissions)
+	}
+	return uid, nil
+}
+
+// lookupClaim finds the value of a possibly nested claim. For example, the
+// path "realm_access.roles" refers to the field "roles" within the object in
+// the claim "realm_access".
+func lookupClaim(claims map[string]any, path string) any {
+	var current any = claims
+	for field := range strings.SplitSeq(path, ".") {
+		obj, ok := current.(map[string]any)
+		if !ok {
+			return nil
+		}
+		current = obj[field]
+	}
+	return current
+}
+
+// claimValues interprets a claim value as a list of strings. A single string
+// is interpreted as a list with one element.
+func claimValues(value any) []string {
+	switch value := value.(type) {
+	case string:
+		return []string{value}
+	case []any:
+		result := make([]string, 0, len(value))
+		for _, elem := range value {
+			if str, ok := elem.(string); ok {
+				result = append(result, str)
+			}
+		}
+		return result
+	default:
+		return nil
+	}
+}
+
+type userIdentity struct {
+	keppel.TenantPermissionsIdentity
+}
+
+// PluginTypeID implements the keppel.UserIdentity interface.
+func (uid *userIdentity) PluginTypeID() string { return "oidc" }
+
+// DeserializeFromJSON implements the keppel.UserIdentity interface.
+func (uid *userIdentity) DeserializeFromJSON(in []byte, ad keppel.AuthDriver) error {
+	if _, ok := ad.(*AuthDriver); !ok {
+		return keppel.ErrAuthDriverMismatch
+	}
+	return json.Unmarshal(in, &uid.TenantPermissionsIdentity)
+}
@@ -0,0 +1,379 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package oidc
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/mock"
+
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+////////////////////////////////////////////////////////////////////////////////
+// mock OIDC provider
+
+type mockProvider struct {
+	Server *httptest.Server
+	// the keys published in the JWKS (key = key ID)
+	Keys           map[string]crypto.Signer
+	JWKSFetchCount int
+	// if true, requests for the JWKS fail
+	JWKSUnavailable bool
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	p := &mockProvider{Keys: make(map[string]crypto.Signer)}
+	p.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			must(t, json.NewEncoder(w).Encode(map[string]string{
+				"issuer":   p.Server.URL,
+				"jwks_uri": p.Server.URL + "/jwks",
+			}))
+		case "/jwks":
+			p.JWKSFetchCount++
+			if p.JWKSUnavailable {
+				http.Error(w, "service unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			keys := []map[string]string{
+				// keys for other purposes are ignored
+				{"kid": "enc", "kty": "RSA", "use": "enc", "n": "AQAB", "e": "AQAB"},
+			}
+			for keyID, key := range p.Keys {
+				keys = append(keys, marshalJWK(keyID, key.Public()))
+			}
+			must(t, json.NewEncoder(w).Encode(map[string]any{"keys": keys}))
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(p.Server.Close)
+	return p
+}
+
+func marshalJWK(keyID string, key crypto.PublicKey) map[string]string {
+	encode := base64.RawURLEncoding.EncodeToString
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return map[string]string{"kid": keyID, "kty": "RSA", "use": "sig", "n": encode(key.N.Bytes()), "e": encode(big.NewInt(int64(key.E)).Bytes())}
+	case ed25519.PublicKey:
+		return map[string]string{"kid": keyID, "kty": "OKP", "crv": "Ed25519", "x": encode(key)}
+	default:
+		panic("unsupported key type")
+	}
+}
+
+// IssueToken signs a token with the key of the given ID.
+func (p *mockProvider) IssueToken(t *testing.T, keyID string, claims jwt.MapClaims) string {
+	t.Helper()
+	return signToken(t, keyID, p.Keys[keyID], claims)
+}
+
+func signToken(t *testing.T, keyID string, key crypto.Signer, claims jwt.MapClaims) string {
+	t.Helper()
+	var method jwt.SigningMethod = jwt.SigningMethodRS256
+	if _, ok := key.(ed25519.PrivateKey); ok {
+		method = jwt.SigningMethodEdDSA
+	}
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = keyID
+	tokenStr, err := token.SignedString(key)
+	must(t, err)
+	return tokenStr
+}
+
+func must(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func generateRSAKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	must(t, err)
+	return key
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// tests
+
+func setupAuthDriverForTest(t *testing.T, cfg Config) (*AuthDriver, *mockProvider, *mock.Clock) {
+	t.Helper()
+	p := newMockProvider(t)
+	p.Keys["rsa1"] = generateRSAKey(t)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	must(t, err)
+	p.Keys["ed1"] = edKey
+
+	cfg.IssuerURL = p.Server.URL
+	cfg.Audience = "keppel"
+	d := &AuthDriver{Config: cfg}
+	must(t, d.Config.validate())
+	must(t, d.initJWKS(t.Context(), p.Server.Client()))
+
+	clock := mock.NewClock()
+	d.jwks.TimeNow = clock.Now
+	return d, p, clock
+}
+
+func validClaims(p *mockProvider) jwt.MapClaims {
+	now := time.Now()
+	return jwt.MapClaims{
+		"iss":                p.Server.URL,
+		"aud":                "keppel",
+		"sub":                "c0ffee",
+		"preferred_username": "alice",
+		"exp":                now.Add(time.Hour).Unix(),
+		"iat":                now.Unix(),
+		"groups":             []string{"registry-admins", "developers"},
+		"realm_access":       map[string]any{"roles": []string{"viewer"}},
+	}
+}
+
+func withClaims(claims jwt.MapClaims, overrides jwt.MapClaims) jwt.MapClaims {
+	result := make(jwt.MapClaims, len(claims))
+	for key, value := range claims {
+		result[key] = value
+	}
+	for key, value := range overrides {
+		if value == nil {
+			delete(result, key)
+		} else {
+			result[key] = value
+		}
+	}
+	return result
+}
+
+var testRules = []GroupRule{
+	{Group: "registry-admins", AuthTenantID: "tenant1", Permissions: []keppel.Permission{"view", "pull", "push", "delete", "change"}},
+	{Group: "developers", AuthTenantID: "tenant2", Permissions: []keppel.Permission{"view", "pull"}},
+	{Group: "viewer", AuthTenantID: "tenant3", Permissions: []keppel.Permission{"view"}},
+}
+
+func TestValidTokens(t *testing.T) {
+	d, p, _ := setupAuthDriverForTest(t, Config{UserNameClaim: "preferred_username", Rules: testRules})
+
+	// tokens can be given in the X-Auth-Token header...
+	r := httptest.NewRequest(http.MethodGet, "/keppel/v1/accounts", http.NoBody)
+	r.Header.Set("X-Auth-Token", p.IssueToken(t, "rsa1", validClaims(p)))
+	uid, rerr := d.AuthenticateUserFromRequest(r)
+	if rerr != nil {
+		t.Fatal(rerr.Error())
+	}
+	assert.DeepEqual(t, "user name", uid.UserName(), "alice")
+	assert.DeepEqual(t, "user type", uid.UserType(), keppel.RegularUser)
+	assert.DeepEqual(t, "can push in tenant1", uid.HasPermission(keppel.CanPushToAccount, "tenant1"), true)
+	assert.DeepEqual(t, "can pull in tenant2", uid.HasPermission(keppel.CanPullFromAccount, "tenant2"), true)
+	assert.DeepEqual(t, "can push in tenant2", uid.HasPermission(keppel.CanPushToAccount, "tenant2"), false)
+	assert.DeepEqual(t, "can view tenant3", uid.HasPermission(keppel.CanViewAccount, "tenant3"), false)
+
+	// ...or as password with a special username
+	uid, rerr = d.AuthenticateUser(t.Context(), OIDCTokenUserName, p.IssueToken(t, "ed1", validClaims(p)))
+	if rerr != nil {
+		t.Fatal(rerr.Error())
+	}
+	assert.DeepEqual(t, "user name", uid.UserName(), "alice")
+	_, rerr = d.AuthenticateUser(t.Context(), "alice", p.IssueToken(t, "ed1", validClaims(p)))
+	assert.DeepEqual(t, "error for wrong username", rerr.Error(), `wrong username (to log in with an OIDC access token, use the username "oidc-token")`)
+
+	// the JWKS was only fetched once
+	assert.DeepEqual(t, "JWKS fetch count", p.JWKSFetchCount, 1)
+
+	// identities survive serialization
+	payload, err := uid.SerializeToJSON()
+	must(t, err)
+	uid2, err := keppel.DeserializeUserIdentity("oidc", payload, d)
+	must(t, err)
+	assert.DeepEqual(t, "deserialized identity", uid2, uid)
+
+	// without a token, we fall back to anonymous auth
+	r = httptest.NewRequest(http.MethodGet, "/keppel/v1/accounts", http.NoBody)
+	uid, rerr = d.AuthenticateUserFromRequest(r)
+	if uid != nil || rerr != nil {
+		t.Errorf("expected fallback to anonymous auth, but got uid = %#v, rerr = %#v", uid, rerr)
+	}
+}
+
+func TestNestedGroupsClaim(t *testing.T) {
+	d, p, _ := setupAuthDriverForTest(t, Config{GroupsClaim: "realm_access.roles", Rules: testRules})
+
+	uid, rerr := d.AuthenticateUser(t.Context(), OIDCTokenUserName, p.IssueToken(t, "rsa1", validClaims(p)))
+	if rerr != nil {
+		t.Fatal(rerr.Error())
+	}
+	// the default username claim is "sub"
+	assert.DeepEqual(t, "user name", uid.UserName(), "c0ffee")
+	assert.DeepEqual(t, "can view tenant3", uid.HasPermission(keppel.CanViewAccount, "tenant3"), true)
+	assert.DeepEqual(t, "can view tenant1", uid.HasPermission(keppel.CanViewAccount, "tenant1"), false)
+}
+
+func TestInvalidTokens(t *testing.T) {
+	d, p, _ := setupAuthDriverForTest(t, Config{UserNameClaim: "preferred_username", Rules: testRules})
+	claims := validClaims(p)
+	hourAgo := time.Now().Add(-time.Hour).Unix()
+
+	testCases := map[string]string{
+		"expired token":          p.IssueToken(t, "rsa1", withClaims(claims, jwt.MapClaims{"exp": hourAgo})),
+		"token without expiry":   p.IssueToken(t, "rsa1", withClaims(claims, jwt.MapClaims{"exp": nil})),
+		"wrong audience":         p.IssueToken(t, "rsa1", withClaims(claims, jwt.MapClaims{"aud": "someone-else"})),
+		"wrong issuer":           p.IssueToken(t, "rsa1", withClaims(claims, jwt.MapClaims{"iss": "https://evil.example.org"})),
+		"missing username claim": p.IssueToken(t, "rsa1", withClaims(claims, jwt.MapClaims{"preferred_username": nil})),
+		"forged signature":       signToken(t, "rsa1", generateRSAKey(t), claims),
+		"unknown key":            signToken(t, "rsa2", generateRSAKey(t), claims),
+		"symmetric signature":    signTokenWithSecret(t, claims),
+		"garbage":                "not-a-token",
+	}
+	expectedMessages := map[string]string{
+		"expired token":          "token is expired",
+		"token without expiry":   "exp claim is required",
+		"wrong audience":         "token has invalid audience",
+		"wrong issuer":           "token has invalid issuer",
+		"missing username claim": `no value for claim "preferred_username"`,
+		"forged signature":       "token signature is invalid",
+		"unknown key":            `no key found for key ID "rsa2"`,
+		"symmetric signature":    "signing method HS256 is invalid",
+		"garbage":                "token is malformed",
+	}
+
+	for name, tokenStr := range testCases {
+		uid, rerr := d.AuthenticateUser(t.Context(), OIDCTokenUserName, tokenStr)
+		if uid != nil {
+			t.Errorf("%s: expected authentication to fail, but got uid = %#v", name, uid)
+		}
+		if rerr == nil {
+			t.Errorf("%s: expected authentication to fail, but got no error", name)
+			continue
+		}
+		assert.DeepEqual(t, name+": error code", rerr.Code, keppel.ErrUnauthorized)
+		if !strings.Contains(rerr.Error(), expectedMessages[name]) {
+			t.Errorf("%s: expected error message to contain %q, but got %q", name, expectedMessages[name], rerr.Error())
+		}
+	}
+}
+
+func signTokenWithSecret(t *testing.T, claims jwt.MapClaims) string {
+	t.Helper()
+	tokenStr, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("secret"))
+	must(t, err)
+	return tokenStr
+}
+
+func TestKeyRotation(t *testing.T) {
+	d, p, clock := setupAuthDriverForTest(t, Config{Rules: testRules})
+
+	_, rerr := d.AuthenticateUser(t.Context(), OIDCTokenUserName, p.IssueToken(t, "rsa1", validClaims(p)))
+	if rerr != nil {
+		t.Fatal(rerr.Error())
+	}
+	assert.DeepEqual(t, "JWKS fetch count", p.JWKSFetchCount, 1)
+
+	// the provider rotates its keys: tokens with the new key ID trigger a refresh of the JWKS...
+	p.Keys["rsa2"] = generateRSAKey(t)
+	delete(p.Keys, "rsa1")
+	clock.StepBy(2 * time.Minute)
+	_, rerr = d.AuthenticateUser(t.Context(), OIDCTokenUserName, p.IssueToken(t, "rsa2", validClaims(p)))
+	if rerr != nil {
+		t.Fatal(rerr.Error())
+	}
+	assert.DeepEqual(t, "JWKS fetch count", p.JWKSFetchCount, 2)
+
+	// ...but unknown key IDs do not cause a refresh if the last one was very recent
+	_, rerr = d.AuthenticateUser(t.Context(), OIDCTokenUserName, signToken(t, "rsa3", generateRSAKey(t), validClaims(p)))
+	if rerr == nil {
+		t.Fatal("expected authentication with unknown key to fail, but got no error")
+	}
+	assert.DeepEqual(t, "JWKS fetch count", p.JWKSFetchCount, 2)
+
+	// keys are refreshed periodically even if all key IDs are known
+	clock.StepBy(2 * time.Hour)
+	_, rerr = d.AuthenticateUser(t.Context(), OIDCTokenUserName, p.IssueToken(t, "ed1", validClaims(p)))
+	if rerr != nil {
+		t.Fatal(rerr.Error())
+	}
+	assert.DeepEqual(t, "JWKS fetch count", p.JWKSFetchCount, 3)
+}
+
+func TestJWKSUnavailable(t *testing.T) {
+	d, p, clock := setupAuthDriverForTest(t, Config{Rules: testRules})
+
+	// when the JWKS cannot be fetched, the error is reported...
+	p.JWKSUnavailable = true
+	_, rerr := d.AuthenticateUser(t.Context(), OIDCTokenUserName, p.IssueToken(t, "rsa1", validClaims(p)))
+	if rerr == nil {
+		t.Fatal("expected authentication to fail while the JWKS is unavailable, but got no error")
+	}
+	assert.DeepEqual(t, "JWKS fetch count", p.JWKSFetchCount, 1)
+
+	// ...and the fetch is not retried immediately, even when the provider comes back
+	p.JWKSUnavailable = false
+	_, rerr = d.AuthenticateUser(t.Context(), OIDCTokenUserName, p.IssueToken(t, "rsa1", validClaims(p)))
+	if rerr == nil {
+		t.Fatal("expected authentication to fail before retrying the JWKS fetch, but got no error")
+	}
+	assert.DeepEqual(t, "JWKS fetch count", p.JWKSFetchCount, 1)
+
+	clock.StepBy(2 * time.Minute)
+	_, rerr = d.AuthenticateUser(t.Context(), OIDCTokenUserName, p.IssueToken(t, "rsa1", validClaims(p)))
+	if rerr != nil {
+		t.Fatal(rerr.Error())
+	}
+	assert.DeepEqual(t, "JWKS fetch count", p.JWKSFetchCount, 2)
+
+	// when refreshing fails later on, the stale keys continue to be used
+	p.JWKSUnavailable = true
+	clock.StepBy(2 * time.Hour)
+	_, rerr = d.AuthenticateUser(t.Context(), OIDCTokenUserName, p.IssueToken(t, "rsa1", validClaims(p)))
+	if rerr != nil {
+		t.Fatal(rerr.Error())
+	}
+	assert.DeepEqual(t, "JWKS fetch count", p.JWKSFetchCount, 3)
+}
+
+func TestDiscoveryIssuerMismatch(t *testing.T) {
+	p := newMockProvider(t)
+	d := &AuthDriver{Config: Config{IssuerURL: p.Server.URL + "/", Audience: "keppel"}}
+	must(t, d.Config.validate())
+	err := d.initJWKS(t.Context(), p.Server.Client())
+	if err == nil || !strings.Contains(err.Error(), "issuer mismatch") {
+		t.Errorf("expected issuer mismatch error, but got: %v", err)
+	}
+}
+
+func TestConfigValidation(t *testing.T) {
+	cfg := Config{
+		Rules: []GroupRule{{Permissions: []keppel.Permission{"pull", "fly"}}},
+	}
+	err := cfg.validate()
+	if err == nil {
+		t.Fatal("expected config validation to fail, but got no error")
+	}
+	assert.DeepEqual(t, "error message", err.Error(), strings.Join([]string{
+		`issuer_url is missing`,
+		`audience is missing`,
+		`rules[0].group is missing`,
+		`rules[0].auth_tenant_id is missing`,
+		`rules[0].permissions contains unknown permission "fly"`,
+	}, "\n"))
+	assert.DeepEqual(t, "default username claim", cfg.UserNameClaim, "sub")
+	assert.DeepEqual(t, "default groups claim", cfg.GroupsClaim, "groups")
+}
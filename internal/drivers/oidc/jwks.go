@@ -0,0 +1,285 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sapcc/go-bits/logg"
+)
+
+const (
+	// how long fetched keys are used before they are refreshed
+	jwksMaxAge = 1 * time.Hour
+	// how long we wait at least before refetching keys because of an unknown key ID
+	jwksMinRefreshInterval = 1 * time.Minute
+)
+
+// discoverJWKSURL reads the OpenID provider configuration of the given issuer
+// and returns its JWKS URL.
+func discoverJWKSURL(ctx context.Context, client *http.Client, issuerURL string) (string, error) {
+	discoveryURL := strings.TrimSuffix(issuerURL, "/") + "/.well-known/openid-configuration"
+	var data struct {
+		Issuer  string `json:"issuer"`
+		JWKSURL string `json:"jwks_uri"`
+	}
+	err := getJSON(ctx, client, discoveryURL, &data)
+	if err != nil {
+		return "", err
+	}
+	// as per OpenID Connect Discovery 1.0, section 4.3
+	if data.Issuer != issuerURL {
+		return "", fmt.Errorf("issuer mismatch in %s: expected %q, but got %q", discoveryURL, issuerURL, data.Issuer)
+	}
+	if data.JWKSURL == "" {
+		return "", fmt.Errorf("no jwks_uri found in %s", discoveryURL)
+	}
+	return data.JWKSURL, nil
+}
+
+func getJSON(ctx context.Context, client *http.Client, url string, target any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, http.NoBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned unexpected status %d", url, resp.StatusCode)
+	}
+	err = json.NewDecoder(resp.Body).Decode(target)
+	if err != nil {
+		return fmt.Errorf("cannot decode response from GET %s: %w", url, err)
+	}
+	return nil
+}
+
+// jwksCache holds the public keys of the identity provider. Keys are
+// refreshed periodically, and also when a token refers to an unknown key ID
+// (since the identity provider might have rotated its keys in the meantime).
+type jwksCache struct {
+	URL    string
+	Client *http.Client
+	// for unit tests
+	TimeNow func() time.Time
+
+	mutex sync.Mutex
+	keys  map[string]crypto.PublicKey // key = key ID
+	// when `keys` was last fetched successfully
+	fetchedAt time.Time
+	// when we last tried to fetch keys (successfully or not), and with which error
+	lastAttemptAt    time.Time
+	lastAttemptError error
+	// while a fetch is in progress, this channel is closed when it completes;
+	// concurrent callers wait on it instead of starting their own fetch
+	fetchDone chan struct{}
+}
+
+// GetKey returns the public key with the given key ID.
+func (c *jwksCache) GetKey(ctx context.Context, keyID string) (crypto.PublicKey, error) {
+	c.mutex.Lock()
+	for {
+		now := c.TimeNow()
+		key, exists := c.keys[keyID]
+		switch {
+		case exists && now.Sub(c.fetchedAt) < jwksMaxAge:
+			c.mutex.Unlock()
+			return key, nil
+		case c.fetchDone != nil:
+			// another caller is already fetching keys, so wait for its result instead
+			// of hitting the identity provider again, and then reevaluate
+			fetchDone := c.fetchDone
+			c.mutex.Unlock()
+			select {
+			case <-fetchDone:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			c.mutex.Lock()
+			continue
+		case !c.lastAttemptAt.IsZero() && now.Sub(c.lastAttemptAt) < jwksMinRefreshInterval:
+			// do not allow clients to hammer the identity provider with made-up key
+			// IDs, and do not retry failed fetches immediately either
+			err := c.lastAttemptError
+			c.mutex.Unlock()
+			switch {
+			case exists:
+				// keep using stale keys while the identity provider is unreachable
+				return key, nil
+			case err != nil:
+				return nil, err
+			default:
+				return nil, fmt.Errorf("no key found for key ID %q", keyID)
+			}
+		}
+		break
+	}
+
+	// fetch keys without holding the lock, so that callers with known keys are
+	// not blocked (the fetch is not aborted when this caller goes away, since
+	// other callers might be waiting for it)
+	fetchDone := make(chan struct{})
+	c.fetchDone = fetchDone
+	c.lastAttemptAt = c.TimeNow()
+	c.mutex.Unlock()
+	keys, err := c.fetchKeys(context.WithoutCancel(ctx))
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.fetchDone = nil
+	close(fetchDone)
+
+	c.lastAttemptError = err
+	if err != nil {
+		key, exists := c.keys[keyID]
+		if exists {
+			// keep using stale keys while the identity provider is unreachable
+			logg.Error("while refreshing OIDC signing keys: %s", err.Error())
+			return key, nil
+		}
+		return nil, err
+	}
+	c.keys = keys
+	c.fetchedAt = c.lastAttemptAt
+
+	key, exists := c.keys[keyID]
+	if !exists {
+		return nil, fmt.Errorf("no key found for key ID %q", keyID)
+	}
+	return key, nil
+}
+
+func (c *jwksCache) fetchKeys(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	var data struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	err := getJSON(ctx, c.Client, c.URL, &data)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(data.Keys))
+	for _, buf := range data.Keys {
+		keyID, key, err := parseJWK(buf)
+		if err != nil {
+			// skip keys that we do not understand, there might be others that we can use
+			logg.Info("ignoring unusable key from %s: %s", c.URL, err.Error())
+			continue
+		}
+		if key != nil {
+			keys[keyID] = key
+		}
+	}
+	return keys, nil
+}
+
+// parseJWK parses a single JSON Web Key (RFC 7517). Keys that are not meant
+// for signatures are skipped by returning a nil key.
+func parseJWK(buf []byte) (keyID string, key crypto.PublicKey, err error) {
+	var jwk struct {
+		KeyID   string `json:"kid"`
+		KeyType string `json:"kty"`
+		Use     string `json:"use"`
+		// for RSA
+		N string `json:"n"`
+		E string `json:"e"`
+		// for EC and OKP
+		Curve string `json:"crv"`
+		X     string `json:"x"`
+		Y     string `json:"y"`
+	}
+	err = json.Unmarshal(buf, &jwk)
+	if err != nil {
+		return "", nil, err
+	}
+	if jwk.Use != "" && jwk.Use != "sig" {
+		return jwk.KeyID, nil, nil
+	}
+
+	decode := func(field, value string) []byte {
+		if err != nil {
+			return nil
+		}
+		var result []byte
+		result, err = base64.RawURLEncoding.DecodeString(value)
+		if err == nil && len(result) == 0 {
+			err = fmt.Errorf("missing value for %q", field)
+		}
+		if err != nil {
+			err = fmt.Errorf("in key %q: cannot decode %q: %w", jwk.KeyID, field, err)
+		}
+		return result
+	}
+
+	switch jwk.KeyType {
+	case "RSA":
+		n := decode("n", jwk.N)
+		e := decode("e", jwk.E)
+		if err != nil {
+			return "", nil, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 {
+			return "", nil, fmt.Errorf("in key %q: exponent is too large", jwk.KeyID)
+		}
+		return jwk.KeyID, &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return "", nil, fmt.Errorf("in key %q: unsupported curve %q", jwk.KeyID, jwk.Curve)
+		}
+		x := decode("x", jwk.X)
+		y := decode("y", jwk.Y)
+		if err != nil {
+			return "", nil, err
+		}
+		pubkey := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		_, err = pubkey.ECDH() // this validates that the point is on the curve
+		if err != nil {
+			return "", nil, fmt.Errorf("in key %q: %w", jwk.KeyID, err)
+		}
+		return jwk.KeyID, pubkey, nil
+
+	case "OKP":
+		if jwk.Curve != "Ed25519" {
+			return "", nil, fmt.Errorf("in key %q: unsupported curve %q", jwk.KeyID, jwk.Curve)
+		}
+		x := decode("x", jwk.X)
+		if err != nil {
+			return "", nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return "", nil, fmt.Errorf("in key %q: wrong length for Ed25519 public key", jwk.KeyID)
+		}
+		return jwk.KeyID, ed25519.PublicKey(x), nil
+
+	default:
+		return "", nil, errors.New("unsupported key type: " + jwk.KeyType)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"time"
 
@@ -14,24 +15,64 @@ import (
 	"github.com/sapcc/go-bits/logg"
 )
 
+// maxTokenCacheTTL is how long a successful token validation is cached at most.
+// The cache entry expires earlier if the Keystone token itself expires earlier.
+const maxTokenCacheTTL = 5 * time.Minute
+
 // redisCacher is an adapter around *redis.Client that implements the
 // gopherpolicy.Cacher interface.
 type redisCacher struct {
 	*redis.Client
 }
 
+// invalidatingCacher is a gopherpolicy.Cacher that can also remove entries.
+// This is used to evict cached token payloads that led to an auth failure.
+type invalidatingCacher interface {
+	InvalidateTokenPayload(ctx context.Context, cacheKey string)
+}
+
+// The cache key is usually a Keystone token or a set of credentials, so we
+// only ever use its hash as a key in Redis.
 func hashCacheKey(cacheKey string) string {
 	sha256Hash := sha256.Sum256([]byte(cacheKey))
 	return "keystone-" + hex.EncodeToString(sha256Hash[:])
 }
 
+// tokenCacheTTLFor returns how long the given token payload may be cached, or
+// 0 if it shall not be cached at all.
+func tokenCacheTTLFor(payload []byte, now time.Time) time.Duration {
+	// The payload is the JSON serialization of a gopherpolicy.serializableToken.
+	// We only need the token's expiry from it.
+	var data struct {
+		Token struct {
+			ExpiresAt time.Time `json:"expires_at"`
+		} `json:"token_id"`
+	}
+	err := json.Unmarshal(payload, &data)
+	if err != nil || data.Token.ExpiresAt.IsZero() {
+		return maxTokenCacheTTL
+	}
+	return max(0, min(maxTokenCacheTTL, data.Token.ExpiresAt.Sub(now)))
+}
+
 func (c redisCacher) StoreTokenPayload(ctx context.Context, cacheKey string, payload []byte) {
-	err := c.Set(ctx, hashCacheKey(cacheKey), payload, 5*time.Minute).Err()
+	ttl := tokenCacheTTLFor(payload, time.Now())
+	if ttl < time.Second {
+		return
+	}
+	err := c.Set(ctx, hashCacheKey(cacheKey), payload, ttl).Err()
 	if err != nil {
 		logg.Error("cannot cache token payload in Redis: %s", err.Error())
 	}
 }
 
+func (c redisCacher) InvalidateTokenPayload(ctx context.Context, cacheKey string) {
+	err := c.Del(ctx, hashCacheKey(cacheKey)).Err()
+	if err != nil {
+		logg.Error("cannot remove token payload from Redis: %s", err.Error())
+	}
+}
+
 func (c redisCacher) LoadTokenPayload(ctx context.Context, cacheKey string) []byte {
 	payload, err := c.Get(ctx, hashCacheKey(cacheKey)).Bytes()
 	if errors.Is(err, redis.Nil) {
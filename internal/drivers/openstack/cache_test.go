@@ -0,0 +1,105 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package openstack
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/sapcc/go-bits/assert"
+
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+func TestKeystoneTokenCache(t *testing.T) {
+	keystone := &mockKeystone{Tokens: map[string]mockKeystoneToken{
+		"long-lived-token":  {Roles: []string{"keppel_viewer"}, ExpiresAt: time.Now().Add(time.Hour)},
+		"short-lived-token": {Roles: []string{"keppel_viewer"}, ExpiresAt: time.Now().Add(2 * time.Minute)},
+		"unrelated-token":   {Roles: []string{"member"}, ExpiresAt: time.Now().Add(time.Hour)},
+	}}
+	srv := newMockKeystone(t, keystone)
+	sr := miniredis.RunT(t)
+	rc := redis.NewClient(&redis.Options{Addr: sr.Addr(), DisableIdentity: true})
+	d := setupKeystoneDriverForTest(t, srv.URL, redisCacher{rc})
+
+	authenticate := func(token string, expectedCode keppel.RegistryV2ErrorCode) {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodGet, "/keppel/v1/accounts", http.NoBody)
+		r.Header.Set("X-Auth-Token", token)
+		uid, rerr := d.AuthenticateUserFromRequest(r)
+		if expectedCode == "" {
+			if rerr != nil {
+				t.Fatal(rerr.Error())
+			}
+			assert.DeepEqual(t, "user name", uid.UserName(), "ci-user@Default/ci-project@Default")
+		} else {
+			if rerr == nil {
+				t.Fatalf("expected authentication with %s to fail, but it succeeded", token)
+			}
+			assert.DeepEqual(t, "error code for "+token, rerr.Code, expectedCode)
+		}
+	}
+	expectRequestCount := func(expected int) {
+		t.Helper()
+		assert.DeepEqual(t, "request count", keystone.RequestCount, expected)
+	}
+
+	// cache miss: the token is validated by Keystone and then cached under its
+	// hash (the token itself never appears in Redis)
+	authenticate("long-lived-token", "")
+	expectRequestCount(1)
+	assert.DeepEqual(t, "keys in Redis", sr.Keys(), []string{hashCacheKey("long-lived-token")})
+	assert.DeepEqual(t, "TTL of long-lived token", sr.TTL(hashCacheKey("long-lived-token")), maxTokenCacheTTL)
+
+	// cache hit: Keystone is not asked again
+	authenticate("long-lived-token", "")
+	expectRequestCount(1)
+
+	// the cache entry for a token expiring soon does not outlive the token
+	authenticate("short-lived-token", "")
+	expectRequestCount(2)
+	ttl := sr.TTL(hashCacheKey("short-lived-token"))
+	if ttl <= 0 || ttl > 2*time.Minute {
+		t.Errorf("expected TTL of short-lived token to be within its lifetime of 2 minutes, but got %s", ttl)
+	}
+
+	// after the cache entries expire, the token is validated by Keystone again
+	sr.FastForward(maxTokenCacheTTL)
+	assert.DeepEqual(t, "keys in Redis after expiry", len(sr.Keys()), 0)
+	authenticate("long-lived-token", "")
+	expectRequestCount(3)
+
+	// unknown tokens are not cached
+	authenticate("unknown-token", keppel.ErrUnauthorized)
+	authenticate("unknown-token", keppel.ErrUnauthorized)
+	expectRequestCount(5)
+	assert.DeepEqual(t, "unknown token is cached", sr.Exists(hashCacheKey("unknown-token")), false)
+
+	// a token without any Keppel roles is rejected, and its cache entry is
+	// evicted, so that a role assignment in Keystone takes effect immediately
+	authenticate("unrelated-token", keppel.ErrDenied)
+	expectRequestCount(6)
+	assert.DeepEqual(t, "rejected token is cached", sr.Exists(hashCacheKey("unrelated-token")), false)
+	token := keystone.Tokens["unrelated-token"]
+	token.Roles = append(token.Roles, "keppel_viewer")
+	keystone.Tokens["unrelated-token"] = token
+	authenticate("unrelated-token", "")
+	expectRequestCount(7)
+}
+
+func TestTokenCacheTTL(t *testing.T) {
+	now := time.Unix(1700000000, 0).UTC()
+	payloadExpiringAt := func(expiresAt time.Time) []byte {
+		return []byte(`{"token_id":{"expires_at":"` + expiresAt.Format(time.RFC3339) + `"}}`)
+	}
+
+	assert.DeepEqual(t, "TTL for long-lived token", tokenCacheTTLFor(payloadExpiringAt(now.Add(time.Hour)), now), maxTokenCacheTTL)
+	assert.DeepEqual(t, "TTL for short-lived token", tokenCacheTTLFor(payloadExpiringAt(now.Add(time.Minute)), now), time.Minute)
+	assert.DeepEqual(t, "TTL for expired token", tokenCacheTTLFor(payloadExpiringAt(now.Add(-time.Minute)), now), time.Duration(0))
+	assert.DeepEqual(t, "TTL for unparseable payload", tokenCacheTTLFor([]byte(`{}`), now), maxTokenCacheTTL)
+}
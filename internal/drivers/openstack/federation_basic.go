@@ -44,8 +44,11 @@ func (d *federationDriverBasic) Init(_ context.Context, ad keppel.AuthDriver, cf
 		return keppel.ErrAuthDriverMismatch
 	}
 
-	wlStr := strings.TrimSuffix(osext.MustGetenv("KEPPEL_NAMECLAIM_WHITELIST"), ",")
-	for wlEntryStr := range strings.SplitSeq(wlStr, ",") {
+	wlStr, err := osext.NeedGetenv("KEPPEL_NAMECLAIM_WHITELIST")
+	if err != nil {
+		return err
+	}
+	for wlEntryStr := range strings.SplitSeq(strings.TrimSuffix(wlStr, ","), ",") {
 		wlEntryFields := strings.SplitN(wlEntryStr, ":", 2)
 		if len(wlEntryFields) != 2 {
 			return errors.New(`KEPPEL_NAMECLAIM_WHITELIST must have the form "project1:accountName1,project2:accountName2,..."`)
@@ -112,3 +115,8 @@ func (d *federationDriverBasic) RecordExistingAccount(ctx context.Context, accou
 func (d *federationDriverBasic) FindPrimaryAccount(ctx context.Context, accountName models.AccountName) (string, error) {
 	return "", keppel.ErrNoSuchPrimaryAccount
 }
+
+// SweepArchivedAccountNames implements the keppel.FederationDriver interface.
+func (d *federationDriverBasic) SweepArchivedAccountNames(ctx context.Context, now time.Time) error {
+	return nil
+}
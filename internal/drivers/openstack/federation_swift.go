@@ -11,14 +11,20 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"reflect"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gophercloud/gophercloud/v2/openstack"
 	"github.com/majewsky/schwift/v2"
 	"github.com/majewsky/schwift/v2/gopherschwift"
+	"github.com/opencontainers/go-digest"
+	"github.com/sapcc/go-bits/errext"
 	"github.com/sapcc/go-bits/gophercloudext"
 	"github.com/sapcc/go-bits/logg"
 	"github.com/sapcc/go-bits/osext"
@@ -32,6 +38,26 @@ import (
 type federationDriverSwift struct {
 	Container   *schwift.Container
 	OwnHostName string
+	// If ArchiveRetention is non-zero, the account files of deleted primary
+	// accounts are moved into the archive instead of being deleted, and are
+	// only deleted after this retention period.
+	ArchiveRetention time.Duration
+	// Requests to Swift that fail with a transient error (5xx status or network
+	// error) are retried up to RetryAttempts times. The delay before the first
+	// retry is RetryBaseDelay, and doubles with each further retry.
+	RetryAttempts  int
+	RetryBaseDelay time.Duration
+	// If SelfHeal is true, corrupted account files for primary accounts hosted
+	// by this Keppel are reconstructed by RecordExistingAccount.
+	SelfHeal bool
+	// RecordExistingAccounts announces up to this many accounts concurrently.
+	AnnouncementConcurrency int
+	timeNow                 func() time.Time
+	reservationCache        struct {
+		Mutex        sync.Mutex
+		Reservations []keppel.AccountNameReservation
+		FetchedAt    time.Time
+	}
 }
 
 func init() {
@@ -44,6 +70,32 @@ func (fd *federationDriverSwift) PluginTypeID() string { return "swift" }
 // Init implements the keppel.FederationDriver interface.
 func (fd *federationDriverSwift) Init(ctx context.Context, ad keppel.AuthDriver, cfg keppel.Configuration) (err error) {
 	fd.OwnHostName = cfg.APIPublicHostname
+	fd.timeNow = time.Now
+	fd.RetryBaseDelay = 500 * time.Millisecond
+
+	retryAttemptsStr := osext.GetenvOrDefault("KEPPEL_FEDERATION_SWIFT_RETRY_ATTEMPTS", "3")
+	retryAttempts, err := strconv.ParseUint(retryAttemptsStr, 10, 8)
+	if err != nil {
+		return fmt.Errorf("malformed KEPPEL_FEDERATION_SWIFT_RETRY_ATTEMPTS: %q is not a non-negative integer", retryAttemptsStr)
+	}
+	fd.RetryAttempts = int(retryAttempts)
+	fd.SelfHeal = osext.GetenvBool("KEPPEL_FEDERATION_SWIFT_SELF_HEAL")
+
+	concurrencyStr := osext.GetenvOrDefault("KEPPEL_FEDERATION_SWIFT_ANNOUNCEMENT_CONCURRENCY", "10")
+	concurrency, err := strconv.ParseUint(concurrencyStr, 10, 8)
+	if err != nil || concurrency == 0 {
+		return fmt.Errorf("malformed KEPPEL_FEDERATION_SWIFT_ANNOUNCEMENT_CONCURRENCY: %q is not a positive integer", concurrencyStr)
+	}
+	fd.AnnouncementConcurrency = int(concurrency)
+
+	retentionStr := osext.GetenvOrDefault("KEPPEL_FEDERATION_ARCHIVE_RETENTION", "")
+	if retentionStr != "" {
+		fd.ArchiveRetention, err = time.ParseDuration(retentionStr)
+		if err != nil || fd.ArchiveRetention < 0 {
+			return fmt.Errorf("malformed KEPPEL_FEDERATION_ARCHIVE_RETENTION: %q is not a positive duration", retentionStr)
+		}
+	}
+
 	fd.Container, err = initSwiftContainerConnection(ctx, "KEPPEL_FEDERATION_")
 	return err
 }
@@ -64,7 +116,11 @@ func initSwiftContainerConnection(ctx context.Context, envPrefix string) (*schwi
 	if err != nil {
 		return nil, err
 	}
-	container, err := swiftAccount.Container(osext.MustGetenv(envPrefix + "SWIFT_CONTAINER")).EnsureExists(ctx)
+	containerName, err := osext.NeedGetenv(envPrefix + "SWIFT_CONTAINER")
+	if err != nil {
+		return nil, err
+	}
+	container, err := swiftAccount.Container(containerName).EnsureExists(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -72,6 +128,10 @@ func initSwiftContainerConnection(ctx context.Context, envPrefix string) (*schwi
 	return container, nil
 }
 
+// errWriteCollision is returned by modifyAccountFile when a concurrent write
+// by someone else was detected. Claims failing with this error can be retried.
+var errWriteCollision = errors.New("write collision")
+
 type accountFile struct {
 	AccountName         models.AccountName `json:"-"`
 	PrimaryHostName     string             `json:"primary_hostname"`
@@ -83,9 +143,97 @@ func (fd *federationDriverSwift) accountFileObj(accountName models.AccountName)
 	return fd.Container.Object(fmt.Sprintf("accounts/%s.json", accountName))
 }
 
+// Archived account files are stored under a separate prefix, so that they
+// do not interfere with claims on the same account name by new accounts.
+const archivedAccountFilePrefix = "deleted/accounts/"
+
+func (fd *federationDriverSwift) archivedAccountFileObj(accountName models.AccountName, deletedAt time.Time) *schwift.Object {
+	return fd.Container.Object(fmt.Sprintf("%s%s/%d.json", archivedAccountFilePrefix, accountName, deletedAt.Unix()))
+}
+
+// Parses the name of an archived account file into the time when the account was deleted.
+func parseArchivedAccountFileName(objectName string) (deletedAt time.Time, ok bool) {
+	_, fileName, ok := strings.Cut(strings.TrimPrefix(objectName, archivedAccountFilePrefix), "/")
+	if !ok {
+		return time.Time{}, false
+	}
+	timestamp, err := strconv.ParseInt(strings.TrimSuffix(fileName, ".json"), 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(timestamp, 0), true
+}
+
+// Account files carry a checksum of their contents in this metadata field, so
+// that corruption can be detected when reading them.
+const accountFileChecksumMetadataKey = "Keppel-Checksum"
+
+func accountFileChecksum(buf []byte) string {
+	return digest.SHA256.FromBytes(buf).String()
+}
+
+// corruptedAccountFileError is returned by readAccountFile when the contents
+// of an account file do not match its checksum, or cannot be parsed.
+type corruptedAccountFileError struct {
+	AccountName models.AccountName
+	Reason      string
+}
+
+// Error implements the builtin/error interface.
+func (e corruptedAccountFileError) Error() string {
+	return fmt.Sprintf("corrupted account file for %s: %s", e.AccountName, e.Reason)
+}
+
+// Returns whether the given error from Swift is likely to go away when retrying.
+// Server-side errors and network errors are considered transient, whereas all
+// other errors (esp. 4xx responses) are considered permanent.
+func isTransientSwiftError(err error) bool {
+	if uerr, ok := errext.As[schwift.UnexpectedStatusCodeError](err); ok {
+		return uerr.ActualResponse.StatusCode >= 500
+	}
+	_, ok := errext.As[net.Error](err)
+	return ok
+}
+
+// Executes the given action, and retries it with exponential backoff if it
+// fails with a transient error.
+func (fd *federationDriverSwift) retryOnTransientError(ctx context.Context, action func() error) error {
+	delay := fd.RetryBaseDelay
+	for attempt := 0; ; attempt++ {
+		err := action()
+		if err == nil || attempt >= fd.RetryAttempts || !isTransientSwiftError(err) {
+			return err
+		}
+		logg.Info("federation: retrying after transient error from Swift: %s", err.Error())
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
 // Downloads and parses an account file from the Swift container.
 func (fd *federationDriverSwift) readAccountFile(ctx context.Context, accountName models.AccountName) (accountFile, error) {
-	buf, err := fd.accountFileObj(accountName).Download(ctx, nil).AsByteSlice()
+	var (
+		buf              []byte
+		expectedChecksum string
+	)
+	err := fd.retryOnTransientError(ctx, func() error {
+		obj := fd.accountFileObj(accountName)
+		var err error
+		buf, err = obj.Download(ctx, nil).AsByteSlice()
+		if err != nil {
+			return err
+		}
+		hdr, err := obj.Headers(ctx) // does not cause a request since the headers were cached by Download()
+		if err != nil {
+			return err
+		}
+		expectedChecksum = hdr.Metadata().Get(accountFileChecksumMetadataKey)
+		return nil
+	})
 	if err != nil {
 		if schwift.Is(err, http.StatusNotFound) {
 			// account file does not exist -> create an empty one that we can fill now
@@ -94,10 +242,39 @@ func (fd *federationDriverSwift) readAccountFile(ctx context.Context, accountNam
 		return accountFile{}, err
 	}
 
+	// account files written by older versions of this driver do not have a
+	// checksum yet; they will get one the next time they are written
+	if expectedChecksum != "" {
+		actualChecksum := accountFileChecksum(buf)
+		if actualChecksum != expectedChecksum {
+			return accountFile{}, corruptedAccountFileError{accountName,
+				fmt.Sprintf("expected checksum %s, but got %s", expectedChecksum, actualChecksum)}
+		}
+	}
+
 	var file accountFile
 	err = json.Unmarshal(buf, &file)
+	if err != nil {
+		return accountFile{}, corruptedAccountFileError{accountName, "cannot parse contents: " + err.Error()}
+	}
 	file.AccountName = accountName
-	return file, err
+	return file, nil
+}
+
+// Uploads an account file into the Swift container.
+func (fd *federationDriverSwift) writeAccountFile(ctx context.Context, file accountFile) error {
+	buf, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+	obj := fd.accountFileObj(file.AccountName)
+	logg.Info("federation: writing account file %s", obj.FullName())
+	hdr := schwift.NewObjectHeaders()
+	hdr.ContentType().Set("application/json")
+	hdr.Metadata().Set(accountFileChecksumMetadataKey, accountFileChecksum(buf))
+	return fd.retryOnTransientError(ctx, func() error {
+		return obj.Upload(ctx, bytes.NewReader(buf), nil, hdr.ToOpts())
+	})
 }
 
 // Base implementation for all write operations performed by this driver. Swift
@@ -123,15 +300,7 @@ func (fd *federationDriverSwift) modifyAccountFile(ctx context.Context, accountN
 	}
 
 	// perform the write
-	buf, err := json.Marshal(fileOldModified)
-	if err != nil {
-		return err
-	}
-	obj := fd.accountFileObj(accountName)
-	logg.Info("federation: writing account file %s", obj.FullName())
-	hdr := schwift.NewObjectHeaders()
-	hdr.ContentType().Set("application/json")
-	err = obj.Upload(ctx, bytes.NewReader(buf), nil, hdr.ToOpts())
+	err = fd.writeAccountFile(ctx, fileOldModified)
 	if err != nil {
 		return err
 	}
@@ -153,7 +322,7 @@ func (fd *federationDriverSwift) modifyAccountFile(ctx context.Context, accountN
 		// fildOldModified)` here, but that would be too strict of a condition. We
 		// don't care whether someone edited the file right after us, we care
 		// whether the contents of our write are still there.
-		return fmt.Errorf("write collision while trying to update the account file for %q, please retry", accountName)
+		return fmt.Errorf("%w while trying to update the account file for %q, please retry", errWriteCollision, accountName)
 	}
 
 	return nil
@@ -171,13 +340,16 @@ func (fd *federationDriverSwift) ClaimAccountName(ctx context.Context, account m
 		isUserError, err = fd.claimPrimaryAccount(ctx, account, subleaseTokenSecret)
 	}
 
-	if err != nil {
-		if isUserError {
-			return keppel.ClaimFailed, err
-		}
+	switch {
+	case err == nil:
+		return keppel.ClaimSucceeded, nil
+	case errors.Is(err, errWriteCollision):
+		return keppel.ClaimRaceLost, err
+	case isUserError:
+		return keppel.ClaimFailed, err
+	default:
 		return keppel.ClaimErrored, err
 	}
-	return keppel.ClaimSucceeded, nil
 }
 
 func (fd *federationDriverSwift) claimPrimaryAccount(ctx context.Context, account models.Account, subleaseTokenSecret string) (isUserError bool, err error) {
@@ -186,14 +358,30 @@ func (fd *federationDriverSwift) claimPrimaryAccount(ctx context.Context, accoun
 		return true, errors.New("cannot check sublease token when claiming a primary account")
 	}
 
+	var reservations []keppel.AccountNameReservation
+	err = fd.retryOnTransientError(ctx, func() (err error) {
+		reservations, err = fd.listAccountNameReservations(ctx)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	err = keppel.CheckAccountNameReservations(reservations, account)
+	if err != nil {
+		return true, err
+	}
+
 	isUserError = false
 	err = fd.modifyAccountFile(ctx, account.Name, func(file *accountFile, firstPass bool) error {
-		_ = firstPass
-
 		if file.PrimaryHostName == "" || file.PrimaryHostName == fd.OwnHostName {
 			file.PrimaryHostName = fd.OwnHostName
 			return nil
 		}
+		if !firstPass {
+			// the name was free when we wrote our claim, so someone else must have
+			// claimed it at the same time and overwritten our claim
+			return fmt.Errorf("%w while claiming account name %s: concurrent claim from %s", errWriteCollision, account.Name, file.PrimaryHostName)
+		}
 		isUserError = true
 		return fmt.Errorf("account name %s is already in use at %s", account.Name, file.PrimaryHostName)
 	})
@@ -274,6 +462,10 @@ func (fd *federationDriverSwift) ForfeitAccountName(ctx context.Context, account
 	if err != nil {
 		return err
 	}
+	if file.PrimaryHostName == "" && len(file.ReplicaHostNames) == 0 {
+		// account file does not exist -> name was already forfeited
+		return nil
+	}
 	err = fd.verifyAccountOwnership(file, fd.OwnHostName)
 	if err != nil {
 		return err
@@ -281,6 +473,22 @@ func (fd *federationDriverSwift) ForfeitAccountName(ctx context.Context, account
 	if len(file.ReplicaHostNames) > 0 {
 		return fmt.Errorf("cannot delete primary account %s: %d replicas are still attached to it", account.Name, len(file.ReplicaHostNames))
 	}
+
+	// if requested, keep a copy of the account file as an audit trail of who owned this account name
+	if fd.ArchiveRetention > 0 {
+		buf, err := json.Marshal(file)
+		if err != nil {
+			return err
+		}
+		obj := fd.archivedAccountFileObj(account.Name, fd.timeNow())
+		logg.Info("federation: archiving account file for %s as %s", account.Name, obj.FullName())
+		hdr := schwift.NewObjectHeaders()
+		hdr.ContentType().Set("application/json")
+		err = obj.Upload(ctx, bytes.NewReader(buf), nil, hdr.ToOpts())
+		if err != nil {
+			return fmt.Errorf("while archiving account file for %s: %w", account.Name, err)
+		}
+	}
 	return fd.accountFileObj(account.Name).Delete(ctx, nil, nil)
 }
 
@@ -292,6 +500,51 @@ func (fd *federationDriverSwift) RecordExistingAccount(ctx context.Context, acco
 	// more complicated to better guard against them is a bad tradeoff in my
 	// opinion. Instead, we just make sure that the driver loudly complains once
 	// it finds an inconsistency, so the operator can take care of fixing it.
+	err := fd.recordExistingAccount(ctx, account)
+
+	// if the account file is corrupted and we host the primary account, we know
+	// enough to rebuild it (replicas will re-add themselves when they announce
+	// their accounts)
+	if _, ok := errext.As[corruptedAccountFileError](err); ok && fd.SelfHeal && account.UpstreamPeerHostName == "" {
+		logg.Error("federation: rebuilding account file after error: %s", err.Error())
+		err = fd.writeAccountFile(ctx, accountFile{AccountName: account.Name, PrimaryHostName: fd.OwnHostName})
+	}
+
+	// since this is not critical (we will be called again for this account
+	// later), a Swift outage should not be reported as an error here
+	if err != nil && isTransientSwiftError(err) {
+		logg.Error("federation: skipping update of account file for %s because of transient error: %s", account.Name, err.Error())
+		return nil
+	}
+	return err
+}
+
+// SupportsBatchAnnouncements implements the keppel.BatchAnnouncingFederationDriver interface.
+func (fd *federationDriverSwift) SupportsBatchAnnouncements() bool {
+	return true
+}
+
+// RecordExistingAccounts implements the keppel.BatchAnnouncingFederationDriver interface.
+func (fd *federationDriverSwift) RecordExistingAccounts(ctx context.Context, accounts []models.Account, now time.Time) []error {
+	// Swift does not have bulk writes, so the best we can do is to overlap the
+	// round-trips for the individual account files
+	errs := make([]error, len(accounts))
+	semaphore := make(chan struct{}, max(fd.AnnouncementConcurrency, 1))
+	var wg sync.WaitGroup
+	for idx, account := range accounts {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			errs[idx] = fd.RecordExistingAccount(ctx, account, now)
+		}()
+	}
+	wg.Wait()
+	return errs
+}
+
+func (fd *federationDriverSwift) recordExistingAccount(ctx context.Context, account models.Account) error {
 	return fd.modifyAccountFile(ctx, account.Name, func(file *accountFile, _ bool) error {
 		// check that the primary hostname is correct, or fill in if missing
 		var expectedPrimaryHostName string
@@ -337,6 +590,88 @@ func (fd *federationDriverSwift) FindPrimaryAccount(ctx context.Context, account
 	return file.PrimaryHostName, nil
 }
 
+// SweepArchivedAccountNames implements the keppel.FederationDriver interface.
+func (fd *federationDriverSwift) SweepArchivedAccountNames(ctx context.Context, now time.Time) error {
+	if fd.ArchiveRetention == 0 {
+		return nil
+	}
+
+	iter := fd.Container.Objects()
+	iter.Prefix = archivedAccountFilePrefix
+	objects, err := iter.Collect(ctx)
+	if err != nil {
+		return err
+	}
+	for _, obj := range objects {
+		deletedAt, ok := parseArchivedAccountFileName(obj.Name())
+		if !ok {
+			logg.Error("federation: ignoring unexpected object in account file archive: %s", obj.FullName())
+			continue
+		}
+		if deletedAt.Add(fd.ArchiveRetention).After(now) {
+			continue
+		}
+		logg.Info("federation: removing archived account file %s after end of retention period", obj.FullName())
+		err := obj.Delete(ctx, nil, nil)
+		if err != nil && !schwift.Is(err, http.StatusNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Account name reservations are stored as one object per reserved prefix.
+const reservationFilePrefix = "reservations/"
+
+// How long the result of listAccountNameReservations() is reused before the
+// reservation objects are listed again.
+const reservationCacheTTL = 1 * time.Minute
+
+// listAccountNameReservations returns the reservations that the operator has
+// uploaded into the container. Since every claim of a primary account needs
+// this, the result is cached for reservationCacheTTL.
+func (fd *federationDriverSwift) listAccountNameReservations(ctx context.Context) ([]keppel.AccountNameReservation, error) {
+	fd.reservationCache.Mutex.Lock()
+	defer fd.reservationCache.Mutex.Unlock()
+
+	now := fd.timeNow()
+	if !fd.reservationCache.FetchedAt.IsZero() && now.Sub(fd.reservationCache.FetchedAt) < reservationCacheTTL {
+		return fd.reservationCache.Reservations, nil
+	}
+
+	iter := fd.Container.Objects()
+	iter.Prefix = reservationFilePrefix
+	objects, err := iter.Collect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]keppel.AccountNameReservation, 0, len(objects))
+	for _, obj := range objects {
+		buf, err := obj.Download(ctx, nil).AsByteSlice()
+		if err != nil {
+			if schwift.Is(err, http.StatusNotFound) {
+				// reservation was removed while we were listing
+				continue
+			}
+			return nil, err
+		}
+		var reservation keppel.AccountNameReservation
+		err = json.Unmarshal(buf, &reservation)
+		if err == nil {
+			err = reservation.Validate()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("while parsing %s: %w", obj.FullName(), err)
+		}
+		result = append(result, reservation)
+	}
+
+	fd.reservationCache.Reservations = result
+	fd.reservationCache.FetchedAt = now
+	return result, nil
+}
+
 func addStringToList(list []string, value string) []string {
 	if slices.Contains(list, value) {
 		return list
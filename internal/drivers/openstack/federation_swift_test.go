@@ -0,0 +1,478 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package openstack
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/majewsky/schwift/v2"
+	"github.com/sapcc/go-bits/assert"
+
+	"github.com/sapcc/keppel/internal/keppel"
+	"github.com/sapcc/keppel/internal/models"
+)
+
+// inMemorySwiftBackend is a schwift.Backend that implements just enough of
+// the Swift API for the federation driver to work on a single container.
+type inMemorySwiftBackend struct {
+	mutex    sync.Mutex
+	objects  map[string][]byte      // key = object name
+	metadata map[string]http.Header // key = object name, value = X-Object-Meta-* headers
+	// If set, this is called after each successful PUT. This can be used to
+	// simulate concurrent writes by other clients.
+	afterPut func(objectName string)
+	// If non-empty, the next requests fail with these status codes instead of
+	// being processed. A status code of 0 simulates a network error.
+	injectedFailures []int
+}
+
+const inMemorySwiftEndpoint = "http://swift.example.com/v1/AUTH_test/"
+
+func (b *inMemorySwiftBackend) EndpointURL() string { return inMemorySwiftEndpoint }
+
+func (b *inMemorySwiftBackend) Clone(newEndpointURL string) schwift.Backend { return b }
+
+func (b *inMemorySwiftBackend) Do(req *http.Request) (*http.Response, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if len(b.injectedFailures) > 0 {
+		status := b.injectedFailures[0]
+		b.injectedFailures = b.injectedFailures[1:]
+		if status == 0 {
+			return nil, &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+		}
+		rec := httptest.NewRecorder()
+		rec.WriteHeader(status)
+		return rec.Result(), nil
+	}
+
+	rec := httptest.NewRecorder()
+	path, err := url.PathUnescape(strings.TrimPrefix(req.URL.EscapedPath(), "/v1/AUTH_test/"))
+	if err != nil {
+		return nil, err
+	}
+	_, objectName, _ := strings.Cut(path, "/")
+	isObject := objectName != ""
+
+	switch {
+	case !isObject && req.Method == http.MethodGet:
+		var names []string
+		for name := range b.objects {
+			if strings.HasPrefix(name, req.URL.Query().Get("prefix")) && name > req.URL.Query().Get("marker") {
+				names = append(names, name)
+			}
+		}
+		slices.Sort(names)
+		if len(names) == 0 {
+			rec.WriteHeader(http.StatusNoContent)
+		} else {
+			rec.WriteHeader(http.StatusOK)
+			_, _ = io.WriteString(rec, strings.Join(names, "\n")+"\n")
+		}
+	case isObject && req.Method == http.MethodGet:
+		content, exists := b.objects[objectName]
+		if !exists {
+			rec.WriteHeader(http.StatusNotFound)
+		} else {
+			for key, values := range b.metadata[objectName] {
+				rec.Header()[key] = values
+			}
+			rec.WriteHeader(http.StatusOK)
+			_, _ = rec.Write(content)
+		}
+	case isObject && req.Method == http.MethodPut:
+		content, err := io.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		b.objects[objectName] = content
+		b.metadata[objectName] = make(http.Header)
+		for key, values := range req.Header {
+			if strings.HasPrefix(key, "X-Object-Meta-") {
+				b.metadata[objectName][key] = values
+			}
+		}
+		if b.afterPut != nil {
+			b.afterPut(objectName)
+		}
+		rec.Header().Set("Etag", req.Header.Get("Etag"))
+		rec.WriteHeader(http.StatusCreated)
+	case isObject && req.Method == http.MethodDelete:
+		_, exists := b.objects[objectName]
+		if !exists {
+			rec.WriteHeader(http.StatusNotFound)
+		} else {
+			delete(b.objects, objectName)
+			delete(b.metadata, objectName)
+			rec.WriteHeader(http.StatusNoContent)
+		}
+	default:
+		rec.WriteHeader(http.StatusMethodNotAllowed)
+	}
+	return rec.Result(), nil
+}
+
+func (b *inMemorySwiftBackend) objectNames() []string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	names := make([]string, 0, len(b.objects))
+	for name := range b.objects {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func setupSwiftFederationDriver(t *testing.T, archiveRetention time.Duration, now time.Time) (*federationDriverSwift, *inMemorySwiftBackend) {
+	t.Helper()
+	backend := &inMemorySwiftBackend{objects: make(map[string][]byte), metadata: make(map[string]http.Header)}
+	swiftAccount, err := schwift.InitializeAccount(backend)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	fd := &federationDriverSwift{
+		Container:               swiftAccount.Container("keppel-federation"),
+		OwnHostName:             "registry.example.org",
+		ArchiveRetention:        archiveRetention,
+		AnnouncementConcurrency: 2,
+		timeNow:                 func() time.Time { return now },
+	}
+	return fd, backend
+}
+
+func TestSwiftFederationForfeitWithoutArchive(t *testing.T) {
+	fd, backend := setupSwiftFederationDriver(t, 0, time.Unix(3600, 0))
+	account := models.Account{Name: "test1"}
+
+	result, err := fd.ClaimAccountName(t.Context(), account, "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "claim result", result, keppel.ClaimSucceeded)
+	assert.DeepEqual(t, "objects after claim", backend.objectNames(), []string{"accounts/test1.json"})
+
+	// without archive retention, the account file is deleted outright
+	err = fd.ForfeitAccountName(t.Context(), account)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "objects after forfeit", backend.objectNames(), []string{})
+
+	// forfeiting again is a no-op (this happens when the account could not be
+	// deleted from the database after the first forfeit)
+	err = fd.ForfeitAccountName(t.Context(), account)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "objects after second forfeit", backend.objectNames(), []string{})
+
+	// sweeping is a no-op
+	err = fd.SweepArchivedAccountNames(t.Context(), time.Unix(7200, 0))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestSwiftFederationForfeitWithArchive(t *testing.T) {
+	retention := 24 * time.Hour
+	fd, backend := setupSwiftFederationDriver(t, retention, time.Unix(3600, 0))
+	account := models.Account{Name: "test1"}
+
+	_, err := fd.ClaimAccountName(t.Context(), account, "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// with archive retention, the account file is moved into the archive
+	err = fd.ForfeitAccountName(t.Context(), account)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "objects after forfeit", backend.objectNames(), []string{"deleted/accounts/test1/3600.json"})
+	assert.DeepEqual(t, "archived account file",
+		string(backend.objects["deleted/accounts/test1/3600.json"]),
+		`{"primary_hostname":"registry.example.org","replica_hostnames":null,"sublease_token_secret":""}`,
+	)
+
+	// the account name is free to be claimed again, by us or by someone else
+	_, err = fd.FindPrimaryAccount(t.Context(), account.Name)
+	assert.DeepEqual(t, "FindPrimaryAccount error", err, keppel.ErrNoSuchPrimaryAccount)
+	_, err = fd.ClaimAccountName(t.Context(), account, "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	fd.timeNow = func() time.Time { return time.Unix(7200, 0) }
+	err = fd.ForfeitAccountName(t.Context(), account)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "objects after second forfeit", backend.objectNames(),
+		[]string{"deleted/accounts/test1/3600.json", "deleted/accounts/test1/7200.json"})
+
+	// archived account files are only swept once their retention period has elapsed
+	err = fd.SweepArchivedAccountNames(t.Context(), time.Unix(3600, 0).Add(retention-time.Second))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "objects after early sweep", backend.objectNames(),
+		[]string{"deleted/accounts/test1/3600.json", "deleted/accounts/test1/7200.json"})
+
+	err = fd.SweepArchivedAccountNames(t.Context(), time.Unix(3600, 0).Add(retention))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "objects after first sweep", backend.objectNames(), []string{"deleted/accounts/test1/7200.json"})
+
+	err = fd.SweepArchivedAccountNames(t.Context(), time.Unix(7200, 0).Add(retention))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "objects after second sweep", backend.objectNames(), []string{})
+}
+
+func TestSwiftFederationClaimRace(t *testing.T) {
+	fd, backend := setupSwiftFederationDriver(t, 0, time.Unix(3600, 0))
+	account := models.Account{Name: "test1"}
+
+	// simulate another Keppel claiming the same name right after us
+	otherClaim := []byte(`{"primary_hostname":"registry-other.example.org","replica_hostnames":null,"sublease_token_secret":""}`)
+	backend.afterPut = func(objectName string) {
+		if objectName == "accounts/test1.json" {
+			backend.objects[objectName] = otherClaim
+			backend.metadata[objectName] = http.Header{"X-Object-Meta-Keppel-Checksum": {accountFileChecksum(otherClaim)}}
+		}
+	}
+
+	// we lose the race, which is reported as a transient error
+	result, err := fd.ClaimAccountName(t.Context(), account, "")
+	assert.DeepEqual(t, "claim result", result, keppel.ClaimRaceLost)
+	assert.DeepEqual(t, "claim error", err.Error(),
+		"write collision while claiming account name test1: concurrent claim from registry-other.example.org")
+
+	// when retrying, we see that the name is owned by someone else, which is a permanent error
+	backend.afterPut = nil
+	result, err = fd.ClaimAccountName(t.Context(), account, "")
+	assert.DeepEqual(t, "claim result", result, keppel.ClaimFailed)
+	assert.DeepEqual(t, "claim error", err.Error(),
+		"account name test1 is already in use at registry-other.example.org")
+}
+
+func TestSwiftFederationAccountNameReservations(t *testing.T) {
+	fd, backend := setupSwiftFederationDriver(t, 0, time.Unix(3600, 0))
+	now := time.Unix(3600, 0)
+	fd.timeNow = func() time.Time { return now }
+
+	// reservations are maintained by the operator by uploading objects into the container
+	backend.objects["reservations/mycorp-.json"] = []byte(`{"prefix":"mycorp-","auth_tenant_id":"tenant1"}`)
+
+	// other tenants cannot claim names below the reserved prefix...
+	result, err := fd.ClaimAccountName(t.Context(), models.Account{Name: "mycorp-foo", AuthTenantID: "tenant2"}, "")
+	assert.DeepEqual(t, "claim result for other tenant", result, keppel.ClaimFailed)
+	assert.DeepEqual(t, "claim error for other tenant", err.Error(),
+		`account name mycorp-foo is reserved for a different auth tenant (reserved prefix: "mycorp-")`)
+
+	// ...but the reserving tenant can
+	result, err = fd.ClaimAccountName(t.Context(), models.Account{Name: "mycorp-foo", AuthTenantID: "tenant1"}, "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "claim result for reserving tenant", result, keppel.ClaimSucceeded)
+
+	// the list of reservations is cached, so removing the reservation does not take effect immediately
+	backend.mutex.Lock()
+	delete(backend.objects, "reservations/mycorp-.json")
+	backend.mutex.Unlock()
+	result, _ = fd.ClaimAccountName(t.Context(), models.Account{Name: "mycorp-bar", AuthTenantID: "tenant2"}, "")
+	assert.DeepEqual(t, "claim result with cached reservation", result, keppel.ClaimFailed)
+
+	// after the cache expires, other tenants can claim free names below the prefix
+	now = now.Add(reservationCacheTTL)
+	result, err = fd.ClaimAccountName(t.Context(), models.Account{Name: "mycorp-bar", AuthTenantID: "tenant2"}, "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "claim result after release", result, keppel.ClaimSucceeded)
+	assert.DeepEqual(t, "objects after release", backend.objectNames(), []string{"accounts/mycorp-bar.json", "accounts/mycorp-foo.json"})
+
+	// malformed reservations are reported instead of being ignored
+	now = now.Add(reservationCacheTTL)
+	backend.objects["reservations/Invalid.json"] = []byte(`{"prefix":"Invalid","auth_tenant_id":"tenant1"}`)
+	result, err = fd.ClaimAccountName(t.Context(), models.Account{Name: "test1", AuthTenantID: "tenant2"}, "")
+	assert.DeepEqual(t, "claim result with malformed reservation", result, keppel.ClaimErrored)
+	assert.DeepEqual(t, "claim error with malformed reservation", err.Error(),
+		`while parsing keppel-federation/reservations/Invalid.json: invalid account name prefix: "Invalid"`)
+}
+
+func TestSwiftFederationTransientErrors(t *testing.T) {
+	fd, backend := setupSwiftFederationDriver(t, 0, time.Unix(3600, 0))
+	fd.RetryAttempts = 3
+	fd.RetryBaseDelay = time.Millisecond
+	account := models.Account{Name: "test1", AuthTenantID: "tenant1"}
+
+	// transient errors (5xx and network errors) are retried during claims
+	backend.injectedFailures = []int{http.StatusServiceUnavailable, 0, http.StatusInternalServerError}
+	result, err := fd.ClaimAccountName(t.Context(), account, "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "claim result with few transient errors", result, keppel.ClaimSucceeded)
+	assert.DeepEqual(t, "remaining injected failures", len(backend.injectedFailures), 0)
+
+	// if the outage persists, the claim eventually fails (the list of
+	// reservations is cached by now, so the account file is the first thing we GET)
+	account2 := models.Account{Name: "test2", AuthTenantID: "tenant1"}
+	backend.injectedFailures = slices.Repeat([]int{http.StatusServiceUnavailable}, 10)
+	result, err = fd.ClaimAccountName(t.Context(), account2, "")
+	assert.DeepEqual(t, "claim result with many transient errors", result, keppel.ClaimErrored)
+	assert.DeepEqual(t, "claim error with many transient errors", err.Error(),
+		`could not GET "keppel-federation/accounts/test2.json" in Swift: expected 200 response, got 503 instead`)
+	assert.DeepEqual(t, "remaining injected failures", len(backend.injectedFailures), 6) // 1 attempt + 3 retries
+
+	// permanent errors (4xx) are not retried
+	backend.injectedFailures = []int{http.StatusForbidden, http.StatusServiceUnavailable}
+	result, err = fd.ClaimAccountName(t.Context(), account2, "")
+	assert.DeepEqual(t, "claim result with permanent error", result, keppel.ClaimErrored)
+	assert.DeepEqual(t, "claim error with permanent error", err.Error(),
+		`could not GET "keppel-federation/accounts/test2.json" in Swift: expected 200 response, got 403 instead`)
+	assert.DeepEqual(t, "remaining injected failures", len(backend.injectedFailures), 1)
+
+	// announcements are not critical, so a persistent outage is not reported as an error
+	backend.injectedFailures = slices.Repeat([]int{http.StatusServiceUnavailable}, 10)
+	err = fd.RecordExistingAccount(t.Context(), account2, time.Unix(3600, 0))
+	if err != nil {
+		t.Errorf("expected RecordExistingAccount to ignore transient errors, but got: %s", err.Error())
+	}
+
+	// but permanent errors are still reported
+	backend.injectedFailures = []int{http.StatusForbidden}
+	err = fd.RecordExistingAccount(t.Context(), account2, time.Unix(3600, 0))
+	assert.DeepEqual(t, "error from RecordExistingAccount", err.Error(),
+		`could not GET "keppel-federation/accounts/test2.json" in Swift: expected 200 response, got 403 instead`)
+}
+
+func TestSwiftFederationCorruptedAccountFile(t *testing.T) {
+	fd, backend := setupSwiftFederationDriver(t, 0, time.Unix(3600, 0))
+	account := models.Account{Name: "test1", AuthTenantID: "tenant1"}
+	replicaAccount := models.Account{Name: "test1", AuthTenantID: "tenant1", UpstreamPeerHostName: "registry.example.org"}
+
+	_, err := fd.ClaimAccountName(t.Context(), account, "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	primaryHostName, err := fd.FindPrimaryAccount(t.Context(), account.Name)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "primary hostname", primaryHostName, "registry.example.org")
+
+	// account files without checksum (as written by older versions) are accepted
+	delete(backend.metadata, "accounts/test1.json")
+	primaryHostName, err = fd.FindPrimaryAccount(t.Context(), account.Name)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "primary hostname", primaryHostName, "registry.example.org")
+
+	// when the account file is rewritten, it gets a checksum
+	other := &federationDriverSwift{Container: fd.Container, OwnHostName: "registry-secondary.example.org", timeNow: fd.timeNow}
+	err = other.RecordExistingAccount(t.Context(), replicaAccount, time.Unix(3600, 0))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	goodContents := backend.objects["accounts/test1.json"]
+	goodChecksum := accountFileChecksum(goodContents)
+	assert.DeepEqual(t, "checksum", backend.metadata["accounts/test1.json"].Get("X-Object-Meta-Keppel-Checksum"), goodChecksum)
+
+	// corrupt the account file
+	badContents := []byte(`{"primary_hostname":"registry.evil.example.org","replica_hostnames":["registry-secondary.example.org"],"sublease_token_secret":""}`)
+	backend.objects["accounts/test1.json"] = badContents
+	_, err = fd.FindPrimaryAccount(t.Context(), account.Name)
+	assert.DeepEqual(t, "error for checksum mismatch", err.Error(),
+		"corrupted account file for test1: expected checksum "+goodChecksum+", but got "+accountFileChecksum(badContents))
+
+	// without checksum, unparseable files are also reported as corrupted
+	backend.objects["accounts/test1.json"] = []byte(`{"primary_hostname":`)
+	delete(backend.metadata, "accounts/test1.json")
+	_, err = fd.FindPrimaryAccount(t.Context(), account.Name)
+	assert.DeepEqual(t, "error for unparseable file", err.Error(),
+		"corrupted account file for test1: cannot parse contents: unexpected end of JSON input")
+
+	// without self-heal, the corruption is reported during announcements
+	backend.objects["accounts/test1.json"] = badContents
+	backend.metadata["accounts/test1.json"] = http.Header{"X-Object-Meta-Keppel-Checksum": {goodChecksum}}
+	err = fd.RecordExistingAccount(t.Context(), account, time.Unix(3600, 0))
+	assert.DeepEqual(t, "error from RecordExistingAccount", err.Error(),
+		"corrupted account file for test1: expected checksum "+goodChecksum+", but got "+accountFileChecksum(badContents))
+
+	// with self-heal, a replica does not know enough to rebuild the account file...
+	other.SelfHeal = true
+	err = other.RecordExistingAccount(t.Context(), replicaAccount, time.Unix(3600, 0))
+	assert.DeepEqual(t, "error from RecordExistingAccount on replica", err.Error(),
+		"corrupted account file for test1: expected checksum "+goodChecksum+", but got "+accountFileChecksum(badContents))
+
+	// ...but the primary does
+	fd.SelfHeal = true
+	err = fd.RecordExistingAccount(t.Context(), account, time.Unix(3600, 0))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	primaryHostName, err = fd.FindPrimaryAccount(t.Context(), account.Name)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "primary hostname after self-heal", primaryHostName, "registry.example.org")
+
+	// the replica re-adds itself on its next announcement
+	err = other.RecordExistingAccount(t.Context(), replicaAccount, time.Unix(3600, 0))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "account file after self-heal", string(backend.objects["accounts/test1.json"]), string(goodContents))
+}
+
+func TestSwiftFederationBatchAnnouncement(t *testing.T) {
+	fd, backend := setupSwiftFederationDriver(t, 0, time.Unix(3600, 0))
+
+	// one of the account names is already taken by someone else
+	otherFile := accountFile{AccountName: "test3", PrimaryHostName: "registry-other.example.org"}
+	err := fd.writeAccountFile(t.Context(), otherFile)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var accounts []models.Account
+	for _, name := range []models.AccountName{"test1", "test2", "test3", "test4", "test5"} {
+		accounts = append(accounts, models.Account{Name: name, AuthTenantID: "tenant1"})
+	}
+	errs := keppel.RecordExistingAccounts(t.Context(), fd, accounts, time.Unix(3600, 0))
+
+	// errors are reported for the correct account, and do not affect the other accounts
+	assert.DeepEqual(t, "number of results", len(errs), len(accounts))
+	for idx, err := range errs {
+		if accounts[idx].Name == "test3" {
+			assert.DeepEqual(t, "error for test3", err.Error(),
+				"expected primary for account test3 to be hosted by registry.example.org, but is actually hosted by \"registry-other.example.org\"")
+		} else if err != nil {
+			t.Errorf("unexpected error for %s: %s", accounts[idx].Name, err.Error())
+		}
+	}
+	assert.DeepEqual(t, "objects after announcement", backend.objectNames(), []string{
+		"accounts/test1.json",
+		"accounts/test2.json",
+		"accounts/test3.json",
+		"accounts/test4.json",
+		"accounts/test5.json",
+	})
+}
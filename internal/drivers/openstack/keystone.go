@@ -3,7 +3,7 @@
 
 // Package openstack contains:
 //
-// - the AuthDriver "keystone": Keppel tenants are Keystone projects. Incoming HTTP requests are authenticated by reading a Keystone token from the X-Auth-Token request header.
+// - the AuthDriver "keystone": Keppel tenants are Keystone projects. Incoming HTTP requests are authenticated by reading a Keystone token from the X-Auth-Token request header, or Keystone application credentials from the X-Auth-Application-Credential-ID and X-Auth-Application-Credential-Secret request headers.
 //
 // - the StorageDriver "swift": Data for a Keppel account is stored in the Swift container "keppel-<accountname>" in the tenant's Swift account.
 //
@@ -66,16 +66,24 @@ func (d *keystoneDriver) Init(ctx context.Context, rc *redis.Client) (err error)
 	}
 
 	// load oslo.policy
-	d.TokenValidator = &gopherpolicy.TokenValidator{IdentityV3: d.IdentityV3}
-	policyFilePath := osext.MustGetenv("KEPPEL_OSLO_POLICY_PATH")
-	err = d.TokenValidator.LoadPolicyFile(policyFilePath, nil)
+	policyFilePath, err := osext.NeedGetenv("KEPPEL_OSLO_POLICY_PATH")
 	if err != nil {
 		return err
 	}
+	var cacher gopherpolicy.Cacher
 	if rc == nil {
-		d.TokenValidator.Cacher = gopherpolicy.InMemoryCacher()
+		cacher = gopherpolicy.InMemoryCacher()
 	} else {
-		d.TokenValidator.Cacher = redisCacher{rc}
+		cacher = redisCacher{rc}
+	}
+	return d.initTokenValidator(policyFilePath, cacher)
+}
+
+func (d *keystoneDriver) initTokenValidator(policyFilePath string, cacher gopherpolicy.Cacher) error {
+	d.TokenValidator = &gopherpolicy.TokenValidator{IdentityV3: d.IdentityV3, Cacher: cacher}
+	err := d.TokenValidator.LoadPolicyFile(policyFilePath, nil)
+	if err != nil {
+		return err
 	}
 
 	// read policy file "manually" to find which Keystone roles are relevant to us
@@ -99,6 +107,25 @@ func (d *keystoneDriver) AuthenticateUser(ctx context.Context, userName, passwor
 	if rerr != nil {
 		return nil, rerr
 	}
+
+	subject := fmt.Sprintf("user %q", userName)
+	if authOpts.ApplicationCredentialID != "" {
+		subject = fmt.Sprintf("application credential %q", authOpts.ApplicationCredentialID)
+	}
+	uid, rerr := d.authenticateWithCredentials(ctx, userName, password, authOpts, subject)
+	if rerr != nil {
+		// do not return a typed nil in the interface-typed return value
+		return nil, rerr
+	}
+	return uid, nil
+}
+
+// authenticateWithCredentials obtains a Keystone token for the given credentials.
+// The userName and password are only used to build the cache key for the
+// TokenValidator, so application credentials given through request headers
+// share their cache entries with those given through basic auth. If the
+// authentication fails, the respective cache entry is removed.
+func (d *keystoneDriver) authenticateWithCredentials(ctx context.Context, userName, password string, authOpts tokens.AuthOptions, subject string) (*keystoneUserIdentity, *keppel.RegistryV2Error) {
 	authOpts.IdentityEndpoint = d.IdentityV3.Endpoint
 	authOpts.AllowReauth = false
 
@@ -119,19 +146,21 @@ func (d *keystoneDriver) AuthenticateUser(ctx context.Context, userName, passwor
 	throwAwayClient.ReauthFunc = nil
 	throwAwayClient.SetTokenAndAuthResult(nil) //nolint:errcheck
 
+	cacheKey := credentialsCacheKey(userName, password)
 	t := d.TokenValidator.CheckCredentials(
-		ctx, fmt.Sprintf("username=%s,password=%s", userName, password),
+		ctx, cacheKey,
 		func() gopherpolicy.TokenResult { return tokens.Create(ctx, &throwAwayClient, &authOpts) },
 	)
 
 	if t.Err != nil {
+		d.invalidateCachedToken(ctx, cacheKey)
 		if err, ok := errext.As[gophercloud.ErrUnexpectedResponseCode](t.Err); ok && err.Actual == http.StatusTooManyRequests {
 			retryAfterStr := err.ResponseHeader.Get("Retry-After")
 			return nil, keppel.ErrTooManyRequests.With("").WithHeader("Retry-After", retryAfterStr)
 		}
 		return nil, keppel.ErrUnauthorized.With(
-			"failed to get token for user %q: %s",
-			userName, t.Err.Error(),
+			"failed to get token for %s: %s",
+			subject, t.Err.Error(),
 		)
 	}
 	return newKeystoneUserIdentity(t, d.IsRelevantRole), nil
@@ -149,16 +178,13 @@ var userNameRx = regexp.MustCompile(`^([^/@]+)@([^/@]+)/([^/@]+)(?:@([^/@]+))?$`
 //                                      user   u. dom.   project    pr. dom.
 
 func parseUserNameAndPassword(userName, password string) (tokens.AuthOptions, *keppel.RegistryV2Error) {
-	if strings.HasPrefix(userName, "applicationcredential-") {
-		return tokens.AuthOptions{
-			ApplicationCredentialID:     strings.TrimPrefix(userName, "applicationcredential-"),
-			ApplicationCredentialSecret: password,
-		}, nil
+	if appCredID, ok := strings.CutPrefix(userName, "applicationcredential-"); ok {
+		return parseApplicationCredential(appCredID, password)
 	}
 
 	match := userNameRx.FindStringSubmatch(userName)
 	if match == nil {
-		return tokens.AuthOptions{}, keppel.ErrUnauthorized.With(`invalid username (expected "user@domain/project" or "user@domain/project@domain" format)`)
+		return tokens.AuthOptions{}, keppel.ErrUnauthorized.With(`invalid username (expected "user@domain/project", "user@domain/project@domain" or "applicationcredential-$ID" format)`)
 	}
 
 	ao := tokens.AuthOptions{
@@ -176,27 +202,78 @@ func parseUserNameAndPassword(userName, password string) (tokens.AuthOptions, *k
 	return ao, nil
 }
 
+func parseApplicationCredential(id, secret string) (tokens.AuthOptions, *keppel.RegistryV2Error) {
+	if id == "" || secret == "" {
+		return tokens.AuthOptions{}, keppel.ErrUnauthorized.With("application credential ID and secret must not be empty")
+	}
+	// Application credentials are always scoped to the project in which they
+	// were created, and the resulting token only carries the roles that were
+	// delegated to the application credential. We therefore do not need to
+	// (and must not) specify a scope here.
+	return tokens.AuthOptions{
+		ApplicationCredentialID:     id,
+		ApplicationCredentialSecret: secret,
+	}, nil
+}
+
 // AuthenticateUserFromRequest implements the keppel.AuthDriver interface.
 func (d *keystoneDriver) AuthenticateUserFromRequest(r *http.Request) (keppel.UserIdentity, *keppel.RegistryV2Error) {
-	if r.Header.Get("X-Auth-Token") == "" {
+	var (
+		a        *keystoneUserIdentity
+		cacheKey string
+	)
+	switch {
+	case r.Header.Get("X-Auth-Token") != "":
+		cacheKey = r.Header.Get("X-Auth-Token") // this is what TokenValidator.CheckToken() uses
+		t := d.TokenValidator.CheckToken(r)
+		if t.Err != nil {
+			d.invalidateCachedToken(r.Context(), cacheKey)
+			return nil, keppel.ErrUnauthorized.With("X-Auth-Token validation failed: " + t.Err.Error())
+		}
+		// t.Context.Request = mux.Vars(r) //not used at the moment
+		a = newKeystoneUserIdentity(t, d.IsRelevantRole)
+
+	case r.Header.Get("X-Auth-Application-Credential-ID") != "" || r.Header.Get("X-Auth-Application-Credential-Secret") != "":
+		appCredID := r.Header.Get("X-Auth-Application-Credential-ID")
+		appCredSecret := r.Header.Get("X-Auth-Application-Credential-Secret")
+		authOpts, rerr := parseApplicationCredential(appCredID, appCredSecret)
+		if rerr != nil {
+			return nil, rerr
+		}
+		userName := "applicationcredential-" + appCredID
+		cacheKey = credentialsCacheKey(userName, appCredSecret)
+		a, rerr = d.authenticateWithCredentials(r.Context(),
+			userName, appCredSecret, authOpts,
+			fmt.Sprintf("application credential %q", appCredID),
+		)
+		if rerr != nil {
+			return nil, rerr
+		}
+
+	default:
 		// fallback to anonymous auth
 		return nil, nil
 	}
 
-	t := d.TokenValidator.CheckToken(r)
-	if t.Err != nil {
-		return nil, keppel.ErrUnauthorized.With("X-Auth-Token validation failed: " + t.Err.Error())
-	}
-
-	// t.Context.Request = mux.Vars(r) //not used at the moment
-
-	a := newKeystoneUserIdentity(t, d.IsRelevantRole)
 	if !a.t.Check("account:list") {
+		// if the user was just granted access in Keystone, we want them to be able
+		// to use it on the next request instead of after the cache entry expires
+		d.invalidateCachedToken(r.Context(), cacheKey)
 		return nil, keppel.ErrDenied.With("").WithStatus(http.StatusForbidden)
 	}
 	return a, nil
 }
 
+func credentialsCacheKey(userName, password string) string {
+	return fmt.Sprintf("username=%s,password=%s", userName, password)
+}
+
+func (d *keystoneDriver) invalidateCachedToken(ctx context.Context, cacheKey string) {
+	if c, ok := d.TokenValidator.Cacher.(invalidatingCacher); ok {
+		c.InvalidateTokenPayload(ctx, cacheKey)
+	}
+}
+
 type keystoneUserIdentity struct {
 	t *gopherpolicy.Token
 	// ^ WARNING: Token may not always contain everything you expect
@@ -220,13 +297,14 @@ func newKeystoneUserIdentity(t *gopherpolicy.Token, isRelevantRole map[string]bo
 }
 
 var ruleForPerm = map[keppel.Permission]string{
-	keppel.CanViewAccount:       "account:show",
-	keppel.CanPullFromAccount:   "account:pull",
-	keppel.CanPushToAccount:     "account:push",
-	keppel.CanDeleteFromAccount: "account:delete",
-	keppel.CanChangeAccount:     "account:edit",
-	keppel.CanViewQuotas:        "quota:show",
-	keppel.CanChangeQuotas:      "quota:edit",
+	keppel.CanViewAccount:         "account:show",
+	keppel.CanPullFromAccount:     "account:pull",
+	keppel.CanPushToAccount:       "account:push",
+	keppel.CanDeleteFromAccount:   "account:delete",
+	keppel.CanChangeAccount:       "account:edit",
+	keppel.CanViewQuotas:          "quota:show",
+	keppel.CanChangeQuotas:        "quota:edit",
+	keppel.CanAdministrateCluster: "cluster:admin",
 }
 
 // PluginTypeID implements the keppel.UserIdentity interface.
@@ -244,7 +322,8 @@ func (a *keystoneUserIdentity) UserName() string {
 
 // HasPermission implements the keppel.UserIdentity interface.
 func (a *keystoneUserIdentity) HasPermission(perm keppel.Permission, tenantID string) bool {
-	if tenantID == "" {
+	// only CanAdministrateCluster is not tied to an auth tenant
+	if (tenantID == "") != (perm == keppel.CanAdministrateCluster) {
 		return false
 	}
 
@@ -0,0 +1,256 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package openstack
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gophercloud/gophercloud/v2"
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/gopherpolicy"
+
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+const testPolicyJSON = `{
+	"project_scope": "project_id:%(target.project.id)s",
+	"account:list": "role:keppel_viewer or role:keppel_admin",
+	"account:show": "rule:project_scope and (role:keppel_viewer or role:keppel_admin)",
+	"account:pull": "rule:project_scope and (role:keppel_viewer or role:keppel_admin)",
+	"account:push": "rule:project_scope and role:keppel_admin",
+	"account:delete": "rule:project_scope and role:keppel_admin",
+	"account:edit": "rule:project_scope and role:keppel_admin",
+	"quota:show": "rule:project_scope and role:keppel_admin",
+	"quota:edit": "role:cloud_keppel_admin"
+}`
+
+// mockKeystoneAppCred describes an application credential known to the mock Keystone.
+type mockKeystoneAppCred struct {
+	Secret string
+	Name   string
+	// the roles delegated to this application credential
+	Roles []string
+}
+
+// mockKeystoneToken describes a token known to the mock Keystone.
+type mockKeystoneToken struct {
+	Roles     []string
+	ExpiresAt time.Time
+}
+
+// mockKeystone implements just enough of the Keystone v3 API to create tokens
+// from application credentials, and to validate existing tokens.
+type mockKeystone struct {
+	AppCreds map[string]mockKeystoneAppCred
+	Tokens   map[string]mockKeystoneToken
+	// RequestCount counts the requests to the token API, in order to observe caching.
+	RequestCount int
+}
+
+func newMockKeystone(t *testing.T, k *mockKeystone) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v3/auth/tokens" {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		k.RequestCount++
+
+		switch r.Method {
+		case http.MethodGet:
+			token, exists := k.Tokens[r.Header.Get("X-Subject-Token")]
+			if !exists || token.ExpiresAt.Before(time.Now()) {
+				http.Error(w, `{"error":{"code":404,"message":"Could not find token."}}`, http.StatusNotFound)
+				return
+			}
+			writeMockKeystoneToken(t, w, http.StatusOK, r.Header.Get("X-Subject-Token"), token.Roles, token.ExpiresAt, nil)
+		case http.MethodPost:
+			k.handleCreateToken(t, w, r)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func (k *mockKeystone) handleCreateToken(t *testing.T, w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Auth struct {
+			Identity struct {
+				Methods               []string `json:"methods"`
+				ApplicationCredential struct {
+					ID     string `json:"id"`
+					Secret string `json:"secret"`
+				} `json:"application_credential"`
+			} `json:"identity"`
+			Scope any `json:"scope"`
+		} `json:"auth"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	identity := req.Auth.Identity
+	if len(identity.Methods) != 1 || identity.Methods[0] != "application_credential" || req.Auth.Scope != nil {
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+		return
+	}
+	appCredID := identity.ApplicationCredential.ID
+	appCred, exists := k.AppCreds[appCredID]
+	if !exists || appCred.Secret != identity.ApplicationCredential.Secret {
+		http.Error(w, `{"error":{"code":401,"message":"The request you have made requires authentication."}}`, http.StatusUnauthorized)
+		return
+	}
+	writeMockKeystoneToken(t, w, http.StatusCreated, "token-for-"+appCredID, appCred.Roles, time.Now().Add(time.Hour),
+		map[string]any{"id": appCredID, "name": appCred.Name, "restricted": true},
+	)
+}
+
+func writeMockKeystoneToken(t *testing.T, w http.ResponseWriter, status int, tokenID string, roleNames []string, expiresAt time.Time, appCred map[string]any) {
+	roles := make([]map[string]string, len(roleNames))
+	for idx, role := range roleNames {
+		roles[idx] = map[string]string{"id": "role-" + role, "name": role}
+	}
+	domain := map[string]string{"id": "domain1", "name": "Default"}
+	token := map[string]any{
+		"expires_at": expiresAt.UTC().Format(time.RFC3339),
+		"issued_at":  time.Now().UTC().Format(time.RFC3339),
+		"user":       map[string]any{"id": "user1", "name": "ci-user", "domain": domain},
+		"project":    map[string]any{"id": "project1", "name": "ci-project", "domain": domain},
+		"roles":      roles,
+		"catalog":    []any{},
+	}
+	if appCred != nil {
+		token["methods"] = []string{"application_credential"}
+		token["application_credential"] = appCred
+	} else {
+		token["methods"] = []string{"password"}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Subject-Token", tokenID)
+	w.WriteHeader(status)
+	must(t, json.NewEncoder(w).Encode(map[string]any{"token": token}))
+}
+
+func must(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func setupKeystoneDriverForTest(t *testing.T, keystoneURL string, cacher gopherpolicy.Cacher) *keystoneDriver {
+	policyFilePath := filepath.Join(t.TempDir(), "policy.json")
+	must(t, os.WriteFile(policyFilePath, []byte(testPolicyJSON), 0o600))
+
+	d := &keystoneDriver{
+		IdentityV3: &gophercloud.ServiceClient{
+			ProviderClient: &gophercloud.ProviderClient{},
+			Endpoint:       keystoneURL + "/v3/",
+		},
+	}
+	must(t, d.initTokenValidator(policyFilePath, cacher))
+	return d
+}
+
+func TestKeystoneApplicationCredentials(t *testing.T) {
+	keystone := &mockKeystone{AppCreds: map[string]mockKeystoneAppCred{
+		"readonly":  {Secret: "secret1", Name: "ci-pull", Roles: []string{"keppel_viewer", "member"}},
+		"readwrite": {Secret: "secret2", Name: "ci-push", Roles: []string{"keppel_admin"}},
+		"unrelated": {Secret: "secret3", Name: "ci-other", Roles: []string{"member"}},
+	}}
+	srv := newMockKeystone(t, keystone)
+	d := setupKeystoneDriverForTest(t, srv.URL, gopherpolicy.InMemoryCacher())
+
+	// application credentials can be given through basic auth (e.g. for `docker login`)...
+	uid, rerr := d.AuthenticateUser(t.Context(), "applicationcredential-readonly", "secret1")
+	if rerr != nil {
+		t.Fatal(rerr.Error())
+	}
+	assert.DeepEqual(t, "user name", uid.UserName(), "ci-user@Default/ci-project@Default")
+	assert.DeepEqual(t, "user type", uid.UserType(), keppel.RegularUser)
+
+	// ...and the permissions are derived from the roles delegated to the application credential
+	expectPermissions := func(uid keppel.UserIdentity, expected map[keppel.Permission]bool) {
+		t.Helper()
+		for perm, expectedResult := range expected {
+			assert.DeepEqual(t, "permission "+string(perm)+" in project1", uid.HasPermission(perm, "project1"), expectedResult)
+			assert.DeepEqual(t, "permission "+string(perm)+" in project2", uid.HasPermission(perm, "project2"), false)
+		}
+	}
+	expectPermissions(uid, map[keppel.Permission]bool{
+		keppel.CanViewAccount:       true,
+		keppel.CanPullFromAccount:   true,
+		keppel.CanPushToAccount:     false,
+		keppel.CanDeleteFromAccount: false,
+		keppel.CanChangeAccount:     false,
+	})
+
+	// only the roles relevant to our policy are retained, and they survive
+	// serialization into a Keppel token along with the application credential
+	payload, err := uid.SerializeToJSON()
+	must(t, err)
+	uid2 := &keystoneUserIdentity{}
+	must(t, uid2.DeserializeFromJSON(payload, d))
+	assert.DeepEqual(t, "roles after serialization", uid2.t.Context.Roles, []string{"keppel_viewer"})
+	assert.DeepEqual(t, "application credential after serialization", uid2.t.ApplicationCredentialID(), "readonly")
+
+	// authenticating again with the same credentials uses the cached token
+	countBefore := keystone.RequestCount
+	_, rerr = d.AuthenticateUser(t.Context(), "applicationcredential-readonly", "secret1")
+	if rerr != nil {
+		t.Fatal(rerr.Error())
+	}
+	assert.DeepEqual(t, "request count after cached authentication", keystone.RequestCount, countBefore)
+
+	// application credentials can also be given through request headers
+	r := httptest.NewRequest(http.MethodGet, "/keppel/v1/accounts", http.NoBody)
+	r.Header.Set("X-Auth-Application-Credential-ID", "readwrite")
+	r.Header.Set("X-Auth-Application-Credential-Secret", "secret2")
+	uid, rerr = d.AuthenticateUserFromRequest(r)
+	if rerr != nil {
+		t.Fatal(rerr.Error())
+	}
+	expectPermissions(uid, map[keppel.Permission]bool{
+		keppel.CanViewAccount:       true,
+		keppel.CanPullFromAccount:   true,
+		keppel.CanPushToAccount:     true,
+		keppel.CanDeleteFromAccount: true,
+		keppel.CanChangeAccount:     true,
+		keppel.CanChangeQuotas:      false,
+	})
+
+	// error cases
+	_, rerr = d.AuthenticateUser(t.Context(), "applicationcredential-readonly", "wrong")
+	assert.DeepEqual(t, "error code for wrong secret", rerr.Code, keppel.ErrUnauthorized)
+	_, rerr = d.AuthenticateUser(t.Context(), "applicationcredential-", "secret1")
+	assert.DeepEqual(t, "error message for empty ID", rerr.Error(), "application credential ID and secret must not be empty")
+
+	r = httptest.NewRequest(http.MethodGet, "/keppel/v1/accounts", http.NoBody)
+	r.Header.Set("X-Auth-Application-Credential-ID", "readonly")
+	_, rerr = d.AuthenticateUserFromRequest(r)
+	assert.DeepEqual(t, "error message for missing secret", rerr.Error(), "application credential ID and secret must not be empty")
+
+	// application credentials without any Keppel roles are rejected by the "account:list" check
+	r = httptest.NewRequest(http.MethodGet, "/keppel/v1/accounts", http.NoBody)
+	r.Header.Set("X-Auth-Application-Credential-ID", "unrelated")
+	r.Header.Set("X-Auth-Application-Credential-Secret", "secret3")
+	_, rerr = d.AuthenticateUserFromRequest(r)
+	assert.DeepEqual(t, "status for application credential without Keppel roles", rerr.Status, http.StatusForbidden)
+
+	// without any credentials, the driver falls back to anonymous auth
+	r = httptest.NewRequest(http.MethodGet, "/keppel/v1/accounts", http.NoBody)
+	uid, rerr = d.AuthenticateUserFromRequest(r)
+	if uid != nil || rerr != nil {
+		t.Errorf("expected fallback to anonymous auth, but got uid = %#v, rerr = %#v", uid, rerr)
+	}
+}
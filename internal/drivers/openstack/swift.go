@@ -320,7 +320,11 @@ func (d *swiftDriver) ReadTrivyReport(ctx context.Context, account models.Reduce
 		return nil, err
 	}
 	o := c.Object(stringy.TrivyReportObjectName(repoName, manifestDigest, format))
-	return o.Download(ctx, nil).AsByteSlice()
+	contents, err := o.Download(ctx, nil).AsByteSlice()
+	if err != nil {
+		return nil, err
+	}
+	return trivy.DecompressReport(contents)
 }
 
 // WriteTrivyReport implements the keppel.StorageDriver interface.
@@ -329,6 +333,10 @@ func (d *swiftDriver) WriteTrivyReport(ctx context.Context, account models.Reduc
 	if err != nil {
 		return err
 	}
+	payload, err = payload.Compress()
+	if err != nil {
+		return err
+	}
 	o := c.Object(stringy.TrivyReportObjectName(repoName, manifestDigest, payload.Format))
 	return uploadToObject(ctx, o, bytes.NewReader(payload.Contents), nil, nil)
 }
@@ -426,6 +434,13 @@ func mergeChunkCount(chunkCounts map[string]uint32, key string, chunkNumber uint
 	}
 }
 
+// StorageCapacity implements the keppel.StorageDriver interface.
+func (d *swiftDriver) StorageCapacity(ctx context.Context) (used, total uint64, err error) {
+	// each Keppel account lives in its own Swift account, so there is no
+	// single place to ask for the overall capacity
+	return 0, 0, keppel.ErrCapacityUnknown
+}
+
 // CanSetupAccount implements the keppel.StorageDriver interface.
 func (d *swiftDriver) CanSetupAccount(ctx context.Context, account models.ReducedAccount) error {
 	// check that the Swift account is accessible
@@ -9,6 +9,8 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/redis/go-redis/v9"
@@ -33,7 +35,10 @@ func (d *federationDriver) PluginTypeID() string { return "redis" }
 
 // Init implements the keppel.FederationDriver interface.
 func (d *federationDriver) Init(ctx context.Context, ad keppel.AuthDriver, cfg keppel.Configuration) error {
-	osext.MustGetenv("KEPPEL_FEDERATION_REDIS_HOSTNAME") // check config
+	_, err := osext.NeedGetenv("KEPPEL_FEDERATION_REDIS_HOSTNAME") // check config
+	if err != nil {
+		return err
+	}
 	opts, err := keppel.GetRedisOptions("KEPPEL_FEDERATION")
 	if err != nil {
 		return fmt.Errorf("cannot parse federation Redis URL: %s", err.Error())
@@ -53,6 +58,9 @@ func (d *federationDriver) replicasKey(accountName models.AccountName) string {
 func (d *federationDriver) tokenKey(accountName models.AccountName) string {
 	return fmt.Sprintf("%s-token-%s", d.prefix, accountName)
 }
+func (d *federationDriver) reservationsKey() string {
+	return d.prefix + "-reservations"
+}
 
 const (
 	checkAndClearScript = `
@@ -79,13 +87,22 @@ func (d *federationDriver) claimPrimaryAccount(ctx context.Context, account mode
 		return keppel.ClaimFailed, errors.New("cannot check sublease token when claiming a primary account")
 	}
 
+	reservations, err := d.listAccountNameReservations(ctx)
+	if err != nil {
+		return keppel.ClaimErrored, err
+	}
+	err = keppel.CheckAccountNameReservations(reservations, account)
+	if err != nil {
+		return keppel.ClaimFailed, err
+	}
+
 	// three scenarios:
 	// 1. no one has a claim -> SETNX will claim it for us, so GET will return our hostname -> success
 	// 2. we have a claim -> SETNX does nothing, but GET will return our hostname -> success
 	// 3. someone else has a claim -> SETNX does nothing and GET returns their hostname -> error
 
 	key := d.primaryKey(account.Name)
-	err := d.rc.SetNX(ctx, key, d.ownHostname, 0).Err()
+	err = d.rc.SetNX(ctx, key, d.ownHostname, 0).Err()
 	if err != nil {
 		return keppel.ClaimErrored, err
 	}
@@ -165,8 +182,16 @@ func (d *federationDriver) ForfeitAccountName(ctx context.Context, account model
 		return d.rc.SRem(ctx, d.replicasKey(account.Name), d.ownHostname).Err()
 	}
 
-	// case 2: primary account -> double-check that we really own it
-	err := d.validatePrimaryHostname(ctx, account, d.ownHostname)
+	// case 2: primary account -> double-check that we really own it (unless
+	// the name was already forfeited)
+	exists, err := d.rc.Exists(ctx, d.primaryKey(account.Name)).Result()
+	if err != nil {
+		return err
+	}
+	if exists == 0 {
+		return nil
+	}
+	err = d.validatePrimaryHostname(ctx, account, d.ownHostname)
 	if err != nil {
 		return err
 	}
@@ -248,3 +273,25 @@ func (d *federationDriver) FindPrimaryAccount(ctx context.Context, accountName m
 	}
 	return primaryHostname, err
 }
+
+// SweepArchivedAccountNames implements the keppel.FederationDriver interface.
+func (d *federationDriver) SweepArchivedAccountNames(ctx context.Context, now time.Time) error {
+	return nil
+}
+
+// listAccountNameReservations returns the reservations that the operator has
+// recorded in the reservations hash.
+func (d *federationDriver) listAccountNameReservations(ctx context.Context) ([]keppel.AccountNameReservation, error) {
+	entries, err := d.rc.HGetAll(ctx, d.reservationsKey()).Result()
+	if err != nil {
+		return nil, err
+	}
+	result := make([]keppel.AccountNameReservation, 0, len(entries))
+	for prefix, authTenantID := range entries {
+		result = append(result, keppel.AccountNameReservation{Prefix: prefix, AuthTenantID: authTenantID})
+	}
+	slices.SortFunc(result, func(lhs, rhs keppel.AccountNameReservation) int {
+		return strings.Compare(lhs.Prefix, rhs.Prefix)
+	})
+	return result, nil
+}
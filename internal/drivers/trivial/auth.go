@@ -70,9 +70,13 @@ func (d *AuthDriver) PluginTypeID() string {
 }
 
 func (d *AuthDriver) Init(ctx context.Context, rc *redis.Client) error {
-	d.userName = osext.MustGetenv("KEPPEL_USERNAME")
-	d.password = osext.MustGetenv("KEPPEL_PASSWORD")
-	return nil
+	var err error
+	d.userName, err = osext.NeedGetenv("KEPPEL_USERNAME")
+	if err != nil {
+		return err
+	}
+	d.password, err = osext.NeedGetenv("KEPPEL_PASSWORD")
+	return err
 }
 
 func (d *AuthDriver) AuthenticateUser(ctx context.Context, userName, password string) (keppel.UserIdentity, *keppel.RegistryV2Error) {
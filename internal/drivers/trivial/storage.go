@@ -37,6 +37,12 @@ type StorageDriver struct {
 	trivyReports         map[string][]byte
 	trivyReportsMutex    sync.RWMutex
 	ForbidNewAccounts    bool
+	// If CorruptBlobs is set, the last byte of each chunk is altered before it
+	// is stored, to simulate a storage backend that silently corrupts data.
+	CorruptBlobs bool
+	// If OnCanSetupAccount is set, it is called at the start of each call to
+	// CanSetupAccount, to let tests observe accounts while they are being created.
+	OnCanSetupAccount func(account models.ReducedAccount)
 }
 
 // PluginTypeID implements the keppel.StorageDriver interface.
@@ -97,6 +103,10 @@ func (d *StorageDriver) AppendToBlob(ctx context.Context, account models.Reduced
 		return err
 	}
 
+	if d.CorruptBlobs && len(chunkBytes) > 0 {
+		chunkBytes[len(chunkBytes)-1] ^= 0xFF
+	}
+
 	d.blobsMutex.Lock()
 	defer d.blobsMutex.Unlock()
 	d.blobs[k] = append(d.blobs[k], chunkBytes...)
@@ -206,11 +216,15 @@ func (d *StorageDriver) ReadTrivyReport(ctx context.Context, account models.Redu
 	if !exists {
 		return nil, errNoSuchTrivyReport
 	}
-	return contents, nil
+	return trivy.DecompressReport(contents)
 }
 
 // WriteTrivyReport implements the keppel.StorageDriver interface.
 func (d *StorageDriver) WriteTrivyReport(ctx context.Context, account models.ReducedAccount, repoName string, manifestDigest digest.Digest, payload trivy.ReportPayload) error {
+	payload, err := payload.Compress()
+	if err != nil {
+		return err
+	}
 	k := trivyReportKey(account, repoName, manifestDigest, payload.Format)
 	d.trivyReportsMutex.Lock()
 	defer d.trivyReportsMutex.Unlock()
@@ -299,8 +313,35 @@ func (d *StorageDriver) ListStorageContents(ctx context.Context, account models.
 	return blobs, manifests, trivyReports, nil
 }
 
+// StorageCapacity implements the keppel.StorageDriver interface.
+func (d *StorageDriver) StorageCapacity(ctx context.Context) (used, total uint64, err error) {
+	d.blobsMutex.RLock()
+	for _, contents := range d.blobs {
+		used += uint64(len(contents))
+	}
+	d.blobsMutex.RUnlock()
+
+	d.manifestMutex.RLock()
+	for _, contents := range d.manifests {
+		used += uint64(len(contents))
+	}
+	d.manifestMutex.RUnlock()
+
+	d.trivyReportsMutex.RLock()
+	for _, contents := range d.trivyReports {
+		used += uint64(len(contents))
+	}
+	d.trivyReportsMutex.RUnlock()
+
+	// this driver is only limited by the amount of RAM available
+	return used, keppel.UnlimitedStorageCapacity, nil
+}
+
 // CanSetupAccount implements the keppel.StorageDriver interface.
 func (d *StorageDriver) CanSetupAccount(ctx context.Context, account models.ReducedAccount) error {
+	if d.OnCanSetupAccount != nil {
+		d.OnCanSetupAccount(account)
+	}
 	if d.ForbidNewAccounts {
 		return errors.New("CanSetupAccount failed as requested")
 	}
@@ -0,0 +1,98 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package trivial
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	. "github.com/majewsky/gg/option"
+	"github.com/opencontainers/go-digest"
+	"github.com/sapcc/go-bits/assert"
+
+	"github.com/sapcc/keppel/internal/keppel"
+	"github.com/sapcc/keppel/internal/models"
+	"github.com/sapcc/keppel/internal/trivy"
+)
+
+func TestStorageCapacity(t *testing.T) {
+	ctx := context.Background()
+	sd := &StorageDriver{}
+	mustDo(t, sd.Init(nil, keppel.Configuration{}))
+
+	expectCapacity := func(expectedUsed uint64) {
+		t.Helper()
+		used, total, err := sd.StorageCapacity(ctx)
+		mustDo(t, err)
+		assert.DeepEqual(t, "used capacity", used, expectedUsed)
+		assert.DeepEqual(t, "total capacity", total, uint64(keppel.UnlimitedStorageCapacity))
+	}
+	expectCapacity(0)
+
+	// all kinds of stored objects count towards the used capacity
+	account := models.ReducedAccount{Name: "test1"}
+	blobContents := []byte("hello world")
+	mustDo(t, sd.AppendToBlob(ctx, account, "blob1", 1, Some(uint64(len(blobContents))), bytes.NewReader(blobContents)))
+	mustDo(t, sd.FinalizeBlob(ctx, account, "blob1", 1))
+	expectCapacity(11)
+
+	manifestContents := []byte(`{"foo":"bar"}`)
+	manifestDigest := digest.FromBytes(manifestContents)
+	mustDo(t, sd.WriteManifest(ctx, account, "repo", manifestDigest, manifestContents))
+	expectCapacity(24)
+
+	// Trivy reports are stored in compressed form
+	report := trivy.ReportPayload{Format: "json", Contents: []byte("{}")}
+	compressedReport, err := report.Compress()
+	mustDo(t, err)
+	mustDo(t, sd.WriteTrivyReport(ctx, account, "repo", manifestDigest, report))
+	expectCapacity(24 + uint64(len(compressedReport.Contents)))
+
+	// deleted objects do not count anymore
+	mustDo(t, sd.DeleteBlob(ctx, account, "blob1"))
+	expectCapacity(13 + uint64(len(compressedReport.Contents)))
+}
+
+func TestTrivyReportCompression(t *testing.T) {
+	ctx := context.Background()
+	sd := &StorageDriver{}
+	mustDo(t, sd.Init(nil, keppel.Configuration{}))
+
+	account := models.ReducedAccount{Name: "test1"}
+	manifestDigest := digest.FromString("dummy")
+	reportContents := []byte(`{"SchemaVersion":2,"Results":[]}`)
+	key := trivyReportKey(account, "repo", manifestDigest, "json")
+
+	// reports are compressed when written, and decompressed when read
+	mustDo(t, sd.WriteTrivyReport(ctx, account, "repo", manifestDigest, trivy.ReportPayload{Format: "json", Contents: reportContents}))
+	if bytes.Equal(sd.trivyReports[key], reportContents) {
+		t.Error("expected Trivy report to be stored in compressed form, but it was stored verbatim")
+	}
+	buf, err := sd.ReadTrivyReport(ctx, account, "repo", manifestDigest, "json")
+	mustDo(t, err)
+	assert.DeepEqual(t, "report contents", string(buf), string(reportContents))
+
+	// payloads that are already compressed are not compressed again
+	compressedReport, err := trivy.ReportPayload{Format: "json", Contents: reportContents}.Compress()
+	mustDo(t, err)
+	mustDo(t, sd.WriteTrivyReport(ctx, account, "repo", manifestDigest, compressedReport))
+	assert.DeepEqual(t, "stored contents", sd.trivyReports[key], compressedReport.Contents)
+	buf, err = sd.ReadTrivyReport(ctx, account, "repo", manifestDigest, "json")
+	mustDo(t, err)
+	assert.DeepEqual(t, "report contents", string(buf), string(reportContents))
+
+	// reports that were stored before compression was introduced can still be read
+	sd.trivyReports[key] = reportContents
+	buf, err = sd.ReadTrivyReport(ctx, account, "repo", manifestDigest, "json")
+	mustDo(t, err)
+	assert.DeepEqual(t, "report contents", string(buf), string(reportContents))
+}
+
+func mustDo(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+}
@@ -4,21 +4,37 @@
 package keppel
 
 import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"time"
+	"unicode"
+
 	"github.com/sapcc/keppel/internal/models"
 )
 
 // Account represents an account in the API.
 type Account struct {
-	Name              models.AccountName    `json:"name"`
-	AuthTenantID      string                `json:"auth_tenant_id"`
-	GCPolicies        []GCPolicy            `json:"gc_policies,omitempty"`
-	RBACPolicies      []RBACPolicy          `json:"rbac_policies"`
-	ReplicationPolicy *ReplicationPolicy    `json:"replication,omitempty"`
-	State             string                `json:"state,omitempty"`
-	TagPolicies       []TagPolicy           `json:"tag_policies,omitempty"`
-	ValidationPolicy  *ValidationPolicy     `json:"validation,omitempty"`
-	PlatformFilter    models.PlatformFilter `json:"platform_filter,omitempty"`
-	Metadata          *map[string]string    `json:"metadata"`
+	Name                    models.AccountName    `json:"name"`
+	AuthTenantID            string                `json:"auth_tenant_id"`
+	GCPolicies              []GCPolicy            `json:"gc_policies,omitempty"`
+	RBACPolicies            []RBACPolicy          `json:"rbac_policies"`
+	ReplicationPolicy       *ReplicationPolicy    `json:"replication,omitempty"`
+	State                   string                `json:"state,omitempty"`
+	TagPolicies             []TagPolicy           `json:"tag_policies,omitempty"`
+	ValidationPolicy        *ValidationPolicy     `json:"validation,omitempty"`
+	PlatformFilter          models.PlatformFilter `json:"platform_filter,omitempty"`
+	PlatformFilterInherited bool                  `json:"platform_filter_inherited,omitempty"`
+	ManifestCacheTTL        *Duration             `json:"manifest_cache_ttl,omitempty"`
+	ManifestTrashRetention  *Duration             `json:"manifest_trash_retention,omitempty"`
+	Metadata                *map[string]string    `json:"metadata"`
+	ReadOnly                bool                  `json:"read_only,omitempty"`
+	PullEnabled             *bool                 `json:"pull_enabled,omitempty"`
+	PushEnabled             *bool                 `json:"push_enabled,omitempty"`
+	AnycastEnabled          *bool                 `json:"anycast_enabled,omitempty"`
+	StrictMediaTypes        bool                  `json:"strict_media_types,omitempty"`
+	ValidateOnPush          bool                  `json:"validate_on_push,omitempty"`
+	Labels                  map[string]string     `json:"labels,omitempty"`
 
 	// NOTE: When changing fields, please also adjust type Account in `internal/drivers/basic` as necessary.
 }
@@ -48,9 +64,41 @@ func RenderAccount(dbAccount models.Account) (Account, error) {
 		tagPolicies = []TagPolicy{}
 	}
 
+	labels, err := ParseAccountLabels(dbAccount.LabelsJSON)
+	if err != nil {
+		return Account{}, err
+	}
+
 	var state string
-	if dbAccount.IsDeleting {
+	switch {
+	case dbAccount.IsDeleting:
 		state = "deleting"
+	case dbAccount.IsCreating:
+		state = "creating"
+	}
+
+	var manifestCacheTTL *Duration
+	if dbAccount.ManifestCacheTTLSecs > 0 {
+		ttl := Duration(time.Duration(dbAccount.ManifestCacheTTLSecs) * time.Second)
+		manifestCacheTTL = &ttl
+	}
+
+	var manifestTrashRetention *Duration
+	if dbAccount.ManifestTrashRetentionSecs > 0 {
+		retention := Duration(time.Duration(dbAccount.ManifestTrashRetentionSecs) * time.Second)
+		manifestTrashRetention = &retention
+	}
+
+	// pull_enabled, push_enabled and anycast_enabled are only shown when they deviate from the default
+	var pullEnabled, pushEnabled, anycastEnabled *bool
+	if dbAccount.IsPullDisabled {
+		pullEnabled = new(bool)
+	}
+	if dbAccount.IsPushDisabled {
+		pushEnabled = new(bool)
+	}
+	if dbAccount.IsAnycastDisabled {
+		anycastEnabled = new(bool)
 	}
 
 	return Account{
@@ -63,5 +111,56 @@ func RenderAccount(dbAccount models.Account) (Account, error) {
 		TagPolicies:       tagPolicies,
 		ValidationPolicy:  RenderValidationPolicy(dbAccount.Reduced()),
 		PlatformFilter:    dbAccount.PlatformFilter,
+		// internal replicas always use the platform filter of their primary account
+		PlatformFilterInherited: dbAccount.UpstreamPeerHostName != "" && len(dbAccount.PlatformFilter) > 0,
+		ManifestCacheTTL:        manifestCacheTTL,
+		ManifestTrashRetention:  manifestTrashRetention,
+		ReadOnly:                dbAccount.IsReadOnly,
+		PullEnabled:             pullEnabled,
+		PushEnabled:             pushEnabled,
+		AnycastEnabled:          anycastEnabled,
+		StrictMediaTypes:        dbAccount.StrictMediaTypes,
+		ValidateOnPush:          dbAccount.ValidateOnPush,
+		Labels:                  labels,
 	}, nil
 }
+
+const (
+	maxAccountLabelCount       = 32
+	maxAccountLabelValueLength = 255
+)
+
+// Label keys are restricted such that they can be used unambiguously in
+// filters like `?label=key:value`.
+var accountLabelKeyRx = regexp.MustCompile(`^[a-zA-Z0-9](?:[a-zA-Z0-9._/-]{0,61}[a-zA-Z0-9])?$`)
+
+// ValidateAccountLabels returns an error if the given set of account labels is not acceptable.
+func ValidateAccountLabels(labels map[string]string) error {
+	if len(labels) > maxAccountLabelCount {
+		return fmt.Errorf("too many labels (got %d, but only %d are allowed)", len(labels), maxAccountLabelCount)
+	}
+	for key, value := range labels {
+		if !accountLabelKeyRx.MatchString(key) {
+			return fmt.Errorf("invalid label key: %q (must be between 1 and 63 characters long, and contain only letters, digits, dots, dashes, underscores and slashes, starting and ending with a letter or digit)", key)
+		}
+		if len(value) > maxAccountLabelValueLength {
+			return fmt.Errorf("value for label %q is too long (must be at most %d bytes)", key, maxAccountLabelValueLength)
+		}
+		for _, r := range value {
+			if !unicode.IsPrint(r) {
+				return fmt.Errorf("value for label %q contains non-printable characters", key)
+			}
+		}
+	}
+	return nil
+}
+
+// ParseAccountLabels parses the LabelsJSON field of an account.
+func ParseAccountLabels(labelsJSON string) (map[string]string, error) {
+	if labelsJSON == "" || labelsJSON == "{}" {
+		return nil, nil
+	}
+	var labels map[string]string
+	err := json.Unmarshal([]byte(labelsJSON), &labels)
+	return labels, err
+}
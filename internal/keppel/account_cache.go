@@ -0,0 +1,90 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package keppel
+
+import (
+	"context"
+	"slices"
+	"sync"
+
+	"github.com/go-gorp/gorp/v3"
+
+	"github.com/sapcc/keppel/internal/models"
+)
+
+type accountCacheContextKey struct{}
+
+// accountCache holds the results of account lookups for a single request.
+// All methods can be called on a nil *accountCache, in which case nothing is cached.
+type accountCache struct {
+	mutex   sync.Mutex
+	entries map[models.AccountName]accountCacheEntry
+}
+
+type accountCacheEntry struct {
+	// Account is nil if only the ReducedAccount has been loaded so far.
+	Account *models.Account
+	// ReducedAccount is nil if the account does not exist.
+	ReducedAccount *models.ReducedAccount
+}
+
+// WithAccountCache returns a child context that caches the results of
+// FindAccount(), FindReducedAccount() and DoesAccountExist(), such that each
+// account is loaded from the DB at most once while this context is in use.
+//
+// Since cache entries are never invalidated, this shall only be used for
+// contexts that are scoped to a single request, and only in code paths that
+// do not modify accounts. Lookups on DB.ReadReplica() bypass the cache.
+func WithAccountCache(ctx context.Context) context.Context {
+	cache := &accountCache{entries: make(map[models.AccountName]accountCacheEntry)}
+	return context.WithValue(ctx, accountCacheContextKey{}, cache)
+}
+
+func getAccountCache(ctx context.Context, db gorp.SqlExecutor) *accountCache {
+	if _, isReadReplica := db.(readReplicaExecutor); isReadReplica {
+		return nil
+	}
+	cache, _ := ctx.Value(accountCacheContextKey{}).(*accountCache)
+	return cache
+}
+
+func (c *accountCache) get(name models.AccountName) (accountCacheEntry, bool) {
+	if c == nil {
+		return accountCacheEntry{}, false
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	entry, exists := c.entries[name]
+	return entry, exists
+}
+
+func (c *accountCache) put(name models.AccountName, entry accountCacheEntry) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries[name] = entry
+}
+
+// The following functions return copies of the cached objects, so that callers
+// cannot alter the cache contents by modifying the returned objects.
+
+func (e accountCacheEntry) cloneAccount() *models.Account {
+	if e.Account == nil {
+		return nil
+	}
+	account := *e.Account
+	account.PlatformFilter = slices.Clone(account.PlatformFilter)
+	return &account
+}
+
+func (e accountCacheEntry) cloneReducedAccount() *models.ReducedAccount {
+	if e.ReducedAccount == nil {
+		return nil
+	}
+	account := *e.ReducedAccount
+	account.PlatformFilter = slices.Clone(account.PlatformFilter)
+	return &account
+}
@@ -0,0 +1,92 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package keppel
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/go-gorp/gorp/v3"
+	"github.com/sapcc/go-bits/assert"
+
+	"github.com/sapcc/keppel/internal/models"
+)
+
+// accountCacheTestExecutor counts the queries issued by FindAccount(). All
+// other methods of gorp.SqlExecutor panic when called, so this also ensures
+// that cached lookups do not issue any other queries.
+type accountCacheTestExecutor struct {
+	gorp.SqlExecutor
+	Accounts       map[models.AccountName]models.Account
+	SelectOneCalls int
+}
+
+func (e *accountCacheTestExecutor) SelectOne(holder any, query string, args ...any) error {
+	e.SelectOneCalls++
+	account, exists := e.Accounts[args[0].(models.AccountName)]
+	if !exists {
+		return sql.ErrNoRows
+	}
+	*holder.(*models.Account) = account
+	return nil
+}
+
+func TestAccountCache(t *testing.T) {
+	db := &accountCacheTestExecutor{
+		Accounts: map[models.AccountName]models.Account{
+			"test1": {Name: "test1", AuthTenantID: "tenant1"},
+		},
+	}
+	expectQueries := func(expected int) {
+		t.Helper()
+		assert.DeepEqual(t, "number of queries", db.SelectOneCalls, expected)
+		db.SelectOneCalls = 0
+	}
+
+	// without cache, each lookup is a separate query
+	for range 2 {
+		account, err := FindAccount(t.Context(), db, "test1")
+		assert.DeepEqual(t, "error", err, nil)
+		assert.DeepEqual(t, "auth tenant ID", account.AuthTenantID, "tenant1")
+	}
+	expectQueries(2)
+
+	// with cache, repeated lookups of the same account within a request only
+	// issue a single query
+	ctx := WithAccountCache(t.Context())
+	for range 2 {
+		account, err := FindAccount(ctx, db, "test1")
+		assert.DeepEqual(t, "error", err, nil)
+		assert.DeepEqual(t, "auth tenant ID", account.AuthTenantID, "tenant1")
+
+		// modifying the result must not affect the cache
+		account.AuthTenantID = "modified"
+	}
+	reducedAccount, err := FindReducedAccount(ctx, db, "test1")
+	assert.DeepEqual(t, "error", err, nil)
+	assert.DeepEqual(t, "reduced account", *reducedAccount, models.ReducedAccount{Name: "test1", AuthTenantID: "tenant1"})
+	exists, err := DoesAccountExist(ctx, db, "test1")
+	assert.DeepEqual(t, "error", err, nil)
+	assert.DeepEqual(t, "account exists", exists, true)
+	expectQueries(1)
+
+	// the nonexistence of an account is cached as well
+	for range 2 {
+		account, err := FindAccount(ctx, db, "test2")
+		assert.DeepEqual(t, "error", err, nil)
+		assert.DeepEqual(t, "account", account, (*models.Account)(nil))
+	}
+	reducedAccount, err = FindReducedAccount(ctx, db, "test2")
+	assert.DeepEqual(t, "error", err, nil)
+	assert.DeepEqual(t, "reduced account", reducedAccount, (*models.ReducedAccount)(nil))
+	exists, err = DoesAccountExist(ctx, db, "test2")
+	assert.DeepEqual(t, "error", err, nil)
+	assert.DeepEqual(t, "account exists", exists, false)
+	expectQueries(1)
+
+	// caches are not shared between requests
+	_, err = FindAccount(WithAccountCache(t.Context()), db, "test1")
+	assert.DeepEqual(t, "error", err, nil)
+	expectQueries(1)
+}
@@ -0,0 +1,47 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package keppel
+
+import (
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+
+	"github.com/sapcc/keppel/internal/models"
+)
+
+func TestRenderAccountPlatformFilterInherited(t *testing.T) {
+	filter := models.PlatformFilter{{OS: "linux", Architecture: "amd64"}}
+	testCases := []struct {
+		Description       string
+		Account           models.Account
+		ExpectedInherited bool
+	}{
+		{
+			Description: "primary account without platform filter",
+			Account:     models.Account{Name: "test1"},
+		},
+		{
+			Description: "external replica with explicit platform filter",
+			Account:     models.Account{Name: "test1", ExternalPeerURL: "registry.example.com", PlatformFilter: filter},
+		},
+		{
+			Description: "internal replica without platform filter",
+			Account:     models.Account{Name: "test1", UpstreamPeerHostName: "registry.example.org"},
+		},
+		{
+			Description:       "internal replica with platform filter from primary account",
+			Account:           models.Account{Name: "test1", UpstreamPeerHostName: "registry.example.org", PlatformFilter: filter},
+			ExpectedInherited: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		rendered, err := RenderAccount(tc.Account)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.Description, err.Error())
+		}
+		assert.DeepEqual(t, tc.Description, rendered.PlatformFilterInherited, tc.ExpectedInherited)
+	}
+}
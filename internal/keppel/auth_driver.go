@@ -32,8 +32,25 @@ const (
 	CanViewQuotas Permission = "viewquota"
 	// CanChangeQuotas is the permission for changing an auth tenant's quotas.
 	CanChangeQuotas Permission = "changequota"
+	// CanAdministrateCluster is the permission for inspecting and modifying
+	// cluster-wide state, e.g. pending replications. Since this permission is
+	// not tied to any auth tenant, HasPermission() is called with an empty
+	// tenant ID to check it.
+	CanAdministrateCluster Permission = "clusteradmin"
 )
 
+// IsValid returns whether this is one of the Permission values defined above.
+// Auth drivers can use this to validate permissions in their configuration.
+func (p Permission) IsValid() bool {
+	switch p {
+	case CanViewAccount, CanPullFromAccount, CanPushToAccount, CanDeleteFromAccount,
+		CanChangeAccount, CanViewQuotas, CanChangeQuotas, CanAdministrateCluster:
+		return true
+	default:
+		return false
+	}
+}
+
 // AuthDriver represents an authentication backend that supports multiple
 // tenants. A tenant is a scope where users can be authorized to perform certain
 // actions. For example, in OpenStack, a Keppel tenant is a Keystone project.
@@ -5,22 +5,32 @@ package keppel
 
 import (
 	"crypto"
+	_ "crypto/sha512" // makes digest.SHA384 and digest.SHA512 available
+	"encoding/json"
 	"fmt"
+	"math"
+	"mime"
 	"net"
+	"net/http"
 	"net/url"
 	"os"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/opencontainers/go-digest"
 	"github.com/redis/go-redis/v9"
 	"github.com/sapcc/go-api-declarations/bininfo"
 	"github.com/sapcc/go-bits/easypg"
+	"github.com/sapcc/go-bits/errext"
 	"github.com/sapcc/go-bits/logg"
 	"github.com/sapcc/go-bits/must"
 	"github.com/sapcc/go-bits/osext"
 
+	"github.com/sapcc/keppel/internal/models"
 	"github.com/sapcc/keppel/internal/trivy"
 )
 
@@ -29,16 +39,162 @@ import (
 type Configuration struct {
 	APIPublicHostname        string
 	AnycastAPIPublicHostname string
-	JWTIssuerKeys            []crypto.PrivateKey
-	AnycastJWTIssuerKeys     []crypto.PrivateKey
+	JWTIssuerKeys            []IssuerKey
+	AnycastJWTIssuerKeys     []IssuerKey
 	Trivy                    *trivy.Config
+	// If ReadOnly is true, all accounts behave as if they had the read-only flag set.
+	ReadOnly bool
+	// If ReadOnlyAllowsReplication is true, replication into read-only replica accounts is still allowed.
+	ReadOnlyAllowsReplication bool
+	// DigestAlgorithms lists the digest algorithms that are accepted when blobs
+	// and manifests are uploaded. If empty, only digest.Canonical is accepted.
+	DigestAlgorithms []digest.Algorithm
+	// PeerHostNames contains the hostnames of all peers listed in KEPPEL_PEERS.
+	PeerHostNames []string
+	// UpstreamConnectionPool configures the HTTP connections to upstream
+	// registries that are used for replication.
+	UpstreamConnectionPool ConnectionPoolConfig
+	// DBConnectionPool configures the connections to the database.
+	DBConnectionPool DBConnectionPoolConfig
+	// ReverseProxyForwardedHeaders lists the request headers that are forwarded
+	// when an anycast request is reverse-proxied to a peer. If empty,
+	// DefaultReverseProxyForwardedHeaders is used.
+	ReverseProxyForwardedHeaders []string
+	// ReverseProxyStrippedHeaders lists the response headers that are removed
+	// when an anycast request is reverse-proxied to a peer. If nil,
+	// DefaultReverseProxyStrippedHeaders is used. If empty, but not nil, no
+	// headers are removed.
+	ReverseProxyStrippedHeaders []string
+	// MaxScopesPerToken limits how many scopes can be requested at once from
+	// the auth API. If zero, DefaultMaxScopesPerToken is used.
+	MaxScopesPerToken int
+	// MaxManifestReferenceDepth limits how deeply manifests may be nested
+	// within each other (e.g. an image index referencing another image index
+	// referencing an image manifest has a depth of 2). If zero,
+	// DefaultMaxManifestReferenceDepth is used.
+	MaxManifestReferenceDepth int
+	// DefaultBlobMediaType is reported as the media type of blobs whose media
+	// type is not known from any manifest. If empty,
+	// models.DefaultBlobMediaType is used.
+	DefaultBlobMediaType string
+	// If TrackIssuedTokens is true, tokens issued to users are recorded in the
+	// database, such that they can be listed and revoked per auth tenant.
+	// Revocations are only checked while this is true, at the cost of one
+	// database read per request that is authenticated with a token.
+	TrackIssuedTokens bool
+	// OpaqueManifestMediaTypes lists the media types (besides
+	// ManifestMediaTypes) of manifests that are accepted and stored as opaque
+	// artifact manifests. If empty, all valid media types are accepted.
+	OpaqueManifestMediaTypes []string
+	// JanitorJitterFraction is only used by keppel-janitor. It controls how far
+	// the next run of a recurring task may deviate from the regular interval.
+	// TryParseConfiguration() sets this to DefaultJanitorJitterFraction unless
+	// configured otherwise.
+	JanitorJitterFraction float64
+}
+
+// IsDigestAlgorithmAccepted returns whether blobs and manifests may be
+// uploaded with digests using the given algorithm.
+func (cfg Configuration) IsDigestAlgorithmAccepted(algo digest.Algorithm) bool {
+	if len(cfg.DigestAlgorithms) == 0 {
+		return algo == digest.Canonical
+	}
+	return slices.Contains(cfg.DigestAlgorithms, algo)
+}
+
+// DefaultReverseProxyForwardedHeaders is the default value for
+// Configuration.ReverseProxyForwardedHeaders.
+var DefaultReverseProxyForwardedHeaders = []string{
+	"Accept",
+	"Accept-Encoding",
+	"Authorization",
+	"Range",
+}
+
+// ReverseProxyForwardedHeaderNames returns the canonical names of all request
+// headers that are forwarded when reverse-proxying anycast requests to a peer.
+func (cfg Configuration) ReverseProxyForwardedHeaderNames() []string {
+	forwarded := cfg.ReverseProxyForwardedHeaders
+	if len(forwarded) == 0 {
+		forwarded = DefaultReverseProxyForwardedHeaders
+	}
+	result := make([]string, len(forwarded))
+	for idx, name := range forwarded {
+		result[idx] = http.CanonicalHeaderKey(name)
+	}
+	return result
+}
+
+// DefaultMaxScopesPerToken is the default value for Configuration.MaxScopesPerToken.
+const DefaultMaxScopesPerToken = 100
+
+// DefaultJanitorJitterFraction is the default value for Configuration.JanitorJitterFraction.
+const DefaultJanitorJitterFraction = 0.1
+
+// EffectiveMaxScopesPerToken returns MaxScopesPerToken, or its default value if unset.
+func (cfg Configuration) EffectiveMaxScopesPerToken() int {
+	if cfg.MaxScopesPerToken == 0 {
+		return DefaultMaxScopesPerToken
+	}
+	return cfg.MaxScopesPerToken
+}
+
+// DefaultMaxManifestReferenceDepth is the default value for Configuration.MaxManifestReferenceDepth.
+const DefaultMaxManifestReferenceDepth = 8
+
+// EffectiveMaxManifestReferenceDepth returns MaxManifestReferenceDepth, or its default value if unset.
+func (cfg Configuration) EffectiveMaxManifestReferenceDepth() int {
+	if cfg.MaxManifestReferenceDepth == 0 {
+		return DefaultMaxManifestReferenceDepth
+	}
+	return cfg.MaxManifestReferenceDepth
+}
+
+// BlobMediaType returns the media type of the given blob, falling back to
+// DefaultBlobMediaType if the media type of the blob is not known.
+func (cfg Configuration) BlobMediaType(blob models.Blob) string {
+	fallback := cfg.DefaultBlobMediaType
+	if fallback == "" {
+		fallback = models.DefaultBlobMediaType
+	}
+	return blob.SafeMediaType(fallback)
+}
+
+// DefaultReverseProxyStrippedHeaders is the default value for
+// Configuration.ReverseProxyStrippedHeaders.
+var DefaultReverseProxyStrippedHeaders = []string{
+	"Server",
+	"Set-Cookie",
+	"X-Powered-By",
+}
+
+// IsReverseProxyStrippedHeader returns whether the given response header is
+// removed when reverse-proxying anycast requests to a peer.
+func (cfg Configuration) IsReverseProxyStrippedHeader(name string) bool {
+	stripped := cfg.ReverseProxyStrippedHeaders
+	if stripped == nil {
+		stripped = DefaultReverseProxyStrippedHeaders
+	}
+	name = http.CanonicalHeaderKey(name)
+	return slices.ContainsFunc(stripped, func(h string) bool {
+		return http.CanonicalHeaderKey(h) == name
+	})
 }
 
 var (
+	headerNameRx      = regexp.MustCompile("^[!#$%&'*+.^_`|~0-9A-Za-z-]+$") // "token" from RFC 9110, section 5.6.2
 	looksLikePEMRx    = regexp.MustCompile(`^\s*-----\s*BEGIN`)
 	stripWhitespaceRx = regexp.MustCompile(`(?m)^\s*|\s*$`)
 )
 
+// IssuerKey is a private key that keppel-api uses to sign auth tokens.
+type IssuerKey struct {
+	// ID is an optional human-readable identifier for this key. If not empty,
+	// it is put into the "kid" header of all tokens signed with this key.
+	ID         string
+	PrivateKey crypto.PrivateKey
+}
+
 // ParseIssuerKey parses the contents of the KEPPEL_ISSUER_KEY variable.
 func ParseIssuerKey(in string) (crypto.PrivateKey, error) {
 	// if it looks like PEM, it's probably PEM; otherwise it's a filename
@@ -83,60 +239,326 @@ func GetDatabaseURLFromEnvironment() (dbURL url.URL, dbName string) {
 	})), dbName
 }
 
+// GetReadReplicaDatabaseURLFromEnvironment reads the KEPPEL_DB_REPLICA_*
+// environment variables. If no read replica is configured, ok is false.
+func GetReadReplicaDatabaseURLFromEnvironment() (dbURL url.URL, ok bool) {
+	hostName := os.Getenv("KEPPEL_DB_REPLICA_HOSTNAME")
+	if hostName == "" {
+		return url.URL{}, false
+	}
+	// all settings other than the hostname and port are shared with the primary database
+	return must.Return(easypg.URLFrom(easypg.URLParts{
+		HostName:          hostName,
+		Port:              osext.GetenvOrDefault("KEPPEL_DB_REPLICA_PORT", osext.GetenvOrDefault("KEPPEL_DB_PORT", "5432")),
+		UserName:          osext.GetenvOrDefault("KEPPEL_DB_USERNAME", "postgres"),
+		Password:          os.Getenv("KEPPEL_DB_PASSWORD"),
+		ConnectionOptions: os.Getenv("KEPPEL_DB_CONNECTION_OPTIONS"),
+		DatabaseName:      osext.GetenvOrDefault("KEPPEL_DB_NAME", "keppel"),
+	})), true
+}
+
 // ParseConfiguration obtains a keppel.Configuration instance from the
 // corresponding environment variables. Aborts on error.
 func ParseConfiguration() Configuration {
+	cfg, errs := TryParseConfiguration()
+	errs.LogFatalIfError()
+	return cfg
+}
+
+// TryParseConfiguration is like ParseConfiguration, but instead of aborting on
+// the first error, it returns all errors that were encountered.
+func TryParseConfiguration() (Configuration, errext.ErrorSet) {
 	logg.Debug("parsing configuration...")
+	var errs errext.ErrorSet
 
+	apiPublicHostname, err := osext.NeedGetenv("KEPPEL_API_PUBLIC_FQDN")
+	errs.Add(err)
 	cfg := Configuration{
-		APIPublicHostname:        osext.MustGetenv("KEPPEL_API_PUBLIC_FQDN"),
-		AnycastAPIPublicHostname: os.Getenv("KEPPEL_API_ANYCAST_FQDN"),
+		APIPublicHostname:         apiPublicHostname,
+		AnycastAPIPublicHostname:  os.Getenv("KEPPEL_API_ANYCAST_FQDN"),
+		ReadOnly:                  osext.GetenvBool("KEPPEL_READ_ONLY"),
+		ReadOnlyAllowsReplication: osext.GetenvBool("KEPPEL_READ_ONLY_ALLOW_REPLICATION"),
+		TrackIssuedTokens:         osext.GetenvBool("KEPPEL_TRACK_ISSUED_TOKENS"),
 	}
 
-	parseIssuerKeys := func(prefix string) []crypto.PrivateKey {
-		key, err := ParseIssuerKey(osext.MustGetenv(prefix + "_ISSUER_KEY"))
+	parseIssuerKeys := func(prefix string) []IssuerKey {
+		keyStr, err := osext.NeedGetenv(prefix + "_ISSUER_KEY")
 		if err != nil {
-			logg.Fatal("failed to read %s_ISSUER_KEY: %s", prefix, err.Error())
+			errs.Add(err)
+			return nil
 		}
+		key, err := ParseIssuerKey(keyStr)
+		if err != nil {
+			errs.Addf("failed to read %s_ISSUER_KEY: %s", prefix, err.Error())
+			return nil
+		}
+		keyID := os.Getenv(prefix + "_ISSUER_KEY_ID")
 		prevKeyStr := os.Getenv(prefix + "_PREVIOUS_ISSUER_KEY")
 		if prevKeyStr == "" {
-			return []crypto.PrivateKey{key}
+			return []IssuerKey{{ID: keyID, PrivateKey: key}}
 		}
 		prevKey, err := ParseIssuerKey(prevKeyStr)
 		if err != nil {
-			logg.Fatal("failed to read %s_PREVIOUS_ISSUER_KEY: %s", prefix, err.Error())
+			errs.Addf("failed to read %s_PREVIOUS_ISSUER_KEY: %s", prefix, err.Error())
+			return nil
 		}
-		return []crypto.PrivateKey{key, prevKey}
+		prevKeyID := os.Getenv(prefix + "_PREVIOUS_ISSUER_KEY_ID")
+		if keyID != "" && keyID == prevKeyID {
+			errs.Addf("%s_ISSUER_KEY_ID and %s_PREVIOUS_ISSUER_KEY_ID must not be identical", prefix, prefix)
+			return nil
+		}
+		return []IssuerKey{{ID: keyID, PrivateKey: key}, {ID: prevKeyID, PrivateKey: prevKey}}
 	}
 
+	cfg.DigestAlgorithms, err = parseDigestAlgorithms(osext.GetenvOrDefault("KEPPEL_DIGEST_ALGORITHMS", string(digest.Canonical)))
+	errs.Add(err)
+
+	cfg.ReverseProxyForwardedHeaders, err = parseForwardedHeaderNames("KEPPEL_ANYCAST_FORWARDED_HEADERS")
+	errs.Add(err)
+	cfg.ReverseProxyStrippedHeaders, err = parseHeaderNames("KEPPEL_ANYCAST_STRIPPED_HEADERS")
+	errs.Add(err)
+
+	cfg.UpstreamConnectionPool, err = parseConnectionPoolConfig("KEPPEL_UPSTREAM")
+	errs.Add(err)
+	cfg.DBConnectionPool, err = parseDBConnectionPoolConfig()
+	errs.Add(err)
+
+	maxScopesStr := osext.GetenvOrDefault("KEPPEL_MAX_SCOPES_PER_TOKEN", strconv.Itoa(DefaultMaxScopesPerToken))
+	maxScopes, err := strconv.ParseUint(maxScopesStr, 10, 16)
+	if err != nil || maxScopes == 0 {
+		errs.Addf("malformed KEPPEL_MAX_SCOPES_PER_TOKEN: %q is not a positive integer", maxScopesStr)
+	} else {
+		cfg.MaxScopesPerToken = int(maxScopes)
+	}
+
+	maxDepthStr := osext.GetenvOrDefault("KEPPEL_MAX_MANIFEST_REFERENCE_DEPTH", strconv.Itoa(DefaultMaxManifestReferenceDepth))
+	maxDepth, err := strconv.ParseUint(maxDepthStr, 10, 16)
+	if err != nil || maxDepth == 0 {
+		errs.Addf("malformed KEPPEL_MAX_MANIFEST_REFERENCE_DEPTH: %q is not a positive integer", maxDepthStr)
+	} else {
+		cfg.MaxManifestReferenceDepth = int(maxDepth)
+	}
+
+	jitterFractionStr := osext.GetenvOrDefault("KEPPEL_JANITOR_JITTER_FRACTION", strconv.FormatFloat(DefaultJanitorJitterFraction, 'f', -1, 64))
+	jitterFraction, err := strconv.ParseFloat(jitterFractionStr, 64)
+	if err != nil || math.IsNaN(jitterFraction) || jitterFraction < 0 || jitterFraction > 1 {
+		errs.Addf("malformed KEPPEL_JANITOR_JITTER_FRACTION: %q is not a number between 0 and 1", jitterFractionStr)
+	} else {
+		cfg.JanitorJitterFraction = jitterFraction
+	}
+
+	cfg.DefaultBlobMediaType = osext.GetenvOrDefault("KEPPEL_DEFAULT_BLOB_MEDIA_TYPE", models.DefaultBlobMediaType)
+	_, _, err = mime.ParseMediaType(cfg.DefaultBlobMediaType)
+	if err != nil {
+		errs.Addf("malformed KEPPEL_DEFAULT_BLOB_MEDIA_TYPE: %q is not a valid media type", cfg.DefaultBlobMediaType)
+	}
+
+	cfg.OpaqueManifestMediaTypes, err = parseOpaqueManifestMediaTypes(os.Getenv("KEPPEL_OPAQUE_MANIFEST_MEDIA_TYPES"))
+	errs.Add(err)
+
+	cfg.PeerHostNames, err = parsePeerHostNames(osext.GetenvOrDefault("KEPPEL_PEERS", "[]"))
+	errs.Add(err)
+
 	cfg.JWTIssuerKeys = parseIssuerKeys("KEPPEL")
 	if cfg.AnycastAPIPublicHostname != "" {
 		cfg.AnycastJWTIssuerKeys = parseIssuerKeys("KEPPEL_ANYCAST")
 	}
 
-	trivyURL := mayGetenvURL("KEPPEL_TRIVY_URL")
+	trivyURL, err := mayGetenvURL("KEPPEL_TRIVY_URL")
+	errs.Add(err)
 	if trivyURL != nil {
 		additionalPullableRepos := strings.Split(os.Getenv("KEPPEL_TRIVY_ADDITIONAL_PULLABLE_REPOS"), ",")
+		token, err := osext.NeedGetenv("KEPPEL_TRIVY_TOKEN")
+		errs.Add(err)
 		cfg.Trivy = &trivy.Config{
 			AdditionalPullableRepos: additionalPullableRepos,
-			Token:                   osext.MustGetenv("KEPPEL_TRIVY_TOKEN"),
+			Token:                   token,
 			URL:                     *trivyURL,
 		}
 	}
 
-	return cfg
+	return cfg, errs
+}
+
+func parseOpaqueManifestMediaTypes(in string) ([]string, error) {
+	var result []string
+	for _, field := range strings.Split(in, ",") {
+		mediaType := strings.TrimSpace(field)
+		if mediaType == "" {
+			continue
+		}
+		_, _, err := mime.ParseMediaType(mediaType)
+		if err != nil {
+			return nil, fmt.Errorf("malformed KEPPEL_OPAQUE_MANIFEST_MEDIA_TYPES: %q is not a valid media type", mediaType)
+		}
+		if IsKnownManifestMediaType(mediaType) {
+			return nil, fmt.Errorf("malformed KEPPEL_OPAQUE_MANIFEST_MEDIA_TYPES: %q is not an opaque media type", mediaType)
+		}
+		if !slices.Contains(result, mediaType) {
+			result = append(result, mediaType)
+		}
+	}
+	return result, nil
+}
+
+func parseDigestAlgorithms(in string) ([]digest.Algorithm, error) {
+	var result []digest.Algorithm
+	for _, field := range strings.Split(in, ",") {
+		algo := digest.Algorithm(strings.TrimSpace(field))
+		if algo == "" {
+			continue
+		}
+		if !algo.Available() {
+			return nil, fmt.Errorf("malformed KEPPEL_DIGEST_ALGORITHMS: unsupported digest algorithm %q", algo)
+		}
+		if !slices.Contains(result, algo) {
+			result = append(result, algo)
+		}
+	}
+	// tag pushes always produce digests using the canonical algorithm, so we cannot do without it
+	if !slices.Contains(result, digest.Canonical) {
+		return nil, fmt.Errorf("malformed KEPPEL_DIGEST_ALGORITHMS: must include %q", digest.Canonical)
+	}
+	return result, nil
+}
+
+// parseHeaderNames parses a comma-separated list of HTTP header names from the
+// given environment variable. If the variable is unset, nil is returned. If it
+// is set, but empty, a non-nil empty list is returned.
+func parseHeaderNames(key string) ([]string, error) {
+	val, exists := os.LookupEnv(key)
+	if !exists {
+		return nil, nil
+	}
+	result := []string{}
+	for _, field := range strings.Split(val, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if !headerNameRx.MatchString(field) {
+			return nil, fmt.Errorf("malformed %s: invalid header name %q", key, field)
+		}
+		result = append(result, field)
+	}
+	return result, nil
+}
+
+// parseForwardedHeaderNames works like parseHeaderNames, but also rejects
+// headers that ReverseProxyAnycastRequestToPeer cannot forward.
+func parseForwardedHeaderNames(key string) ([]string, error) {
+	names, err := parseHeaderNames(key)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		// outgoing requests always carry our own User-Agent (see userAgentRoundTripper)
+		if http.CanonicalHeaderKey(name) == "User-Agent" {
+			return nil, fmt.Errorf("malformed %s: the %q header cannot be forwarded", key, name)
+		}
+	}
+	return names, nil
+}
+
+// parseConnectionPoolConfig reads a ConnectionPoolConfig from the environment
+// variables with the given prefix.
+func parseConnectionPoolConfig(prefix string) (ConnectionPoolConfig, error) {
+	result := ConnectionPoolConfig{
+		DisableKeepAlives: osext.GetenvBool(prefix + "_DISABLE_KEEPALIVES"),
+	}
+
+	key := prefix + "_MAX_IDLE_CONNS_PER_HOST"
+	val := osext.GetenvOrDefault(key, "16")
+	maxIdleConns, err := strconv.ParseUint(val, 10, 16)
+	if err != nil {
+		return ConnectionPoolConfig{}, fmt.Errorf("malformed %s: %q is not a non-negative integer", key, val)
+	}
+	result.MaxIdleConnsPerHost = int(maxIdleConns)
+
+	key = prefix + "_IDLE_CONN_TIMEOUT"
+	val = osext.GetenvOrDefault(key, "90s")
+	result.IdleConnTimeout, err = time.ParseDuration(val)
+	if err != nil || result.IdleConnTimeout < 0 {
+		return ConnectionPoolConfig{}, fmt.Errorf("malformed %s: %q is not a valid duration", key, val)
+	}
+
+	return result, nil
+}
+
+// parseDBConnectionPoolConfig reads a DBConnectionPoolConfig from the
+// KEPPEL_DB_* environment variables.
+func parseDBConnectionPoolConfig() (DBConnectionPoolConfig, error) {
+	var result DBConnectionPoolConfig
+
+	key := "KEPPEL_DB_MAX_OPEN_CONNS"
+	val := osext.GetenvOrDefault(key, strconv.Itoa(DefaultDBMaxOpenConns))
+	maxOpenConns, err := strconv.ParseUint(val, 10, 16)
+	if err != nil || maxOpenConns == 0 {
+		return DBConnectionPoolConfig{}, fmt.Errorf("malformed %s: %q is not a positive integer", key, val)
+	}
+	result.MaxOpenConns = int(maxOpenConns)
+
+	key = "KEPPEL_DB_MAX_IDLE_CONNS"
+	val = osext.GetenvOrDefault(key, strconv.Itoa(DefaultDBMaxIdleConns))
+	maxIdleConns, err := strconv.ParseUint(val, 10, 16)
+	if err != nil {
+		return DBConnectionPoolConfig{}, fmt.Errorf("malformed %s: %q is not a non-negative integer", key, val)
+	}
+	result.MaxIdleConns = int(maxIdleConns)
+
+	key = "KEPPEL_DB_CONN_MAX_LIFETIME"
+	val = osext.GetenvOrDefault(key, "0s")
+	result.ConnMaxLifetime, err = time.ParseDuration(val)
+	if err != nil || result.ConnMaxLifetime < 0 {
+		return DBConnectionPoolConfig{}, fmt.Errorf("malformed %s: %q is not a valid duration", key, val)
+	}
+
+	return result, nil
+}
+
+// PeerConfig is an entry in the KEPPEL_PEERS configuration variable.
+type PeerConfig struct {
+	Hostname             string `json:"hostname"`
+	UseForPullDelegation *bool  `json:"use_for_pull_delegation"`
+}
+
+// ParsePeersConfiguration parses the contents of the KEPPEL_PEERS variable.
+func ParsePeersConfiguration(in string) ([]PeerConfig, error) {
+	var peers []PeerConfig
+	decoder := json.NewDecoder(strings.NewReader(in))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&peers)
+	if err != nil {
+		return nil, fmt.Errorf("malformed KEPPEL_PEERS: %w", err)
+	}
+	return peers, nil
+}
+
+// parsePeerHostNames extracts the hostnames from KEPPEL_PEERS.
+func parsePeerHostNames(in string) ([]string, error) {
+	peers, err := ParsePeersConfiguration(in)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]string, 0, len(peers))
+	for _, peer := range peers {
+		if peer.Hostname != "" {
+			result = append(result, peer.Hostname)
+		}
+	}
+	return result, nil
 }
 
-func mayGetenvURL(key string) *url.URL {
+func mayGetenvURL(key string) (*url.URL, error) {
 	val := os.Getenv(key)
 	if val == "" {
-		return nil
+		return nil, nil
 	}
 	parsed, err := url.Parse(val)
 	if err != nil {
-		logg.Fatal("malformed %s: %s", key, err.Error())
+		return nil, fmt.Errorf("malformed %s: %s", key, err.Error())
 	}
-	return parsed
+	return parsed, nil
 }
 
 // GetRedisOptions returns a redis.Options by getting the required parameters
@@ -0,0 +1,27 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package keppel
+
+import (
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+
+	"github.com/sapcc/keppel/internal/models"
+)
+
+func TestBlobMediaType(t *testing.T) {
+	knownBlob := models.Blob{MediaType: "application/vnd.oci.image.layer.v1.tar+gzip"}
+	unknownBlob := models.Blob{}
+
+	// without explicit configuration, the fallback is application/octet-stream
+	var cfg Configuration
+	assert.DeepEqual(t, "media type of known blob", cfg.BlobMediaType(knownBlob), knownBlob.MediaType)
+	assert.DeepEqual(t, "media type of unknown blob", cfg.BlobMediaType(unknownBlob), "application/octet-stream")
+
+	// the configured fallback only applies to blobs without a recorded media type
+	cfg.DefaultBlobMediaType = "application/vnd.oci.image.layer.v1.tar"
+	assert.DeepEqual(t, "media type of known blob", cfg.BlobMediaType(knownBlob), knownBlob.MediaType)
+	assert.DeepEqual(t, "media type of unknown blob", cfg.BlobMediaType(unknownBlob), cfg.DefaultBlobMediaType)
+}
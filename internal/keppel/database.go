@@ -5,6 +5,10 @@ package keppel
 
 import (
 	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
 
 	"github.com/go-gorp/gorp/v3"
 	"github.com/sapcc/go-bits/easypg"
@@ -427,11 +431,152 @@ var sqlMigrations = map[string]string{
 			ALTER COLUMN next_check_at SET NOT NULL,
 			DROP CONSTRAINT next_check_at_only_null_when_rotten;
 	`,
+	"054_add_accounts_is_read_only.up.sql": `
+		ALTER TABLE accounts ADD COLUMN is_read_only BOOLEAN NOT NULL DEFAULT FALSE;
+	`,
+	"054_add_accounts_is_read_only.down.sql": `
+		ALTER TABLE accounts DROP COLUMN is_read_only;
+	`,
+	"055_add_accounts_labels_json.up.sql": `
+		ALTER TABLE accounts ADD COLUMN labels_json TEXT NOT NULL DEFAULT '';
+	`,
+	"055_add_accounts_labels_json.down.sql": `
+		ALTER TABLE accounts DROP COLUMN labels_json;
+	`,
+	"056_add_manifest_cache_ttl.up.sql": `
+		ALTER TABLE accounts ADD COLUMN manifest_cache_ttl_secs BIGINT NOT NULL DEFAULT 0;
+		ALTER TABLE tags ADD COLUMN last_refreshed_at TIMESTAMPTZ DEFAULT NULL;
+	`,
+	"056_add_manifest_cache_ttl.down.sql": `
+		ALTER TABLE accounts DROP COLUMN manifest_cache_ttl_secs;
+		ALTER TABLE tags DROP COLUMN last_refreshed_at;
+	`,
+	"057_add_tag_pins.up.sql": `
+		CREATE TABLE tag_pins (
+			repo_id   BIGINT      NOT NULL,
+			name      TEXT        NOT NULL,
+			pinned_at TIMESTAMPTZ NOT NULL,
+			pinned_by TEXT        NOT NULL DEFAULT '',
+			PRIMARY KEY (repo_id, name),
+			FOREIGN KEY (repo_id, name) REFERENCES tags ON DELETE CASCADE
+		);
+	`,
+	"057_add_tag_pins.down.sql": `
+		DROP TABLE tag_pins;
+	`,
+	"058_add_manifest_trash.up.sql": `
+		ALTER TABLE accounts ADD COLUMN manifest_trash_retention_secs BIGINT NOT NULL DEFAULT 0;
+		ALTER TABLE manifests ADD COLUMN deleted_at TIMESTAMPTZ DEFAULT NULL;
+		ALTER TABLE manifests ADD COLUMN deleted_tags_json TEXT NOT NULL DEFAULT '';
+	`,
+	"058_add_manifest_trash.down.sql": `
+		DELETE FROM manifests WHERE deleted_at IS NOT NULL;
+		ALTER TABLE accounts DROP COLUMN manifest_trash_retention_secs;
+		ALTER TABLE manifests DROP COLUMN deleted_at;
+		ALTER TABLE manifests DROP COLUMN deleted_tags_json;
+	`,
+	"059_add_manifest_artifact_type_index.up.sql": `
+		CREATE INDEX ON manifests (repo_id, artifact_type) WHERE artifact_type != '';
+	`,
+	"059_add_manifest_artifact_type_index.down.sql": `
+		DROP INDEX manifests_repo_id_artifact_type_idx;
+	`,
+	"060_add_accounts_strict_media_types.up.sql": `
+		ALTER TABLE accounts ADD COLUMN strict_media_types BOOLEAN NOT NULL DEFAULT FALSE;
+	`,
+	"060_add_accounts_strict_media_types.down.sql": `
+		ALTER TABLE accounts DROP COLUMN strict_media_types;
+	`,
+	"061_add_accounts_validate_on_push.up.sql": `
+		ALTER TABLE accounts ADD COLUMN validate_on_push BOOLEAN NOT NULL DEFAULT FALSE;
+	`,
+	"061_add_accounts_validate_on_push.down.sql": `
+		ALTER TABLE accounts DROP COLUMN validate_on_push;
+	`,
+	"062_add_integrity_reports.up.sql": `
+		ALTER TABLE blobs ADD COLUMN last_validated_at TIMESTAMPTZ DEFAULT NULL;
+		ALTER TABLE manifests ADD COLUMN last_validated_at TIMESTAMPTZ DEFAULT NULL;
+		ALTER TABLE accounts ADD COLUMN next_integrity_report_at TIMESTAMPTZ DEFAULT NULL;
+		CREATE TABLE integrity_reports (
+			account_name        TEXT        NOT NULL PRIMARY KEY REFERENCES accounts ON DELETE CASCADE,
+			created_at          TIMESTAMPTZ NOT NULL,
+			validated_blobs     BIGINT      NOT NULL,
+			failed_blobs        BIGINT      NOT NULL,
+			validated_manifests BIGINT      NOT NULL,
+			failed_manifests    BIGINT      NOT NULL
+		);
+	`,
+	"062_add_integrity_reports.down.sql": `
+		DROP TABLE integrity_reports;
+		ALTER TABLE accounts DROP COLUMN next_integrity_report_at;
+		ALTER TABLE manifests DROP COLUMN last_validated_at;
+		ALTER TABLE blobs DROP COLUMN last_validated_at;
+	`,
+	"063_add_accounts_is_creating.up.sql": `
+		ALTER TABLE accounts ADD COLUMN is_creating BOOLEAN NOT NULL DEFAULT FALSE;
+	`,
+	"063_add_accounts_is_creating.down.sql": `
+		ALTER TABLE accounts DROP COLUMN is_creating;
+	`,
+	"064_add_accounts_is_pull_disabled_and_is_push_disabled.up.sql": `
+		ALTER TABLE accounts
+			ADD COLUMN is_pull_disabled BOOLEAN NOT NULL DEFAULT FALSE,
+			ADD COLUMN is_push_disabled BOOLEAN NOT NULL DEFAULT FALSE;
+	`,
+	"064_add_accounts_is_pull_disabled_and_is_push_disabled.down.sql": `
+		ALTER TABLE accounts
+			DROP COLUMN is_pull_disabled,
+			DROP COLUMN is_push_disabled;
+	`,
+	"065_add_issued_tokens.up.sql": `
+		CREATE TABLE issued_tokens (
+			id             TEXT        NOT NULL,
+			auth_tenant_id TEXT        NOT NULL,
+			user_name      TEXT        NOT NULL,
+			scopes         TEXT        NOT NULL,
+			issued_at      TIMESTAMPTZ NOT NULL,
+			expires_at     TIMESTAMPTZ NOT NULL,
+			revoked_at     TIMESTAMPTZ DEFAULT NULL,
+			PRIMARY KEY (id, auth_tenant_id)
+		);
+		CREATE INDEX issued_tokens_auth_tenant_id_idx ON issued_tokens (auth_tenant_id);
+	`,
+	"065_add_issued_tokens.down.sql": `
+		DROP TABLE issued_tokens;
+	`,
+	"066_add_accounts_is_anycast_disabled.up.sql": `
+		ALTER TABLE accounts ADD COLUMN is_anycast_disabled BOOLEAN NOT NULL DEFAULT FALSE;
+	`,
+	"066_add_accounts_is_anycast_disabled.down.sql": `
+		ALTER TABLE accounts DROP COLUMN is_anycast_disabled;
+	`,
+	"067_add_accounts_creation_started_at.up.sql": `
+		ALTER TABLE accounts ADD COLUMN creation_started_at TIMESTAMPTZ DEFAULT NULL;
+	`,
+	"067_add_accounts_creation_started_at.down.sql": `
+		ALTER TABLE accounts DROP COLUMN creation_started_at;
+	`,
+	"068_add_blobs_next_media_type_backfill_at.up.sql": `
+		ALTER TABLE blobs ADD COLUMN next_media_type_backfill_at TIMESTAMPTZ DEFAULT NULL;
+		UPDATE blobs SET next_media_type_backfill_at = NOW() WHERE media_type = '';
+		CREATE INDEX blobs_next_media_type_backfill_at_idx ON blobs (next_media_type_backfill_at) WHERE media_type = '' AND next_media_type_backfill_at IS NOT NULL;
+	`,
+	"068_add_blobs_next_media_type_backfill_at.down.sql": `
+		ALTER TABLE blobs DROP COLUMN next_media_type_backfill_at;
+	`,
+	"069_add_repos_catalog_order_idx.up.sql": `
+		CREATE INDEX repos_catalog_order_idx ON repos (account_name COLLATE "C", name COLLATE "C");
+	`,
+	"069_add_repos_catalog_order_idx.down.sql": `
+		DROP INDEX repos_catalog_order_idx;
+	`,
 }
 
 // DB adds convenience functions on top of gorp.DbMap.
 type DB struct {
 	gorp.DbMap
+	// readReplica is nil if no read replica is configured.
+	readReplica *gorp.DbMap
 }
 
 // SelectBool is analogous to the other SelectFoo() functions from gorp.DbMap
@@ -449,26 +594,128 @@ func DBConfiguration() easypg.Configuration {
 	}
 }
 
+const (
+	// DefaultDBMaxOpenConns is the default for DBConnectionPoolConfig.MaxOpenConns.
+	DefaultDBMaxOpenConns = 16
+	// DefaultDBMaxIdleConns is the default for DBConnectionPoolConfig.MaxIdleConns.
+	// This is the same default that package database/sql uses.
+	DefaultDBMaxIdleConns = 2
+)
+
+// DBConnectionPoolConfig contains tuning parameters for the connection pool of a sql.DB.
+type DBConnectionPoolConfig struct {
+	// MaxOpenConns is the maximum number of open connections to the database.
+	MaxOpenConns int
+	// MaxIdleConns is the maximum number of idle connections that are kept
+	// open for reuse. If zero, idle connections are closed immediately.
+	MaxIdleConns int
+	// ConnMaxLifetime is how long a connection may be reused. If zero,
+	// connections are reused indefinitely.
+	ConnMaxLifetime time.Duration
+}
+
+// ApplyTo configures the connection pool of the given database connection.
+func (c DBConnectionPoolConfig) ApplyTo(dbConn *sql.DB) {
+	dbConn.SetMaxOpenConns(c.MaxOpenConns)
+	dbConn.SetMaxIdleConns(c.MaxIdleConns)
+	dbConn.SetConnMaxLifetime(c.ConnMaxLifetime)
+}
+
 // InitORM wraps a database connection into a gorp.DbMap instance.
+//
+// The connection pool is limited to DefaultDBMaxOpenConns. Callers that want
+// to use different settings should call DBConnectionPoolConfig.ApplyTo()
+// afterwards.
 func InitORM(dbConn *sql.DB) *DB {
 	// ensure that this process does not starve other Keppel processes for DB connections
-	dbConn.SetMaxOpenConns(16)
+	dbConn.SetMaxOpenConns(DefaultDBMaxOpenConns)
 
 	result := &DB{DbMap: gorp.DbMap{Db: dbConn, Dialect: gorp.PostgresDialect{}}}
-	result.DbMap.AddTableWithName(models.Account{}, "accounts").SetKeys(false, "name")
-	result.DbMap.AddTableWithName(models.Blob{}, "blobs").SetKeys(true, "id")
-	result.DbMap.AddTableWithName(models.Upload{}, "uploads").SetKeys(false, "repo_id", "uuid")
-	result.DbMap.AddTableWithName(models.Repository{}, "repos").SetKeys(true, "id")
-	result.DbMap.AddTableWithName(models.Manifest{}, "manifests").SetKeys(false, "repo_id", "digest")
-	result.DbMap.AddTableWithName(models.Tag{}, "tags").SetKeys(false, "repo_id", "name")
-	result.DbMap.AddTableWithName(models.ManifestContent{}, "manifest_contents").SetKeys(false, "repo_id", "digest")
-	result.DbMap.AddTableWithName(models.Quotas{}, "quotas").SetKeys(false, "auth_tenant_id")
-	result.DbMap.AddTableWithName(models.Peer{}, "peers").SetKeys(false, "hostname")
-	result.DbMap.AddTableWithName(models.PendingBlob{}, "pending_blobs").SetKeys(false, "account_name", "digest")
-	result.DbMap.AddTableWithName(models.UnknownBlob{}, "unknown_blobs").SetKeys(false, "account_name", "storage_id")
-	result.DbMap.AddTableWithName(models.UnknownManifest{}, "unknown_manifests").SetKeys(false, "account_name", "repo_name", "digest")
-	result.DbMap.AddTableWithName(models.UnknownTrivyReport{}, "unknown_trivy_reports").SetKeys(false, "account_name", "repo_name", "digest", "format")
-	result.DbMap.AddTableWithName(models.TrivySecurityInfo{}, "trivy_security_info").SetKeys(false, "repo_id", "digest")
-
+	addTablesTo(&result.DbMap)
 	return result
 }
+
+// ConnectToReadReplica opens a connection to a read replica of the database.
+// Unlike easypg.Connect(), this does not run any migrations, since the read
+// replica obtains its schema from the primary database.
+func ConnectToReadReplica(dbURL url.URL) (*sql.DB, error) {
+	dbConn, err := sql.Open("postgres", dbURL.String())
+	if err == nil {
+		err = dbConn.Ping()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to read replica of database: %w", err)
+	}
+	return dbConn, nil
+}
+
+// WithReadReplica adds a connection to a read replica of the database. This
+// connection will be used by ReadReplica().
+func (db *DB) WithReadReplica(replicaConn *sql.DB) *DB {
+	replicaConn.SetMaxOpenConns(DefaultDBMaxOpenConns)
+
+	db.readReplica = &gorp.DbMap{Db: replicaConn, Dialect: gorp.PostgresDialect{}}
+	addTablesTo(db.readReplica)
+	return db
+}
+
+// ReadReplica returns an executor for read-only queries that tolerate
+// replication lag, i.e. queries that do not need to observe writes that were
+// only just performed on the primary. If no read replica is configured, the
+// primary database is used instead.
+func (db *DB) ReadReplica() ReadOnlyExecutor {
+	if db.readReplica == nil {
+		return &db.DbMap
+	}
+	return readReplicaExecutor{db.readReplica}
+}
+
+// ReadOnlyExecutor is the type returned by DB.ReadReplica(). It can be used
+// both with gorp-style helper functions and with package sqlext.
+type ReadOnlyExecutor interface {
+	gorp.SqlExecutor
+	Prepare(query string) (*sql.Stmt, error)
+}
+
+// readReplicaExecutor is what DB.ReadReplica() returns if there is a read replica.
+// This type allows FindAccount() etc. to recognize queries on the read replica,
+// whose results must not be put in the account cache: The cache is shared with
+// queries on the primary database, which must not observe stale results.
+type readReplicaExecutor struct {
+	*gorp.DbMap
+}
+
+// SelectOneFromReplica is like db.SelectOne(), but the query is executed on
+// the read replica if there is one. If the read replica does not have a
+// matching row, the query is repeated on the primary database since the row
+// might just have been written there.
+func (db *DB) SelectOneFromReplica(holder any, query string, args ...any) error {
+	if db.readReplica == nil {
+		return db.SelectOne(holder, query, args...)
+	}
+	err := db.readReplica.SelectOne(holder, query, args...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return db.SelectOne(holder, query, args...)
+	}
+	return err
+}
+
+func addTablesTo(dbMap *gorp.DbMap) {
+	dbMap.AddTableWithName(models.Account{}, "accounts").SetKeys(false, "name")
+	dbMap.AddTableWithName(models.Blob{}, "blobs").SetKeys(true, "id")
+	dbMap.AddTableWithName(models.Upload{}, "uploads").SetKeys(false, "repo_id", "uuid")
+	dbMap.AddTableWithName(models.Repository{}, "repos").SetKeys(true, "id")
+	dbMap.AddTableWithName(models.Manifest{}, "manifests").SetKeys(false, "repo_id", "digest")
+	dbMap.AddTableWithName(models.Tag{}, "tags").SetKeys(false, "repo_id", "name")
+	dbMap.AddTableWithName(models.TagPin{}, "tag_pins").SetKeys(false, "repo_id", "name")
+	dbMap.AddTableWithName(models.ManifestContent{}, "manifest_contents").SetKeys(false, "repo_id", "digest")
+	dbMap.AddTableWithName(models.Quotas{}, "quotas").SetKeys(false, "auth_tenant_id")
+	dbMap.AddTableWithName(models.Peer{}, "peers").SetKeys(false, "hostname")
+	dbMap.AddTableWithName(models.PendingBlob{}, "pending_blobs").SetKeys(false, "account_name", "digest")
+	dbMap.AddTableWithName(models.IntegrityReport{}, "integrity_reports").SetKeys(false, "account_name")
+	dbMap.AddTableWithName(models.UnknownBlob{}, "unknown_blobs").SetKeys(false, "account_name", "storage_id")
+	dbMap.AddTableWithName(models.UnknownManifest{}, "unknown_manifests").SetKeys(false, "account_name", "repo_name", "digest")
+	dbMap.AddTableWithName(models.UnknownTrivyReport{}, "unknown_trivy_reports").SetKeys(false, "account_name", "repo_name", "digest", "format")
+	dbMap.AddTableWithName(models.TrivySecurityInfo{}, "trivy_security_info").SetKeys(false, "repo_id", "digest")
+	dbMap.AddTableWithName(models.IssuedToken{}, "issued_tokens").SetKeys(false, "id", "auth_tenant_id")
+}
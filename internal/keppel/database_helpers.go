@@ -4,8 +4,10 @@
 package keppel
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"time"
 
 	"github.com/go-gorp/gorp/v3"
 	"github.com/opencontainers/go-digest"
@@ -14,44 +16,92 @@ import (
 	"github.com/sapcc/keppel/internal/models"
 )
 
+const accountGetByNameQuery = `SELECT * FROM accounts WHERE name = $1`
+
 // FindAccount works similar to db.SelectOne(), but returns nil instead of
 // sql.ErrNoRows if no account exists with this name.
-func FindAccount(db gorp.SqlExecutor, name models.AccountName) (*models.Account, error) {
+//
+// If the context was prepared with WithAccountCache(), the result is cached.
+func FindAccount(ctx context.Context, db gorp.SqlExecutor, name models.AccountName) (*models.Account, error) {
+	cache := getAccountCache(ctx, db)
+	entry, exists := cache.get(name)
+	if exists && (entry.Account != nil || entry.ReducedAccount == nil) {
+		return entry.cloneAccount(), nil
+	}
+
 	var account models.Account
-	err := db.SelectOne(&account, "SELECT * FROM accounts WHERE name = $1", name)
+	startedAt := time.Now()
+	err := db.SelectOne(&account, accountGetByNameQuery, name)
+	ObserveQueryDuration("account_get_by_name", startedAt)
 	if errors.Is(err, sql.ErrNoRows) {
+		cache.put(name, accountCacheEntry{})
 		return nil, nil
 	}
+	if err == nil {
+		reduced := account.Reduced()
+		entry = accountCacheEntry{Account: &account, ReducedAccount: &reduced}
+		cache.put(name, entry)
+		return entry.cloneAccount(), nil
+	}
 	return &account, err
 }
 
 var reducedAccountGetByNameQuery = sqlext.SimplifyWhitespace(`
 	SELECT auth_tenant_id, upstream_peer_hostname,
 	       external_peer_url, external_peer_username, external_peer_password,
-	       platform_filter, rule_for_manifest, is_deleting
+	       platform_filter, manifest_cache_ttl_secs, manifest_trash_retention_secs,
+	       rule_for_manifest, strict_media_types, validate_on_push, is_creating, is_deleting, is_read_only,
+	       is_pull_disabled, is_push_disabled, is_anycast_disabled, rbac_policies_json
 	  FROM accounts
 	 WHERE name = $1
 `)
 
 // FindReducedAccount is like FindAccount, but it returns a ReducedAccount instead.
 // This can be significantly faster than FindAccount if only the most common stuff is needed.
-func FindReducedAccount(db gorp.SqlExecutor, name models.AccountName) (*models.ReducedAccount, error) {
+func FindReducedAccount(ctx context.Context, db gorp.SqlExecutor, name models.AccountName) (*models.ReducedAccount, error) {
+	cache := getAccountCache(ctx, db)
+	entry, exists := cache.get(name)
+	if exists {
+		return entry.cloneReducedAccount(), nil
+	}
+
 	a := models.ReducedAccount{Name: name}
+	startedAt := time.Now()
 	err := db.QueryRow(reducedAccountGetByNameQuery, name).Scan(
 		&a.AuthTenantID, &a.UpstreamPeerHostName,
 		&a.ExternalPeerURL, &a.ExternalPeerUserName, &a.ExternalPeerPassword,
-		&a.PlatformFilter, &a.RuleForManifest, &a.IsDeleting,
+		&a.PlatformFilter, &a.ManifestCacheTTLSecs, &a.ManifestTrashRetentionSecs,
+		&a.RuleForManifest, &a.StrictMediaTypes, &a.ValidateOnPush, &a.IsCreating, &a.IsDeleting, &a.IsReadOnly,
+		&a.IsPullDisabled, &a.IsPushDisabled, &a.IsAnycastDisabled, &a.RBACPoliciesJSON,
 	)
+	ObserveQueryDuration("reduced_account_get_by_name", startedAt)
 	if errors.Is(err, sql.ErrNoRows) {
+		cache.put(name, accountCacheEntry{})
 		return nil, nil
 	}
+	if err == nil {
+		entry = accountCacheEntry{ReducedAccount: &a}
+		cache.put(name, entry)
+		return entry.cloneReducedAccount(), nil
+	}
 	return &a, err
 }
 
+const accountExistsQuery = `SELECT COUNT(*) FROM accounts WHERE name = $1`
+
 // DoesAccountExist checks if an account with the given name exists in the DB.
-func DoesAccountExist(db gorp.SqlExecutor, name models.AccountName) (bool, error) {
+func DoesAccountExist(ctx context.Context, db gorp.SqlExecutor, name models.AccountName) (bool, error) {
+	// if we are caching, load the account right away since the caller is likely
+	// to need it later on
+	if getAccountCache(ctx, db) != nil {
+		account, err := FindReducedAccount(ctx, db, name)
+		return account != nil, err
+	}
+
 	var count uint64
-	err := db.QueryRow(`SELECT COUNT(*) FROM accounts WHERE name = $1`, name).Scan(&count)
+	startedAt := time.Now()
+	err := db.QueryRow(accountExistsQuery, name).Scan(&count)
+	ObserveQueryDuration("account_exists", startedAt)
 	return count > 0, err
 }
 
@@ -87,7 +137,9 @@ func FindBlobByRepositoryName(db gorp.SqlExecutor, blobDigest digest.Digest, rep
 // the blob in question does not exist, sql.ErrNoRows is returned.
 func FindBlobByRepository(db gorp.SqlExecutor, blobDigest digest.Digest, repo models.Repository) (*models.Blob, error) {
 	var blob models.Blob
+	startedAt := time.Now()
 	err := db.SelectOne(&blob, blobGetQueryByRepoID, repo.AccountName, blobDigest.String(), repo.ID)
+	ObserveQueryDuration("blob_get_by_repo_id", startedAt)
 	return &blob, err
 }
 
@@ -0,0 +1,55 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package keppel
+
+import (
+	"slices"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var dbQueryDurationHistogram = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "keppel_db_query_duration_seconds",
+		Help:    "Time taken to execute frequently used database queries.",
+		Buckets: prometheus.DefBuckets,
+	},
+	[]string{"query"},
+)
+
+// instrumentedQueryNames contains all values for the "query" label of
+// keppel_db_query_duration_seconds. Each name refers to one query constant.
+var instrumentedQueryNames = []string{
+	"account_exists",
+	"account_get_by_name",
+	"blob_get_by_repo_id",
+	"catalog_get_max_repo_id",
+	"catalog_get_page",
+	"manifest_content_get",
+	"manifest_get_by_repo_id",
+	"reduced_account_get_by_name",
+	"tag_digest_get",
+	"tags_list",
+}
+
+func init() {
+	prometheus.MustRegister(dbQueryDurationHistogram)
+	// initialize all series, so that queries that were not executed yet show up as zero
+	for _, queryName := range instrumentedQueryNames {
+		dbQueryDurationHistogram.WithLabelValues(queryName)
+	}
+	dbQueryDurationHistogram.WithLabelValues("other")
+}
+
+// ObserveQueryDuration records the execution time of the query with the given
+// name in the keppel_db_query_duration_seconds metric. To keep the label
+// cardinality bounded, names that are not listed in instrumentedQueryNames are
+// reported as "other".
+func ObserveQueryDuration(queryName string, startedAt time.Time) {
+	if !slices.Contains(instrumentedQueryNames, queryName) {
+		queryName = "other"
+	}
+	dbQueryDurationHistogram.WithLabelValues(queryName).Observe(time.Since(startedAt).Seconds())
+}
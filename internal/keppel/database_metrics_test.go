@@ -0,0 +1,74 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package keppel
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/go-gorp/gorp/v3"
+	"github.com/opencontainers/go-digest"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/sapcc/go-bits/assert"
+
+	"github.com/sapcc/keppel/internal/models"
+)
+
+// emptyTestExecutor behaves like a database without any rows. All methods
+// except SelectOne() panic when called.
+type emptyTestExecutor struct {
+	gorp.SqlExecutor
+}
+
+func (emptyTestExecutor) SelectOne(holder any, query string, args ...any) error {
+	return sql.ErrNoRows
+}
+
+func TestDBQueryMetrics(t *testing.T) {
+	getObservationCount := func(queryName string) uint64 {
+		t.Helper()
+		var m dto.Metric
+		err := dbQueryDurationHistogram.WithLabelValues(queryName).(prometheus.Histogram).Write(&m)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return m.GetHistogram().GetSampleCount()
+	}
+	expectObservations := func(queryName string, action func()) {
+		t.Helper()
+		countBefore := getObservationCount(queryName)
+		action()
+		assert.DeepEqual(t, "observations for "+queryName, getObservationCount(queryName)-countBefore, uint64(1))
+	}
+
+	// queries are recorded when executed (regardless of whether they find something)
+	expectObservations("account_get_by_name", func() {
+		_, err := FindAccount(t.Context(), emptyTestExecutor{}, "test1")
+		assert.DeepEqual(t, "error", err, nil)
+	})
+	expectObservations("blob_get_by_repo_id", func() {
+		_, err := FindBlobByRepository(emptyTestExecutor{}, digest.FromString("foo"), models.Repository{ID: 1, AccountName: "test1"})
+		assert.DeepEqual(t, "error", err, sql.ErrNoRows)
+	})
+
+	// queries served from the account cache are not recorded
+	ctx := WithAccountCache(t.Context())
+	expectObservations("account_get_by_name", func() {
+		for range 3 {
+			_, err := FindAccount(ctx, emptyTestExecutor{}, "test1")
+			assert.DeepEqual(t, "error", err, nil)
+		}
+	})
+
+	// unknown query names are reported as "other" to keep the label set bounded
+	expectObservations("other", func() {
+		ObserveQueryDuration("unknown_query", time.Now())
+	})
+	metricsChan := make(chan prometheus.Metric, 100)
+	dbQueryDurationHistogram.Collect(metricsChan)
+	close(metricsChan)
+	assert.DeepEqual(t, "number of series", len(metricsChan), len(instrumentedQueryNames)+1)
+}
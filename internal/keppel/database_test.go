@@ -0,0 +1,237 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package keppel
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dlmiddlecote/sqlstats"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sapcc/go-bits/assert"
+
+	"github.com/sapcc/keppel/internal/models"
+)
+
+// recordingDriver is a database/sql driver that records all statements
+// executed on it, grouped by data source name. Queries never return any rows.
+type recordingDriver struct {
+	mutex      sync.Mutex
+	statements map[string][]string
+}
+
+func (d *recordingDriver) Open(dsn string) (driver.Conn, error) {
+	return recordingConn{d, dsn}, nil
+}
+
+func (d *recordingDriver) record(dsn, query string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.statements[dsn] = append(d.statements[dsn], query)
+}
+
+func (d *recordingDriver) takeStatements(dsn string) []string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	result := d.statements[dsn]
+	delete(d.statements, dsn)
+	return result
+}
+
+type recordingConn struct {
+	driver *recordingDriver
+	dsn    string
+}
+
+func (c recordingConn) Prepare(query string) (driver.Stmt, error) {
+	return recordingStmt{c, query}, nil
+}
+
+func (c recordingConn) Close() error { return nil }
+
+func (c recordingConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("transactions are not supported")
+}
+
+type recordingStmt struct {
+	conn  recordingConn
+	query string
+}
+
+func (s recordingStmt) Close() error  { return nil }
+func (s recordingStmt) NumInput() int { return -1 }
+
+func (s recordingStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.conn.driver.record(s.conn.dsn, s.query)
+	return driver.RowsAffected(1), nil
+}
+
+func (s recordingStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.conn.driver.record(s.conn.dsn, s.query)
+	return emptyRows{}, nil
+}
+
+type emptyRows struct{}
+
+func (emptyRows) Columns() []string              { return []string{"value"} }
+func (emptyRows) Close() error                   { return nil }
+func (emptyRows) Next(dest []driver.Value) error { return io.EOF }
+
+var testDriver = &recordingDriver{statements: make(map[string][]string)}
+
+func init() {
+	sql.Register("keppel-recording-test", testDriver)
+}
+
+func openRecordingDB(t *testing.T, dsn string) *sql.DB {
+	t.Helper()
+	dbConn, err := sql.Open("keppel-recording-test", dsn)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	t.Cleanup(func() { dbConn.Close() })
+	return dbConn
+}
+
+func TestReadReplicaRouting(t *testing.T) {
+	expectStatements := func(dsn string, expected ...string) {
+		t.Helper()
+		assert.DeepEqual(t, "statements on "+dsn, testDriver.takeStatements(dsn), expected)
+	}
+
+	// without a read replica, everything goes to the primary
+	db := InitORM(openRecordingDB(t, "primary-only"))
+	var content []byte
+	err := db.ReadReplica().SelectOne(&content, "SELECT 1")
+	assert.DeepEqual(t, "error", err, sql.ErrNoRows)
+	err = db.SelectOneFromReplica(&content, "SELECT 2")
+	assert.DeepEqual(t, "error", err, sql.ErrNoRows)
+	expectStatements("primary-only", "SELECT 1", "SELECT 2")
+
+	// with a read replica, ReadReplica() goes to the replica...
+	db = InitORM(openRecordingDB(t, "primary")).WithReadReplica(openRecordingDB(t, "replica"))
+	err = db.ReadReplica().SelectOne(&content, "SELECT 1")
+	assert.DeepEqual(t, "error", err, sql.ErrNoRows)
+	expectStatements("replica", "SELECT 1")
+	expectStatements("primary")
+
+	// ...while writes go to the primary
+	_, err = db.Exec("UPDATE foo SET bar = 42")
+	assert.DeepEqual(t, "error", err, nil)
+	expectStatements("replica")
+	expectStatements("primary", "UPDATE foo SET bar = 42")
+
+	// SelectOneFromReplica() falls back to the primary if the replica does not
+	// have a matching row yet
+	err = db.SelectOneFromReplica(&content, "SELECT 2")
+	assert.DeepEqual(t, "error", err, sql.ErrNoRows)
+	expectStatements("replica", "SELECT 2")
+	expectStatements("primary", "SELECT 2")
+
+	// results from the replica are not put into the account cache (otherwise
+	// stale results from the replica could leak into lookups on the primary)
+	ctx := WithAccountCache(t.Context())
+	for range 2 {
+		account, err := FindReducedAccount(ctx, db.ReadReplica(), "test1")
+		assert.DeepEqual(t, "error", err, nil)
+		assert.DeepEqual(t, "account", account, (*models.ReducedAccount)(nil))
+	}
+	expectStatements("replica", reducedAccountGetByNameQuery, reducedAccountGetByNameQuery)
+	for range 2 {
+		account, err := FindReducedAccount(ctx, db, "test1")
+		assert.DeepEqual(t, "error", err, nil)
+		assert.DeepEqual(t, "account", account, (*models.ReducedAccount)(nil))
+	}
+	expectStatements("primary", reducedAccountGetByNameQuery)
+}
+
+func TestDBConnectionPool(t *testing.T) {
+	// test parsing of configuration
+	cfg, err := parseDBConnectionPoolConfig()
+	assert.DeepEqual(t, "error", err, nil)
+	assert.DeepEqual(t, "default config", cfg, DBConnectionPoolConfig{MaxOpenConns: 16, MaxIdleConns: 2})
+
+	expectError := func(expected string) {
+		t.Helper()
+		_, err := parseDBConnectionPoolConfig()
+		if err == nil {
+			t.Errorf("expected error %q, but got no error", expected)
+		} else {
+			assert.DeepEqual(t, "error", err.Error(), expected)
+		}
+	}
+
+	t.Setenv("KEPPEL_DB_MAX_OPEN_CONNS", "0")
+	expectError(`malformed KEPPEL_DB_MAX_OPEN_CONNS: "0" is not a positive integer`)
+	t.Setenv("KEPPEL_DB_MAX_OPEN_CONNS", "5")
+	t.Setenv("KEPPEL_DB_MAX_IDLE_CONNS", "-1")
+	expectError(`malformed KEPPEL_DB_MAX_IDLE_CONNS: "-1" is not a non-negative integer`)
+	t.Setenv("KEPPEL_DB_MAX_IDLE_CONNS", "1")
+	t.Setenv("KEPPEL_DB_CONN_MAX_LIFETIME", "forever")
+	expectError(`malformed KEPPEL_DB_CONN_MAX_LIFETIME: "forever" is not a valid duration`)
+	t.Setenv("KEPPEL_DB_CONN_MAX_LIFETIME", "30m")
+	cfg, err = parseDBConnectionPoolConfig()
+	assert.DeepEqual(t, "error", err, nil)
+	assert.DeepEqual(t, "custom config", cfg, DBConnectionPoolConfig{MaxOpenConns: 5, MaxIdleConns: 1, ConnMaxLifetime: 30 * time.Minute})
+
+	// test that the pool stats are reported by the collector that func main() registers
+	dbConn := openRecordingDB(t, "pool")
+	InitORM(dbConn)
+	cfg.ApplyTo(dbConn)
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(sqlstats.NewStatsCollector("keppel", dbConn))
+
+	getMetrics := func() map[string]float64 {
+		t.Helper()
+		families, err := registry.Gather()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		result := make(map[string]float64)
+		for _, family := range families {
+			for _, metric := range family.GetMetric() {
+				switch {
+				case metric.GetGauge() != nil:
+					result[family.GetName()] = metric.GetGauge().GetValue()
+				case metric.GetCounter() != nil:
+					result[family.GetName()] = metric.GetCounter().GetValue()
+				}
+			}
+		}
+		return result
+	}
+
+	// hold some connections to simulate load
+	var conns []*sql.Conn
+	for range 3 {
+		conn, err := dbConn.Conn(t.Context())
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		conns = append(conns, conn)
+	}
+	metrics := getMetrics()
+	assert.DeepEqual(t, "max_open", metrics["go_sql_stats_connections_max_open"], 5.0)
+	assert.DeepEqual(t, "open", metrics["go_sql_stats_connections_open"], 3.0)
+	assert.DeepEqual(t, "in_use", metrics["go_sql_stats_connections_in_use"], 3.0)
+	assert.DeepEqual(t, "idle", metrics["go_sql_stats_connections_idle"], 0.0)
+
+	// after releasing the connections, only MaxIdleConns of them are kept open
+	for _, conn := range conns {
+		err := conn.Close()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	metrics = getMetrics()
+	assert.DeepEqual(t, "open", metrics["go_sql_stats_connections_open"], 1.0)
+	assert.DeepEqual(t, "in_use", metrics["go_sql_stats_connections_in_use"], 0.0)
+	assert.DeepEqual(t, "idle", metrics["go_sql_stats_connections_idle"], 1.0)
+	assert.DeepEqual(t, "closed_max_idle", metrics["go_sql_stats_connections_closed_max_idle"], 2.0)
+}
@@ -6,6 +6,9 @@ package keppel
 import (
 	"context"
 	"errors"
+	"fmt"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/sapcc/keppel/internal/models"
@@ -26,6 +29,11 @@ const (
 	// ClaimErrored indicates that ClaimAccountName() returned with an error
 	// because of an unexpected problem on the server side.
 	ClaimErrored
+	// ClaimRaceLost indicates that ClaimAccountName() returned with an error
+	// because another Keppel tried to claim the same account name at the same
+	// time. Unlike ClaimFailed, this is a transient condition: When retried, the
+	// claim will either succeed or fail with ClaimFailed.
+	ClaimRaceLost
 )
 
 // ErrNoSuchPrimaryAccount is returned by FederationDriver.FindPrimaryAccount if
@@ -70,6 +78,10 @@ type FederationDriver interface {
 	// ForfeitAccountName is the inverse operation of ClaimAccountName. It is used
 	// when deleting an account and releases this Keppel's claim on the account
 	// name.
+	//
+	// The implementation MUST be idempotent. If the account name is not claimed
+	// at all (e.g. because a previous call succeeded, but the account could not
+	// be deleted from the database afterwards), nil shall be returned.
 	ForfeitAccountName(ctx context.Context, account models.Account) error
 
 	// RecordExistingAccount is called regularly for each account in our database.
@@ -87,6 +99,95 @@ type FederationDriver interface {
 	// the primary account. If no account with this name exists anywhere,
 	// ErrNoSuchPrimaryAccount shall be returned.
 	FindPrimaryAccount(ctx context.Context, accountName models.AccountName) (peerHostName string, err error)
+
+	// SweepArchivedAccountNames is called regularly by the janitor. Drivers that
+	// keep an archive of forfeited account name claims for auditing purposes can
+	// use this call to remove archive entries that are older than their retention
+	// period. Drivers that do not keep such an archive shall return nil.
+	//
+	// The `now` argument contains the value of time.Now(). It may refer to an
+	// artificial wall clock during unit tests.
+	SweepArchivedAccountNames(ctx context.Context, now time.Time) error
+}
+
+// BatchAnnouncingFederationDriver is an optional interface that a
+// FederationDriver can implement if it can announce many existing accounts
+// more efficiently than by calling RecordExistingAccount() for each of them.
+// Use the RecordExistingAccounts() helper function instead of calling the
+// method on this interface directly.
+type BatchAnnouncingFederationDriver interface {
+	FederationDriver
+	// SupportsBatchAnnouncements returns whether RecordExistingAccounts() is
+	// actually more efficient than announcing each account on its own. This can
+	// be false for drivers that merely forward to other drivers, if some of those
+	// do not support batching.
+	SupportsBatchAnnouncements() bool
+	// RecordExistingAccounts works like RecordExistingAccount, but for several
+	// accounts at once. The returned slice must have the same length as
+	// `accounts` and contain the result for each account at the same index.
+	RecordExistingAccounts(ctx context.Context, accounts []models.Account, now time.Time) []error
+}
+
+// SupportsBatchAnnouncements returns whether the FederationDriver can announce
+// many existing accounts at once more efficiently than one by one.
+func SupportsBatchAnnouncements(fd FederationDriver) bool {
+	bfd, ok := fd.(BatchAnnouncingFederationDriver)
+	return ok && bfd.SupportsBatchAnnouncements()
+}
+
+// RecordExistingAccounts announces all given accounts to the FederationDriver.
+// If the driver implements BatchAnnouncingFederationDriver, the announcement is
+// done in one batch, otherwise RecordExistingAccount() is called for each
+// account in turn. The returned slice contains the result for each account at
+// the same index as in `accounts`.
+func RecordExistingAccounts(ctx context.Context, fd FederationDriver, accounts []models.Account, now time.Time) []error {
+	if bfd, ok := fd.(BatchAnnouncingFederationDriver); ok {
+		return bfd.RecordExistingAccounts(ctx, accounts, now)
+	}
+	errs := make([]error, len(accounts))
+	for idx, account := range accounts {
+		errs[idx] = fd.RecordExistingAccount(ctx, account, now)
+	}
+	return errs
+}
+
+// AccountNameReservation reserves all account names starting with Prefix for
+// the given auth tenant. FederationDriver implementations with shared storage
+// can read reservations maintained by the operator from that storage, and
+// enforce them in ClaimAccountName() using CheckAccountNameReservations().
+type AccountNameReservation struct {
+	Prefix       string `json:"prefix"`
+	AuthTenantID string `json:"auth_tenant_id"`
+}
+
+var accountNamePrefixRx = regexp.MustCompile(`^[a-z0-9-]{1,48}$`)
+
+// Validate returns an error if this reservation is not well-formed.
+func (r AccountNameReservation) Validate() error {
+	if !accountNamePrefixRx.MatchString(r.Prefix) {
+		return fmt.Errorf("invalid account name prefix: %q", r.Prefix)
+	}
+	if r.AuthTenantID == "" {
+		return fmt.Errorf("missing auth tenant ID in reservation for prefix %q", r.Prefix)
+	}
+	return nil
+}
+
+// Covers returns whether the given account name falls under this reservation.
+func (r AccountNameReservation) Covers(name models.AccountName) bool {
+	return strings.HasPrefix(string(name), r.Prefix)
+}
+
+// CheckAccountNameReservations is a helper function for implementations of
+// FederationDriver.ClaimAccountName(). It returns an error if the given
+// account is covered by a reservation for a different auth tenant.
+func CheckAccountNameReservations(reservations []AccountNameReservation, account models.Account) error {
+	for _, r := range reservations {
+		if r.Covers(account.Name) && r.AuthTenantID != account.AuthTenantID {
+			return fmt.Errorf("account name %s is reserved for a different auth tenant (reserved prefix: %q)", account.Name, r.Prefix)
+		}
+	}
+	return nil
 }
 
 // FederationDriverRegistry is a pluggable.Registry for FederationDriver implementations.
@@ -0,0 +1,37 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package keppel
+
+import (
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+
+	"github.com/sapcc/keppel/internal/models"
+)
+
+func TestAccountNameReservations(t *testing.T) {
+	reservations := []AccountNameReservation{
+		{Prefix: "mycorp-", AuthTenantID: "tenant1"},
+		{Prefix: "other-", AuthTenantID: "tenant2"},
+	}
+
+	// claims below a reserved prefix are only allowed for the reserving tenant
+	expectClaim := func(name models.AccountName, authTenantID, expectedError string) {
+		t.Helper()
+		err := CheckAccountNameReservations(reservations, models.Account{Name: name, AuthTenantID: authTenantID})
+		if expectedError == "" {
+			assert.DeepEqual(t, "error for "+string(name), err, nil)
+		} else if err == nil {
+			t.Errorf("expected error %q for %s, but got nil", expectedError, name)
+		} else {
+			assert.DeepEqual(t, "error for "+string(name), err.Error(), expectedError)
+		}
+	}
+	expectClaim("mycorp-foo", "tenant1", "")
+	expectClaim("mycorp-foo", "tenant2", `account name mycorp-foo is reserved for a different auth tenant (reserved prefix: "mycorp-")`)
+	expectClaim("other-foo", "tenant2", "")
+	expectClaim("mycorp", "tenant2", "") // not covered by the "mycorp-" prefix
+	expectClaim("unreserved", "tenant3", "")
+}
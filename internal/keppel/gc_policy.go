@@ -7,11 +7,14 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"reflect"
+	"slices"
 	"sort"
 	"strings"
 	"time"
 
 	. "github.com/majewsky/gg/option"
+	"github.com/sapcc/go-bits/regexpext"
 
 	"github.com/sapcc/keppel/internal/models"
 )
@@ -23,6 +26,8 @@ type GCPolicy struct {
 	OnlyUntagged   bool              `json:"only_untagged,omitempty"`
 	TimeConstraint *GCTimeConstraint `json:"time_constraint,omitempty"`
 	Action         string            `json:"action"`
+	// only used with action "retain"
+	RetainCount uint64 `json:"retain_count,omitempty"`
 }
 
 // GCTimeConstraint appears in type GCPolicy.
@@ -116,6 +121,50 @@ func (g GCPolicy) MatchesTimeConstraint(manifest models.Manifest, allManifestsIn
 	return false
 }
 
+// MatchingTagNames returns those of the given tag names that match this
+// policy's tag regexes. This is used by policies with action "retain", which
+// consider each tag individually instead of the full set of tags on a manifest.
+func (g GCPolicy) MatchingTagNames(tagNames []string) []string {
+	var result []string
+	for _, tagName := range tagNames {
+		if g.PolicyMatchRule.MatchesTags([]string{tagName}) {
+			result = append(result, tagName)
+		}
+	}
+	return result
+}
+
+// SelectRetainedTags is used by policies with action "retain". Given all tags
+// in a repo, it returns the names of those matching tags that shall be
+// retained, i.e. the RetainCount most recently pushed ones.
+func (g GCPolicy) SelectRetainedTags(allTagsInRepo []models.Tag) map[string]bool {
+	var matchingTags []models.Tag
+	for _, tag := range allTagsInRepo {
+		if g.PolicyMatchRule.MatchesTags([]string{tag.Name}) {
+			matchingTags = append(matchingTags, tag)
+		}
+	}
+
+	// sort by pushed_at, newest first (with tag name as a tiebreaker to ensure deterministic behavior)
+	sort.Slice(matchingTags, func(i, j int) bool {
+		lhs := matchingTags[i]
+		rhs := matchingTags[j]
+		if lhs.PushedAt.Equal(rhs.PushedAt) {
+			return lhs.Name > rhs.Name
+		}
+		return lhs.PushedAt.After(rhs.PushedAt)
+	})
+
+	result := make(map[string]bool)
+	for idx, tag := range matchingTags {
+		if uint64(idx) >= g.RetainCount {
+			break
+		}
+		result[tag.Name] = true
+	}
+	return result
+}
+
 // Validate returns an error if this policy is invalid.
 func (g GCPolicy) Validate() error {
 	err := g.validate("GC policy")
@@ -169,8 +218,22 @@ func (g GCPolicy) Validate() error {
 		}
 	}
 
+	if g.Action == "retain" {
+		if g.RetainCount == 0 {
+			return errors.New(`GC policy with action "retain" must have the "retain_count" attribute`)
+		}
+		if g.OnlyUntagged {
+			return errors.New(`GC policy with action "retain" cannot set the "only_untagged" attribute`)
+		}
+		if g.TimeConstraint != nil {
+			return errors.New(`GC policy with action "retain" cannot have a time constraint`)
+		}
+	} else if g.RetainCount != 0 && g.Action != "" {
+		return fmt.Errorf(`GC policy with action %q cannot set the "retain_count" attribute`, g.Action)
+	}
+
 	switch g.Action {
-	case "delete", "protect":
+	case "delete", "protect", "retain":
 		// valid
 		return nil
 	case "":
@@ -180,6 +243,84 @@ func (g GCPolicy) Validate() error {
 	}
 }
 
+// ConflictsWith returns whether this GC policy contradicts the given tag
+// policy, i.e. whether all images that this GC policy would delete are
+// protected from deletion by the tag policy, such that this GC policy can
+// never have any effect.
+//
+// Only GC policies with action "delete" are considered. Policies with action
+// "retain" are not reported, since their intent (keeping images) agrees with
+// the tag policy.
+//
+// Partial overlaps are not reported since they are a legitimate way to exempt
+// some images from a broader GC policy. Since regexes cannot be compared in
+// general, this check only reports conflicts that are certain: The tag
+// policy's regexes must either be identical to those of the GC policy, or
+// match everything.
+func (g GCPolicy) ConflictsWith(t TagPolicy) bool {
+	if g.Action != "delete" {
+		return false
+	}
+	if !t.BlockDelete {
+		return false
+	}
+
+	// does the tag policy cover all repositories matched by the GC policy?
+	// (the GC policy's "except_repository" can only make its match narrower)
+	if t.NegativeRepositoryRx != "" || !regexCovers(t.RepositoryRx, g.RepositoryRx) {
+		return false
+	}
+
+	// does the tag policy cover all images matched by the GC policy?
+	switch {
+	case t.NegativeTagRx != "":
+		return false
+	case t.TagRx == "":
+		return true // the tag policy covers all images, including untagged ones
+	case g.OnlyUntagged || g.TagRx == "":
+		return false // the GC policy also matches untagged images, which are not covered by the tag policy
+	default:
+		return regexCovers(t.TagRx, g.TagRx)
+	}
+}
+
+// Returns whether `outer` definitely matches every string that `inner` matches.
+func regexCovers(outer, inner regexpext.BoundedRegexp) bool {
+	// since repository names and tag names cannot be empty, ".+" is as good as ".*" here
+	return outer == inner || outer == ".*" || outer == ".+"
+}
+
+// FindPolicyConflicts checks the GC policies and tag policies of an account
+// against each other, and returns a description of each pair of policies
+// where the GC policy can never delete anything because of the tag policy.
+func FindPolicyConflicts(gcPolicies []GCPolicy, tagPolicies []TagPolicy) []string {
+	return FindNewPolicyConflicts(nil, nil, gcPolicies, tagPolicies)
+}
+
+// FindNewPolicyConflicts is like FindPolicyConflicts, but skips conflicts
+// between a GC policy and a tag policy that both already existed in
+// `oldGCPolicies` and `oldTagPolicies`. This is used when updating an
+// account, so that the update is only rejected for conflicts that it introduces.
+func FindNewPolicyConflicts(oldGCPolicies []GCPolicy, oldTagPolicies []TagPolicy, gcPolicies []GCPolicy, tagPolicies []TagPolicy) []string {
+	var result []string
+	for gIdx, g := range gcPolicies {
+		for tIdx, t := range tagPolicies {
+			if !g.ConflictsWith(t) {
+				continue
+			}
+			isExisting := slices.ContainsFunc(oldGCPolicies, func(old GCPolicy) bool { return reflect.DeepEqual(old, g) }) &&
+				slices.ContainsFunc(oldTagPolicies, func(old TagPolicy) bool { return reflect.DeepEqual(old, t) })
+			if isExisting {
+				continue
+			}
+			result = append(result, fmt.Sprintf(
+				"gc_policies[%d] with action %q cannot delete anything because all matching images are protected by tag_policies[%d]",
+				gIdx, g.Action, tIdx))
+		}
+	}
+	return result
+}
+
 // ParseGCPolicies parses the GC policies for the given account.
 func ParseGCPolicies(account models.Account) ([]GCPolicy, error) {
 	if account.GCPoliciesJSON == "" || account.GCPoliciesJSON == "[]" {
@@ -205,6 +346,9 @@ type GCStatus struct {
 	// If this manifest references a subject and is thus protected from GC,
 	// this contains the subject's digest.
 	ProtectedBySubjectManifest string `json:"protected_by_subject,omitempty"`
+	// If this manifest is tagged with a pinned tag and thus protected from GC,
+	// this contains the name of that tag.
+	ProtectedByPinnedTag string `json:"protected_by_pinned_tag,omitempty"`
 	// If a policy with action "protect" applies to this image,
 	// this contains the definition of the policy.
 	ProtectedByGCPolicy Option[GCPolicy] `json:"protected_by_policy,omitzero"` // This should be renamed but would be a breaking change in the API.
@@ -217,5 +361,5 @@ type GCStatus struct {
 
 // IsProtected returns whether any of the ProtectedBy... fields is filled.
 func (s GCStatus) IsProtected() bool {
-	return s.ProtectedByRecentUpload || s.ProtectedByParentManifest != "" || s.ProtectedBySubjectManifest != "" || s.ProtectedByGCPolicy.IsSome() || s.ProtectedByTagPolicy.IsSome()
+	return s.ProtectedByRecentUpload || s.ProtectedByParentManifest != "" || s.ProtectedBySubjectManifest != "" || s.ProtectedByPinnedTag != "" || s.ProtectedByGCPolicy.IsSome() || s.ProtectedByTagPolicy.IsSome()
 }
@@ -0,0 +1,65 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package keppel
+
+import (
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+)
+
+func TestGCPolicyConflictsWithTagPolicy(t *testing.T) {
+	deleteUntagged := GCPolicy{PolicyMatchRule: PolicyMatchRule{RepositoryRx: "library/.*"}, OnlyUntagged: true, Action: "delete"}
+	deleteAll := GCPolicy{PolicyMatchRule: PolicyMatchRule{RepositoryRx: "library/.*"}, Action: "delete"}
+	deleteNightly := GCPolicy{PolicyMatchRule: PolicyMatchRule{RepositoryRx: "library/.*", TagRx: "nightly-.*"}, Action: "delete"}
+	retainNightly := GCPolicy{PolicyMatchRule: PolicyMatchRule{RepositoryRx: "library/.*", TagRx: "nightly-.*"}, Action: "retain", RetainCount: 5}
+	protectNightly := GCPolicy{PolicyMatchRule: PolicyMatchRule{RepositoryRx: "library/.*", TagRx: "nightly-.*"}, Action: "protect"}
+
+	blockEverything := TagPolicy{PolicyMatchRule: PolicyMatchRule{RepositoryRx: ".*"}, BlockDelete: true}
+	blockLibrary := TagPolicy{PolicyMatchRule: PolicyMatchRule{RepositoryRx: "library/.*"}, BlockDelete: true}
+	blockAlpine := TagPolicy{PolicyMatchRule: PolicyMatchRule{RepositoryRx: "library/alpine"}, BlockDelete: true}
+	blockNightly := TagPolicy{PolicyMatchRule: PolicyMatchRule{RepositoryRx: "library/.*", TagRx: "nightly-.*"}, BlockDelete: true}
+	blockAllTags := TagPolicy{PolicyMatchRule: PolicyMatchRule{RepositoryRx: ".*", TagRx: ".*"}, BlockDelete: true}
+	blockLibraryExceptAlpine := TagPolicy{PolicyMatchRule: PolicyMatchRule{RepositoryRx: "library/.*", NegativeRepositoryRx: "library/alpine"}, BlockDelete: true}
+	blockNightlyExceptLatest := TagPolicy{PolicyMatchRule: PolicyMatchRule{RepositoryRx: "library/.*", TagRx: "nightly-.*", NegativeTagRx: "nightly-latest"}, BlockDelete: true}
+	blockOverwriteOnly := TagPolicy{PolicyMatchRule: PolicyMatchRule{RepositoryRx: ".*"}, BlockOverwrite: true}
+
+	testCases := []struct {
+		GCPolicy        GCPolicy
+		TagPolicy       TagPolicy
+		ExpectConflict  bool
+		TestDescription string
+	}{
+		{deleteUntagged, blockEverything, true, "tag policy without match_tag protects untagged images"},
+		{deleteUntagged, blockLibrary, true, "identical repository regexes"},
+		{deleteUntagged, blockAlpine, false, "tag policy only covers some of the repositories"},
+		{deleteUntagged, blockNightly, false, "tag policy does not protect untagged images"},
+		{deleteAll, blockLibrary, true, "tag policy covers all images in the same repositories"},
+		{deleteAll, blockNightly, false, "GC policy also deletes images without nightly tags"},
+		{deleteNightly, blockNightly, true, "identical tag regexes"},
+		{deleteNightly, blockAllTags, true, "tag policy matches all tags"},
+		{retainNightly, blockNightly, false, "retain policies are not reported"},
+		{protectNightly, blockNightly, false, "protect policies do not delete images"},
+		{deleteNightly, blockLibraryExceptAlpine, false, "except_repository on tag policy makes coverage uncertain"},
+		{deleteNightly, blockNightlyExceptLatest, false, "except_tag on tag policy makes coverage uncertain"},
+		{deleteNightly, blockOverwriteOnly, false, "tag policy does not block deletion"},
+	}
+	for _, tc := range testCases {
+		assert.DeepEqual(t, tc.TestDescription, tc.GCPolicy.ConflictsWith(tc.TagPolicy), tc.ExpectConflict)
+	}
+
+	// FindPolicyConflicts reports all conflicting pairs
+	conflicts := FindPolicyConflicts([]GCPolicy{protectNightly, deleteNightly}, []TagPolicy{blockAlpine, blockNightly})
+	assert.DeepEqual(t, "conflicts", conflicts, []string{
+		`gc_policies[1] with action "delete" cannot delete anything because all matching images are protected by tag_policies[1]`,
+	})
+
+	// FindNewPolicyConflicts only reports conflicts that do not exist in the old set of policies
+	conflicts = FindNewPolicyConflicts([]GCPolicy{deleteNightly}, []TagPolicy{blockNightly},
+		[]GCPolicy{deleteNightly, deleteAll}, []TagPolicy{blockAlpine, blockNightly, blockLibrary})
+	assert.DeepEqual(t, "new conflicts", conflicts, []string{
+		`gc_policies[0] with action "delete" cannot delete anything because all matching images are protected by tag_policies[2]`,
+		`gc_policies[1] with action "delete" cannot delete anything because all matching images are protected by tag_policies[2]`,
+	})
+}
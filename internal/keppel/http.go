@@ -4,7 +4,11 @@
 package keppel
 
 import (
+	"fmt"
 	"net/http"
+	"os"
+	"sync"
+	"time"
 
 	"github.com/sapcc/go-api-declarations/bininfo"
 	"github.com/sapcc/go-bits/httpext"
@@ -14,14 +18,118 @@ import (
 
 var wrap *httpext.WrappedTransport
 
+// userAgentURL is included in the User-Agent of outgoing requests to point
+// operators of upstream registries to where this traffic is coming from.
+const userAgentURL = "https://github.com/sapcc/keppel"
+
 func SetupHTTPClient() {
+	base, _ := http.DefaultTransport.(*http.Transport)
 	wrap = httpext.WrapTransport(&http.DefaultTransport)
 	wrap.SetInsecureSkipVerify(osext.GetenvBool("KEPPEL_INSECURE")) // for debugging with mitmproxy etc. (DO NOT SET IN PRODUCTION)
-	wrap.SetOverrideUserAgent(bininfo.Component(), bininfo.VersionOr("rolling"))
+	product := os.Getenv("KEPPEL_USER_AGENT")
+	wrappers := []func(http.RoundTripper) http.RoundTripper{
+		func(inner http.RoundTripper) http.RoundTripper {
+			return userAgentRoundTripper{inner, product}
+		},
+	}
+	for _, wrapper := range wrappers {
+		wrap.Attach(wrapper)
+	}
+
+	// NOTE: SetInsecureSkipVerify() modifies `base` in place, so the upstream
+	// transports (which are cloned from it later) inherit that setting. The
+	// same wrappers as for the default transport are applied to them.
+	if base != nil {
+		upstreamTransports = &transportPool{
+			base:       base,
+			wrappers:   wrappers,
+			transports: make(map[string]http.RoundTripper),
+		}
+	}
 }
 
 func SetTaskName(taskName string) {
 	bininfo.SetTaskName(taskName)
-	wrap.SetOverrideUserAgent(bininfo.Component(), bininfo.VersionOr("rolling"))
 	logg.Info("starting %s %s", bininfo.Component(), bininfo.VersionOr("rolling"))
 }
+
+// UserAgent returns the User-Agent header value for outgoing requests, e.g.
+// "keppel-api/1.2.3 (+https://github.com/sapcc/keppel)". The product name
+// defaults to the name of the current component, but can be overridden.
+func UserAgent(product string) string {
+	if product == "" {
+		product = bininfo.Component()
+	}
+	return fmt.Sprintf("%s/%s (+%s)", product, bininfo.VersionOr("rolling"), userAgentURL)
+}
+
+// userAgentRoundTripper sets the User-Agent header on all outgoing requests,
+// overriding any User-Agent that the request already carries. (This is why
+// KEPPEL_ANYCAST_FORWARDED_HEADERS may not contain User-Agent.)
+type userAgentRoundTripper struct {
+	inner   http.RoundTripper
+	product string
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+func (rt userAgentRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	// RoundTrip must not modify the original request
+	r = r.Clone(r.Context())
+	r.Header.Set("User-Agent", UserAgent(rt.product))
+	return rt.inner.RoundTrip(r)
+}
+
+// ConnectionPoolConfig contains tuning parameters for a http.Transport.
+type ConnectionPoolConfig struct {
+	// MaxIdleConnsPerHost is the maximum number of idle (keep-alive)
+	// connections that are kept open per host. If zero,
+	// http.DefaultMaxIdleConnsPerHost is used.
+	MaxIdleConnsPerHost int
+	// IdleConnTimeout is how long an idle connection is kept open. If zero,
+	// idle connections are kept open indefinitely.
+	IdleConnTimeout time.Duration
+	// DisableKeepAlives disables connection reuse entirely.
+	DisableKeepAlives bool
+}
+
+// transportPool holds one http.Transport per upstream host, so that
+// connections can be reused across all replications from that host.
+type transportPool struct {
+	mutex      sync.Mutex
+	base       *http.Transport
+	wrappers   []func(http.RoundTripper) http.RoundTripper
+	transports map[string]http.RoundTripper
+}
+
+// This is nil until SetupHTTPClient() is called. Until then (esp. in unit
+// tests), UpstreamHTTPClient() falls back to http.DefaultClient.
+var upstreamTransports *transportPool
+
+func (p *transportPool) get(host string, cfg ConnectionPoolConfig) http.RoundTripper {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	rt, exists := p.transports[host]
+	if !exists {
+		t := p.base.Clone()
+		t.MaxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+		t.IdleConnTimeout = cfg.IdleConnTimeout
+		t.DisableKeepAlives = cfg.DisableKeepAlives
+		rt = t
+		for _, wrapper := range p.wrappers {
+			rt = wrapper(rt)
+		}
+		p.transports[host] = rt
+	}
+	return rt
+}
+
+// UpstreamHTTPClient returns a http.Client for talking to the given upstream
+// registry host during replication. All clients for the same host share one
+// connection pool, as configured in cfg.UpstreamConnectionPool.
+func (cfg Configuration) UpstreamHTTPClient(host string) *http.Client {
+	if upstreamTransports == nil {
+		return http.DefaultClient
+	}
+	return &http.Client{Transport: upstreamTransports.get(host, cfg.UpstreamConnectionPool)}
+}
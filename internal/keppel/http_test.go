@@ -0,0 +1,154 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package keppel
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-api-declarations/bininfo"
+	"github.com/sapcc/go-bits/assert"
+)
+
+func TestUserAgentOnOutgoingRequests(t *testing.T) {
+	var receivedUserAgent string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedUserAgent = r.Header.Get("User-Agent")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	sendRequest := func(product, userAgent string) {
+		t.Helper()
+		client := &http.Client{Transport: userAgentRoundTripper{http.DefaultTransport, product}}
+		req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, srv.URL, http.NoBody)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if userAgent != "" {
+			req.Header.Set("User-Agent", userAgent)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		resp.Body.Close()
+	}
+
+	bininfo.SetTaskName("api")
+	defer bininfo.SetTaskName("")
+	version := bininfo.VersionOr("rolling")
+
+	// by default, the User-Agent identifies the component and version
+	sendRequest("", "")
+	assert.DeepEqual(t, "User-Agent", receivedUserAgent, bininfo.Component()+"/"+version+" (+https://github.com/sapcc/keppel)")
+
+	// the product name can be configured
+	sendRequest("keppel-eu-de-1", "")
+	assert.DeepEqual(t, "User-Agent", receivedUserAgent, "keppel-eu-de-1/"+version+" (+https://github.com/sapcc/keppel)")
+
+	// an explicitly set User-Agent is overridden
+	sendRequest("", "docker/27.0")
+	assert.DeepEqual(t, "User-Agent", receivedUserAgent, bininfo.Component()+"/"+version+" (+https://github.com/sapcc/keppel)")
+}
+
+// newCountingTLSServer starts an HTTPS server that counts how many TCP
+// connections were opened to it.
+func newCountingTLSServer(tb testing.TB) (srv *httptest.Server, connCount *atomic.Int64) {
+	tb.Helper()
+	connCount = &atomic.Int64{}
+	srv = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("blob contents")) //nolint:errcheck
+	}))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			connCount.Add(1)
+		}
+	}
+	srv.StartTLS()
+	tb.Cleanup(srv.Close)
+	return srv, connCount
+}
+
+func newTestTransportPool(srv *httptest.Server) *transportPool {
+	return &transportPool{
+		base:       srv.Client().Transport.(*http.Transport),
+		transports: make(map[string]http.RoundTripper),
+	}
+}
+
+func sendRequestsThroughPool(tb testing.TB, pool *transportPool, srv *httptest.Server, cfg ConnectionPoolConfig, count int) {
+	tb.Helper()
+	host := strings.TrimPrefix(srv.URL, "https://")
+	for range count {
+		// like in the processor, each replication constructs a new client
+		client := &http.Client{Transport: pool.get(host, cfg)}
+		resp, err := client.Get(srv.URL + "/v2/foo/blobs/sha256:abc")
+		if err != nil {
+			tb.Fatal(err.Error())
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+}
+
+func TestUpstreamTransportPool(t *testing.T) {
+	cfg := ConnectionPoolConfig{MaxIdleConnsPerHost: 4, IdleConnTimeout: time.Minute}
+
+	// with keep-alives, all requests share one connection
+	srv, connCount := newCountingTLSServer(t)
+	pool := newTestTransportPool(srv)
+	sendRequestsThroughPool(t, pool, srv, cfg, 10)
+	assert.DeepEqual(t, "connection count", connCount.Load(), int64(1))
+	assert.DeepEqual(t, "transport count", len(pool.transports), 1)
+
+	// without keep-alives, each request opens a new connection
+	srv, connCount = newCountingTLSServer(t)
+	pool = newTestTransportPool(srv)
+	sendRequestsThroughPool(t, pool, srv, ConnectionPoolConfig{DisableKeepAlives: true}, 10)
+	assert.DeepEqual(t, "connection count", connCount.Load(), int64(10))
+}
+
+func TestUpstreamTransportPoolAppliesWrappers(t *testing.T) {
+	var receivedUserAgent string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedUserAgent = r.Header.Get("User-Agent")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	// the same wrappers that are attached to http.DefaultTransport also apply to the upstream transports
+	pool := newTestTransportPool(srv)
+	pool.wrappers = []func(http.RoundTripper) http.RoundTripper{
+		func(inner http.RoundTripper) http.RoundTripper { return userAgentRoundTripper{inner, "keppel-eu-de-1"} },
+	}
+	sendRequestsThroughPool(t, pool, srv, ConnectionPoolConfig{}, 1)
+	assert.DeepEqual(t, "User-Agent", receivedUserAgent, "keppel-eu-de-1/"+bininfo.VersionOr("rolling")+" (+https://github.com/sapcc/keppel)")
+}
+
+// Run with `go test -run=^$ -bench=UpstreamConnection ./internal/keppel`.
+// The "conns/op" metric shows how many TLS handshakes were needed per request.
+func BenchmarkUpstreamConnectionReuse(b *testing.B) {
+	for _, disableKeepAlives := range []bool{false, true} {
+		name := "pooled"
+		if disableKeepAlives {
+			name = "unpooled"
+		}
+		b.Run(name, func(b *testing.B) {
+			srv, connCount := newCountingTLSServer(b)
+			pool := newTestTransportPool(srv)
+			cfg := ConnectionPoolConfig{MaxIdleConnsPerHost: 16, IdleConnTimeout: time.Minute, DisableKeepAlives: disableKeepAlives}
+			b.ResetTimer()
+			sendRequestsThroughPool(b, pool, srv, cfg, b.N)
+			b.ReportMetric(float64(connCount.Load())/float64(b.N), "conns/op")
+		})
+	}
+}
@@ -0,0 +1,231 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package keppel
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	stdlog "log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sapcc/go-api-declarations/bininfo"
+	"github.com/sapcc/go-bits/logg"
+
+	"github.com/sapcc/keppel/internal/models"
+)
+
+// SetupLogging configures the log output format as selected by the
+// KEPPEL_LOG_FORMAT environment variable. The default format "text" is the
+// usual "LEVEL: message" format from package logg. The format "json" emits one
+// JSON object per log line for consumption by log aggregation systems.
+func SetupLogging() {
+	switch format := os.Getenv("KEPPEL_LOG_FORMAT"); format {
+	case "", "text":
+		// nothing to do
+	case "json":
+		useJSONLogWriter(newJSONLogWriter(os.Stderr, time.Now))
+	default:
+		logg.Fatal("invalid value for KEPPEL_LOG_FORMAT: %q (expected \"text\" or \"json\")", format)
+	}
+}
+
+// JSONLogRecord is the structure of a log line emitted when KEPPEL_LOG_FORMAT=json.
+type JSONLogRecord struct {
+	Timestamp string `json:"timestamp"`
+	Level     string `json:"level"`
+	Task      string `json:"task"`
+	Message   string `json:"message"`
+	// only filled for log lines written by LogInfo() or LogError() with the respective LogFields
+	Account   models.AccountName `json:"account,omitempty"`
+	RequestID string             `json:"request_id,omitempty"`
+	// only filled for request logs from package httpapi
+	Request *JSONLogRequest `json:"request,omitempty"`
+}
+
+// JSONLogRequest appears in JSONLogRecord for request logs.
+type JSONLogRequest struct {
+	RemoteAddr string `json:"remote_addr"`
+	Method     string `json:"method"`
+	URL        string `json:"url"`
+	Status     int    `json:"status"`
+	BodySize   int    `json:"body_size"`
+	UserAgent  string `json:"user_agent"`
+	Duration   string `json:"duration"`
+}
+
+var (
+	logLevelRx = regexp.MustCompile(`^([A-Z]+): (.*)$`)
+	// matches the request log format from package httpapi
+	logRequestRx = regexp.MustCompile(`^(\S+) - - "(\S+) (\S+) \S+" (\d{3}) (\d+) "[^"]*" "([^"]*)" (\S+)$`)
+)
+
+// LogFields contains structured fields that are attached to log lines written
+// by LogInfo() and LogError(). They are carried along in a context.Context,
+// see WithLogFields().
+type LogFields struct {
+	Account   models.AccountName
+	RequestID string
+}
+
+type logFieldsContextKey struct{}
+
+// WithLogFields returns a child context that carries the given LogFields.
+// Fields that are empty in the argument are inherited from the parent context.
+func WithLogFields(ctx context.Context, fields LogFields) context.Context {
+	merged := LogFieldsFromContext(ctx)
+	if fields.Account != "" {
+		merged.Account = fields.Account
+	}
+	if fields.RequestID != "" {
+		merged.RequestID = fields.RequestID
+	}
+	return context.WithValue(ctx, logFieldsContextKey{}, merged)
+}
+
+// LogFieldsFromContext returns the LogFields attached to this context by WithLogFields().
+func LogFieldsFromContext(ctx context.Context) LogFields {
+	fields, _ := ctx.Value(logFieldsContextKey{}).(LogFields)
+	return fields
+}
+
+// LogInfo is like logg.Info, but attaches the LogFields from the given context
+// to the log line if the JSON log format is used.
+func LogInfo(ctx context.Context, msg string, args ...any) {
+	logWithFields(ctx, "INFO", msg, args...)
+}
+
+// LogError is like logg.Error, but attaches the LogFields from the given
+// context to the log line if the JSON log format is used.
+func LogError(ctx context.Context, msg string, args ...any) {
+	logWithFields(ctx, "ERROR", msg, args...)
+}
+
+func logWithFields(ctx context.Context, level, msg string, args ...any) {
+	if len(args) > 0 {
+		msg = fmt.Sprintf(msg, args...)
+	}
+	w := currentJSONLogWriter
+	if w == nil {
+		// in text format, the fields are not shown since the message usually contains them already
+		logg.Other(level, "%s", msg)
+		return
+	}
+
+	fields := LogFieldsFromContext(ctx)
+	record := w.newRecord(level, msg)
+	record.Account = fields.Account
+	record.RequestID = fields.RequestID
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	err := w.writeRecord(record)
+	if err != nil {
+		// the log output is broken, so there is nowhere else to report this
+		fmt.Fprintf(os.Stderr, "cannot write log line: %s\n", err.Error())
+	}
+}
+
+type jsonLogWriter struct {
+	mutex  sync.Mutex
+	out    io.Writer
+	now    func() time.Time
+	buffer bytes.Buffer
+}
+
+// This is only set when the JSON log format is used. It is used by LogInfo()
+// and LogError() to write records with LogFields directly, without going
+// through package logg.
+var currentJSONLogWriter *jsonLogWriter
+
+// newJSONLogWriter returns an io.Writer that converts lines written by package
+// logg into JSON log records (see type JSONLogRecord).
+func newJSONLogWriter(out io.Writer, now func() time.Time) *jsonLogWriter {
+	return &jsonLogWriter{out: out, now: now}
+}
+
+// useJSONLogWriter makes the given writer the target of all log output.
+// Passing nil restores the default output of package logg.
+func useJSONLogWriter(w *jsonLogWriter) {
+	currentJSONLogWriter = w
+	if w == nil {
+		logg.SetLogger(stdlog.New(stdlog.Writer(), stdlog.Prefix(), stdlog.Flags()))
+	} else {
+		logg.SetLogger(stdlog.New(w, "", 0))
+	}
+}
+
+// Write implements the io.Writer interface.
+func (w *jsonLogWriter) Write(data []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	// stdlog.Logger writes exactly one line per call, but we do not want to rely on this
+	w.buffer.Write(data)
+	for {
+		line, err := w.buffer.ReadString('\n')
+		if err != nil {
+			// incomplete line -> keep it for the next call
+			w.buffer.Reset()
+			w.buffer.WriteString(line)
+			return len(data), nil
+		}
+		err = w.writeRecord(w.buildRecordFromLine(strings.TrimSuffix(line, "\n")))
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// writeRecord must be called with w.mutex held.
+func (w *jsonLogWriter) writeRecord(record JSONLogRecord) error {
+	buf, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w.out, string(buf))
+	return err
+}
+
+func (w *jsonLogWriter) newRecord(level, msg string) JSONLogRecord {
+	return JSONLogRecord{
+		Timestamp: w.now().UTC().Format(time.RFC3339Nano),
+		Level:     level,
+		Task:      bininfo.Component(),
+		Message:   msg,
+	}
+}
+
+func (w *jsonLogWriter) buildRecordFromLine(line string) JSONLogRecord {
+	record := w.newRecord("INFO", line)
+	if match := logLevelRx.FindStringSubmatch(line); match != nil {
+		record.Level = match[1]
+		record.Message = match[2]
+	}
+
+	if record.Level == "REQUEST" {
+		match := logRequestRx.FindStringSubmatch(record.Message)
+		if match != nil {
+			record.Request = &JSONLogRequest{
+				RemoteAddr: match[1],
+				Method:     match[2],
+				URL:        match[3],
+				UserAgent:  match[6],
+				Duration:   match[7],
+			}
+			// the regex ensures that these are valid integers
+			record.Request.Status, _ = strconv.Atoi(match[4])
+			record.Request.BodySize, _ = strconv.Atoi(match[5])
+		}
+	}
+
+	return record
+}
@@ -0,0 +1,46 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package keppel
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-api-declarations/bininfo"
+	"github.com/sapcc/go-bits/logg"
+)
+
+func TestJSONLogFormat(t *testing.T) {
+	var buf bytes.Buffer
+	now := func() time.Time { return time.Unix(42, 0) }
+	useJSONLogWriter(newJSONLogWriter(&buf, now))
+	defer useJSONLogWriter(nil)
+	bininfo.SetTaskName("janitor")
+	defer bininfo.SetTaskName("")
+
+	// log lines from package logg do not carry any structured fields, even if they mention an account
+	logg.Info("sweeping %d blobs in account %s", 3, "test1")
+	logg.Other("REQUEST", `%s - - "%s %s %s" %03d %d "%s" "%s" %.3fs`,
+		"192.0.2.1", "GET", "/v2/test1/foo/manifests/latest", "HTTP/1.1", 200, 1234, "-", "docker/27.0", 0.042)
+	logg.Info("multi-line\nmessage")
+
+	// log lines with structured fields
+	ctx := WithLogFields(context.Background(), LogFields{RequestID: "req-1"})
+	LogInfo(ctx, "no account here")
+	ctx = WithLogFields(ctx, LogFields{Account: "test2"})
+	LogError(ctx, "cannot announce account %q to federation: %s", "test2", "connection refused")
+
+	component := bininfo.Component()
+	expected := `{"timestamp":"1970-01-01T00:00:42Z","level":"INFO","task":"` + component + `","message":"sweeping 3 blobs in account test1"}
+{"timestamp":"1970-01-01T00:00:42Z","level":"REQUEST","task":"` + component + `","message":"192.0.2.1 - - \"GET /v2/test1/foo/manifests/latest HTTP/1.1\" 200 1234 \"-\" \"docker/27.0\" 0.042s","request":{"remote_addr":"192.0.2.1","method":"GET","url":"/v2/test1/foo/manifests/latest","status":200,"body_size":1234,"user_agent":"docker/27.0","duration":"0.042s"}}
+{"timestamp":"1970-01-01T00:00:42Z","level":"INFO","task":"` + component + `","message":"multi-line\\nmessage"}
+{"timestamp":"1970-01-01T00:00:42Z","level":"INFO","task":"` + component + `","message":"no account here","request_id":"req-1"}
+{"timestamp":"1970-01-01T00:00:42Z","level":"ERROR","task":"` + component + `","message":"cannot announce account \"test2\" to federation: connection refused","account":"test2","request_id":"req-1"}
+`
+	if buf.String() != expected {
+		t.Errorf("expected log output:\n%s\nbut got:\n%s", expected, buf.String())
+	}
+}
@@ -4,7 +4,10 @@
 package keppel
 
 import (
+	"encoding/json"
 	"fmt"
+	"mime"
+	"slices"
 
 	"github.com/sapcc/keppel/internal/models"
 
@@ -80,6 +83,56 @@ func ParseManifest(mediaType string, contents []byte) (ParsedManifest, error) {
 	}
 }
 
+// ParseManifest works like the package-level ParseManifest(), but also accepts
+// manifests with other media types (or only with one of the
+// OpaqueManifestMediaTypes, if those are configured). Those are stored as
+// opaque artifact manifests that do not reference any blobs or manifests.
+//
+// Accounts with StrictMediaTypes reject manifests with unknown media types
+// before they get here.
+func (cfg Configuration) ParseManifest(mediaType string, contents []byte) (ParsedManifest, error) {
+	if IsKnownManifestMediaType(mediaType) || !cfg.isOpaqueManifestMediaTypeAllowed(mediaType) {
+		return ParseManifest(mediaType, contents)
+	}
+
+	// since we do not track any references for opaque artifact manifests, we
+	// must not accept manifests that actually reference blobs or other manifests
+	// (e.g. image manifests pushed with a wrong Content-Type); otherwise the
+	// blobs referenced by them could be garbage-collected
+	var probe struct {
+		MediaType string          `json:"mediaType"`
+		Config    json.RawMessage `json:"config"`
+		Layers    json.RawMessage `json:"layers"`
+		Manifests json.RawMessage `json:"manifests"`
+		Blobs     json.RawMessage `json:"blobs"`
+	}
+	err := json.Unmarshal(contents, &probe)
+	if err == nil {
+		if IsKnownManifestMediaType(probe.MediaType) {
+			return nil, fmt.Errorf("manifest media type %q does not match the media type %q declared in the manifest", mediaType, probe.MediaType)
+		}
+		if probe.Config != nil || probe.Layers != nil || probe.Manifests != nil || probe.Blobs != nil {
+			return nil, fmt.Errorf("manifest with opaque media type %q must not reference blobs or manifests", mediaType)
+		}
+	}
+	return opaqueManifestAdapter{}, nil
+}
+
+func (cfg Configuration) isOpaqueManifestMediaTypeAllowed(mediaType string) bool {
+	if len(cfg.OpaqueManifestMediaTypes) > 0 {
+		return slices.Contains(cfg.OpaqueManifestMediaTypes, mediaType)
+	}
+	_, _, err := mime.ParseMediaType(mediaType)
+	return err == nil
+}
+
+// IsKnownManifestMediaType returns whether the given media type is one of
+// ManifestMediaTypes, i.e. whether ParseManifest() can interpret manifests of
+// this type.
+func IsKnownManifestMediaType(mediaType string) bool {
+	return slices.Contains(ManifestMediaTypes, mediaType)
+}
+
 // v2ManifestListAdapter provides the ParsedManifest interface for the contained type.
 type v2ManifestListAdapter struct {
 	m *manifest.Schema2List
@@ -285,3 +338,41 @@ func (a ociManifestAdapter) ManifestReferences(pf models.PlatformFilter) []image
 func (a ociManifestAdapter) AcceptableAlternates(pf models.PlatformFilter) []imagespecs.Descriptor {
 	return nil
 }
+
+// opaqueManifestAdapter provides the ParsedManifest interface for manifests
+// with a media type that we do not know how to interpret (see
+// Configuration.ParseManifest). Such manifests do not reference any blobs or
+// other manifests as far as Keppel is concerned.
+type opaqueManifestAdapter struct{}
+
+func (a opaqueManifestAdapter) BlobReferences() []manifest.LayerInfo {
+	return nil
+}
+
+func (a opaqueManifestAdapter) FindImageConfigBlob() *types.BlobInfo {
+	return nil
+}
+
+func (a opaqueManifestAdapter) FindImageLayerBlobs() []manifest.LayerInfo {
+	return nil
+}
+
+func (a opaqueManifestAdapter) GetAnnotations() map[string]string {
+	return nil
+}
+
+func (a opaqueManifestAdapter) GetArtifactType() string {
+	return ""
+}
+
+func (a opaqueManifestAdapter) GetSubject() *imagespecs.Descriptor {
+	return nil
+}
+
+func (a opaqueManifestAdapter) ManifestReferences(pf models.PlatformFilter) []imagespecs.Descriptor {
+	return nil
+}
+
+func (a opaqueManifestAdapter) AcceptableAlternates(pf models.PlatformFilter) []imagespecs.Descriptor {
+	return nil
+}
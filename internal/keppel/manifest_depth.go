@@ -0,0 +1,99 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package keppel
+
+import (
+	"github.com/go-gorp/gorp/v3"
+	"github.com/opencontainers/go-digest"
+
+	"github.com/sapcc/keppel/internal/models"
+)
+
+// ErrManifestReferencesTooDeep returns the error that is reported when
+// manifests are nested more deeply than allowed by
+// Configuration.MaxManifestReferenceDepth.
+func ErrManifestReferencesTooDeep(maxDepth int) *RegistryV2Error {
+	return ErrManifestInvalid.With("manifest references are nested more than %d levels deep", maxDepth)
+}
+
+// ErrManifestReferencesCycle returns the error that is reported when a
+// manifest (indirectly) references itself.
+func ErrManifestReferencesCycle(manifestDigest digest.Digest) *RegistryV2Error {
+	return ErrManifestInvalid.With("manifest references form a cycle involving %s", manifestDigest)
+}
+
+const manifestChildrenGetQuery = `SELECT child_digest FROM manifest_manifest_refs WHERE repo_id = $1 AND parent_digest = $2`
+
+// CheckManifestReferenceDepth checks that the manifest with the given digest,
+// when referencing the given child manifests, is not part of a reference
+// chain that is longer than maxDepth, and that it does not reference itself.
+// The references of the child manifests are loaded from the DB.
+//
+// Each manifest is only loaded from the DB once, so shared submanifests do not
+// cause exponential runtime, and the recursion depth is bounded by maxDepth
+// even if the DB contains cyclic references.
+func CheckManifestReferenceDepth(db gorp.SqlExecutor, repo models.Repository, manifestDigest digest.Digest, childDigests []digest.Digest, maxDepth int) error {
+	w := manifestDepthWalker{
+		db:         db,
+		repoID:     repo.ID,
+		maxDepth:   maxDepth,
+		depths:     make(map[digest.Digest]int),
+		inProgress: map[digest.Digest]bool{manifestDigest: true},
+	}
+	for _, childDigest := range childDigests {
+		_, err := w.depthBelow(childDigest, 1)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type manifestDepthWalker struct {
+	db       gorp.SqlExecutor
+	repoID   int64
+	maxDepth int
+	// depths contains the length of the longest reference chain below each
+	// manifest that was fully visited so far
+	depths map[digest.Digest]int
+	// inProgress contains the manifests on the current path (to detect cycles)
+	inProgress map[digest.Digest]bool
+}
+
+// Returns the length of the longest reference chain below the given manifest,
+// which is located at the given level below the root manifest.
+func (w *manifestDepthWalker) depthBelow(manifestDigest digest.Digest, level int) (int, error) {
+	if level > w.maxDepth {
+		return 0, ErrManifestReferencesTooDeep(w.maxDepth)
+	}
+	if w.inProgress[manifestDigest] {
+		return 0, ErrManifestReferencesCycle(manifestDigest)
+	}
+	depth, wasVisited := w.depths[manifestDigest]
+	if wasVisited {
+		if level+depth > w.maxDepth {
+			return 0, ErrManifestReferencesTooDeep(w.maxDepth)
+		}
+		return depth, nil
+	}
+
+	w.inProgress[manifestDigest] = true
+	defer delete(w.inProgress, manifestDigest)
+
+	var childDigests []digest.Digest
+	_, err := w.db.Select(&childDigests, manifestChildrenGetQuery, w.repoID, manifestDigest)
+	if err != nil {
+		return 0, err
+	}
+	for _, childDigest := range childDigests {
+		childDepth, err := w.depthBelow(childDigest, level+1)
+		if err != nil {
+			return 0, err
+		}
+		depth = max(depth, childDepth+1)
+	}
+
+	w.depths[manifestDigest] = depth
+	return depth, nil
+}
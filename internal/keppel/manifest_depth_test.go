@@ -0,0 +1,89 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package keppel
+
+import (
+	"testing"
+
+	"github.com/go-gorp/gorp/v3"
+	"github.com/opencontainers/go-digest"
+	"github.com/sapcc/go-bits/assert"
+
+	"github.com/sapcc/keppel/internal/models"
+)
+
+// manifestRefsTestExecutor serves the manifest_manifest_refs table from a map
+// and counts how often each manifest's children were queried. All other
+// methods of gorp.SqlExecutor panic when called.
+type manifestRefsTestExecutor struct {
+	gorp.SqlExecutor
+	Children    map[digest.Digest][]digest.Digest
+	SelectCalls map[digest.Digest]int
+}
+
+func (e *manifestRefsTestExecutor) Select(holder any, query string, args ...any) ([]any, error) {
+	parentDigest := args[1].(digest.Digest)
+	e.SelectCalls[parentDigest]++
+	*holder.(*[]digest.Digest) = e.Children[parentDigest]
+	return nil, nil
+}
+
+func TestCheckManifestReferenceDepth(t *testing.T) {
+	d := func(name string) digest.Digest { return digest.FromString(name) }
+	repo := models.Repository{ID: 1, AccountName: "test1", Name: "foo"}
+
+	// a chain of indexes: "chain3" -> "chain2" -> "chain1" -> "image"
+	// plus a diamond: "diamond" -> {"left", "right"} -> "chain1" -> "image"
+	// plus a cycle: "cycle1" -> "cycle2" -> "cycle1"
+	db := &manifestRefsTestExecutor{
+		Children: map[digest.Digest][]digest.Digest{
+			d("chain1"):  {d("image")},
+			d("chain2"):  {d("chain1")},
+			d("chain3"):  {d("chain2")},
+			d("left"):    {d("chain1")},
+			d("right"):   {d("chain1"), d("image")},
+			d("diamond"): {d("left"), d("right")},
+			d("cycle1"):  {d("cycle2")},
+			d("cycle2"):  {d("cycle1")},
+		},
+		SelectCalls: make(map[digest.Digest]int),
+	}
+	check := func(manifestDigest digest.Digest, childDigests []digest.Digest, maxDepth int) error {
+		t.Helper()
+		clear(db.SelectCalls)
+		return CheckManifestReferenceDepth(db, repo, manifestDigest, childDigests, maxDepth)
+	}
+	expectError := func(err error, expected string) {
+		t.Helper()
+		if err == nil {
+			t.Errorf("expected error %q, but got no error", expected)
+		} else {
+			assert.DeepEqual(t, "error", err.Error(), expected)
+		}
+	}
+
+	// pushing an index on top of "chain3" yields a depth of 4
+	err := check(d("new"), []digest.Digest{d("chain3")}, 4)
+	assert.DeepEqual(t, "error", err, nil)
+	err = check(d("new"), []digest.Digest{d("chain3")}, 3)
+	expectError(err, "manifest references are nested more than 3 levels deep")
+
+	// in a diamond, the longest path counts, and shared submanifests are only visited once
+	err = check(d("new"), []digest.Digest{d("diamond")}, 4)
+	assert.DeepEqual(t, "error", err, nil)
+	assert.DeepEqual(t, "queries for shared submanifest", db.SelectCalls[d("chain1")], 1)
+	err = check(d("new"), []digest.Digest{d("diamond")}, 3)
+	expectError(err, "manifest references are nested more than 3 levels deep")
+
+	// the depth limit also applies when a submanifest was already visited on a shorter path
+	err = check(d("new"), []digest.Digest{d("chain1"), d("chain3")}, 3)
+	expectError(err, "manifest references are nested more than 3 levels deep")
+
+	// cycles are detected...
+	err = check(d("new"), []digest.Digest{d("cycle1")}, 10)
+	expectError(err, "manifest references form a cycle involving "+d("cycle1").String())
+	// ...including those that involve the new manifest itself
+	err = check(d("chain1"), []digest.Digest{d("chain3")}, 10)
+	expectError(err, "manifest references form a cycle involving "+d("chain1").String())
+}
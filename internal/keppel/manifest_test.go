@@ -0,0 +1,108 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package keppel
+
+import (
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+)
+
+func TestParseOpaqueManifest(t *testing.T) {
+	cfg := Configuration{OpaqueManifestMediaTypes: []string{"application/vnd.example.artifact.v1+json"}}
+
+	testCases := []struct {
+		MediaType    string
+		Contents     string
+		ErrorMessage string
+	}{
+		// allowlisted media type without references
+		{"application/vnd.example.artifact.v1+json", `{"payload":"hello"}`, ""},
+		{"application/vnd.example.artifact.v1+json", `not JSON at all`, ""},
+		// media types that are not allowlisted
+		{"application/vnd.example.other.v1+json", `{"payload":"hello"}`, `unsupported manifest media type: "application/vnd.example.other.v1+json"`},
+		{"text/plain", `hello`, `unsupported manifest media type: "text/plain"`},
+		// allowlisted media type, but contents look like an image manifest or index
+		{
+			"application/vnd.example.artifact.v1+json",
+			`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json"}`,
+			`manifest media type "application/vnd.example.artifact.v1+json" does not match the media type "application/vnd.oci.image.manifest.v1+json" declared in the manifest`,
+		},
+		{
+			"application/vnd.example.artifact.v1+json",
+			`{"schemaVersion":2,"layers":[]}`,
+			`manifest with opaque media type "application/vnd.example.artifact.v1+json" must not reference blobs or manifests`,
+		},
+		{
+			"application/vnd.example.artifact.v1+json",
+			`{"blobs":[{"digest":"sha256:0000000000000000000000000000000000000000000000000000000000000000"}]}`,
+			`manifest with opaque media type "application/vnd.example.artifact.v1+json" must not reference blobs or manifests`,
+		},
+	}
+
+	for _, tc := range testCases {
+		parsed, err := cfg.ParseManifest(tc.MediaType, []byte(tc.Contents))
+		if tc.ErrorMessage == "" {
+			if err != nil {
+				t.Errorf("unexpected error for %q: %s", tc.Contents, err.Error())
+				continue
+			}
+			assert.DeepEqual(t, "blob references", len(parsed.BlobReferences()), 0)
+		} else {
+			if err == nil {
+				t.Errorf("expected error %q for %q, but got no error", tc.ErrorMessage, tc.Contents)
+				continue
+			}
+			assert.DeepEqual(t, "error", err.Error(), tc.ErrorMessage)
+		}
+	}
+
+}
+
+func TestParseOpaqueManifestWithDefaultConfiguration(t *testing.T) {
+	// without an explicit allowlist, all valid media types are accepted, but the
+	// contents are checked in the same way
+	cfg := Configuration{}
+
+	testCases := []struct {
+		MediaType    string
+		Contents     string
+		ErrorMessage string
+	}{
+		{"application/vnd.example.artifact.v1+json", `{"payload":"hello"}`, ""},
+		{"application/vnd.example.other.v1+json", `{"payload":"hello"}`, ""},
+		{"text/plain", `hello`, ""},
+		// invalid media types
+		{"", `{}`, `unsupported manifest media type: ""`},
+		{"not a media type", `{}`, `unsupported manifest media type: "not a media type"`},
+		// contents look like an image manifest or index
+		{
+			"application/octet-stream",
+			`{"schemaVersion":2,"mediaType":"application/vnd.docker.distribution.manifest.v2+json"}`,
+			`manifest media type "application/octet-stream" does not match the media type "application/vnd.docker.distribution.manifest.v2+json" declared in the manifest`,
+		},
+		{
+			"application/octet-stream",
+			`{"schemaVersion":2,"manifests":[]}`,
+			`manifest with opaque media type "application/octet-stream" must not reference blobs or manifests`,
+		},
+	}
+
+	for _, tc := range testCases {
+		parsed, err := cfg.ParseManifest(tc.MediaType, []byte(tc.Contents))
+		if tc.ErrorMessage == "" {
+			if err != nil {
+				t.Errorf("unexpected error for %q: %s", tc.Contents, err.Error())
+				continue
+			}
+			assert.DeepEqual(t, "blob references", len(parsed.BlobReferences()), 0)
+		} else {
+			if err == nil {
+				t.Errorf("expected error %q for %q, but got no error", tc.ErrorMessage, tc.Contents)
+				continue
+			}
+			assert.DeepEqual(t, "error", err.Error(), tc.ErrorMessage)
+		}
+	}
+}
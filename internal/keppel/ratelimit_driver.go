@@ -56,6 +56,18 @@ type RateLimitDriver interface {
 	GetRateLimit(account models.ReducedAccount, action RateLimitedAction) Option[redis_rate.Limit]
 }
 
+// AnonymousRateLimitDriver is an optional interface that a RateLimitDriver can
+// implement to subject anonymous users to separate (usually stricter) rate
+// limits. Since anonymous users cannot be attributed to an auth tenant, these
+// rate limits apply per client IP address across all accounts.
+type AnonymousRateLimitDriver interface {
+	RateLimitDriver
+
+	// GetAnonymousRateLimit shall return None if anonymous users are subject to
+	// the regular rate limit for the given action.
+	GetAnonymousRateLimit(action RateLimitedAction) Option[redis_rate.Limit]
+}
+
 // RateLimitDriverRegistry is a pluggable.Registry for RateLimitDriver implementations.
 var RateLimitDriverRegistry pluggable.Registry[RateLimitDriver]
 
@@ -81,8 +93,22 @@ type RateLimitEngine struct {
 }
 
 // RateLimitAllows checks whether the given action on the given account is allowed by
-// the account's rate limit.
-func (e RateLimitEngine) RateLimitAllows(ctx context.Context, remoteAddr string, account models.ReducedAccount, action RateLimitedAction, amount uint64) (*redis_rate.Result, error) {
+// the account's rate limit. The rate limit is shared by all users of the
+// account, no matter which address their requests come from.
+//
+// If the driver implements AnonymousRateLimitDriver and has a rate limit for
+// anonymous users, requests by anonymous users are checked against that rate
+// limit instead.
+func (e RateLimitEngine) RateLimitAllows(ctx context.Context, remoteAddr string, account models.ReducedAccount, userType UserType, action RateLimitedAction, amount uint64) (*redis_rate.Result, error) {
+	if userType == AnonymousUser {
+		if ard, ok := e.Driver.(AnonymousRateLimitDriver); ok {
+			if rateQuota, ok := ard.GetAnonymousRateLimit(action).Unpack(); ok {
+				key := fmt.Sprintf("keppel-ratelimit-anonymous-%s-%s", remoteAddr, string(action))
+				return e.allowN(ctx, key, rateQuota, amount)
+			}
+		}
+	}
+
 	rateQuota, ok := e.Driver.GetRateLimit(account, action).Unpack()
 	if !ok {
 		// no rate limit for this account and action
@@ -95,6 +121,14 @@ func (e RateLimitEngine) RateLimitAllows(ctx context.Context, remoteAddr string,
 		}, nil
 	}
 
+	// authenticated users are rate-limited per account regardless of where their
+	// requests come from (the auth tenant ID is included for when an account
+	// is deleted and its name is reused in a different auth tenant)
+	key := fmt.Sprintf("keppel-ratelimit-%s-%s-%s", account.AuthTenantID, account.Name, string(action))
+	return e.allowN(ctx, key, rateQuota, amount)
+}
+
+func (e RateLimitEngine) allowN(ctx context.Context, key string, rateQuota redis_rate.Limit, amount uint64) (*redis_rate.Result, error) {
 	// AllowN needs to take `amount` as an int; if this cast overflows, we fail
 	// the entire ratelimit check to be safe (this should never be a problem in
 	// practice because int is 64 bits wide)
@@ -111,7 +145,6 @@ func (e RateLimitEngine) RateLimitAllows(ctx context.Context, remoteAddr string,
 	}
 
 	limiter := redis_rate.NewLimiter(e.Client)
-	key := fmt.Sprintf("keppel-ratelimit-%s-%s-%s", remoteAddr, account.Name, string(action))
 	result, err := limiter.AllowN(ctx, key, rateQuota, int(amount))
 	if err != nil {
 		return &redis_rate.Result{}, err
@@ -4,10 +4,13 @@
 package keppel
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
+	"regexp/syntax"
+	"slices"
 
 	"github.com/sapcc/go-bits/regexpext"
 
@@ -17,11 +20,49 @@ import (
 // RBACPolicy is a policy granting user-defined access to repos in an account.
 // It is stored in serialized form in the RBACPoliciesJSON field of type Account.
 type RBACPolicy struct {
-	CidrPattern          string                  `json:"match_cidr,omitempty"`
-	RepositoryPattern    regexpext.BoundedRegexp `json:"match_repository,omitempty"`
-	UserNamePattern      regexpext.BoundedRegexp `json:"match_username,omitempty"`
-	Permissions          []RBACPermission        `json:"permissions"`
-	ForbiddenPermissions []RBACPermission        `json:"forbidden_permissions,omitempty"`
+	CidrPattern                string                  `json:"match_cidr,omitempty"`
+	RepositoryPattern          regexpext.BoundedRegexp `json:"match_repository,omitempty"`
+	ForbiddenRepositoryPattern regexpext.BoundedRegexp `json:"forbid_repository,omitempty"`
+	UserNamePattern            regexpext.BoundedRegexp `json:"match_username,omitempty"`
+	TagPattern                 regexpext.BoundedRegexp `json:"match_tag,omitempty"`
+	Permissions                []RBACPermission        `json:"permissions"`
+	ForbiddenPermissions       []RBACPermission        `json:"forbidden_permissions,omitempty"`
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+//
+// Unlike for other policy types, the regexes in RBAC policies are not
+// validated during unmarshalling. This is done in ValidateAndNormalize instead,
+// so that invalid patterns are reported as a validation error of the policy
+// (and thus result in 422 instead of 400 from the account API).
+func (r *RBACPolicy) UnmarshalJSON(buf []byte) error {
+	var data struct {
+		CidrPattern                string           `json:"match_cidr,omitempty"`
+		RepositoryPattern          string           `json:"match_repository,omitempty"`
+		ForbiddenRepositoryPattern string           `json:"forbid_repository,omitempty"`
+		UserNamePattern            string           `json:"match_username,omitempty"`
+		TagPattern                 string           `json:"match_tag,omitempty"`
+		Permissions                []RBACPermission `json:"permissions"`
+		ForbiddenPermissions       []RBACPermission `json:"forbidden_permissions,omitempty"`
+	}
+	// the decoder in the account API disallows unknown fields, but this setting does not propagate into custom unmarshalers
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&data)
+	if err != nil {
+		return err
+	}
+
+	*r = RBACPolicy{
+		CidrPattern:                data.CidrPattern,
+		RepositoryPattern:          regexpext.BoundedRegexp(data.RepositoryPattern),
+		ForbiddenRepositoryPattern: regexpext.BoundedRegexp(data.ForbiddenRepositoryPattern),
+		UserNamePattern:            regexpext.BoundedRegexp(data.UserNamePattern),
+		TagPattern:                 regexpext.BoundedRegexp(data.TagPattern),
+		Permissions:                data.Permissions,
+		ForbiddenPermissions:       data.ForbiddenPermissions,
+	}
+	return nil
 }
 
 // RBACPermission enumerates permissions that can be granted by an RBAC policy.
@@ -43,7 +84,9 @@ var isRBACPermission = map[RBACPermission]bool{
 	RBACAnonymousFirstPullPermission: true,
 }
 
-// Matches evaluates the cidr and regexes in this policy.
+// Matches evaluates the cidr and regexes in this policy, except for the tag
+// regex, which is evaluated by MatchesTag, and the "forbid_repository" regex,
+// which is evaluated by EffectivePermissions.
 func (r RBACPolicy) Matches(ip, repoName, userName string) bool {
 	if r.CidrPattern != "" {
 		ip := net.ParseIP(ip)
@@ -63,9 +106,81 @@ func (r RBACPolicy) Matches(ip, repoName, userName string) bool {
 	return true
 }
 
+// maxRBACPatternSize is the maximum number of instructions in the compiled form
+// of a regex in an RBAC policy. Since Go regexes are evaluated in linear time,
+// there is no risk of catastrophic backtracking, but large repetition counts
+// (e.g. "(a{1000}){1000}" or, within the limits of the regex parser,
+// "([a-z]+/){0,500}") still blow up into huge programs that need to be
+// evaluated for every RBAC policy on every auth request.
+const maxRBACPatternSize = 1000
+
+func validateRBACPattern(attribute string, rx regexpext.BoundedRegexp) error {
+	if rx == "" {
+		return nil
+	}
+	compiled, err := rx.Regexp()
+	if err != nil {
+		return fmt.Errorf("invalid %q attribute in RBAC policy: %w", attribute, err)
+	}
+	parsed, err := syntax.Parse(compiled.String(), syntax.Perl)
+	if err != nil {
+		return fmt.Errorf("invalid %q attribute in RBAC policy: %w", attribute, err)
+	}
+	prog, err := syntax.Compile(parsed.Simplify())
+	if err != nil {
+		return fmt.Errorf("invalid %q attribute in RBAC policy: %w", attribute, err)
+	}
+	if len(prog.Inst) > maxRBACPatternSize {
+		return fmt.Errorf("invalid %q attribute in RBAC policy: %q is too complex", attribute, string(rx))
+	}
+	return nil
+}
+
+// MatchesTag evaluates the tag regex in this policy.
+// Policies without a tag regex match all tags.
+func (r RBACPolicy) MatchesTag(tagName string) bool {
+	return r.TagPattern == "" || r.TagPattern.MatchString(tagName)
+}
+
+// EffectivePermissions returns the permissions granted and forbidden by this
+// policy for the given repository, assuming that Matches() is true.
+//
+// For repositories matching "forbid_repository", all permissions that the
+// policy would otherwise grant are forbidden instead. Since forbidding
+// overrides take precedence over granting overrides, this allows for
+// default-allow-with-exceptions patterns like "anonymous pull on everything
+// except secret-*".
+func (r RBACPolicy) EffectivePermissions(repoName string) (granted, forbidden []RBACPermission) {
+	if r.ForbiddenRepositoryPattern != "" && r.ForbiddenRepositoryPattern.MatchString(repoName) {
+		return nil, append(slices.Clone(r.ForbiddenPermissions), r.Permissions...)
+	}
+	return r.Permissions, r.ForbiddenPermissions
+}
+
 // ValidateAndNormalize performs some normalizations and returns an error if
 // this policy is invalid.
+//
+// The "match_repository", "forbid_repository", "match_username" and
+// "match_tag" regexes are always matched against the full repository name,
+// user name or tag name, i.e. they are implicitly anchored at both ends.
 func (r *RBACPolicy) ValidateAndNormalize(strategy ReplicationStrategy) error {
+	err := validateRBACPattern("match_repository", r.RepositoryPattern)
+	if err != nil {
+		return err
+	}
+	err = validateRBACPattern("forbid_repository", r.ForbiddenRepositoryPattern)
+	if err != nil {
+		return err
+	}
+	err = validateRBACPattern("match_username", r.UserNamePattern)
+	if err != nil {
+		return err
+	}
+	err = validateRBACPattern("match_tag", r.TagPattern)
+	if err != nil {
+		return err
+	}
+
 	if r.CidrPattern != "" {
 		_, network, err := net.ParseCIDR(r.CidrPattern)
 		if err != nil {
@@ -104,9 +219,12 @@ func (r *RBACPolicy) ValidateAndNormalize(strategy ReplicationStrategy) error {
 	if len(r.Permissions) == 0 && len(r.ForbiddenPermissions) == 0 {
 		return errors.New(`RBAC policy must grant at least one permission`)
 	}
-	if r.CidrPattern == "" && r.UserNamePattern == "" && r.RepositoryPattern == "" {
+	if r.CidrPattern == "" && r.UserNamePattern == "" && r.RepositoryPattern == "" && r.ForbiddenRepositoryPattern == "" && r.TagPattern == "" {
 		return errors.New(`RBAC policy must have at least one "match_..." attribute`)
 	}
+	if r.ForbiddenRepositoryPattern != "" && len(r.Permissions) == 0 {
+		return errors.New(`RBAC policy with "forbid_repository" must grant at least one permission`)
+	}
 	if (refersToPerm[RBACAnonymousPullPermission] || refersToPerm[RBACAnonymousFirstPullPermission]) && r.UserNamePattern != "" {
 		return errors.New(`RBAC policy with "anonymous_pull" or "anonymous_first_pull" may not have the "match_username" attribute`)
 	}
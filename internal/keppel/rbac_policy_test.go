@@ -0,0 +1,111 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package keppel
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+)
+
+func TestRBACPolicyRepositoryPatternIsAnchored(t *testing.T) {
+	policy := RBACPolicy{RepositoryPattern: "library/.*", Permissions: []RBACPermission{RBACAnonymousPullPermission}}
+	assert.DeepEqual(t, "validation error", policy.ValidateAndNormalize(NoReplicationStrategy), error(nil))
+
+	testCases := map[string]bool{
+		"library/alpine":         true,
+		"library/":               true,
+		"mirror/library/alpine":  false,
+		"library":                false,
+		"otherlibrary/alpine":    false,
+		"foo/library/alpine/bar": false,
+	}
+	for repoName, expected := range testCases {
+		assert.DeepEqual(t, "match result for "+repoName, policy.Matches("1.2.3.4", repoName, ""), expected)
+	}
+}
+
+func TestRBACPolicyInvalidPatterns(t *testing.T) {
+	testCases := map[string]string{
+		// syntax error
+		`{"match_repository":"*/library","permissions":["anonymous_pull"]}`: "invalid \"match_repository\" attribute in RBAC policy: \"*/library\" is not a valid regexp: error parsing regexp: missing argument to repetition operator: `*`",
+		// nested repetitions are rejected by the regex parser already
+		`{"match_username":"(a{1000}){1000}","permissions":["pull"]}`: "invalid \"match_username\" attribute in RBAC policy: \"(a{1000}){1000}\" is not a valid regexp: error parsing regexp: invalid repeat count: `{1000}`",
+		// large repetition counts are accepted by the parser, but compile into huge programs
+		`{"match_repository":"([a-z]+/){0,500}","permissions":["anonymous_pull"]}`: `invalid "match_repository" attribute in RBAC policy: "([a-z]+/){0,500}" is too complex`,
+	}
+	for input, expectedMessage := range testCases {
+		// invalid patterns must not be rejected during unmarshalling, but only during validation
+		var policy RBACPolicy
+		err := json.Unmarshal([]byte(input), &policy)
+		if err != nil {
+			t.Fatalf("unexpected error while unmarshalling %s: %s", input, err.Error())
+		}
+
+		err = policy.ValidateAndNormalize(NoReplicationStrategy)
+		if err == nil {
+			t.Errorf("expected validation of %s to fail, but it succeeded", input)
+		} else {
+			assert.DeepEqual(t, "validation error for "+input, err.Error(), expectedMessage)
+		}
+	}
+
+	// pathological regexes that would cause catastrophic backtracking in other regex engines
+	// are harmless for Go's linear-time regex engine, and thus accepted
+	policy := RBACPolicy{RepositoryPattern: "(a+)+b", Permissions: []RBACPermission{RBACAnonymousPullPermission}}
+	assert.DeepEqual(t, "validation error", policy.ValidateAndNormalize(NoReplicationStrategy), error(nil))
+	assert.DeepEqual(t, "match result", policy.Matches("", "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaac", ""), false)
+
+	// unknown fields are still rejected
+	var policy2 RBACPolicy
+	err := json.Unmarshal([]byte(`{"match_repository":"library/.*","permissions":["anonymous_pull"],"unknown_field":42}`), &policy2)
+	if err == nil {
+		t.Error("expected unmarshalling with unknown field to fail, but it succeeded")
+	}
+}
+
+func TestRBACPolicyMatchesTag(t *testing.T) {
+	policy := RBACPolicy{TagPattern: "dev-.*", Permissions: []RBACPermission{RBACAnonymousPullPermission}}
+	assert.DeepEqual(t, "validation error", policy.ValidateAndNormalize(NoReplicationStrategy), error(nil))
+	assert.DeepEqual(t, "match result for dev-1", policy.MatchesTag("dev-1"), true)
+	assert.DeepEqual(t, "match result for latest", policy.MatchesTag("latest"), false)
+	assert.DeepEqual(t, "match result for my-dev-1", policy.MatchesTag("my-dev-1"), false)
+
+	// policies without a tag pattern match all tags
+	policy = RBACPolicy{RepositoryPattern: "library/.*", Permissions: []RBACPermission{RBACAnonymousPullPermission}}
+	assert.DeepEqual(t, "match result for latest", policy.MatchesTag("latest"), true)
+
+	policy = RBACPolicy{TagPattern: "dev-(", Permissions: []RBACPermission{RBACAnonymousPullPermission}}
+	err := policy.ValidateAndNormalize(NoReplicationStrategy)
+	assert.DeepEqual(t, "validation error", err.Error(), "invalid \"match_tag\" attribute in RBAC policy: \"dev-(\" is not a valid regexp: error parsing regexp: missing closing ): `^(?:dev-()$`")
+}
+
+func TestRBACPolicyEffectivePermissions(t *testing.T) {
+	policy := RBACPolicy{
+		ForbiddenRepositoryPattern: "secret-.*",
+		UserNamePattern:            "correct.*",
+		Permissions:                []RBACPermission{RBACPullPermission},
+		ForbiddenPermissions:       []RBACPermission{RBACDeletePermission},
+	}
+	assert.DeepEqual(t, "validation error", policy.ValidateAndNormalize(NoReplicationStrategy), error(nil))
+
+	granted, forbidden := policy.EffectivePermissions("library/alpine")
+	assert.DeepEqual(t, "granted permissions", granted, []RBACPermission{RBACPullPermission})
+	assert.DeepEqual(t, "forbidden permissions", forbidden, []RBACPermission{RBACDeletePermission})
+
+	// within repos matching "forbid_repository", grants turn into restrictions
+	granted, forbidden = policy.EffectivePermissions("secret-data")
+	assert.DeepEqual(t, "granted permissions", granted, []RBACPermission(nil))
+	assert.DeepEqual(t, "forbidden permissions", forbidden, []RBACPermission{RBACDeletePermission, RBACPullPermission})
+
+	// "forbid_repository" is pointless without any grants
+	policy = RBACPolicy{
+		ForbiddenRepositoryPattern: "secret-.*",
+		UserNamePattern:            "correct.*",
+		ForbiddenPermissions:       []RBACPermission{RBACPullPermission},
+	}
+	err := policy.ValidateAndNormalize(NoReplicationStrategy)
+	assert.DeepEqual(t, "validation error", err.Error(), `RBAC policy with "forbid_repository" must grant at least one permission`)
+}
@@ -7,17 +7,34 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"strings"
+	"time"
 
-	"maps"
-
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sapcc/go-bits/logg"
 )
 
-// When reverse-proxying, these headers from the client request will be
-// forwarded. All other client headers will be discarded.
-var reverseProxyHeaders = []string{
-	"Accept",
-	"Authorization",
+var (
+	reverseProxyRequestsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "keppel_anycast_forwarded_requests",
+			Help: "Counts anycast requests that were reverse-proxied to a peer.",
+		},
+		[]string{"peer_hostname", "outcome"},
+	)
+	reverseProxyDurationHistogram = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "keppel_anycast_forwarding_duration_seconds",
+			Help:    "Time until a peer responds to a reverse-proxied anycast request (not including the transfer of the response body).",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"peer_hostname"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(reverseProxyRequestsCounter)
+	prometheus.MustRegister(reverseProxyDurationHistogram)
 }
 
 // ReverseProxyAnycastRequestToPeer takes a http.Request for the anycast API and
@@ -50,17 +67,46 @@ func (cfg Configuration) ReverseProxyAnycastRequestToPeer(w http.ResponseWriter,
 	if err != nil {
 		return err
 	}
-	for _, headerName := range reverseProxyHeaders {
-		req.Header[headerName] = r.Header[headerName]
+	// only forward the configured headers from the client request (all other
+	// client headers are discarded)
+	//
+	// NOTE: If Accept-Encoding is forwarded, http.Transport does not decompress
+	// the response, so the compressed body is passed through to the client
+	// together with its Content-Encoding header. If not, http.Transport may
+	// negotiate compression on its own, but then it also decompresses the
+	// response body and removes Content-Encoding.
+	for _, headerName := range cfg.ReverseProxyForwardedHeaderNames() {
+		if values, exists := r.Header[headerName]; exists {
+			req.Header[headerName] = values
+		}
 	}
 	req.Header.Set("X-Keppel-Forwarded-By", cfg.APIPublicHostname)
+	// record metrics for all outcomes, including error responses from the peer
+	startedAt := time.Now()
 	resp, err := client.Do(req)
+	peerLabel := cfg.peerMetricLabel(peerHostName)
+	reverseProxyDurationHistogram.With(prometheus.Labels{"peer_hostname": peerLabel}).Observe(time.Since(startedAt).Seconds())
+	var outcome string
+	switch {
+	case err != nil:
+		outcome = "failure"
+	case resp.StatusCode >= 400:
+		outcome = "error_status"
+	default:
+		outcome = "success"
+	}
+	reverseProxyRequestsCounter.With(prometheus.Labels{"peer_hostname": peerLabel, "outcome": outcome}).Inc()
 	if err != nil {
 		return err
 	}
 
-	// forward response to caller
-	maps.Copy(w.Header(), resp.Header)
+	// forward response to caller (except for headers that could leak
+	// peer-internal information)
+	for name, values := range resp.Header {
+		if !cfg.IsReverseProxyStrippedHeader(name) {
+			w.Header()[name] = values
+		}
+	}
 	w.WriteHeader(resp.StatusCode)
 
 	// forward response body to caller, if any
@@ -78,3 +124,17 @@ func (cfg Configuration) ReverseProxyAnycastRequestToPeer(w http.ResponseWriter,
 
 	return nil
 }
+
+// peerMetricLabel maps the hostname of a reverse-proxy target to the
+// hostname of the configured peer that it belongs to. The target hostname may
+// have an account name prefix because of domain remapping (see
+// auth.Audience.MapPeerHostname). Unknown hostnames are reported as "other"
+// to keep the label cardinality bounded.
+func (cfg Configuration) peerMetricLabel(hostName string) string {
+	for _, peerHostName := range cfg.PeerHostNames {
+		if hostName == peerHostName || strings.HasSuffix(hostName, "."+peerHostName) {
+			return peerHostName
+		}
+	}
+	return "other"
+}
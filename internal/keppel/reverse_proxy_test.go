@@ -0,0 +1,276 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package keppel
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/sapcc/go-bits/assert"
+)
+
+// setupReverseProxyPeer starts a mock peer that serves `handler` over HTTPS
+// and makes http.DefaultTransport trust it. Returns the peer's hostname.
+func setupReverseProxyPeer(t *testing.T, handler http.HandlerFunc) string {
+	t.Helper()
+	srv := httptest.NewTLSServer(handler)
+	t.Cleanup(srv.Close)
+
+	origTransport := http.DefaultTransport
+	http.DefaultTransport = srv.Client().Transport
+	t.Cleanup(func() { http.DefaultTransport = origTransport })
+
+	return strings.TrimPrefix(srv.URL, "https://")
+}
+
+func TestReverseProxyMetrics(t *testing.T) {
+	peerHostName := setupReverseProxyPeer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/test1/foo/manifests/missing" {
+			http.Error(w, "not found", http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusOK)
+		}
+	})
+	cfg := Configuration{
+		APIPublicHostname: "registry.example.org",
+		PeerHostNames:     []string{"registry.example.com", peerHostName},
+	}
+
+	getCount := func(peer, outcome string) float64 {
+		t.Helper()
+		var m dto.Metric
+		err := reverseProxyRequestsCounter.With(prometheus.Labels{"peer_hostname": peer, "outcome": outcome}).Write(&m)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return m.GetCounter().GetValue()
+	}
+	forward := func(path, target string) error {
+		r := httptest.NewRequest(http.MethodGet, path, http.NoBody)
+		return cfg.ReverseProxyAnycastRequestToPeer(httptest.NewRecorder(), r, target)
+	}
+
+	// successful and failed responses are both counted
+	for _, path := range []string{"/v2/test1/foo/manifests/latest", "/v2/test1/foo/manifests/missing"} {
+		err := forward(path, peerHostName)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	assert.DeepEqual(t, "success count", getCount(peerHostName, "success"), 1.0)
+	assert.DeepEqual(t, "error_status count", getCount(peerHostName, "error_status"), 1.0)
+
+	// network errors are counted as well (port 1 is not expected to be listening)
+	err := forward("/v2/test1/foo/manifests/latest", "127.0.0.1:1")
+	if err == nil {
+		t.Error("expected error when forwarding to unreachable peer, but got none")
+	}
+	assert.DeepEqual(t, "failure count", getCount("other", "failure"), 1.0)
+
+	// the latency histogram has one observation per request
+	var m dto.Metric
+	err = reverseProxyDurationHistogram.With(prometheus.Labels{"peer_hostname": peerHostName}).(prometheus.Histogram).Write(&m)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "histogram sample count", m.GetHistogram().GetSampleCount(), uint64(2))
+
+	// peer labels are restricted to the configured peers (including domain-remapped hostnames)
+	assert.DeepEqual(t, "peer label", cfg.peerMetricLabel("registry.example.com"), "registry.example.com")
+	assert.DeepEqual(t, "peer label", cfg.peerMetricLabel("test1.registry.example.com"), "registry.example.com")
+	assert.DeepEqual(t, "peer label", cfg.peerMetricLabel("attacker.example.net"), "other")
+	assert.DeepEqual(t, "peer label", cfg.peerMetricLabel("notregistry.example.com"), "other")
+}
+
+func TestReverseProxyStripsHeaders(t *testing.T) {
+	peerHostName := setupReverseProxyPeer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+		w.Header().Set("Docker-Content-Digest", "sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855")
+		w.Header().Set("Set-Cookie", "session=secret")
+		w.Header().Set("Server", "keppel-internal/1.2.3")
+		w.Header().Set("X-Internal-Node", "node-4")
+		w.WriteHeader(http.StatusOK)
+	})
+
+	forward := func(cfg Configuration) http.Header {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodGet, "/v2/test1/foo/manifests/latest", http.NoBody)
+		w := httptest.NewRecorder()
+		err := cfg.ReverseProxyAnycastRequestToPeer(w, r, peerHostName)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return w.Result().Header
+	}
+	expectHeaders := func(hdr http.Header, expected map[string]bool) {
+		t.Helper()
+		for name, isExpected := range expected {
+			assert.DeepEqual(t, "presence of "+name, hdr.Get(name) != "", isExpected)
+		}
+	}
+
+	// by default, a sensible set of headers is stripped
+	hdr := forward(Configuration{APIPublicHostname: "registry.example.org"})
+	expectHeaders(hdr, map[string]bool{
+		"Content-Type":          true,
+		"Docker-Content-Digest": true,
+		"Set-Cookie":            false,
+		"Server":                false,
+		"X-Internal-Node":       true,
+	})
+
+	// the denylist can be configured (header names are case-insensitive)
+	hdr = forward(Configuration{
+		APIPublicHostname:           "registry.example.org",
+		ReverseProxyStrippedHeaders: []string{"set-cookie", "x-internal-node"},
+	})
+	expectHeaders(hdr, map[string]bool{
+		"Content-Type":          true,
+		"Docker-Content-Digest": true,
+		"Set-Cookie":            false,
+		"Server":                true,
+		"X-Internal-Node":       false,
+	})
+
+	// an empty denylist disables stripping entirely
+	hdr = forward(Configuration{
+		APIPublicHostname:           "registry.example.org",
+		ReverseProxyStrippedHeaders: []string{},
+	})
+	expectHeaders(hdr, map[string]bool{
+		"Content-Type":          true,
+		"Docker-Content-Digest": true,
+		"Set-Cookie":            true,
+		"Server":                true,
+		"X-Internal-Node":       true,
+	})
+}
+
+func TestReverseProxyForwardsHeaders(t *testing.T) {
+	var receivedHeader http.Header
+	peerHostName := setupReverseProxyPeer(t, func(w http.ResponseWriter, r *http.Request) {
+		receivedHeader = r.Header.Clone()
+		w.WriteHeader(http.StatusOK)
+	})
+
+	forward := func(cfg Configuration) {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodGet, "/v2/test1/foo/blobs/sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", http.NoBody)
+		r.Header.Set("Accept", "application/octet-stream")
+		r.Header.Set("Authorization", "Bearer foo")
+		r.Header.Set("Range", "bytes=0-99")
+		r.Header.Set("User-Agent", "docker/27.0")
+		r.Header.Set("X-Secret", "only forward if configured")
+		err := cfg.ReverseProxyAnycastRequestToPeer(httptest.NewRecorder(), r, peerHostName)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	// by default, Accept, Accept-Encoding, Authorization and Range are forwarded
+	forward(Configuration{APIPublicHostname: "registry.example.org"})
+	assert.DeepEqual(t, "Accept", receivedHeader.Get("Accept"), "application/octet-stream")
+	assert.DeepEqual(t, "Authorization", receivedHeader.Get("Authorization"), "Bearer foo")
+	assert.DeepEqual(t, "Range", receivedHeader.Get("Range"), "bytes=0-99")
+	assert.DeepEqual(t, "X-Secret", receivedHeader.Get("X-Secret"), "")
+	assert.DeepEqual(t, "X-Keppel-Forwarded-By", receivedHeader.Get("X-Keppel-Forwarded-By"), "registry.example.org")
+
+	// the list can be configured (header names are case-insensitive)
+	forward(Configuration{
+		APIPublicHostname:            "registry.example.org",
+		ReverseProxyForwardedHeaders: []string{"authorization", "x-secret"},
+	})
+	assert.DeepEqual(t, "Accept", receivedHeader.Get("Accept"), "")
+	assert.DeepEqual(t, "Authorization", receivedHeader.Get("Authorization"), "Bearer foo")
+	assert.DeepEqual(t, "Range", receivedHeader.Get("Range"), "")
+	assert.DeepEqual(t, "X-Secret", receivedHeader.Get("X-Secret"), "only forward if configured")
+}
+
+func TestParseHeaderNames(t *testing.T) {
+	t.Setenv("KEPPEL_TEST_HEADERS", " Range, user-agent ,,")
+	names, err := parseHeaderNames("KEPPEL_TEST_HEADERS")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "header names", names, []string{"Range", "user-agent"})
+
+	t.Setenv("KEPPEL_TEST_HEADERS", "Range,X Foo")
+	_, err = parseHeaderNames("KEPPEL_TEST_HEADERS")
+	if err == nil || err.Error() != `malformed KEPPEL_TEST_HEADERS: invalid header name "X Foo"` {
+		t.Errorf("expected error for invalid header name, but got %v", err)
+	}
+
+	// the User-Agent header cannot be forwarded since outgoing requests always carry our own
+	t.Setenv("KEPPEL_TEST_HEADERS", " Range, user-agent ,,")
+	_, err = parseForwardedHeaderNames("KEPPEL_TEST_HEADERS")
+	if err == nil || err.Error() != `malformed KEPPEL_TEST_HEADERS: the "user-agent" header cannot be forwarded` {
+		t.Errorf("expected error for forwarding User-Agent, but got %v", err)
+	}
+	t.Setenv("KEPPEL_TEST_HEADERS", "Authorization,Range")
+	names, err = parseForwardedHeaderNames("KEPPEL_TEST_HEADERS")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "header names", names, []string{"Authorization", "Range"})
+}
+
+func TestReverseProxyPassesThroughCompression(t *testing.T) {
+	manifest := strings.Repeat(`{"mediaType":"application/vnd.oci.image.manifest.v1+json"}`, 100)
+	peerHostName := setupReverseProxyPeer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(manifest)) //nolint:errcheck
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		w.WriteHeader(http.StatusOK)
+		gw := gzip.NewWriter(w)
+		gw.Write([]byte(manifest)) //nolint:errcheck
+		gw.Close()
+	})
+	cfg := Configuration{APIPublicHostname: "registry.example.org"}
+
+	forward := func(acceptEncoding string) *http.Response {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodGet, "/v2/test1/foo/manifests/latest", http.NoBody)
+		if acceptEncoding != "" {
+			r.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		w := httptest.NewRecorder()
+		err := cfg.ReverseProxyAnycastRequestToPeer(w, r, peerHostName)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return w.Result()
+	}
+
+	// if the client accepts gzip, the compressed response is passed through as-is
+	resp := forward("gzip")
+	assert.DeepEqual(t, "Content-Encoding", resp.Header.Get("Content-Encoding"), "gzip")
+	gr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	buf, err := io.ReadAll(gr)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "decompressed body", string(buf), manifest)
+
+	// if the client does not accept compression, it gets the uncompressed body
+	resp = forward("")
+	assert.DeepEqual(t, "Content-Encoding", resp.Header.Get("Content-Encoding"), "")
+	buf, err = io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "body", string(buf), manifest)
+}
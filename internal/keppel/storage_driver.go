@@ -9,6 +9,7 @@ import (
 	"encoding/hex"
 	"errors"
 	"io"
+	"math"
 
 	. "github.com/majewsky/gg/option"
 	"github.com/opencontainers/go-digest"
@@ -85,6 +86,13 @@ type StorageDriver interface {
 	// eventual consistency.
 	ListStorageContents(ctx context.Context, account models.ReducedAccount) (blobs []StoredBlobInfo, manifests []StoredManifestInfo, trivyReports []StoredTrivyReportInfo, err error)
 
+	// StorageCapacity reports how many bytes are used in the storage across all
+	// accounts, and how many bytes can be stored in total. If the storage does not
+	// have a fixed size limit, `total` shall be UnlimitedStorageCapacity.
+	// Implementations that cannot determine their capacity shall return
+	// ErrCapacityUnknown.
+	StorageCapacity(ctx context.Context) (used, total uint64, err error)
+
 	// This method is called before a new account is set up in the DB. The
 	// StorageDriver can use this opportunity to check for any reasons why the
 	// account would not be functional once it is persisted in our DB.
@@ -126,6 +134,14 @@ var ErrAuthDriverMismatch = errors.New("given AuthDriver is not supported by thi
 // StorageDriver does not support blob URLs.
 var ErrCannotGenerateURL = errors.New("URLForBlob() is not supported")
 
+// ErrCapacityUnknown is returned by StorageDriver.StorageCapacity() when the
+// StorageDriver cannot report its capacity.
+var ErrCapacityUnknown = errors.New("StorageCapacity() is not supported")
+
+// UnlimitedStorageCapacity is returned as `total` by
+// StorageDriver.StorageCapacity() when the storage does not have a fixed size limit.
+const UnlimitedStorageCapacity = math.MaxUint64
+
 // StorageDriverRegistry is a pluggable.Registry for StorageDriver implementations.
 var StorageDriverRegistry pluggable.Registry[StorageDriver]
 
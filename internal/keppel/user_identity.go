@@ -4,7 +4,9 @@
 package keppel
 
 import (
+	"encoding/json"
 	"fmt"
+	"slices"
 
 	"github.com/sapcc/go-bits/audittools"
 	"github.com/sapcc/go-bits/pluggable"
@@ -37,6 +39,7 @@ type UserIdentity interface {
 	pluggable.Plugin
 
 	// Returns whether the given auth tenant grants the given permission to this user.
+	// For CanAdministrateCluster, the tenant ID is empty.
 	// The AnonymousUserIdentity always returns false.
 	HasPermission(perm Permission, tenantID string) bool
 
@@ -74,3 +77,61 @@ func DeserializeUserIdentity(typeID string, payload []byte, ad AuthDriver) (User
 	err := uid.DeserializeFromJSON(payload, ad)
 	return uid, err
 }
+
+// TenantPermissionsIdentity is a partial implementation of UserIdentity for
+// regular users whose permissions are listed per auth tenant, e.g. because
+// they are granted by the auth driver's configuration based on group
+// memberships. Auth drivers embed it into their own UserIdentity type, which
+// only needs to add PluginTypeID() and DeserializeFromJSON(). The latter can
+// be implemented by unmarshaling the payload into this type.
+type TenantPermissionsIdentity struct {
+	Name string `json:"name"`
+	// key = auth tenant ID
+	Permissions map[string][]Permission `json:"perms"`
+}
+
+// Grant adds the given permissions in the given auth tenant.
+func (uid *TenantPermissionsIdentity) Grant(authTenantID string, perms []Permission) {
+	if uid.Permissions == nil {
+		uid.Permissions = make(map[string][]Permission)
+	}
+	for _, perm := range perms {
+		if !slices.Contains(uid.Permissions[authTenantID], perm) {
+			uid.Permissions[authTenantID] = append(uid.Permissions[authTenantID], perm)
+		}
+	}
+}
+
+// HasPermission implements the UserIdentity interface.
+func (uid *TenantPermissionsIdentity) HasPermission(perm Permission, tenantID string) bool {
+	if perm == CanAdministrateCluster {
+		// this permission is not tied to an auth tenant, so it can be granted in any auth tenant
+		for _, perms := range uid.Permissions {
+			if slices.Contains(perms, perm) {
+				return tenantID == ""
+			}
+		}
+		return false
+	}
+	return slices.Contains(uid.Permissions[tenantID], perm)
+}
+
+// UserType implements the UserIdentity interface.
+func (uid *TenantPermissionsIdentity) UserType() UserType {
+	return RegularUser
+}
+
+// UserName implements the UserIdentity interface.
+func (uid *TenantPermissionsIdentity) UserName() string {
+	return uid.Name
+}
+
+// UserInfo implements the UserIdentity interface.
+func (uid *TenantPermissionsIdentity) UserInfo() audittools.UserInfo {
+	return nil
+}
+
+// SerializeToJSON implements the UserIdentity interface.
+func (uid *TenantPermissionsIdentity) SerializeToJSON() (payload []byte, err error) {
+	return json.Marshal(uid)
+}
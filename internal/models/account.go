@@ -27,11 +27,32 @@ type Account struct {
 	ExternalPeerPassword string `db:"external_peer_password"`
 	// PlatformFilter restricts which submanifests get replicated when a list manifest is replicated.
 	PlatformFilter PlatformFilter `db:"platform_filter"`
+	// ManifestCacheTTLSecs is only set for external replica accounts. If non-zero, tags that were
+	// replicated more than this many seconds ago are re-resolved from upstream on pull.
+	ManifestCacheTTLSecs int64 `db:"manifest_cache_ttl_secs"`
+	// ManifestTrashRetentionSecs is how long deleted manifests are kept in the trash before being
+	// deleted permanently. If zero, manifests are deleted immediately.
+	ManifestTrashRetentionSecs int64 `db:"manifest_trash_retention_secs"`
 
 	// RuleForManifest is a CEL expression for validating each image manifest in this account.
 	RuleForManifest string `db:"rule_for_manifest"`
+	// StrictMediaTypes indicates whether pushes of manifests with media types not known to Keppel are rejected.
+	StrictMediaTypes bool `db:"strict_media_types"`
+	// ValidateOnPush indicates whether pushed blobs are read back from the storage and validated before the push is acknowledged.
+	ValidateOnPush bool `db:"validate_on_push"`
+	// IsCreating indicates whether the account is still being set up, i.e. its name has not yet been
+	// claimed in the federation driver or its backing storage has not yet been confirmed.
+	IsCreating bool `db:"is_creating"`
 	// IsDeleting indicates whether the account is currently being deleted.
 	IsDeleting bool `db:"is_deleting"`
+	// IsReadOnly indicates whether writes into the account are currently forbidden, e.g. during storage maintenance.
+	IsReadOnly bool `db:"is_read_only"`
+	// IsPullDisabled indicates whether pulls from the account are currently forbidden.
+	IsPullDisabled bool `db:"is_pull_disabled"`
+	// IsPushDisabled indicates whether pushes into the account are currently forbidden.
+	IsPushDisabled bool `db:"is_push_disabled"`
+	// IsAnycastDisabled indicates whether the account is hidden from the anycast API.
+	IsAnycastDisabled bool `db:"is_anycast_disabled"`
 	// IsManaged indicates if the account was created by AccountManagementDriver
 	IsManaged bool `db:"is_managed"`
 
@@ -43,26 +64,40 @@ type Account struct {
 	SecurityScanPoliciesJSON string `db:"security_scan_policies_json"`
 	// TagPoliciesJSON contains a JSON string of []keppel.TagPolicy, or the empty string.
 	TagPoliciesJSON string `db:"tag_policies_json"`
+	// LabelsJSON contains a JSON string of map[string]string, or the empty string.
+	LabelsJSON string `db:"labels_json"`
 
+	CreationStartedAt            Option[time.Time] `db:"creation_started_at"`             // see tasks.AbandonedAccountCreationCleanupJob
 	NextBlobSweepedAt            Option[time.Time] `db:"next_blob_sweep_at"`              // see tasks.BlobSweepJob
 	NextDeletionAttemptAt        Option[time.Time] `db:"next_deletion_attempt_at"`        // see tasks.AccountDeletionJob
 	NextEnforcementAt            Option[time.Time] `db:"next_enforcement_at"`             // see tasks.CreateManagedAccountsJob
 	NextStorageSweepedAt         Option[time.Time] `db:"next_storage_sweep_at"`           // see tasks.StorageSweepJob
 	NextFederationAnnouncementAt Option[time.Time] `db:"next_federation_announcement_at"` // see tasks.AnnounceAccountToFederationJob
+	NextIntegrityReportAt        Option[time.Time] `db:"next_integrity_report_at"`        // see tasks.IntegrityReportJob
 }
 
 // Reduced converts an Account into a ReducedAccount.
 func (a Account) Reduced() ReducedAccount {
 	return ReducedAccount{
-		Name:                 a.Name,
-		AuthTenantID:         a.AuthTenantID,
-		UpstreamPeerHostName: a.UpstreamPeerHostName,
-		ExternalPeerURL:      a.ExternalPeerURL,
-		ExternalPeerUserName: a.ExternalPeerUserName,
-		ExternalPeerPassword: a.ExternalPeerPassword,
-		PlatformFilter:       a.PlatformFilter,
-		RuleForManifest:      a.RuleForManifest,
-		IsDeleting:           a.IsDeleting,
+		Name:                       a.Name,
+		AuthTenantID:               a.AuthTenantID,
+		UpstreamPeerHostName:       a.UpstreamPeerHostName,
+		ExternalPeerURL:            a.ExternalPeerURL,
+		ExternalPeerUserName:       a.ExternalPeerUserName,
+		ExternalPeerPassword:       a.ExternalPeerPassword,
+		PlatformFilter:             a.PlatformFilter,
+		ManifestCacheTTLSecs:       a.ManifestCacheTTLSecs,
+		ManifestTrashRetentionSecs: a.ManifestTrashRetentionSecs,
+		RuleForManifest:            a.RuleForManifest,
+		StrictMediaTypes:           a.StrictMediaTypes,
+		ValidateOnPush:             a.ValidateOnPush,
+		IsCreating:                 a.IsCreating,
+		IsDeleting:                 a.IsDeleting,
+		IsReadOnly:                 a.IsReadOnly,
+		IsPullDisabled:             a.IsPullDisabled,
+		IsPushDisabled:             a.IsPushDisabled,
+		IsAnycastDisabled:          a.IsAnycastDisabled,
+		RBACPoliciesJSON:           a.RBACPoliciesJSON,
 	}
 }
 
@@ -79,10 +114,24 @@ type ReducedAccount struct {
 	ExternalPeerUserName string
 	ExternalPeerPassword string
 	PlatformFilter       PlatformFilter
+	ManifestCacheTTLSecs int64
+
+	// deletion policy
+	ManifestTrashRetentionSecs int64
 
 	// validation policy, status
-	RuleForManifest string
-	IsDeleting      bool
+	RuleForManifest   string
+	StrictMediaTypes  bool
+	ValidateOnPush    bool
+	IsCreating        bool
+	IsDeleting        bool
+	IsReadOnly        bool
+	IsPullDisabled    bool
+	IsPushDisabled    bool
+	IsAnycastDisabled bool
+
+	// access control (needed for evaluating RBAC policies with match_tag on tag-addressed requests)
+	RBACPoliciesJSON string
 
 	// NOTE: When adding or removing fields, always adjust Account.Reduced() and keppel.FindReducedAccount() too!
 }
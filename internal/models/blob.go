@@ -30,14 +30,23 @@ type Blob struct {
 	PushedAt               time.Time         `db:"pushed_at"`
 	NextValidationAt       time.Time         `db:"next_validation_at"` // see tasks.BlobValidationJob
 	ValidationErrorMessage string            `db:"validation_error_message"`
+	LastValidatedAt        Option[time.Time] `db:"last_validated_at"` // see tasks.BlobValidationJob
 	CanBeDeletedAt         Option[time.Time] `db:"can_be_deleted_at"` // see tasks.BlobSweepJob
 	BlocksVulnScanning     Option[bool]      `db:"blocks_vuln_scanning"`
+	// NextMediaTypeBackfillAt is only set for blobs that were pushed before
+	// media types of blobs were recorded (see tasks.BlobMediaTypeBackfillJob).
+	NextMediaTypeBackfillAt Option[time.Time] `db:"next_media_type_backfill_at"`
 }
 
-// SafeMediaType returns the MediaType field, but falls back to "application/octet-stream" if it is empty.
-func (b Blob) SafeMediaType() string {
+// DefaultBlobMediaType is the media type reported for blobs whose media type
+// is not known, unless configured otherwise.
+const DefaultBlobMediaType = "application/octet-stream"
+
+// SafeMediaType returns the MediaType field, but falls back to the given media type if it is empty.
+// Most callers should use keppel.Configuration.BlobMediaType() instead, which supplies the configured fallback.
+func (b Blob) SafeMediaType(fallback string) string {
 	if b.MediaType == "" {
-		return "application/octet-stream"
+		return fallback
 	}
 	return b.MediaType
 }
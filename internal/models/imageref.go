@@ -4,10 +4,13 @@
 package models
 
 import (
+	"errors"
 	"fmt"
 	"net/url"
+	"regexp"
 	"strings"
 
+	. "github.com/majewsky/gg/option"
 	"github.com/opencontainers/go-digest"
 )
 
@@ -16,6 +19,9 @@ const (
 	defaultTagName  = "latest"
 )
 
+// tagNameRx matches the tag names that are accepted by ParseImageReference.
+var tagNameRx = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}$`)
+
 // ImageReference refers to an image that can be pulled from a registry.
 type ImageReference struct {
 	Host      string // either a plain hostname or a host:port like "example.org:443"
@@ -51,11 +57,39 @@ func (r ImageReference) String() string {
 // Both on success and on error, an additional string is returned indicating how
 // the input was interpreted (e.g. which defaults were inferred). This can be
 // shown to the user to help them understand how the reference was parsed.
+//
+// If the input does not include a tag or digest, the tag "latest" is implied.
+// Inputs that consist only of a tag or digest (like ":3.9" or "@sha256:...")
+// are rejected since they do not name a repository. Use
+// ParseImageReferenceWithBase to parse those.
 func ParseImageReference(input string) (ImageReference, string, error) {
+	return ParseImageReferenceWithBase(input, None[ImageReference]())
+}
+
+// ParseImageReferenceWithBase is like ParseImageReference, but additionally
+// accepts inputs that consist only of a tag or digest (like ":3.9" or
+// "@sha256:..."), as commonly found in CI logs. These are interpreted as
+// referring to the host and repository of the given base reference.
+func ParseImageReferenceWithBase(input string, base Option[ImageReference]) (ImageReference, string, error) {
+	switch {
+	case input == "":
+		return ImageReference{}, input, errors.New("image reference may not be empty")
+	case strings.HasPrefix(input, "@"), strings.HasPrefix(input, ":"):
+		return parseBareManifestReference(input, base)
+	}
+
 	// prepend hostname for default registry if input does not include a hostname or host:port
 	inputParts := strings.SplitN(input, "/", 2)
 	hadNoHostName := false
 	if len(inputParts) == 1 || !looksLikeHostName(inputParts[0]) {
+		if len(inputParts) == 1 && looksLikeBareHostName(input) {
+			// e.g. "registry.example.org" or "localhost:5000" could be meant as a
+			// hostname with the repository missing, or as a repository on the default registry
+			return ImageReference{}, input, fmt.Errorf(
+				"ambiguous image reference: %q looks like a hostname, but does not name a repository (to refer to a repository on %s, write %q instead)",
+				input, defaultHostName, defaultHostName+"/"+input,
+			)
+		}
 		input = fmt.Sprintf("%s/%s", defaultHostName, input)
 		hadNoHostName = true
 	}
@@ -72,9 +106,12 @@ func ParseImageReference(input string) (ImageReference, string, error) {
 	case strings.Contains(imageURL.Path, "@"):
 		// input references a digest
 		pathParts := ImageReferenceRx.FindStringSubmatch(imageURL.Path)
+		if pathParts == nil {
+			return ImageReference{}, input, fmt.Errorf("invalid image reference: %q", imageURL.Path)
+		}
 		parsedDigest, err := digest.Parse(pathParts[len(pathParts)-1])
 		if err != nil {
-			return ImageReference{}, input, fmt.Errorf("invalid digest: %q", ref.Reference)
+			return ImageReference{}, input, fmt.Errorf("invalid digest: %q", pathParts[len(pathParts)-1])
 		}
 		ref = ImageReference{
 			Host:      imageURL.Host,
@@ -84,6 +121,9 @@ func ParseImageReference(input string) (ImageReference, string, error) {
 	case strings.Contains(imageURL.Path, ":"):
 		// input references a tag name
 		pathParts := strings.SplitN(imageURL.Path, ":", 2)
+		if !tagNameRx.MatchString(pathParts[1]) {
+			return ImageReference{}, input, fmt.Errorf("invalid tag name: %q", pathParts[1])
+		}
 		ref = ImageReference{
 			Host:      imageURL.Host,
 			RepoName:  strings.TrimPrefix(pathParts[0], "/"),
@@ -94,7 +134,7 @@ func ParseImageReference(input string) (ImageReference, string, error) {
 		ref = ImageReference{
 			Host:      imageURL.Host,
 			RepoName:  strings.TrimPrefix(imageURL.Path, "/"),
-			Reference: ManifestReference{Tag: "latest"},
+			Reference: ManifestReference{Tag: defaultTagName},
 		}
 	}
 
@@ -110,7 +150,51 @@ func ParseImageReference(input string) (ImageReference, string, error) {
 		}
 	}
 
-	return ref, input, nil
+	return ref, ref.interpretation(), nil
+}
+
+// parseBareManifestReference implements ParseImageReferenceWithBase for
+// inputs like ":3.9" or "@sha256:...".
+func parseBareManifestReference(input string, base Option[ImageReference]) (ImageReference, string, error) {
+	baseRef, ok := base.Unpack()
+	if !ok {
+		return ImageReference{}, input, fmt.Errorf(
+			"ambiguous image reference: %q does not name a repository (please provide a full reference like \"registry.example.org/library/alpine%s\")",
+			input, input,
+		)
+	}
+
+	var ref ManifestReference
+	if strings.HasPrefix(input, "@") {
+		parsedDigest, err := digest.Parse(strings.TrimPrefix(input, "@"))
+		if err != nil {
+			return ImageReference{}, input, fmt.Errorf("invalid digest: %q", strings.TrimPrefix(input, "@"))
+		}
+		ref = ManifestReference{Digest: parsedDigest}
+	} else {
+		tagName := strings.TrimPrefix(input, ":")
+		if !tagNameRx.MatchString(tagName) {
+			return ImageReference{}, input, fmt.Errorf("invalid tag name: %q", tagName)
+		}
+		ref = ManifestReference{Tag: tagName}
+	}
+
+	result := ImageReference{
+		Host:      baseRef.Host,
+		RepoName:  baseRef.RepoName,
+		Reference: ref,
+	}
+	return result, result.interpretation(), nil
+}
+
+// interpretation returns a string representation of this reference where
+// no defaults are elided, for use as the interpretation string returned by
+// ParseImageReference.
+func (r ImageReference) interpretation() string {
+	if r.Reference.IsDigest() {
+		return fmt.Sprintf("docker-pullable://%s/%s@%s", r.Host, r.RepoName, r.Reference.Digest)
+	}
+	return fmt.Sprintf("docker-pullable://%s/%s:%s", r.Host, r.RepoName, r.Reference.Tag)
 }
 
 func looksLikeHostName(host string) bool {
@@ -120,3 +204,8 @@ func looksLikeHostName(host string) bool {
 	}
 	return strings.Contains(host, ".") || host == "localhost"
 }
+
+func looksLikeBareHostName(input string) bool {
+	host, _, _ := strings.Cut(input, ":")
+	return strings.Contains(host, ".") || host == "localhost"
+}
@@ -7,6 +7,7 @@ import (
 	"strings"
 	"testing"
 
+	. "github.com/majewsky/gg/option"
 	"github.com/sapcc/go-bits/assert"
 )
 
@@ -29,6 +30,7 @@ func TestParseImageReferenceSuccess(t *testing.T) {
 	}
 	references := []string{
 		"sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+		"sha512:cf83e1357eefb8bdf1542850d66d8007d620e4050b5715dc83f4a921d36ce9ce47d0d13c5d85f2b0ff8318d2877eec2f63b931bd47417a81a538327af927da3e",
 		"qux",
 		"123",
 		"latest",
@@ -79,3 +81,135 @@ func TestParseImageReferenceLabelDigestSuccess(t *testing.T) {
 		t.Logf("input interpretation was: %s", interpretation)
 	}
 }
+
+func TestParseImageReferenceInvalidDigest(t *testing.T) {
+	inputs := []string{
+		"registry.example.org/foo@sha256:abc",
+		"registry.example.org/foo@md5:d41d8cd98f00b204e9800998ecf8427e",
+	}
+	for _, input := range inputs {
+		_, _, err := ParseImageReference(input)
+		if err == nil {
+			t.Errorf("expected %s to not parse, but got no error", input)
+		}
+	}
+}
+
+func TestParseImageReferenceInterpretation(t *testing.T) {
+	digest := "sha256:e9707504ad0d4c119036b6d41ace4a33596139d3feb9ccb6617813ce48c3eeef"
+	base := Some(ImageReference{"registry.example.org", "foo/bar", ManifestReference{Tag: "1.0"}})
+
+	testCases := []struct {
+		Input                  string
+		Base                   Option[ImageReference]
+		ExpectedRef            ImageReference
+		ExpectedInterpretation string
+	}{
+		// full references
+		{
+			Input:                  "registry.example.org/foo/bar:1.0",
+			ExpectedRef:            ImageReference{"registry.example.org", "foo/bar", ManifestReference{Tag: "1.0"}},
+			ExpectedInterpretation: "docker-pullable://registry.example.org/foo/bar:1.0",
+		},
+		{
+			Input:                  "localhost:5000/foo@" + digest,
+			ExpectedRef:            ImageReference{"localhost:5000", "foo", ParseManifestReference(digest)},
+			ExpectedInterpretation: "docker-pullable://localhost:5000/foo@" + digest,
+		},
+		// references without tag use the default tag
+		{
+			Input:                  "registry.example.org/foo/bar",
+			ExpectedRef:            ImageReference{"registry.example.org", "foo/bar", ManifestReference{Tag: "latest"}},
+			ExpectedInterpretation: "docker-pullable://registry.example.org/foo/bar:latest",
+		},
+		{
+			Input:                  "alpine",
+			ExpectedRef:            ImageReference{defaultHostName, "library/alpine", ManifestReference{Tag: "latest"}},
+			ExpectedInterpretation: "docker-pullable://registry-1.docker.io/library/alpine:latest",
+		},
+		// bare tags and digests are resolved against the base reference
+		{
+			Input:                  ":2.0",
+			Base:                   base,
+			ExpectedRef:            ImageReference{"registry.example.org", "foo/bar", ManifestReference{Tag: "2.0"}},
+			ExpectedInterpretation: "docker-pullable://registry.example.org/foo/bar:2.0",
+		},
+		{
+			Input:                  "@" + digest,
+			Base:                   base,
+			ExpectedRef:            ImageReference{"registry.example.org", "foo/bar", ParseManifestReference(digest)},
+			ExpectedInterpretation: "docker-pullable://registry.example.org/foo/bar@" + digest,
+		},
+		// full references ignore the base reference
+		{
+			Input:                  "alpine:3.9",
+			Base:                   base,
+			ExpectedRef:            ImageReference{defaultHostName, "library/alpine", ManifestReference{Tag: "3.9"}},
+			ExpectedInterpretation: "docker-pullable://registry-1.docker.io/library/alpine:3.9",
+		},
+	}
+
+	for _, tc := range testCases {
+		ref, interpretation, err := ParseImageReferenceWithBase(tc.Input, tc.Base)
+		if err != nil {
+			t.Errorf("expected %s to parse, but got error: %s", tc.Input, err.Error())
+			continue
+		}
+		assert.DeepEqual(t, "parse of "+tc.Input, ref, tc.ExpectedRef)
+		assert.DeepEqual(t, "interpretation of "+tc.Input, interpretation, tc.ExpectedInterpretation)
+	}
+}
+
+func TestParseImageReferenceAmbiguous(t *testing.T) {
+	base := Some(ImageReference{"registry.example.org", "foo/bar", ManifestReference{Tag: "1.0"}})
+
+	testCases := []struct {
+		Input         string
+		Base          Option[ImageReference]
+		ExpectedError string
+	}{
+		{
+			Input:         "",
+			ExpectedError: "image reference may not be empty",
+		},
+		{
+			Input:         "@sha256:e9707504ad0d4c119036b6d41ace4a33596139d3feb9ccb6617813ce48c3eeef",
+			ExpectedError: `ambiguous image reference: "@sha256:e9707504ad0d4c119036b6d41ace4a33596139d3feb9ccb6617813ce48c3eeef" does not name a repository (please provide a full reference like "registry.example.org/library/alpine@sha256:e9707504ad0d4c119036b6d41ace4a33596139d3feb9ccb6617813ce48c3eeef")`,
+		},
+		{
+			Input:         ":3.9",
+			ExpectedError: `ambiguous image reference: ":3.9" does not name a repository (please provide a full reference like "registry.example.org/library/alpine:3.9")`,
+		},
+		{
+			Input:         "registry.example.org",
+			ExpectedError: `ambiguous image reference: "registry.example.org" looks like a hostname, but does not name a repository (to refer to a repository on registry-1.docker.io, write "registry-1.docker.io/registry.example.org" instead)`,
+		},
+		{
+			Input:         "localhost:5000",
+			ExpectedError: `ambiguous image reference: "localhost:5000" looks like a hostname, but does not name a repository (to refer to a repository on registry-1.docker.io, write "registry-1.docker.io/localhost:5000" instead)`,
+		},
+		{
+			Input:         "@sha256:abc",
+			Base:          base,
+			ExpectedError: `invalid digest: "sha256:abc"`,
+		},
+		{
+			Input:         ":",
+			Base:          base,
+			ExpectedError: `invalid tag name: ""`,
+		},
+		{
+			Input:         "registry.example.org/foo:",
+			ExpectedError: `invalid tag name: ""`,
+		},
+	}
+
+	for _, tc := range testCases {
+		_, _, err := ParseImageReferenceWithBase(tc.Input, tc.Base)
+		if err == nil {
+			t.Errorf("expected %q to not parse, but got no error", tc.Input)
+			continue
+		}
+		assert.DeepEqual(t, "error for "+tc.Input, err.Error(), tc.ExpectedError)
+	}
+}
@@ -0,0 +1,26 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package models
+
+import "time"
+
+// IntegrityReport contains a record from the `integrity_reports` table.
+//
+// Each report summarizes the outcomes of all blob and manifest validations
+// within an account during the IntegrityReportWindow before CreatedAt.
+type IntegrityReport struct {
+	AccountName            AccountName `db:"account_name"`
+	CreatedAt              time.Time   `db:"created_at"`
+	ValidatedBlobCount     uint64      `db:"validated_blobs"`
+	FailedBlobCount        uint64      `db:"failed_blobs"`
+	ValidatedManifestCount uint64      `db:"validated_manifests"`
+	FailedManifestCount    uint64      `db:"failed_manifests"`
+}
+
+const (
+	// IntegrityReportWindow is the period of time covered by each IntegrityReport.
+	IntegrityReportWindow = 7 * 24 * time.Hour
+	// IntegrityReportInterval is how often IntegrityReportJob renews the report for each account.
+	IntegrityReportInterval = 24 * time.Hour
+)
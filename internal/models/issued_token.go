@@ -0,0 +1,27 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package models
+
+import (
+	"time"
+
+	. "github.com/majewsky/gg/option"
+)
+
+// IssuedToken contains a record from the `issued_tokens` table.
+//
+// Tokens are only recorded if KEPPEL_TRACK_ISSUED_TOKENS is set. A token that
+// covers accounts in multiple auth tenants is recorded once per auth tenant.
+type IssuedToken struct {
+	// ID is the "jti" claim of the token.
+	ID           string `db:"id"`
+	AuthTenantID string `db:"auth_tenant_id"`
+	UserName     string `db:"user_name"`
+	// Scopes is a space-separated list of the scopes granted to the token, in
+	// the same format as in the "scope" parameter of the Auth API.
+	Scopes    string            `db:"scopes"`
+	IssuedAt  time.Time         `db:"issued_at"`
+	ExpiresAt time.Time         `db:"expires_at"`
+	RevokedAt Option[time.Time] `db:"revoked_at"`
+}
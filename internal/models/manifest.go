@@ -19,6 +19,7 @@ type Manifest struct {
 	PushedAt               time.Time         `db:"pushed_at"`
 	NextValidationAt       time.Time         `db:"next_validation_at"` // see tasks.ManifestValidationJob
 	ValidationErrorMessage string            `db:"validation_error_message"`
+	LastValidatedAt        Option[time.Time] `db:"last_validated_at"` // see tasks.ManifestValidationJob
 	LastPulledAt           Option[time.Time] `db:"last_pulled_at"`
 	// LabelsJSON contains a JSON string of a map[string]string, or an empty string.
 	LabelsJSON string `db:"labels_json"`
@@ -32,6 +33,11 @@ type Manifest struct {
 	AnnotationsJSON string        `db:"annotations_json"`
 	ArtifactType    string        `db:"artifact_type"`
 	SubjectDigest   digest.Digest `db:"subject_digest"`
+	// DeletedAt is set while the manifest is in the trash (see Account.ManifestTrashRetentionSecs).
+	// Manifests in the trash are not served, and their tags are moved into DeletedTagsJSON.
+	DeletedAt Option[time.Time] `db:"deleted_at"`
+	// DeletedTagsJSON contains a JSON string of []string, or an empty string.
+	DeletedTagsJSON string `db:"deleted_tags_json"`
 }
 
 const (
@@ -49,6 +55,17 @@ type Tag struct {
 	Digest       digest.Digest     `db:"digest"`
 	PushedAt     time.Time         `db:"pushed_at"`
 	LastPulledAt Option[time.Time] `db:"last_pulled_at"`
+	// only set in external replica accounts with a manifest cache TTL (see Account.ManifestCacheTTLSecs)
+	LastRefreshedAt Option[time.Time] `db:"last_refreshed_at"`
+}
+
+// TagPin contains a record from the `tag_pins` table.
+// A pinned tag (and the manifest tree it points to) is exempt from GC policies.
+type TagPin struct {
+	RepositoryID int64     `db:"repo_id"`
+	TagName      string    `db:"name"`
+	PinnedAt     time.Time `db:"pinned_at"`
+	PinnedBy     string    `db:"pinned_by"`
 }
 
 // ManifestContent contains a record from the `manifest_contents` table.
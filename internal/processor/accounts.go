@@ -13,15 +13,16 @@ import (
 	"reflect"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/sapcc/keppel/internal/auth"
 	peerclient "github.com/sapcc/keppel/internal/client/peer"
 	"github.com/sapcc/keppel/internal/keppel"
 	"github.com/sapcc/keppel/internal/models"
 
+	. "github.com/majewsky/gg/option"
 	"github.com/sapcc/go-api-declarations/cadf"
 	"github.com/sapcc/go-bits/audittools"
-	"github.com/sapcc/go-bits/sqlext"
 )
 
 // GetPlatformFilterFromPrimaryAccount takes a replica account and queries the peer holding the primary account for that account.
@@ -47,8 +48,20 @@ func (p *Processor) GetPlatformFilterFromPrimaryAccount(ctx context.Context, pee
 var looksLikeAPIVersionRx = regexp.MustCompile(`^v[0-9][1-9]*$`)
 var ErrAccountNameEmpty = errors.New("account name cannot be empty string")
 
+// CreateOrUpdateAccountOptions contains optional behavior for CreateOrUpdateAccount().
+type CreateOrUpdateAccountOptions struct {
+	// If ValidateUpstream is true, creating an external replica account or
+	// rotating its replication credentials requires a successful test
+	// authentication against the upstream registry.
+	ValidateUpstream bool
+	// If AllowPolicyConflicts is false, GC policies that cannot delete anything
+	// because of the account's tag policies are rejected, unless the same
+	// conflict already existed before the update (see keppel.FindNewPolicyConflicts).
+	AllowPolicyConflicts bool
+}
+
 // CreateOrUpdate can be used on an API account and returns the database representation of it.
-func (p *Processor) CreateOrUpdateAccount(ctx context.Context, account keppel.Account, userInfo audittools.UserInfo, r *http.Request, getSubleaseToken func(models.Peer) (keppel.SubleaseToken, error), setCustomFields func(*models.Account) *keppel.RegistryV2Error) (models.Account, *keppel.RegistryV2Error) {
+func (p *Processor) CreateOrUpdateAccount(ctx context.Context, account keppel.Account, userInfo audittools.UserInfo, r *http.Request, opts CreateOrUpdateAccountOptions, getSubleaseToken func(models.Peer) (keppel.SubleaseToken, error), setCustomFields func(*models.Account) *keppel.RegistryV2Error) (models.Account, *keppel.RegistryV2Error) {
 	if account.Name == "" {
 		return models.Account{}, keppel.AsRegistryV2Error(ErrAccountNameEmpty)
 	}
@@ -65,7 +78,7 @@ func (p *Processor) CreateOrUpdateAccount(ctx context.Context, account keppel.Ac
 	}
 
 	// check if account already exists
-	originalAccount, err := keppel.FindAccount(p.db, account.Name)
+	originalAccount, err := keppel.FindAccount(ctx, p.db, account.Name)
 	if err != nil {
 		return models.Account{}, keppel.AsRegistryV2Error(err).WithStatus(http.StatusInternalServerError)
 	}
@@ -90,6 +103,12 @@ func (p *Processor) CreateOrUpdateAccount(ctx context.Context, account keppel.Ac
 
 	// validate and update fields as requested
 	targetAccount.IsDeleting = account.State == "deleting"
+	targetAccount.IsReadOnly = account.ReadOnly
+	targetAccount.IsPullDisabled = account.PullEnabled != nil && !*account.PullEnabled
+	targetAccount.IsPushDisabled = account.PushEnabled != nil && !*account.PushEnabled
+	targetAccount.IsAnycastDisabled = account.AnycastEnabled != nil && !*account.AnycastEnabled
+	targetAccount.StrictMediaTypes = account.StrictMediaTypes
+	targetAccount.ValidateOnPush = account.ValidateOnPush
 
 	// validate GC policies
 	if len(account.GCPolicies) == 0 {
@@ -119,6 +138,43 @@ func (p *Processor) CreateOrUpdateAccount(ctx context.Context, account keppel.Ac
 		targetAccount.TagPoliciesJSON = string(buf)
 	}
 
+	// check that GC policies and tag policies do not contradict each other
+	// (conflicts that already existed before this update are not rejected, so
+	// that unrelated changes to the account are still possible)
+	if !opts.AllowPolicyConflicts {
+		var (
+			oldGCPolicies  []keppel.GCPolicy
+			oldTagPolicies []keppel.TagPolicy
+		)
+		if originalAccount != nil {
+			oldGCPolicies, err = keppel.ParseGCPolicies(*originalAccount)
+			if err != nil {
+				return models.Account{}, keppel.AsRegistryV2Error(err).WithStatus(http.StatusInternalServerError)
+			}
+			oldTagPolicies, err = keppel.ParseTagPolicies(originalAccount.TagPoliciesJSON)
+			if err != nil {
+				return models.Account{}, keppel.AsRegistryV2Error(err).WithStatus(http.StatusInternalServerError)
+			}
+		}
+		conflicts := keppel.FindNewPolicyConflicts(oldGCPolicies, oldTagPolicies, account.GCPolicies, account.TagPolicies)
+		if len(conflicts) > 0 {
+			msg := fmt.Errorf("conflicting policies: %s", strings.Join(conflicts, "; "))
+			return models.Account{}, keppel.AsRegistryV2Error(msg).WithStatus(http.StatusUnprocessableEntity)
+		}
+	}
+
+	// validate labels
+	if len(account.Labels) == 0 {
+		targetAccount.LabelsJSON = ""
+	} else {
+		err := keppel.ValidateAccountLabels(account.Labels)
+		if err != nil {
+			return models.Account{}, keppel.AsRegistryV2Error(err).WithStatus(http.StatusUnprocessableEntity)
+		}
+		buf, _ := json.Marshal(account.Labels)
+		targetAccount.LabelsJSON = string(buf)
+	}
+
 	// validate replication policy (for OnFirstUseStrategy, the peer hostname is
 	// checked for correctness down below when validating the platform filter)
 	var originalStrategy keppel.ReplicationStrategy
@@ -155,6 +211,51 @@ func (p *Processor) CreateOrUpdateAccount(ctx context.Context, account keppel.Ac
 		replicationStrategy = rp.Strategy
 	}
 
+	// when an external replica account is created or its credentials are
+	// rotated, check that the upstream registry can be reached with these
+	// credentials before saving them (otherwise replication would only fail
+	// later on, in a much less obvious way)
+	isReplicationCredentialsRotation := originalAccount != nil && replicationStrategy == keppel.FromExternalOnFirstUseStrategy &&
+		(originalAccount.ExternalPeerUserName != targetAccount.ExternalPeerUserName || originalAccount.ExternalPeerPassword != targetAccount.ExternalPeerPassword)
+	isExternalReplicaCreation := originalAccount == nil && replicationStrategy == keppel.FromExternalOnFirstUseStrategy
+	if opts.ValidateUpstream && (isExternalReplicaCreation || isReplicationCredentialsRotation) {
+		err := newRepoClientForExternalPeer(targetAccount.Reduced(), "").CheckCredentials(ctx)
+		if err != nil {
+			var msg error
+			if isReplicationCredentialsRotation {
+				msg = fmt.Errorf("cannot authenticate with upstream registry using the new credentials: %w", err)
+			} else {
+				msg = fmt.Errorf("cannot connect to upstream registry: %w", err)
+			}
+			return models.Account{}, keppel.AsRegistryV2Error(msg).WithStatus(http.StatusUnprocessableEntity)
+		}
+	}
+
+	// validate manifest cache TTL
+	if account.ManifestCacheTTL == nil || *account.ManifestCacheTTL == 0 {
+		targetAccount.ManifestCacheTTLSecs = 0
+	} else {
+		ttl := time.Duration(*account.ManifestCacheTTL)
+		if replicationStrategy != keppel.FromExternalOnFirstUseStrategy {
+			return models.Account{}, keppel.AsRegistryV2Error(errors.New(`manifest cache TTL is only allowed on external replica accounts`)).WithStatus(http.StatusUnprocessableEntity)
+		}
+		if ttl < 0 {
+			return models.Account{}, keppel.AsRegistryV2Error(errors.New(`manifest cache TTL may not be negative`)).WithStatus(http.StatusUnprocessableEntity)
+		}
+		targetAccount.ManifestCacheTTLSecs = int64(ttl / time.Second)
+	}
+
+	// validate manifest trash retention
+	if account.ManifestTrashRetention == nil {
+		targetAccount.ManifestTrashRetentionSecs = 0
+	} else {
+		retention := time.Duration(*account.ManifestTrashRetention)
+		if retention < 0 {
+			return models.Account{}, keppel.AsRegistryV2Error(errors.New(`manifest trash retention may not be negative`)).WithStatus(http.StatusUnprocessableEntity)
+		}
+		targetAccount.ManifestTrashRetentionSecs = int64(retention / time.Second)
+	}
+
 	// validate RBAC policies
 	if len(account.RBACPolicies) == 0 {
 		targetAccount.RBACPoliciesJSON = ""
@@ -225,53 +326,30 @@ func (p *Processor) CreateOrUpdateAccount(ctx context.Context, account keppel.Ac
 		return models.Account{}, rerr
 	}
 
-	// create account if required
+	// create account if required (the account is recorded in state "creating"
+	// until its name is claimed and its backing storage is confirmed; if setup
+	// is interrupted, a repeated PUT resumes it, otherwise the janitor cleans up
+	// the account after a while)
 	if originalAccount == nil {
-		// sublease tokens are only relevant when creating replica accounts
-		subleaseTokenSecret := ""
-		if targetAccount.UpstreamPeerHostName != "" {
-			subleaseToken, err := getSubleaseToken(peer)
-			if err != nil {
-				return models.Account{}, keppel.AsRegistryV2Error(err).WithStatus(http.StatusBadRequest)
-			}
-			subleaseTokenSecret = subleaseToken.Secret
-		}
-
-		// check permission to claim account name (this only happens here because
-		// it's only relevant for account creations, not for updates)
-		claimResult, err := p.fd.ClaimAccountName(ctx, targetAccount, subleaseTokenSecret)
-		switch claimResult {
-		case keppel.ClaimSucceeded:
-			// nothing to do
-		case keppel.ClaimFailed:
-			// user error
-			return models.Account{}, keppel.AsRegistryV2Error(err).WithStatus(http.StatusForbidden)
-		case keppel.ClaimErrored:
-			// server error
-			return models.Account{}, keppel.AsRegistryV2Error(err).WithStatus(http.StatusInternalServerError)
-		}
-
-		err = p.sd.CanSetupAccount(ctx, targetAccount.Reduced())
-		if err != nil {
-			msg := fmt.Errorf("cannot set up backing storage for this account: %w", err)
-			return models.Account{}, keppel.AsRegistryV2Error(msg).WithStatus(http.StatusConflict)
-		}
-
-		tx, err := p.db.Begin()
+		targetAccount.IsCreating = true
+		targetAccount.CreationStartedAt = Some(p.timeNow())
+		err = p.db.Insert(&targetAccount)
 		if err != nil {
 			return models.Account{}, keppel.AsRegistryV2Error(err).WithStatus(http.StatusInternalServerError)
 		}
-		defer sqlext.RollbackUnlessCommitted(tx)
-
-		err = tx.Insert(&targetAccount)
-		if err != nil {
-			return models.Account{}, keppel.AsRegistryV2Error(err).WithStatus(http.StatusInternalServerError)
-		}
-
-		// commit the changes
-		err = tx.Commit()
-		if err != nil {
-			return models.Account{}, keppel.AsRegistryV2Error(err).WithStatus(http.StatusInternalServerError)
+	}
+	if targetAccount.IsCreating {
+		rerr := p.setupAccount(ctx, &targetAccount, peer, getSubleaseToken)
+		if rerr != nil {
+			if originalAccount == nil {
+				// do not leave a half-created account behind if the initial setup
+				// attempt fails (if this cleanup fails as well, the janitor takes care of it)
+				_, err := p.db.Exec(deleteFailedAccountCreationQuery, targetAccount.Name)
+				if err != nil {
+					return models.Account{}, keppel.AsRegistryV2Error(err).WithStatus(http.StatusInternalServerError)
+				}
+			}
+			return models.Account{}, rerr
 		}
 
 		if userInfo != nil {
@@ -284,7 +362,9 @@ func (p *Processor) CreateOrUpdateAccount(ctx context.Context, account keppel.Ac
 				Target:     AuditAccount{Account: targetAccount},
 			})
 		}
-	} else {
+	}
+
+	if originalAccount != nil {
 		// originalAccount != nil: update if necessary
 		if !reflect.DeepEqual(*originalAccount, targetAccount) {
 			_, err := p.db.Update(&targetAccount)
@@ -294,7 +374,8 @@ func (p *Processor) CreateOrUpdateAccount(ctx context.Context, account keppel.Ac
 		}
 
 		// audit log is necessary for all changes except to InMaintenance
-		if userInfo != nil {
+		// (if an interrupted setup was resumed, the creation was already audited above)
+		if userInfo != nil && !originalAccount.IsCreating {
 			originalAccount.IsDeleting = targetAccount.IsDeleting
 			if !reflect.DeepEqual(*originalAccount, targetAccount) {
 				p.auditor.Record(audittools.Event{
@@ -306,12 +387,83 @@ func (p *Processor) CreateOrUpdateAccount(ctx context.Context, account keppel.Ac
 					Target:     AuditAccount{Account: targetAccount},
 				})
 			}
+			if isReplicationCredentialsRotation {
+				p.auditor.Record(audittools.Event{
+					Time:       p.timeNow(),
+					Request:    r,
+					User:       userInfo,
+					ReasonCode: http.StatusOK,
+					Action:     cadf.UpdateAction,
+					Target:     AuditReplicationCredentials{Account: targetAccount},
+				})
+			}
 		}
 	}
 
 	return targetAccount, nil
 }
 
+var (
+	deleteFailedAccountCreationQuery = `DELETE FROM accounts WHERE name = $1 AND is_creating`
+	finishAccountCreationQuery       = `UPDATE accounts SET is_creating = FALSE, creation_started_at = NULL WHERE name = $1 AND is_creating`
+)
+
+// Claims the name of an account that is still being created, and confirms
+// that its backing storage can be set up. On success, the account is updated
+// in the DB to no longer be in state "creating".
+func (p *Processor) setupAccount(ctx context.Context, account *models.Account, peer models.Peer, getSubleaseToken func(models.Peer) (keppel.SubleaseToken, error)) *keppel.RegistryV2Error {
+	// sublease tokens are only relevant when creating replica accounts
+	subleaseTokenSecret := ""
+	if account.UpstreamPeerHostName != "" {
+		subleaseToken, err := getSubleaseToken(peer)
+		if err != nil {
+			return keppel.AsRegistryV2Error(err).WithStatus(http.StatusBadRequest)
+		}
+		subleaseTokenSecret = subleaseToken.Secret
+	}
+
+	// check permission to claim account name (this only happens here because
+	// it's only relevant for account creations, not for updates)
+	claimResult, err := p.fd.ClaimAccountName(ctx, *account, subleaseTokenSecret)
+	switch claimResult {
+	case keppel.ClaimSucceeded:
+		// nothing to do
+	case keppel.ClaimFailed:
+		// user error
+		return keppel.AsRegistryV2Error(err).WithStatus(http.StatusForbidden)
+	case keppel.ClaimErrored:
+		// server error
+		return keppel.AsRegistryV2Error(err).WithStatus(http.StatusInternalServerError)
+	case keppel.ClaimRaceLost:
+		// transient conflict with another Keppel claiming the same name; the retry will show who won
+		return keppel.AsRegistryV2Error(err).WithStatus(http.StatusConflict).WithHeader("Retry-After", "1")
+	}
+
+	err = p.sd.CanSetupAccount(ctx, account.Reduced())
+	if err != nil {
+		msg := fmt.Errorf("cannot set up backing storage for this account: %w", err)
+		return keppel.AsRegistryV2Error(msg).WithStatus(http.StatusConflict)
+	}
+
+	// the "AND is_creating" guard ensures that we do not revive an account that
+	// the janitor has given up on in the meantime
+	result, err := p.db.Exec(finishAccountCreationQuery, account.Name)
+	if err != nil {
+		return keppel.AsRegistryV2Error(err).WithStatus(http.StatusInternalServerError)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return keppel.AsRegistryV2Error(err).WithStatus(http.StatusInternalServerError)
+	}
+	if rowsAffected == 0 {
+		msg := errors.New("account setup took too long and was abandoned")
+		return keppel.AsRegistryV2Error(msg).WithStatus(http.StatusConflict)
+	}
+	account.IsCreating = false
+	account.CreationStartedAt = None[time.Time]()
+	return nil
+}
+
 var (
 	markAccountForDeletion = `UPDATE accounts SET is_deleting = TRUE, next_deletion_attempt_at = $1 WHERE name = $2`
 )
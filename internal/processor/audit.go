@@ -9,6 +9,7 @@ import (
 	"github.com/sapcc/go-api-declarations/cadf"
 	"github.com/sapcc/go-bits/must"
 
+	"github.com/sapcc/keppel/internal/keppel"
 	"github.com/sapcc/keppel/internal/models"
 )
 
@@ -43,9 +44,48 @@ func (a AuditAccount) Render() cadf.Resource {
 		res.Attachments = append(res.Attachments, attachment)
 	}
 
+	labelsJSON := a.Account.LabelsJSON
+	if labelsJSON != "" && labelsJSON != "{}" {
+		attachment := must.Return(cadf.NewJSONAttachment("labels", json.RawMessage(labelsJSON)))
+		res.Attachments = append(res.Attachments, attachment)
+	}
+
 	return res
 }
 
+// AuditReplicationCredentials is an audittools.Target. It is used when the
+// credentials of an external replica account are rotated.
+type AuditReplicationCredentials struct {
+	Account models.Account
+}
+
+// Render implements the audittools.Target interface.
+func (a AuditReplicationCredentials) Render() cadf.Resource {
+	return cadf.Resource{
+		TypeURI:   "docker-registry/account/replication-credentials",
+		ID:        string(a.Account.Name),
+		ProjectID: a.Account.AuthTenantID,
+		Attachments: []cadf.Attachment{
+			// NOTE: The password is never included in the audit log.
+			must.Return(cadf.NewJSONAttachment("payload", keppel.RenderReplicationPolicy(a.Account))),
+		},
+	}
+}
+
+// AuditPeer is an audittools.Target.
+type AuditPeer struct {
+	HostName string
+}
+
+// Render implements the audittools.Target interface.
+func (a AuditPeer) Render() cadf.Resource {
+	return cadf.Resource{
+		TypeURI: "docker-registry/peer",
+		ID:      a.HostName,
+		Name:    a.HostName,
+	}
+}
+
 // AuditQuotas is an audittools.Target.
 type AuditQuotas struct {
 	QuotasBefore models.Quotas
@@ -4,6 +4,7 @@
 package processor
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
 	"errors"
@@ -16,6 +17,8 @@ import (
 	"github.com/containers/image/v5/manifest"
 	"github.com/go-gorp/gorp/v3"
 	. "github.com/majewsky/gg/option"
+	"github.com/opencontainers/go-digest"
+	imagespecs "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sapcc/go-bits/logg"
 
@@ -67,6 +70,27 @@ func (p *Processor) ValidateExistingBlob(ctx context.Context, account models.Red
 	return nil
 }
 
+// ValidatePushedBlob is called by the registry API after a blob upload has
+// been finalized in the storage, but before it is recorded in the DB. If the
+// account has ValidateOnPush enabled, the blob contents are read back from
+// the storage and validated like in ValidateExistingBlob().
+func (p *Processor) ValidatePushedBlob(ctx context.Context, account models.ReducedAccount, storageID string, blobDigest digest.Digest, sizeBytes uint64) error {
+	if !account.ValidateOnPush {
+		return nil
+	}
+	blob := models.Blob{
+		AccountName: account.Name,
+		Digest:      blobDigest,
+		SizeBytes:   sizeBytes,
+		StorageID:   storageID,
+	}
+	err := p.ValidateExistingBlob(ctx, account, blob)
+	if err != nil {
+		return keppel.ErrDigestInvalid.With("validation of pushed blob failed: %s", err.Error())
+	}
+	return nil
+}
+
 // An io.Writer that just counts how many bytes were written into it.
 type byteCountingWriter struct {
 	bytesWritten uint64
@@ -104,6 +128,38 @@ func (p *Processor) FindBlobOrInsertUnbackedBlob(ctx context.Context, layerInfo
 	return blob, err
 }
 
+// ensureEmptyBlobMounted ensures that the well-known empty JSON blob (with
+// contents `{}`) from the OCI image spec exists in the given account and is
+// mounted into the given repo. OCI artifact manifests commonly reference this
+// blob as their config, but clients may skip uploading it since its contents are
+// known in advance.
+func (p *Processor) ensureEmptyBlobMounted(ctx context.Context, account models.ReducedAccount, repo models.Repository) error {
+	emptyDesc := imagespecs.DescriptorEmptyJSON
+	_, err := keppel.FindBlobByRepository(p.db, emptyDesc.Digest, repo)
+	if !errors.Is(err, sql.ErrNoRows) { // either success or unexpected error
+		return err
+	}
+
+	blob, err := keppel.FindBlobByAccountName(p.db, emptyDesc.Digest, account.Name)
+	if errors.Is(err, sql.ErrNoRows) {
+		// the blob does not exist in this account yet, so we need to create it
+		blob = &models.Blob{
+			AccountName: account.Name,
+			Digest:      emptyDesc.Digest,
+			MediaType:   emptyDesc.MediaType,
+		}
+		sizeBytes := keppel.AtLeastZero(len(emptyDesc.Data))
+		err = p.storeNewBlob(ctx, account, blob, bytes.NewReader(emptyDesc.Data), &sizeBytes)
+		if err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	return keppel.MountBlobIntoRepo(p.db, *blob, repo)
+}
+
 var (
 	// ErrConcurrentReplication is returned from Processor.ReplicateBlob() when the
 	// same blob is already being replicated by another worker.
@@ -165,7 +221,7 @@ func (p *Processor) ReplicateBlob(ctx context.Context, blob models.Blob, account
 	// stream into `w` if requested
 	blobReader := io.Reader(blobReadCloser)
 	if w != nil {
-		w.Header().Set("Content-Type", blob.SafeMediaType()) // we know the media type because we have already replicated a referencing manifest
+		w.Header().Set("Content-Type", p.cfg.BlobMediaType(blob)) // we know the media type because we have already replicated a referencing manifest
 		w.Header().Set("Docker-Content-Digest", blob.Digest.String())
 		w.Header().Set("Content-Length", strconv.FormatUint(blobLengthBytes, 10))
 		w.WriteHeader(http.StatusOK)
@@ -236,6 +292,48 @@ func (p *Processor) uploadBlobToLocal(ctx context.Context, blob models.Blob, acc
 	return err
 }
 
+// storeNewBlob writes the given contents into a new storage location in the
+// given account, and inserts the given blob record for it. The StorageID,
+// SizeBytes, PushedAt and NextValidationAt fields of the blob record are filled
+// by this method. If any step fails, the new storage location is cleaned up.
+//
+// Warning: Like in AppendToBlob(), the digest of the contents is not validated.
+func (p *Processor) storeNewBlob(ctx context.Context, account models.ReducedAccount, blob *models.Blob, contents io.Reader, lengthBytes *uint64) error {
+	upload := models.Upload{
+		StorageID: p.generateStorageID(),
+		SizeBytes: 0,
+		NumChunks: 0,
+	}
+	err := p.AppendToBlob(ctx, account, &upload, contents, lengthBytes)
+	if err == nil {
+		err = p.sd.FinalizeBlob(ctx, account, upload.StorageID, upload.NumChunks)
+	}
+	if err != nil {
+		abortErr := p.sd.AbortBlobUpload(ctx, account, upload.StorageID, upload.NumChunks)
+		if abortErr != nil {
+			logg.Error("additional error encountered when aborting upload %s into account %s: %s",
+				upload.StorageID, account.Name, abortErr.Error())
+		}
+		return err
+	}
+
+	now := p.timeNow()
+	blob.SizeBytes = upload.SizeBytes
+	blob.StorageID = upload.StorageID
+	blob.PushedAt = now
+	blob.NextValidationAt = now.Add(models.BlobValidationInterval)
+	err = p.db.Insert(blob)
+	if err != nil {
+		deleteErr := p.sd.DeleteBlob(ctx, account, upload.StorageID)
+		if deleteErr != nil {
+			logg.Error("additional error encountered while deleting blob %s from account %s after DB error: %s",
+				upload.StorageID, account.Name, deleteErr.Error())
+		}
+		return err
+	}
+	return nil
+}
+
 // AppendToBlob appends bytes to a blob upload, and updates the upload's
 // SizeBytes and NumChunks fields appropriately. Chunking of large uploads is
 // implemented at this level, to accommodate storage drivers that have a size
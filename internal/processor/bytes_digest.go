@@ -13,9 +13,15 @@ type BytesWithDigest struct {
 }
 
 func NewBytesWithDigest(buf []byte) BytesWithDigest {
+	return NewBytesWithDigestOf(buf, digest.Canonical)
+}
+
+// NewBytesWithDigestOf is like NewBytesWithDigest, but computes the digest
+// using the given algorithm instead of digest.Canonical.
+func NewBytesWithDigestOf(buf []byte, algo digest.Algorithm) BytesWithDigest {
 	return BytesWithDigest{
 		bytes:     buf,
-		ownDigest: digest.Canonical.FromBytes(buf),
+		ownDigest: algo.FromBytes(buf),
 	}
 }
 func (b BytesWithDigest) Bytes() []byte {
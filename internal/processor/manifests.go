@@ -44,7 +44,7 @@ type IncomingManifest struct {
 }
 
 var checkManifestExistsQuery = sqlext.SimplifyWhitespace(`
-	SELECT COUNT(*) > 0 FROM manifests WHERE repo_id = $1 AND digest = $2
+	SELECT COUNT(*) > 0 FROM manifests WHERE repo_id = $1 AND digest = $2 AND deleted_at IS NULL
 `)
 var checkTagExistsQuery = sqlext.SimplifyWhitespace(`
 	SELECT COUNT(*) > 0 FROM tags WHERE repo_id = $1 AND name = $2
@@ -61,7 +61,13 @@ func (p *Processor) ValidateAndStoreManifest(ctx context.Context, account models
 	// check is not 100% reliable since it does not run in the same transaction as
 	// the actual upsert, so results should be taken with a grain of salt; but the
 	// result is accurate enough to avoid most duplicate audit events
-	contentsDigest := digest.Canonical.FromBytes(m.Contents)
+	// (when the manifest is pushed by digest, the digest algorithm chosen by the client is used)
+	digestAlgo := digest.Canonical
+	if m.Reference.IsDigest() {
+		digestAlgo = m.Reference.Digest.Algorithm()
+	}
+	manifestBytes := NewBytesWithDigestOf(m.Contents, digestAlgo)
+	contentsDigest := manifestBytes.Digest()
 	manifestExistsAlready, err := p.db.SelectBool(checkManifestExistsQuery, repo.ID, contentsDigest.String())
 	if err != nil {
 		return nil, err
@@ -115,7 +121,7 @@ func (p *Processor) ValidateAndStoreManifest(ctx context.Context, account models
 		// digest against the actual manifest data
 		manifest.Digest = m.Reference.Digest
 	}
-	err = p.validateAndStoreManifestCommon(ctx, account, repo, manifest, NewBytesWithDigest(m.Contents), validateAndStoreManifestOpts{
+	err = p.validateAndStoreManifestCommon(ctx, account, repo, manifest, manifestBytes, validateAndStoreManifestOpts{
 		IsBeingPushed: true,
 		ActionBeforeCommit: func(tx *gorp.Transaction) error {
 			if m.Reference.IsTag() {
@@ -181,7 +187,7 @@ func (p *Processor) ValidateExistingManifest(ctx context.Context, account models
 		return err
 	}
 
-	return p.validateAndStoreManifestCommon(ctx, account, repo, manifest, NewBytesWithDigest(manifestBytes),
+	return p.validateAndStoreManifestCommon(ctx, account, repo, manifest, NewBytesWithDigestOf(manifestBytes, manifest.Digest.Algorithm()),
 		validateAndStoreManifestOpts{},
 	)
 }
@@ -192,8 +198,14 @@ type validateAndStoreManifestOpts struct {
 }
 
 func (p *Processor) validateAndStoreManifestCommon(ctx context.Context, account models.ReducedAccount, repo models.Repository, manifest *models.Manifest, manifestBytes BytesWithDigest, opts validateAndStoreManifestOpts) error {
+	// accounts with strict media types only accept manifests that we know how to
+	// interpret (like for the validation rule below, this is only checked on push)
+	if opts.IsBeingPushed && account.StrictMediaTypes && !keppel.IsKnownManifestMediaType(manifest.MediaType) {
+		return keppel.ErrManifestInvalid.With("manifest media type %q is not allowed in this account", manifest.MediaType)
+	}
+
 	// parse manifest
-	manifestParsed, err := keppel.ParseManifest(manifest.MediaType, manifestBytes.Bytes())
+	manifestParsed, err := p.cfg.ParseManifest(manifest.MediaType, manifestBytes.Bytes())
 	if err != nil {
 		return keppel.ErrManifestInvalid.With(err.Error())
 	}
@@ -208,15 +220,33 @@ func (p *Processor) validateAndStoreManifestCommon(ctx context.Context, account
 	manifest.SizeBytes = keppel.AtLeastZero(manifestBytes.Len())
 	for _, desc := range manifestParsed.BlobReferences() {
 		manifest.SizeBytes += keppel.AtLeastZero(desc.Size)
+
+		// the empty JSON blob does not need to be uploaded by the client
+		if desc.Digest == imagespecs.DescriptorEmptyJSON.Digest {
+			err := p.ensureEmptyBlobMounted(ctx, account, repo)
+			if err != nil {
+				return err
+			}
+		}
 	}
 
 	return p.insideTransaction(ctx, func(ctx context.Context, tx *gorp.Transaction) error {
-		refsInfo, err := findManifestReferencedObjects(tx, account, repo, manifestParsed)
+		refsInfo, err := findManifestReferencedObjects(tx, account, repo, manifest.Digest, manifestParsed, p.cfg.EffectiveMaxManifestReferenceDepth())
 		if err != nil {
 			return err
 		}
 		manifest.SizeBytes += refsInfo.SumChildSizes
 
+		// accounts with validation on push additionally require that all
+		// referenced blobs are actually present in the storage (this is only
+		// checked on push for the same reason as the validation rule below)
+		if opts.IsBeingPushed && account.ValidateOnPush {
+			err := p.checkReferencedBlobsArePresent(ctx, tx, account, repo, manifestParsed)
+			if err != nil {
+				return err
+			}
+		}
+
 		configInfo, err := parseManifestConfig(ctx, tx, p.sd, account, manifestParsed)
 		if err != nil {
 			return err
@@ -309,6 +339,30 @@ func (p *Processor) validateAndStoreManifestCommon(ctx context.Context, account
 	})
 }
 
+// checkReferencedBlobsArePresent is used for accounts with validation on push.
+// It checks that all blobs referenced by the given manifest have been uploaded
+// and can actually be read from the storage, instead of only being known to the DB.
+func (p *Processor) checkReferencedBlobsArePresent(ctx context.Context, tx *gorp.Transaction, account models.ReducedAccount, repo models.Repository, manifest keppel.ParsedManifest) error {
+	for _, layerInfo := range manifest.BlobReferences() {
+		blob, err := keppel.FindBlobByRepository(tx, layerInfo.Digest, repo)
+		if err != nil {
+			return err
+		}
+		if blob.StorageID == "" {
+			return keppel.ErrManifestBlobUnknown.With("blob has not been uploaded to the storage yet").WithDetail(layerInfo.Digest.String())
+		}
+		readCloser, _, err := p.sd.ReadBlob(ctx, account, blob.StorageID)
+		if err != nil {
+			return keppel.ErrManifestBlobUnknown.With("blob could not be found in the storage: %s", err.Error()).WithDetail(layerInfo.Digest.String())
+		}
+		err = readCloser.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 type blobRef struct {
 	ID        int64
 	MediaType string
@@ -324,7 +378,7 @@ type manifestRefsInfo struct {
 	SumChildSizes   uint64
 }
 
-func findManifestReferencedObjects(tx *gorp.Transaction, account models.ReducedAccount, repo models.Repository, manifest keppel.ParsedManifest) (result manifestRefsInfo, err error) {
+func findManifestReferencedObjects(tx *gorp.Transaction, account models.ReducedAccount, repo models.Repository, manifestDigest digest.Digest, manifest keppel.ParsedManifest, maxDepth int) (result manifestRefsInfo, err error) {
 	// ensure that we don't insert duplicate entries into `blobRefs` and `manifestDigests`
 	wasHandled := make(map[digest.Digest]bool)
 
@@ -355,15 +409,16 @@ func findManifestReferencedObjects(tx *gorp.Transaction, account models.ReducedA
 	}
 
 	// for all manifests referenced by this manifest...
+	var childDigests []digest.Digest
 	for idx, desc := range manifest.ManifestReferences(account.PlatformFilter) {
 		if wasHandled[desc.Digest] {
 			continue
 		}
 		wasHandled[desc.Digest] = true
 
-		// check that the child manifest exists
+		// check that the child manifest exists (and is not in the trash)
 		manifest, err := keppel.FindManifest(tx, repo, desc.Digest)
-		if errors.Is(err, sql.ErrNoRows) {
+		if errors.Is(err, sql.ErrNoRows) || (err == nil && manifest.DeletedAt.IsSome()) {
 			return manifestRefsInfo{}, keppel.ErrManifestUnknown.With("").WithDetail(desc.Digest.String())
 		}
 		if err != nil {
@@ -396,6 +451,13 @@ func findManifestReferencedObjects(tx *gorp.Transaction, account models.ReducedA
 		result.MinCreationTime = keppel.MinMaybeTime(result.MinCreationTime, manifest.MinLayerCreatedAt)
 		result.MaxCreationTime = keppel.MaxMaybeTime(result.MaxCreationTime, manifest.MaxLayerCreatedAt)
 		result.SumChildSizes += manifest.SizeBytes
+		childDigests = append(childDigests, desc.Digest)
+	}
+
+	// check that the child manifests (and their children, and so on) are not nested too deeply
+	err = keppel.CheckManifestReferenceDepth(tx, repo, manifestDigest, childDigests, maxDepth)
+	if err != nil {
+		return manifestRefsInfo{}, err
 	}
 
 	return result, nil
@@ -481,7 +543,9 @@ var upsertManifestQuery = sqlext.SimplifyWhitespace(`
 	ON CONFLICT (repo_id, digest) DO UPDATE
 		SET size_bytes = EXCLUDED.size_bytes, next_validation_at = EXCLUDED.next_validation_at, labels_json = EXCLUDED.labels_json,
 		min_layer_created_at = EXCLUDED.min_layer_created_at, max_layer_created_at = EXCLUDED.max_layer_created_at,
-		annotations_json = EXCLUDED.annotations_json, artifact_type = EXCLUDED.artifact_type, subject_digest = EXCLUDED.subject_digest
+		annotations_json = EXCLUDED.annotations_json, artifact_type = EXCLUDED.artifact_type, subject_digest = EXCLUDED.subject_digest,
+		-- pushing a manifest that is in the trash takes it out of the trash
+		deleted_at = NULL, deleted_tags_json = ''
 `)
 
 var upsertManifestContentQuery = sqlext.SimplifyWhitespace(`
@@ -685,6 +749,17 @@ func (e UpstreamManifestMissingError) Error() string {
 // ReplicateManifest replicates the manifest from its account's upstream registry.
 // On success, the manifest's metadata and contents are returned.
 func (p *Processor) ReplicateManifest(ctx context.Context, account models.ReducedAccount, repo models.Repository, reference models.ManifestReference, tagPolicies []keppel.TagPolicy, actx keppel.AuditContext) (*models.Manifest, []byte, error) {
+	return p.replicateManifest(ctx, account, repo, reference, tagPolicies, actx, 0)
+}
+
+// The `level` argument is used to abort the recursion into referenced manifests
+// if the upstream serves manifests that are nested too deeply.
+func (p *Processor) replicateManifest(ctx context.Context, account models.ReducedAccount, repo models.Repository, reference models.ManifestReference, tagPolicies []keppel.TagPolicy, actx keppel.AuditContext, level int) (*models.Manifest, []byte, error) {
+	maxDepth := p.cfg.EffectiveMaxManifestReferenceDepth()
+	if level > maxDepth {
+		return nil, nil, keppel.ErrManifestReferencesTooDeep(maxDepth)
+	}
+
 	manifestBytes, manifestMediaType, err := p.downloadManifestViaInboundCache(ctx, account, repo, reference)
 	if err != nil {
 		if errorIsManifestNotFound(err) {
@@ -694,16 +769,16 @@ func (p *Processor) ReplicateManifest(ctx context.Context, account models.Reduce
 	}
 
 	// parse the manifest to discover references to other manifests and blobs
-	manifestParsed, err := keppel.ParseManifest(manifestMediaType, manifestBytes)
+	manifestParsed, err := p.cfg.ParseManifest(manifestMediaType, manifestBytes)
 	if err != nil {
 		return nil, nil, keppel.ErrManifestInvalid.With(err.Error())
 	}
 
 	// replicate referenced manifests recursively if required
 	for _, desc := range manifestParsed.ManifestReferences(account.PlatformFilter) {
-		_, err := keppel.FindManifest(p.db, repo, desc.Digest)
-		if errors.Is(err, sql.ErrNoRows) {
-			_, _, err = p.ReplicateManifest(ctx, account, repo, models.ManifestReference{Digest: desc.Digest}, tagPolicies, actx)
+		manifest, err := keppel.FindManifest(p.db, repo, desc.Digest)
+		if errors.Is(err, sql.ErrNoRows) || (err == nil && manifest.DeletedAt.IsSome()) {
+			_, _, err = p.replicateManifest(ctx, account, repo, models.ManifestReference{Digest: desc.Digest}, tagPolicies, actx, level+1)
 		}
 		if err != nil {
 			return nil, nil, err
@@ -875,7 +950,8 @@ func (e DeleteManifestBlockedByTagPolicyError) Error() string {
 }
 
 // DeleteManifest deletes the given manifest from both the database and the
-// backing storage.
+// backing storage. If the account has a manifest trash retention, the manifest
+// is moved into the trash instead (see PurgeManifest and RestoreManifest).
 //
 // If the manifest does not exist, sql.ErrNoRows is returned.
 func (p *Processor) DeleteManifest(ctx context.Context, account models.ReducedAccount, repo models.Repository, manifestDigest digest.Digest, tagPolicies []keppel.TagPolicy, actx keppel.AuditContext) error {
@@ -894,14 +970,54 @@ func (p *Processor) DeleteManifest(ctx context.Context, account models.ReducedAc
 		tags = append(tags, tagResult.Name)
 	}
 
-	for _, tagPolicy := range tagPolicies {
-		if tagPolicy.BlockDelete && tagPolicy.MatchesRepository(repo.Name) && tagPolicy.MatchesTags(tags) {
-			return keppel.ErrDenied.WithError(DeleteManifestBlockedByTagPolicyError{tagPolicy}).WithStatus(http.StatusConflict)
+	// tag policies do not block the cleanup of accounts that are being deleted
+	if !account.IsDeleting {
+		for _, tagPolicy := range tagPolicies {
+			if tagPolicy.BlockDelete && tagPolicy.MatchesRepository(repo.Name) && tagPolicy.MatchesTags(tags) {
+				return keppel.ErrDenied.WithError(DeleteManifestBlockedByTagPolicyError{tagPolicy}).WithStatus(http.StatusConflict)
+			}
 		}
 	}
 
+	// the trash is skipped when cleaning up accounts that are being deleted
+	if account.ManifestTrashRetentionSecs > 0 && !account.IsDeleting {
+		err = p.moveManifestToTrash(repo, manifestDigest, tags)
+	} else {
+		err = p.PurgeManifest(ctx, account, repo, manifestDigest)
+	}
+	if err != nil {
+		return err
+	}
+
+	if userInfo := actx.UserIdentity.UserInfo(); userInfo != nil {
+		p.auditor.Record(audittools.Event{
+			Time:       p.timeNow(),
+			Request:    actx.Request,
+			User:       userInfo,
+			ReasonCode: http.StatusOK,
+			Action:     cadf.DeleteAction,
+			Target: auditManifest{
+				Account:    account,
+				Repository: repo,
+				Digest:     manifestDigest,
+				Tags:       tags,
+			},
+		})
+	}
+
+	return nil
+}
+
+// PurgeManifest deletes the given manifest from both the database and the
+// backing storage, bypassing the manifest trash. Unlike DeleteManifest, this
+// does not evaluate tag policies and does not generate an audit event, so
+// outside of DeleteManifest, it should only be used on manifests that are
+// already in the trash.
+//
+// If the manifest does not exist, sql.ErrNoRows is returned.
+func (p *Processor) PurgeManifest(ctx context.Context, account models.ReducedAccount, repo models.Repository, manifestDigest digest.Digest) error {
 	var securityInfo models.TrivySecurityInfo
-	_, err = p.db.Select(&securityInfo,
+	_, err := p.db.Select(&securityInfo,
 		`SELECT * FROM trivy_security_info WHERE repo_id = $1 AND digest = $2`,
 		repo.ID, manifestDigest)
 	if err != nil {
@@ -954,6 +1070,133 @@ func (p *Processor) DeleteManifest(ctx context.Context, account models.ReducedAc
 			return err
 		}
 	}
+	return nil
+}
+
+var trashManifestFindParentQuery = sqlext.SimplifyWhitespace(`
+	SELECT r.parent_digest
+	  FROM manifest_manifest_refs r
+	  JOIN manifests m ON m.repo_id = r.repo_id AND m.digest = r.parent_digest
+	 WHERE r.repo_id = $1 AND r.child_digest = $2 AND m.deleted_at IS NULL
+	 LIMIT 1
+`)
+
+var trashManifestQuery = sqlext.SimplifyWhitespace(`
+	UPDATE manifests SET deleted_at = $3, deleted_tags_json = $4
+	 WHERE repo_id = $1 AND digest = $2 AND deleted_at IS NULL
+`)
+
+// Moves the given manifest into the trash. The manifest stays in the backing
+// storage, but its tags are removed and remembered for RestoreManifest.
+func (p *Processor) moveManifestToTrash(repo models.Repository, manifestDigest digest.Digest, tags []string) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer sqlext.RollbackUnlessCommitted(tx)
+
+	// same restriction as for the DELETE in PurgeManifest (which is enforced by
+	// the DB there), except that parents in the trash do not count
+	otherDigest, err := tx.SelectStr(trashManifestFindParentQuery, repo.ID, manifestDigest)
+	if err != nil {
+		return err
+	}
+	if otherDigest != "" {
+		return fmt.Errorf("cannot delete a manifest which is referenced by the manifest %s", otherDigest)
+	}
+
+	var tagsJSON string
+	if len(tags) > 0 {
+		buf, err := json.Marshal(tags)
+		if err != nil {
+			return err
+		}
+		tagsJSON = string(buf)
+	}
+	result, err := tx.Exec(trashManifestQuery, repo.ID, manifestDigest, p.timeNow(), tagsJSON)
+	if err != nil {
+		return err
+	}
+	rowsUpdated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsUpdated == 0 {
+		return sql.ErrNoRows
+	}
+
+	_, err = tx.Exec(`DELETE FROM tags WHERE repo_id = $1 AND digest = $2`, repo.ID, manifestDigest)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+var restoreManifestFindQuery = sqlext.SimplifyWhitespace(`
+	SELECT deleted_tags_json FROM manifests
+	 WHERE repo_id = $1 AND digest = $2 AND deleted_at IS NOT NULL
+	   FOR UPDATE
+`)
+
+var restoreManifestQuery = sqlext.SimplifyWhitespace(`
+	UPDATE manifests SET deleted_at = NULL, deleted_tags_json = ''
+	 WHERE repo_id = $1 AND digest = $2
+`)
+
+var restoreTagQuery = sqlext.SimplifyWhitespace(`
+	INSERT INTO tags (repo_id, name, digest, pushed_at)
+	VALUES ($1, $2, $3, $4)
+	ON CONFLICT DO NOTHING
+`)
+
+// RestoreManifest takes the given manifest out of the trash. Its former tags
+// are restored as well, unless a tag with the same name has been pushed in
+// the meantime.
+//
+// If the manifest is not in the trash, sql.ErrNoRows is returned.
+func (p *Processor) RestoreManifest(account models.ReducedAccount, repo models.Repository, manifestDigest digest.Digest, actx keppel.AuditContext) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer sqlext.RollbackUnlessCommitted(tx)
+
+	// the former tags need to be read before the UPDATE clears them
+	var tagsJSON string
+	err = tx.QueryRow(restoreManifestFindQuery, repo.ID, manifestDigest).Scan(&tagsJSON)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(restoreManifestQuery, repo.ID, manifestDigest)
+	if err != nil {
+		return err
+	}
+	var tags []string
+	if tagsJSON != "" {
+		err = json.Unmarshal([]byte(tagsJSON), &tags)
+		if err != nil {
+			return fmt.Errorf("cannot parse deleted_tags_json of manifest %s@%s: %w", repo.FullName(), manifestDigest, err)
+		}
+	}
+
+	var restoredTags []string
+	for _, tagName := range tags {
+		result, err := tx.Exec(restoreTagQuery, repo.ID, tagName, manifestDigest, p.timeNow())
+		if err != nil {
+			return err
+		}
+		rowsInserted, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if rowsInserted > 0 {
+			restoredTags = append(restoredTags, tagName)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
 
 	if userInfo := actx.UserIdentity.UserInfo(); userInfo != nil {
 		p.auditor.Record(audittools.Event{
@@ -961,12 +1204,12 @@ func (p *Processor) DeleteManifest(ctx context.Context, account models.ReducedAc
 			Request:    actx.Request,
 			User:       userInfo,
 			ReasonCode: http.StatusOK,
-			Action:     cadf.DeleteAction,
+			Action:     cadf.UpdateAction,
 			Target: auditManifest{
 				Account:    account,
 				Repository: repo,
 				Digest:     manifestDigest,
-				Tags:       tags,
+				Tags:       restoredTags,
 			},
 		})
 	}
@@ -974,12 +1217,17 @@ func (p *Processor) DeleteManifest(ctx context.Context, account models.ReducedAc
 	return nil
 }
 
-// DeleteTag deletes the given tag from the database. The manifest is not deleted.
+// DeleteTag deletes the given tag from the database and returns the digest of
+// the manifest that it pointed to. The manifest is not deleted, even if it is
+// not tagged anymore; cleaning up untagged manifests is left to GC policies.
 // If the tag does not exist, sql.ErrNoRows is returned.
-func (p *Processor) DeleteTag(account models.ReducedAccount, repo models.Repository, tagName string, tagPolicies []keppel.TagPolicy, actx keppel.AuditContext) error {
-	for _, tagPolicy := range tagPolicies {
-		if tagPolicy.BlockDelete && tagPolicy.MatchesRepository(repo.Name) && tagPolicy.MatchesTags([]string{tagName}) {
-			return keppel.ErrDenied.With("cannot delete tag as it is protected by a tag_policy").WithStatus(http.StatusConflict)
+func (p *Processor) DeleteTag(account models.ReducedAccount, repo models.Repository, tagName string, tagPolicies []keppel.TagPolicy, actx keppel.AuditContext) (digest.Digest, error) {
+	// tag policies do not block the cleanup of accounts that are being deleted
+	if !account.IsDeleting {
+		for _, tagPolicy := range tagPolicies {
+			if tagPolicy.BlockDelete && tagPolicy.MatchesRepository(repo.Name) && tagPolicy.MatchesTags([]string{tagName}) {
+				return "", keppel.ErrDenied.With("cannot delete tag as it is protected by a tag_policy").WithStatus(http.StatusConflict)
+			}
 		}
 	}
 
@@ -987,15 +1235,15 @@ func (p *Processor) DeleteTag(account models.ReducedAccount, repo models.Reposit
 		`DELETE FROM tags WHERE repo_id = $1 AND name = $2 RETURNING digest`,
 		repo.ID, tagName)
 	if err != nil {
-		return err
+		return "", err
 	}
 	if digestStr == "" {
-		return sql.ErrNoRows
+		return "", sql.ErrNoRows
 	}
 
 	tagDigest, err := digest.Parse(digestStr)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	if userInfo := actx.UserIdentity.UserInfo(); userInfo != nil {
@@ -1014,7 +1262,7 @@ func (p *Processor) DeleteTag(account models.ReducedAccount, repo models.Reposit
 		})
 	}
 
-	return nil
+	return tagDigest, nil
 }
 
 // auditManifest is an audittools.Target.
@@ -127,9 +127,11 @@ func (p *Processor) checkQuotaForManifestPush(account models.ReducedAccount) err
 // the upstream repo in the corresponding primary account.
 func (p *Processor) getRepoClientForUpstream(account models.ReducedAccount, repo models.Repository) (*client.RepoClient, error) {
 	// use cached client if possible (this one probably already contains a valid
-	// pull token)
+	// pull token), unless the replication credentials have been rotated since
 	if c, ok := p.repoClients[repo.FullName()]; ok {
-		return c, nil
+		if account.ExternalPeerURL == "" || (c.UserName == account.ExternalPeerUserName && c.Password == account.ExternalPeerPassword) {
+			return c, nil
+		}
 	}
 
 	if account.UpstreamPeerHostName != "" {
@@ -140,33 +142,42 @@ func (p *Processor) getRepoClientForUpstream(account models.ReducedAccount, repo
 		}
 
 		c := &client.RepoClient{
-			Scheme:   "https",
-			Host:     peer.HostName,
-			RepoName: repo.FullName(),
-			UserName: "replication@" + p.cfg.APIPublicHostname,
-			Password: peer.OurPassword,
+			Scheme:     "https",
+			Host:       peer.HostName,
+			RepoName:   repo.FullName(),
+			UserName:   "replication@" + p.cfg.APIPublicHostname,
+			Password:   peer.OurPassword,
+			HTTPClient: p.cfg.UpstreamHTTPClient(peer.HostName),
 		}
 		p.repoClients[repo.FullName()] = c
 		return c, nil
 	}
 
 	if account.ExternalPeerURL != "" {
-		c := &client.RepoClient{
-			Scheme:   "https",
-			UserName: account.ExternalPeerUserName,
-			Password: account.ExternalPeerPassword,
-		}
-		if strings.Contains(account.ExternalPeerURL, "/") {
-			fields := strings.SplitN(account.ExternalPeerURL, "/", 2)
-			c.Host = fields[0]
-			c.RepoName = fmt.Sprintf("%s/%s", fields[1], repo.Name)
-		} else {
-			c.Host = account.ExternalPeerURL
-			c.RepoName = repo.Name
-		}
+		c := newRepoClientForExternalPeer(account, repo.Name)
+		c.HTTPClient = p.cfg.UpstreamHTTPClient(c.Host)
 		p.repoClients[repo.FullName()] = c
 		return c, nil
 	}
 
 	return nil, fmt.Errorf("account %q does not have an upstream", account.Name)
 }
+
+// Returns a RepoClient for accessing the given repo in the upstream registry
+// of an external replica account.
+func newRepoClientForExternalPeer(account models.ReducedAccount, repoName string) *client.RepoClient {
+	c := &client.RepoClient{
+		Scheme:   "https",
+		UserName: account.ExternalPeerUserName,
+		Password: account.ExternalPeerPassword,
+	}
+	if strings.Contains(account.ExternalPeerURL, "/") {
+		fields := strings.SplitN(account.ExternalPeerURL, "/", 2)
+		c.Host = fields[0]
+		c.RepoName = fmt.Sprintf("%s/%s", fields[1], repoName)
+	} else {
+		c.Host = account.ExternalPeerURL
+		c.RepoName = repoName
+	}
+	return c
+}
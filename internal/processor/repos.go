@@ -0,0 +1,172 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package processor
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/go-gorp/gorp/v3"
+	"github.com/opencontainers/go-digest"
+	"github.com/sapcc/go-bits/logg"
+	"github.com/sapcc/go-bits/sqlext"
+
+	"github.com/sapcc/keppel/internal/keppel"
+	"github.com/sapcc/keppel/internal/models"
+	"github.com/sapcc/keppel/internal/trivy"
+)
+
+// CopyBlob makes the given blob from the source account available in the
+// target account, and returns the blob record in the target account. If the
+// target account already has a blob with the same digest, that blob is reused.
+// Otherwise the blob contents are copied into a new storage location.
+//
+// The returned blob is not mounted into any repo yet. If the caller does not
+// mount it, it will be cleaned up by the janitor eventually.
+func (p *Processor) CopyBlob(ctx context.Context, blob models.Blob, from, to models.ReducedAccount) (*models.Blob, error) {
+	existingBlob, err := keppel.FindBlobByAccountName(p.db, blob.Digest, to.Name)
+	if err == nil {
+		return existingBlob, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	reader, sizeBytes, err := p.sd.ReadBlob(ctx, from, blob.StorageID)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	newBlob := models.Blob{
+		AccountName:        to.Name,
+		Digest:             blob.Digest,
+		MediaType:          blob.MediaType,
+		BlocksVulnScanning: blob.BlocksVulnScanning,
+	}
+	err = p.storeNewBlob(ctx, to, &newBlob, reader, &sizeBytes)
+	if err != nil {
+		return nil, err
+	}
+	return &newBlob, nil
+}
+
+var repoMovedManifestsQuery = sqlext.SimplifyWhitespace(`
+	SELECT m.digest, COALESCE(t.has_enriched_report, FALSE)
+	  FROM manifests m
+	  LEFT OUTER JOIN trivy_security_info t ON t.repo_id = m.repo_id AND t.digest = m.digest
+	 WHERE m.repo_id = $1
+`)
+
+var repoMountedBlobsQuery = sqlext.SimplifyWhitespace(`
+	SELECT b.* FROM blobs b JOIN blob_mounts bm ON bm.blob_id = b.id WHERE bm.repo_id = $1
+`)
+
+// MoveRepository renames the given repository to `newName`, and moves it into
+// `to` if that is a different account than `from`. All manifests, tags and
+// blob mounts stay attached to the repository. When moving across accounts,
+// the blobs are copied into the target account using CopyBlob().
+//
+// The caller is responsible for checking that the target repository does not
+// exist yet, and that no uploads are in progress in the source repository.
+func (p *Processor) MoveRepository(ctx context.Context, from models.ReducedAccount, repo models.Repository, to models.ReducedAccount, newName string) error {
+	// collect the manifests that need to be copied to their new storage location
+	type movedManifest struct {
+		Digest            digest.Digest
+		HasEnrichedReport bool
+	}
+	var manifests []movedManifest
+	err := sqlext.ForeachRow(p.db, repoMovedManifestsQuery, []any{repo.ID}, func(rows *sql.Rows) error {
+		var m movedManifest
+		err := rows.Scan(&m.Digest, &m.HasEnrichedReport)
+		manifests = append(manifests, m)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	// the storage location of manifests and Trivy reports depends on the repo
+	// name, so we need to write them to the new location first (if the DB
+	// update fails afterwards, the new copies will be cleaned up by the janitor)
+	for _, m := range manifests {
+		contents, err := p.sd.ReadManifest(ctx, from, repo.Name, m.Digest)
+		if err != nil {
+			return fmt.Errorf("cannot read manifest %s@%s: %w", repo.FullName(), m.Digest, err)
+		}
+		err = p.sd.WriteManifest(ctx, to, newName, m.Digest, contents)
+		if err != nil {
+			return fmt.Errorf("cannot write manifest %s/%s@%s: %w", to.Name, newName, m.Digest, err)
+		}
+		if m.HasEnrichedReport {
+			report, err := p.sd.ReadTrivyReport(ctx, from, repo.Name, m.Digest, "json")
+			if err != nil {
+				return fmt.Errorf("cannot read Trivy report for %s@%s: %w", repo.FullName(), m.Digest, err)
+			}
+			err = p.sd.WriteTrivyReport(ctx, to, newName, m.Digest, trivy.ReportPayload{Format: "json", Contents: report})
+			if err != nil {
+				return fmt.Errorf("cannot write Trivy report for %s/%s@%s: %w", to.Name, newName, m.Digest, err)
+			}
+		}
+	}
+
+	// when moving across accounts, the blobs need to be made available in the target account
+	blobIDMapping := make(map[int64]int64) // key = blob ID in source account, value = blob ID in target account
+	if from.Name != to.Name {
+		var blobs []models.Blob
+		_, err := p.db.Select(&blobs, repoMountedBlobsQuery, repo.ID)
+		if err != nil {
+			return err
+		}
+		for _, blob := range blobs {
+			newBlob, err := p.CopyBlob(ctx, blob, from, to)
+			if err != nil {
+				return fmt.Errorf("cannot copy blob %s into account %s: %w", blob.Digest, to.Name, err)
+			}
+			blobIDMapping[blob.ID] = newBlob.ID
+		}
+	}
+
+	err = p.insideTransaction(ctx, func(ctx context.Context, tx *gorp.Transaction) error {
+		for oldBlobID, newBlobID := range blobIDMapping {
+			_, err := tx.Exec(`INSERT INTO blob_mounts (blob_id, repo_id) VALUES ($1, $2) ON CONFLICT DO NOTHING`, newBlobID, repo.ID)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(`UPDATE manifest_blob_refs SET blob_id = $1 WHERE repo_id = $2 AND blob_id = $3`, newBlobID, repo.ID, oldBlobID)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(`DELETE FROM blob_mounts WHERE blob_id = $1 AND repo_id = $2`, oldBlobID, repo.ID)
+			if err != nil {
+				return err
+			}
+		}
+		_, err := tx.Exec(`UPDATE repos SET account_name = $1, name = $2 WHERE id = $3`, to.Name, newName, repo.ID)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	// the old copies in the storage are not referenced by the DB anymore; if
+	// deleting them fails, they will be cleaned up by the janitor eventually
+	for _, m := range manifests {
+		err := p.sd.DeleteManifest(ctx, from, repo.Name, m.Digest)
+		if err != nil {
+			logg.Error("cannot delete manifest %s@%s after moving the repo to %s/%s: %s",
+				repo.FullName(), m.Digest, to.Name, newName, err.Error())
+		}
+		if m.HasEnrichedReport {
+			err := p.sd.DeleteTrivyReport(ctx, from, repo.Name, m.Digest, "json")
+			if err != nil {
+				logg.Error("cannot delete Trivy report for %s@%s after moving the repo to %s/%s: %s",
+					repo.FullName(), m.Digest, to.Name, newName, err.Error())
+			}
+		}
+	}
+	return nil
+}
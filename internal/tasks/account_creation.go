@@ -0,0 +1,82 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package tasks
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-gorp/gorp/v3"
+	. "github.com/majewsky/gg/option"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sapcc/go-bits/jobloop"
+	"github.com/sapcc/go-bits/sqlext"
+
+	"github.com/sapcc/keppel/internal/keppel"
+	"github.com/sapcc/keppel/internal/models"
+)
+
+// abandonedAccountCreationTimeout is how long an account may stay in state
+// "creating" before its setup is considered abandoned. This is much longer
+// than any PUT request could reasonably take.
+const abandonedAccountCreationTimeout = 1 * time.Hour
+
+var abandonedAccountCreationSearchQuery = sqlext.SimplifyWhitespace(`
+	SELECT * FROM accounts
+	 WHERE is_creating AND creation_started_at < $1
+	ORDER BY creation_started_at ASC, name ASC
+	-- only one account at a time
+	LIMIT 1
+	-- prevent other janitor processes from cleaning up the same account concurrently
+	FOR UPDATE SKIP LOCKED
+`)
+
+// AbandonedAccountCreationCleanupJob is a job. Each task finds an account that
+// has been in state "creating" for more than an hour (because the request
+// creating it was interrupted and never repeated), releases its name claim, and
+// removes it from the database.
+func (j *Janitor) AbandonedAccountCreationCleanupJob(registerer prometheus.Registerer) jobloop.Job {
+	return (&jobloop.TxGuardedJob[*gorp.Transaction, models.Account]{
+		Metadata: jobloop.JobMetadata{
+			ReadableName: "cleanup of abandoned account creations",
+			CounterOpts: prometheus.CounterOpts{
+				Name: "keppel_abandoned_account_creation_cleanups",
+				Help: "Counter for cleanup operations for accounts whose setup was abandoned.",
+			},
+		},
+		BeginTx: j.db.Begin,
+		DiscoverRow: func(_ context.Context, tx *gorp.Transaction, _ prometheus.Labels) (account models.Account, err error) {
+			maxCreationStartedAt := j.timeNow().Add(-abandonedAccountCreationTimeout)
+			err = tx.SelectOne(&account, abandonedAccountCreationSearchQuery, maxCreationStartedAt)
+			dueAt := account.CreationStartedAt
+			if createdAt, ok := dueAt.Unpack(); ok {
+				dueAt = Some(createdAt.Add(abandonedAccountCreationTimeout))
+			}
+			j.reportOldestPending("abandoned-account-creation-cleanup", dueAt, err)
+			return account, err
+		},
+		ProcessRow: j.deleteAbandonedAccountCreation,
+	}).Setup(registerer)
+}
+
+func (j *Janitor) deleteAbandonedAccountCreation(ctx context.Context, tx *gorp.Transaction, account models.Account, labels prometheus.Labels) error {
+	ctx = keppel.WithLogFields(ctx, keppel.LogFields{Account: account.Name})
+
+	// the account cannot have any contents since all writes into it were
+	// rejected, so only the name claim needs to be cleaned up (this happens while
+	// we hold the row lock, so that a concurrent PUT request resuming the setup
+	// cannot complete it in the meantime; if the name was never claimed,
+	// ForfeitAccountName() does nothing)
+	_, err := tx.Delete(&account)
+	if err != nil {
+		return err
+	}
+	err = j.fd.ForfeitAccountName(ctx, account)
+	if err != nil {
+		return fmt.Errorf("while cleaning up name claim for abandoned account creation: %w", err)
+	}
+	keppel.LogInfo(ctx, "cleaned up abandoned creation of account %q", account.Name)
+	return tx.Commit()
+}
@@ -0,0 +1,52 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package tasks
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/majewsky/gg/option"
+	"github.com/sapcc/go-bits/easypg"
+
+	"github.com/sapcc/keppel/internal/models"
+	"github.com/sapcc/keppel/internal/test"
+)
+
+func TestAbandonedAccountCreationCleanup(t *testing.T) {
+	j, s := setup(t)
+	job := j.AbandonedAccountCreationCleanupJob(s.Registry)
+
+	// regular accounts are not touched
+	s.Clock.StepBy(24 * time.Hour)
+	expectNoRows(t, job.ProcessOne(s.Ctx))
+
+	test.MustDo(t, s.DB.Insert(&models.Account{
+		Name:                     "abandoned",
+		AuthTenantID:             "test1authtenant",
+		SecurityScanPoliciesJSON: "[]",
+		TagPoliciesJSON:          "[]",
+		GCPoliciesJSON:           "[]",
+		IsCreating:               true,
+		CreationStartedAt:        Some(s.Clock.Now()),
+	}))
+	tr, _ := easypg.NewTracker(t, s.DB.Db)
+
+	// while the setup could still be in progress, the account is left alone
+	s.Clock.StepBy(30 * time.Minute)
+	expectNoRows(t, job.ProcessOne(s.Ctx))
+	tr.DBChanges().AssertEmpty()
+
+	// if the name claim cannot be released, the account is kept for the next attempt
+	s.Clock.StepBy(31 * time.Minute)
+	s.FD.ForfeitFails = true
+	expectError(t, "while cleaning up name claim for abandoned account creation: ForfeitAccountName failed as requested", job.ProcessOne(s.Ctx))
+	tr.DBChanges().AssertEmpty()
+
+	// otherwise, the account is removed
+	s.FD.ForfeitFails = false
+	expectSuccess(t, job.ProcessOne(s.Ctx))
+	tr.DBChanges().AssertEqualf(`DELETE FROM accounts WHERE name = 'abandoned';`)
+	expectNoRows(t, job.ProcessOne(s.Ctx))
+}
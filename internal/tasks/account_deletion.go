@@ -10,21 +10,26 @@ import (
 	"fmt"
 	"time"
 
+	. "github.com/majewsky/gg/option"
 	"github.com/opencontainers/go-digest"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sapcc/go-bits/jobloop"
-	"github.com/sapcc/go-bits/logg"
 	"github.com/sapcc/go-bits/sqlext"
 
 	"github.com/sapcc/keppel/internal/keppel"
 	"github.com/sapcc/keppel/internal/models"
 )
 
-// EnforceManagedAccounts is a job. Each task creates newly discovered accounts from the driver.
+// DeleteAccountsJob is a job. Each task finds an account that has been marked
+// for deletion, and cleans up its contents until the account can be deleted.
+//
+// Tasks are claimed with row locks during discovery, so it is safe to run this
+// job with multiple goroutines or in multiple janitor processes at once.
 func (j *Janitor) DeleteAccountsJob(registerer prometheus.Registerer) jobloop.Job {
 	return (&jobloop.ProducerConsumerJob[models.AccountName]{
 		Metadata: jobloop.JobMetadata{
-			ReadableName: "delete accounts marked for deletion",
+			ReadableName:    "delete accounts marked for deletion",
+			ConcurrencySafe: true,
 			CounterOpts: prometheus.CounterOpts{
 				Name: "keppel_account_deletions",
 				Help: "Counter for attempts to cleanup a deleted account..",
@@ -35,17 +40,50 @@ func (j *Janitor) DeleteAccountsJob(registerer prometheus.Registerer) jobloop.Jo
 	}).Setup(registerer)
 }
 
+// accountDeletionClaimDuration is how long an account is withheld from other
+// workers after being discovered by discoverAccountForDeletion. Processing
+// always reschedules the next attempt on its own, so this only matters if the
+// worker goes away in the middle of processing.
+const accountDeletionClaimDuration = 1 * time.Hour
+
 var (
 	accountDeletionSelectQuery = sqlext.SimplifyWhitespace(`
-		SELECT name FROM accounts
+		SELECT name, next_deletion_attempt_at FROM accounts
 		WHERE is_deleting AND next_deletion_attempt_at < $1
 		ORDER BY next_deletion_attempt_at ASC, name ASC
+		-- only one account at a time
+		LIMIT 1
+		-- do not wait for accounts that are being claimed by other workers concurrently
+		FOR UPDATE SKIP LOCKED
+	`)
+	accountDeletionClaimQuery = sqlext.SimplifyWhitespace(`
+		UPDATE accounts SET next_deletion_attempt_at = $2 WHERE name = $1
 	`)
 )
 
 func (j *Janitor) discoverAccountForDeletion(_ context.Context, _ prometheus.Labels) (accountName models.AccountName, err error) {
-	err = j.db.SelectOne(&accountName, accountDeletionSelectQuery, j.timeNow())
-	return accountName, err
+	tx, err := j.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer sqlext.RollbackUnlessCommitted(tx)
+
+	var nextDeletionAttemptAt time.Time
+	err = tx.QueryRow(accountDeletionSelectQuery, j.timeNow()).Scan(&accountName, &nextDeletionAttemptAt)
+	j.reportOldestPending("account-deletion", Some(nextDeletionAttemptAt), err)
+	if err != nil {
+		return "", err
+	}
+
+	// claim the account by moving its next_deletion_attempt_at into the future,
+	// so that other workers will not select it once our row lock is released
+	// (we cannot hold the row lock during processing since deleteMarkedAccount
+	// updates the account through other DB connections)
+	_, err = tx.Exec(accountDeletionClaimQuery, accountName, j.timeNow().Add(accountDeletionClaimDuration))
+	if err != nil {
+		return "", err
+	}
+	return accountName, tx.Commit()
 }
 
 var (
@@ -70,8 +108,16 @@ var (
 	deleteAccountMarkAllBlobsForDeletionQuery = `UPDATE blobs SET can_be_deleted_at = $2 WHERE account_name = $1`
 )
 
-func (j *Janitor) deleteMarkedAccount(ctx context.Context, accountName models.AccountName, labels prometheus.Labels) (returnErr error) {
-	account, err := keppel.FindAccount(j.db, accountName)
+func (j *Janitor) deleteMarkedAccount(ctx context.Context, accountName models.AccountName, labels prometheus.Labels) error {
+	ctx = keppel.WithLogFields(ctx, keppel.LogFields{Account: accountName})
+	return j.deleteMarkedAccountInPasses(ctx, accountName, labels, 0)
+}
+
+// Each pass deletes the manifests that are not referenced by other manifests,
+// so it takes one pass per level of manifest nesting to delete all manifests.
+// The `pass` argument counts the passes to bound the recursion depth.
+func (j *Janitor) deleteMarkedAccountInPasses(ctx context.Context, accountName models.AccountName, labels prometheus.Labels, pass int) (returnErr error) {
+	account, err := keppel.FindAccount(ctx, j.db, accountName)
 	if errors.Is(err, sql.ErrNoRows) {
 		// assume the account got already deleted
 		return nil
@@ -82,9 +128,9 @@ func (j *Janitor) deleteMarkedAccount(ctx context.Context, accountName models.Ac
 
 	defer func() {
 		if returnErr != nil {
-			_, err = j.db.Exec(`UPDATE accounts SET next_deletion_attempt_at = $1 WHERE name = $2`, j.timeNow().Add(10*time.Minute), account.Name)
+			_, err = j.db.Exec(`UPDATE accounts SET next_deletion_attempt_at = $1 WHERE name = $2`, j.timeNow().Add(j.addJitter(10*time.Minute)), account.Name)
 			if err != nil {
-				logg.Error("additional error encountered while marking account %s for deletion: %s", account.Name, err.Error())
+				keppel.LogError(ctx, "additional error encountered while marking account %s for deletion: %s", account.Name, err.Error())
 			}
 		}
 	}()
@@ -145,7 +191,14 @@ func (j *Janitor) deleteMarkedAccount(ctx context.Context, accountName models.Ac
 	}
 	if manifestCount > 0 {
 		if deletedManifestCount > 0 {
-			return j.deleteMarkedAccount(ctx, account.Name, labels)
+			// if manifests are nested more deeply than allowed, we will continue with
+			// the next set of passes on the next deletion attempt
+			maxDepth := j.cfg.EffectiveMaxManifestReferenceDepth()
+			if pass >= maxDepth {
+				return fmt.Errorf("cannot finish deleting account %q: %d manifests remain after %d passes, since manifest references are nested more than %d levels deep",
+					account.Name, manifestCount, pass+1, maxDepth)
+			}
+			return j.deleteMarkedAccountInPasses(ctx, account.Name, labels, pass+1)
 		} else {
 			return fmt.Errorf("cannot make progress on deleting account %q: %d manifests remain, but none are ready to delete",
 				account.Name, manifestCount)
@@ -176,11 +229,11 @@ func (j *Janitor) deleteMarkedAccount(ctx context.Context, accountName models.Ac
 			return err
 		}
 
-		_, err = j.db.Exec(`UPDATE accounts SET next_deletion_attempt_at = $1 WHERE name = $2`, j.timeNow().Add(1*time.Minute), account.Name)
+		_, err = j.db.Exec(`UPDATE accounts SET next_deletion_attempt_at = $1 WHERE name = $2`, j.timeNow().Add(j.addJitter(1*time.Minute)), account.Name)
 		if err != nil {
 			return err
 		}
-		logg.Info("cleaning up managed account %q: waiting for %d blobs to be deleted", account.Name, blobCount)
+		keppel.LogInfo(ctx, "cleaning up managed account %q: waiting for %d blobs to be deleted", account.Name, blobCount)
 		return nil
 	}
 
@@ -255,19 +308,12 @@ func (j *Janitor) deleteMarkedAccount(ctx context.Context, accountName models.Ac
 
 	// end of section that should be kept in sync with tasks/storage.go:sweepStorage
 
-	// start deleting the account in a transaction
-	tx, err := j.db.Begin()
-	if err != nil {
-		return err
-	}
-	defer sqlext.RollbackUnlessCommitted(tx)
-	_, err = tx.Delete(account)
-	if err != nil {
-		return err
-	}
-
-	// before committing the transaction, confirm account deletion with the
-	// storage driver and the federation driver
+	// before deleting the account, confirm account deletion with the storage
+	// driver and the federation driver (this is not done inside a transaction
+	// to avoid holding a lock on the account row while these drivers talk to
+	// their backends, including any retries on transient errors; if deleting
+	// the row fails afterwards, the next attempt repeats these calls, which is
+	// fine since ForfeitAccountName() is idempotent)
 	err = j.sd.CleanupAccount(ctx, accountReduced)
 	if err != nil {
 		return fmt.Errorf("while cleaning up storage for account: %w", err)
@@ -277,5 +323,6 @@ func (j *Janitor) deleteMarkedAccount(ctx context.Context, accountName models.Ac
 		return fmt.Errorf("while cleaning up name claim for account: %w", err)
 	}
 
-	return tx.Commit()
+	_, err = j.db.Delete(account)
+	return err
 }
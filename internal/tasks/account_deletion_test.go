@@ -0,0 +1,142 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package tasks
+
+import (
+	"database/sql"
+	"net/http"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/easypg"
+
+	"github.com/sapcc/keppel/internal/models"
+	"github.com/sapcc/keppel/internal/test"
+)
+
+func TestDeleteAccountsWithConcurrentWorkers(t *testing.T) {
+	accountNames := []models.AccountName{"delete1", "delete2", "delete3", "delete4"}
+	opts := make([]test.SetupOption, len(accountNames))
+	for idx, name := range accountNames {
+		opts[idx] = test.WithAccount(models.Account{Name: name, AuthTenantID: "test1authtenant"})
+	}
+	j, s := setup(t, opts...)
+	s.Clock.StepBy(1 * time.Hour)
+	test.MustExec(t, s.DB,
+		`UPDATE accounts SET is_deleting = TRUE, next_deletion_attempt_at = $1 WHERE name LIKE 'delete%'`,
+		s.Clock.Now(),
+	)
+	s.Clock.StepBy(1 * time.Minute)
+
+	// several workers discovering at the same time must each claim a different account
+	var (
+		wg               sync.WaitGroup
+		mutex            sync.Mutex
+		discoveredNames  []models.AccountName
+		discoveredErrors []error
+	)
+	for range len(accountNames) + 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			name, err := j.discoverAccountForDeletion(s.Ctx, nil)
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err == nil {
+				discoveredNames = append(discoveredNames, name)
+			} else {
+				discoveredErrors = append(discoveredErrors, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	slices.Sort(discoveredNames)
+	assert.DeepEqual(t, "discovered accounts", discoveredNames, accountNames)
+	assert.DeepEqual(t, "number of discovery errors", len(discoveredErrors), 2)
+	for _, err := range discoveredErrors {
+		expectError(t, sql.ErrNoRows.Error(), err)
+	}
+
+	// the claimed accounts are not discovered again until the claim expires
+	_, err := j.discoverAccountForDeletion(s.Ctx, nil)
+	expectError(t, sql.ErrNoRows.Error(), err)
+	s.Clock.StepBy(accountDeletionClaimDuration + time.Minute)
+
+	// running the entire job in parallel deletes each account exactly once
+	tr, _ := easypg.NewTracker(t, s.DB.Db)
+	job := j.DeleteAccountsJob(s.Registry)
+	errs := make([]error, len(accountNames))
+	for idx := range accountNames {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[idx] = job.ProcessOne(s.Ctx)
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		expectSuccess(t, err)
+	}
+	expectError(t, sql.ErrNoRows.Error(), job.ProcessOne(s.Ctx))
+	tr.DBChanges().AssertEqualf(`
+			DELETE FROM accounts WHERE name = 'delete1';
+			DELETE FROM accounts WHERE name = 'delete2';
+			DELETE FROM accounts WHERE name = 'delete3';
+			DELETE FROM accounts WHERE name = 'delete4';
+		`)
+}
+
+func TestDeleteAccountWithNestedManifests(t *testing.T) {
+	j, s := setup(t)
+	repoRef := models.Repository{AccountName: "test1", Name: "foo"}
+
+	// as a setup, upload an image index containing an image list containing an image
+	image := test.GenerateImage(test.GenerateExampleLayer(1))
+	list := test.GenerateImageList(image)
+	list.MustUpload(t, s, repoRef, "")
+	index := test.GenerateImageIndex(list.Manifest)
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/v2/test1/foo/manifests/" + index.Digest.String(),
+		Header: map[string]string{
+			"Authorization": "Bearer " + s.GetToken(t, "repository:test1/foo:pull,push"),
+			"Content-Type":  index.MediaType,
+		},
+		Body:         assert.ByteData(index.Contents),
+		ExpectStatus: http.StatusCreated,
+	}.Check(t, s.Handler)
+
+	// lower the limit for manifest nesting below what the account contains
+	j.cfg.MaxManifestReferenceDepth = 1
+
+	s.Clock.StepBy(1 * time.Hour)
+	test.MustExec(t, s.DB,
+		`UPDATE accounts SET is_deleting = TRUE, next_deletion_attempt_at = $1 WHERE name = $2`,
+		s.Clock.Now(), "test1",
+	)
+	s.Clock.StepBy(1 * time.Minute)
+	expectManifestCount := func(expected int64) {
+		t.Helper()
+		count, err := s.DB.SelectInt(`SELECT COUNT(*) FROM manifests`)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		assert.DeepEqual(t, "number of manifests", count, expected)
+	}
+
+	// the first deletion attempt stops after one pass per allowed nesting level...
+	job := j.DeleteAccountsJob(s.Registry)
+	expectError(t, `cannot finish deleting account "test1": 1 manifests remain after 2 passes, since manifest references are nested more than 1 levels deep`,
+		job.ProcessOne(s.Ctx))
+	expectManifestCount(1)
+
+	// ...and the next attempt continues where the previous one left off
+	s.Clock.StepBy(15 * time.Minute)
+	expectSuccess(t, job.ProcessOne(s.Ctx))
+	expectManifestCount(0)
+}
@@ -21,6 +21,7 @@ import (
 	peerclient "github.com/sapcc/keppel/internal/client/peer"
 	"github.com/sapcc/keppel/internal/keppel"
 	"github.com/sapcc/keppel/internal/models"
+	"github.com/sapcc/keppel/internal/processor"
 )
 
 // EnforceManagedAccounts is a job. Each task creates newly discovered accounts from the driver.
@@ -90,7 +91,7 @@ func (j *Janitor) enforceManagedAccount(ctx context.Context, accountName models.
 		}
 	} else {
 		var accountModel *models.Account
-		accountModel, err = keppel.FindAccount(j.db, accountName)
+		accountModel, err = keppel.FindAccount(ctx, j.db, accountName)
 		if err != nil {
 			if errors.Is(err, sql.ErrNoRows) {
 				nextCheckDuration = 0 // assume the account got already deleted
@@ -155,8 +156,13 @@ func (j *Janitor) createOrUpdateManagedAccount(ctx context.Context, account kepp
 		return nil
 	}
 
-	// create or update account
-	_, rerr := j.processor().CreateOrUpdateAccount(ctx, account, userIdentity.UserInfo(), janitorDummyRequest, getSubleaseToken, setCustomFields)
+	// create or update account (the upstream of managed external replica accounts is not validated,
+	// since a temporary upstream outage should not block the enforcement of the other account settings;
+	// conflicts between GC and tag policies are accepted since the operator has configured them deliberately)
+	_, rerr := j.processor().CreateOrUpdateAccount(ctx, account, userIdentity.UserInfo(), janitorDummyRequest, processor.CreateOrUpdateAccountOptions{
+		ValidateUpstream:     false,
+		AllowPolicyConflicts: true,
+	}, getSubleaseToken, setCustomFields)
 	if rerr != nil {
 		return rerr
 	}
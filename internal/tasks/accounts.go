@@ -5,35 +5,71 @@ package tasks
 
 import (
 	"context"
+	"database/sql"
 	"time"
 
+	"github.com/go-gorp/gorp/v3"
+	. "github.com/majewsky/gg/option"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sapcc/go-bits/jobloop"
-	"github.com/sapcc/go-bits/logg"
 	"github.com/sapcc/go-bits/sqlext"
 
+	"github.com/sapcc/keppel/internal/keppel"
 	"github.com/sapcc/keppel/internal/models"
 )
 
 var accountAnnouncementSearchQuery = sqlext.SimplifyWhitespace(`
 	SELECT * FROM accounts
-		WHERE next_federation_announcement_at IS NULL OR next_federation_announcement_at < $1
-	-- accounts without any announcements first, then sorted by last announcement
-	ORDER BY next_federation_announcement_at IS NULL DESC, next_federation_announcement_at ASC
-	-- only one account at a time
-	LIMIT 1
+		WHERE (next_federation_announcement_at IS NULL OR next_federation_announcement_at < $1)
+		-- accounts that are still being created have not necessarily claimed their name yet
+		  AND NOT is_creating
+	-- accounts without any announcements first, then sorted by last announcement (ties are broken by name to get stable batches)
+	ORDER BY next_federation_announcement_at IS NULL DESC, next_federation_announcement_at ASC, name ASC
+	-- only one account at a time (or one batch of accounts, if the federation driver supports batching)
+	LIMIT $2
+	-- prevent other janitor processes from announcing the same account concurrently
+	FOR UPDATE SKIP LOCKED
 `)
 
 var accountAnnouncementDoneQuery = sqlext.SimplifyWhitespace(`
 	UPDATE accounts SET next_federation_announcement_at = $2 WHERE name = $1
 `)
 
+// Upper limit for how many accounts are announced in one task when the
+// FederationDriver supports batch announcements.
+const accountAnnouncementBatchSize = 100
+
+var announcementBatchSizeHistogram = prometheus.NewHistogram(
+	prometheus.HistogramOpts{
+		Name:    "keppel_account_federation_announcement_batch_size",
+		Help:    "Histogram of how many accounts were announced to the federation driver in one task of the account federation announcement job.",
+		Buckets: []float64{1, 2, 5, 10, 20, 50, 100},
+	},
+)
+
+func init() {
+	prometheus.MustRegister(announcementBatchSizeHistogram)
+}
+
 // AccountFederationAnnouncementJob is a job. Each task finds an account that has not been
 // announced to the FederationDriver in more than an hour, and announces it. If
 // no accounts need to be announced, sql.ErrNoRows is returned to instruct the
 // caller to slow down.
+//
+// If the FederationDriver supports batch announcements (see
+// keppel.SupportsBatchAnnouncements), each task instead finds and announces up
+// to accountAnnouncementBatchSize accounts.
+//
+// The accounts are locked while their next announcement is scheduled, so
+// multiple janitor processes can run this job concurrently. The announcement
+// itself happens after the transaction has been committed.
 func (j *Janitor) AccountFederationAnnouncementJob(registerer prometheus.Registerer) jobloop.Job { //nolint: dupl // interface implementation of different things
-	return (&jobloop.ProducerConsumerJob[models.Account]{
+	batchSize := 1
+	if keppel.SupportsBatchAnnouncements(j.fd) {
+		batchSize = accountAnnouncementBatchSize
+	}
+
+	return (&jobloop.TxGuardedJob[*gorp.Transaction, []models.Account]{
 		Metadata: jobloop.JobMetadata{
 			ReadableName: "account federation announcement",
 			CounterOpts: prometheus.CounterOpts{
@@ -41,22 +77,65 @@ func (j *Janitor) AccountFederationAnnouncementJob(registerer prometheus.Registe
 				Help: "Counter for announcements of existing accounts to the federation driver.",
 			},
 		},
-		DiscoverTask: func(_ context.Context, _ prometheus.Labels) (account models.Account, err error) {
-			err = j.db.SelectOne(&account, accountAnnouncementSearchQuery, j.timeNow())
-			return account, err
+		BeginTx: j.db.Begin,
+		DiscoverRow: func(_ context.Context, tx *gorp.Transaction, _ prometheus.Labels) (accounts []models.Account, err error) {
+			_, err = tx.Select(&accounts, accountAnnouncementSearchQuery, j.timeNow(), batchSize)
+			if err == nil && len(accounts) == 0 {
+				err = sql.ErrNoRows
+			}
+			var dueAt Option[time.Time]
+			if len(accounts) > 0 {
+				dueAt = accounts[0].NextFederationAnnouncementAt
+			}
+			j.reportOldestPending("account-federation-announcement", dueAt, err)
+			return accounts, err
 		},
-		ProcessTask: j.announceAccountToFederation,
+		ProcessRow: j.announceAccountsToFederation,
 	}).Setup(registerer)
 }
 
-func (j *Janitor) announceAccountToFederation(ctx context.Context, account models.Account, labels prometheus.Labels) error {
-	err := j.fd.RecordExistingAccount(ctx, account, j.timeNow())
+func (j *Janitor) announceAccountsToFederation(ctx context.Context, tx *gorp.Transaction, accounts []models.Account, labels prometheus.Labels) error {
+	// claim the accounts by scheduling their next announcement before we
+	// announce them, so that the row locks do not need to be held during the
+	// (potentially slow) calls into the federation driver
+	for _, account := range accounts {
+		_, err := tx.Exec(accountAnnouncementDoneQuery, account.Name, j.timeNow().Add(j.addJitter(1*time.Hour)))
+		if err != nil {
+			return err
+		}
+	}
+	err := tx.Commit()
 	if err != nil {
-		// since the announcement is not critical for day-to-day operation, we
-		// accept that it can fail and move on regardless
-		logg.Error("cannot announce account %q to federation: %s", account.Name, err.Error())
+		return err
 	}
 
-	_, err = j.db.Exec(accountAnnouncementDoneQuery, account.Name, j.timeNow().Add(j.addJitter(1*time.Hour)))
-	return err
+	announcementBatchSizeHistogram.Observe(float64(len(accounts)))
+	errs := keppel.RecordExistingAccounts(ctx, j.fd, accounts, j.timeNow())
+	for idx, account := range accounts {
+		if errs[idx] != nil {
+			// since the announcement is not critical for day-to-day operation, we
+			// accept that it can fail and move on regardless
+			keppel.LogError(keppel.WithLogFields(ctx, keppel.LogFields{Account: account.Name}), "cannot announce account %q to federation: %s", account.Name, errs[idx].Error())
+		}
+	}
+	return nil
+}
+
+// FederationArchiveSweepJob is a job. Each task instructs the FederationDriver
+// to remove archived account name claims whose retention period has elapsed.
+func (j *Janitor) FederationArchiveSweepJob(registerer prometheus.Registerer) jobloop.Job {
+	return (&jobloop.CronJob{
+		Metadata: jobloop.JobMetadata{
+			ReadableName: "federation archive sweep",
+			CounterOpts: prometheus.CounterOpts{
+				Name: "keppel_federation_archive_sweeps",
+				Help: "Counter for sweeps of archived account name claims in the federation driver.",
+			},
+		},
+		Interval:     1 * time.Hour,
+		InitialDelay: 1 * time.Minute,
+		Task: func(ctx context.Context, _ prometheus.Labels) error {
+			return j.fd.SweepArchivedAccountNames(ctx, j.timeNow())
+		},
+	}).Setup(registerer)
 }
@@ -5,6 +5,7 @@ package tasks
 
 import (
 	"database/sql"
+	"slices"
 	"testing"
 	"time"
 
@@ -50,6 +51,54 @@ func TestAnnounceAccountsToFederation(t *testing.T) {
 	expectAccountsAnnouncedJustNow(t, s /*, nothing */)
 }
 
+func TestAnnounceAccountsToFederationInBatches(t *testing.T) {
+	_, s := setup(t)
+	s.FD.RecordedAccounts = nil
+	s.Clock.StepBy(1 * time.Hour)
+
+	var account1 models.Account
+	test.MustDo(t, s.DB.SelectOne(&account1, `SELECT * FROM accounts`))
+	account2 := models.Account{Name: "test2", AuthTenantID: "test2authtenant", GCPoliciesJSON: "[]"}
+	test.MustDo(t, s.DB.Insert(&account2))
+
+	// when the federation driver supports batching, all due accounts are announced in one task
+	fd := &test.BatchAnnouncingFederationDriver{FederationDriver: s.FD}
+	j := NewJanitor(s.Config, fd, s.SD, s.ICD, s.DB, s.AMD, s.Auditor).OverrideTimeNow(s.Clock.Now).OverrideGenerateStorageID(s.SIDGenerator.Next)
+	j.DisableJitter()
+	accountJob := j.AccountFederationAnnouncementJob(s.Registry)
+
+	expectSuccess(t, accountJob.ProcessOne(s.Ctx))
+	expectAccountsAnnouncedJustNow(t, s, account1, account2)
+	expectError(t, sql.ErrNoRows.Error(), accountJob.ProcessOne(s.Ctx))
+	expectAccountsAnnouncedJustNow(t, s /*, nothing */)
+	assert.DeepEqual(t, "announced batch sizes", fd.RecordedBatchSizes, []int{2})
+}
+
+func TestAnnounceAccountsToFederationInBatchesUnsupported(t *testing.T) {
+	_, s := setup(t)
+	s.FD.RecordedAccounts = nil
+	s.Clock.StepBy(1 * time.Hour)
+
+	var account1 models.Account
+	test.MustDo(t, s.DB.SelectOne(&account1, `SELECT * FROM accounts`))
+	account2 := models.Account{Name: "test2", AuthTenantID: "test2authtenant", GCPoliciesJSON: "[]"}
+	test.MustDo(t, s.DB.Insert(&account2))
+
+	// when the federation driver reports that batching is not actually supported
+	// (e.g. because of a non-batching subdriver in the "multi" driver), accounts are announced one at a time
+	fd := &test.BatchAnnouncingFederationDriver{FederationDriver: s.FD, BatchingUnsupported: true}
+	j := NewJanitor(s.Config, fd, s.SD, s.ICD, s.DB, s.AMD, s.Auditor).OverrideTimeNow(s.Clock.Now).OverrideGenerateStorageID(s.SIDGenerator.Next)
+	j.DisableJitter()
+	accountJob := j.AccountFederationAnnouncementJob(s.Registry)
+
+	expectSuccess(t, accountJob.ProcessOne(s.Ctx))
+	expectAccountsAnnouncedJustNow(t, s, account1)
+	expectSuccess(t, accountJob.ProcessOne(s.Ctx))
+	expectAccountsAnnouncedJustNow(t, s, account2)
+	expectError(t, sql.ErrNoRows.Error(), accountJob.ProcessOne(s.Ctx))
+	assert.DeepEqual(t, "announced batch sizes", fd.RecordedBatchSizes, []int{1, 1})
+}
+
 func expectAccountsAnnouncedJustNow(t *testing.T, s test.Setup, accounts ...models.Account) {
 	t.Helper()
 	var expected []test.AccountRecordedByFederationDriver
@@ -65,3 +114,36 @@ func expectAccountsAnnouncedJustNow(t *testing.T, s test.Setup, accounts ...mode
 	// reset for next test step
 	s.FD.RecordedAccounts = nil
 }
+
+func TestAnnounceAccountsToFederationConcurrently(t *testing.T) {
+	_, s := setup(t)
+	s.Clock.StepBy(1 * time.Hour)
+	test.MustDo(t, s.DB.Insert(&models.Account{Name: "test2", AuthTenantID: "test2authtenant", GCPoliciesJSON: "[]"}))
+
+	// while one janitor process holds an account in a running transaction,
+	// another janitor process discovers the next account instead of blocking or
+	// selecting the same account
+	tx1, err := s.DB.Begin()
+	test.MustDo(t, err)
+	defer tx1.Rollback() //nolint:errcheck
+	tx2, err := s.DB.Begin()
+	test.MustDo(t, err)
+	defer tx2.Rollback() //nolint:errcheck
+	tx3, err := s.DB.Begin()
+	test.MustDo(t, err)
+	defer tx3.Rollback() //nolint:errcheck
+
+	var account1, account2, account3 models.Account
+	test.MustDo(t, tx1.SelectOne(&account1, accountAnnouncementSearchQuery, s.Clock.Now(), 1))
+	test.MustDo(t, tx2.SelectOne(&account2, accountAnnouncementSearchQuery, s.Clock.Now(), 1))
+	expectError(t, sql.ErrNoRows.Error(), tx3.SelectOne(&account3, accountAnnouncementSearchQuery, s.Clock.Now(), 1))
+
+	accountNames := []models.AccountName{account1.Name, account2.Name}
+	slices.Sort(accountNames)
+	assert.DeepEqual(t, "discovered accounts", accountNames, []models.AccountName{"test1", "test2"})
+
+	// once the lock is released, the account can be discovered again
+	test.MustDo(t, tx1.Rollback())
+	test.MustDo(t, tx3.SelectOne(&account3, accountAnnouncementSearchQuery, s.Clock.Now(), 1))
+	assert.DeepEqual(t, "discovered account", account3.Name, account1.Name)
+}
@@ -72,6 +72,7 @@ func (j *Janitor) BlobMountSweepJob(registerer prometheus.Registerer) jobloop.Jo
 		},
 		DiscoverTask: func(_ context.Context, _ prometheus.Labels) (repo models.Repository, err error) {
 			err = j.db.SelectOne(&repo, blobMountSweepSearchQuery, j.timeNow())
+			j.reportOldestPending("blob-mount-sweep", repo.NextBlobMountSweepAt, err)
 			return repo, err
 		},
 		ProcessTask: j.sweepBlobMountsInRepo,
@@ -5,12 +5,14 @@ package tasks
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
 	"time"
 
+	"github.com/go-gorp/gorp/v3"
+	. "github.com/majewsky/gg/option"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sapcc/go-bits/jobloop"
-	"github.com/sapcc/go-bits/logg"
 	"github.com/sapcc/go-bits/sqlext"
 
 	"github.com/sapcc/keppel/internal/keppel"
@@ -70,6 +72,7 @@ func (j *Janitor) BlobSweepJob(registerer prometheus.Registerer) jobloop.Job { /
 		},
 		DiscoverTask: func(_ context.Context, _ prometheus.Labels) (account models.Account, err error) {
 			err = j.db.SelectOne(&account, blobSweepSearchQuery, j.timeNow())
+			j.reportOldestPending("blob-sweep", account.NextBlobSweepedAt, err)
 			return account, err
 		},
 		ProcessTask: j.sweepBlobsInRepo,
@@ -77,6 +80,7 @@ func (j *Janitor) BlobSweepJob(registerer prometheus.Registerer) jobloop.Job { /
 }
 
 func (j *Janitor) sweepBlobsInRepo(ctx context.Context, account models.Account, _ prometheus.Labels) error {
+	ctx = keppel.WithLogFields(ctx, keppel.LogFields{Account: account.Name})
 	// allow next pass in 1 hour to delete the newly marked blob mounts, but use a
 	// slightly earlier cut-off time to account for the marking taking some time
 	canBeDeletedAt := j.timeNow().Add(30 * time.Minute)
@@ -115,7 +119,7 @@ func (j *Janitor) sweepBlobsInRepo(ctx context.Context, account models.Account,
 	// will not notice this inconsistency because the DB is our primary source of
 	// truth.
 	if len(blobs) > 0 {
-		logg.Info("sweeping %d blobs in account %s", len(blobs), account.Name)
+		keppel.LogInfo(ctx, "sweeping %d blobs in account %s", len(blobs), account.Name)
 	}
 	for _, blob := range blobs {
 		// without transaction: we need this committed right now
@@ -142,8 +146,8 @@ var validateBlobSearchQuery = sqlext.SimplifyWhitespace(`
 `)
 
 var validateBlobFinishQuery = sqlext.SimplifyWhitespace(`
-	UPDATE blobs SET next_validation_at = $1, validation_error_message = $2
-	WHERE account_name = $3 AND digest = $4
+	UPDATE blobs SET last_validated_at = $1, next_validation_at = $2, validation_error_message = $3
+	WHERE account_name = $4 AND digest = $5
 `)
 
 // BlobValidationJob is a job. Each task validates a blob that has not been validated for more
@@ -161,6 +165,7 @@ func (j *Janitor) BlobValidationJob(registerer prometheus.Registerer) jobloop.Jo
 		},
 		DiscoverTask: func(_ context.Context, _ prometheus.Labels) (blob models.Blob, err error) {
 			err = j.db.SelectOne(&blob, validateBlobSearchQuery, j.timeNow())
+			j.reportOldestPending("blob-validation", Some(blob.NextValidationAt), err)
 			return blob, err
 		},
 		ProcessTask: j.validateBlob,
@@ -169,7 +174,7 @@ func (j *Janitor) BlobValidationJob(registerer prometheus.Registerer) jobloop.Jo
 
 func (j *Janitor) validateBlob(ctx context.Context, blob models.Blob, _ prometheus.Labels) error {
 	// find corresponding account
-	account, err := keppel.FindAccount(j.db, blob.AccountName)
+	account, err := keppel.FindAccount(ctx, j.db, blob.AccountName)
 	if err != nil {
 		return fmt.Errorf("cannot find account for manifest %s/%s: %s", blob.AccountName, blob.Digest, err.Error())
 	}
@@ -178,7 +183,7 @@ func (j *Janitor) validateBlob(ctx context.Context, blob models.Blob, _ promethe
 	err = j.processor().ValidateExistingBlob(ctx, account.Reduced(), blob)
 	if err == nil {
 		// on success, reset error message and schedule next validation
-		_, err := j.db.Exec(validateBlobFinishQuery,
+		_, err := j.db.Exec(validateBlobFinishQuery, j.timeNow(),
 			j.timeNow().Add(j.addJitter(models.BlobValidationInterval)),
 			"", account.Name, blob.Digest,
 		)
@@ -187,7 +192,7 @@ func (j *Janitor) validateBlob(ctx context.Context, blob models.Blob, _ promethe
 		}
 	} else {
 		// on failure, log error message and schedule next validation sooner than usual
-		_, updateErr := j.db.Exec(validateBlobFinishQuery,
+		_, updateErr := j.db.Exec(validateBlobFinishQuery, j.timeNow(),
 			j.timeNow().Add(j.addJitter(models.BlobValidationAfterErrorInterval)),
 			err.Error(), account.Name, blob.Digest,
 		)
@@ -199,3 +204,89 @@ func (j *Janitor) validateBlob(ctx context.Context, blob models.Blob, _ promethe
 
 	return nil
 }
+
+var blobMediaTypeBackfillSearchQuery = sqlext.SimplifyWhitespace(`
+	SELECT * FROM blobs
+	 WHERE media_type = '' AND next_media_type_backfill_at < $1 AND id IN (SELECT blob_id FROM manifest_blob_refs)
+	 ORDER BY next_media_type_backfill_at ASC, id ASC
+	 -- only one blob at a time
+	 LIMIT 1
+	 -- prevent other janitor processes from backfilling the same blob concurrently
+	 FOR UPDATE SKIP LOCKED
+`)
+
+var blobMediaTypeBackfillManifestsQuery = sqlext.SimplifyWhitespace(`
+	SELECT m.media_type, mc.content
+	  FROM manifest_blob_refs r
+	  JOIN manifests m ON m.repo_id = r.repo_id AND m.digest = r.digest
+	  JOIN manifest_contents mc ON mc.repo_id = r.repo_id AND mc.digest = r.digest
+	 WHERE r.blob_id = $1
+	 ORDER BY r.repo_id, r.digest
+`)
+
+// BlobMediaTypeBackfillJob is a job. Each task finds a blob whose media type
+// is not known, even though it is referenced by at least one manifest, and
+// fills in the media type declared for it in one of those manifests.
+//
+// Since manifest pushes always record the media types of referenced blobs
+// nowadays, this job only has work to do for blobs that were pushed before
+// that was the case (which are marked by `next_media_type_backfill_at` during
+// the respective DB migration). If none of the referencing manifests declares
+// a media type, nothing is recorded, so that the blob keeps being reported
+// with the configured fallback media type.
+func (j *Janitor) BlobMediaTypeBackfillJob(registerer prometheus.Registerer) jobloop.Job {
+	return (&jobloop.TxGuardedJob[*gorp.Transaction, models.Blob]{
+		Metadata: jobloop.JobMetadata{
+			ReadableName: "backfill blob media type",
+			CounterOpts: prometheus.CounterOpts{
+				Name: "keppel_blob_media_type_backfills",
+				Help: "Counter for blobs whose missing media type was backfilled from referencing manifests.",
+			},
+		},
+		BeginTx: j.db.Begin,
+		DiscoverRow: func(_ context.Context, tx *gorp.Transaction, _ prometheus.Labels) (blob models.Blob, err error) {
+			err = tx.SelectOne(&blob, blobMediaTypeBackfillSearchQuery, j.timeNow())
+			return blob, err
+		},
+		ProcessRow: j.backfillBlobMediaType,
+	}).Setup(registerer)
+}
+
+func (j *Janitor) backfillBlobMediaType(ctx context.Context, tx *gorp.Transaction, blob models.Blob, _ prometheus.Labels) error {
+	var mediaType string
+	err := sqlext.ForeachRow(tx, blobMediaTypeBackfillManifestsQuery, []any{blob.ID}, func(rows *sql.Rows) error {
+		var (
+			manifestMediaType string
+			manifestContent   []byte
+		)
+		err := rows.Scan(&manifestMediaType, &manifestContent)
+		if err != nil || mediaType != "" {
+			return err
+		}
+		manifest, err := j.cfg.ParseManifest(manifestMediaType, manifestContent)
+		if err != nil {
+			// not fatal, one of the other manifests might still be able to tell us the media type
+			keppel.LogError(keppel.WithLogFields(ctx, keppel.LogFields{Account: blob.AccountName}), "cannot parse manifest while backfilling media type of blob %s in account %s: %s",
+				blob.Digest, blob.AccountName, err.Error())
+			return nil
+		}
+		for _, layerInfo := range manifest.BlobReferences() {
+			if layerInfo.Digest == blob.Digest && layerInfo.MediaType != "" {
+				mediaType = layerInfo.MediaType
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// only persist media types that are actually declared by a manifest, so
+	// that changes to the configured fallback affect this blob as well
+	_, err = tx.Exec(`UPDATE blobs SET media_type = $1, next_media_type_backfill_at = NULL WHERE id = $2`, mediaType, blob.ID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
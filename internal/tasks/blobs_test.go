@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/opencontainers/go-digest"
+	"github.com/sapcc/go-bits/assert"
 	"github.com/sapcc/go-bits/easypg"
 
 	"github.com/sapcc/keppel/internal/models"
@@ -124,3 +125,61 @@ func TestValidateBlobs(t *testing.T) {
 	expectError(t, sql.ErrNoRows.Error(), validateBlobJob.ProcessOne(s.Ctx))
 	easypg.AssertDBContent(t, s.DB.Db, "fixtures/blob-validate-003.sql")
 }
+
+func TestValidateBlobsWithSHA512(t *testing.T) {
+	j, s := setup(t, test.WithDigestAlgorithms(digest.SHA256, digest.SHA512))
+	s.Clock.StepBy(1 * time.Hour)
+	validateBlobJob := j.BlobValidationJob(s.Registry)
+
+	blob := test.GenerateExampleLayer(1)
+	blob.Digest = digest.SHA512.FromBytes(blob.Contents)
+	dbBlob := blob.MustUpload(t, s, fooRepoRef)
+
+	// BlobValidationJob should be happy about this blob
+	s.Clock.StepBy(8 * 24 * time.Hour)
+	expectSuccess(t, validateBlobJob.ProcessOne(s.Ctx))
+	expectError(t, sql.ErrNoRows.Error(), validateBlobJob.ProcessOne(s.Ctx))
+
+	// if the digest is broken, the mismatch is reported using the same algorithm
+	wrongDigest := digest.SHA512.FromBytes([]byte("not the right content"))
+	test.MustExec(t, s.DB, `UPDATE blobs SET digest = $1 WHERE id = $2`, wrongDigest.String(), dbBlob.ID)
+	s.Clock.StepBy(8 * 24 * time.Hour)
+	expectError(t, fmt.Sprintf("expected digest %s, but got %s", wrongDigest, dbBlob.Digest), validateBlobJob.ProcessOne(s.Ctx))
+}
+
+func TestBackfillBlobMediaTypes(t *testing.T) {
+	j, s := setup(t)
+	backfillJob := j.BlobMediaTypeBackfillJob(s.Registry)
+
+	// upload an image, and also a blob that is not referenced by any manifest
+	image := test.GenerateImage(test.GenerateExampleLayer(1))
+	image.MustUpload(t, s, fooRepoRef, "latest")
+	strayBlob := test.GenerateExampleLayer(2).MustUpload(t, s, fooRepoRef)
+
+	// no blobs are missing their media type yet
+	expectError(t, sql.ErrNoRows.Error(), backfillJob.ProcessOne(s.Ctx))
+
+	// simulate blobs that were pushed before we started recording media types
+	// (the respective DB migration schedules these blobs for backfilling)
+	test.MustExec(t, s.DB, `UPDATE blobs SET media_type = '', next_media_type_backfill_at = $1`, s.Clock.Now())
+	s.Clock.StepBy(1 * time.Minute)
+
+	// the layer and config blobs get their media types from the manifest;
+	// the unreferenced blob is ignored since there is no manifest to learn from
+	expectSuccess(t, backfillJob.ProcessOne(s.Ctx))
+	expectSuccess(t, backfillJob.ProcessOne(s.Ctx))
+	expectError(t, sql.ErrNoRows.Error(), backfillJob.ProcessOne(s.Ctx))
+
+	for _, blob := range []test.Bytes{image.Layers[0], image.Config} {
+		mediaType, err := s.DB.SelectStr(`SELECT media_type FROM blobs WHERE digest = $1`, blob.Digest.String())
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		assert.DeepEqual(t, "media type of blob "+blob.Digest.String(), mediaType, blob.MediaType)
+	}
+	mediaType, err := s.DB.SelectStr(`SELECT media_type FROM blobs WHERE id = $1`, strayBlob.ID)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "media type of unreferenced blob", mediaType, "")
+}
@@ -8,6 +8,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"slices"
 	"sort"
 	"time"
 
@@ -55,6 +56,7 @@ func (j *Janitor) ManifestGarbageCollectionJob(registerer prometheus.Registerer)
 		},
 		DiscoverTask: func(_ context.Context, _ prometheus.Labels) (repo models.Repository, err error) {
 			err = j.db.SelectOne(&repo, imageGCRepoSelectQuery, j.timeNow())
+			j.reportOldestPending("gc", repo.NextGarbageCollectionAt, err)
 			return repo, err
 		},
 		ProcessTask: j.garbageCollectManifestsInRepo,
@@ -63,7 +65,7 @@ func (j *Janitor) ManifestGarbageCollectionJob(registerer prometheus.Registerer)
 
 func (j *Janitor) garbageCollectManifestsInRepo(ctx context.Context, repo models.Repository, labels prometheus.Labels) (returnErr error) {
 	// load GC policies for this repository
-	account, err := keppel.FindAccount(j.db, repo.AccountName)
+	account, err := keppel.FindAccount(ctx, j.db, repo.AccountName)
 	if err != nil {
 		return fmt.Errorf("cannot find account for repo %s: %w", repo.FullName(), err)
 	}
@@ -117,7 +119,7 @@ type manifestData struct {
 func (j *Janitor) executeGCPolicies(ctx context.Context, account models.ReducedAccount, repo models.Repository, gcPolicies []keppel.GCPolicy, tagPolicies []keppel.TagPolicy) error {
 	// load manifests in repo
 	var dbManifests []models.Manifest
-	_, err := j.db.Select(&dbManifests, `SELECT * FROM manifests WHERE repo_id = $1`, repo.ID)
+	_, err := j.db.Select(&dbManifests, `SELECT * FROM manifests WHERE repo_id = $1 AND deleted_at IS NULL`, repo.ID)
 	if err != nil {
 		return err
 	}
@@ -157,6 +159,29 @@ func (j *Janitor) executeGCPolicies(ctx context.Context, account models.ReducedA
 		return err
 	}
 
+	// check pinned tags to fill GCStatus.ProtectedByPinnedTag
+	query = `SELECT t.digest, t.name FROM tags t JOIN tag_pins p ON p.repo_id = t.repo_id AND p.name = t.name WHERE t.repo_id = $1 ORDER BY t.name`
+	err = sqlext.ForeachRow(j.db, query, []any{repo.ID}, func(rows *sql.Rows) error {
+		var (
+			digest  digest.Digest
+			tagName string
+		)
+		err := rows.Scan(&digest, &tagName)
+		if err != nil {
+			return err
+		}
+		for _, m := range manifests {
+			if m.Manifest.Digest == digest && m.GCStatus.ProtectedByPinnedTag == "" {
+				m.GCStatus.ProtectedByPinnedTag = tagName
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
 	// check manifest-manifest relations to fill GCStatus.ProtectedByManifest
 	query = `SELECT parent_digest, child_digest FROM manifest_manifest_refs WHERE repo_id = $1`
 	err = sqlext.ForeachRow(j.db, query, []any{repo.ID}, func(rows *sql.Rows) error {
@@ -223,6 +248,17 @@ func (j *Janitor) evaluatePolicy(ctx context.Context, proc *processor.Processor,
 		}
 	}
 
+	// for "retain" policies, we need to know which tags are retained
+	var retainedTags map[string]bool
+	if gcPolicy.Action == "retain" {
+		var allTags []models.Tag
+		_, err := j.db.Select(&allTags, `SELECT * FROM tags WHERE repo_id = $1`, repo.ID)
+		if err != nil {
+			return err
+		}
+		retainedTags = gcPolicy.SelectRetainedTags(allTags)
+	}
+
 	// evaluate policy for each manifest
 	for _, m := range manifests {
 		// skip those manifests that are already deleted, and those which are
@@ -231,9 +267,9 @@ func (j *Janitor) evaluatePolicy(ctx context.Context, proc *processor.Processor,
 			continue
 		}
 
-		// track matching "delete" policies in GCStatus to allow users insight
-		// into how policies match
-		if gcPolicy.Action == "delete" {
+		// track matching "delete" and "retain" policies in GCStatus to allow users
+		// insight into how policies match
+		if gcPolicy.Action == "delete" || gcPolicy.Action == "retain" {
 			m.GCStatus.RelevantGCPolicies = append(m.GCStatus.RelevantGCPolicies, gcPolicy)
 		}
 
@@ -245,11 +281,26 @@ func (j *Janitor) evaluatePolicy(ctx context.Context, proc *processor.Processor,
 			continue
 		}
 
+		// for "retain" policies, manifests without matching tags are not
+		// considered, and manifests are protected if they have at least one tag
+		// that is either retained or not covered by this policy
+		if gcPolicy.Action == "retain" {
+			matchingTagNames := gcPolicy.MatchingTagNames(m.TagNames)
+			if len(matchingTagNames) == 0 {
+				continue
+			}
+			isRetained := func(tagName string) bool { return retainedTags[tagName] }
+			if len(matchingTagNames) < len(m.TagNames) || slices.ContainsFunc(matchingTagNames, isRetained) {
+				m.GCStatus.ProtectedByGCPolicy = Some(gcPolicy)
+				continue
+			}
+		}
+
 		// execute policy action
 		switch gcPolicy.Action {
 		case "protect":
 			m.GCStatus.ProtectedByGCPolicy = Some(gcPolicy)
-		case "delete":
+		case "delete", "retain":
 			err := proc.DeleteManifest(ctx, account, repo, m.Manifest.Digest, tagPolicies, keppel.AuditContext{
 				UserIdentity: janitorUserIdentity{
 					TaskName: "policy-driven-gc",
@@ -319,6 +319,81 @@ func TestGCProtectOldestAndNewest(t *testing.T) {
 	}
 }
 
+// TestGCRetainNewestTags checks policies with action "retain".
+func TestGCRetainNewestTags(t *testing.T) {
+	j, s := setup(t)
+
+	// upload some release images with strictly increasing pushed_at timestamps
+	images := make([]test.Image, 6)
+	for idx := range images {
+		images[idx] = test.GenerateImage(test.GenerateExampleLayer(int64(idx)))
+		images[idx].MustUpload(t, s, fooRepoRef, fmt.Sprintf("v%d", idx+1))
+		s.Clock.StepBy(1 * time.Minute)
+	}
+	// images[0] is also referenced by an image list, and images[1] also has a tag not matching the policy
+	test.GenerateImageList(images[0]).MustUpload(t, s, fooRepoRef, "")
+	images[1].MustUpload(t, s, fooRepoRef, "stable")
+
+	// skip an hour to avoid protected_by_recent_upload
+	s.Clock.StepBy(1 * time.Hour)
+
+	countManifestsWithTag := func(tagName string) int64 {
+		t.Helper()
+		count, err := s.DB.SelectInt(`SELECT COUNT(*) FROM manifests m JOIN tags t ON t.repo_id = m.repo_id AND t.digest = m.digest WHERE t.name = $1`, tagName)
+		test.MustDo(t, err)
+		return count
+	}
+	garbageJob := j.ManifestGarbageCollectionJob(s.Registry)
+
+	// with exactly as many matching tags as the policy retains, nothing happens
+	test.MustExec(t, s.DB,
+		`UPDATE accounts SET gc_policies_json = $1`,
+		`[{"match_repository":".*","match_tag":"v[0-9]+","action":"retain","retain_count":6}]`,
+	)
+	expectSuccess(t, garbageJob.ProcessOne(s.Ctx))
+	expectError(t, sql.ErrNoRows.Error(), garbageJob.ProcessOne(s.Ctx))
+	for idx := range images {
+		if countManifestsWithTag(fmt.Sprintf("v%d", idx+1)) != 1 {
+			t.Errorf("expected tag v%d to still exist, but it is gone", idx+1)
+		}
+	}
+
+	// with more matching tags than the policy retains, the oldest ones get
+	// collected unless their manifests are protected otherwise
+	test.MustExec(t, s.DB,
+		`UPDATE accounts SET gc_policies_json = $1`,
+		`[{"match_repository":".*","match_tag":"v[0-9]+","action":"retain","retain_count":2}]`,
+	)
+	test.MustExec(t, s.DB, `UPDATE repos SET next_gc_at = NULL`)
+	expectSuccess(t, garbageJob.ProcessOne(s.Ctx))
+	expectError(t, sql.ErrNoRows.Error(), garbageJob.ProcessOne(s.Ctx))
+	expectedTagCounts := map[string]int64{
+		"v1":     1, // protected by parent manifest
+		"v2":     1, // protected by non-matching tag
+		"stable": 1,
+		"v3":     0, // collected
+		"v4":     0, // collected
+		"v5":     1, // retained
+		"v6":     1, // retained
+	}
+	for tagName, expected := range expectedTagCounts {
+		actual := countManifestsWithTag(tagName)
+		if actual != expected {
+			t.Errorf("expected %d manifests with tag %s, but got %d", expected, tagName, actual)
+		}
+	}
+
+	// running the policy again does not collect anything else
+	test.MustExec(t, s.DB, `UPDATE repos SET next_gc_at = NULL`)
+	tr, _ := easypg.NewTracker(t, s.DB.Db)
+	expectSuccess(t, garbageJob.ProcessOne(s.Ctx))
+	tr.DBChanges().AssertEqualf(`
+			UPDATE repos SET next_gc_at = %d WHERE id = 1 AND account_name = 'test1' AND name = 'foo';
+		`,
+		s.Clock.Now().Add(1*time.Hour).Unix(),
+	)
+}
+
 // TestGCProtectComesTooLate checks that a "protect" policy is ineffective if an
 // image has already been removed by an earlier "delete" policy.
 func TestGCProtectComesTooLate(t *testing.T) {
@@ -434,3 +509,57 @@ func TestTagPolicyProtectsFromGCManifest(t *testing.T) {
 		deletingTagPolicyJSON, image.Manifest.Digest, s.Clock.Now().Add(1*time.Hour).Unix(),
 	)
 }
+
+func TestPinnedTagProtectsFromGC(t *testing.T) {
+	j, s := setup(t)
+
+	images := []test.Image{
+		test.GenerateImage(test.GenerateExampleLayer(0)),
+		test.GenerateImage(test.GenerateExampleLayer(1)),
+	}
+	images[0].MustUpload(t, s, fooRepoRef, "debug")
+	images[1].MustUpload(t, s, fooRepoRef, "other")
+	test.MustExec(t, s.DB, `INSERT INTO tag_pins (repo_id, name, pinned_at) VALUES (1, 'debug', $1)`, s.Clock.Now())
+
+	deletingGCPolicyJSON := `[{"match_repository":".*","time_constraint":{"on":"pushed_at","older_than":{"value":30,"unit":"m"}},"action":"delete"}]`
+	test.MustExec(t, s.DB, `UPDATE accounts SET gc_policies_json = $1`, deletingGCPolicyJSON)
+
+	tr, _ := easypg.NewTracker(t, s.DB.Db)
+	garbageJob := j.ManifestGarbageCollectionJob(s.Registry)
+
+	// skip an hour to avoid protected_by_recent_upload
+	s.Clock.StepBy(1 * time.Hour)
+
+	// the policy matches both images, but only the unpinned one gets deleted
+	expectSuccess(t, garbageJob.ProcessOne(s.Ctx))
+	expectError(t, sql.ErrNoRows.Error(), garbageJob.ProcessOne(s.Ctx))
+	tr.DBChanges().AssertEqualf(`
+			DELETE FROM manifest_blob_refs WHERE repo_id = 1 AND digest = '%[2]s' AND blob_id = 3;
+			DELETE FROM manifest_blob_refs WHERE repo_id = 1 AND digest = '%[2]s' AND blob_id = 4;
+			DELETE FROM manifest_contents WHERE repo_id = 1 AND digest = '%[2]s';
+			UPDATE manifests SET gc_status_json = '{"protected_by_pinned_tag":"debug"}' WHERE repo_id = 1 AND digest = '%[1]s';
+			DELETE FROM manifests WHERE repo_id = 1 AND digest = '%[2]s';
+			UPDATE repos SET next_gc_at = %[3]d WHERE id = 1 AND account_name = 'test1' AND name = 'foo';
+			DELETE FROM tags WHERE repo_id = 1 AND name = 'other';
+			DELETE FROM trivy_security_info WHERE repo_id = 1 AND digest = '%[2]s';
+		`,
+		images[0].Manifest.Digest, images[1].Manifest.Digest, s.Clock.Now().Add(1*time.Hour).Unix(),
+	)
+
+	// after unpinning, the next GC run deletes the image as well
+	test.MustExec(t, s.DB, `DELETE FROM tag_pins`)
+	tr.DBChanges().Ignore()
+	s.Clock.StepBy(2 * time.Hour)
+	expectSuccess(t, garbageJob.ProcessOne(s.Ctx))
+	tr.DBChanges().AssertEqualf(`
+			DELETE FROM manifest_blob_refs WHERE repo_id = 1 AND digest = '%[1]s' AND blob_id = 1;
+			DELETE FROM manifest_blob_refs WHERE repo_id = 1 AND digest = '%[1]s' AND blob_id = 2;
+			DELETE FROM manifest_contents WHERE repo_id = 1 AND digest = '%[1]s';
+			DELETE FROM manifests WHERE repo_id = 1 AND digest = '%[1]s';
+			UPDATE repos SET next_gc_at = %[2]d WHERE id = 1 AND account_name = 'test1' AND name = 'foo';
+			DELETE FROM tags WHERE repo_id = 1 AND name = 'debug';
+			DELETE FROM trivy_security_info WHERE repo_id = 1 AND digest = '%[1]s';
+		`,
+		images[0].Manifest.Digest, s.Clock.Now().Add(1*time.Hour).Unix(),
+	)
+}
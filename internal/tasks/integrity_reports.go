@@ -0,0 +1,139 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package tasks
+
+import (
+	"context"
+
+	"github.com/go-gorp/gorp/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sapcc/go-bits/jobloop"
+	"github.com/sapcc/go-bits/sqlext"
+
+	"github.com/sapcc/keppel/internal/models"
+)
+
+var integrityReportGauge = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "keppel_integrity_report_validations",
+		Help: "Number of blob and manifest validations in an account during the last 7 days, as of the most recent integrity report.",
+	},
+	[]string{"account", "auth_tenant_id", "object_type", "outcome"},
+)
+
+func init() {
+	prometheus.MustRegister(integrityReportGauge)
+}
+
+var integrityReportSearchQuery = sqlext.SimplifyWhitespace(`
+	SELECT * FROM accounts
+		WHERE next_integrity_report_at IS NULL OR next_integrity_report_at < $1
+	-- accounts without any reports first, then sorted by last report
+	ORDER BY next_integrity_report_at IS NULL DESC, next_integrity_report_at ASC
+	-- only one account at a time
+	LIMIT 1
+	-- prevent other janitor processes from reporting on the same account concurrently
+	FOR UPDATE SKIP LOCKED
+`)
+
+var integrityReportCountBlobsQuery = sqlext.SimplifyWhitespace(`
+	SELECT COUNT(*), COUNT(*) FILTER (WHERE validation_error_message != '')
+	  FROM blobs
+	 WHERE account_name = $1 AND last_validated_at > $2
+`)
+
+var integrityReportCountManifestsQuery = sqlext.SimplifyWhitespace(`
+	SELECT COUNT(*), COUNT(*) FILTER (WHERE m.validation_error_message != '')
+	  FROM manifests m
+	  JOIN repos r ON m.repo_id = r.id
+	 WHERE r.account_name = $1 AND m.last_validated_at > $2
+`)
+
+var integrityReportUpsertQuery = sqlext.SimplifyWhitespace(`
+	INSERT INTO integrity_reports (account_name, created_at, validated_blobs, failed_blobs, validated_manifests, failed_manifests)
+	VALUES ($1, $2, $3, $4, $5, $6)
+	ON CONFLICT (account_name) DO UPDATE
+		SET created_at = EXCLUDED.created_at,
+		validated_blobs = EXCLUDED.validated_blobs, failed_blobs = EXCLUDED.failed_blobs,
+		validated_manifests = EXCLUDED.validated_manifests, failed_manifests = EXCLUDED.failed_manifests
+`)
+
+var integrityReportDoneQuery = sqlext.SimplifyWhitespace(`
+	UPDATE accounts SET next_integrity_report_at = $2 WHERE name = $1
+`)
+
+// IntegrityReportJob is a job. Each task finds an account whose integrity
+// report has not been renewed in more than 24 hours, and summarizes the
+// outcomes of all blob and manifest validations in that account during the
+// last 7 days.
+//
+// Validations are counted by the most recent outcome of each object, so a
+// blob that failed validation and was fixed afterwards is counted as passing.
+func (j *Janitor) IntegrityReportJob(registerer prometheus.Registerer) jobloop.Job { //nolint: dupl // interface implementation of different things
+	return (&jobloop.TxGuardedJob[*gorp.Transaction, models.Account]{
+		Metadata: jobloop.JobMetadata{
+			ReadableName: "account integrity report",
+			CounterOpts: prometheus.CounterOpts{
+				Name: "keppel_integrity_reports",
+				Help: "Counter for integrity reports on accounts.",
+			},
+		},
+		BeginTx: j.db.Begin,
+		DiscoverRow: func(_ context.Context, tx *gorp.Transaction, _ prometheus.Labels) (account models.Account, err error) {
+			err = tx.SelectOne(&account, integrityReportSearchQuery, j.timeNow())
+			j.reportOldestPending("integrity-report", account.NextIntegrityReportAt, err)
+			return account, err
+		},
+		ProcessRow: j.createIntegrityReport,
+	}).Setup(registerer)
+}
+
+func (j *Janitor) createIntegrityReport(_ context.Context, tx *gorp.Transaction, account models.Account, _ prometheus.Labels) error {
+	report := models.IntegrityReport{
+		AccountName: account.Name,
+		CreatedAt:   j.timeNow(),
+	}
+	windowStart := report.CreatedAt.Add(-models.IntegrityReportWindow)
+
+	err := tx.QueryRow(integrityReportCountBlobsQuery, account.Name, windowStart).
+		Scan(&report.ValidatedBlobCount, &report.FailedBlobCount)
+	if err != nil {
+		return err
+	}
+	err = tx.QueryRow(integrityReportCountManifestsQuery, account.Name, windowStart).
+		Scan(&report.ValidatedManifestCount, &report.FailedManifestCount)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(integrityReportUpsertQuery, report.AccountName, report.CreatedAt,
+		report.ValidatedBlobCount, report.FailedBlobCount,
+		report.ValidatedManifestCount, report.FailedManifestCount,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(integrityReportDoneQuery, account.Name, j.timeNow().Add(j.addJitter(models.IntegrityReportInterval)))
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	setGauge := func(objectType, outcome string, value uint64) {
+		integrityReportGauge.With(prometheus.Labels{
+			"account":        string(account.Name),
+			"auth_tenant_id": account.AuthTenantID,
+			"object_type":    objectType,
+			"outcome":        outcome,
+		}).Set(float64(value))
+	}
+	setGauge("blob", "success", report.ValidatedBlobCount-report.FailedBlobCount)
+	setGauge("blob", "failure", report.FailedBlobCount)
+	setGauge("manifest", "success", report.ValidatedManifestCount-report.FailedManifestCount)
+	setGauge("manifest", "failure", report.FailedManifestCount)
+	return nil
+}
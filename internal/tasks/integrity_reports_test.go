@@ -0,0 +1,98 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package tasks
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/sapcc/go-bits/assert"
+
+	"github.com/sapcc/keppel/internal/models"
+	"github.com/sapcc/keppel/internal/test"
+)
+
+func TestIntegrityReportJob(t *testing.T) {
+	j, s := setup(t)
+	s.Clock.StepBy(1 * time.Hour)
+	validateBlobJob := j.BlobValidationJob(s.Registry)
+	validateManifestJob := j.ManifestValidationJob(s.Registry)
+	integrityReportJob := j.IntegrityReportJob(s.Registry)
+
+	expectReport := func(validatedBlobs, failedBlobs, validatedManifests, failedManifests uint64) {
+		t.Helper()
+		var report models.IntegrityReport
+		test.MustDo(t, s.DB.SelectOne(&report, `SELECT * FROM integrity_reports WHERE account_name = $1`, "test1"))
+		assert.DeepEqual(t, "created_at", report.CreatedAt.Unix(), s.Clock.Now().Unix())
+		assert.DeepEqual(t, "validated_blobs", report.ValidatedBlobCount, validatedBlobs)
+		assert.DeepEqual(t, "failed_blobs", report.FailedBlobCount, failedBlobs)
+		assert.DeepEqual(t, "validated_manifests", report.ValidatedManifestCount, validatedManifests)
+		assert.DeepEqual(t, "failed_manifests", report.FailedManifestCount, failedManifests)
+
+		getGauge := func(objectType, outcome string) uint64 {
+			t.Helper()
+			var m dto.Metric
+			labels := prometheus.Labels{"account": "test1", "auth_tenant_id": "test1authtenant", "object_type": objectType, "outcome": outcome}
+			test.MustDo(t, integrityReportGauge.With(labels).Write(&m))
+			return uint64(m.GetGauge().GetValue())
+		}
+		assert.DeepEqual(t, "blob successes", getGauge("blob", "success"), validatedBlobs-failedBlobs)
+		assert.DeepEqual(t, "blob failures", getGauge("blob", "failure"), failedBlobs)
+		assert.DeepEqual(t, "manifest successes", getGauge("manifest", "success"), validatedManifests-failedManifests)
+		assert.DeepEqual(t, "manifest failures", getGauge("manifest", "failure"), failedManifests)
+	}
+
+	// upload an image with two layers (i.e. three blobs and one manifest)
+	image := test.GenerateImage(test.GenerateExampleLayer(1), test.GenerateExampleLayer(2))
+	image.MustUpload(t, s, fooRepoRef, "latest")
+
+	// before anything was validated, the report is empty
+	expectSuccess(t, integrityReportJob.ProcessOne(s.Ctx))
+	expectReport(0, 0, 0, 0)
+	expectError(t, sql.ErrNoRows.Error(), integrityReportJob.ProcessOne(s.Ctx))
+
+	// deliberately destroy one of the layer digests, which breaks the validation
+	// of that blob as well as of the manifest referencing it
+	wrongDigest := digest.Canonical.FromBytes([]byte("not the right content"))
+	test.MustExec(t, s.DB, `UPDATE blobs SET digest = $1 WHERE digest = $2`,
+		wrongDigest.String(), image.Layers[0].Digest.String(),
+	)
+	s.Clock.StepBy(8 * 24 * time.Hour)
+	failedBlobValidations := 0
+	for range 3 {
+		if validateBlobJob.ProcessOne(s.Ctx) != nil {
+			failedBlobValidations++
+		}
+	}
+	assert.DeepEqual(t, "failed blob validations", failedBlobValidations, 1)
+	expectError(t, sql.ErrNoRows.Error(), validateBlobJob.ProcessOne(s.Ctx))
+	if validateManifestJob.ProcessOne(s.Ctx) == nil {
+		t.Error("expected manifest validation to fail, but it succeeded")
+	}
+
+	// the next report shows a mix of passing and failing validations
+	expectSuccess(t, integrityReportJob.ProcessOne(s.Ctx))
+	expectReport(3, 1, 1, 1)
+
+	// fix the issue; after the next round of validations, the next report is clean again
+	test.MustExec(t, s.DB, `UPDATE blobs SET digest = $1 WHERE digest = $2`,
+		image.Layers[0].Digest.String(), wrongDigest.String(),
+	)
+	s.Clock.StepBy(8 * 24 * time.Hour)
+	for range 3 {
+		expectSuccess(t, validateBlobJob.ProcessOne(s.Ctx))
+	}
+	expectSuccess(t, validateManifestJob.ProcessOne(s.Ctx))
+	expectSuccess(t, integrityReportJob.ProcessOne(s.Ctx))
+	expectReport(3, 0, 1, 0)
+
+	// validations that are older than the report window are not counted
+	s.Clock.StepBy(8 * 24 * time.Hour)
+	expectSuccess(t, integrityReportJob.ProcessOne(s.Ctx))
+	expectReport(0, 0, 0, 0)
+}
@@ -0,0 +1,35 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package tasks
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sapcc/go-bits/jobloop"
+)
+
+var issuedTokenSweepQuery = `DELETE FROM issued_tokens WHERE expires_at < $1`
+
+// IssuedTokenSweepJob is a job. Each task removes records of tracked tokens
+// that have expired, since expired tokens cannot be used and therefore do not
+// need to be listed or revoked anymore.
+func (j *Janitor) IssuedTokenSweepJob(registerer prometheus.Registerer) jobloop.Job {
+	return (&jobloop.CronJob{
+		Metadata: jobloop.JobMetadata{
+			ReadableName: "issued token sweep",
+			CounterOpts: prometheus.CounterOpts{
+				Name: "keppel_issued_token_sweeps",
+				Help: "Counter for sweeps of expired tokens in the issued_tokens table.",
+			},
+		},
+		Interval:     1 * time.Hour,
+		InitialDelay: 1 * time.Minute,
+		Task: func(ctx context.Context, _ prometheus.Labels) error {
+			_, err := j.db.Exec(issuedTokenSweepQuery, j.timeNow())
+			return err
+		},
+	}).Setup(registerer)
+}
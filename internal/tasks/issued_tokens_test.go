@@ -0,0 +1,45 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package tasks
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/majewsky/gg/option"
+	"github.com/sapcc/go-bits/easypg"
+
+	"github.com/sapcc/keppel/internal/models"
+	"github.com/sapcc/keppel/internal/test"
+)
+
+func TestIssuedTokenSweep(t *testing.T) {
+	j, s := setup(t, test.WithTokenTracking)
+	job := j.IssuedTokenSweepJob(s.Registry)
+
+	s.Clock.StepBy(1 * time.Hour)
+	for idx, expiresIn := range []time.Duration{-1 * time.Minute, 1 * time.Minute} {
+		test.MustDo(t, s.DB.Insert(&models.IssuedToken{
+			ID:           []string{"expired", "valid"}[idx],
+			AuthTenantID: "test1authtenant",
+			UserName:     "correctusername",
+			Scopes:       "repository:test1/foo:pull",
+			IssuedAt:     s.Clock.Now().Add(-1 * time.Hour),
+			ExpiresAt:    s.Clock.Now().Add(expiresIn),
+			RevokedAt:    None[time.Time](),
+		}))
+	}
+
+	// only the expired token is removed
+	tr, _ := easypg.NewTracker(t, s.DB.Db)
+	expectSuccess(t, job.ProcessOne(s.Ctx))
+	tr.DBChanges().AssertEqualf(`DELETE FROM issued_tokens WHERE id = 'expired' AND auth_tenant_id = 'test1authtenant';`)
+
+	// nothing else happens until the valid token expires
+	expectSuccess(t, job.ProcessOne(s.Ctx))
+	tr.DBChanges().AssertEmpty()
+	s.Clock.StepBy(2 * time.Minute)
+	expectSuccess(t, job.ProcessOne(s.Ctx))
+	tr.DBChanges().AssertEqualf(`DELETE FROM issued_tokens WHERE id = 'valid' AND auth_tenant_id = 'test1authtenant';`)
+}
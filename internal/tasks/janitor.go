@@ -6,6 +6,8 @@ package tasks
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"math"
 	"math/rand"
 	"net/http"
 	"net/url"
@@ -50,7 +52,8 @@ type Janitor struct {
 
 // NewJanitor creates a new Janitor.
 func NewJanitor(cfg keppel.Configuration, fd keppel.FederationDriver, sd keppel.StorageDriver, icd keppel.InboundCacheDriver, db *keppel.DB, amd keppel.AccountManagementDriver, auditor audittools.Auditor) *Janitor {
-	j := &Janitor{cfg, fd, sd, icd, db, amd, auditor, time.Now, keppel.GenerateStorageID, addJitter}
+	j := &Janitor{cfg, fd, sd, icd, db, amd, auditor, time.Now, keppel.GenerateStorageID, nil}
+	j.useJitterFraction(DefaultJitterFraction)
 	return j
 }
 
@@ -71,14 +74,35 @@ func (j *Janitor) DisableJitter() {
 	j.addJitter = func(d time.Duration) time.Duration { return d }
 }
 
-// addJitter returns a random duration within +/- 10% of the requested value.
-// This can be used to even out the load on a scheduled job over time, by
-// spreading jobs that would normally be scheduled right next to each other out
-// over time without corrupting the individual schedules too much.
-func addJitter(duration time.Duration) time.Duration {
+// DefaultJitterFraction is the jitter fraction used by a Janitor unless
+// SetJitterFraction() is called.
+const DefaultJitterFraction = keppel.DefaultJanitorJitterFraction
+
+// SetJitterFraction configures how far the Janitor may deviate from the
+// regular interval when scheduling the next run of a recurring task. For
+// example, with a fraction of 0.1, a task that runs once per hour will be
+// rescheduled between 54 and 66 minutes later. The fraction must be between 0
+// and 1 (inclusive).
+func (j *Janitor) SetJitterFraction(fraction float64) error {
+	if math.IsNaN(fraction) || fraction < 0 || fraction > 1 {
+		return fmt.Errorf("jitter fraction must be between 0 and 1, but got %g", fraction)
+	}
+	j.useJitterFraction(fraction)
+	return nil
+}
+
+func (j *Janitor) useJitterFraction(fraction float64) {
+	j.addJitter = func(d time.Duration) time.Duration { return addJitter(d, fraction) }
+}
+
+// addJitter returns a random duration within +/- (100*fraction)% of the
+// requested value. This can be used to even out the load on a scheduled job
+// over time, by spreading jobs that would normally be scheduled right next to
+// each other out over time without corrupting the individual schedules too much.
+func addJitter(duration time.Duration, fraction float64) time.Duration {
 	//nolint:gosec // This is not crypto-relevant, so math/rand is okay.
 	r := rand.Float64() //NOTE: 0 <= r < 1
-	return time.Duration(float64(duration) * (0.9 + 0.2*r))
+	return time.Duration(float64(duration) * (1 - fraction + 2*fraction*r))
 }
 
 func (j *Janitor) processor() *processor.Processor {
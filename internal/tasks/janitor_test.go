@@ -18,7 +18,7 @@ func TestAddJitter(t *testing.T) {
 
 	// take 1000 samples of addJitter()
 	for range 1000 {
-		d := addJitter(baseDuration)
+		d := addJitter(baseDuration, DefaultJitterFraction)
 		// no sample should be outside the +/-10% range of the base duration
 		if d < lowerBound {
 			t.Errorf("expected jittered duration to be above %s, but got %s", lowerBound, d)
@@ -45,3 +45,35 @@ func TestAddJitter(t *testing.T) {
 			baseDuration, 100*float64(biggerCount)/1000.)
 	}
 }
+
+func TestJitterFraction(t *testing.T) {
+	baseDuration := 60 * time.Minute
+	j := &Janitor{}
+
+	// with a fraction of 0, there is no jitter at all
+	expectSuccess(t, j.SetJitterFraction(0))
+	for range 100 {
+		d := j.addJitter(baseDuration)
+		if d != baseDuration {
+			t.Errorf("expected jittered duration to be exactly %s, but got %s", baseDuration, d)
+		}
+	}
+
+	// with a fraction of 0.5, samples spread out across +/-50% of the base duration
+	expectSuccess(t, j.SetJitterFraction(0.5))
+	lowerBound := baseDuration / 2
+	upperBound := baseDuration * 3 / 2
+	for range 1000 {
+		d := j.addJitter(baseDuration)
+		if d < lowerBound {
+			t.Errorf("expected jittered duration to be above %s, but got %s", lowerBound, d)
+		}
+		if d > upperBound {
+			t.Errorf("expected jittered duration to be below %s, but got %s", upperBound, d)
+		}
+	}
+
+	// fractions outside of [0, 1] are rejected
+	expectError(t, "jitter fraction must be between 0 and 1, but got -0.1", j.SetJitterFraction(-0.1))
+	expectError(t, "jitter fraction must be between 0 and 1, but got 1.5", j.SetJitterFraction(1.5))
+}
@@ -0,0 +1,52 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package tasks
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	. "github.com/majewsky/gg/option"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var oldestPendingGauge = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "keppel_janitor_oldest_pending_seconds",
+		Help: "For each janitor job, the time in seconds since the oldest pending task became due (as observed during the most recent task discovery), or 0 if no tasks are pending.",
+	},
+	[]string{"job"},
+)
+
+func init() {
+	prometheus.MustRegister(oldestPendingGauge)
+}
+
+// reportOldestPending updates the keppel_janitor_oldest_pending_seconds gauge
+// for the given job (one of JobNames) after a task discovery.
+//
+// The discovery queries of all instrumented jobs sort the due tasks by their
+// respective `next_*_at` clock field, so the task that was just discovered is
+// always the one that has been waiting for the longest time. Its clock is
+// therefore equal to MIN(next_*_at) over all pending tasks, and we get the
+// metric without issuing any extra queries.
+//
+// Tasks that have never been scheduled before (i.e. where the clock field is
+// NULL) are counted as having become due right now.
+func (j *Janitor) reportOldestPending(job string, dueAt Option[time.Time], err error) {
+	labels := prometheus.Labels{"job": job}
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		oldestPendingGauge.With(labels).Set(0)
+	case err != nil:
+		// leave the previous value in place; the error is reported by jobloop
+	default:
+		var age time.Duration
+		if t, ok := dueAt.Unpack(); ok {
+			age = max(0, j.timeNow().Sub(t))
+		}
+		oldestPendingGauge.With(labels).Set(age.Seconds())
+	}
+}
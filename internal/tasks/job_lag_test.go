@@ -0,0 +1,52 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package tasks
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/sapcc/go-bits/assert"
+
+	"github.com/sapcc/keppel/internal/models"
+	"github.com/sapcc/keppel/internal/test"
+)
+
+func TestOldestPendingGauge(t *testing.T) {
+	j, s := setup(t)
+	s.Clock.StepBy(1 * time.Hour)
+	validateBlobJob := j.BlobValidationJob(s.Registry)
+
+	expectOldestPending := func(expected time.Duration) {
+		t.Helper()
+		var m dto.Metric
+		test.MustDo(t, oldestPendingGauge.With(prometheus.Labels{"job": "blob-validation"}).Write(&m))
+		assert.DeepEqual(t, "oldest pending seconds", m.GetGauge().GetValue(), expected.Seconds())
+	}
+
+	// upload two blobs (with a bit of time in between to make their order deterministic)
+	for idx := range 2 {
+		s.Clock.StepBy(time.Second)
+		test.GenerateExampleLayer(int64(idx)).MustUpload(t, s, fooRepoRef)
+	}
+
+	// when nothing is due, the gauge is zero
+	expectError(t, sql.ErrNoRows.Error(), validateBlobJob.ProcessOne(s.Ctx))
+	expectOldestPending(0)
+
+	// when the janitor falls behind, the gauge reports how long the oldest
+	// pending task has been overdue
+	s.Clock.StepBy(models.BlobValidationInterval + 10*time.Minute)
+	expectSuccess(t, validateBlobJob.ProcessOne(s.Ctx))
+	expectOldestPending(10*time.Minute + time.Second)
+	expectSuccess(t, validateBlobJob.ProcessOne(s.Ctx))
+	expectOldestPending(10 * time.Minute)
+
+	// once the janitor has caught up, the gauge goes back to zero
+	expectError(t, sql.ErrNoRows.Error(), validateBlobJob.ProcessOne(s.Ctx))
+	expectOldestPending(0)
+}
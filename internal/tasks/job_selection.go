@@ -0,0 +1,71 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package tasks
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// JobNames contains the names of all janitor jobs that can be selected with
+// ParseJobSelection(), in the order in which the janitor starts them.
+var JobNames = []string{
+	"account-federation-announcement",
+	"federation-archive-sweep",
+	"issued-token-sweep",
+	"abandoned-upload-cleanup",
+	"abandoned-account-creation-cleanup",
+	"account-deletion",
+	"managed-account-enforcement",
+	"gc",
+	"manifest-trash-purge",
+	"blob-mount-sweep",
+	"blob-sweep",
+	"storage-sweep",
+	"storage-capacity-check",
+	"manifest-sync",
+	"blob-validation",
+	"blob-media-type-backfill",
+	"manifest-validation",
+	"integrity-report",
+	"trivy-security-status",
+}
+
+// JobSelection is the set of janitor jobs that shall run in a janitor process.
+// The keys are elements of JobNames.
+type JobSelection map[string]bool
+
+// ParseJobSelection parses a comma-separated list of job names, as given in
+// the --jobs flag of `keppel server janitor`. If the input is empty, all jobs
+// are selected.
+func ParseJobSelection(input string) (JobSelection, error) {
+	result := make(JobSelection)
+	if strings.TrimSpace(input) == "" {
+		for _, name := range JobNames {
+			result[name] = true
+		}
+		return result, nil
+	}
+
+	for name := range strings.SplitSeq(input, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !slices.Contains(JobNames, name) {
+			return nil, fmt.Errorf("unknown janitor job %q (known jobs are: %s)", name, strings.Join(JobNames, ", "))
+		}
+		result[name] = true
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("no janitor jobs selected in %q", input)
+	}
+	return result, nil
+}
+
+// Contains returns whether the given job is selected.
+func (s JobSelection) Contains(name string) bool {
+	return s[name]
+}
@@ -0,0 +1,34 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package tasks
+
+import (
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+)
+
+func TestParseJobSelection(t *testing.T) {
+	// empty input selects all jobs
+	for _, input := range []string{"", "  "} {
+		selection, err := ParseJobSelection(input)
+		expectSuccess(t, err)
+		assert.DeepEqual(t, "number of selected jobs", len(selection), len(JobNames))
+		for _, name := range JobNames {
+			assert.DeepEqual(t, "selection contains "+name, selection.Contains(name), true)
+		}
+	}
+
+	// explicit selection (whitespace and empty elements are ignored)
+	selection, err := ParseJobSelection("account-deletion, gc,,")
+	expectSuccess(t, err)
+	assert.DeepEqual(t, "selection", selection, JobSelection{"account-deletion": true, "gc": true})
+	assert.DeepEqual(t, "selection contains blob-sweep", selection.Contains("blob-sweep"), false)
+
+	// error cases
+	_, err = ParseJobSelection("gc,garbage-collection")
+	expectError(t, `unknown janitor job "garbage-collection" (known jobs are: account-federation-announcement, federation-archive-sweep, issued-token-sweep, abandoned-upload-cleanup, abandoned-account-creation-cleanup, account-deletion, managed-account-enforcement, gc, manifest-trash-purge, blob-mount-sweep, blob-sweep, storage-sweep, storage-capacity-check, manifest-sync, blob-validation, blob-media-type-backfill, manifest-validation, integrity-report, trivy-security-status)`, err)
+	_, err = ParseJobSelection(",")
+	expectError(t, `no janitor jobs selected in ","`, err)
+}
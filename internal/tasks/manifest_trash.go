@@ -0,0 +1,70 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package tasks
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sapcc/go-bits/jobloop"
+	"github.com/sapcc/go-bits/logg"
+	"github.com/sapcc/go-bits/sqlext"
+
+	"github.com/sapcc/keppel/internal/keppel"
+	"github.com/sapcc/keppel/internal/models"
+)
+
+// query that finds the next manifest whose trash retention has expired
+var expiredTrashedManifestSearchQuery = sqlext.SimplifyWhitespace(`
+	SELECT m.* FROM manifests m
+	  JOIN repos r ON r.id = m.repo_id
+	  JOIN accounts a ON a.name = r.account_name
+	 WHERE m.deleted_at + a.manifest_trash_retention_secs * INTERVAL '1 second' < $1
+	   -- children of manifests in the trash can only be purged after their parent
+	   AND NOT EXISTS (SELECT 1 FROM manifest_manifest_refs mmr WHERE mmr.repo_id = m.repo_id AND mmr.child_digest = m.digest)
+	 ORDER BY m.deleted_at ASC -- oldest deletions first
+	 LIMIT 1                   -- one at a time
+`)
+
+// ManifestTrashPurgeJob is a job. Each task finds a manifest that has been in
+// the trash for longer than its account's trash retention, and deletes it
+// permanently.
+func (j *Janitor) ManifestTrashPurgeJob(registerer prometheus.Registerer) jobloop.Job {
+	return (&jobloop.ProducerConsumerJob[models.Manifest]{
+		Metadata: jobloop.JobMetadata{
+			ReadableName: "purge of expired manifests from trash",
+			CounterOpts: prometheus.CounterOpts{
+				Name: "keppel_manifest_trash_purges",
+				Help: "Counter for manifests that were permanently deleted after their trash retention expired.",
+			},
+		},
+		DiscoverTask: func(_ context.Context, _ prometheus.Labels) (manifest models.Manifest, err error) {
+			err = j.db.SelectOne(&manifest, expiredTrashedManifestSearchQuery, j.timeNow())
+			return manifest, err
+		},
+		ProcessTask: j.purgeTrashedManifest,
+	}).Setup(registerer)
+}
+
+func (j *Janitor) purgeTrashedManifest(ctx context.Context, manifest models.Manifest, labels prometheus.Labels) error {
+	repo, err := keppel.FindRepositoryByID(j.db, manifest.RepositoryID)
+	if err != nil {
+		return fmt.Errorf("cannot find repo for manifest %s: %w", manifest.Digest, err)
+	}
+	account, err := keppel.FindReducedAccount(ctx, j.db, repo.AccountName)
+	if err != nil {
+		return fmt.Errorf("cannot find account for repo %s: %w", repo.FullName(), err)
+	}
+	if account == nil {
+		return fmt.Errorf("cannot find account for repo %s: no such account", repo.FullName())
+	}
+
+	err = j.processor().PurgeManifest(ctx, *account, *repo, manifest.Digest)
+	if err != nil {
+		return fmt.Errorf("cannot purge manifest %s@%s from trash: %w", repo.FullName(), manifest.Digest, err)
+	}
+	logg.Info("purged manifest %s@%s from trash", repo.FullName(), manifest.Digest)
+	return nil
+}
@@ -0,0 +1,106 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package tasks
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/easypg"
+
+	"github.com/sapcc/keppel/internal/keppel"
+	"github.com/sapcc/keppel/internal/test"
+)
+
+func deleteManifestForTest(t *testing.T, j *Janitor, s test.Setup, manifestDigest digest.Digest) {
+	t.Helper()
+	account, err := keppel.FindReducedAccount(t.Context(), s.DB, fooRepoRef.AccountName)
+	test.MustDo(t, err)
+	repo, err := keppel.FindRepository(s.DB, fooRepoRef.Name, fooRepoRef.AccountName)
+	test.MustDo(t, err)
+	test.MustDo(t, j.processor().DeleteManifest(s.Ctx, *account, *repo, manifestDigest, nil, keppel.AuditContext{
+		UserIdentity: janitorUserIdentity{TaskName: "test"},
+		Request:      janitorDummyRequest,
+	}))
+}
+
+func TestManifestTrashPurge(t *testing.T) {
+	j, s := setup(t)
+	test.MustExec(t, s.DB, `UPDATE accounts SET manifest_trash_retention_secs = 3600`)
+	image := test.GenerateImage(test.GenerateExampleLayer(0))
+	image.MustUpload(t, s, fooRepoRef, "latest")
+
+	// deleting the manifest moves it into the trash
+	s.Clock.StepBy(1 * time.Minute)
+	tr, _ := easypg.NewTracker(t, s.DB.Db)
+	deleteManifestForTest(t, j, s, image.Manifest.Digest)
+	deletedAt := s.Clock.Now()
+	tr.DBChanges().AssertEqualf(`
+			UPDATE manifests SET deleted_at = %[2]d, deleted_tags_json = '["latest"]' WHERE repo_id = 1 AND digest = '%[1]s';
+			DELETE FROM tags WHERE repo_id = 1 AND name = 'latest';
+		`,
+		image.Manifest.Digest, deletedAt.Unix(),
+	)
+
+	// the manifest is not purged before the retention has expired
+	purgeJob := j.ManifestTrashPurgeJob(s.Registry)
+	s.Clock.StepBy(59 * time.Minute)
+	expectError(t, sql.ErrNoRows.Error(), purgeJob.ProcessOne(s.Ctx))
+	tr.DBChanges().AssertEmpty()
+
+	// afterwards, it is purged just like a regular manifest deletion
+	s.Clock.StepBy(2 * time.Minute)
+	expectSuccess(t, purgeJob.ProcessOne(s.Ctx))
+	expectError(t, sql.ErrNoRows.Error(), purgeJob.ProcessOne(s.Ctx))
+	tr.DBChanges().AssertEqualf(`
+			DELETE FROM manifest_blob_refs WHERE repo_id = 1 AND digest = '%[1]s' AND blob_id = 1;
+			DELETE FROM manifest_blob_refs WHERE repo_id = 1 AND digest = '%[1]s' AND blob_id = 2;
+			DELETE FROM manifest_contents WHERE repo_id = 1 AND digest = '%[1]s';
+			DELETE FROM manifests WHERE repo_id = 1 AND digest = '%[1]s';
+			DELETE FROM trivy_security_info WHERE repo_id = 1 AND digest = '%[1]s';
+		`,
+		image.Manifest.Digest,
+	)
+}
+
+func TestManifestTrashPurgeWithImageList(t *testing.T) {
+	j, s := setup(t)
+	test.MustExec(t, s.DB, `UPDATE accounts SET manifest_trash_retention_secs = 3600`)
+	images := []test.Image{
+		test.GenerateImage(test.GenerateExampleLayer(0)),
+		test.GenerateImage(test.GenerateExampleLayer(1)),
+	}
+	imageList := test.GenerateImageList(images...)
+	imageList.MustUpload(t, s, fooRepoRef, "latest")
+
+	// while the list is alive, its children cannot be deleted, but once the
+	// list is in the trash, they can be moved into the trash as well
+	deleteManifestForTest(t, j, s, imageList.Manifest.Digest)
+	s.Clock.StepBy(1 * time.Minute)
+	deleteManifestForTest(t, j, s, images[0].Manifest.Digest)
+
+	countManifests := func() int64 {
+		t.Helper()
+		count, err := s.DB.SelectInt(`SELECT COUNT(*) FROM manifests`)
+		test.MustDo(t, err)
+		return count
+	}
+	assert.DeepEqual(t, "manifest count", countManifests(), int64(3))
+
+	// the child can only be purged after the list was purged
+	purgeJob := j.ManifestTrashPurgeJob(s.Registry)
+	s.Clock.StepBy(2 * time.Hour)
+	expectSuccess(t, purgeJob.ProcessOne(s.Ctx))
+	exists, err := s.DB.SelectBool(`SELECT COUNT(*) > 0 FROM manifests WHERE digest = $1`, imageList.Manifest.Digest.String())
+	test.MustDo(t, err)
+	assert.DeepEqual(t, "image list exists", exists, false)
+	expectSuccess(t, purgeJob.ProcessOne(s.Ctx))
+	expectError(t, sql.ErrNoRows.Error(), purgeJob.ProcessOne(s.Ctx))
+
+	// the other child was never deleted, so it stays
+	assert.DeepEqual(t, "manifest count", countManifests(), int64(1))
+}
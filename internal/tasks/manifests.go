@@ -50,8 +50,8 @@ var validateManifestSearchQuery = sqlext.SimplifyWhitespace(`
 // attribute of their constituent images.
 
 var validateManifestFinishQuery = sqlext.SimplifyWhitespace(`
-	UPDATE manifests SET next_validation_at = $1, validation_error_message = $2
-	WHERE repo_id = $3 AND digest = $4
+	UPDATE manifests SET last_validated_at = $1, next_validation_at = $2, validation_error_message = $3
+	WHERE repo_id = $4 AND digest = $5
 `)
 
 // ManifestValidationJob is a job. Each task validates a manifest that has not been validated for more
@@ -69,6 +69,7 @@ func (j *Janitor) ManifestValidationJob(registerer prometheus.Registerer) jobloo
 		},
 		DiscoverTask: func(_ context.Context, _ prometheus.Labels) (manifest models.Manifest, err error) {
 			err = j.db.SelectOne(&manifest, validateManifestSearchQuery, j.timeNow())
+			j.reportOldestPending("manifest-validation", Some(manifest.NextValidationAt), err)
 			return manifest, err
 		},
 		ProcessTask: j.validateManifest,
@@ -82,7 +83,7 @@ func (j *Janitor) validateManifest(ctx context.Context, manifest models.Manifest
 	if err != nil {
 		return fmt.Errorf("cannot find repo %d for manifest %s: %w", manifest.RepositoryID, manifest.Digest, err)
 	}
-	account, err := keppel.FindReducedAccount(j.db, repo.AccountName)
+	account, err := keppel.FindReducedAccount(ctx, j.db, repo.AccountName)
 	if err != nil {
 		return fmt.Errorf("cannot find account for manifest %s/%s: %w", repo.FullName(), manifest.Digest, err)
 	}
@@ -96,7 +97,7 @@ func (j *Janitor) validateManifest(ctx context.Context, manifest models.Manifest
 	err = j.processor().ValidateExistingManifest(ctx, *account, repo, &manifest)
 	if err != nil {
 		// on failure, log error message and schedule next validation sooner than usual
-		_, updateErr := j.db.Exec(validateManifestFinishQuery,
+		_, updateErr := j.db.Exec(validateManifestFinishQuery, j.timeNow(),
 			j.timeNow().Add(j.addJitter(models.ManifestValidationAfterErrorInterval)),
 			err.Error(), repo.ID, manifest.Digest,
 		)
@@ -108,7 +109,7 @@ func (j *Janitor) validateManifest(ctx context.Context, manifest models.Manifest
 
 	// on success, reset error message and schedule next validation
 	_, err = j.db.Exec(validateManifestFinishQuery,
-		nextValidationAt, "", repo.ID, manifest.Digest,
+		j.timeNow(), nextValidationAt, "", repo.ID, manifest.Digest,
 	)
 	return err
 }
@@ -152,6 +153,7 @@ func (j *Janitor) ManifestSyncJob(registerer prometheus.Registerer) jobloop.Job
 		},
 		DiscoverTask: func(_ context.Context, _ prometheus.Labels) (repo models.Repository, err error) {
 			err = j.db.SelectOne(&repo, syncManifestRepoSelectQuery, j.timeNow())
+			j.reportOldestPending("manifest-sync", repo.NextManifestSyncAt, err)
 			return repo, err
 		},
 		ProcessTask: j.syncManifestsInReplicaRepo,
@@ -160,7 +162,7 @@ func (j *Janitor) ManifestSyncJob(registerer prometheus.Registerer) jobloop.Job
 
 func (j *Janitor) syncManifestsInReplicaRepo(ctx context.Context, repo models.Repository, _ prometheus.Labels) error {
 	// find corresponding account
-	account, err := keppel.FindAccount(j.db, repo.AccountName)
+	account, err := keppel.FindAccount(ctx, j.db, repo.AccountName)
 	if err != nil {
 		return fmt.Errorf("cannot find account for repo %s: %w", repo.FullName(), err)
 	}
@@ -242,7 +244,7 @@ func (j *Janitor) getReplicaSyncPayload(ctx context.Context, account models.Acco
 	}
 
 	var manifests []keppel.ManifestForSync
-	query = `SELECT digest, last_pulled_at FROM manifests WHERE repo_id = $1`
+	query = `SELECT digest, last_pulled_at FROM manifests WHERE repo_id = $1 AND deleted_at IS NULL`
 	err = sqlext.ForeachRow(j.db, query, []any{repo.ID}, func(rows *sql.Rows) error {
 		var (
 			digest       digest.Digest
@@ -324,7 +326,7 @@ TAG:
 
 var repoUntaggedManifestsSelectQuery = sqlext.SimplifyWhitespace(`
 	SELECT m.* FROM manifests m
-		WHERE repo_id = $1
+		WHERE repo_id = $1 AND deleted_at IS NULL
 		AND digest NOT IN (SELECT DISTINCT digest FROM tags WHERE repo_id = $1)
 `)
 
@@ -447,11 +449,14 @@ func (j *Janitor) collectManifestLayerBlobs(ctx context.Context, account models.
 	if err != nil {
 		return nil, err
 	}
-	manifestParsed, err := keppel.ParseManifest(manifest.MediaType, manifestBytes)
+	manifestParsed, err := j.cfg.ParseManifest(manifest.MediaType, manifestBytes)
 	if err != nil {
 		return nil, keppel.ErrManifestInvalid.With(err.Error())
 	}
 	manifestDigest := digest.FromBytes(manifestBytes)
+	if manifest.Digest != "" {
+		manifestDigest = manifest.Digest.Algorithm().FromBytes(manifestBytes)
+	}
 	if manifest.Digest != "" && manifestDigest != manifest.Digest {
 		return nil, keppel.ErrDigestInvalid.With("actual manifest digest is %s", manifestDigest)
 	}
@@ -504,9 +509,13 @@ func (j *Janitor) CheckTrivySecurityStatusJob(registerer prometheus.Registerer)
 			_, err = tx.Select(&securityInfos, securityCheckSelectQuery, j.timeNow())
 
 			// jobloop expects to receive errNoRows instead of an empty result
+			var oldestNextCheckAt Option[time.Time]
 			if len(securityInfos) == 0 {
 				err = sql.ErrNoRows
+			} else {
+				oldestNextCheckAt = securityInfos[0].NextCheckAt
 			}
+			j.reportOldestPending("trivy-security-status", oldestNextCheckAt, err)
 
 			return securityInfos, err
 		},
@@ -615,7 +624,7 @@ func (j *Janitor) doSecurityCheck(ctx context.Context, securityInfo *models.Triv
 	if err != nil {
 		return fmt.Errorf("cannot find repo for manifest %s: %w", securityInfo.Digest, err)
 	}
-	account, err := keppel.FindAccount(j.db, repo.AccountName)
+	account, err := keppel.FindAccount(ctx, j.db, repo.AccountName)
 	if err != nil {
 		return fmt.Errorf("cannot find account for repo %s: %w", repo.FullName(), err)
 	}
@@ -875,11 +875,11 @@ func TestManifestValidationJobWithoutPlatform(t *testing.T) {
 	expectSuccess(t, validateManifestJob.ProcessOne(s.Ctx))
 	expectError(t, sql.ErrNoRows.Error(), validateManifestJob.ProcessOne(s.Ctx))
 	tr.DBChanges().AssertEqualf(`
-			UPDATE manifests SET next_validation_at = %d WHERE repo_id = 1 AND digest = '%s';
-			UPDATE manifests SET next_validation_at = %d WHERE repo_id = 1 AND digest = '%s';
+			UPDATE manifests SET next_validation_at = %[1]d, last_validated_at = %[2]d WHERE repo_id = 1 AND digest = '%[3]s';
+			UPDATE manifests SET next_validation_at = %[1]d, last_validated_at = %[2]d WHERE repo_id = 1 AND digest = '%[4]s';
 		`,
-		s.Clock.Now().Add(models.ManifestValidationInterval).Unix(), imageList.Manifest.Digest,
-		s.Clock.Now().Add(models.ManifestValidationInterval).Unix(), image.Manifest.Digest,
+		s.Clock.Now().Add(models.ManifestValidationInterval).Unix(), s.Clock.Now().Unix(),
+		imageList.Manifest.Digest, image.Manifest.Digest,
 	)
 }
 
@@ -13,9 +13,11 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"time"
 
 	"github.com/go-gorp/gorp/v3"
 	"github.com/opencontainers/go-digest"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sapcc/go-bits/logg"
 
 	authapi "github.com/sapcc/keppel/internal/api/auth"
@@ -23,6 +25,18 @@ import (
 	"github.com/sapcc/keppel/internal/models"
 )
 
+var peerPasswordIssuedAtGauge = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "keppel_peer_password_issued_at",
+		Help: "UNIX timestamp of when the current replication password for this peer was issued.",
+	},
+	[]string{"peer_hostname"},
+)
+
+func init() {
+	prometheus.MustRegister(peerPasswordIssuedAtGauge)
+}
+
 // IssueNewPasswordForPeer issues a new replication password for the given peer.
 //
 // The `tx` argument can be given if the caller already has a transaction open
@@ -116,5 +130,6 @@ func IssueNewPasswordForPeer(ctx context.Context, cfg keppel.Configuration, db *
 		}
 	}
 
+	peerPasswordIssuedAtGauge.WithLabelValues(peer.HostName).Set(float64(time.Now().Unix()))
 	return nil
 }
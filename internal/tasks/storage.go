@@ -10,7 +10,6 @@ import (
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sapcc/go-bits/jobloop"
-	"github.com/sapcc/go-bits/logg"
 	"github.com/sapcc/go-bits/sqlext"
 
 	"github.com/sapcc/keppel/internal/keppel"
@@ -52,6 +51,7 @@ func (j *Janitor) StorageSweepJob(registerer prometheus.Registerer) jobloop.Job
 		},
 		DiscoverTask: func(_ context.Context, _ prometheus.Labels) (account models.Account, err error) {
 			err = j.db.SelectOne(&account, storageSweepSearchQuery, j.timeNow())
+			j.reportOldestPending("storage-sweep", account.NextStorageSweepedAt, err)
 			return account, err
 		},
 		ProcessTask: j.sweepStorage,
@@ -62,6 +62,7 @@ func (j *Janitor) StorageSweepJob(registerer prometheus.Registerer) jobloop.Job
 //
 // Note: This must be kept in synced with the slimmed down version in DeleteAccountsJob!
 func (j *Janitor) sweepStorage(ctx context.Context, account models.Account, _ prometheus.Labels) error {
+	ctx = keppel.WithLogFields(ctx, keppel.LogFields{Account: account.Name})
 	reducedAccount := account.Reduced()
 
 	// enumerate blobs, manifests and trivy reports in the backing storage
@@ -183,11 +184,11 @@ func (j *Janitor) deleteUnknownBlob(ctx context.Context, blobsByStorageID map[st
 		// need to use different cleanup strategies depending on whether the
 		// blob upload was finalized or not
 		if blobInfo.ChunkCount > 0 {
-			logg.Info("storage sweep in account %s: removing unfinalized blob stored at %s with %d chunks",
+			keppel.LogInfo(ctx, "storage sweep in account %s: removing unfinalized blob stored at %s with %d chunks",
 				account.Name, unknownBlob.StorageID, blobInfo.ChunkCount)
 			err = j.sd.AbortBlobUpload(ctx, account, unknownBlob.StorageID, blobInfo.ChunkCount)
 		} else {
-			logg.Info("storage sweep in account %s: removing finalized blob stored at %s",
+			keppel.LogInfo(ctx, "storage sweep in account %s: removing finalized blob stored at %s",
 				account.Name, unknownBlob.StorageID)
 			err = j.sd.DeleteBlob(ctx, account, unknownBlob.StorageID)
 		}
@@ -279,7 +280,7 @@ func (j *Janitor) deleteUnknownManifest(ctx context.Context, isActualManifest ma
 	// if we deleted the manifest from the backing storage in a previous
 	// sweep, but could not remove the unknown_manifests entry from the DB)
 	if isActualManifest[unknownManifestInfo] {
-		logg.Info("storage sweep in account %s: removing manifest %s/%s",
+		keppel.LogInfo(ctx, "storage sweep in account %s: removing manifest %s/%s",
 			account.Name, unknownManifest.RepositoryName, unknownManifest.Digest)
 		err := j.sd.DeleteManifest(ctx, account, unknownManifest.RepositoryName, unknownManifest.Digest)
 		if err != nil {
@@ -372,7 +373,7 @@ func (j *Janitor) deleteUnknownTrivyReport(ctx context.Context, isActualReport m
 	// if we deleted the report from the backing storage in a previous sweep,
 	// but could not remove the unknown_trivy_reports entry from the DB)
 	if isActualReport[unknownReportInfo] {
-		logg.Info("storage sweep in account %s: removing Trivy report %s/%s/%s",
+		keppel.LogInfo(ctx, "storage sweep in account %s: removing Trivy report %s/%s/%s",
 			account.Name, unknownReport.RepositoryName, unknownReport.Digest, unknownReport.Format)
 		err := j.sd.DeleteTrivyReport(ctx, account, unknownReport.RepositoryName, unknownReport.Digest, unknownReport.Format)
 		if err != nil {
@@ -0,0 +1,64 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package tasks
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sapcc/go-bits/jobloop"
+	"github.com/sapcc/go-bits/logg"
+
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+var storageCapacityGauge = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "keppel_storage_capacity_bytes",
+		Help: `Capacity of the storage backend, as reported by the storage driver. The "total" series is absent if the storage does not have a fixed size limit.`,
+	},
+	[]string{"type"},
+)
+
+func init() {
+	prometheus.MustRegister(storageCapacityGauge)
+}
+
+// StorageCapacityCheckJob is a job. Each task queries the storage driver for
+// its used and total capacity, and reports them as metrics.
+func (j *Janitor) StorageCapacityCheckJob(registerer prometheus.Registerer) jobloop.Job {
+	return (&jobloop.CronJob{
+		Metadata: jobloop.JobMetadata{
+			ReadableName: "check storage capacity",
+			CounterOpts: prometheus.CounterOpts{
+				Name: "keppel_storage_capacity_checks",
+				Help: "Counter for storage capacity checks.",
+			},
+		},
+		Interval:     5 * time.Minute,
+		InitialDelay: 10 * time.Second,
+		Task:         j.checkStorageCapacity,
+	}).Setup(registerer)
+}
+
+func (j *Janitor) checkStorageCapacity(ctx context.Context, _ prometheus.Labels) error {
+	used, total, err := j.sd.StorageCapacity(ctx)
+	if errors.Is(err, keppel.ErrCapacityUnknown) {
+		logg.Debug("storage driver %q cannot report its capacity", j.sd.PluginTypeID())
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	storageCapacityGauge.With(prometheus.Labels{"type": "used"}).Set(float64(used))
+	if total == keppel.UnlimitedStorageCapacity {
+		storageCapacityGauge.Delete(prometheus.Labels{"type": "total"})
+	} else {
+		storageCapacityGauge.With(prometheus.Labels{"type": "total"}).Set(float64(total))
+	}
+	return nil
+}
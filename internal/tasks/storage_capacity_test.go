@@ -0,0 +1,33 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package tasks
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/sapcc/go-bits/assert"
+
+	"github.com/sapcc/keppel/internal/test"
+)
+
+func TestStorageCapacityCheckJob(t *testing.T) {
+	j, s := setup(t)
+	job := j.StorageCapacityCheckJob(s.Registry)
+
+	image := test.GenerateImage(test.GenerateExampleLayer(0))
+	image.MustUpload(t, s, fooRepoRef, "latest")
+	expectSuccess(t, job.ProcessOne(s.Ctx))
+
+	var m dto.Metric
+	test.MustDo(t, storageCapacityGauge.With(prometheus.Labels{"type": "used"}).Write(&m))
+	assert.DeepEqual(t, "used capacity", m.GetGauge().GetValue(), float64(image.SizeBytes()))
+
+	// the trivial storage driver does not have a size limit, so there is no "total" series
+	ch := make(chan prometheus.Metric, 10)
+	storageCapacityGauge.Collect(ch)
+	close(ch)
+	assert.DeepEqual(t, "number of series", len(ch), 1)
+}
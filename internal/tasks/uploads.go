@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/go-gorp/gorp/v3"
+	. "github.com/majewsky/gg/option"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sapcc/go-bits/jobloop"
 	"github.com/sapcc/go-bits/sqlext"
@@ -46,6 +47,7 @@ func (j *Janitor) AbandonedUploadCleanupJob(registerer prometheus.Registerer) jo
 		DiscoverRow: func(_ context.Context, tx *gorp.Transaction, _ prometheus.Labels) (upload models.Upload, err error) {
 			maxUpdatedAt := j.timeNow().Add(-24 * time.Hour)
 			err = tx.SelectOne(&upload, abandonedUploadSearchQuery, maxUpdatedAt)
+			j.reportOldestPending("abandoned-upload-cleanup", Some(upload.UpdatedAt.Add(24*time.Hour)), err)
 			return upload, err
 		},
 		ProcessRow: j.deleteAbandonedUpload,
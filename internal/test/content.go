@@ -306,6 +306,30 @@ func (l ImageList) ImageRef(s Setup, repo models.Repository) models.ImageReferen
 	}
 }
 
+// GenerateImageIndex makes an OCI image index referencing the given manifests
+// (without platform information). In contrast to GenerateImageList, this can
+// be used to build nested image indexes.
+func GenerateImageIndex(manifests ...Bytes) Bytes {
+	manifestDescs := []map[string]any{}
+	for _, m := range manifests {
+		manifestDescs = append(manifestDescs, map[string]any{
+			"mediaType": m.MediaType,
+			"size":      len(m.Contents),
+			"digest":    m.Digest,
+		})
+	}
+
+	indexBytes, err := json.Marshal(map[string]any{
+		"schemaVersion": 2,
+		"mediaType":     imgspecv1.MediaTypeImageIndex,
+		"manifests":     manifestDescs,
+	})
+	if err != nil {
+		panic(err.Error())
+	}
+	return newBytesWithMediaType(indexBytes, imgspecv1.MediaTypeImageIndex)
+}
+
 func makeTimestamp(seconds int) string {
 	return time.Unix(int64(seconds), 0).UTC().Format(time.RFC3339Nano)
 }
@@ -24,10 +24,12 @@ type FederationDriver struct {
 	APIPublicHostName              string
 	ClaimFailsBecauseOfUserError   bool
 	ClaimFailsBecauseOfServerError bool
+	ClaimFailsBecauseOfRaceLost    bool
 	ForfeitFails                   bool
 	NextSubleaseTokenSecretToIssue string
 	ValidSubleaseTokenSecrets      map[models.AccountName]string
 	RecordedAccounts               []AccountRecordedByFederationDriver
+	AccountNameReservations        []keppel.AccountNameReservation
 }
 
 // AccountRecordedByFederationDriver appears in type FederationDriver.
@@ -60,6 +62,17 @@ func (d *FederationDriver) ClaimAccountName(ctx context.Context, account models.
 	if d.ClaimFailsBecauseOfServerError {
 		return keppel.ClaimErrored, fmt.Errorf("failed to assign name %q to auth tenant %q", account.Name, account.AuthTenantID)
 	}
+	if d.ClaimFailsBecauseOfRaceLost {
+		return keppel.ClaimRaceLost, fmt.Errorf("concurrent claim on name %q, please retry", account.Name)
+	}
+
+	// for primary accounts, enforce reservations
+	if account.UpstreamPeerHostName == "" {
+		err := keppel.CheckAccountNameReservations(d.AccountNameReservations, account)
+		if err != nil {
+			return keppel.ClaimFailed, err
+		}
+	}
 
 	// for replica accounts, do the regular sublease-token dance
 	if account.UpstreamPeerHostName != "" {
@@ -101,6 +114,32 @@ func (d *FederationDriver) RecordExistingAccount(ctx context.Context, account mo
 	return nil
 }
 
+// BatchAnnouncingFederationDriver wraps FederationDriver to implement the
+// keppel.BatchAnnouncingFederationDriver interface. It records the sizes of
+// all batches that were announced through it.
+type BatchAnnouncingFederationDriver struct {
+	*FederationDriver
+	RecordedBatchSizes []int
+	// if true, SupportsBatchAnnouncements() reports false (like the "multi"
+	// driver does when one of its subdrivers does not support batching)
+	BatchingUnsupported bool
+}
+
+// SupportsBatchAnnouncements implements the keppel.BatchAnnouncingFederationDriver interface.
+func (d *BatchAnnouncingFederationDriver) SupportsBatchAnnouncements() bool {
+	return !d.BatchingUnsupported
+}
+
+// RecordExistingAccounts implements the keppel.BatchAnnouncingFederationDriver interface.
+func (d *BatchAnnouncingFederationDriver) RecordExistingAccounts(ctx context.Context, accounts []models.Account, now time.Time) []error {
+	d.RecordedBatchSizes = append(d.RecordedBatchSizes, len(accounts))
+	errs := make([]error, len(accounts))
+	for idx, account := range accounts {
+		errs[idx] = d.RecordExistingAccount(ctx, account, now)
+	}
+	return errs
+}
+
 // FindPrimaryAccount implements the keppel.FederationDriver interface.
 func (d *FederationDriver) FindPrimaryAccount(ctx context.Context, accountName models.AccountName) (string, error) {
 	for _, fd := range federationDriversForThisUnitTest {
@@ -112,3 +151,8 @@ func (d *FederationDriver) FindPrimaryAccount(ctx context.Context, accountName m
 	}
 	return "", keppel.ErrNoSuchPrimaryAccount
 }
+
+// SweepArchivedAccountNames implements the keppel.FederationDriver interface.
+func (d *FederationDriver) SweepArchivedAccountNames(ctx context.Context, now time.Time) error {
+	return nil
+}
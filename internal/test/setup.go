@@ -42,7 +42,13 @@ type setupParams struct {
 	WithQuotas              bool
 	WithPreviousIssuerKey   bool
 	WithoutCurrentIssuerKey bool
+	WithIssuerKeyIDs        bool
+	WithTokenTracking       bool
 	RateLimitEngine         *keppel.RateLimitEngine
+	DigestAlgorithms        []digest.Algorithm
+	DefaultBlobMediaType    string
+	MaxManifestRefDepth     int
+	OpaqueMediaTypes        []string
 	SetupOfPrimary          *Setup
 	Accounts                []*models.Account
 	Repos                   []*models.Repository
@@ -89,6 +95,11 @@ func WithQuotas(params *setupParams) {
 	params.WithQuotas = true
 }
 
+// WithTokenTracking is a SetupOption that sets the TrackIssuedTokens field in keppel.Configuration.
+func WithTokenTracking(params *setupParams) {
+	params.WithTokenTracking = true
+}
+
 // WithRateLimitEngine is a SetupOption to use a RateLimitEngine in enabled APIs.
 func WithRateLimitEngine(rle *keppel.RateLimitEngine) SetupOption {
 	return func(params *setupParams) {
@@ -96,6 +107,34 @@ func WithRateLimitEngine(rle *keppel.RateLimitEngine) SetupOption {
 	}
 }
 
+// WithDigestAlgorithms is a SetupOption that sets the DigestAlgorithms field in keppel.Configuration.
+func WithDigestAlgorithms(algos ...digest.Algorithm) SetupOption {
+	return func(params *setupParams) {
+		params.DigestAlgorithms = algos
+	}
+}
+
+// WithDefaultBlobMediaType is a SetupOption that sets the DefaultBlobMediaType field in keppel.Configuration.
+func WithDefaultBlobMediaType(mediaType string) SetupOption {
+	return func(params *setupParams) {
+		params.DefaultBlobMediaType = mediaType
+	}
+}
+
+// WithMaxManifestReferenceDepth is a SetupOption that sets the MaxManifestReferenceDepth field in keppel.Configuration.
+func WithMaxManifestReferenceDepth(maxDepth int) SetupOption {
+	return func(params *setupParams) {
+		params.MaxManifestRefDepth = maxDepth
+	}
+}
+
+// WithOpaqueManifestMediaTypes is a SetupOption that sets the OpaqueManifestMediaTypes field in keppel.Configuration.
+func WithOpaqueManifestMediaTypes(mediaTypes ...string) SetupOption {
+	return func(params *setupParams) {
+		params.OpaqueMediaTypes = mediaTypes
+	}
+}
+
 // WithAccount is a SetupOption that adds the given keppel.Account to the DB during NewSetup().
 func WithAccount(account models.Account) SetupOption {
 	return func(params *setupParams) {
@@ -132,6 +171,12 @@ func WithoutCurrentIssuerKey(params *setupParams) {
 	params.WithoutCurrentIssuerKey = true
 }
 
+// WithIssuerKeyIDs is a SetupOption that assigns the key IDs "current" and
+// "previous" to the respective sets of test issuer keys.
+func WithIssuerKeyIDs(params *setupParams) {
+	params.WithIssuerKeyIDs = true
+}
+
 // Setup contains all the pieces that are needed for most tests.
 type Setup struct {
 	// fields that are always set
@@ -192,7 +237,12 @@ func NewSetup(t *testing.T, opts ...SetupOption) Setup {
 	// build keppel.Configuration
 	s := Setup{
 		Config: keppel.Configuration{
-			APIPublicHostname: apiPublicHostname,
+			APIPublicHostname:         apiPublicHostname,
+			DigestAlgorithms:          params.DigestAlgorithms,
+			DefaultBlobMediaType:      params.DefaultBlobMediaType,
+			MaxManifestReferenceDepth: params.MaxManifestRefDepth,
+			OpaqueManifestMediaTypes:  params.OpaqueMediaTypes,
+			TrackIssuedTokens:         params.WithTokenTracking,
 		},
 		Ctx:        t.Context(),
 		Registry:   prometheus.NewPedanticRegistry(),
@@ -203,15 +253,19 @@ func NewSetup(t *testing.T, opts ...SetupOption) Setup {
 	if params.WithoutCurrentIssuerKey && !params.WithPreviousIssuerKey {
 		t.Fatal("test.WithoutCurrentIssuerKey requires test.WithPreviousIssuerKey")
 	}
+	var currentIssuerKeyID, previousIssuerKeyID string
+	if params.WithIssuerKeyIDs {
+		currentIssuerKeyID, previousIssuerKeyID = "current", "previous"
+	}
 	if params.WithPreviousIssuerKey {
 		key, err := keppel.ParseIssuerKey(UnitTestIssuerRSAPrivateKey)
 		MustDo(t, err)
-		s.Config.JWTIssuerKeys = append(s.Config.JWTIssuerKeys, key)
+		s.Config.JWTIssuerKeys = append(s.Config.JWTIssuerKeys, keppel.IssuerKey{ID: previousIssuerKeyID, PrivateKey: key})
 	}
 	if !params.WithoutCurrentIssuerKey {
 		jwtIssuerKey, err := keppel.ParseIssuerKey(UnitTestIssuerEd25519PrivateKey)
 		MustDo(t, err)
-		s.Config.JWTIssuerKeys = append(s.Config.JWTIssuerKeys, jwtIssuerKey)
+		s.Config.JWTIssuerKeys = append(s.Config.JWTIssuerKeys, keppel.IssuerKey{ID: currentIssuerKeyID, PrivateKey: jwtIssuerKey})
 	}
 
 	if params.WithTrivyDouble {
@@ -233,7 +287,7 @@ func NewSetup(t *testing.T, opts ...SetupOption) Setup {
 	dbOpts := []easypg.TestSetupOption{
 		// manifest_manifest_refs needs a specialized cleanup strategy because of an "ON DELETE RESTRICT" constraint
 		easypg.ClearContentsWith(`DELETE FROM manifest_manifest_refs WHERE parent_digest NOT IN (SELECT child_digest FROM manifest_manifest_refs)`),
-		easypg.ClearTables("manifest_blob_refs", "accounts", "peers", "quotas"),
+		easypg.ClearTables("manifest_blob_refs", "accounts", "peers", "quotas", "issued_tokens"),
 		easypg.ResetPrimaryKeys("blobs", "repos"),
 	}
 	if params.IsSecondary {
@@ -248,12 +302,12 @@ func NewSetup(t *testing.T, opts ...SetupOption) Setup {
 		if params.WithPreviousIssuerKey {
 			key, err := keppel.ParseIssuerKey(UnitTestAnycastIssuerRSAPrivateKey)
 			MustDo(t, err)
-			s.Config.AnycastJWTIssuerKeys = append(s.Config.AnycastJWTIssuerKeys, key)
+			s.Config.AnycastJWTIssuerKeys = append(s.Config.AnycastJWTIssuerKeys, keppel.IssuerKey{ID: previousIssuerKeyID, PrivateKey: key})
 		}
 		if !params.WithoutCurrentIssuerKey {
 			jwtIssuerKey, err := keppel.ParseIssuerKey(UnitTestAnycastIssuerEd25519PrivateKey)
 			MustDo(t, err)
-			s.Config.AnycastJWTIssuerKeys = append(s.Config.AnycastJWTIssuerKeys, jwtIssuerKey)
+			s.Config.AnycastJWTIssuerKeys = append(s.Config.AnycastJWTIssuerKeys, keppel.IssuerKey{ID: currentIssuerKeyID, PrivateKey: jwtIssuerKey})
 		}
 	}
 
@@ -304,7 +358,7 @@ func NewSetup(t *testing.T, opts ...SetupOption) Setup {
 		apis = append(apis, keppelv1.NewAPI(s.Config, ad, fd, sd, icd, s.DB, s.Auditor, params.RateLimitEngine).OverrideTimeNow(s.Clock.Now))
 	}
 	if params.WithPeerAPI {
-		apis = append(apis, peerv1.NewAPI(s.Config, ad, s.DB))
+		apis = append(apis, peerv1.NewAPI(s.Config, ad, s.DB, s.Auditor))
 	}
 	s.Handler = httpapi.Compose(apis...)
 	if tt, ok := http.DefaultTransport.(*RoundTripper); ok {
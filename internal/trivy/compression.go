@@ -0,0 +1,54 @@
+// SPDX-FileCopyrightText: 2025 SAP SE or an SAP affiliate company
+// SPDX-License-Identifier: Apache-2.0
+
+package trivy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+)
+
+// The first two bytes of every gzip stream (see RFC 1952). Trivy reports are
+// JSON documents, so uncompressed reports can never start with these bytes.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// Compress returns a copy of this payload with gzip-compressed Contents.
+// If the payload is already compressed, it is returned unchanged.
+//
+// Storage drivers use this to store reports in compressed form.
+func (p ReportPayload) Compress() (ReportPayload, error) {
+	if p.Compressed {
+		return p, nil
+	}
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write(p.Contents)
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		return ReportPayload{}, err
+	}
+	return ReportPayload{
+		Format:     p.Format,
+		Contents:   buf.Bytes(),
+		Compressed: true,
+	}, nil
+}
+
+// DecompressReport takes the contents of a report as stored by a storage
+// driver, and returns the uncompressed report. Reports that were stored
+// before compression was introduced are returned unchanged.
+func DecompressReport(contents []byte) ([]byte, error) {
+	if !bytes.HasPrefix(contents, gzipMagic) {
+		return contents, nil
+	}
+	r, err := gzip.NewReader(bytes.NewReader(contents))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
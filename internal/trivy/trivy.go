@@ -5,6 +5,7 @@ package trivy
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
@@ -31,6 +32,28 @@ const (
 	KeppelTokenHeader = "Keppel-Token"
 )
 
+// ProxyErrorCode is a machine-readable error code that appears in error
+// responses from the trivy proxy.
+type ProxyErrorCode string
+
+// Possible values for ProxyErrorCode.
+const (
+	ProxyErrorUnauthorized      ProxyErrorCode = "UNAUTHORIZED"
+	ProxyErrorInvalidRequest    ProxyErrorCode = "INVALID_REQUEST"
+	ProxyErrorTooManyScans      ProxyErrorCode = "TOO_MANY_SCANS"
+	ProxyErrorImageUnauthorized ProxyErrorCode = "IMAGE_UNAUTHORIZED"
+	ProxyErrorImageNotFound     ProxyErrorCode = "IMAGE_NOT_FOUND"
+	ProxyErrorDBDownloadFailed  ProxyErrorCode = "DB_DOWNLOAD_FAILED"
+	ProxyErrorTimeout           ProxyErrorCode = "TIMEOUT"
+	ProxyErrorScanFailed        ProxyErrorCode = "SCAN_FAILED"
+)
+
+// ProxyError is the JSON payload of an error response from the trivy proxy.
+type ProxyError struct {
+	Code    ProxyErrorCode `json:"code"`
+	Message string         `json:"message"`
+}
+
 // Config contains credentials for talking to a Trivy server through a
 // trivy-proxy deployment.
 type Config struct {
@@ -44,6 +67,8 @@ type Config struct {
 type ReportPayload struct {
 	Format   string
 	Contents []byte
+	// If true, Contents is gzip-compressed (see Compress()).
+	Compressed bool
 }
 
 // ScanManifest queries the Trivy server for a report on the given manifest.
@@ -73,6 +98,10 @@ func (tc *Config) ScanManifest(ctx context.Context, keppelToken string, manifest
 		return ReportPayload{}, err
 	}
 	if resp.StatusCode != http.StatusOK {
+		var perr ProxyError
+		if json.Unmarshal(respBody, &perr) == nil && perr.Code != "" {
+			return ReportPayload{}, fmt.Errorf("trivy proxy did not return 200: %d %s: %s", resp.StatusCode, perr.Code, stripColor(perr.Message))
+		}
 		// from inner to outer: cast to string, remove extra new lines, remove color escape codes, replace multiple consecutive spaces with one
 		respCleaned := strings.Join(strings.Fields(stripColor(strings.TrimSpace(string(respBody)))), " ")
 		return ReportPayload{}, fmt.Errorf("trivy proxy did not return 200: %d %s", resp.StatusCode, respCleaned)
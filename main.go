@@ -23,7 +23,9 @@ import (
 	// include all known driver implementations
 	_ "github.com/sapcc/keppel/internal/drivers/basic"
 	_ "github.com/sapcc/keppel/internal/drivers/filesystem"
+	_ "github.com/sapcc/keppel/internal/drivers/ldap"
 	_ "github.com/sapcc/keppel/internal/drivers/multi"
+	_ "github.com/sapcc/keppel/internal/drivers/oidc"
 	_ "github.com/sapcc/keppel/internal/drivers/openstack"
 	_ "github.com/sapcc/keppel/internal/drivers/redis"
 	_ "github.com/sapcc/keppel/internal/drivers/trivial"
@@ -31,6 +33,7 @@ import (
 
 func main() {
 	logg.ShowDebug = osext.GetenvBool("KEPPEL_DEBUG")
+	keppel.SetupLogging()
 	undoMaxprocs := must.Return(maxprocs.Set(maxprocs.Logger(logg.Debug)))
 	defer undoMaxprocs()
 	keppel.SetupHTTPClient()